@@ -0,0 +1,193 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+)
+
+// acmPCASubordinateTemplateARN is the ACM-PCA template used to issue
+// intermediate CA certificates.
+const acmPCASubordinateTemplateARN = "arn:aws:acm-pca:::template/SubordinateCACertificate_PathLen0/V1"
+
+// ACMPCASigner is a Signer that delegates signing to AWS Private CA
+// (ACM-PCA), so that certificates issued by the depot chain to an ACM-PCA
+// hierarchy. The depot still stores and distributes the signed certificates;
+// the ACM-PCA CA's certificate should be stored in the depot under the
+// depot's CA name or imported with ImportTrustedCA so that clients can verify
+// them.
+type ACMPCASigner struct {
+	// CertificateAuthorityARN is the ARN of the private CA that signs
+	// certificates.
+	CertificateAuthorityARN string
+	// Region is the AWS region of the private CA.
+	Region string
+	// Credentials are used to sign requests to AWS. If unset, they are read
+	// from the environment.
+	Credentials AWSCredentials
+	// TemplateARN is the ACM-PCA template used to issue certificates that
+	// are not intermediate CAs. If unset, ACM-PCA's default end entity
+	// template is used.
+	TemplateARN string
+	// PollInterval is how often to check whether an issued certificate is
+	// ready. It defaults to one second.
+	PollInterval time.Duration
+	// Endpoint overrides the ACM-PCA endpoint for the region.
+	Endpoint string
+	// Client is the HTTP client used to make requests. If nil, a client
+	// with a default timeout is used.
+	Client *http.Client
+}
+
+type acmPCAValidity struct {
+	Type  string `json:"Type"`
+	Value int64  `json:"Value"`
+}
+
+type acmPCAIssueCertificateInput struct {
+	CertificateAuthorityArn string         `json:"CertificateAuthorityArn"`
+	Csr                     []byte         `json:"Csr"`
+	SigningAlgorithm        string         `json:"SigningAlgorithm"`
+	TemplateArn             string         `json:"TemplateArn,omitempty"`
+	Validity                acmPCAValidity `json:"Validity"`
+	IdempotencyToken        string         `json:"IdempotencyToken,omitempty"`
+}
+
+type acmPCAIssueCertificateOutput struct {
+	CertificateArn string `json:"CertificateArn"`
+}
+
+type acmPCAGetCertificateInput struct {
+	CertificateAuthorityArn string `json:"CertificateAuthorityArn"`
+	CertificateArn          string `json:"CertificateArn"`
+}
+
+type acmPCAGetCertificateOutput struct {
+	Certificate      string `json:"Certificate"`
+	CertificateChain string `json:"CertificateChain"`
+}
+
+// Sign issues a certificate for the request with ACM-PCA and waits for it to
+// be ready.
+func (s *ACMPCASigner) Sign(ctx context.Context, csr *pkix.CertificateSigningRequest, req IssuanceRequest) (*pkix.Certificate, error) {
+	if s.CertificateAuthorityARN == "" {
+		return nil, errors.New("must specify ACM-PCA certificate authority ARN")
+	}
+	if req.Expires <= 0 {
+		return nil, errors.New("must specify a positive expiration")
+	}
+
+	csrPEM, err := csr.Export()
+	if err != nil {
+		return nil, errors.Wrap(err, "exporting certificate signing request")
+	}
+	algorithm, err := acmPCASigningAlgorithm(csr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	input := acmPCAIssueCertificateInput{
+		CertificateAuthorityArn: s.CertificateAuthorityARN,
+		Csr:                     csrPEM,
+		SigningAlgorithm:        algorithm,
+		TemplateArn:             s.TemplateARN,
+		Validity: acmPCAValidity{
+			Type:  "ABSOLUTE",
+			Value: time.Now().Add(req.Expires).Unix(),
+		},
+	}
+	if req.Intermediate {
+		input.TemplateArn = acmPCASubordinateTemplateARN
+	}
+
+	client := s.client()
+	issued := acmPCAIssueCertificateOutput{}
+	if err = client.do(ctx, "IssueCertificate", input, &issued); err != nil {
+		return nil, errors.Wrap(err, "issuing certificate with ACM-PCA")
+	}
+
+	crtPEM, err := s.waitForCertificate(ctx, client, issued.CertificateArn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting certificate '%s' from ACM-PCA", issued.CertificateArn)
+	}
+	crt, err := pkix.NewCertificateFromPEM([]byte(crtPEM))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing certificate from ACM-PCA")
+	}
+
+	return crt, nil
+}
+
+// waitForCertificate polls ACM-PCA until the issued certificate is ready.
+func (s *ACMPCASigner) waitForCertificate(ctx context.Context, client *awsJSONClient, arn string) (string, error) {
+	interval := s.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "", errors.WithStack(ctx.Err())
+		case <-timer.C:
+		}
+
+		out := acmPCAGetCertificateOutput{}
+		err := client.do(ctx, "GetCertificate", acmPCAGetCertificateInput{
+			CertificateAuthorityArn: s.CertificateAuthorityARN,
+			CertificateArn:          arn,
+		}, &out)
+		if isAWSErrorType(err, "RequestInProgressException") {
+			timer.Reset(interval)
+			continue
+		}
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if out.Certificate == "" {
+			return "", errors.New("ACM-PCA did not return a certificate")
+		}
+
+		return out.Certificate, nil
+	}
+}
+
+func (s *ACMPCASigner) client() *awsJSONClient {
+	creds := s.Credentials
+	if creds.AccessKeyID == "" {
+		creds = AWSCredentialsFromEnv()
+	}
+
+	return &awsJSONClient{
+		service:      "acm-pca",
+		region:       s.Region,
+		endpoint:     s.Endpoint,
+		targetPrefix: "ACMPrivateCA",
+		credentials:  creds,
+		client:       s.Client,
+	}
+}
+
+// acmPCASigningAlgorithm returns the ACM-PCA signing algorithm matching the
+// CSR's key type.
+func acmPCASigningAlgorithm(csr *pkix.CertificateSigningRequest) (string, error) {
+	rawCSR, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		return "", errors.Wrap(err, "getting raw certificate signing request")
+	}
+
+	switch rawCSR.PublicKeyAlgorithm {
+	case x509.RSA:
+		return "SHA256WITHRSA", nil
+	case x509.ECDSA:
+		return "SHA256WITHECDSA", nil
+	default:
+		return "", errors.Errorf("ACM-PCA cannot sign keys of type %s", rawCSR.PublicKeyAlgorithm)
+	}
+}
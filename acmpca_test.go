@@ -0,0 +1,122 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACMPCASigner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const caARN = "arn:aws:acm-pca:us-east-1:123456789012:certificate-authority/ca"
+	caKey, err := pkix.CreateRSAKey(2048)
+	require.NoError(t, err)
+	caCrt, err := pkix.CreateCertificateAuthority(caKey, "", time.Now().Add(time.Hour), "", "", "", "", "pca-root", nil)
+	require.NoError(t, err)
+
+	key, err := pkix.CreateRSAKey(2048)
+	require.NoError(t, err)
+	csr, err := pkix.CreateCertificateSigningRequest(key, "", nil, []string{"alice.example.com"}, nil, "", "", "", "", "alice")
+	require.NoError(t, err)
+
+	creds := AWSCredentials{AccessKeyID: "id", SecretAccessKey: "secret"}
+
+	t.Run("IssuesAndWaitsForCertificate", func(t *testing.T) {
+		pending := 2
+		var issued []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "application/x-amz-json-1.1", r.Header.Get("Content-Type"))
+			assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=id/"))
+			assert.Contains(t, r.Header.Get("Authorization"), "/us-east-1/acm-pca/aws4_request")
+
+			switch r.Header.Get("X-Amz-Target") {
+			case "ACMPrivateCA.IssueCertificate":
+				input := acmPCAIssueCertificateInput{}
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+				assert.Equal(t, caARN, input.CertificateAuthorityArn)
+				assert.Equal(t, "SHA256WITHRSA", input.SigningAlgorithm)
+				assert.Equal(t, "ABSOLUTE", input.Validity.Type)
+				assert.InDelta(t, time.Now().Add(time.Hour).Unix(), input.Validity.Value, 60)
+				assert.Empty(t, input.TemplateArn)
+
+				reqCSR, err := pkix.NewCertificateSigningRequestFromPEM(input.Csr)
+				require.NoError(t, err)
+				crt, err := pkix.CreateCertificateHost(caCrt, caKey, reqCSR, time.Now().Add(time.Hour))
+				require.NoError(t, err)
+				issued, err = crt.Export()
+				require.NoError(t, err)
+
+				assert.NoError(t, json.NewEncoder(w).Encode(acmPCAIssueCertificateOutput{CertificateArn: caARN + "/certificate/1"}))
+			case "ACMPrivateCA.GetCertificate":
+				input := acmPCAGetCertificateInput{}
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+				assert.Equal(t, caARN+"/certificate/1", input.CertificateArn)
+				if pending > 0 {
+					pending--
+					w.WriteHeader(http.StatusBadRequest)
+					_, err := w.Write([]byte(`{"__type": "RequestInProgressException", "message": "pending"}`))
+					assert.NoError(t, err)
+					return
+				}
+				assert.NoError(t, json.NewEncoder(w).Encode(acmPCAGetCertificateOutput{Certificate: string(issued)}))
+			default:
+				t.Errorf("unexpected target '%s'", r.Header.Get("X-Amz-Target"))
+			}
+		}))
+		defer srv.Close()
+
+		signer := &ACMPCASigner{
+			CertificateAuthorityARN: caARN,
+			Region:                  "us-east-1",
+			Credentials:             creds,
+			PollInterval:            time.Millisecond,
+			Endpoint:                srv.URL,
+		}
+		crt, err := signer.Sign(ctx, csr, IssuanceRequest{Name: "alice", Expires: time.Hour})
+		require.NoError(t, err)
+		rawCrt, err := crt.GetRawCertificate()
+		require.NoError(t, err)
+		assert.Equal(t, "alice", rawCrt.Subject.CommonName)
+		assert.Equal(t, "pca-root", rawCrt.Issuer.CommonName)
+		assert.Zero(t, pending)
+	})
+	t.Run("UsesSubordinateTemplateForIntermediates", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			input := acmPCAIssueCertificateInput{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+			assert.Equal(t, acmPCASubordinateTemplateARN, input.TemplateArn)
+			w.WriteHeader(http.StatusBadRequest)
+			_, err := w.Write([]byte(`{"__type": "LimitExceededException", "message": "limit"}`))
+			assert.NoError(t, err)
+		}))
+		defer srv.Close()
+
+		signer := &ACMPCASigner{
+			CertificateAuthorityARN: caARN,
+			Region:                  "us-east-1",
+			Credentials:             creds,
+			Endpoint:                srv.URL,
+		}
+		_, err := signer.Sign(ctx, csr, IssuanceRequest{Name: "alice", Intermediate: true, Expires: time.Hour})
+		require.Error(t, err)
+		assert.True(t, isAWSErrorType(err, "LimitExceededException"))
+	})
+	t.Run("FailsWithoutConfiguration", func(t *testing.T) {
+		_, err := (&ACMPCASigner{Region: "us-east-1", Credentials: creds}).Sign(ctx, csr, IssuanceRequest{Expires: time.Hour})
+		assert.Error(t, err)
+		_, err = (&ACMPCASigner{CertificateAuthorityARN: caARN, Credentials: creds}).Sign(ctx, csr, IssuanceRequest{Expires: time.Hour})
+		assert.Error(t, err)
+		_, err = (&ACMPCASigner{CertificateAuthorityARN: caARN, Region: "us-east-1", Credentials: creds}).Sign(ctx, csr, IssuanceRequest{})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,352 @@
+package certdepot
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+const (
+	// aliasParam is the parameter of an alias that holds the name it
+	// refers to.
+	aliasParam = "alias"
+	// aliasesParam is the parameter of a name that holds its aliases.
+	aliasesParam = "aliases"
+	// aliasLockName is the lock held while aliases change.
+	aliasLockName = "certdepot_aliases"
+)
+
+// AliasLockTTL is how long an aliasing depot holds the alias lock while
+// adding or removing aliases before other processes consider it abandoned.
+var AliasLockTTL = time.Minute
+
+// aliasDepot is a Depot that resolves aliases to the names they refer to.
+type aliasDepot struct {
+	inner Depot
+	// mu serializes changes to aliases within the process; the alias lock
+	// serializes them across processes.
+	mu sync.Mutex
+}
+
+// NewAliasingDepot returns a handle to the depot that supports aliases (see
+// AddAlias), so that the same credentials can be found under several names,
+// such as a host's ID and its DNS name, without storing them more than once.
+// Every operation on an alias, including Get, Find, Save, and Delete, applies
+// to the credentials of the name it refers to, so the alias never has a copy
+// that differs from the name's. Aliases are kept when the name's credentials
+// are deleted, so that they survive the credentials being re-issued, and
+// until then behave as the name does; use RemoveAlias to remove them.
+func NewAliasingDepot(inner Depot) (Depot, error) {
+	if inner == nil {
+		return nil, errors.New("must specify depot")
+	}
+
+	return &aliasDepot{inner: inner}, nil
+}
+
+// target returns the name the alias refers to and whether the name is an
+// alias.
+func (a *aliasDepot) target(alias string) (string, bool, error) {
+	data, exists, err := GetIfExists(a.inner, ParamTag(alias, aliasParam))
+	if err != nil {
+		return "", false, errors.Wrapf(err, "getting alias '%s'", alias)
+	}
+	if !exists {
+		return "", false, nil
+	}
+	return string(data), true, nil
+}
+
+// resolve returns the tag with its name replaced by the name it refers to, if
+// the name is an alias.
+func (a *aliasDepot) resolve(tag *depot.Tag) (*depot.Tag, error) {
+	if name, param := GetNameFromParamTag(tag); name != "" {
+		if param == aliasParam || param == aliasesParam {
+			return tag, nil
+		}
+		target, isAlias, err := a.target(name)
+		if err != nil || !isAlias {
+			return tag, errors.WithStack(err)
+		}
+		return ParamTag(target, param), nil
+	}
+
+	name, kind, err := ParseTag(tag)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	target, isAlias, err := a.target(name)
+	if err != nil || !isAlias {
+		return tag, errors.WithStack(err)
+	}
+	return kind.Tag(target)
+}
+
+func (a *aliasDepot) Put(tag *depot.Tag, data []byte) error {
+	resolved, err := a.resolve(tag)
+	if err != nil {
+		return err
+	}
+	return a.inner.Put(resolved, data)
+}
+
+func (a *aliasDepot) Check(tag *depot.Tag) bool {
+	exists, _ := a.CheckWithError(tag)
+	return exists
+}
+
+func (a *aliasDepot) CheckWithError(tag *depot.Tag) (bool, error) {
+	resolved, err := a.resolve(tag)
+	if err != nil {
+		return false, err
+	}
+	return a.inner.CheckWithError(resolved)
+}
+
+func (a *aliasDepot) Get(tag *depot.Tag) ([]byte, error) {
+	resolved, err := a.resolve(tag)
+	if err != nil {
+		return nil, err
+	}
+	return a.inner.Get(resolved)
+}
+
+func (a *aliasDepot) GetIfExists(tag *depot.Tag) ([]byte, bool, error) {
+	resolved, err := a.resolve(tag)
+	if err != nil {
+		return nil, false, err
+	}
+	return GetIfExists(a.inner, resolved)
+}
+
+func (a *aliasDepot) Delete(tag *depot.Tag) error {
+	resolved, err := a.resolve(tag)
+	if err != nil {
+		return err
+	}
+	return a.inner.Delete(resolved)
+}
+
+func (a *aliasDepot) Save(name string, creds *Credentials) error {
+	return depotSave(a, name, creds)
+}
+
+func (a *aliasDepot) Find(name string) (*Credentials, error) {
+	return depotFind(a, name, a.DepotOptions())
+}
+
+func (a *aliasDepot) Generate(name string) (*Credentials, error) {
+	return depotGenerateDefault(a, name, a.DepotOptions())
+}
+
+func (a *aliasDepot) GenerateWithOptions(opts CertificateOptions) (*Credentials, error) {
+	return depotGenerate(a, opts.CommonName, a.DepotOptions(), opts)
+}
+
+// DepotOptions returns the inner depot's options.
+func (a *aliasDepot) DepotOptions() DepotOptions { return getDepotOptions(a.inner) }
+
+// ListNames returns the names in the inner depot, which must implement
+// NameLister, except for aliases.
+func (a *aliasDepot) ListNames() ([]string, error) {
+	lister, ok := a.inner.(NameLister)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not support listing entries", a.inner)
+	}
+	names, err := lister.ListNames()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	filtered := []string{}
+	for _, name := range names {
+		_, isAlias, err := a.target(name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !isAlias {
+			filtered = append(filtered, name)
+		}
+	}
+
+	return filtered, nil
+}
+
+// withAliasLock calls fn while holding the alias lock.
+func (a *aliasDepot) withAliasLock(fn func() error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return withLock(depotContext(a.inner), a.inner, aliasLockName, AliasLockTTL, fn)
+}
+
+// AddAlias makes the alias refer to the name. If the name is itself an alias,
+// the alias refers to the name it refers to. It returns an error if the name
+// does not have a certificate, if the alias has credentials of its own, or if
+// the alias already refers to another name.
+func (a *aliasDepot) AddAlias(name, alias string) error {
+	name, err := canonicalName(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	alias, err = canonicalName(alias)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return a.withAliasLock(func() error {
+		if target, isAlias, err := a.target(name); err != nil {
+			return errors.WithStack(err)
+		} else if isAlias {
+			name = target
+		}
+		if name == alias {
+			return errors.Errorf("'%s' cannot be an alias of itself", alias)
+		}
+		exists, err := CheckCertificateWithError(a.inner, name)
+		if err != nil {
+			return errors.Wrapf(err, "checking certificate for '%s'", name)
+		}
+		if !exists {
+			return errors.Errorf("certificate for '%s' does not exist", name)
+		}
+
+		target, isAlias, err := a.target(alias)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if isAlias {
+			if target == name {
+				return nil
+			}
+			return errors.Errorf("'%s' is already an alias of '%s'", alias, target)
+		}
+		for _, tag := range []*depot.Tag{CrtTag(alias), PrivKeyTag(alias), ParamTag(alias, aliasesParam)} {
+			exists, err := a.inner.CheckWithError(tag)
+			if err != nil {
+				return errors.Wrapf(err, "checking for credentials of '%s'", alias)
+			}
+			if exists {
+				return errors.Errorf("'%s' has its own credentials or aliases", alias)
+			}
+		}
+
+		aliases, err := a.aliases(name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err = a.putAliases(name, append(aliases, alias)); err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.Wrapf(a.inner.Put(ParamTag(alias, aliasParam), []byte(name)), "saving alias '%s'", alias)
+	})
+}
+
+// RemoveAlias removes the alias without changing the credentials of the name
+// it refers to.
+func (a *aliasDepot) RemoveAlias(alias string) error {
+	alias, err := canonicalName(alias)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return a.withAliasLock(func() error {
+		target, isAlias, err := a.target(alias)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !isAlias {
+			return errors.Errorf("'%s' is not an alias", alias)
+		}
+
+		aliases, err := a.aliases(target)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		remaining := []string{}
+		for _, existing := range aliases {
+			if existing != alias {
+				remaining = append(remaining, existing)
+			}
+		}
+		if err = a.putAliases(target, remaining); err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.Wrapf(deleteIfExists(a.inner, ParamTag(alias, aliasParam)), "deleting alias '%s'", alias)
+	})
+}
+
+// GetAliases returns the aliases that refer to the name.
+func (a *aliasDepot) GetAliases(name string) ([]string, error) {
+	name, err := canonicalName(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return a.aliases(name)
+}
+
+// aliases returns the sorted aliases that refer to the name.
+func (a *aliasDepot) aliases(name string) ([]string, error) {
+	data, exists, err := GetIfExists(a.inner, ParamTag(name, aliasesParam))
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting aliases of '%s'", name)
+	}
+	aliases := []string{}
+	if !exists {
+		return aliases, nil
+	}
+	if err = json.Unmarshal(data, &aliases); err != nil {
+		return nil, errors.Wrapf(err, "parsing aliases of '%s'", name)
+	}
+	return aliases, nil
+}
+
+// putAliases replaces the aliases that refer to the name.
+func (a *aliasDepot) putAliases(name string, aliases []string) error {
+	tag := ParamTag(name, aliasesParam)
+	if err := deleteIfExists(a.inner, tag); err != nil {
+		return errors.Wrapf(err, "deleting aliases of '%s'", name)
+	}
+	if len(aliases) == 0 {
+		return nil
+	}
+	sort.Strings(aliases)
+	data, err := json.Marshal(aliases)
+	if err != nil {
+		return errors.Wrapf(err, "marshalling aliases of '%s'", name)
+	}
+	return errors.Wrapf(a.inner.Put(tag, data), "saving aliases of '%s'", name)
+}
+
+// AddAlias makes the alias refer to the name in the depot, which must
+// support aliases (see NewAliasingDepot).
+func AddAlias(wd Depot, name, alias string) error {
+	aliaser, ok := wd.(Aliaser)
+	if !ok {
+		return errors.Errorf("depot of type %T does not support aliases", wd)
+	}
+	return aliaser.AddAlias(name, alias)
+}
+
+// RemoveAlias removes the alias from the depot, which must support aliases
+// (see NewAliasingDepot).
+func RemoveAlias(wd Depot, alias string) error {
+	aliaser, ok := wd.(Aliaser)
+	if !ok {
+		return errors.Errorf("depot of type %T does not support aliases", wd)
+	}
+	return aliaser.RemoveAlias(alias)
+}
+
+// GetAliases returns the aliases that refer to the name in the depot, which
+// must support aliases (see NewAliasingDepot).
+func GetAliases(wd Depot, name string) ([]string, error) {
+	aliaser, ok := wd.(Aliaser)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not support aliases", wd)
+	}
+	return aliaser.GetAliases(name)
+}
@@ -0,0 +1,150 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AttestationEvidence is evidence supplied by the requester of a certificate
+// that proves the identity of the host the certificate is for, such as a
+// cloud instance identity document or a TPM quote.
+type AttestationEvidence struct {
+	// Type identifies the kind of evidence, such as
+	// AWSInstanceIdentityEvidence.
+	Type string `bson:"type" json:"type" yaml:"type"`
+	// Document is the attested document.
+	Document []byte `bson:"document" json:"document" yaml:"document"`
+	// Signature is the signature over the document.
+	Signature []byte `bson:"signature,omitempty" json:"signature,omitempty" yaml:"signature,omitempty"`
+}
+
+// Attestor verifies the evidence supplied by the requester of a certificate
+// before the certificate is issued. Attest returns a non-nil error to deny
+// issuance.
+type Attestor interface {
+	Attest(context.Context, IssuanceRequest, *AttestationEvidence) error
+}
+
+// AttestorFunc adapts a function into an Attestor.
+type AttestorFunc func(context.Context, IssuanceRequest, *AttestationEvidence) error
+
+// Attest calls the underlying function.
+func (f AttestorFunc) Attest(ctx context.Context, req IssuanceRequest, evidence *AttestationEvidence) error {
+	return f(ctx, req, evidence)
+}
+
+// attestIssuance consults the depot's configured Attestor, if any, before the
+// certificate described by the request is signed. Issuance is denied if the
+// depot has an Attestor and no evidence is supplied.
+func attestIssuance(wd Depot, req IssuanceRequest, evidence *AttestationEvidence) error {
+	attestor := getDepotOptions(wd).Attestor
+	if attestor == nil {
+		return nil
+	}
+	if evidence == nil {
+		return errors.Errorf("issuance of '%s' requires attestation evidence", req.Name)
+	}
+
+	return attestor.Attest(depotContext(wd), req, evidence)
+}
+
+// AWSInstanceIdentityEvidence is the type of evidence containing an EC2
+// instance identity document and its signature.
+const AWSInstanceIdentityEvidence = "aws-instance-identity"
+
+// AWSInstanceIdentityDocument is the EC2 instance identity document, as
+// returned by the instance metadata service at
+// /latest/dynamic/instance-identity/document.
+type AWSInstanceIdentityDocument struct {
+	AccountID        string    `json:"accountId"`
+	InstanceID       string    `json:"instanceId"`
+	InstanceType     string    `json:"instanceType"`
+	ImageID          string    `json:"imageId"`
+	Region           string    `json:"region"`
+	AvailabilityZone string    `json:"availabilityZone"`
+	PrivateIP        string    `json:"privateIp"`
+	PendingTime      time.Time `json:"pendingTime"`
+}
+
+// AWSInstanceIdentityAttestor is an Attestor that verifies EC2 instance
+// identity documents. The evidence must contain the document and the
+// base64-decoded SHA256 with RSA signature over it, as returned by the
+// instance metadata service at /latest/dynamic/instance-identity/signature.
+// Issuance is only allowed for names that belong to the instance.
+type AWSInstanceIdentityAttestor struct {
+	// Certificates are the AWS public certificates used to verify the
+	// signatures of instance identity documents in the allowed regions
+	// (required).
+	Certificates []*x509.Certificate
+	// AccountIDs are the AWS accounts whose instances may request
+	// certificates. If empty, instances in any account may request
+	// certificates.
+	AccountIDs []string
+	// Regions are the regions whose instances may request certificates.
+	// If empty, instances in any region may request certificates.
+	Regions []string
+	// AllowedNames returns the names that the instance may request in the
+	// common name and subject alt names of its certificate. If nil, the
+	// instance may only request its instance ID and private IP address.
+	AllowedNames func(AWSInstanceIdentityDocument) []string
+}
+
+// Attest verifies the instance identity document in the evidence and checks
+// that every name in the issuance request belongs to the instance.
+func (a *AWSInstanceIdentityAttestor) Attest(ctx context.Context, req IssuanceRequest, evidence *AttestationEvidence) error {
+	if evidence.Type != AWSInstanceIdentityEvidence {
+		return errors.Errorf("evidence of type '%s' is not an AWS instance identity document", evidence.Type)
+	}
+	if len(a.Certificates) == 0 {
+		return errors.New("must specify AWS certificates to verify instance identity documents")
+	}
+
+	verified := false
+	for _, crt := range a.Certificates {
+		if crt.CheckSignature(x509.SHA256WithRSA, evidence.Document, evidence.Signature) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("instance identity document signature is invalid")
+	}
+
+	doc := AWSInstanceIdentityDocument{}
+	if err := json.Unmarshal(evidence.Document, &doc); err != nil {
+		return errors.Wrap(err, "unmarshalling instance identity document")
+	}
+	if len(a.AccountIDs) != 0 && !containsString(a.AccountIDs, doc.AccountID) {
+		return errors.Errorf("instance account '%s' is not allowed", doc.AccountID)
+	}
+	if len(a.Regions) != 0 && !containsString(a.Regions, doc.Region) {
+		return errors.Errorf("instance region '%s' is not allowed", doc.Region)
+	}
+
+	allowed := []string{doc.InstanceID, doc.PrivateIP}
+	if a.AllowedNames != nil {
+		allowed = a.AllowedNames(doc)
+	}
+	requested := append([]string{req.CommonName}, req.Domain...)
+	requested = append(requested, req.IP...)
+	for _, name := range requested {
+		if name != "" && !containsString(allowed, name) {
+			return errors.Errorf("instance '%s' is not allowed to request a certificate for '%s'", doc.InstanceID, name)
+		}
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
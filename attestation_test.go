@@ -0,0 +1,133 @@
+package certdepot
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSInstanceIdentityAttestor(t *testing.T) {
+	awsKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "aws"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &awsKey.PublicKey, awsKey)
+	require.NoError(t, err)
+	awsCrt, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	newEvidence := func(t *testing.T, doc AWSInstanceIdentityDocument) *AttestationEvidence {
+		data, err := json.Marshal(doc)
+		require.NoError(t, err)
+		digest := sha256.Sum256(data)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, awsKey, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+		return &AttestationEvidence{Type: AWSInstanceIdentityEvidence, Document: data, Signature: sig}
+	}
+	doc := AWSInstanceIdentityDocument{
+		AccountID:  "123456789012",
+		InstanceID: "i-0123456789abcdef0",
+		Region:     "us-east-1",
+		PrivateIP:  "10.0.0.1",
+	}
+
+	tempDir, err := ioutil.TempDir(".", "attestation-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	attestor := &AWSInstanceIdentityAttestor{
+		Certificates: []*x509.Certificate{awsCrt},
+		AccountIDs:   []string{"123456789012"},
+	}
+	d, err := MakeFileDepot(tempDir, DepotOptions{
+		CA:                "root",
+		DefaultExpiration: time.Hour,
+		Attestor:          attestor,
+	})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d), "root CAs are not attested")
+
+	generate := func(evidence *AttestationEvidence, ip ...string) error {
+		_, err := d.GenerateWithOptions(CertificateOptions{
+			CommonName: doc.InstanceID,
+			Host:       doc.InstanceID,
+			IP:         ip,
+			Evidence:   evidence,
+		})
+		return err
+	}
+
+	t.Run("IssuesWithValidEvidence", func(t *testing.T) {
+		assert.NoError(t, generate(newEvidence(t, doc), doc.PrivateIP))
+	})
+	t.Run("DeniesWithoutEvidence", func(t *testing.T) {
+		assert.Error(t, generate(nil))
+		_, err := d.Generate(doc.InstanceID)
+		assert.Error(t, err)
+	})
+	t.Run("DeniesWithInvalidSignature", func(t *testing.T) {
+		evidence := newEvidence(t, doc)
+		evidence.Signature[0] ^= 0xff
+		assert.Error(t, generate(evidence))
+	})
+	t.Run("DeniesWithWrongEvidenceType", func(t *testing.T) {
+		evidence := newEvidence(t, doc)
+		evidence.Type = "tpm-quote"
+		assert.Error(t, generate(evidence))
+	})
+	t.Run("DeniesOtherAccount", func(t *testing.T) {
+		other := doc
+		other.AccountID = "210987654321"
+		assert.Error(t, generate(newEvidence(t, other)))
+	})
+	t.Run("DeniesNamesNotBelongingToInstance", func(t *testing.T) {
+		assert.Error(t, generate(newEvidence(t, doc), "10.0.0.2"))
+
+		other := doc
+		other.InstanceID = "i-fedcba9876543210f"
+		assert.Error(t, generate(newEvidence(t, other)))
+	})
+	t.Run("AllowsCustomNames", func(t *testing.T) {
+		attestor.AllowedNames = func(doc AWSInstanceIdentityDocument) []string {
+			return []string{doc.InstanceID, doc.PrivateIP, "10.0.0.2"}
+		}
+		defer func() { attestor.AllowedNames = nil }()
+		assert.NoError(t, generate(newEvidence(t, doc), "10.0.0.2"))
+	})
+	t.Run("ConsultsCustomAttestor", func(t *testing.T) {
+		var attested IssuanceRequest
+		custom := AttestorFunc(func(_ context.Context, req IssuanceRequest, evidence *AttestationEvidence) error {
+			attested = req
+			assert.Equal(t, "tpm-quote", evidence.Type)
+			return nil
+		})
+		customDepot, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour, Attestor: custom})
+		require.NoError(t, err)
+		_, err = customDepot.GenerateWithOptions(CertificateOptions{
+			CommonName: "alice",
+			Host:       "alice",
+			Evidence:   &AttestationEvidence{Type: "tpm-quote"},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "alice", attested.Name)
+	})
+}
@@ -0,0 +1,234 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AWSCredentials are the credentials used to sign requests to AWS services.
+type AWSCredentials struct {
+	AccessKeyID     string `bson:"access_key_id" json:"access_key_id" yaml:"access_key_id"`
+	SecretAccessKey string `bson:"secret_access_key" json:"secret_access_key" yaml:"secret_access_key"`
+	SessionToken    string `bson:"session_token,omitempty" json:"session_token,omitempty" yaml:"session_token,omitempty"`
+}
+
+// AWSCredentialsFromEnv returns the AWS credentials set in the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment
+// variables.
+func AWSCredentialsFromEnv() AWSCredentials {
+	return AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// Validate checks that the credentials are set.
+func (c AWSCredentials) Validate() error {
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return errors.New("must specify AWS access key ID and secret access key")
+	}
+	return nil
+}
+
+// awsError is an error returned by an AWS JSON API.
+type awsError struct {
+	StatusCode int
+	Type       string `json:"__type"`
+	Message    string `json:"message"`
+}
+
+func (e *awsError) Error() string {
+	return fmt.Sprintf("AWS returned status %d: %s: %s", e.StatusCode, e.Type, e.Message)
+}
+
+// isAWSErrorType returns whether the error was returned by an AWS JSON API
+// with the given exception type.
+func isAWSErrorType(err error, exceptionType string) bool {
+	awsErr, ok := errors.Cause(err).(*awsError)
+	if !ok {
+		return false
+	}
+	// The type may be qualified with a namespace, e.g.
+	// "com.amazonaws.acmpca#RequestInProgressException".
+	return awsErr.Type == exceptionType || strings.HasSuffix(awsErr.Type, "#"+exceptionType)
+}
+
+// awsJSONClient makes requests to an AWS API that uses the JSON 1.1
+// protocol.
+type awsJSONClient struct {
+	service      string
+	region       string
+	endpoint     string
+	targetPrefix string
+	credentials  AWSCredentials
+	client       *http.Client
+}
+
+// do calls the target action with the input and unmarshals the response into
+// the output.
+func (c *awsJSONClient) do(ctx context.Context, action string, input, output interface{}) error {
+	if err := c.credentials.Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+	if c.region == "" {
+		return errors.New("must specify AWS region")
+	}
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		return errors.Wrap(err, "marshalling request body")
+	}
+
+	endpoint := c.endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com/", c.service, c.region)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", c.targetPrefix+"."+action)
+	signAWSRequest(req, body, c.credentials, c.region, c.service, time.Now())
+
+	client := c.client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "making request")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "reading response body")
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		awsErr := &awsError{}
+		if err = json.Unmarshal(respBody, awsErr); err != nil || awsErr.Type == "" {
+			return errors.Errorf("request returned status %d: %s", resp.StatusCode, string(respBody))
+		}
+		awsErr.StatusCode = resp.StatusCode
+		return errors.WithStack(awsErr)
+	}
+	if output == nil {
+		return nil
+	}
+
+	return errors.Wrap(json.Unmarshal(respBody, output), "unmarshalling response body")
+}
+
+// signAWSRequest signs the request with AWS Signature Version 4. Every header
+// already set on the request is signed, along with the host.
+func signAWSRequest(req *http.Request, body []byte, creds AWSCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if key == "authorization" {
+			continue
+		}
+		trimmed := make([]string, 0, len(values))
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		headers[key] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalAWSQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalAWSQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(key)+"="+awsURIEncode(value))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode encodes the string as required by AWS Signature Version 4,
+// which differs from url.QueryEscape in how it encodes spaces and '~'.
+func awsURIEncode(s string) string {
+	return strings.Replace(strings.Replace(url.QueryEscape(s), "+", "%20", -1), "%7E", "~", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,522 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// azureKeyVaultAPIVersion is the version of the Key Vault REST API the
+	// depot uses.
+	azureKeyVaultAPIVersion = "7.4"
+	// azureKeyVaultResource is the resource that tokens for Key Vault are
+	// requested for.
+	azureKeyVaultResource = "https://vault.azure.net"
+	// azureIMDSTokenEndpoint is the Azure Instance Metadata Service
+	// endpoint that issues tokens for a VM's managed identity.
+	azureIMDSTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// azureDefaultAuthorityHost is the Microsoft Entra ID host that issues
+	// tokens for service principals.
+	azureDefaultAuthorityHost = "https://login.microsoftonline.com"
+	// azurePEMContentType is the content type of secrets holding PEM data.
+	azurePEMContentType = "application/x-pem-file"
+	// azureBase64ContentType is the content type of secrets holding
+	// base64-encoded binary data.
+	azureBase64ContentType = "application/octet-stream;base64"
+	// azureMaxSecretNameLength is the maximum length of a secret name.
+	azureMaxSecretNameLength = 127
+)
+
+// AzureKeyVaultOptions describe how an Azure Key Vault depot connects to Key
+// Vault and authenticates.
+type AzureKeyVaultOptions struct {
+	// VaultURL is the URL of the key vault, e.g.
+	// "https://my-vault.vault.azure.net".
+	VaultURL string `bson:"vault_url" json:"vault_url" yaml:"vault_url"`
+	// Prefix is prepended to the name of every secret the depot stores. It
+	// defaults to "certdepot".
+	Prefix string `bson:"prefix,omitempty" json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	// TenantID, ClientID, and ClientSecret are the credentials of a service
+	// principal. If ClientSecret is unset, the managed identity of the
+	// host is used instead.
+	TenantID     string `bson:"tenant_id,omitempty" json:"tenant_id,omitempty" yaml:"tenant_id,omitempty"`
+	ClientID     string `bson:"client_id,omitempty" json:"client_id,omitempty" yaml:"client_id,omitempty"`
+	ClientSecret string `bson:"client_secret,omitempty" json:"client_secret,omitempty" yaml:"client_secret,omitempty"`
+	// ManagedIdentityEndpoint overrides the endpoint that issues tokens
+	// for the managed identity. If unset, the endpoint in the
+	// IDENTITY_ENDPOINT environment variable is used on App Service and
+	// Functions, and the Instance Metadata Service is used elsewhere.
+	ManagedIdentityEndpoint string `bson:"managed_identity_endpoint,omitempty" json:"managed_identity_endpoint,omitempty" yaml:"managed_identity_endpoint,omitempty"`
+	// AuthorityHost overrides the host that issues tokens for service
+	// principals, such as for sovereign clouds.
+	AuthorityHost string `bson:"authority_host,omitempty" json:"authority_host,omitempty" yaml:"authority_host,omitempty"`
+	// Client is the HTTP client used to make requests. If nil, a client
+	// with a default timeout is used.
+	Client *http.Client `bson:"-" json:"-" yaml:"-"`
+}
+
+// Validate checks that the options are valid and sets defaults.
+func (o *AzureKeyVaultOptions) Validate() error {
+	if o.VaultURL == "" {
+		return errors.New("must specify key vault URL")
+	}
+	if _, err := url.Parse(o.VaultURL); err != nil {
+		return errors.Wrap(err, "parsing key vault URL")
+	}
+	o.VaultURL = strings.TrimSuffix(o.VaultURL, "/")
+	if o.ClientSecret != "" && (o.TenantID == "" || o.ClientID == "") {
+		return errors.New("must specify tenant ID and client ID with client secret")
+	}
+	if o.Prefix == "" {
+		o.Prefix = "certdepot"
+	}
+	for _, c := range o.Prefix {
+		if !isAzureSecretNameChar(c) {
+			return errors.Errorf("prefix '%s' may only contain letters, digits, and hyphens", o.Prefix)
+		}
+	}
+	if o.AuthorityHost == "" {
+		o.AuthorityHost = azureDefaultAuthorityHost
+	}
+	o.AuthorityHost = strings.TrimSuffix(o.AuthorityHost, "/")
+
+	return nil
+}
+
+// azureError is an error returned by Azure.
+type azureError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *azureError) Error() string {
+	return fmt.Sprintf("Azure returned status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// isAzureStatus returns whether the error was returned by Azure with the given
+// status code.
+func isAzureStatus(err error, code int) bool {
+	azureErr, ok := errors.Cause(err).(*azureError)
+	return ok && azureErr.StatusCode == code
+}
+
+// azureSeconds is a number of seconds, which Azure token endpoints return as
+// either a JSON number or a string.
+type azureSeconds int64
+
+func (s *azureSeconds) UnmarshalJSON(data []byte) error {
+	seconds, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "parsing seconds")
+	}
+	*s = azureSeconds(seconds)
+	return nil
+}
+
+type azureToken struct {
+	AccessToken string       `json:"access_token"`
+	ExpiresIn   azureSeconds `json:"expires_in"`
+}
+
+type azureSecret struct {
+	Value       string `json:"value"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+type azureSecretList struct {
+	Value []struct {
+		ID string `json:"id"`
+	} `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+// azureKeyVaultStore is a CredentialStore backed by Azure Key Vault secrets.
+// Each kind of data for a name is a separate secret.
+type azureKeyVaultStore struct {
+	ctx  context.Context
+	opts AzureKeyVaultOptions
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewAzureKeyVaultDepot returns a depot that stores certificates, keys,
+// certificate requests, and revocation lists as secrets in Azure Key Vault,
+// authenticating with a service principal or the host's managed identity.
+// Data is stored as PEM-encoded secrets rather than Key Vault certificates,
+// since the depot stores the kinds of data for a name separately. Requests
+// to Azure are made with the context.
+//
+// Deleted secrets are purged, so the key vault must not have purge protection
+// enabled, and the identity must be allowed to get, list, set, delete, and
+// purge secrets.
+func NewAzureKeyVaultDepot(ctx context.Context, opts AzureKeyVaultOptions, depotOpts DepotOptions) (Depot, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid Azure Key Vault options")
+	}
+
+	store := &azureKeyVaultStore{ctx: ctx, opts: opts}
+	if _, err := store.getToken(); err != nil {
+		return nil, errors.Wrap(err, "authenticating to Azure")
+	}
+
+	return NewStoreDepot(store, depotOpts)
+}
+
+func (s *azureKeyVaultStore) Get(name string, kind CredentialKind) ([]byte, error) {
+	secret := azureSecret{}
+	if err := s.do(http.MethodGet, s.secretURL("secrets", name, kind), nil, &secret); err != nil {
+		if isAzureStatus(err, http.StatusNotFound) {
+			return nil, errors.Errorf("%s for '%s' not found", kind, name)
+		}
+		return nil, errors.Wrapf(err, "getting %s for '%s'", kind, name)
+	}
+
+	if secret.ContentType == azureBase64ContentType {
+		data, err := base64.StdEncoding.DecodeString(secret.Value)
+		return data, errors.Wrapf(err, "decoding %s for '%s'", kind, name)
+	}
+	return []byte(secret.Value), nil
+}
+
+func (s *azureKeyVaultStore) Put(name string, kind CredentialKind, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+
+	secretName := s.secretName(name, kind)
+	if len(secretName) > azureMaxSecretNameLength {
+		return errors.Errorf("name '%s' is too long to store in Azure Key Vault", name)
+	}
+
+	secret := azureSecret{Value: string(data), ContentType: azurePEMContentType}
+	if !utf8.Valid(data) {
+		secret = azureSecret{Value: base64.StdEncoding.EncodeToString(data), ContentType: azureBase64ContentType}
+	}
+
+	return errors.Wrapf(s.do(http.MethodPut, s.secretURL("secrets", name, kind), secret, nil), "setting %s for '%s'", kind, name)
+}
+
+func (s *azureKeyVaultStore) Check(name string, kind CredentialKind) (bool, error) {
+	err := s.do(http.MethodGet, s.secretURL("secrets", name, kind), nil, &azureSecret{})
+	if isAzureStatus(err, http.StatusNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "checking %s for '%s'", kind, name)
+	}
+	return true, nil
+}
+
+func (s *azureKeyVaultStore) Delete(name string, kind CredentialKind) error {
+	if err := s.do(http.MethodDelete, s.secretURL("secrets", name, kind), nil, nil); err != nil {
+		if isAzureStatus(err, http.StatusNotFound) {
+			return errors.Errorf("%s for '%s' not found", kind, name)
+		}
+		return errors.Wrapf(err, "deleting %s for '%s'", kind, name)
+	}
+
+	// Deleted secrets are kept until they are purged, and a secret with
+	// the same name cannot be set until then. Deletion completes in the
+	// background, so the purge is retried while it is in progress.
+	purgeURL := s.secretURL("deletedsecrets", name, kind)
+	for attempt := 0; ; attempt++ {
+		err := s.do(http.MethodDelete, purgeURL, nil, nil)
+		if isAzureStatus(err, http.StatusNotFound) {
+			// Soft-delete is disabled, so there is nothing to purge.
+			return nil
+		}
+		if err == nil || attempt >= 10 || !isAzureStatus(err, http.StatusConflict) {
+			return errors.Wrapf(err, "purging %s for '%s'", kind, name)
+		}
+
+		timer := time.NewTimer(time.Duration(attempt+1) * 100 * time.Millisecond)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return errors.Wrapf(s.ctx.Err(), "purging %s for '%s'", kind, name)
+		case <-timer.C:
+		}
+	}
+}
+
+// ListNames returns the sorted names that have secrets in the key vault.
+func (s *azureKeyVaultStore) ListNames() ([]string, error) {
+	seen := map[string]bool{}
+	names := []string{}
+	next := s.opts.VaultURL + "/secrets?api-version=" + azureKeyVaultAPIVersion
+	for next != "" {
+		list := azureSecretList{}
+		if err := s.do(http.MethodGet, next, nil, &list); err != nil {
+			return nil, errors.Wrap(err, "listing secrets")
+		}
+
+		for _, secret := range list.Value {
+			stored, _, ok := s.parseSecretName(secret.ID[strings.LastIndex(secret.ID, "/")+1:])
+			if !ok {
+				continue
+			}
+			// Parameters are stored under the name with the
+			// parameter suffix, so they belong to the name without
+			// it.
+			name := getNameFromTag(PrivKeyTag(stored))
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+		next = list.NextLink
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// secretName returns the name of the secret for the name and kind. Secret
+// names may only contain letters, digits, and hyphens, so other characters in
+// the name are escaped as a hyphen followed by two hex digits, and the kind is
+// separated from the name by two hyphens, which escaping never produces.
+func (s *azureKeyVaultStore) secretName(name string, kind CredentialKind) string {
+	escaped := &strings.Builder{}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < utf8.RuneSelf && c != '-' && isAzureSecretNameChar(rune(c)) {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(escaped, "-%02X", c)
+		}
+	}
+
+	return s.opts.Prefix + "-" + escaped.String() + "--" + strings.Replace(string(kind), "_", "", -1)
+}
+
+// parseSecretName returns the name and kind of the secret name, and whether
+// it is the name of a secret stored by the depot.
+func (s *azureKeyVaultStore) parseSecretName(secretName string) (string, CredentialKind, bool) {
+	if !strings.HasPrefix(secretName, s.opts.Prefix+"-") {
+		return "", "", false
+	}
+	secretName = strings.TrimPrefix(secretName, s.opts.Prefix+"-")
+	idx := strings.LastIndex(secretName, "--")
+	if idx < 0 {
+		return "", "", false
+	}
+
+	var kind CredentialKind
+	for _, k := range CredentialKinds {
+		if strings.Replace(string(k), "_", "", -1) == secretName[idx+2:] {
+			kind = k
+		}
+	}
+	if kind == "" {
+		return "", "", false
+	}
+
+	name := &strings.Builder{}
+	escaped := secretName[:idx]
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != '-' {
+			name.WriteByte(escaped[i])
+			continue
+		}
+		if i+2 >= len(escaped) {
+			return "", "", false
+		}
+		c, err := strconv.ParseUint(escaped[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", "", false
+		}
+		name.WriteByte(byte(c))
+		i += 2
+	}
+
+	return name.String(), kind, true
+}
+
+func isAzureSecretNameChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-'
+}
+
+// secretURL returns the URL of the secret for the name and kind in the
+// collection, either "secrets" or "deletedsecrets".
+func (s *azureKeyVaultStore) secretURL(collection, name string, kind CredentialKind) string {
+	return fmt.Sprintf("%s/%s/%s?api-version=%s", s.opts.VaultURL, collection, s.secretName(name, kind), azureKeyVaultAPIVersion)
+}
+
+// do makes an authenticated request to Key Vault, getting a new token and
+// retrying once if the token is rejected.
+func (s *azureKeyVaultStore) do(method, url string, input, output interface{}) error {
+	token, err := s.getToken()
+	if err != nil {
+		return errors.Wrap(err, "authenticating to Azure")
+	}
+	err = s.request(method, url, http.Header{"Authorization": {"Bearer " + token}}, input, output)
+	if !isAzureStatus(err, http.StatusUnauthorized) {
+		return err
+	}
+
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+	if token, err = s.getToken(); err != nil {
+		return errors.Wrap(err, "authenticating to Azure")
+	}
+	return s.request(method, url, http.Header{"Authorization": {"Bearer " + token}}, input, output)
+}
+
+// getToken returns a token for Key Vault, getting a new one if the cached
+// token is missing or about to expire.
+func (s *azureKeyVaultStore) getToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Before(s.tokenExpiry) {
+		return s.token, nil
+	}
+
+	var token azureToken
+	var err error
+	if s.opts.ClientSecret != "" {
+		token, err = s.getServicePrincipalToken()
+	} else {
+		token, err = s.getManagedIdentityToken()
+	}
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("Azure did not return a token")
+	}
+
+	s.token = token.AccessToken
+	// Get a new token shortly before this one expires so that requests in
+	// flight do not fail.
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	s.tokenExpiry = time.Now().Add(lifetime - lifetime/10)
+
+	return s.token, nil
+}
+
+// getServicePrincipalToken gets a token with the client credentials of the
+// service principal.
+func (s *azureKeyVaultStore) getServicePrincipalToken() (azureToken, error) {
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {s.opts.ClientID},
+		"client_secret": {s.opts.ClientSecret},
+		"scope":         {azureKeyVaultResource + "/.default"},
+	}
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", s.opts.AuthorityHost, url.PathEscape(s.opts.TenantID))
+
+	token := azureToken{}
+	err := s.request(http.MethodPost, tokenURL, http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}, strings.NewReader(form.Encode()), &token)
+	return token, errors.Wrap(err, "getting service principal token")
+}
+
+// getManagedIdentityToken gets a token for the host's managed identity from
+// the App Service identity endpoint or the Instance Metadata Service.
+func (s *azureKeyVaultStore) getManagedIdentityToken() (azureToken, error) {
+	query := url.Values{"resource": {azureKeyVaultResource}}
+	if s.opts.ClientID != "" {
+		query.Set("client_id", s.opts.ClientID)
+	}
+
+	header := http.Header{}
+	endpoint := s.opts.ManagedIdentityEndpoint
+	if identityEndpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint == "" && identityEndpoint != "" {
+		endpoint = identityEndpoint
+		header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+		query.Set("api-version", "2019-08-01")
+	} else {
+		if endpoint == "" {
+			endpoint = azureIMDSTokenEndpoint
+		}
+		header.Set("Metadata", "true")
+		query.Set("api-version", "2018-02-01")
+	}
+
+	token := azureToken{}
+	err := s.request(http.MethodGet, endpoint+"?"+query.Encode(), header, nil, &token)
+	return token, errors.Wrap(err, "getting managed identity token")
+}
+
+// request makes a request to Azure and unmarshals the response into the
+// output. The input is either a reader of the request body or a value that is
+// marshalled into a JSON body.
+func (s *azureKeyVaultStore) request(method, url string, header http.Header, input, output interface{}) error {
+	var body io.Reader
+	switch in := input.(type) {
+	case nil:
+	case io.Reader:
+		body = in
+	default:
+		data, err := json.Marshal(input)
+		if err != nil {
+			return errors.Wrap(err, "marshalling request body")
+		}
+		body = bytes.NewReader(data)
+		header = header.Clone()
+		header.Set("Content-Type", "application/json")
+	}
+
+	req, err := http.NewRequestWithContext(s.ctx, method, url, body)
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	client := s.opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "making request")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "reading response body")
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		errResp := struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+			// Token endpoints return OAuth errors.
+			Description string `json:"error_description"`
+		}{}
+		_ = json.Unmarshal(respBody, &errResp)
+		azureErr := &azureError{StatusCode: resp.StatusCode, Code: errResp.Error.Code, Message: errResp.Error.Message}
+		if azureErr.Message == "" {
+			azureErr.Message = errResp.Description
+		}
+		return errors.WithStack(azureErr)
+	}
+	if output == nil || len(respBody) == 0 {
+		return nil
+	}
+
+	return errors.Wrap(json.Unmarshal(respBody, output), "unmarshalling response body")
+}
@@ -0,0 +1,273 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAzureKeyVault is an in-memory Azure Key Vault that supports secrets with
+// soft-delete, along with the managed identity and service principal token
+// endpoints.
+type fakeAzureKeyVault struct {
+	mu        sync.Mutex
+	serverURL string
+	token     string
+	secrets   map[string]azureSecret
+	deleted   map[string]bool
+	tokens    int
+}
+
+func newFakeAzureKeyVault() *fakeAzureKeyVault {
+	return &fakeAzureKeyVault{secrets: map[string]azureSecret{}, deleted: map[string]bool{}}
+}
+
+func (v *fakeAzureKeyVault) writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"code": code, "message": code}})
+}
+
+func (v *fakeAzureKeyVault) issueToken(w http.ResponseWriter) {
+	v.tokens++
+	v.token = "token" + strings.Repeat("!", v.tokens)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": v.token, "expires_in": "3600"})
+}
+
+func (v *fakeAzureKeyVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/metadata/identity/oauth2/token":
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != azureKeyVaultResource {
+			v.writeError(w, http.StatusBadRequest, "invalid_request")
+			return
+		}
+		v.issueToken(w)
+		return
+	case "/tenant/oauth2/v2.0/token":
+		if r.FormValue("client_id") != "client" || r.FormValue("client_secret") != "secret" || r.FormValue("scope") != azureKeyVaultResource+"/.default" {
+			v.writeError(w, http.StatusUnauthorized, "invalid_client")
+			return
+		}
+		v.issueToken(w)
+		return
+	}
+	if r.URL.Query().Get("api-version") != azureKeyVaultAPIVersion {
+		v.writeError(w, http.StatusBadRequest, "BadParameter")
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+v.token {
+		v.writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if r.URL.Path == "/secrets" && r.Method == http.MethodGet {
+		names := []string{}
+		for name := range v.secrets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		// Return one secret per page to exercise paging.
+		start := 0
+		if skip := r.URL.Query().Get("skip"); skip != "" {
+			start = sort.SearchStrings(names, skip)
+		}
+		list := azureSecretList{}
+		if start < len(names) {
+			list.Value = append(list.Value, struct {
+				ID string `json:"id"`
+			}{ID: v.serverURL + "/secrets/" + names[start]})
+		}
+		if start+1 < len(names) {
+			list.NextLink = v.serverURL + "/secrets?api-version=" + azureKeyVaultAPIVersion + "&skip=" + names[start+1]
+		}
+		_ = json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || len(parts[1]) > azureMaxSecretNameLength {
+		v.writeError(w, http.StatusBadRequest, "BadParameter")
+		return
+	}
+	for _, c := range parts[1] {
+		if !isAzureSecretNameChar(c) {
+			v.writeError(w, http.StatusBadRequest, "BadParameter")
+			return
+		}
+	}
+	name := parts[1]
+
+	switch {
+	case parts[0] == "secrets" && r.Method == http.MethodGet:
+		secret, ok := v.secrets[name]
+		if !ok {
+			v.writeError(w, http.StatusNotFound, "SecretNotFound")
+			return
+		}
+		_ = json.NewEncoder(w).Encode(secret)
+	case parts[0] == "secrets" && r.Method == http.MethodPut:
+		if v.deleted[name] {
+			v.writeError(w, http.StatusConflict, "Conflict")
+			return
+		}
+		secret := azureSecret{}
+		if err := json.NewDecoder(r.Body).Decode(&secret); err != nil {
+			v.writeError(w, http.StatusBadRequest, "BadParameter")
+			return
+		}
+		v.secrets[name] = secret
+		_ = json.NewEncoder(w).Encode(secret)
+	case parts[0] == "secrets" && r.Method == http.MethodDelete:
+		if _, ok := v.secrets[name]; !ok {
+			v.writeError(w, http.StatusNotFound, "SecretNotFound")
+			return
+		}
+		delete(v.secrets, name)
+		v.deleted[name] = true
+		w.WriteHeader(http.StatusOK)
+	case parts[0] == "deletedsecrets" && r.Method == http.MethodDelete:
+		if !v.deleted[name] {
+			v.writeError(w, http.StatusNotFound, "SecretNotFound")
+			return
+		}
+		delete(v.deleted, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		v.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func newFakeAzureKeyVaultServer(t *testing.T) (*fakeAzureKeyVault, *httptest.Server) {
+	vault := newFakeAzureKeyVault()
+	server := httptest.NewServer(vault)
+	t.Cleanup(server.Close)
+	vault.serverURL = server.URL
+	return vault, server
+}
+
+func TestAzureKeyVaultDepot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	depotOpts := DepotOptions{CA: ConformanceSuiteCA, DefaultExpiration: time.Hour}
+
+	t.Run("Conformance", func(t *testing.T) {
+		DepotConformanceSuite(t, func() Depot {
+			_, server := newFakeAzureKeyVaultServer(t)
+			d, err := NewAzureKeyVaultDepot(ctx, AzureKeyVaultOptions{
+				VaultURL:                server.URL,
+				ManagedIdentityEndpoint: server.URL + "/metadata/identity/oauth2/token",
+			}, depotOpts)
+			require.NoError(t, err)
+			return d
+		})
+	})
+	t.Run("StoresDataAsSecrets", func(t *testing.T) {
+		vault, server := newFakeAzureKeyVaultServer(t)
+		d, err := NewAzureKeyVaultDepot(ctx, AzureKeyVaultOptions{
+			VaultURL:                server.URL,
+			Prefix:                  "certs",
+			ManagedIdentityEndpoint: server.URL + "/metadata/identity/oauth2/token",
+		}, depotOpts)
+		require.NoError(t, err)
+
+		require.NoError(t, d.Put(CrtTag("bob.example.com"), []byte("cert")))
+		require.NoError(t, d.Put(ParamTag("bob.example.com", "pass"), []byte{0xff, 0x00}))
+		require.NoError(t, d.Put(SSHCertTag("bob.example.com"), []byte("ssh")))
+
+		vault.mu.Lock()
+		assert.Equal(t, azureSecret{Value: "cert", ContentType: azurePEMContentType}, vault.secrets["certs-bob-2Eexample-2Ecom--cert"])
+		assert.Equal(t, azureBase64ContentType, vault.secrets["certs-bob-2Eexample-2Ecom-2E-2Epass--key"].ContentType)
+		assert.Contains(t, vault.secrets, "certs-bob-2Eexample-2Ecom--sshcert")
+		vault.mu.Unlock()
+
+		data, err := d.Get(ParamTag("bob.example.com", "pass"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0xff, 0x00}, data)
+
+		names, err := d.(NameLister).ListNames()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"bob.example.com"}, names)
+
+		// Deleted secrets are purged so that they can be set again.
+		require.NoError(t, d.Delete(CrtTag("bob.example.com")))
+		require.NoError(t, d.Put(CrtTag("bob.example.com"), []byte("new cert")))
+		data, err = d.Get(CrtTag("bob.example.com"))
+		require.NoError(t, err)
+		assert.Equal(t, "new cert", string(data))
+
+		assert.Error(t, d.Put(CrtTag(strings.Repeat("a", azureMaxSecretNameLength)), []byte("cert")))
+	})
+	t.Run("AuthenticatesWithServicePrincipal", func(t *testing.T) {
+		vault, server := newFakeAzureKeyVaultServer(t)
+		d, err := NewAzureKeyVaultDepot(ctx, AzureKeyVaultOptions{
+			VaultURL:      server.URL,
+			TenantID:      "tenant",
+			ClientID:      "client",
+			ClientSecret:  "secret",
+			AuthorityHost: server.URL,
+		}, depotOpts)
+		require.NoError(t, err)
+		require.NoError(t, d.Put(CrtTag("bob"), []byte("cert")))
+
+		// A revoked token is replaced and the request retried.
+		vault.mu.Lock()
+		vault.token = "revoked"
+		vault.mu.Unlock()
+		data, err := d.Get(CrtTag("bob"))
+		require.NoError(t, err)
+		assert.Equal(t, "cert", string(data))
+		assert.Equal(t, 2, vault.tokens)
+
+		_, err = NewAzureKeyVaultDepot(ctx, AzureKeyVaultOptions{
+			VaultURL:      server.URL,
+			TenantID:      "tenant",
+			ClientID:      "client",
+			ClientSecret:  "wrong",
+			AuthorityHost: server.URL,
+		}, depotOpts)
+		assert.Error(t, err)
+	})
+	t.Run("ParsesSecretNames", func(t *testing.T) {
+		s := &azureKeyVaultStore{opts: AzureKeyVaultOptions{Prefix: "certdepot"}}
+		for _, name := range []string{"bob", "a-b", "a--b", "-", "bob.example.com..pass", "x/y z", "ünïcode"} {
+			for _, kind := range CredentialKinds {
+				secretName := s.secretName(name, kind)
+				for _, c := range secretName {
+					assert.True(t, isAzureSecretNameChar(c), secretName)
+				}
+				parsedName, parsedKind, ok := s.parseSecretName(secretName)
+				require.True(t, ok, secretName)
+				assert.Equal(t, name, parsedName)
+				assert.Equal(t, kind, parsedKind)
+			}
+		}
+
+		for _, secretName := range []string{"other-bob--cert", "certdepot-bob", "certdepot-bob--unknown", "certdepot-bob-2--cert", "certdepot-bob-ZZ--cert"} {
+			_, _, ok := s.parseSecretName(secretName)
+			assert.False(t, ok, secretName)
+		}
+	})
+	t.Run("RejectsInvalidOptions", func(t *testing.T) {
+		for name, opts := range map[string]AzureKeyVaultOptions{
+			"MissingVaultURL": {},
+			"MissingTenantID": {VaultURL: "https://vault", ClientID: "client", ClientSecret: "secret"},
+			"InvalidPrefix":   {VaultURL: "https://vault", Prefix: "cert_depot"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				assert.Error(t, opts.Validate())
+			})
+		}
+	})
+}
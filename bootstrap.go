@@ -2,6 +2,7 @@ package certdepot
 
 import (
 	"context"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/square/certstrap/depot"
@@ -9,8 +10,12 @@ import (
 )
 
 // BootstrapDepotConfig contains options for BootstrapDepot. Must provide
-// either the name of the FileDepot or the MongoDepot options, not both or
-// neither.
+// exactly one of the name of the FileDepot, the MongoDepot options, or the
+// KubernetesDepot options.
+//
+// Durations in the configuration, such as the expiration of the certificates
+// and the depot's default expiration, may be given in JSON and YAML as strings
+// like "720h" or "90d" (see ParseDuration) instead of numbers of nanoseconds.
 type BootstrapDepotConfig struct {
 	// Name of FileDepot (directory). If a MongoDepot is desired, leave
 	// empty.
@@ -18,6 +23,10 @@ type BootstrapDepotConfig struct {
 	// Options for setting up a MongoDepot. If a FileDepot is desired,
 	// leave pointer nil or the struct empty.
 	MongoDepot *MongoDBOptions `bson:"mongo_depot,omitempty" json:"mongo_depot,omitempty" yaml:"mongo_depot,omitempty"`
+	// Options for setting up a Kubernetes depot, so that the CA and
+	// service certificate are provisioned as TLS secrets in the cluster.
+	// Leave nil unless a Kubernetes depot is desired.
+	KubernetesDepot *KubernetesDepotOptions `bson:"kubernetes_depot,omitempty" json:"kubernetes_depot,omitempty" yaml:"kubernetes_depot,omitempty"`
 	// CA certificate, this is optional unless CAKey is not empty, in
 	// which case a CA certificate must also be provided.
 	CACert string `bson:"ca_cert" json:"ca_cert" yaml:"ca_cert"`
@@ -41,14 +50,31 @@ type BootstrapDepotConfig struct {
 
 // Validate ensures that the BootstrapDepotConfig is configured correctly.
 func (c *BootstrapDepotConfig) Validate() error {
-	if c.FileDepot != "" && c.MongoDepot != nil && !c.MongoDepot.IsZero() {
+	configs := 0
+	if c.FileDepot != "" {
+		configs++
+	}
+	if c.MongoDepot != nil && !c.MongoDepot.IsZero() {
+		configs++
+	}
+	if !c.KubernetesDepot.IsZero() {
+		configs++
+	}
+
+	if configs > 1 {
 		return errors.New("cannot specify more than one depot configuration")
 	}
 
-	if c.FileDepot == "" && (c.MongoDepot == nil || c.MongoDepot.IsZero()) {
+	if configs == 0 {
 		return errors.New("must specify one depot configuration")
 	}
 
+	return c.validateCertificates()
+}
+
+// validateCertificates ensures that the CA and service certificate options
+// are configured correctly.
+func (c *BootstrapDepotConfig) validateCertificates() error {
 	if c.CAName == "" || c.ServiceName == "" {
 		return errors.New("must specify the name of the CA and service")
 	}
@@ -73,7 +99,10 @@ func (c *BootstrapDepotConfig) Validate() error {
 }
 
 // BootstrapDepot creates a certificate depot with a CA and service
-// certificate.
+// certificate. If the depot implements Locker, the depot is bootstrapped
+// while holding a lock so that only one of several instances bootstrapping
+// the same depot concurrently creates the CA; the others wait for the lock
+// and then reuse it.
 func BootstrapDepot(ctx context.Context, conf BootstrapDepotConfig) (Depot, error) {
 	return BootstrapDepotWithMongoClient(ctx, nil, conf)
 }
@@ -81,15 +110,103 @@ func BootstrapDepot(ctx context.Context, conf BootstrapDepotConfig) (Depot, erro
 // BootstrapDepotWithMongoClient creates a certificate depot with a CA and
 // service certificate using the provided mongo driver client.
 func BootstrapDepotWithMongoClient(ctx context.Context, client *mongo.Client, conf BootstrapDepotConfig) (Depot, error) {
+	d, _, err := BootstrapDepotWithReport(ctx, client, conf)
+	return d, err
+}
+
+// BootstrapDepotWithReport is the same as BootstrapDepotWithMongoClient, but
+// also returns a report of what bootstrapping did, so that provisioning tools
+// can log and check whether the CA and service certificate were created or
+// already existed. The client may be nil.
+func BootstrapDepotWithReport(ctx context.Context, client *mongo.Client, conf BootstrapDepotConfig) (Depot, *BootstrapReport, error) {
 	d, err := CreateDepot(ctx, client, conf)
 	if err != nil {
-		return nil, errors.Wrap(err, "creating depot")
+		return nil, nil, errors.Wrap(err, "creating depot")
+	}
+
+	var report *BootstrapReport
+	if err = withLock(ctx, d, bootstrapLockName, BootstrapLockTTL, func() error {
+		var err error
+		report, err = bootstrapDepot(d, conf)
+		return err
+	}); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return d, report, nil
+}
+
+// BootstrapAction is what bootstrapping did with a certificate.
+type BootstrapAction string
+
+const (
+	// BootstrapCreated is a certificate that bootstrapping issued.
+	BootstrapCreated BootstrapAction = "created"
+	// BootstrapImported is a CA certificate that bootstrapping added from
+	// BootstrapDepotConfig.CACert.
+	BootstrapImported BootstrapAction = "imported"
+	// BootstrapExisted is a certificate that was already in the depot.
+	BootstrapExisted BootstrapAction = "existed"
+)
+
+// BootstrapCertificate describes a certificate handled by bootstrapping.
+type BootstrapCertificate struct {
+	// Name is the name the certificate is stored under.
+	Name string `bson:"name" json:"name" yaml:"name"`
+	// Action is what bootstrapping did with the certificate.
+	Action BootstrapAction `bson:"action" json:"action" yaml:"action"`
+	// Fingerprint is the hex-encoded SHA-256 digest of the DER-encoded
+	// certificate. It is empty if the certificate is not stored under
+	// Name or cannot be parsed.
+	Fingerprint string `bson:"fingerprint,omitempty" json:"fingerprint,omitempty" yaml:"fingerprint,omitempty"`
+	// NotAfter is when the certificate expires.
+	NotAfter time.Time `bson:"not_after,omitempty" json:"not_after,omitempty" yaml:"not_after,omitempty"`
+}
+
+// BootstrapReport describes what bootstrapping a depot did. It is built
+// while holding the bootstrap lock, so when several instances bootstrap the
+// same depot concurrently, exactly one reports that it created the CA.
+type BootstrapReport struct {
+	CA      BootstrapCertificate `bson:"ca" json:"ca" yaml:"ca"`
+	Service BootstrapCertificate `bson:"service" json:"service" yaml:"service"`
+}
+
+// describe fills in the fingerprint and expiration of the certificate from
+// the depot. Certificates that are missing or cannot be parsed are left
+// undescribed rather than failing the bootstrap.
+func (c *BootstrapCertificate) describe(d Depot) error {
+	data, exists, err := GetIfExists(d, CrtTag(c.Name))
+	if err != nil {
+		return errors.Wrapf(err, "getting certificate '%s'", c.Name)
 	}
+	if !exists {
+		return nil
+	}
+
+	crts, err := parsePEMCertificates(data)
+	if err != nil || len(crts) == 0 {
+		return nil
+	}
+	c.Fingerprint = certificateFingerprint(crts[0])
+	c.NotAfter = crts[0].NotAfter.UTC()
+
+	return nil
+}
 
+// bootstrapDepot creates the CA and service certificate in the depot if they
+// do not exist and reports what it did.
+func bootstrapDepot(d Depot, conf BootstrapDepotConfig) (*BootstrapReport, error) {
+	report := &BootstrapReport{
+		CA:      BootstrapCertificate{Name: conf.CAName, Action: BootstrapExisted},
+		Service: BootstrapCertificate{Name: conf.ServiceName, Action: BootstrapExisted},
+	}
+
+	var err error
 	if conf.CACert != "" {
 		if err = addCert(d, conf); err != nil {
 			return nil, errors.Wrap(err, "adding a CA cert")
 		}
+		report.CA.Action = BootstrapImported
 	}
 	if exists, err := CheckCertificateWithError(d, conf.CAName); err != nil {
 		return nil, err
@@ -97,16 +214,28 @@ func BootstrapDepotWithMongoClient(ctx context.Context, client *mongo.Client, co
 		if err = createCA(d, conf); err != nil {
 			return nil, errors.Wrap(err, "creating a CA cert")
 		}
+		report.CA.Action = BootstrapCreated
+		report.Service.Action = BootstrapCreated
 	} else if exists, err = CheckCertificateWithError(d, conf.ServiceName); err != nil {
 		return nil, err
 	} else if !exists {
 		if err = createServerCert(d, conf); err != nil {
 			return nil, errors.Wrap(err, "checking the service certificate")
 		}
+		report.Service.Action = BootstrapCreated
 	}
 
-	return d, nil
+	if err = saveBootstrapDepotOptions(d, conf); err != nil {
+		return nil, errors.Wrap(err, "saving depot options")
+	}
+	if err = report.CA.describe(d); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = report.Service.describe(d); err != nil {
+		return nil, errors.WithStack(err)
+	}
 
+	return report, nil
 }
 
 // CreateDepot creates a certificate depot with the given BootstrapDepotConfig.
@@ -124,6 +253,15 @@ func CreateDepot(ctx context.Context, client *mongo.Client, conf BootstrapDepotC
 		if err != nil {
 			return nil, errors.Wrap(err, "initializing the file deopt")
 		}
+	} else if !conf.KubernetesDepot.IsZero() {
+		opts := *conf.KubernetesDepot
+		if opts.DepotOptions.CA == "" {
+			opts.DepotOptions.CA = conf.CAName
+		}
+		d, err = NewKubernetesDepot(ctx, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, "initializing the Kubernetes depot")
+		}
 	} else if !conf.MongoDepot.IsZero() {
 		if client != nil {
 			d, err = NewMongoDBCertDepotWithClient(ctx, client, conf.MongoDepot)
@@ -138,6 +276,24 @@ func CreateDepot(ctx context.Context, client *mongo.Client, conf BootstrapDepotC
 	return d, nil
 }
 
+// saveBootstrapDepotOptions persists the bootstrapped CA, and the service
+// expiration as the default expiration if there is none, as the depot's
+// options so that depots opened later can generate certificates.
+func saveBootstrapDepotOptions(d Depot, conf BootstrapDepotConfig) error {
+	saver, ok := d.(DepotOptionsSaver)
+	if !ok {
+		return nil
+	}
+
+	opts := getDepotOptions(d)
+	opts.CA = conf.CAName
+	if opts.DefaultExpiration == 0 && conf.ServiceOpts != nil {
+		opts.DefaultExpiration = conf.ServiceOpts.Expires
+	}
+
+	return saver.SaveDepotOptions(opts)
+}
+
 func addCert(d Depot, conf BootstrapDepotConfig) error {
 	if err := d.Put(depot.CrtTag(conf.CAName), []byte(conf.CACert)); err != nil {
 		return errors.Wrap(err, "adding CA cert to depot")
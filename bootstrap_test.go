@@ -2,10 +2,12 @@ package certdepot
 
 import (
 	"context"
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/square/certstrap/depot"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -52,6 +54,28 @@ func TestBootstrapDepotConfigValidate(t *testing.T) {
 				CAKey:       "ca key",
 			},
 		},
+		{
+			name: "ValidKubernetesDepot",
+			conf: BootstrapDepotConfig{
+				KubernetesDepot: &KubernetesDepotOptions{
+					Namespace: "ns",
+				},
+				CAName:      "root",
+				ServiceName: "localhost",
+			},
+		},
+		{
+			name: "FileAndKubernetesDepot",
+			conf: BootstrapDepotConfig{
+				FileDepot: "depot",
+				KubernetesDepot: &KubernetesDepotOptions{
+					Namespace: "ns",
+				},
+				CAName:      "root",
+				ServiceName: "localhost",
+			},
+			fail: true,
+		},
 		{
 			name: "UnsetDepot",
 			conf: BootstrapDepotConfig{
@@ -192,7 +216,7 @@ func TestBootstrapDepot(t *testing.T) {
 	ctx := context.TODO()
 	connctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
-	client, err := mongo.Connect(connctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	client, err := mongo.Connect(connctx, options.Client().ApplyURI(testMongoDBURI()))
 	require.NoError(t, err)
 	tempDepot, err := NewFileDepot("temp_depot")
 	require.NoError(t, err)
@@ -238,6 +262,7 @@ func TestBootstrapDepot(t *testing.T) {
 			name: "MongoDepot",
 			setup: func(conf *BootstrapDepotConfig) Depot {
 				conf.MongoDepot = &MongoDBOptions{
+					MongoDBURI:     testMongoDBURI(),
 					DatabaseName:   databaseName,
 					CollectionName: depotName,
 				}
@@ -257,6 +282,7 @@ func TestBootstrapDepot(t *testing.T) {
 			name: "MongoDepotExistingClient",
 			setup: func(conf *BootstrapDepotConfig) Depot {
 				conf.MongoDepot = &MongoDBOptions{
+					MongoDBURI:     testMongoDBURI(),
 					DatabaseName:   databaseName,
 					CollectionName: depotName,
 				}
@@ -402,3 +428,48 @@ func TestBootstrapDepot(t *testing.T) {
 		})
 	}
 }
+
+func TestBootstrapDepotWithReport(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "bootstrap-report-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	ctx := context.TODO()
+	conf := BootstrapDepotConfig{
+		FileDepot:   tempDir,
+		CAName:      "root",
+		ServiceName: "localhost",
+		CAOpts:      &CertificateOptions{CommonName: "root", Expires: time.Hour},
+		ServiceOpts: &CertificateOptions{CommonName: "localhost", Host: "localhost", CA: "root", Expires: time.Hour},
+	}
+
+	d, report, err := BootstrapDepotWithReport(ctx, nil, conf)
+	require.NoError(t, err)
+	require.NotNil(t, report)
+	assert.Equal(t, BootstrapCreated, report.CA.Action)
+	assert.Equal(t, BootstrapCreated, report.Service.Action)
+	assert.Equal(t, "root", report.CA.Name)
+	crt, err := getRawCertificate(d, "localhost")
+	require.NoError(t, err)
+	assert.Equal(t, certificateFingerprint(crt), report.Service.Fingerprint)
+	assert.True(t, report.Service.NotAfter.Equal(crt.NotAfter))
+	assert.NotEmpty(t, report.CA.Fingerprint)
+
+	_, again, err := BootstrapDepotWithReport(ctx, nil, conf)
+	require.NoError(t, err)
+	assert.Equal(t, BootstrapExisted, again.CA.Action)
+	assert.Equal(t, BootstrapExisted, again.Service.Action)
+	assert.Equal(t, report.CA.Fingerprint, again.CA.Fingerprint)
+	assert.Equal(t, report.Service.Fingerprint, again.Service.Fingerprint)
+
+	for _, tag := range []*depot.Tag{CrtTag("localhost"), PrivKeyTag("localhost"), CsrTag("localhost")} {
+		require.NoError(t, d.Delete(tag))
+	}
+	conf.ServiceOpts = &CertificateOptions{CommonName: "localhost", Host: "localhost", CA: "root", Expires: time.Hour}
+	_, rotated, err := BootstrapDepotWithReport(ctx, nil, conf)
+	require.NoError(t, err)
+	assert.Equal(t, BootstrapExisted, rotated.CA.Action)
+	assert.Equal(t, BootstrapCreated, rotated.Service.Action)
+	assert.NotEqual(t, report.Service.Fingerprint, rotated.Service.Fingerprint)
+}
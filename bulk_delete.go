@@ -0,0 +1,148 @@
+package certdepot
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DeleteMatching removes all the data stored for every name in the depot that
+// matches the glob pattern, as matched by path.Match, so that, for example,
+// the certificates of a decommissioned cluster can be removed with
+// "cluster-west-*". The depot's CA and trusted CAs are never removed. It
+// returns the number of names removed. The depot must implement
+// MatchingDeleter.
+func DeleteMatching(wd Depot, pattern string) (int, error) {
+	deleter, ok := wd.(MatchingDeleter)
+	if !ok {
+		return 0, errors.Errorf("depot of type %T does not support deleting matching names", wd)
+	}
+
+	deleted, err := deleter.DeleteMatching(pattern)
+	return deleted, errors.Wrapf(err, "deleting names matching '%s'", pattern)
+}
+
+// protectedNames returns the names of the depot's CA and trusted CAs, which
+// DeleteMatching never removes.
+func protectedNames(wd Depot) []string {
+	opts := getDepotOptions(wd)
+	names := []string{}
+	for _, name := range append([]string{opts.CA}, opts.TrustedCAs...) {
+		if name != "" {
+			names = append(names, formatName(name))
+		}
+	}
+
+	return names
+}
+
+// validateGlob checks that the pattern is a well-formed glob pattern.
+func validateGlob(pattern string) error {
+	if pattern == "" {
+		return errors.New("pattern cannot be empty")
+	}
+	_, err := path.Match(pattern, "")
+	return errors.Wrapf(err, "invalid pattern '%s'", pattern)
+}
+
+// globToRegexp converts a glob pattern, as matched by path.Match, into an
+// equivalent anchored regular expression.
+func globToRegexp(pattern string) (string, error) {
+	if err := validateGlob(pattern); err != nil {
+		return "", err
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			re.WriteString("[^/]*")
+		case '?':
+			re.WriteString("[^/]")
+		case '\\':
+			i++
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '[':
+			end := i + 1
+			if end < len(pattern) && pattern[end] == '^' {
+				end++
+			}
+			for ; pattern[end] != ']'; end++ {
+				if pattern[end] == '\\' {
+					end++
+				}
+			}
+			re.WriteString(pattern[i : end+1])
+			i = end
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+
+	return re.String(), nil
+}
+
+// DeleteMatching removes every file, including sidecar files, stored for the
+// names in the file depot that match the glob pattern, except for the depot's
+// CA and trusted CAs.
+func (fd *fileDepot) DeleteMatching(pattern string) (int, error) {
+	if err := validateGlob(pattern); err != nil {
+		return 0, err
+	}
+	names, err := fd.ListNames()
+	if err != nil {
+		return 0, errors.Wrap(err, "listing names")
+	}
+	protected := map[string]bool{}
+	for _, name := range protectedNames(fd) {
+		protected[name] = true
+	}
+
+	deleted := 0
+	catcher := grip.NewBasicCatcher()
+	for _, name := range names {
+		if protected[name] {
+			continue
+		}
+		if matched, _ := path.Match(pattern, name); !matched {
+			continue
+		}
+		if err = fd.deleteName(name); err != nil {
+			catcher.Wrapf(err, "deleting '%s'", name)
+			continue
+		}
+		deleted++
+	}
+
+	return deleted, catcher.Resolve()
+}
+
+// DeleteMatching removes the users in the mongo depot whose names match the
+// glob pattern with a single regular expression query, except for the depot's
+// CA and trusted CAs.
+func (m *mongoDepot) DeleteMatching(pattern string) (int, error) {
+	re, err := globToRegexp(pattern)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	ctx, cancel := m.writeContext()
+	defer cancel()
+
+	m.recentWrites.record("")
+	res, err := m.coll.DeleteMany(ctx, bson.M{userIDKey: bson.M{
+		"$regex": re,
+		"$nin":   protectedNames(m),
+	}})
+	if err != nil {
+		return 0, errors.Wrap(err, "removing matching users")
+	}
+
+	return int(res.DeletedCount), nil
+}
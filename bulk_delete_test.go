@@ -0,0 +1,112 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	names := []string{"cluster-west-1", "cluster-west-", "cluster-east-1", "xcluster-west-1", "a*b", "a.b", "axb", "root"}
+	for _, pattern := range []string{"cluster-west-*", "cluster-?ast-1", "cluster-[ew]*", "cluster-[^e]*", "a\\*b", "a.b", "*", "root"} {
+		re, err := globToRegexp(pattern)
+		require.NoError(t, err)
+		compiled := regexp.MustCompile(re)
+		for _, name := range names {
+			matched, err := path.Match(pattern, name)
+			require.NoError(t, err)
+			assert.Equal(t, matched, compiled.MatchString(name), "pattern '%s', name '%s'", pattern, name)
+		}
+	}
+
+	for _, pattern := range []string{"", "[", "cluster-[west"} {
+		_, err := globToRegexp(pattern)
+		assert.Error(t, err, pattern)
+	}
+}
+
+func TestDeleteMatching(t *testing.T) {
+	ctx := context.TODO()
+	depotOpts := DepotOptions{CA: "root", DefaultExpiration: time.Hour, TrustedCAs: []string{"cluster-west-ca"}}
+
+	for name, makeDepot := range map[string]func(t *testing.T) (Depot, func()){
+		"FileDepot": func(t *testing.T) (Depot, func()) {
+			tempDir, err := ioutil.TempDir(".", "bulk-delete-test")
+			require.NoError(t, err)
+			d, err := MakeFileDepot(tempDir, depotOpts)
+			require.NoError(t, err)
+			return d, func() { assert.NoError(t, os.RemoveAll(tempDir)) }
+		},
+		"MongoDB": func(t *testing.T) (Depot, func()) {
+			d, err := NewMongoDBCertDepot(ctx, &MongoDBOptions{
+				MongoDBURI:     testMongoDBURI(),
+				DatabaseName:   "certDepot",
+				CollectionName: "bulk_delete",
+				DepotOptions:   depotOpts,
+			})
+			require.NoError(t, err)
+			m := d.(*mongoDepot)
+			return d, func() {
+				assert.NoError(t, m.coll.(*mongo.Collection).Drop(ctx))
+				assert.NoError(t, m.metadataCollection().(*mongo.Collection).Drop(ctx))
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d, cleanup := makeDepot(t)
+			defer cleanup()
+
+			caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+			require.NoError(t, caOpts.Init(d))
+			caCrt, err := d.Get(CrtTag("root"))
+			require.NoError(t, err)
+			require.NoError(t, d.Put(CrtTag("cluster-west-ca"), caCrt))
+			for _, name := range []string{"cluster-west-1", "cluster-west-2", "cluster-east-1"} {
+				creds, err := d.Generate(name)
+				require.NoError(t, err)
+				require.NoError(t, d.Save(name, creds))
+				require.NoError(t, d.Put(ParamTag(name, "dhparam"), []byte("params")))
+			}
+
+			t.Run("RejectsInvalidPattern", func(t *testing.T) {
+				_, err := DeleteMatching(d, "cluster-[")
+				assert.Error(t, err)
+			})
+			t.Run("DeletesMatchingNames", func(t *testing.T) {
+				deleted, err := DeleteMatching(d, "cluster-west-*")
+				require.NoError(t, err)
+				assert.Equal(t, 2, deleted)
+
+				for _, name := range []string{"cluster-west-1", "cluster-west-2"} {
+					assert.False(t, CheckCertificate(d, name))
+					assert.False(t, CheckPrivateKey(d, name))
+					assert.False(t, d.Check(ParamTag(name, "dhparam")))
+				}
+				assert.True(t, CheckCertificate(d, "cluster-east-1"))
+				assert.True(t, CheckCertificate(d, "cluster-west-ca"), "trusted CA must not be deleted")
+			})
+			t.Run("NeverDeletesCA", func(t *testing.T) {
+				deleted, err := DeleteMatching(d, "*")
+				require.NoError(t, err)
+				assert.Equal(t, 1, deleted)
+				assert.False(t, CheckCertificate(d, "cluster-east-1"))
+				assert.True(t, CheckCertificate(d, "root"))
+				assert.True(t, CheckCertificate(d, "cluster-west-ca"))
+			})
+		})
+	}
+	t.Run("UnsupportedDepot", func(t *testing.T) {
+		d, err := NewStoreDepot(newMapStore(), DepotOptions{})
+		require.NoError(t, err)
+		_, err = DeleteMatching(d, "*")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,147 @@
+package certdepot
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+)
+
+// IssuedBundle contains credentials in parsed and DER-encoded forms in
+// addition to PEM, so that consumers do not need to re-parse the PEM-encoded
+// credentials.
+type IssuedBundle struct {
+	// Credentials are the PEM-encoded credentials.
+	Credentials *Credentials
+	// Certificate is the parsed leaf certificate.
+	Certificate *x509.Certificate
+	// Chain contains the parsed leaf certificate followed by any
+	// intermediate CA certificates.
+	Chain []*x509.Certificate
+	// CACertificates contains the parsed CA certificates.
+	CACertificates []*x509.Certificate
+	// Signer is the private key, or the remote signer if the credentials'
+	// private key is held by a backend.
+	Signer crypto.Signer
+	// KeyDER is the PKCS #8, DER-encoded private key. It is empty if the
+	// private key is held by a backend.
+	KeyDER []byte
+	// SerialNumber is the hex-encoded serial number of the leaf
+	// certificate.
+	SerialNumber string
+	// Fingerprint is the hex-encoded SHA-256 digest of the DER-encoded leaf
+	// certificate.
+	Fingerprint string
+}
+
+// ChainDER returns the DER encoding of each certificate in the chain.
+func (b *IssuedBundle) ChainDER() [][]byte {
+	der := make([][]byte, 0, len(b.Chain))
+	for _, crt := range b.Chain {
+		der = append(der, crt.Raw)
+	}
+	return der
+}
+
+// TLSCertificate returns the chain and private key as a tls.Certificate.
+func (b *IssuedBundle) TLSCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: b.ChainDER(),
+		PrivateKey:  b.Signer,
+		Leaf:        b.Certificate,
+	}
+}
+
+// Bundle returns the credentials in parsed and DER-encoded forms. Credentials
+// returned by Generate and GenerateWithOptions already hold the parsed
+// certificate and key, so they are not parsed again and the serial number and
+// fingerprint of the issued certificate are available without re-parsing the
+// PEM. If the credentials have a Signer, it is used in place of the private
+// key. Encrypted private keys are not supported.
+func (c *Credentials) Bundle() (*IssuedBundle, error) {
+	if c.bundle != nil {
+		return c.bundle, nil
+	}
+
+	chain, err := parsePEMCertificates(c.Cert)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing certificate chain")
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("credentials do not contain a certificate")
+	}
+
+	var bundle *IssuedBundle
+	if c.Signer != nil {
+		bundle, err = c.newRemoteBundle(chain[0], chain[1:])
+	} else {
+		var key *pkix.Key
+		key, err = pkix.NewKeyFromPrivateKeyPEM(c.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing private key")
+		}
+		bundle, err = c.newBundle(chain[0], chain[1:], key)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c.bundle = bundle
+
+	return bundle, nil
+}
+
+// newBundle creates the bundle for the credentials from the already parsed
+// leaf certificate, intermediate CA certificates, and key.
+func (c *Credentials) newBundle(crt *x509.Certificate, intermediates []*x509.Certificate, key *pkix.Key) (*IssuedBundle, error) {
+	signer, ok := key.Private.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("private key of type %T cannot sign", key.Private)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling private key")
+	}
+
+	return c.newBundleWithSigner(crt, intermediates, signer, keyDER)
+}
+
+// newRemoteBundle creates the bundle for the credentials from the already
+// parsed leaf certificate and intermediate CA certificates, using the
+// credentials' Signer as the private key.
+func (c *Credentials) newRemoteBundle(crt *x509.Certificate, intermediates []*x509.Certificate) (*IssuedBundle, error) {
+	pub, ok := c.Signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(crt.PublicKey) {
+		return nil, errors.New("signer's public key does not match the certificate")
+	}
+
+	return c.newBundleWithSigner(crt, intermediates, c.Signer, nil)
+}
+
+func (c *Credentials) newBundleWithSigner(crt *x509.Certificate, intermediates []*x509.Certificate, signer crypto.Signer, keyDER []byte) (*IssuedBundle, error) {
+	caCrts, err := parsePEMCertificates(c.CACert)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing CA certificates")
+	}
+
+	return &IssuedBundle{
+		Credentials:    c,
+		Certificate:    crt,
+		Chain:          append([]*x509.Certificate{crt}, intermediates...),
+		CACertificates: caCrts,
+		Signer:         signer,
+		KeyDER:         keyDER,
+		SerialNumber:   crt.SerialNumber.Text(16),
+		Fingerprint:    certificateFingerprint(crt),
+	}, nil
+}
+
+// certificateFingerprint returns the hex-encoded SHA-256 digest of the
+// DER-encoded certificate.
+func certificateFingerprint(crt *x509.Certificate) string {
+	sum := sha256.Sum256(crt.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,83 @@
+package certdepot
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialsBundle(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "bundle-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+
+	checkBundle := func(t *testing.T, creds *Credentials, bundle *IssuedBundle) {
+		assert.Equal(t, creds, bundle.Credentials)
+		assert.Equal(t, "alice", bundle.Certificate.Subject.CommonName)
+		require.Len(t, bundle.Chain, 1)
+		assert.Equal(t, bundle.Certificate, bundle.Chain[0])
+		assert.Equal(t, [][]byte{bundle.Certificate.Raw}, bundle.ChainDER())
+		require.Len(t, bundle.CACertificates, 1)
+		assert.Equal(t, "root", bundle.CACertificates[0].Subject.CommonName)
+		assert.Equal(t, bundle.Certificate.PublicKey, bundle.Signer.Public())
+		assert.Equal(t, bundle.Certificate.SerialNumber.Text(16), bundle.SerialNumber)
+		sum := sha256.Sum256(bundle.Certificate.Raw)
+		assert.Equal(t, hex.EncodeToString(sum[:]), bundle.Fingerprint)
+
+		key, err := x509.ParsePKCS8PrivateKey(bundle.KeyDER)
+		require.NoError(t, err)
+		assert.Equal(t, bundle.Signer, key)
+
+		tlsCrt := bundle.TLSCertificate()
+		assert.Equal(t, bundle.ChainDER(), tlsCrt.Certificate)
+		assert.Equal(t, bundle.Certificate, tlsCrt.Leaf)
+	}
+
+	t.Run("Generate", func(t *testing.T) {
+		creds, err := d.Generate("alice")
+		require.NoError(t, err)
+		require.NotNil(t, creds.bundle)
+		bundle, err := creds.Bundle()
+		require.NoError(t, err)
+		checkBundle(t, creds, bundle)
+		require.NoError(t, d.Put(CrtTag("alice"), creds.Cert))
+		require.NoError(t, d.Put(PrivKeyTag("alice"), creds.Key))
+	})
+	t.Run("Find", func(t *testing.T) {
+		creds, err := d.Find("alice")
+		require.NoError(t, err)
+		assert.Nil(t, creds.bundle)
+		bundle, err := creds.Bundle()
+		require.NoError(t, err)
+		checkBundle(t, creds, bundle)
+
+		cached, err := creds.Bundle()
+		require.NoError(t, err)
+		assert.True(t, bundle == cached)
+	})
+	t.Run("NotExported", func(t *testing.T) {
+		creds, err := d.Generate("bob")
+		require.NoError(t, err)
+		data, err := json.Marshal(creds)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "bundle")
+	})
+	t.Run("FailsWithInvalidCredentials", func(t *testing.T) {
+		_, err := (&Credentials{Cert: []byte("cert"), Key: []byte("key")}).Bundle()
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,166 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+)
+
+// DeleteCAOptions configure DeleteCA.
+type DeleteCAOptions struct {
+	// Force deletes the CA even if unexpired certificates in the depot
+	// still chain to it.
+	Force bool `bson:"force" json:"force" yaml:"force"`
+}
+
+// CAInUseError is returned when deleting a CA is refused because unexpired
+// certificates in the depot still chain to it. Use errors.As to check for it.
+type CAInUseError struct {
+	// Name is the name of the CA.
+	Name string
+	// Dependents are the names of the unexpired certificates issued by the
+	// CA.
+	Dependents []string
+}
+
+func (e *CAInUseError) Error() string {
+	return fmt.Sprintf("CA '%s' still issues %d unexpired certificate(s): %s", e.Name, len(e.Dependents), strings.Join(e.Dependents, ", "))
+}
+
+// IsCAInUseError returns whether the error, or the error it wraps, is a
+// CAInUseError.
+func IsCAInUseError(err error) bool {
+	var inUseErr *CAInUseError
+	return errors.As(err, &inUseErr)
+}
+
+// FindCADependents returns the sorted names of the unexpired certificates in
+// the depot that were issued by the CA, including intermediate CAs. The depot
+// must implement NameLister or EntryStreamer.
+func FindCADependents(ctx context.Context, wd Depot, name string) ([]string, error) {
+	ca, err := GetPKIXCertificate(wd, name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return findCADependents(ctx, wd, name, ca)
+}
+
+func findCADependents(ctx context.Context, wd Depot, name string, ca *x509.Certificate) ([]string, error) {
+	iter, err := ListIterator(ctx, wd, ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing depot entries")
+	}
+	defer func() {
+		grip.Warning(message.WrapError(iter.Close(ctx), message.Fields{
+			"message": "could not close depot iterator",
+			"ca":      name,
+		}))
+	}()
+
+	now := time.Now()
+	dependents := []string{}
+	for iter.Next(ctx) {
+		entry := iter.Entry().Name
+		if entry == name {
+			continue
+		}
+		data, exists, err := GetIfExists(wd, CrtTag(entry))
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting certificate for '%s'", entry)
+		}
+		if !exists {
+			continue
+		}
+		crt, err := parseCertificatePEM(data)
+		if err != nil {
+			// Unparseable certificates cannot chain to the CA, and
+			// VerifyDepot reports them.
+			continue
+		}
+		if now.After(crt.NotAfter) || !bytes.Equal(crt.RawIssuer, ca.RawSubject) || crt.CheckSignatureFrom(ca) != nil {
+			continue
+		}
+		dependents = append(dependents, entry)
+	}
+	if err = iter.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterating over depot entries")
+	}
+	sort.Strings(dependents)
+
+	return dependents, nil
+}
+
+// DeleteCA removes all the data stored for the CA, refusing with a
+// CAInUseError if unexpired certificates in the depot still chain to it
+// unless Force is set. Names that are not CAs are deleted without checking.
+func DeleteCA(ctx context.Context, wd Depot, name string, opts DeleteCAOptions) error {
+	if err := checkCADeletion(ctx, wd, name, opts); err != nil {
+		return errors.WithStack(err)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	for _, kind := range CredentialKinds {
+		tag, err := kind.Tag(name)
+		if err != nil {
+			catcher.Add(err)
+			continue
+		}
+		catcher.Wrapf(deleteIfExists(wd, tag), "deleting %s for '%s'", kind, name)
+	}
+
+	return catcher.Resolve()
+}
+
+// checkCADeletion returns an error if the name is a CA that unexpired
+// certificates in the depot still chain to, unless the deletion is forced.
+func checkCADeletion(ctx context.Context, wd Depot, name string, opts DeleteCAOptions) error {
+	data, exists, err := GetIfExists(wd, CrtTag(name))
+	if err != nil {
+		return errors.Wrapf(err, "getting certificate for '%s'", name)
+	}
+	if !exists {
+		return nil
+	}
+	ca, err := parseCertificatePEM(data)
+	if err != nil || !ca.IsCA {
+		return nil
+	}
+
+	if opts.Force {
+		grip.Warning(message.Fields{
+			"message": "force deleting CA without checking for certificates issued by it",
+			"ca":      name,
+		})
+		return nil
+	}
+
+	dependents, err := findCADependents(ctx, wd, name, ca)
+	if err != nil {
+		return errors.Wrapf(err, "finding certificates issued by CA '%s'; set Force to delete it anyway", name)
+	}
+	if len(dependents) > 0 {
+		return &CAInUseError{Name: name, Dependents: dependents}
+	}
+
+	return nil
+}
+
+// parseCertificatePEM parses a PEM-encoded certificate.
+func parseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	crt, err := pkix.NewCertificateFromPEM(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing certificate PEM")
+	}
+
+	rawCrt, err := crt.GetRawCertificate()
+	return rawCrt, errors.Wrap(err, "parsing certificate")
+}
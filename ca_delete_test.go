@@ -0,0 +1,71 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteCA(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tempDir, err := ioutil.TempDir(".", "ca-delete-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	for _, name := range []string{"root", "unused"} {
+		caOpts := CertificateOptions{CommonName: name, Expires: time.Hour}
+		require.NoError(t, caOpts.Init(d))
+	}
+	for _, name := range []string{"bob", "alice"} {
+		creds, err := d.Generate(name)
+		require.NoError(t, err)
+		require.NoError(t, d.Save(name, creds))
+	}
+
+	t.Run("FindsDependents", func(t *testing.T) {
+		dependents, err := FindCADependents(ctx, d, "root")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"alice", "bob"}, dependents)
+
+		dependents, err = FindCADependents(ctx, d, "unused")
+		require.NoError(t, err)
+		assert.Empty(t, dependents)
+	})
+	t.Run("RefusesToDeleteCAInUse", func(t *testing.T) {
+		err := DeleteCA(ctx, d, "root", DeleteCAOptions{})
+		require.Error(t, err)
+		assert.True(t, IsCAInUseError(err))
+		var inUseErr *CAInUseError
+		require.ErrorAs(t, err, &inUseErr)
+		assert.Equal(t, []string{"alice", "bob"}, inUseErr.Dependents)
+
+		assert.True(t, IsCAInUseError(DeleteCertificate(d, "root")))
+		assert.True(t, d.Check(CrtTag("root")))
+		assert.True(t, d.Check(PrivKeyTag("root")))
+	})
+	t.Run("DeletesUnusedCA", func(t *testing.T) {
+		require.NoError(t, DeleteCA(ctx, d, "unused", DeleteCAOptions{}))
+		assert.False(t, d.Check(CrtTag("unused")))
+		assert.False(t, d.Check(PrivKeyTag("unused")))
+	})
+	t.Run("DeletesLeafCertificates", func(t *testing.T) {
+		require.NoError(t, DeleteCertificate(d, "bob"))
+		assert.False(t, d.Check(CrtTag("bob")))
+	})
+	t.Run("ForceDeletesCAInUse", func(t *testing.T) {
+		require.NoError(t, DeleteCA(ctx, d, "root", DeleteCAOptions{Force: true}))
+		assert.False(t, d.Check(CrtTag("root")))
+		assert.False(t, d.Check(PrivKeyTag("root")))
+		assert.True(t, d.Check(CrtTag("alice")))
+	})
+}
@@ -0,0 +1,185 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+// DefaultCAPoolRefreshInterval is how often a DynamicCertPool re-reads its CA
+// certificates from the depot.
+const DefaultCAPoolRefreshInterval = time.Minute
+
+// DynamicCertPool is an x509.CertPool built from CA certificates in a depot
+// that is rebuilt when the certificates change in the depot, such as when a
+// CA is rotated or a trusted CA is imported. Because a tls.Config's RootCAs
+// and ClientCAs cannot be swapped on a live config, use the pool's
+// VerifyPeerCertificate as the config's VerifyPeerCertificate hook, with
+// InsecureSkipVerify on clients or ClientAuth set to RequireAnyClientCert on
+// servers, so that every handshake is verified against the current pool.
+type DynamicCertPool struct {
+	wd      Depot
+	caNames []string
+
+	mu   sync.RWMutex
+	pool *x509.CertPool
+	pem  []byte
+}
+
+// NewCAPool builds a pool from the named CA certificates in the depot. If no
+// names are given, the depot's CA and trusted CAs are used. The pool is
+// refreshed from the depot every DefaultCAPoolRefreshInterval until the
+// context is canceled.
+func NewCAPool(ctx context.Context, wd Depot, caNames ...string) (*DynamicCertPool, error) {
+	p, err := newCAPool(wd, caNames...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	go p.refreshEvery(ctx, DefaultCAPoolRefreshInterval)
+
+	return p, nil
+}
+
+// newCAPool builds a pool from the named CA certificates in the depot without
+// refreshing it in the background.
+func newCAPool(wd Depot, caNames ...string) (*DynamicCertPool, error) {
+	if len(caNames) == 0 {
+		opts := getDepotOptions(wd)
+		if opts.CA == "" {
+			return nil, errors.New("must provide names of CAs if the depot has no default CA")
+		}
+		caNames = append([]string{opts.CA}, opts.TrustedCAs...)
+	}
+
+	p := &DynamicCertPool{wd: wd}
+	for _, name := range caNames {
+		p.caNames = append(p.caNames, formatName(name))
+	}
+	if _, err := p.Refresh(); err != nil {
+		return nil, errors.Wrap(err, "building CA pool")
+	}
+
+	return p, nil
+}
+
+// Pool returns the current pool. The returned pool is not modified by later
+// refreshes.
+func (p *DynamicCertPool) Pool() *x509.CertPool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.pool
+}
+
+// Refresh re-reads the CA certificates from the depot and rebuilds the pool if
+// they changed. It returns whether the pool changed. If the certificates
+// cannot be read, the current pool is kept.
+func (p *DynamicCertPool) Refresh() (bool, error) {
+	var bundle []byte
+	for _, name := range p.caNames {
+		data, err := p.wd.Get(CrtTag(name))
+		if err != nil {
+			return false, errors.Wrapf(err, "getting CA certificate '%s'", name)
+		}
+		bundle = append(bundle, data...)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			bundle = append(bundle, '\n')
+		}
+	}
+
+	p.mu.RLock()
+	unchanged := p.pool != nil && bytes.Equal(bundle, p.pem)
+	p.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	crts, err := parseCACertificates(bundle)
+	if err != nil {
+		return false, errors.Wrap(err, "parsing CA certificates")
+	}
+	if len(crts) == 0 {
+		return false, errors.New("no CA certificates found")
+	}
+	pool := x509.NewCertPool()
+	for _, crt := range crts {
+		pool.AddCert(crt)
+	}
+
+	p.mu.Lock()
+	p.pool = pool
+	p.pem = bundle
+	p.mu.Unlock()
+
+	return true, nil
+}
+
+// VerifyPeerCertificate verifies that the peer's certificate chains to a CA in
+// the current pool. It has the signature of tls.Config.VerifyPeerCertificate.
+// It does not verify the peer's host name.
+func (p *DynamicCertPool) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	_, err := p.verify(rawCerts)
+	return err
+}
+
+// verify parses the peer's certificates and returns the verified chains.
+func (p *DynamicCertPool) verify(rawCerts [][]byte) ([][]*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("peer did not present a certificate")
+	}
+
+	crts := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		crt, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing peer certificate")
+		}
+		crts = append(crts, crt)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, crt := range crts[1:] {
+		intermediates.AddCert(crt)
+	}
+
+	chains, err := crts[0].Verify(x509.VerifyOptions{
+		Roots:         p.Pool(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "verifying peer certificate")
+	}
+
+	return chains, nil
+}
+
+func (p *DynamicCertPool) refreshEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := p.Refresh()
+		grip.Error(message.WrapError(err, message.Fields{
+			"message": "could not refresh CA pool",
+			"cas":     p.caNames,
+		}))
+		grip.InfoWhen(changed, message.Fields{
+			"message": "refreshed CA pool",
+			"cas":     p.caNames,
+		})
+	}
+}
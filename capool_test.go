@@ -0,0 +1,87 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDynamicCertPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tempDir, err := ioutil.TempDir(".", "capool-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	for _, name := range []string{"root", "other"} {
+		caOpts := CertificateOptions{CommonName: name, Expires: time.Hour}
+		require.NoError(t, caOpts.Init(d))
+	}
+
+	peerCert := func(t *testing.T, name, ca string) [][]byte {
+		opts := CertificateOptions{CommonName: name, Host: name, CA: ca, Expires: time.Hour}
+		require.NoError(t, opts.CreateCertificate(d))
+		data, err := d.Get(CrtTag(name))
+		require.NoError(t, err)
+		block, _ := pem.Decode(data)
+		require.NotNil(t, block)
+		return [][]byte{block.Bytes}
+	}
+	rootPeer := peerCert(t, "alice", "root")
+	otherPeer := peerCert(t, "bob", "other")
+
+	t.Run("DefaultsToDepotCA", func(t *testing.T) {
+		pool, err := NewCAPool(ctx, d)
+		require.NoError(t, err)
+		assert.NoError(t, pool.VerifyPeerCertificate(rootPeer, nil))
+		assert.Error(t, pool.VerifyPeerCertificate(otherPeer, nil))
+		assert.Error(t, pool.VerifyPeerCertificate(nil, nil))
+	})
+	t.Run("UsesNamedCAs", func(t *testing.T) {
+		pool, err := NewCAPool(ctx, d, "root", "other")
+		require.NoError(t, err)
+		assert.NoError(t, pool.VerifyPeerCertificate(rootPeer, nil))
+		assert.NoError(t, pool.VerifyPeerCertificate(otherPeer, nil))
+	})
+	t.Run("FailsWithMissingCA", func(t *testing.T) {
+		_, err := NewCAPool(ctx, d, "nonexistent")
+		assert.Error(t, err)
+	})
+	t.Run("RefreshesWhenCAChanges", func(t *testing.T) {
+		pool, err := NewCAPool(ctx, d, "trusted")
+		require.Error(t, err)
+		assert.Nil(t, pool)
+
+		otherCert, err := d.Get(CrtTag("other"))
+		require.NoError(t, err)
+		require.NoError(t, ImportTrustedCA(d, "trusted", otherCert))
+		pool, err = NewCAPool(ctx, d, "trusted")
+		require.NoError(t, err)
+		assert.NoError(t, pool.VerifyPeerCertificate(otherPeer, nil))
+		original := pool.Pool()
+
+		changed, err := pool.Refresh()
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.Equal(t, original, pool.Pool())
+
+		rootCert, err := d.Get(CrtTag("root"))
+		require.NoError(t, err)
+		require.NoError(t, ImportTrustedCA(d, "trusted", rootCert))
+		changed, err = pool.Refresh()
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.NoError(t, pool.VerifyPeerCertificate(rootPeer, nil))
+		assert.Error(t, pool.VerifyPeerCertificate(otherPeer, nil))
+	})
+}
@@ -1,17 +1,30 @@
 package certdepot
 
 import (
+	"context"
+	"crypto/elliptic"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
 	"github.com/pkg/errors"
 	"github.com/square/certstrap/depot"
 	"github.com/square/certstrap/pkix"
 )
 
+const (
+	// KeyTypeRSA generates RSA keys.
+	KeyTypeRSA = "rsa"
+	// KeyTypeECDSA generates ECDSA keys.
+	KeyTypeECDSA = "ecdsa"
+)
+
 // CertificateOptions contains options to use for Init, CertRequest, and Sign.
 type CertificateOptions struct {
 	//
@@ -21,6 +34,10 @@ type CertificateOptions struct {
 	Passphrase string `bson:"passphrase,omitempty" json:"passphrase,omitempty" yaml:"passphrase,omitempty"`
 	// Size (in bits) of RSA keypair to generate (defaults to 2048).
 	KeyBits int `bson:"key_bits,omitempty" json:"key_bits,omitempty" yaml:"key_bits,omitempty"`
+	// Type of keypair to generate, either KeyTypeRSA (the default) or
+	// KeyTypeECDSA. For ECDSA keys, KeyBits selects the curve: 256 (the
+	// default), 384, or 521.
+	KeyType string `bson:"key_type,omitempty" json:"key_type,omitempty" yaml:"key_type,omitempty"`
 	// Sets the Organization (O) field of the certificate.
 	Organization string `bson:"o,omitempty" json:"o,omitempty" yaml:"o,omitempty"`
 	// Sets the Country (C) field of the certificate.
@@ -41,16 +58,40 @@ type CertificateOptions struct {
 	URI []string `bson:"uri,omitempty" json:"uri,omitempty" yaml:"uri,omitempty"`
 	// Path to private key PEM file (if blank, will generate new keypair).
 	Key string `bson:"key,omitempty" json:"key,omitempty" yaml:"key,omitempty"`
+	// The subject alt names to derive the common name of the certificate
+	// request from, in order, if CommonName is not set. The first of the
+	// sources that is requested is used. If empty, the first domain is
+	// used, followed by the first IP address, so that certificates can be
+	// requested for IP-only identities. See StorageName for where the
+	// certificate is stored.
+	NameSources []NameSource `bson:"name_sources,omitempty" json:"name_sources,omitempty" yaml:"name_sources,omitempty"`
 
 	//
 	// Options specific to Init and Sign.
 	//
-	// How long until the certificate expires.
+	// How long until the certificate expires. If zero, the depot's
+	// DefaultExpiration is used. It must be at least MinExpiration.
 	Expires time.Duration `bson:"expires,omitempty" json:"expires,omitempty" yaml:"expires,omitempty"`
+	// Custom X.509 extensions to add to the certificate.
+	Extensions []Extension `bson:"extensions,omitempty" json:"extensions,omitempty" yaml:"extensions,omitempty"`
+	// Dotted-decimal OIDs of the certificate policies under which the
+	// certificate is issued.
+	PolicyIdentifiers []string `bson:"policies,omitempty" json:"policies,omitempty" yaml:"policies,omitempty"`
+	// URI of the Certification Practice Statement (CPS), which is added as
+	// a qualifier to each certificate policy. If no policies are given, the
+	// CPS is added to the anyPolicy identifier.
+	CPSURI string `bson:"cps_uri,omitempty" json:"cps_uri,omitempty" yaml:"cps_uri,omitempty"`
 
 	//
 	// Options specific to Sign.
 	//
+	// Name the certificate request, private key, and certificate are
+	// stored under in the depot. If set, Host is only used as a subject
+	// alt name and is added to the DNS names, or to the IP addresses if it
+	// is an IP address, of the certificate request. If empty, the
+	// certificate request and key are stored under the common name and the
+	// certificate is stored under the host.
+	Name string `bson:"name,omitempty" json:"name,omitempty" yaml:"name,omitempty"`
 	// Host name of the certificate to be signed.
 	Host string `bson:"host,omitempty" json:"host,omitempty" yaml:"host,omitempty"`
 	// Name of CA to issue cert with.
@@ -59,18 +100,55 @@ type CertificateOptions struct {
 	CAPassphrase string `bson:"ca_passphrase,omitempty" json:"ca_passphrase,omitempty" yaml:"ca_passphrase,omitempty"`
 	// Whether generated certificate should be an intermediate.
 	Intermediate bool `bson:"intermediate,omitempty" json:"intermediate,omitempty" yaml:"intermediate,omitempty"`
+	// Maximum number of intermediate CAs that may follow this CA in a
+	// certificate chain. This is only used by Init and when signing an
+	// intermediate. Zero (the default) only allows the CA to issue leaf
+	// certificates and a negative value sets no limit.
+	MaxPathLen int `bson:"max_path_len,omitempty" json:"max_path_len,omitempty" yaml:"max_path_len,omitempty"`
+	// Identity of the caller requesting the certificate. This is recorded
+	// in the audit log and passed to the depot's IssuanceApprover. If the
+	// depot's context carries a principal (see WithPrincipal), that
+	// principal is used instead and this must be empty or match it.
+	Principal string `bson:"-" json:"-" yaml:"-"`
+	// Evidence supplied by the caller to prove the identity of the host the
+	// certificate is for. It is required if the depot has an Attestor.
+	Evidence *AttestationEvidence `bson:"-" json:"-" yaml:"-"`
+	// Purpose of the certificate, which sets its extended key usages so
+	// that the purpose is recorded in the certificate stored in the depot
+	// (see GetCertificatePurpose). If empty, certstrap's default of both
+	// server and client authentication is used. It cannot be set for CAs.
+	Purpose CertificatePurpose `bson:"purpose,omitempty" json:"purpose,omitempty" yaml:"purpose,omitempty"`
+	// Whether to delete the stored certificate request once the certificate
+	// has been signed and stored in the depot. It is also deleted if the
+	// depot's DeleteCSRAfterSign option is set.
+	DeleteCSR bool `bson:"delete_csr,omitempty" json:"delete_csr,omitempty" yaml:"delete_csr,omitempty"`
+
+	//
+	// Options specific to CreateCertificate.
+	//
+	// Whether to keep the certificate signing request only in memory while
+	// the certificate is signed instead of storing it in the depot. The
+	// private key is still stored.
+	DiscardCSR bool `bson:"discard_csr,omitempty" json:"discard_csr,omitempty" yaml:"discard_csr,omitempty"`
 
 	csr *pkix.CertificateSigningRequest
 	key *pkix.Key
 	crt *pkix.Certificate
 }
 
+// MinExpiration is the shortest lifetime of a certificate created by Init or
+// Sign.
+const MinExpiration = time.Minute
+
 // Init initializes a new CA.
 func (opts *CertificateOptions) Init(wd Depot) error {
-	if opts.CommonName == "" {
-		return errors.New("must provide common name of CA")
+	if err := opts.Validate(OperationInit); err != nil {
+		return errors.Wrap(err, "invalid options")
 	}
-	formattedName := strings.Replace(opts.CommonName, " ", "_", -1)
+	if err := opts.resolveExpiration(wd); err != nil {
+		return errors.WithStack(err)
+	}
+	formattedName := formatName(opts.CommonName)
 
 	certExists, err := CheckCertificateWithError(wd, formattedName)
 	if err != nil {
@@ -84,13 +162,38 @@ func (opts *CertificateOptions) Init(wd Depot) error {
 		return errors.New("CA with specified name already exists")
 	}
 
+	req, err := opts.issuanceRequest(depotContext(wd), formattedName)
+	if err != nil {
+		return errors.Wrap(err, "describing CA issuance")
+	}
+	req.CA = formattedName
+	req.RootCA = true
+	if err = approveIssuance(wd, req); err != nil {
+		grip.Info(message.WrapError(err, message.Fields{
+			"message":   "certificate issuance denied",
+			"op":        "init",
+			"name":      req.Name,
+			"principal": req.Principal,
+		}))
+		return errors.Wrap(err, "approving CA issuance")
+	}
+
 	key, err := opts.getOrCreatePrivateKey()
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	defer zeroPrivateKey(key.Private)
+	if err = getCryptoPolicy(getDepotOptions(wd)).checkPublicKey(formattedName, key.Public); err != nil {
+		return err
+	}
+
+	templateOpts, err := opts.templateOptions()
+	if err != nil {
+		return errors.Wrap(err, "getting certificate template options")
+	}
 
 	expiresTime := time.Now().Add(opts.Expires)
-	crt, err := pkix.CreateCertificateAuthority(
+	crt, err := pkix.CreateCertificateAuthorityWithOptions(
 		key,
 		opts.OrganizationalUnit,
 		expiresTime,
@@ -100,6 +203,7 @@ func (opts *CertificateOptions) Init(wd Depot) error {
 		opts.Locality,
 		opts.CommonName,
 		[]string{},
+		append(templateOpts, opts.pathLenOption())...,
 	)
 	if err != nil {
 		return errors.Wrap(err, "creating certificate authority")
@@ -128,15 +232,40 @@ func (opts *CertificateOptions) Init(wd Depot) error {
 		return errors.Wrap(err, "saving certificate revocation list")
 	}
 
-	if md, ok := wd.(*mongoDepot); ok {
+	if tracker, ok := wd.(ExpiryTracker); ok {
 		rawCrt, err := crt.GetRawCertificate()
 		if err != nil {
 			return errors.Wrap(err, "getting raw cert")
 		}
-		if err = md.PutTTL(formattedName, rawCrt.NotAfter); err != nil {
+		if err = tracker.PutTTL(formattedName, rawCrt.NotAfter); err != nil {
 			return errors.Wrap(err, "setting certificate TTL")
 		}
 	}
+
+	grip.Info(message.Fields{
+		"message":   "issued certificate",
+		"op":        "init",
+		"name":      req.Name,
+		"principal": req.Principal,
+	})
+
+	return nil
+}
+
+// resolveExpiration sets Expires to the depot's DefaultExpiration if it is
+// zero and checks that it is at least MinExpiration, since a zero lifetime
+// would create a certificate that is already expired.
+func (opts *CertificateOptions) resolveExpiration(wd Depot) error {
+	if opts.Expires == 0 {
+		opts.Expires = getDepotOptions(wd).DefaultExpiration
+	}
+	if opts.Expires == 0 {
+		return errors.New("must specify an expiration if the depot has no default expiration")
+	}
+	if opts.Expires < MinExpiration {
+		return errors.Errorf("expiration %s is shorter than the minimum of %s", opts.Expires, MinExpiration)
+	}
+
 	return nil
 }
 
@@ -171,10 +300,14 @@ func (opts *CertificateOptions) CertRequestInMemory() (*pkix.CertificateSigningR
 	if opts.certRequestedInMemory() {
 		return opts.csr, opts.key, nil
 	}
+	if err := opts.Validate(OperationCertRequest); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid options")
+	}
 
-	ips, err := pkix.ParseAndValidateIPs(strings.Join(opts.IP, ","))
+	domains, ipStrs := opts.subjectAltNames()
+	ips, err := pkix.ParseAndValidateIPs(strings.Join(ipStrs, ","))
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "parsing and validating IPs '%s'", opts.IP)
+		return nil, nil, errors.Wrapf(err, "parsing and validating IPs '%s'", ipStrs)
 	}
 
 	uris, err := pkix.ParseAndValidateURIs(strings.Join(opts.URI, ","))
@@ -196,7 +329,7 @@ func (opts *CertificateOptions) CertRequestInMemory() (*pkix.CertificateSigningR
 		key,
 		opts.OrganizationalUnit,
 		ips,
-		opts.Domain,
+		domains,
 		uris,
 		opts.Organization,
 		opts.Country,
@@ -242,17 +375,41 @@ func (opts *CertificateOptions) PutCertRequestFromMemory(wd Depot) error {
 		return errors.Wrap(err, "saving certificate request")
 	}
 
+	return opts.putPrivateKeyFromMemory(wd, formattedName)
+}
+
+// certRequestForCreate creates the certificate request and key for
+// CreateCertificate, storing the certificate request in the depot unless
+// DiscardCSR is set.
+func (opts *CertificateOptions) certRequestForCreate(wd Depot) error {
+	if !opts.DiscardCSR {
+		return opts.CertRequest(wd)
+	}
+
+	if _, _, err := opts.CertRequestInMemory(); err != nil {
+		return errors.Wrap(err, "creating cert request and key")
+	}
+	formattedName, err := opts.getFormattedCertificateRequestName()
+	if err != nil {
+		return errors.Wrap(err, "getting formatted name")
+	}
+	privKeyExists, err := CheckPrivateKeyWithError(wd, formattedName)
+	if err != nil {
+		return err
+	}
+	if privKeyExists {
+		return errors.New("private key already exists")
+	}
+
+	return opts.putPrivateKeyFromMemory(wd, formattedName)
+}
+
+func (opts *CertificateOptions) putPrivateKeyFromMemory(wd Depot, formattedName string) error {
 	if opts.Passphrase != "" {
-		if err = depot.PutEncryptedPrivateKey(wd, formattedName, opts.key, []byte(opts.Passphrase)); err != nil {
-			return errors.Wrap(err, "saving encrypted private key")
-		}
-	} else {
-		if err = depot.PutPrivateKey(wd, formattedName, opts.key); err != nil {
-			return errors.Wrap(err, "saving private key")
-		}
+		return errors.Wrap(depot.PutEncryptedPrivateKey(wd, formattedName, opts.key, []byte(opts.Passphrase)), "saving encrypted private key")
 	}
 
-	return nil
+	return errors.Wrap(depot.PutPrivateKey(wd, formattedName, opts.key), "saving private key")
 }
 
 // Sign signs a CSR with a given CA for a new certificate.
@@ -261,8 +418,26 @@ func (opts *CertificateOptions) Sign(wd Depot) error {
 	if err != nil {
 		return errors.Wrap(err, "signing certificate request")
 	}
+	if err = opts.PutCertFromMemory(wd); err != nil {
+		return err
+	}
 
-	return opts.PutCertFromMemory(wd)
+	return errors.Wrap(opts.deleteSignedCertRequest(wd), "deleting signed certificate request")
+}
+
+// deleteSignedCertRequest removes the certificate request that was signed
+// from the depot if either the options or the depot ask for it, since stale
+// requests otherwise accumulate indefinitely.
+func (opts *CertificateOptions) deleteSignedCertRequest(wd Depot) error {
+	if !opts.DeleteCSR && !getDepotOptions(wd).DeleteCSRAfterSign {
+		return nil
+	}
+	formattedName, err := opts.getFormattedCertificateRequestName()
+	if err != nil {
+		return errors.Wrap(err, "getting formatted name")
+	}
+
+	return deleteIfExists(wd, CsrTag(formattedName))
 }
 
 func (opts *CertificateOptions) signedInMemory() bool {
@@ -276,14 +451,14 @@ func (opts *CertificateOptions) SignInMemory(wd Depot) (*pkix.Certificate, error
 	if opts.signedInMemory() {
 		return opts.crt, nil
 	}
-	if opts.Host == "" {
-		return nil, errors.New("must provide name of host")
+	if err := opts.Validate(OperationSign); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
 	}
-	if opts.CA == "" {
-		return nil, errors.New("must provide name of CA")
+	if err := opts.resolveExpiration(wd); err != nil {
+		return nil, errors.WithStack(err)
 	}
-	formattedReqName := strings.Replace(opts.Host, " ", "_", -1)
-	formattedCAName := strings.Replace(opts.CA, " ", "_", -1)
+	formattedReqName := opts.formattedCertificateName()
+	formattedCAName := formatName(opts.CA)
 
 	var csr *pkix.CertificateSigningRequest
 	if opts.certRequestedInMemory() {
@@ -295,6 +470,21 @@ func (opts *CertificateOptions) SignInMemory(wd Depot) (*pkix.Certificate, error
 			return nil, errors.Wrap(err, "getting host's certificate signing request")
 		}
 	}
+
+	if policy := getCryptoPolicy(getDepotOptions(wd)); policy.enabled() {
+		rawCSR, err := csr.GetRawCertificateSigningRequest()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting raw certificate signing request")
+		}
+		if err = policy.checkPublicKey(formattedReqName, rawCSR.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if signer := getDepotOptions(wd).Signer; signer != nil {
+		return opts.signExternally(depotContext(wd), wd, signer, csr, formattedReqName)
+	}
+
 	crt, err := depot.GetCertificate(wd, formattedCAName)
 	if err != nil {
 		return nil, errors.Wrap(err, "getting CA certificate")
@@ -311,6 +501,9 @@ func (opts *CertificateOptions) SignInMemory(wd Depot) (*pkix.Certificate, error
 	if !rawCrt.IsCA {
 		return nil, errors.Errorf("'%s' is not allowed to sign certificates", opts.CA)
 	}
+	if err = getCryptoPolicy(getDepotOptions(wd)).checkCertificate(formattedCAName, rawCrt, time.Now()); err != nil {
+		return nil, err
+	}
 
 	var key *pkix.Key
 	if opts.CAPassphrase == "" {
@@ -324,19 +517,107 @@ func (opts *CertificateOptions) SignInMemory(wd Depot) (*pkix.Certificate, error
 			return nil, errors.Wrap(err, "getting encrypted CA key")
 		}
 	}
+	// The CA key is only needed to sign this certificate.
+	defer zeroPrivateKey(key.Private)
+
+	req, err := opts.approveSign(wd, formattedReqName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	templateOpts, err := opts.templateOptions()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting certificate template options")
+	}
 
 	expiresTime := time.Now().Add(opts.Expires)
 	var crtOut *pkix.Certificate
 	if opts.Intermediate {
-		crtOut, err = pkix.CreateIntermediateCertificateAuthority(crt, key, csr, expiresTime)
+		crtOut, err = pkix.CreateIntermediateCertificateAuthorityWithOptions(crt, key, csr, expiresTime, append(templateOpts, opts.pathLenOption())...)
 	} else {
-		crtOut, err = pkix.CreateCertificateHost(crt, key, csr, expiresTime)
+		crtOut, err = createCertificateHost(crt, key, csr, expiresTime, templateOpts...)
 	}
 	if err != nil {
 		return nil, errors.Wrap(err, "creating certificate")
 	}
 
 	opts.crt = crtOut
+	grip.Info(message.Fields{
+		"message":   "issued certificate",
+		"op":        "sign",
+		"name":      req.Name,
+		"ca":        req.CA,
+		"principal": req.Principal,
+	})
+
+	return crtOut, nil
+}
+
+// approveSign describes the certificate that will be signed for the options
+// and consults the depot's IssuanceApprover and Attestor.
+func (opts *CertificateOptions) approveSign(wd Depot, name string) (IssuanceRequest, error) {
+	req, err := opts.issuanceRequest(depotContext(wd), name)
+	if err != nil {
+		return req, errors.Wrap(err, "describing certificate issuance")
+	}
+	if err = approveIssuance(wd, req); err != nil {
+		grip.Info(message.WrapError(err, message.Fields{
+			"message":   "certificate issuance denied",
+			"op":        "sign",
+			"name":      req.Name,
+			"ca":        req.CA,
+			"principal": req.Principal,
+		}))
+		return req, errors.Wrap(err, "approving certificate issuance")
+	}
+	if err = attestIssuance(wd, req, opts.Evidence); err != nil {
+		grip.Info(message.WrapError(err, message.Fields{
+			"message":   "certificate attestation failed",
+			"op":        "sign",
+			"name":      req.Name,
+			"ca":        req.CA,
+			"principal": req.Principal,
+		}))
+		return req, errors.Wrap(err, "attesting certificate issuance")
+	}
+
+	return req, nil
+}
+
+// signExternally signs the certificate request with an external Signer
+// instead of a CA key in the depot.
+func (opts *CertificateOptions) signExternally(ctx context.Context, wd Depot, signer Signer, csr *pkix.CertificateSigningRequest, name string) (*pkix.Certificate, error) {
+	req, err := opts.approveSign(wd, name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	crtOut, err := signer.Sign(ctx, csr, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "signing certificate with external signer")
+	}
+	if crtOut == nil {
+		return nil, errors.New("external signer did not return a certificate")
+	}
+	if policy := getCryptoPolicy(getDepotOptions(wd)); policy.enabled() {
+		rawCrt, err := crtOut.GetRawCertificate()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting raw certificate from external signer")
+		}
+		if err = policy.checkCertificate(name, rawCrt, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	opts.crt = crtOut
+	grip.Info(message.Fields{
+		"message":   "issued certificate",
+		"op":        "sign",
+		"signer":    fmt.Sprintf("%T", signer),
+		"name":      req.Name,
+		"ca":        req.CA,
+		"principal": req.Principal,
+	})
 
 	return crtOut, nil
 }
@@ -347,7 +628,7 @@ func (opts *CertificateOptions) PutCertFromMemory(wd Depot) error {
 	if !opts.signedInMemory() {
 		return errors.New("must sign cert first before putting into depot")
 	}
-	formattedReqName := strings.Replace(opts.Host, " ", "_", -1)
+	formattedReqName := opts.formattedCertificateName()
 
 	exists, err := CheckCertificateWithError(wd, formattedReqName)
 	if err != nil {
@@ -361,12 +642,12 @@ func (opts *CertificateOptions) PutCertFromMemory(wd Depot) error {
 		return errors.Wrap(err, "saving certificate")
 	}
 
-	if md, ok := wd.(*mongoDepot); ok {
+	if tracker, ok := wd.(ExpiryTracker); ok {
 		rawCrt, err := opts.crt.GetRawCertificate()
 		if err != nil {
 			return errors.Wrap(err, "getting raw certificate")
 		}
-		if err = md.PutTTL(formattedReqName, rawCrt.NotAfter); err != nil {
+		if err = tracker.PutTTL(formattedReqName, rawCrt.NotAfter); err != nil {
 			return errors.Wrap(err, "saving certificate TTL")
 		}
 	}
@@ -374,6 +655,56 @@ func (opts *CertificateOptions) PutCertFromMemory(wd Depot) error {
 	return nil
 }
 
+func (opts *CertificateOptions) pathLenOption() pkix.Option {
+	return pkix.WithPathlenOption(opts.MaxPathLen, opts.MaxPathLen < 0)
+}
+
+// formatName returns the name that the certificates for the name are stored
+// under in a depot. Spaces are replaced with underscores.
+func formatName(name string) string {
+	return strings.Replace(name, " ", "_", -1)
+}
+
+// reservedNames are the names that depots use to store their own data, such as
+// the registry of temporary credentials, rather than credentials. They are
+// never returned by ListNames.
+var reservedNames = map[string]bool{
+	temporaryRegistryName: true,
+	manifestName:          true,
+	aliasLockName:         true,
+}
+
+// withoutReservedNames returns the names except for the reserved names.
+func withoutReservedNames(names []string) []string {
+	filtered := names[:0]
+	for _, name := range names {
+		if !reservedNames[name] {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
+
+// canonicalName returns the formatted name for a name given to a depot, or an
+// error if the name cannot be stored in every depot or is reserved. Names must not contain
+// "..", which separates a name from the suffixes of ChainTag, SSHCertTag, and
+// ParamTag, so that a name such as "x..chain" cannot collide with the chain of
+// "x".
+func canonicalName(name string) (string, error) {
+	formatted := formatName(name)
+	if formatted == "" {
+		return "", errors.New("name cannot be empty")
+	}
+	if formatted == "." || strings.Contains(formatted, paramTagSeparator) || strings.ContainsAny(formatted, "/\\\x00") {
+		return "", errors.Errorf("name '%s' contains invalid characters", name)
+	}
+	if reservedNames[formatted] {
+		return "", errors.Errorf("name '%s' is reserved", name)
+	}
+
+	return formatted, nil
+}
+
 func getFormattedCertificateRequestName(name string) (string, error) {
 	filenameAcceptable, err := regexp.Compile("[^a-zA-Z0-9._-]")
 	if err != nil {
@@ -383,6 +714,9 @@ func getFormattedCertificateRequestName(name string) (string, error) {
 }
 
 func (opts CertificateOptions) getFormattedCertificateRequestName() (string, error) {
+	if opts.Name != "" {
+		return getFormattedCertificateRequestName(opts.Name)
+	}
 	name, err := opts.getCertificateRequestName()
 	if err != nil {
 		return "", errors.Wrap(err, "getting name for certificate request")
@@ -390,15 +724,80 @@ func (opts CertificateOptions) getFormattedCertificateRequestName() (string, err
 	return getFormattedCertificateRequestName(name)
 }
 
-func (opts CertificateOptions) getCertificateRequestName() (string, error) {
+// formattedCertificateName returns the name the certificate is stored under
+// in the depot, or an empty string if there is none.
+func (opts CertificateOptions) formattedCertificateName() string {
 	switch {
-	case opts.CommonName != "":
-		return opts.CommonName, nil
-	case len(opts.Domain) != 0:
-		return opts.Domain[0], nil
+	case opts.Name != "":
+		name, _ := getFormattedCertificateRequestName(opts.Name)
+		return name
+	case opts.Host != "":
+		return formatName(opts.Host)
 	default:
-		return "", errors.New("must provide a common name or domain")
+		// The certificate request is stored under the name derived from
+		// the requested identity, so the certificate is as well.
+		name, _ := opts.getFormattedCertificateRequestName()
+		return name
+	}
+}
+
+// StorageName returns the name that the certificate requested by the options
+// is stored under in the depot. It is Name if set, Host otherwise, and
+// otherwise the common name of the certificate request, which, if CommonName
+// is not set, is derived from the subject alt names as configured by
+// NameSources. Characters that cannot be stored, such as the colons of an
+// IPv6 address, are replaced with underscores for Name and a derived name,
+// and spaces are replaced with underscores for Host.
+func (opts CertificateOptions) StorageName() (string, error) {
+	name := opts.formattedCertificateName()
+	if name == "" {
+		_, err := opts.getCertificateRequestName()
+		return "", errors.Wrap(err, "must provide name or host")
 	}
+	return name, nil
+}
+
+// subjectAltNames returns the requested DNS names and IP addresses, including
+// the host if the options have a separate storage name.
+func (opts CertificateOptions) subjectAltNames() ([]string, []string) {
+	domains, ips := opts.Domain, opts.IP
+	if opts.Name == "" || opts.Host == "" {
+		return domains, ips
+	}
+
+	if net.ParseIP(opts.Host) != nil {
+		for _, ip := range ips {
+			if ip == opts.Host {
+				return domains, ips
+			}
+		}
+		return domains, append(append([]string{}, ips...), opts.Host)
+	}
+	for _, domain := range domains {
+		if domain == opts.Host {
+			return domains, ips
+		}
+	}
+	return append(append([]string{}, domains...), opts.Host), ips
+}
+
+func (opts CertificateOptions) getCertificateRequestName() (string, error) {
+	if opts.CommonName != "" {
+		return opts.CommonName, nil
+	}
+
+	sources := opts.NameSources
+	if len(sources) == 0 {
+		sources = defaultNameSources
+	}
+	domains, ips := opts.subjectAltNames()
+	for _, source := range sources {
+		if name := source.name(domains, ips); name != "" {
+			return name, nil
+		}
+	}
+
+	return "", errors.Errorf("must provide a common name or one of: %s", joinNameSources(sources))
 }
 
 func (opts CertificateOptions) getOrCreatePrivateKey() (*pkix.Key, error) {
@@ -409,9 +808,19 @@ func (opts CertificateOptions) getOrCreatePrivateKey() (*pkix.Key, error) {
 			return nil, errors.Wrapf(err, "reading key '%s'", opts.Key)
 		}
 		key, err = pkix.NewKeyFromPrivateKeyPEM(keyBytes)
+		zeroBytes(keyBytes)
 		if err != nil {
 			return nil, errors.Wrap(err, "getting key from PEM")
 		}
+	} else if opts.KeyType == KeyTypeECDSA {
+		curve, err := ecdsaCurve(opts.KeyBits)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		key, err = pkix.CreateECDSAKey(curve)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating ECDSA key")
+		}
 	} else {
 		if opts.KeyBits == 0 {
 			opts.KeyBits = 2048
@@ -425,27 +834,42 @@ func (opts CertificateOptions) getOrCreatePrivateKey() (*pkix.Key, error) {
 	return key, nil
 }
 
+// ecdsaCurve returns the elliptic curve with the given size in bits, or P-256
+// if the size is zero.
+func ecdsaCurve(bits int) (elliptic.Curve, error) {
+	switch bits {
+	case 0, 256:
+		return elliptic.P256(), nil
+	case 384:
+		return elliptic.P384(), nil
+	case 521:
+		return elliptic.P521(), nil
+	default:
+		return nil, errors.Errorf("no ECDSA curve with %d bits", bits)
+	}
+}
+
 func getNameAndKey(tag *depot.Tag) (string, string, error) {
-	if name := depot.GetNameFromCrtTag(tag); name != "" {
-		return strings.Replace(name, " ", "_", -1), userCertKey, nil
+	if name, param := GetNameFromParamTag(tag); name != "" {
+		return formatName(name), userParamsKey + "." + param, nil
 	}
-	if name := depot.GetNameFromPrivKeyTag(tag); name != "" {
-		return strings.Replace(name, " ", "_", -1), userPrivateKeyKey, nil
+	name, kind, err := ParseTag(tag)
+	if err != nil {
+		return "", "", errors.WithStack(err)
 	}
-	if name := depot.GetNameFromCsrTag(tag); name != "" {
+	if kind == CredentialCSR {
 		formattedName, err := getFormattedCertificateRequestName(name)
 		return formattedName, userCertReqKey, err
 	}
-	if name := depot.GetNameFromCrlTag(tag); name != "" {
-		return strings.Replace(name, " ", "_", -1), userCertRevocListKey, nil
-	}
-	return "", "", nil
+
+	return formatName(name), userKindKeys[kind], nil
 }
 
 // CreateCertificate is a convenience function for creating a certificate
-// request and signing it.
+// request and signing it. If DiscardCSR is set, the certificate request is not
+// stored in the depot.
 func (opts *CertificateOptions) CreateCertificate(wd Depot) error {
-	if err := opts.CertRequest(wd); err != nil {
+	if err := opts.certRequestForCreate(wd); err != nil {
 		return errors.Wrap(err, "creating the certificate request")
 	}
 	if err := opts.Sign(wd); err != nil {
@@ -455,33 +879,54 @@ func (opts *CertificateOptions) CreateCertificate(wd Depot) error {
 	return nil
 }
 
-// CreateCertificateOnExpiration checks if a certificate does not exist or if
-// it expires within the duration `after` and creates a new certificate if
-// either condition is met. True is returned if a certificate is created,
-// false otherwise. If the certificate is a CA, the behavior is undefined.
+// CreateCertificateOnExpiration checks if a certificate does not exist, if it
+// expires within the duration `after`, or if its common name or subject alt
+// names differ from those requested by the options, and creates a new
+// certificate if any condition is met. True is returned if a certificate is
+// created, false otherwise. If the certificate is a CA, the behavior is
+// undefined.
 func (opts *CertificateOptions) CreateCertificateOnExpiration(wd Depot, after time.Duration) (bool, error) {
-	var (
-		exists  bool
-		created bool
-		err     error
-	)
-	dne := true
+	dne, err := opts.deleteForRenewal(wd, after)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if !dne {
+		return false, nil
+	}
 
-	if exists, err = CheckCertificateWithError(wd, opts.CommonName); err != nil {
-		return created, err
-	} else if exists {
-		dne, err = DeleteOnExpiration(wd, opts.CommonName, after)
-		if err != nil {
-			return created, errors.Wrap(err, "deleting expiring certificate")
-		}
+	return true, errors.Wrap(opts.CreateCertificate(wd), "creating certificate")
+}
+
+// deleteForRenewal deletes the certificate requested by the options if it
+// expires within the duration `after` or if its common name or subject alt
+// names differ from those requested. True is returned if there is no
+// certificate in the depot afterwards.
+func (opts *CertificateOptions) deleteForRenewal(wd Depot, after time.Duration) (bool, error) {
+	name := opts.CommonName
+	if opts.Name != "" || name == "" {
+		name = opts.formattedCertificateName()
 	}
 
-	if dne {
-		err = opts.CreateCertificate(wd)
-		created = true
+	exists, err := CheckCertificateWithError(wd, name)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return true, nil
 	}
 
-	return created, errors.Wrap(err, "creating certificate")
+	dne, err := DeleteOnExpiration(wd, name, after)
+	if err != nil {
+		return false, errors.Wrap(err, "deleting expiring certificate")
+	}
+	if !dne {
+		dne, err = deleteOnSubjectChange(wd, name, *opts)
+		if err != nil {
+			return false, errors.Wrap(err, "deleting outdated certificate")
+		}
+	}
+
+	return dne, nil
 }
 
 // ValidityBounds returns the date range for which the certificate is valid.
@@ -518,7 +963,9 @@ func DeleteOnExpiration(wd Depot, name string, after time.Duration) (bool, error
 		}
 
 		if !rawCert.IsCA {
-			err = depot.DeleteCertificateSigningRequest(wd, name)
+			// The certificate request may not have been kept in the
+			// depot (see DiscardCSR).
+			err = deleteIfExists(wd, CsrTag(name))
 			if err != nil {
 				return deleted, errors.Wrap(err, "deleting expiring certificate signing request")
 			}
@@ -535,6 +982,40 @@ func DeleteOnExpiration(wd Depot, name string, after time.Duration) (bool, error
 	return deleted, nil
 }
 
+// deleteOnSubjectChange deletes the given certificate from the depot if its
+// common name or subject alt names differ from those requested by the options.
+// True is returned if the certificate is deleted, false otherwise.
+func deleteOnSubjectChange(wd Depot, name string, opts CertificateOptions) (bool, error) {
+	rawCert, err := getRawCertificate(wd, name)
+	if err != nil {
+		return false, errors.Wrap(err, "getting raw certificate")
+	}
+
+	diff, err := subjectDiff(rawCert, opts)
+	if err != nil {
+		return false, errors.Wrap(err, "comparing certificate subject")
+	}
+	if diff == "" {
+		return false, nil
+	}
+
+	csrName, err := getFormattedCertificateRequestName(name)
+	if err != nil {
+		return false, errors.Wrap(err, "getting certificate request name")
+	}
+	if err = deleteIfExists(wd, CrtTag(name), CsrTag(csrName), PrivKeyTag(name)); err != nil {
+		return false, errors.Wrap(err, "deleting certificate")
+	}
+
+	grip.Info(message.Fields{
+		"message": "deleted certificate with outdated subject",
+		"name":    name,
+		"reason":  diff,
+	})
+
+	return true, nil
+}
+
 func getRawCertificate(d Depot, name string) (*x509.Certificate, error) {
 	cert, err := depot.GetCertificate(d, name)
 	if err != nil {
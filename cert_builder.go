@@ -0,0 +1,276 @@
+package certdepot
+
+import (
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+)
+
+// CertificateOptionsBuilder builds CertificateOptions field by field,
+// validating them when they are built instead of leaving misconfigured options
+// to be silently ignored or to fail deep inside Init, CertRequest, or Sign.
+// Setting a field to an empty value or setting it twice to different values is
+// an error, while the methods that take lists append to them. Create one with
+// NewCertificateOptions.
+type CertificateOptionsBuilder struct {
+	opts    CertificateOptions
+	catcher grip.Catcher
+}
+
+// NewCertificateOptions returns a builder for CertificateOptions.
+func NewCertificateOptions() *CertificateOptionsBuilder {
+	return &CertificateOptionsBuilder{catcher: grip.NewBasicCatcher()}
+}
+
+// setString sets the field unless the value is empty or the field was already
+// set to a different value.
+func (b *CertificateOptionsBuilder) setString(field string, dst *string, value string) *CertificateOptionsBuilder {
+	switch {
+	case value == "":
+		b.catcher.Errorf("%s cannot be empty", field)
+	case *dst != "" && *dst != value:
+		b.catcher.Errorf("%s is set to both '%s' and '%s'", field, *dst, value)
+	default:
+		*dst = value
+	}
+	return b
+}
+
+// setInt sets the field unless it was already set to a different value.
+func (b *CertificateOptionsBuilder) setInt(field string, dst *int, value int) *CertificateOptionsBuilder {
+	if *dst != 0 && *dst != value {
+		b.catcher.Errorf("%s is set to both %d and %d", field, *dst, value)
+		return b
+	}
+	*dst = value
+	return b
+}
+
+// CommonName sets the Common Name (CN) field of the certificate.
+func (b *CertificateOptionsBuilder) CommonName(cn string) *CertificateOptionsBuilder {
+	return b.setString("common name", &b.opts.CommonName, cn)
+}
+
+// Organization sets the Organization (O) field of the certificate.
+func (b *CertificateOptionsBuilder) Organization(o string) *CertificateOptionsBuilder {
+	return b.setString("organization", &b.opts.Organization, o)
+}
+
+// OrganizationalUnit sets the Organizational Unit (OU) field of the
+// certificate.
+func (b *CertificateOptionsBuilder) OrganizationalUnit(ou string) *CertificateOptionsBuilder {
+	return b.setString("organizational unit", &b.opts.OrganizationalUnit, ou)
+}
+
+// Country sets the Country (C) field of the certificate.
+func (b *CertificateOptionsBuilder) Country(c string) *CertificateOptionsBuilder {
+	return b.setString("country", &b.opts.Country, c)
+}
+
+// Province sets the State/Province (ST) field of the certificate.
+func (b *CertificateOptionsBuilder) Province(st string) *CertificateOptionsBuilder {
+	return b.setString("province", &b.opts.Province, st)
+}
+
+// Locality sets the Locality (L) field of the certificate.
+func (b *CertificateOptionsBuilder) Locality(l string) *CertificateOptionsBuilder {
+	return b.setString("locality", &b.opts.Locality, l)
+}
+
+// Domains adds DNS subject alt names.
+func (b *CertificateOptionsBuilder) Domains(domains ...string) *CertificateOptionsBuilder {
+	b.opts.Domain = append(b.opts.Domain, domains...)
+	return b
+}
+
+// IPs adds IP address subject alt names.
+func (b *CertificateOptionsBuilder) IPs(ips ...string) *CertificateOptionsBuilder {
+	b.opts.IP = append(b.opts.IP, ips...)
+	return b
+}
+
+// URIs adds URI subject alt names.
+func (b *CertificateOptionsBuilder) URIs(uris ...string) *CertificateOptionsBuilder {
+	b.opts.URI = append(b.opts.URI, uris...)
+	return b
+}
+
+// NameSources adds the subject alt names that the common name of the
+// certificate request is derived from if it is not set.
+func (b *CertificateOptionsBuilder) NameSources(sources ...NameSource) *CertificateOptionsBuilder {
+	b.opts.NameSources = append(b.opts.NameSources, sources...)
+	return b
+}
+
+// Passphrase sets the passphrase that encrypts the private key.
+func (b *CertificateOptionsBuilder) Passphrase(passphrase string) *CertificateOptionsBuilder {
+	return b.setString("passphrase", &b.opts.Passphrase, passphrase)
+}
+
+// KeyFile sets the path to an existing private key PEM file to use instead of
+// generating a new key.
+func (b *CertificateOptionsBuilder) KeyFile(path string) *CertificateOptionsBuilder {
+	return b.setString("key file", &b.opts.Key, path)
+}
+
+// RSAKey generates an RSA key of the given size in bits.
+func (b *CertificateOptionsBuilder) RSAKey(bits int) *CertificateOptionsBuilder {
+	b.setString("key type", &b.opts.KeyType, KeyTypeRSA)
+	return b.setInt("key size", &b.opts.KeyBits, bits)
+}
+
+// ECDSAKey generates an ECDSA key on the curve with the given size in bits.
+func (b *CertificateOptionsBuilder) ECDSAKey(bits int) *CertificateOptionsBuilder {
+	b.setString("key type", &b.opts.KeyType, KeyTypeECDSA)
+	return b.setInt("key size", &b.opts.KeyBits, bits)
+}
+
+// Expires sets how long until the certificate expires.
+func (b *CertificateOptionsBuilder) Expires(d time.Duration) *CertificateOptionsBuilder {
+	if d == 0 {
+		b.catcher.New("expiration cannot be zero")
+		return b
+	}
+	if b.opts.Expires != 0 && b.opts.Expires != d {
+		b.catcher.Errorf("expiration is set to both %s and %s", b.opts.Expires, d)
+		return b
+	}
+	b.opts.Expires = d
+	return b
+}
+
+// Extensions adds custom X.509 extensions to the certificate.
+func (b *CertificateOptionsBuilder) Extensions(exts ...Extension) *CertificateOptionsBuilder {
+	b.opts.Extensions = append(b.opts.Extensions, exts...)
+	return b
+}
+
+// Policies adds the dotted-decimal OIDs of the certificate policies under
+// which the certificate is issued.
+func (b *CertificateOptionsBuilder) Policies(oids ...string) *CertificateOptionsBuilder {
+	b.opts.PolicyIdentifiers = append(b.opts.PolicyIdentifiers, oids...)
+	return b
+}
+
+// CPSURI sets the URI of the Certification Practice Statement.
+func (b *CertificateOptionsBuilder) CPSURI(uri string) *CertificateOptionsBuilder {
+	return b.setString("CPS URI", &b.opts.CPSURI, uri)
+}
+
+// Name sets the name the certificate is stored under in the depot.
+func (b *CertificateOptionsBuilder) Name(name string) *CertificateOptionsBuilder {
+	return b.setString("name", &b.opts.Name, name)
+}
+
+// Host sets the host name of the certificate to be signed.
+func (b *CertificateOptionsBuilder) Host(host string) *CertificateOptionsBuilder {
+	return b.setString("host", &b.opts.Host, host)
+}
+
+// CA sets the name of the CA that signs the certificate.
+func (b *CertificateOptionsBuilder) CA(ca string) *CertificateOptionsBuilder {
+	return b.setString("CA", &b.opts.CA, ca)
+}
+
+// CAPassphrase sets the passphrase that decrypts the CA's private key.
+func (b *CertificateOptionsBuilder) CAPassphrase(passphrase string) *CertificateOptionsBuilder {
+	return b.setString("CA passphrase", &b.opts.CAPassphrase, passphrase)
+}
+
+// Intermediate signs the certificate as an intermediate CA that allows the
+// given number of intermediate CAs to follow it in a certificate chain. A
+// negative maximum path length sets no limit.
+func (b *CertificateOptionsBuilder) Intermediate(maxPathLen int) *CertificateOptionsBuilder {
+	b.opts.Intermediate = true
+	return b.setInt("maximum path length", &b.opts.MaxPathLen, maxPathLen)
+}
+
+// MaxPathLen sets the maximum number of intermediate CAs that may follow a CA
+// created by Init in a certificate chain.
+func (b *CertificateOptionsBuilder) MaxPathLen(maxPathLen int) *CertificateOptionsBuilder {
+	return b.setInt("maximum path length", &b.opts.MaxPathLen, maxPathLen)
+}
+
+// Purpose sets the purpose of the certificate.
+func (b *CertificateOptionsBuilder) Purpose(purpose CertificatePurpose) *CertificateOptionsBuilder {
+	return b.setString("purpose", (*string)(&b.opts.Purpose), string(purpose))
+}
+
+// Principal sets the identity of the caller requesting the certificate.
+func (b *CertificateOptionsBuilder) Principal(principal string) *CertificateOptionsBuilder {
+	return b.setString("principal", &b.opts.Principal, principal)
+}
+
+// Evidence sets the evidence proving the identity of the host the certificate
+// is for.
+func (b *CertificateOptionsBuilder) Evidence(evidence *AttestationEvidence) *CertificateOptionsBuilder {
+	if evidence == nil {
+		b.catcher.New("evidence cannot be nil")
+		return b
+	}
+	b.opts.Evidence = evidence
+	return b
+}
+
+// DeleteCSR deletes the stored certificate request once the certificate has
+// been signed.
+func (b *CertificateOptionsBuilder) DeleteCSR() *CertificateOptionsBuilder {
+	b.opts.DeleteCSR = true
+	return b
+}
+
+// DiscardCSR keeps the certificate request only in memory in
+// CreateCertificate.
+func (b *CertificateOptionsBuilder) DiscardCSR() *CertificateOptionsBuilder {
+	b.opts.DiscardCSR = true
+	return b
+}
+
+// Build returns the options, or all the errors from setting them along with
+// any malformed subject alt names, extensions, policies, expiration, or key
+// options. Use BuildFor to also check that the options required by an
+// operation are set. Each call returns new options, so the builder can be
+// reused as a template.
+func (b *CertificateOptionsBuilder) Build() (*CertificateOptions, error) {
+	catcher := grip.NewBasicCatcher()
+	catcher.Add(b.catcher.Resolve())
+
+	opts := b.copyOptions()
+	opts.validateSubjectAltNames(catcher)
+	opts.validateIssuance(catcher)
+	opts.validateKey(catcher)
+	catcher.NewWhen(opts.Purpose != "" && opts.Intermediate, "cannot set purpose of an intermediate CA")
+	if catcher.HasErrors() {
+		return nil, errors.Wrap(catcher.Resolve(), "invalid certificate options")
+	}
+
+	return opts, nil
+}
+
+// BuildFor is like Build, but also validates the options for the operation
+// (see Validate).
+func (b *CertificateOptionsBuilder) BuildFor(op CertificateOperation) (*CertificateOptions, error) {
+	opts, err := b.Build()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = opts.Validate(op); err != nil {
+		return nil, errors.Wrapf(err, "invalid certificate options for %s", op)
+	}
+
+	return opts, nil
+}
+
+// copyOptions returns a copy of the options that does not share lists with
+// the builder.
+func (b *CertificateOptionsBuilder) copyOptions() *CertificateOptions {
+	opts := b.opts
+	opts.IP = append([]string(nil), b.opts.IP...)
+	opts.Domain = append([]string(nil), b.opts.Domain...)
+	opts.URI = append([]string(nil), b.opts.URI...)
+	opts.NameSources = append([]NameSource(nil), b.opts.NameSources...)
+	opts.Extensions = append([]Extension(nil), b.opts.Extensions...)
+	opts.PolicyIdentifiers = append([]string(nil), b.opts.PolicyIdentifiers...)
+	return &opts
+}
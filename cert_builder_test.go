@@ -0,0 +1,103 @@
+package certdepot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateOptionsBuilder(t *testing.T) {
+	t.Run("BuildsOptions", func(t *testing.T) {
+		opts, err := NewCertificateOptions().
+			CommonName("bob").
+			Domains("bob.example.com").
+			Domains("*.bob.example.com").
+			IPs("10.0.0.1").
+			ECDSAKey(384).
+			Expires(24 * time.Hour).
+			CA("root").
+			Purpose(PurposeServer).
+			DeleteCSR().
+			Build()
+		require.NoError(t, err)
+		assert.Equal(t, &CertificateOptions{
+			CommonName: "bob",
+			Domain:     []string{"bob.example.com", "*.bob.example.com"},
+			IP:         []string{"10.0.0.1"},
+			KeyType:    KeyTypeECDSA,
+			KeyBits:    384,
+			Expires:    24 * time.Hour,
+			CA:         "root",
+			Purpose:    PurposeServer,
+			DeleteCSR:  true,
+		}, opts)
+	})
+	t.Run("ReportsAllErrors", func(t *testing.T) {
+		_, err := NewCertificateOptions().
+			CommonName("").
+			Host("a").
+			Host("b").
+			Domains("bad domain").
+			IPs("not-an-ip").
+			Expires(time.Second).
+			RSAKey(2048).
+			ECDSAKey(256).
+			Build()
+		require.Error(t, err)
+		for _, msg := range []string{
+			"common name cannot be empty",
+			"host is set to both 'a' and 'b'",
+			"invalid domain 'bad domain'",
+			"invalid IP address 'not-an-ip'",
+			"shorter than the minimum",
+			"key type is set to both 'rsa' and 'ecdsa'",
+			"key size is set to both 2048 and 256",
+		} {
+			assert.Contains(t, err.Error(), msg)
+		}
+	})
+	t.Run("ValidatesForOperation", func(t *testing.T) {
+		b := NewCertificateOptions().Host("bob").Expires(time.Hour)
+		_, err := b.BuildFor(OperationSign)
+		assert.Error(t, err)
+
+		opts, err := b.CA("root").BuildFor(OperationSign)
+		require.NoError(t, err)
+		assert.Equal(t, "root", opts.CA)
+
+		_, err = NewCertificateOptions().CommonName("ca").Purpose(PurposeClient).BuildFor(OperationInit)
+		assert.Error(t, err)
+	})
+	t.Run("ReturnsIndependentOptions", func(t *testing.T) {
+		b := NewCertificateOptions().CommonName("bob").Domains("bob.example.com")
+		first, err := b.Build()
+		require.NoError(t, err)
+		first.Domain[0] = "changed.example.com"
+
+		second, err := b.Domains("alice.example.com").Build()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"bob.example.com", "alice.example.com"}, second.Domain)
+	})
+	t.Run("CreatesCertificates", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir(".", "cert-builder-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		}()
+		d, err := MakeFileDepot(tempDir, DepotOptions{})
+		require.NoError(t, err)
+
+		caOpts, err := NewCertificateOptions().CommonName("root").Expires(time.Hour).BuildFor(OperationInit)
+		require.NoError(t, err)
+		require.NoError(t, caOpts.Init(d))
+
+		opts, err := NewCertificateOptions().CommonName("bob").Host("bob").CA("root").Expires(time.Hour).BuildFor(OperationSign)
+		require.NoError(t, err)
+		require.NoError(t, opts.CreateCertificate(d))
+		assert.True(t, d.Check(CrtTag("bob")))
+	})
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/mongodb/grip"
+	"github.com/square/certstrap/depot"
 	"github.com/square/certstrap/pkix"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -201,14 +202,17 @@ func TestCertRequest(t *testing.T) {
 		hasErr     bool
 	}{
 		{
-			name:       "NoCommonNameOrDomain",
-			changeOpts: func() {},
-			hasErr:     true,
+			name: "NoCommonNameOrDomain",
+			changeOpts: func() {
+				opts.NameSources = []NameSource{NameSourceDomain}
+			},
+			hasErr: true,
 		},
 		{
 			name:    "NewCSRWithOutCommonName",
 			csrName: "evergreen",
 			changeOpts: func() {
+				opts.NameSources = nil
 				opts.Domain = []string{"evergreen"}
 			},
 			keyTest: func() {
@@ -906,6 +910,83 @@ func TestCreateCertificateOnExpiration(t *testing.T) {
 	assert.True(t, rawUserCrt.NotBefore.Before(time.Now()))
 	assert.True(t, rawUserCrt.NotAfter.Before(time.Now().Add(time.Hour)))
 	assert.False(t, rawUserCrt.IsCA)
+
+	// user cert exists and not expiring, but SANs changed
+	opts.Reset()
+	opts.Expires = 24 * time.Hour
+	opts.Domain = []string{"user.example.com"}
+	created, err = opts.CreateCertificateOnExpiration(d, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	rawUserCrt, err = getRawCertificate(d, user)
+	require.NoError(t, err)
+	assert.Equal(t, opts.Domain, rawUserCrt.DNSNames)
+	assert.True(t, rawUserCrt.NotAfter.After(time.Now().Add(23*time.Hour)))
+
+	// user cert exists with the same SANs
+	opts.Reset()
+	created, err = opts.CreateCertificateOnExpiration(d, time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, created)
+
+	// user cert expiring and CSR discarded
+	opts.Reset()
+	opts.DiscardCSR = true
+	created, err = opts.CreateCertificateOnExpiration(d, 25*time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.True(t, CheckCertificate(d, user))
+	assert.True(t, CheckPrivateKey(d, user))
+	assert.False(t, CheckCertificateSigningRequest(d, user))
+
+	// user cert expiring without a CSR in the depot
+	opts.Reset()
+	created, err = opts.CreateCertificateOnExpiration(d, 25*time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.False(t, CheckCertificateSigningRequest(d, user))
+}
+
+func TestDeleteCSRAfterSign(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "cert-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	for testName, testCase := range map[string]struct {
+		depotOpts DepotOptions
+		deleteCSR bool
+		keepsCSR  bool
+	}{
+		"KeepsCSRByDefault": {keepsCSR: true},
+		"DeletesCSRWithOption": {
+			deleteCSR: true,
+		},
+		"DeletesCSRWithDepotOption": {
+			depotOpts: DepotOptions{DeleteCSRAfterSign: true},
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			testCase.depotOpts.CA = "root"
+			d, err := MakeFileDepot(filepath.Join(tempDir, testName), testCase.depotOpts)
+			require.NoError(t, err)
+			caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+			require.NoError(t, caOpts.Init(d))
+
+			opts := CertificateOptions{
+				CA:         "root",
+				CommonName: "user",
+				Host:       "user",
+				Expires:    time.Hour,
+				DeleteCSR:  testCase.deleteCSR,
+			}
+			require.NoError(t, opts.CreateCertificate(d))
+			assert.True(t, CheckCertificate(d, "user"))
+			assert.True(t, CheckPrivateKey(d, "user"))
+			assert.Equal(t, testCase.keepsCSR, CheckCertificateSigningRequest(d, "user"))
+		})
+	}
 }
 
 func convertIPs(ips []string) []net.IP {
@@ -916,3 +997,112 @@ func convertIPs(ips []string) []net.IP {
 
 	return converted
 }
+
+func TestExpirationDefaults(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "cert-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	t.Run("FailsWithoutDefault", func(t *testing.T) {
+		d, err := NewFileDepot(tempDir)
+		require.NoError(t, err)
+
+		caOpts := CertificateOptions{CommonName: "nodefault"}
+		assert.Error(t, caOpts.Init(d))
+		assert.False(t, CheckCertificate(d, "nodefault"))
+	})
+	t.Run("FailsBelowMinimum", func(t *testing.T) {
+		d, err := MakeFileDepot(tempDir, DepotOptions{DefaultExpiration: time.Hour})
+		require.NoError(t, err)
+
+		for _, expires := range []time.Duration{-time.Hour, time.Second} {
+			caOpts := CertificateOptions{CommonName: "short", Expires: expires}
+			assert.Error(t, caOpts.Init(d))
+			assert.False(t, CheckCertificate(d, "short"))
+		}
+	})
+	t.Run("UsesDepotDefault", func(t *testing.T) {
+		d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: 2 * time.Hour})
+		require.NoError(t, err)
+
+		caOpts := CertificateOptions{CommonName: "root"}
+		require.NoError(t, caOpts.Init(d))
+		crt, err := getRawCertificate(d, "root")
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(2*time.Hour), crt.NotAfter, time.Minute)
+
+		opts := CertificateOptions{CommonName: "user", Host: "user", CA: "root"}
+		require.NoError(t, opts.CreateCertificate(d))
+		crt, err = getRawCertificate(d, "user")
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(2*time.Hour), crt.NotAfter, time.Minute)
+
+		opts = CertificateOptions{CommonName: "short", Host: "short", CA: "root", Expires: time.Second}
+		assert.Error(t, opts.CreateCertificate(d))
+		assert.False(t, CheckCertificate(d, "short"))
+	})
+}
+
+func TestCertificateName(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "cert-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root"}
+	require.NoError(t, caOpts.Init(d))
+
+	t.Run("StoresUnderNameWithHostAsSAN", func(t *testing.T) {
+		opts := CertificateOptions{
+			Name:   "web service",
+			Host:   "web.example.com",
+			Domain: []string{"web.internal"},
+			IP:     []string{"10.0.0.1"},
+			CA:     "root",
+		}
+		require.NoError(t, opts.CreateCertificate(d))
+
+		for _, tag := range []*depot.Tag{CrtTag("web_service"), PrivKeyTag("web_service"), CsrTag("web_service")} {
+			assert.True(t, d.Check(tag))
+		}
+		assert.False(t, CheckCertificate(d, "web.example.com"))
+
+		crt, err := getRawCertificate(d, "web_service")
+		require.NoError(t, err)
+		assert.Equal(t, "web.internal", crt.Subject.CommonName)
+		assert.ElementsMatch(t, []string{"web.internal", "web.example.com"}, crt.DNSNames)
+		assert.Equal(t, convertIPs([]string{"10.0.0.1"}), crt.IPAddresses)
+
+		opts.Reset()
+		created, err := opts.CreateCertificateOnExpiration(d, time.Minute)
+		require.NoError(t, err)
+		assert.False(t, created)
+
+		opts.Reset()
+		opts.Host = "web2.example.com"
+		created, err = opts.CreateCertificateOnExpiration(d, time.Minute)
+		require.NoError(t, err)
+		assert.True(t, created)
+		crt, err = getRawCertificate(d, "web_service")
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"web.internal", "web2.example.com"}, crt.DNSNames)
+	})
+	t.Run("AddsIPHostAsIPAddress", func(t *testing.T) {
+		opts := CertificateOptions{
+			Name:       "db",
+			CommonName: "db",
+			Host:       "10.0.0.2",
+			CA:         "root",
+		}
+		require.NoError(t, opts.CreateCertificate(d))
+
+		crt, err := getRawCertificate(d, "db")
+		require.NoError(t, err)
+		assert.Empty(t, crt.DNSNames)
+		assert.Equal(t, convertIPs([]string{"10.0.0.2"}), crt.IPAddresses)
+	})
+}
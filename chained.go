@@ -0,0 +1,182 @@
+package certdepot
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+// chainedDepot is a Depot that reads through from a local depot to a parent
+// depot and only writes to the local depot.
+type chainedDepot struct {
+	local  Depot
+	parent Depot
+}
+
+// MakeChainedDepot returns a depot layered on top of a parent depot, such as
+// a region-local MongoDB depot on top of a global one. Reads are served by the
+// local depot and fall through to the parent depot for data the local depot
+// does not have, such as CA certificates, while writes, including certificates
+// issued by the chained depot, only go to the local depot. Deletes only
+// remove data from the local depot.
+//
+// The depot options are the local depot's, with any unset fields filled in
+// from the parent depot's. Expiration tracking is delegated to the local
+// depot if it implements ExpiryTracker.
+func MakeChainedDepot(local, parent Depot) (Depot, error) {
+	if local == nil || parent == nil {
+		return nil, errors.New("must specify local and parent depots")
+	}
+
+	return &chainedDepot{local: local, parent: parent}, nil
+}
+
+// Put inserts the data into the local depot.
+func (c *chainedDepot) Put(tag *depot.Tag, data []byte) error {
+	return c.local.Put(tag, data)
+}
+
+// Check returns whether the data exists in either depot.
+func (c *chainedDepot) Check(tag *depot.Tag) bool {
+	return c.local.Check(tag) || c.parent.Check(tag)
+}
+
+// CheckWithError returns whether the data exists in either depot.
+func (c *chainedDepot) CheckWithError(tag *depot.Tag) (bool, error) {
+	exists, err := c.local.CheckWithError(tag)
+	if err != nil {
+		return false, errors.Wrap(err, "checking local depot")
+	}
+	if exists {
+		return true, nil
+	}
+
+	exists, err = c.parent.CheckWithError(tag)
+	return exists, errors.Wrap(err, "checking parent depot")
+}
+
+// Get reads the data from the local depot, or from the parent depot if the
+// local depot does not have it.
+func (c *chainedDepot) Get(tag *depot.Tag) ([]byte, error) {
+	data, exists, err := GetIfExists(c.local, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting from local depot")
+	}
+	if exists {
+		return data, nil
+	}
+
+	return c.parent.Get(tag)
+}
+
+// GetIfExists reads the data from the local depot, or from the parent depot
+// if the local depot does not have it.
+func (c *chainedDepot) GetIfExists(tag *depot.Tag) ([]byte, bool, error) {
+	data, exists, err := GetIfExists(c.local, tag)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "getting from local depot")
+	}
+	if exists {
+		return data, true, nil
+	}
+
+	data, exists, err = GetIfExists(c.parent, tag)
+	return data, exists, errors.Wrap(err, "getting from parent depot")
+}
+
+// Delete removes the data from the local depot.
+func (c *chainedDepot) Delete(tag *depot.Tag) error {
+	return c.local.Delete(tag)
+}
+
+func (c *chainedDepot) Save(name string, creds *Credentials) error {
+	return depotSave(c, name, creds)
+}
+
+func (c *chainedDepot) Find(name string) (*Credentials, error) {
+	return depotFind(c, name, c.DepotOptions())
+}
+
+func (c *chainedDepot) Generate(name string) (*Credentials, error) {
+	return depotGenerateDefault(c, name, c.DepotOptions())
+}
+
+func (c *chainedDepot) GenerateWithOptions(opts CertificateOptions) (*Credentials, error) {
+	return depotGenerate(c, opts.CommonName, c.DepotOptions(), opts)
+}
+
+// DepotOptions returns the local depot's options, with any unset fields
+// filled in from the parent depot's.
+func (c *chainedDepot) DepotOptions() DepotOptions {
+	return getDepotOptions(c.local).withDefaults(getDepotOptions(c.parent))
+}
+
+// ListNames returns the names in either depot. Both depots must implement
+// NameLister.
+func (c *chainedDepot) ListNames() ([]string, error) {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, dpt := range []Depot{c.local, c.parent} {
+		lister, ok := dpt.(NameLister)
+		if !ok {
+			return nil, errors.Errorf("depot of type %T cannot list names", dpt)
+		}
+		layerNames, err := lister.ListNames()
+		if err != nil {
+			return nil, errors.Wrap(err, "listing names")
+		}
+		for _, name := range layerNames {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// PutTTL sets when the credentials for the name expire in the local depot.
+// It does nothing if the local depot does not track expiration.
+func (c *chainedDepot) PutTTL(name string, expiration time.Time) error {
+	return putTTL(c.local, name, expiration)
+}
+
+// GetTTL returns when the credentials for the name expire in the local depot,
+// or the zero time if the local depot does not track expiration.
+func (c *chainedDepot) GetTTL(name string) (time.Time, error) {
+	tracker, ok := c.local.(ExpiryTracker)
+	if !ok {
+		return time.Time{}, nil
+	}
+	return tracker.GetTTL(name)
+}
+
+// FindExpiresBefore returns the entries in the local depot that expire before
+// the cutoff.
+func (c *chainedDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
+	tracker, ok := c.local.(ExpiryTracker)
+	if !ok {
+		return []User{}, nil
+	}
+	return tracker.FindExpiresBefore(cutoff)
+}
+
+// DeleteExpiresBefore removes the entries in the local depot that expire
+// before the cutoff.
+func (c *chainedDepot) DeleteExpiresBefore(cutoff time.Time) error {
+	tracker, ok := c.local.(ExpiryTracker)
+	if !ok {
+		return nil
+	}
+	return tracker.DeleteExpiresBefore(cutoff)
+}
+
+// DeleteMatching removes the entries matching the pattern from the local
+// depot.
+func (c *chainedDepot) DeleteMatching(pattern string) (int, error) {
+	return DeleteMatching(c.local, pattern)
+}
@@ -0,0 +1,88 @@
+package certdepot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainedDepot(t *testing.T) {
+	newFileDepot := func(t *testing.T, opts DepotOptions) Depot {
+		tempDir, err := ioutil.TempDir(".", "chained-test")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		})
+		d, err := MakeFileDepot(tempDir, opts)
+		require.NoError(t, err)
+		return d
+	}
+
+	t.Run("Conformance", func(t *testing.T) {
+		opts := DepotOptions{CA: ConformanceSuiteCA, DefaultExpiration: time.Hour}
+		DepotConformanceSuite(t, func() Depot {
+			d, err := MakeChainedDepot(newFileDepot(t, opts), newFileDepot(t, opts))
+			require.NoError(t, err)
+			return d
+		})
+	})
+	t.Run("FailsWithoutParent", func(t *testing.T) {
+		_, err := MakeChainedDepot(newFileDepot(t, DepotOptions{}), nil)
+		assert.Error(t, err)
+	})
+
+	parent := newFileDepot(t, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(parent))
+	local := newFileDepot(t, DepotOptions{})
+	d, err := MakeChainedDepot(local, parent)
+	require.NoError(t, err)
+
+	t.Run("InheritsParentOptions", func(t *testing.T) {
+		do := getDepotOptions(d)
+		assert.Equal(t, "root", do.CA)
+		assert.Equal(t, time.Hour, do.DefaultExpiration)
+	})
+	t.Run("ReadsThroughToParent", func(t *testing.T) {
+		assert.True(t, CheckCertificate(d, "root"))
+		assert.False(t, CheckCertificate(local, "root"))
+		caCrt, err := d.Get(CrtTag("root"))
+		require.NoError(t, err)
+		parentCACrt, err := parent.Get(CrtTag("root"))
+		require.NoError(t, err)
+		assert.Equal(t, parentCACrt, caCrt)
+	})
+	t.Run("WritesLocally", func(t *testing.T) {
+		creds, err := d.Generate("alice")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("alice", creds))
+
+		assert.True(t, CheckCertificate(local, "alice"))
+		assert.False(t, CheckCertificate(parent, "alice"))
+		found, err := d.Find("alice")
+		require.NoError(t, err)
+		assert.Equal(t, creds.Cert, found.Cert)
+
+		names, err := d.(NameLister).ListNames()
+		require.NoError(t, err)
+		assert.Contains(t, names, "alice")
+		assert.Contains(t, names, "root")
+	})
+	t.Run("LocalShadowsParent", func(t *testing.T) {
+		require.NoError(t, parent.Put(ParamTag("bob", "dhparam"), []byte("parent")))
+		require.NoError(t, d.Put(ParamTag("bob", "dhparam"), []byte("local")))
+
+		data, err := d.Get(ParamTag("bob", "dhparam"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("local"), data)
+
+		require.NoError(t, d.Delete(ParamTag("bob", "dhparam")))
+		data, err = d.Get(ParamTag("bob", "dhparam"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("parent"), data)
+	})
+}
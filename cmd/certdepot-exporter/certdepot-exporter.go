@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/evergreen-ci/certdepot"
+	"github.com/pkg/errors"
+)
+
+// certdepot-exporter serves the expiration of every certificate in a depot in
+// the Prometheus text exposition format, so that expiring certificates can be
+// alerted on.
+func main() {
+	var (
+		fileDepot      string
+		mongoDBURI     string
+		databaseName   string
+		collectionName string
+		listenAddr     string
+		metricsPath    string
+		scrapeTimeout  time.Duration
+		workers        int
+	)
+
+	flag.StringVar(&fileDepot, "fileDepot", "", "directory of the file depot to export")
+	flag.StringVar(&mongoDBURI, "mongodbURI", "", "URI of the MongoDB depot to export")
+	flag.StringVar(&databaseName, "dbName", "certDepot", "database of the MongoDB depot")
+	flag.StringVar(&collectionName, "collName", "certs", "collection of the MongoDB depot")
+	flag.StringVar(&listenAddr, "listen", ":9469", "address to serve metrics on")
+	flag.StringVar(&metricsPath, "path", "/metrics", "path to serve metrics on")
+	flag.DurationVar(&scrapeTimeout, "timeout", 30*time.Second, "timeout for reading the depot on each scrape")
+	flag.IntVar(&workers, "workers", 1, "number of certificates to read at once on each scrape")
+	flag.Parse()
+
+	d, err := openDepot(context.Background(), fileDepot, mongoDBURI, databaseName, collectionName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write(collectMetrics(ctx, d, certdepot.WorkerPoolOptions{Workers: workers}, time.Now()))
+	})
+
+	if err := http.ListenAndServe(listenAddr, mux); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// openDepot opens the file depot if a directory is given, or the MongoDB
+// depot otherwise.
+func openDepot(ctx context.Context, fileDepot, mongoDBURI, databaseName, collectionName string) (certdepot.Depot, error) {
+	if fileDepot != "" && mongoDBURI != "" {
+		return nil, errors.New("cannot specify both a file depot and a MongoDB depot")
+	}
+	if fileDepot != "" {
+		d, err := certdepot.NewFileDepot(fileDepot)
+		return d, errors.Wrap(err, "opening file depot")
+	}
+	if mongoDBURI == "" {
+		return nil, errors.New("must specify a file depot or a MongoDB depot")
+	}
+
+	d, err := certdepot.NewMongoDBCertDepot(ctx, &certdepot.MongoDBOptions{
+		MongoDBURI:     mongoDBURI,
+		DatabaseName:   databaseName,
+		CollectionName: collectionName,
+	})
+	return d, errors.Wrap(err, "opening MongoDB depot")
+}
+
+// collectMetrics reads the certificate expirations from the depot and formats
+// them as Prometheus metrics.
+func collectMetrics(ctx context.Context, d certdepot.Depot, opts certdepot.WorkerPoolOptions, now time.Time) []byte {
+	buf := &bytes.Buffer{}
+
+	start := time.Now()
+	expirations, err := certdepot.ListCertificateExpirationsWithOptions(ctx, d, opts)
+	duration := time.Since(start)
+
+	writeHeader(buf, "certdepot_scrape_success", "Whether the certificate depot was read successfully.")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading certificate expirations: %s\n", err)
+		fmt.Fprintln(buf, "certdepot_scrape_success 0")
+		return buf.Bytes()
+	}
+	fmt.Fprintln(buf, "certdepot_scrape_success 1")
+
+	writeHeader(buf, "certdepot_scrape_duration_seconds", "How long it took to read the certificate depot.")
+	fmt.Fprintf(buf, "certdepot_scrape_duration_seconds %g\n", duration.Seconds())
+
+	writeHeader(buf, "certdepot_certificate_expiry_timestamp_seconds", "When the certificate expires, in seconds since the Unix epoch.")
+	for _, exp := range expirations {
+		fmt.Fprintf(buf, "certdepot_certificate_expiry_timestamp_seconds{%s} %d\n", labels(exp), exp.NotAfter.Unix())
+	}
+
+	writeHeader(buf, "certdepot_certificate_expires_in_seconds", "How long until the certificate expires, negative if it has expired.")
+	for _, exp := range expirations {
+		fmt.Fprintf(buf, "certdepot_certificate_expires_in_seconds{%s} %g\n", labels(exp), exp.NotAfter.Sub(now).Seconds())
+	}
+
+	expired := 0
+	for _, exp := range expirations {
+		if exp.NotAfter.Before(now) {
+			expired++
+		}
+	}
+	writeHeader(buf, "certdepot_certificates", "The number of certificates in the depot.")
+	fmt.Fprintf(buf, "certdepot_certificates %d\n", len(expirations))
+	writeHeader(buf, "certdepot_certificates_expired", "The number of expired certificates in the depot.")
+	fmt.Fprintf(buf, "certdepot_certificates_expired %d\n", expired)
+
+	return buf.Bytes()
+}
+
+func writeHeader(buf *bytes.Buffer, name, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+}
+
+func labels(exp certdepot.CertificateExpiration) string {
+	return fmt.Sprintf(`name="%s",cn="%s",is_ca="%t",purpose="%s"`, escapeLabel(exp.Name), escapeLabel(exp.CommonName), exp.IsCA, escapeLabel(string(exp.Purpose)))
+}
+
+// escapeLabel escapes a label value for the Prometheus text format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/evergreen-ci/certdepot"
+	"github.com/pkg/errors"
+)
+
+// certdepot-reconcile converges a depot to the certificates declared in a
+// JSON specs file. By default it only prints the plan of changes as JSON, so
+// that it can be reviewed before it is applied with -apply.
+func main() {
+	var (
+		fileDepot      string
+		mongoDBURI     string
+		databaseName   string
+		collectionName string
+		specsPath      string
+		apply          bool
+		detailedExit   bool
+		timeout        time.Duration
+		workers        int
+	)
+
+	flag.StringVar(&fileDepot, "fileDepot", "", "directory of the file depot to reconcile")
+	flag.StringVar(&mongoDBURI, "mongodbURI", "", "URI of the MongoDB depot to reconcile")
+	flag.StringVar(&databaseName, "dbName", "certDepot", "database of the MongoDB depot")
+	flag.StringVar(&collectionName, "collName", "certs", "collection of the MongoDB depot")
+	flag.StringVar(&specsPath, "specs", "", "path to the JSON list of certificate specs")
+	flag.BoolVar(&apply, "apply", false, "make the changes instead of only planning them")
+	flag.BoolVar(&detailedExit, "detailed-exitcode", false, "exit with status 2 if there are changes")
+	flag.DurationVar(&timeout, "timeout", 5*time.Minute, "timeout for reconciling the depot")
+	flag.IntVar(&workers, "workers", 1, "number of certificates to converge at once")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	res, err := run(ctx, fileDepot, mongoDBURI, databaseName, collectionName, specsPath, certdepot.ReconcileOptions{
+		Plan:              !apply,
+		WorkerPoolOptions: certdepot.WorkerPoolOptions{Workers: workers},
+	})
+	if res != nil {
+		out, exportErr := res.Export()
+		if exportErr != nil {
+			fmt.Fprintln(os.Stderr, exportErr)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if detailedExit && res.HasChanges() {
+		os.Exit(2)
+	}
+}
+
+func run(ctx context.Context, fileDepot, mongoDBURI, databaseName, collectionName, specsPath string, opts certdepot.ReconcileOptions) (*certdepot.ReconcileResult, error) {
+	if specsPath == "" {
+		return nil, errors.New("must specify a certificate specs file")
+	}
+	specs, err := certdepot.NewCertificateSpecsFromFile(specsPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	d, err := openDepot(ctx, fileDepot, mongoDBURI, databaseName, collectionName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	res, err := certdepot.ReconcileWithOptions(ctx, d, specs, opts)
+	if opts.Plan {
+		return res, errors.Wrap(err, "planning depot reconciliation")
+	}
+	return res, errors.Wrap(err, "reconciling depot")
+}
+
+// openDepot opens the file depot if a directory is given, or the MongoDB
+// depot otherwise.
+func openDepot(ctx context.Context, fileDepot, mongoDBURI, databaseName, collectionName string) (certdepot.Depot, error) {
+	if fileDepot != "" && mongoDBURI != "" {
+		return nil, errors.New("cannot specify both a file depot and a MongoDB depot")
+	}
+	if fileDepot != "" {
+		d, err := certdepot.NewFileDepot(fileDepot)
+		return d, errors.Wrap(err, "opening file depot")
+	}
+	if mongoDBURI == "" {
+		return nil, errors.New("must specify a file depot or a MongoDB depot")
+	}
+
+	d, err := certdepot.NewMongoDBCertDepot(ctx, &certdepot.MongoDBOptions{
+		MongoDBURI:     mongoDBURI,
+		DatabaseName:   databaseName,
+		CollectionName: collectionName,
+	})
+	return d, errors.Wrap(err, "opening MongoDB depot")
+}
@@ -0,0 +1,160 @@
+package certdepot
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ConformanceSuiteCA is the name of the CA that DepotConformanceSuite creates
+// in each depot. Depots passed to the suite must be configured with it as
+// their DepotOptions.CA.
+const ConformanceSuiteCA = "conformance_root"
+
+// DepotConformanceSuite runs the behavior every Depot implementation must
+// have against depots returned by newDepot, so that authors of other depot
+// backends can verify them. newDepot is called once per test and must return
+// an empty depot configured with ConformanceSuiteCA as its CA; any cleanup
+// should be registered with t.Cleanup.
+//
+// The suite does not test behavior that differs between the depots in this
+// package, such as whether Put overwrites existing data or whether Delete
+// fails if there is nothing to delete.
+func DepotConformanceSuite(t *testing.T, newDepot func() Depot) {
+	tags := map[string]func(string) *depot.Tag{
+		"Certificate":        CrtTag,
+		"PrivateKey":         PrivKeyTag,
+		"CertificateRequest": CsrTag,
+		"RevocationList":     CrlTag,
+		"Param": func(name string) *depot.Tag {
+			return ParamTag(name, "dhparam")
+		},
+	}
+
+	for tagName, makeTag := range tags {
+		t.Run(tagName, func(t *testing.T) {
+			t.Run("PutThenGet", func(t *testing.T) {
+				d := newDepot()
+				require.NoError(t, d.Put(makeTag("alice"), []byte("data")))
+
+				data, err := d.Get(makeTag("alice"))
+				require.NoError(t, err)
+				assert.Equal(t, []byte("data"), data)
+				assert.True(t, d.Check(makeTag("alice")))
+				exists, err := d.CheckWithError(makeTag("alice"))
+				require.NoError(t, err)
+				assert.True(t, exists)
+			})
+			t.Run("MissingDoesNotExist", func(t *testing.T) {
+				d := newDepot()
+
+				_, err := d.Get(makeTag("alice"))
+				assert.Error(t, err)
+				assert.False(t, d.Check(makeTag("alice")))
+				exists, err := d.CheckWithError(makeTag("alice"))
+				require.NoError(t, err)
+				assert.False(t, exists)
+			})
+			t.Run("DeleteRemoves", func(t *testing.T) {
+				d := newDepot()
+				require.NoError(t, d.Put(makeTag("alice"), []byte("data")))
+				require.NoError(t, d.Delete(makeTag("alice")))
+
+				_, err := d.Get(makeTag("alice"))
+				assert.Error(t, err)
+				assert.False(t, d.Check(makeTag("alice")))
+			})
+			t.Run("NamesAreIndependent", func(t *testing.T) {
+				d := newDepot()
+				require.NoError(t, d.Put(makeTag("alice"), []byte("alice data")))
+				require.NoError(t, d.Put(makeTag("bob"), []byte("bob data")))
+				require.NoError(t, d.Delete(makeTag("alice")))
+
+				assert.False(t, d.Check(makeTag("alice")))
+				data, err := d.Get(makeTag("bob"))
+				require.NoError(t, err)
+				assert.Equal(t, []byte("bob data"), data)
+			})
+		})
+	}
+
+	t.Run("TagsAreIndependent", func(t *testing.T) {
+		d := newDepot()
+		for tagName, makeTag := range tags {
+			require.NoError(t, d.Put(makeTag("alice"), []byte(tagName)))
+		}
+		require.NoError(t, d.Delete(CrtTag("alice")))
+
+		assert.False(t, d.Check(CrtTag("alice")))
+		for tagName, makeTag := range tags {
+			if tagName == "Certificate" {
+				continue
+			}
+			data, err := d.Get(makeTag("alice"))
+			require.NoError(t, err, tagName)
+			assert.Equal(t, []byte(tagName), data)
+		}
+	})
+	t.Run("SignsWithCA", func(t *testing.T) {
+		d := newDepot()
+		initConformanceSuiteCA(t, d)
+		opts := CertificateOptions{
+			CommonName: "alice",
+			Host:       "alice",
+			CA:         ConformanceSuiteCA,
+			Expires:    time.Hour,
+		}
+		require.NoError(t, opts.CertRequest(d))
+		require.NoError(t, opts.Sign(d))
+
+		assert.True(t, d.Check(PrivKeyTag("alice")))
+		crt, err := getRawCertificate(d, "alice")
+		require.NoError(t, err)
+		assertSignedByConformanceSuiteCA(t, d, crt)
+	})
+	t.Run("GenerateThenFind", func(t *testing.T) {
+		d := newDepot()
+		initConformanceSuiteCA(t, d)
+
+		creds, err := d.Generate("alice")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", creds.ServerName)
+		bundle, err := creds.Bundle()
+		require.NoError(t, err)
+		assertSignedByConformanceSuiteCA(t, d, bundle.Certificate)
+
+		require.NoError(t, d.Put(CrtTag("alice"), creds.Cert))
+		require.NoError(t, d.Put(PrivKeyTag("alice"), creds.Key))
+		found, err := d.Find("alice")
+		require.NoError(t, err)
+		assert.Equal(t, creds.Cert, found.Cert)
+		assert.Equal(t, creds.Key, found.Key)
+		assert.Equal(t, creds.CACert, found.CACert)
+	})
+	t.Run("FindMissingFails", func(t *testing.T) {
+		d := newDepot()
+		initConformanceSuiteCA(t, d)
+
+		creds, err := d.Find("alice")
+		assert.Error(t, err)
+		assert.Nil(t, creds)
+	})
+}
+
+func initConformanceSuiteCA(t *testing.T, d Depot) {
+	opts := CertificateOptions{
+		CommonName: ConformanceSuiteCA,
+		Expires:    time.Hour,
+	}
+	require.NoError(t, opts.Init(d))
+}
+
+func assertSignedByConformanceSuiteCA(t *testing.T, d Depot, crt *x509.Certificate) {
+	ca, err := getRawCertificate(d, ConformanceSuiteCA)
+	require.NoError(t, err)
+	assert.NoError(t, crt.CheckSignatureFrom(ca))
+}
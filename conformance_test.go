@@ -0,0 +1,69 @@
+package certdepot
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// testMongoDBURIEnv is the environment variable that overrides the URI of the
+// mongod the tests run against.
+const testMongoDBURIEnv = "CERTDEPOT_TEST_MONGODB_URI"
+
+// testMongoDBURI returns the URI of the mongod the tests run against.
+func testMongoDBURI() string {
+	if uri := os.Getenv(testMongoDBURIEnv); uri != "" {
+		return uri
+	}
+	return "mongodb://localhost:27017"
+}
+
+func TestDepotConformance(t *testing.T) {
+	depotOpts := DepotOptions{
+		CA:                ConformanceSuiteCA,
+		DefaultExpiration: time.Hour,
+	}
+
+	t.Run("File", func(t *testing.T) {
+		DepotConformanceSuite(t, func() Depot {
+			tempDir, err := ioutil.TempDir(".", "conformance-test")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				assert.NoError(t, os.RemoveAll(tempDir))
+			})
+
+			d, err := MakeFileDepot(tempDir, depotOpts)
+			require.NoError(t, err)
+			return d
+		})
+	})
+	t.Run("MongoDB", func(t *testing.T) {
+		ctx := context.Background()
+		collections := 0
+		DepotConformanceSuite(t, func() Depot {
+			collections++
+			opts := &MongoDBOptions{
+				MongoDBURI:     testMongoDBURI(),
+				DatabaseName:   "certDepot",
+				CollectionName: fmt.Sprintf("conformance%d", collections),
+				DepotOptions:   depotOpts,
+			}
+			d, err := NewMongoDBCertDepot(ctx, opts)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				coll := d.(*mongoDepot).coll.(*mongo.Collection)
+				assert.NoError(t, coll.Drop(ctx))
+				assert.NoError(t, d.(*mongoDepot).metadataCollection().(*mongo.Collection).Drop(ctx))
+			})
+
+			return d
+		})
+	})
+}
@@ -1,8 +1,14 @@
 package certdepot
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
 	"os"
@@ -24,9 +30,19 @@ type Credentials struct {
 	Cert []byte `bson:"cert" json:"cert" yaml:"cert"`
 	// Key is the PEM-encoded private key.
 	Key []byte `bson:"key" json:"key" yaml:"key"`
-
-	// ServerName is the name of the service being contacted.
+	// Signer, if set, is used in place of Key to sign TLS handshakes, such
+	// as a signer returned by NewRemoteSigner for a private key that is held
+	// by a KMS, Vault, or an HSM and never enters process memory. Key may be
+	// empty if Signer is set. Signer is not exported.
+	Signer crypto.Signer `bson:"-" json:"-" yaml:"-"`
+
+	// ServerName is the name of the service being contacted. In credentials
+	// returned by a depot, it is the name the credentials are stored under,
+	// with spaces replaced by underscores.
 	ServerName string `bson:"server_name" json:"server_name" yaml:"server_name"`
+
+	// bundle caches the parsed credentials returned by Bundle.
+	bundle *IssuedBundle
 }
 
 // NewCredentials initializes a new Credential struct.
@@ -76,7 +92,7 @@ func (c *Credentials) Validate() error {
 
 	catcher.NewWhen(len(c.CACert) == 0, "CA certificate should not be empty")
 	catcher.NewWhen(len(c.Cert) == 0, "certificate should not be empty")
-	catcher.NewWhen(len(c.Key) == 0, "key should not be empty")
+	catcher.NewWhen(len(c.Key) == 0 && c.Signer == nil, "key should not be empty")
 
 	return catcher.Resolve()
 }
@@ -92,9 +108,19 @@ func (c *Credentials) Resolve() (*tls.Config, error) {
 		return nil, errors.New("failed to append client CA certificate")
 	}
 
-	cert, err := tls.X509KeyPair(c.Cert, c.Key)
-	if err != nil {
-		return nil, errors.Wrap(err, "loading key pair")
+	var cert tls.Certificate
+	if c.Signer != nil {
+		bundle, err := c.Bundle()
+		if err != nil {
+			return nil, errors.Wrap(err, "loading certificate with signer")
+		}
+		cert = bundle.TLSCertificate()
+	} else {
+		var err error
+		cert, err = tls.X509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading key pair")
+		}
 	}
 
 	return &tls.Config{
@@ -115,11 +141,45 @@ func (c *Credentials) Export() ([]byte, error) {
 	if err := c.Validate(); err != nil {
 		return nil, errors.Wrap(err, "invalid credentials")
 	}
+	if len(c.Key) == 0 {
+		return nil, errors.New("cannot export credentials whose private key is held by a signer")
+	}
 
-	b, err := json.Marshal(c)
+	// Marshal the fields directly, since MarshalJSON redacts the key.
+	b, err := json.Marshal((*credentialsFields)(c))
 	if err != nil {
 		return nil, errors.Wrap(err, "exporting credentials")
 	}
 
 	return b, nil
 }
+
+// Equal returns whether the credentials hold the same PEM-encoded assets and
+// server name as the other credentials. The private keys are compared in
+// constant time.
+func (c *Credentials) Equal(other *Credentials) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+
+	return bytes.Equal(c.CACert, other.CACert) &&
+		bytes.Equal(c.Cert, other.Cert) &&
+		subtle.ConstantTimeCompare(c.Key, other.Key) == 1 &&
+		c.ServerName == other.ServerName
+}
+
+// Fingerprint returns the hex-encoded SHA-256 digest of the credentials. Two
+// credentials have the same fingerprint exactly when they are Equal, so
+// consumers polling for credentials can compare fingerprints to detect
+// whether the credentials changed without holding on to the previous ones.
+func (c *Credentials) Fingerprint() string {
+	h := sha256.New()
+	for _, field := range [][]byte{c.CACert, c.Cert, c.Key, []byte(c.ServerName)} {
+		// Prefix each field with its length so that the boundaries
+		// between fields are unambiguous.
+		_ = binary.Write(h, binary.BigEndian, uint64(len(field)))
+		_, _ = h.Write(field)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -166,3 +166,50 @@ EKTcWGekdmdDPsHloRNtsiCa697B2O9IFA==
 		})
 	}
 }
+
+func TestCredentialsEqual(t *testing.T) {
+	creds := &Credentials{
+		CACert:     []byte("ca"),
+		Cert:       []byte("cert"),
+		Key:        []byte("key"),
+		ServerName: "alice",
+	}
+	same := &Credentials{
+		CACert:     []byte("ca"),
+		Cert:       []byte("cert"),
+		Key:        []byte("key"),
+		ServerName: "alice",
+	}
+
+	t.Run("SameCredentials", func(t *testing.T) {
+		assert.True(t, creds.Equal(same))
+		assert.True(t, same.Equal(creds))
+		assert.Equal(t, creds.Fingerprint(), same.Fingerprint())
+	})
+	t.Run("DifferentCredentials", func(t *testing.T) {
+		for testName, other := range map[string]*Credentials{
+			"CACert":     {CACert: []byte("ca2"), Cert: []byte("cert"), Key: []byte("key"), ServerName: "alice"},
+			"Cert":       {CACert: []byte("ca"), Cert: []byte("cert2"), Key: []byte("key"), ServerName: "alice"},
+			"Key":        {CACert: []byte("ca"), Cert: []byte("cert"), Key: []byte("key2"), ServerName: "alice"},
+			"ServerName": {CACert: []byte("ca"), Cert: []byte("cert"), Key: []byte("key"), ServerName: "bob"},
+			"Boundary":   {CACert: []byte("c"), Cert: []byte("acert"), Key: []byte("key"), ServerName: "alice"},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				assert.False(t, creds.Equal(other))
+				assert.NotEqual(t, creds.Fingerprint(), other.Fingerprint())
+			})
+		}
+	})
+	t.Run("Nil", func(t *testing.T) {
+		var nilCreds *Credentials
+		assert.False(t, creds.Equal(nil))
+		assert.False(t, nilCreds.Equal(creds))
+		assert.True(t, nilCreds.Equal(nil))
+	})
+	t.Run("IgnoresParsedBundle", func(t *testing.T) {
+		parsed := *same
+		parsed.bundle = &IssuedBundle{}
+		assert.True(t, creds.Equal(&parsed))
+		assert.Equal(t, creds.Fingerprint(), parsed.Fingerprint())
+	})
+}
@@ -0,0 +1,195 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+// maxCRLSize is the largest revocation list a CRLFetcher will download.
+const maxCRLSize = 16 << 20
+
+// CRLFetcher downloads the certificate revocation lists of CAs that the depot
+// does not issue revocation lists for, such as imported or federated trust
+// anchors, and stores them in the depot under each CA's CrlTag so that
+// VerifyPeer checks revocations against fresh data.
+type CRLFetcher struct {
+	// Depot is the depot holding the CA certificates and to store the
+	// revocation lists in.
+	Depot Depot
+	// CAs are the names of the CAs to fetch revocation lists for. If empty,
+	// the depot's TrustedCAs are used.
+	CAs []string
+	// URLs overrides, by CA name, where to fetch the CA's revocation list
+	// from. By default, the CRL distribution points in the CA's certificate
+	// are used.
+	URLs map[string][]string
+	// Client is the HTTP client used to download revocation lists. It
+	// defaults to a client with a 30 second timeout.
+	Client *http.Client
+}
+
+// Fetch downloads the revocation list of every CA and stores it in the depot.
+// Errors for one CA do not stop the others from being fetched.
+func (f *CRLFetcher) Fetch(ctx context.Context) error {
+	if f.Depot == nil {
+		return errors.New("must specify a depot")
+	}
+
+	names := f.CAs
+	if len(names) == 0 {
+		names = getDepotOptions(f.Depot).TrustedCAs
+	}
+	if len(names) == 0 {
+		return errors.New("must specify CAs to fetch revocation lists for")
+	}
+
+	catcher := grip.NewBasicCatcher()
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+		catcher.Wrapf(f.FetchCA(ctx, name), "fetching revocation list for '%s'", name)
+	}
+
+	return catcher.Resolve()
+}
+
+// Run fetches the revocation lists every interval until the context is
+// canceled. Errors are logged rather than returned so that one unreachable
+// distribution point does not stop later fetches.
+func (f *CRLFetcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		grip.Error(message.WrapError(f.Fetch(ctx), message.Fields{
+			"message": "could not fetch revocation lists",
+			"cas":     f.CAs,
+		}))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// FetchCA downloads the revocation list of the named CA from the first
+// distribution point that returns one and stores it in the depot. The
+// revocation list must be signed by the CA's certificate in the depot, and it
+// replaces the stored revocation list only if it is newer.
+func (f *CRLFetcher) FetchCA(ctx context.Context, name string) error {
+	caCrt, err := getRawCertificate(f.Depot, name)
+	if err != nil {
+		return errors.Wrap(err, "getting CA certificate")
+	}
+
+	urls, ok := f.URLs[name]
+	if !ok {
+		urls = caCrt.CRLDistributionPoints
+	}
+	if len(urls) == 0 {
+		return errors.New("CA has no CRL distribution points")
+	}
+
+	catcher := grip.NewBasicCatcher()
+	for _, u := range urls {
+		crl, err := f.download(ctx, u, caCrt)
+		if err != nil {
+			catcher.Wrapf(err, "downloading from '%s'", u)
+			continue
+		}
+
+		return errors.WithStack(storeCRL(f.Depot, name, crl))
+	}
+
+	return catcher.Resolve()
+}
+
+// download fetches and validates the revocation list at the URL, which may be
+// DER- or PEM-encoded.
+func (f *CRLFetcher) download(ctx context.Context, rawURL string, caCrt *x509.Certificate) (*x509.RevocationList, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing URL")
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, errors.Errorf("unsupported URL scheme '%s'", parsed.Scheme)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	client := f.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "sending request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("request returned status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCRLSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading response")
+	}
+	if len(data) > maxCRLSize {
+		return nil, errors.Errorf("revocation list is larger than %d bytes", maxCRLSize)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing revocation list")
+	}
+	if err = crl.CheckSignatureFrom(caCrt); err != nil {
+		return nil, errors.Wrap(err, "checking revocation list signature")
+	}
+	if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(time.Now()) {
+		return nil, errors.Errorf("revocation list expired at %s", crl.NextUpdate)
+	}
+
+	return crl, nil
+}
+
+// storeCRL stores the revocation list under the CA's CrlTag unless the stored
+// revocation list is the same or newer.
+func storeCRL(wd Depot, name string, crl *x509.RevocationList) error {
+	data, err := getIfExists(wd, CrlTag(name))
+	if err != nil {
+		return errors.Wrap(err, "getting stored revocation list")
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if bytes.Equal(block.Bytes, crl.Raw) {
+			return nil
+		}
+		if stored, err := x509.ParseRevocationList(block.Bytes); err == nil && !crl.ThisUpdate.After(stored.ThisUpdate) {
+			return nil
+		}
+	}
+
+	if err = deleteIfExists(wd, CrlTag(name)); err != nil {
+		return errors.Wrap(err, "deleting stored revocation list")
+	}
+
+	return errors.Wrap(wd.Put(CrlTag(name), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl.Raw})), "storing revocation list")
+}
@@ -0,0 +1,141 @@
+package certdepot
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCRLFetcher(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "crl-fetch-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	ctx := context.Background()
+
+	// The external CA lives in its own depot; only its certificate is
+	// imported into the depot under test.
+	external, err := MakeFileDepot(tempDir+"/external", DepotOptions{CA: "partner", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "partner", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(external))
+	caCrt, err := getRawCertificate(external, "partner")
+	require.NoError(t, err)
+	caKey, err := depot.GetPrivateKey(external, "partner")
+	require.NoError(t, err)
+	peerOpts := CertificateOptions{CommonName: "peer", Host: "peer", CA: "partner", Expires: time.Hour}
+	require.NoError(t, peerOpts.CreateCertificate(external))
+	peerCrt, err := getRawCertificate(external, "peer")
+	require.NoError(t, err)
+
+	d, err := MakeFileDepot(tempDir+"/local", DepotOptions{CA: "root", DefaultExpiration: time.Hour, TrustedCAs: []string{"partner"}})
+	require.NoError(t, err)
+	require.NoError(t, d.Put(CrtTag("partner"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCrt.Raw})))
+
+	newCRL := func(t *testing.T, number int64, thisUpdate time.Time, revoked ...*big.Int) []byte {
+		list := &x509.RevocationList{
+			Number:     big.NewInt(number),
+			ThisUpdate: thisUpdate,
+			NextUpdate: thisUpdate.Add(time.Hour),
+		}
+		for _, serial := range revoked {
+			list.RevokedCertificates = append(list.RevokedCertificates, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: thisUpdate})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, list, caCrt, caKey.Private.(crypto.Signer))
+		require.NoError(t, err)
+		return der
+	}
+
+	var (
+		mu     sync.Mutex
+		served []byte
+	)
+	serve := func(data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		served = data
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if served == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(served)
+	}))
+	defer srv.Close()
+
+	fetcher := &CRLFetcher{Depot: d, URLs: map[string][]string{"partner": {srv.URL + "/missing", srv.URL}}}
+	storedCRL := func(t *testing.T) *x509.RevocationList {
+		data, err := d.Get(CrlTag("partner"))
+		require.NoError(t, err)
+		block, _ := pem.Decode(data)
+		require.NotNil(t, block)
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		require.NoError(t, err)
+		return crl
+	}
+
+	t.Run("FailsWithoutCRL", func(t *testing.T) {
+		assert.Error(t, fetcher.Fetch(ctx))
+		assert.False(t, d.Check(CrlTag("partner")))
+	})
+	t.Run("StoresCRL", func(t *testing.T) {
+		serve(newCRL(t, 1, time.Now().Add(-time.Minute), peerCrt.SerialNumber))
+		require.NoError(t, fetcher.Fetch(ctx))
+		assert.EqualValues(t, 1, storedCRL(t).Number.Int64())
+
+		err := VerifyPeer(d, "partner")([][]byte{peerCrt.Raw}, nil)
+		assert.Error(t, err)
+	})
+	t.Run("ReplacesWithNewerPEMCRL", func(t *testing.T) {
+		serve(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: newCRL(t, 2, time.Now())}))
+		require.NoError(t, fetcher.Fetch(ctx))
+		assert.EqualValues(t, 2, storedCRL(t).Number.Int64())
+
+		assert.NoError(t, VerifyPeer(d, "partner")([][]byte{peerCrt.Raw}, nil))
+	})
+	t.Run("KeepsNewerStoredCRL", func(t *testing.T) {
+		serve(newCRL(t, 1, time.Now().Add(-30*time.Minute)))
+		require.NoError(t, fetcher.Fetch(ctx))
+		assert.EqualValues(t, 2, storedCRL(t).Number.Int64())
+	})
+	t.Run("RejectsCRLFromOtherCA", func(t *testing.T) {
+		otherOpts := CertificateOptions{CommonName: "other", Expires: time.Hour}
+		require.NoError(t, otherOpts.Init(external))
+		otherCrt, err := getRawCertificate(external, "other")
+		require.NoError(t, err)
+		otherKey, err := depot.GetPrivateKey(external, "other")
+		require.NoError(t, err)
+		der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(3),
+			ThisUpdate: time.Now(),
+			NextUpdate: time.Now().Add(time.Hour),
+		}, otherCrt, otherKey.Private.(crypto.Signer))
+		require.NoError(t, err)
+		serve(der)
+
+		assert.Error(t, fetcher.Fetch(ctx))
+		assert.EqualValues(t, 2, storedCRL(t).Number.Int64())
+	})
+	t.Run("RequiresDistributionPoints", func(t *testing.T) {
+		assert.Error(t, (&CRLFetcher{Depot: d}).Fetch(ctx))
+	})
+}
@@ -1,17 +1,23 @@
 package certdepot
 
 import (
-	"strings"
+	"context"
+	"math/rand"
 	"time"
 
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // PutTTL sets the TTL to the given expiration time for the name. If the name is
 // not found in the collection, this will error. The expiration must be within
 // the validity bounds of the certificate for the given name.
 func (m *mongoDepot) PutTTL(name string, expiration time.Time) error {
+	ctx, cancel := m.writeContext()
+	defer cancel()
+
 	expiration = expiration.UTC()
 
 	minExpiration, maxExpiration, err := ValidityBounds(m, name)
@@ -22,10 +28,15 @@ func (m *mongoDepot) PutTTL(name string, expiration time.Time) error {
 		return errors.Errorf("cannot set expiration to %s because it must be between %s and %s", expiration, minExpiration, maxExpiration)
 	}
 
-	formattedName := strings.Replace(name, " ", "_", -1)
-	updateRes, err := m.client.Database(m.databaseName).Collection(m.collectionName).UpdateOne(m.ctx,
+	formattedName := formatName(name)
+	update := bson.M{"$set": bson.M{userTTLKey: expiration}, "$inc": bson.M{userRevisionKey: 1}}
+	if err = m.decorate(formattedName, update); err != nil {
+		return errors.Wrap(err, "decorating user")
+	}
+	m.recentWrites.record(formattedName)
+	updateRes, err := m.coll.UpdateOne(ctx,
 		bson.M{userIDKey: formattedName},
-		bson.M{"$set": bson.M{userTTLKey: expiration}})
+		update)
 	if err != nil {
 		return errors.Wrap(err, "updating TTL in the database")
 	}
@@ -36,9 +47,12 @@ func (m *mongoDepot) PutTTL(name string, expiration time.Time) error {
 }
 
 func (m *mongoDepot) GetTTL(name string) (time.Time, error) {
-	formattedName := strings.Replace(name, " ", "_", -1)
+	ctx, cancel := m.readContext()
+	defer cancel()
+
+	formattedName := formatName(name)
 	var user User
-	if err := m.client.Database(m.databaseName).Collection(m.collectionName).FindOne(m.ctx,
+	if err := m.readColl(formattedName).FindOne(ctx,
 		bson.M{userIDKey: formattedName},
 	).Decode(&user); err != nil {
 		return time.Time{}, errors.Wrap(err, "getting TTL from database")
@@ -48,13 +62,16 @@ func (m *mongoDepot) GetTTL(name string) (time.Time, error) {
 
 // FindExpiresBefore finds all Users that expire before the given cutoff time.
 func (m *mongoDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
 	users := []User{}
-	res, err := m.client.Database(m.databaseName).Collection(m.collectionName).
-		Find(m.ctx, expiresBeforeQuery(cutoff))
+	res, err := m.coll.
+		Find(ctx, expiresBeforeQuery(cutoff))
 	if err != nil {
 		return nil, errors.Wrap(err, "finding expired users")
 	}
-	if err := res.All(m.ctx, &users); err != nil {
+	if err := res.All(ctx, &users); err != nil {
 		return nil, errors.Wrap(err, "decoding results")
 	}
 
@@ -64,14 +81,251 @@ func (m *mongoDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
 // DeleteExpiresBefore removes all Users that expire before the given cutoff
 // time.
 func (m *mongoDepot) DeleteExpiresBefore(cutoff time.Time) error {
-	_, err := m.client.Database(m.databaseName).Collection(m.collectionName).
-		DeleteMany(m.ctx, expiresBeforeQuery(cutoff))
+	ctx, cancel := m.writeContext()
+	defer cancel()
+
+	_, err := m.coll.
+		DeleteMany(ctx, expiresBeforeQuery(cutoff))
 	if err != nil {
 		return errors.Wrap(err, "removing expired users")
 	}
 	return nil
 }
 
+// ExpiryScanOptions control how FindExpiresBeforeInBatches and
+// DeleteExpiresBeforeInBatches process expired users, so that scanning large
+// collections does not spike database load.
+type ExpiryScanOptions struct {
+	// BatchSize is the number of users processed per query. Defaults to
+	// 1000.
+	BatchSize int `bson:"batch_size,omitempty" json:"batch_size,omitempty" yaml:"batch_size,omitempty"`
+	// BatchInterval is how long to wait between batches.
+	BatchInterval time.Duration `bson:"batch_interval,omitempty" json:"batch_interval,omitempty" yaml:"batch_interval,omitempty"`
+	// Jitter is the maximum random duration added to each wait between
+	// batches, so that many processes scanning at once spread out their
+	// queries.
+	Jitter time.Duration `bson:"jitter,omitempty" json:"jitter,omitempty" yaml:"jitter,omitempty"`
+	// MaxDocuments is the maximum number of users processed in total. If
+	// zero, all expired users are processed.
+	MaxDocuments int `bson:"max_documents,omitempty" json:"max_documents,omitempty" yaml:"max_documents,omitempty"`
+}
+
+const defaultExpiryScanBatchSize = 1000
+
+// Validate checks that the options are valid and sets defaults.
+func (opts *ExpiryScanOptions) Validate() error {
+	if opts.BatchSize < 0 || opts.BatchInterval < 0 || opts.Jitter < 0 || opts.MaxDocuments < 0 {
+		return errors.New("expiry scan options cannot be negative")
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = defaultExpiryScanBatchSize
+	}
+
+	return nil
+}
+
+// nextBatchSize returns the number of users to process in the next batch
+// given the number already processed, or zero if no more should be processed.
+func (opts *ExpiryScanOptions) nextBatchSize(processed int) int {
+	if opts.MaxDocuments == 0 {
+		return opts.BatchSize
+	}
+	if remaining := opts.MaxDocuments - processed; remaining < opts.BatchSize {
+		return remaining
+	}
+	return opts.BatchSize
+}
+
+// wait sleeps for the batch interval plus jitter, returning early with an
+// error if the context is done.
+func (opts *ExpiryScanOptions) wait(ctx context.Context) error {
+	wait := opts.BatchInterval
+	if opts.Jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(opts.Jitter)))
+	}
+	if wait <= 0 {
+		return errors.WithStack(ctx.Err())
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+// FindExpiresBeforeInBatches is the same as FindExpiresBefore but queries the
+// expired users in batches according to the options.
+func (m *mongoDepot) FindExpiresBeforeInBatches(cutoff time.Time, opts ExpiryScanOptions) ([]User, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	users := []User{}
+	err := m.expiresBeforeBatches(cutoff, opts, bson.M{}, func(batch []User) error {
+		users = append(users, batch...)
+		return nil
+	})
+
+	return users, errors.WithStack(err)
+}
+
+// DeleteExpiresBeforeInBatches is the same as DeleteExpiresBefore but deletes
+// the expired users in batches according to the options. It returns the
+// number of users deleted.
+func (m *mongoDepot) DeleteExpiresBeforeInBatches(cutoff time.Time, opts ExpiryScanOptions) (int, error) {
+	if err := opts.Validate(); err != nil {
+		return 0, errors.Wrap(err, "invalid options")
+	}
+
+	deleted := 0
+	err := m.expiresBeforeBatches(cutoff, opts, bson.M{userIDKey: 1}, func(batch []User) error {
+		ids := make([]string, 0, len(batch))
+		for _, u := range batch {
+			ids = append(ids, u.ID)
+		}
+		query := expiresBeforeQuery(cutoff)
+		query[userIDKey] = bson.M{"$in": ids}
+		ctx, cancel := m.writeContext()
+		defer cancel()
+		m.recentWrites.record("")
+		res, err := m.coll.DeleteMany(ctx, query)
+		if err != nil {
+			return errors.Wrap(err, "removing expired users")
+		}
+		deleted += int(res.DeletedCount)
+
+		return nil
+	})
+
+	return deleted, errors.WithStack(err)
+}
+
+// expiresBeforeBatches pages through the users that expire before the cutoff
+// in order of ID and calls process on each batch.
+func (m *mongoDepot) expiresBeforeBatches(cutoff time.Time, opts ExpiryScanOptions, projection bson.M, process func([]User) error) error {
+	processed := 0
+	lastID := ""
+	for {
+		limit := opts.nextBatchSize(processed)
+		if limit <= 0 {
+			return nil
+		}
+		if processed > 0 {
+			if err := opts.wait(m.ctx); err != nil {
+				return errors.Wrap(err, "waiting between batches")
+			}
+		}
+
+		query := expiresBeforeQuery(cutoff)
+		if processed > 0 {
+			query[userIDKey] = bson.M{"$gt": lastID}
+		}
+		findOpts := options.Find().SetSort(bson.M{userIDKey: 1}).SetLimit(int64(limit))
+		if len(projection) != 0 {
+			findOpts.SetProjection(projection)
+		}
+		batch, err := m.findExpiresBeforeBatch(query, findOpts)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err = process(batch); err != nil {
+			return errors.WithStack(err)
+		}
+		processed += len(batch)
+		lastID = batch[len(batch)-1].ID
+		if len(batch) < limit {
+			return nil
+		}
+	}
+}
+
+// findExpiresBeforeBatch finds a single batch of users that expire before the
+// cutoff.
+func (m *mongoDepot) findExpiresBeforeBatch(query bson.M, findOpts *options.FindOptions) ([]User, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
+	res, err := m.coll.Find(ctx, query, findOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "finding expired users")
+	}
+	batch := []User{}
+	if err = res.All(ctx, &batch); err != nil {
+		return nil, errors.Wrap(err, "decoding results")
+	}
+
+	return batch, nil
+}
+
+// ExpiryHistogram counts the users in the mongo depot by the time until their
+// TTL with a single aggregation. Users without a TTL are not counted.
+func (m *mongoDepot) ExpiryHistogram(now time.Time, bounds []time.Duration) (*ExpiryHistogram, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
+	// Dates are stored with millisecond precision, so the boundaries must
+	// be too for the bucket IDs to match them.
+	now = now.UTC().Truncate(time.Millisecond)
+	boundaries := []interface{}{time.Time{}, now}
+	for _, bound := range bounds {
+		boundaries = append(boundaries, now.Add(bound).Truncate(time.Millisecond))
+	}
+	const unbounded = "unbounded"
+
+	res, err := m.coll.Aggregate(ctx, []bson.M{
+		{"$match": bson.M{userTTLKey: bson.M{"$type": "date"}}},
+		{"$bucket": bson.M{
+			"groupBy":    "$" + userTTLKey,
+			"boundaries": boundaries,
+			"default":    unbounded,
+			"output":     bson.M{"count": bson.M{"$sum": 1}},
+		}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "aggregating TTLs")
+	}
+
+	buckets := []struct {
+		ID    interface{} `bson:"_id"`
+		Count int         `bson:"count"`
+	}{}
+	if err = res.All(ctx, &buckets); err != nil {
+		return nil, errors.Wrap(err, "decoding TTL buckets")
+	}
+
+	h := newExpiryHistogram(now, bounds)
+	for _, bucket := range buckets {
+		lower, ok := bucket.ID.(primitive.DateTime)
+		if !ok {
+			h.Buckets[len(h.Buckets)-1].Count += bucket.Count
+			continue
+		}
+		switch start := lower.Time().UTC(); {
+		case start.Before(now):
+			h.Expired += bucket.Count
+		case start.Equal(now):
+			h.Buckets[0].Count += bucket.Count
+		default:
+			for i, bound := range bounds {
+				if start.Equal(now.Add(bound).Truncate(time.Millisecond)) {
+					h.Buckets[i+1].Count += bucket.Count
+					break
+				}
+			}
+		}
+	}
+
+	return h, nil
+}
+
 func expiresBeforeQuery(cutoff time.Time) bson.M {
 	return bson.M{userTTLKey: bson.M{"$lte": cutoff}}
 }
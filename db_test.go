@@ -2,6 +2,7 @@ package certdepot
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
@@ -14,7 +15,6 @@ import (
 
 func TestDB(t *testing.T) {
 	const (
-		uri            = "mongodb://localhost:27017"
 		databaseName   = "certDepot"
 		collectionName = "certs"
 		dbTimeout      = 5 * time.Second
@@ -66,7 +66,7 @@ func TestDB(t *testing.T) {
 							Expires:    24 * time.Hour,
 						},
 						MongoDepot: &MongoDBOptions{
-							MongoDBURI:     uri,
+							MongoDBURI:     testMongoDBURI(),
 							DatabaseName:   databaseName,
 							CollectionName: collectionName,
 						},
@@ -230,17 +230,75 @@ func TestDB(t *testing.T) {
 				})
 			}
 		},
+		"ExpiresBeforeInBatches": func(ctx context.Context, t *testing.T, md *mongoDepot, client *mongo.Client, coll *mongo.Collection) {
+			ttl := time.Now()
+			cutoff := ttl.Add(time.Hour)
+			insertUsers := func(ctx context.Context, t *testing.T) {
+				for _, name := range []string{"user1", "user2", "user3", "user4", "user5"} {
+					_, err := coll.InsertOne(ctx, &User{ID: name, TTL: ttl})
+					require.NoError(t, err)
+				}
+				_, err := coll.InsertOne(ctx, &User{ID: "user6", TTL: cutoff.Add(time.Hour)})
+				require.NoError(t, err)
+			}
+
+			for subTestName, subTestCase := range map[string]func(ctx context.Context, t *testing.T){
+				"FindMatchesAllExpired": func(ctx context.Context, t *testing.T) {
+					insertUsers(ctx, t)
+					dbUsers, err := md.FindExpiresBeforeInBatches(cutoff, ExpiryScanOptions{BatchSize: 2, BatchInterval: time.Millisecond})
+					require.NoError(t, err)
+					require.Len(t, dbUsers, 5)
+					for i, u := range dbUsers {
+						assert.Equal(t, fmt.Sprintf("user%d", i+1), u.ID)
+					}
+				},
+				"FindStopsAtMaxDocuments": func(ctx context.Context, t *testing.T) {
+					insertUsers(ctx, t)
+					dbUsers, err := md.FindExpiresBeforeInBatches(cutoff, ExpiryScanOptions{BatchSize: 2, MaxDocuments: 3})
+					require.NoError(t, err)
+					assert.Len(t, dbUsers, 3)
+				},
+				"DeleteRemovesAllExpired": func(ctx context.Context, t *testing.T) {
+					insertUsers(ctx, t)
+					deleted, err := md.DeleteExpiresBeforeInBatches(cutoff, ExpiryScanOptions{BatchSize: 2, Jitter: time.Millisecond})
+					require.NoError(t, err)
+					assert.Equal(t, 5, deleted)
+					count, err := coll.CountDocuments(ctx, bson.M{})
+					require.NoError(t, err)
+					assert.EqualValues(t, 1, count)
+				},
+				"DeleteStopsAtMaxDocuments": func(ctx context.Context, t *testing.T) {
+					insertUsers(ctx, t)
+					deleted, err := md.DeleteExpiresBeforeInBatches(cutoff, ExpiryScanOptions{BatchSize: 2, MaxDocuments: 3})
+					require.NoError(t, err)
+					assert.Equal(t, 3, deleted)
+					count, err := coll.CountDocuments(ctx, bson.M{})
+					require.NoError(t, err)
+					assert.EqualValues(t, 3, count)
+				},
+			} {
+				t.Run(subTestName, func(t *testing.T) {
+					require.NoError(t, coll.Drop(ctx))
+					defer func() {
+						assert.NoError(t, coll.Drop(ctx))
+					}()
+					tctx, cancel := context.WithTimeout(ctx, dbTimeout)
+					defer cancel()
+					subTestCase(tctx, t)
+				})
+			}
+		},
 	} {
 
 		t.Run(name, func(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
-			client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+			client, err := mongo.Connect(ctx, options.Client().ApplyURI(testMongoDBURI()))
 			require.NoError(t, err)
 
 			opts := &MongoDBOptions{
-				MongoDBURI:     uri,
+				MongoDBURI:     testMongoDBURI(),
 				DatabaseName:   databaseName,
 				CollectionName: collectionName,
 			}
@@ -254,3 +312,42 @@ func TestDB(t *testing.T) {
 		})
 	}
 }
+
+func TestExpiryScanOptions(t *testing.T) {
+	t.Run("ValidateSetsDefaults", func(t *testing.T) {
+		opts := ExpiryScanOptions{}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, defaultExpiryScanBatchSize, opts.BatchSize)
+	})
+	t.Run("ValidateFailsWithNegativeValues", func(t *testing.T) {
+		for _, opts := range []ExpiryScanOptions{
+			{BatchSize: -1},
+			{BatchInterval: -time.Second},
+			{Jitter: -time.Second},
+			{MaxDocuments: -1},
+		} {
+			assert.Error(t, opts.Validate())
+		}
+	})
+	t.Run("NextBatchSizeRespectsMaxDocuments", func(t *testing.T) {
+		opts := ExpiryScanOptions{BatchSize: 10, MaxDocuments: 25}
+		assert.Equal(t, 10, opts.nextBatchSize(0))
+		assert.Equal(t, 5, opts.nextBatchSize(20))
+		assert.Equal(t, 0, opts.nextBatchSize(25))
+
+		opts.MaxDocuments = 0
+		assert.Equal(t, 10, opts.nextBatchSize(1000))
+	})
+	t.Run("WaitStopsWhenContextIsDone", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		opts := ExpiryScanOptions{BatchInterval: time.Hour}
+		assert.Error(t, opts.wait(ctx))
+	})
+	t.Run("WaitSleepsWithJitter", func(t *testing.T) {
+		opts := ExpiryScanOptions{BatchInterval: time.Millisecond, Jitter: time.Millisecond}
+		start := time.Now()
+		require.NoError(t, opts.wait(context.Background()))
+		assert.True(t, time.Since(start) >= time.Millisecond)
+	})
+}
@@ -0,0 +1,66 @@
+package certdepot
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RegisterUserDecorator adds a decorator that is called before every write to
+// a user document in the depot, which must implement UserDecoratorRegistrar,
+// so that applications can keep their own bookkeeping on the documents
+// certdepot manages instead of in a parallel collection.
+func RegisterUserDecorator(wd Depot, decorator UserDecorator) error {
+	if decorator == nil {
+		return errors.New("must specify decorator")
+	}
+	registrar, ok := wd.(UserDecoratorRegistrar)
+	if !ok {
+		return errors.Errorf("depot of type %T does not support user decorators", wd)
+	}
+	registrar.RegisterUserDecorator(decorator)
+
+	return nil
+}
+
+// RegisterUserDecorator adds the decorator to those called before every write
+// to a user document.
+func (m *mongoDepot) RegisterUserDecorator(decorator UserDecorator) {
+	m.decoratorsMu.Lock()
+	defer m.decoratorsMu.Unlock()
+	m.decorators = append(m.decorators, decorator)
+}
+
+// decorate calls the decorators on the user with the name and adds the extra
+// fields they set to the $set of the update.
+func (m *mongoDepot) decorate(name string, update bson.M) error {
+	m.decoratorsMu.RLock()
+	decorators := m.decorators
+	m.decoratorsMu.RUnlock()
+	if len(decorators) == 0 {
+		return nil
+	}
+
+	u := &User{ID: name, Extra: map[string]interface{}{}}
+	for _, decorator := range decorators {
+		decorator(u)
+	}
+	if len(u.Extra) == 0 {
+		return nil
+	}
+
+	set, ok := update["$set"].(bson.M)
+	if !ok {
+		set = bson.M{}
+		update["$set"] = set
+	}
+	for field, value := range u.Extra {
+		if field == "" || strings.ContainsAny(field, ".$") {
+			return errors.Errorf("invalid extra field '%s' set by user decorator", field)
+		}
+		set[userExtraKey+"."+field] = value
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestUserDecorators(t *testing.T) {
+	ctx := context.TODO()
+	stampCluster := func(u *User) {
+		u.Extra["cluster_id"] = "cluster-west"
+	}
+
+	t.Run("AddsExtraFieldsToUpdate", func(t *testing.T) {
+		m := &mongoDepot{}
+		update := bson.M{"$set": bson.M{userCertKey: "cert"}}
+		require.NoError(t, m.decorate("alice", update))
+		assert.Equal(t, bson.M{"$set": bson.M{userCertKey: "cert"}}, update)
+
+		require.NoError(t, RegisterUserDecorator(m, stampCluster))
+		require.NoError(t, RegisterUserDecorator(m, func(u *User) {
+			u.Extra["job_id"] = "job-" + u.ID
+			u.Cert = "ignored"
+		}))
+		require.NoError(t, m.decorate("alice", update))
+		assert.Equal(t, bson.M{"$set": bson.M{
+			userCertKey:                  "cert",
+			userExtraKey + ".cluster_id": "cluster-west",
+			userExtraKey + ".job_id":     "job-alice",
+		}}, update)
+
+		update = bson.M{"$inc": bson.M{userRevisionKey: 1}}
+		require.NoError(t, m.decorate("bob", update))
+		assert.Equal(t, "job-bob", update["$set"].(bson.M)[userExtraKey+".job_id"])
+	})
+	t.Run("RejectsInvalidFields", func(t *testing.T) {
+		m := &mongoDepot{}
+		require.NoError(t, RegisterUserDecorator(m, func(u *User) {
+			u.Extra["$where"] = "true"
+		}))
+		assert.Error(t, m.decorate("alice", bson.M{}))
+		assert.Error(t, RegisterUserDecorator(m, nil))
+	})
+	t.Run("FileDepot", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir(".", "decorator-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		}()
+		d, err := NewFileDepot(tempDir)
+		require.NoError(t, err)
+		assert.Error(t, RegisterUserDecorator(d, stampCluster))
+	})
+	t.Run("MongoDB", func(t *testing.T) {
+		d, err := NewMongoDBCertDepot(ctx, &MongoDBOptions{
+			MongoDBURI:     testMongoDBURI(),
+			DatabaseName:   "certDepot",
+			CollectionName: "decorator",
+			DepotOptions:   DepotOptions{CA: "root", DefaultExpiration: time.Hour},
+			UserDecorators: []UserDecorator{stampCluster},
+		})
+		require.NoError(t, err)
+		m := d.(*mongoDepot)
+		defer func() {
+			assert.NoError(t, m.coll.(*mongo.Collection).Drop(ctx))
+			assert.NoError(t, m.metadataCollection().(*mongo.Collection).Drop(ctx))
+		}()
+
+		caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+		require.NoError(t, caOpts.Init(d))
+		creds, err := d.Generate("alice")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("alice", creds))
+
+		u := User{}
+		require.NoError(t, m.coll.FindOne(ctx, bson.M{userIDKey: "alice"}).Decode(&u))
+		assert.Equal(t, "cluster-west", u.Extra["cluster_id"])
+		found, err := d.Find("alice")
+		require.NoError(t, err)
+		assert.Equal(t, creds.Cert, found.Cert)
+	})
+}
@@ -0,0 +1,201 @@
+package certdepot
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+// depotFSFiles maps the extension of each file in a depot's fs.FS to the tag
+// holding its contents, matching the layout of a file depot.
+var depotFSFiles = []struct {
+	ext  string
+	tag  func(string) *depot.Tag
+	mode fs.FileMode
+}{
+	{ext: ".crt", tag: CrtTag, mode: 0444},
+	{ext: ".key", tag: PrivKeyTag, mode: 0400},
+	{ext: ".csr", tag: CsrTag, mode: 0444},
+	{ext: ".crl", tag: CrlTag, mode: 0444},
+}
+
+// depotFS is a read-only fs.FS view of a depot.
+type depotFS struct {
+	wd Depot
+}
+
+// NewDepotFS returns a read-only fs.FS view of the depot, so that tooling that
+// expects a directory of PEM files can read any depot, such as a MongoDB
+// depot, without exporting it to disk. Like a file depot, the data for each
+// name is in the files "<name>.crt", "<name>.key", "<name>.csr", and
+// "<name>.crl" in the root directory. Files are read from the depot when they
+// are opened. The root directory can only be listed if the depot implements
+// NameLister; listing it reads every entry in the depot.
+func NewDepotFS(wd Depot) fs.FS {
+	return &depotFS{wd: wd}
+}
+
+// Open opens the named file or the root directory.
+func (dfs *depotFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		entries, err := dfs.readDir()
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &depotFSDir{info: depotFSFileInfo{name: ".", mode: fs.ModeDir | 0555}, entries: entries}, nil
+	}
+
+	data, info, err := dfs.readFile(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &depotFSFile{info: info, Reader: bytes.NewReader(data)}, nil
+}
+
+// ReadFile returns the contents of the named file.
+func (dfs *depotFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+
+	data, _, err := dfs.readFile(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+
+	return data, nil
+}
+
+// ReadDir returns the files in the root directory, sorted by name.
+func (dfs *depotFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	entries, err := dfs.readDir()
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	return entries, nil
+}
+
+// readFile reads the data for the file from the depot.
+func (dfs *depotFS) readFile(name string) ([]byte, depotFSFileInfo, error) {
+	if strings.Contains(name, "/") {
+		return nil, depotFSFileInfo{}, fs.ErrNotExist
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for _, file := range depotFSFiles {
+		if file.ext != ext || base == "" {
+			continue
+		}
+		data, exists, err := GetIfExists(dfs.wd, file.tag(base))
+		if err != nil {
+			return nil, depotFSFileInfo{}, errors.Wrapf(err, "getting '%s' from depot", name)
+		}
+		if !exists {
+			return nil, depotFSFileInfo{}, fs.ErrNotExist
+		}
+		return data, depotFSFileInfo{name: name, size: int64(len(data)), mode: file.mode}, nil
+	}
+
+	return nil, depotFSFileInfo{}, fs.ErrNotExist
+}
+
+// readDir returns the files for every name in the depot.
+func (dfs *depotFS) readDir() ([]fs.DirEntry, error) {
+	lister, ok := dfs.wd.(NameLister)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T cannot list names", dfs.wd)
+	}
+	names, err := lister.ListNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing names")
+	}
+
+	entries := []fs.DirEntry{}
+	for _, name := range names {
+		for _, file := range depotFSFiles {
+			data, exists, err := GetIfExists(dfs.wd, file.tag(name))
+			if err != nil {
+				return nil, errors.Wrapf(err, "getting data for name '%s'", name)
+			}
+			if exists {
+				entries = append(entries, fs.FileInfoToDirEntry(depotFSFileInfo{name: name + file.ext, size: int64(len(data)), mode: file.mode}))
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+// depotFSFileInfo describes a file or the root directory in a depot's fs.FS.
+type depotFSFileInfo struct {
+	name string
+	size int64
+	mode fs.FileMode
+}
+
+func (fi depotFSFileInfo) Name() string       { return fi.name }
+func (fi depotFSFileInfo) Size() int64        { return fi.size }
+func (fi depotFSFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi depotFSFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi depotFSFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi depotFSFileInfo) Sys() interface{}   { return nil }
+
+// depotFSFile is an open file in a depot's fs.FS.
+type depotFSFile struct {
+	*bytes.Reader
+	info depotFSFileInfo
+}
+
+func (f *depotFSFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *depotFSFile) Close() error               { return nil }
+
+// depotFSDir is the open root directory of a depot's fs.FS.
+type depotFSDir struct {
+	info    depotFSFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *depotFSDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *depotFSDir) Close() error               { return nil }
+
+func (d *depotFSDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries in the directory, or all remaining
+// entries if n <= 0.
+func (d *depotFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+
+	return remaining[:n], nil
+}
@@ -0,0 +1,52 @@
+package certdepot
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDepotFS(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "depot-fs-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+	creds, err := d.Generate("alice")
+	require.NoError(t, err)
+	require.NoError(t, d.Save("alice", creds))
+
+	fsys := NewDepotFS(d)
+
+	t.Run("Conformance", func(t *testing.T) {
+		assert.NoError(t, fstest.TestFS(fsys, "root.crt", "root.key", "root.crl", "alice.crt", "alice.key"))
+	})
+	t.Run("ReadsPEMFiles", func(t *testing.T) {
+		crt, err := fs.ReadFile(fsys, "alice.crt")
+		require.NoError(t, err)
+		assert.Equal(t, creds.Cert, crt)
+		key, err := fs.ReadFile(fsys, "alice.key")
+		require.NoError(t, err)
+		assert.Equal(t, creds.Key, key)
+
+		info, err := fs.Stat(fsys, "alice.key")
+		require.NoError(t, err)
+		assert.Equal(t, fs.FileMode(0400), info.Mode())
+	})
+	t.Run("MissingFilesDoNotExist", func(t *testing.T) {
+		for _, name := range []string{"bob.crt", "alice.csr", "alice.pem", ".crt", "dir/alice.crt"} {
+			_, err := fs.ReadFile(fsys, name)
+			assert.ErrorIs(t, err, fs.ErrNotExist, name)
+		}
+	})
+}
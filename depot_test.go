@@ -2,6 +2,10 @@ package certdepot
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -34,6 +38,7 @@ func getTagPath(tag *depot.Tag) string {
 
 func TestDepot(t *testing.T) {
 	var tempDir string
+	var memDepot Depot
 	var data []byte
 
 	const databaseName = "certDepot"
@@ -42,16 +47,18 @@ func TestDepot(t *testing.T) {
 	ctx := context.TODO()
 	connctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
-	client, err := mongo.Connect(connctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	client, err := mongo.Connect(connctx, options.Client().ApplyURI(testMongoDBURI()))
 	require.NoError(t, err)
 
 	defer func() {
 		dropContext, cancel := context.WithTimeout(ctx, 2*time.Second)
 		defer cancel()
 
-		err = client.Database(databaseName).Collection(collectionName).Drop(dropContext)
-		if err != nil {
-			assert.Equal(t, "ns not found", err.Error())
+		for _, coll := range []string{collectionName, collectionName + depotMetadataCollectionSuffix} {
+			err = client.Database(databaseName).Collection(coll).Drop(dropContext)
+			if err != nil {
+				assert.Equal(t, "ns not found", err.Error())
+			}
 		}
 	}()
 
@@ -64,9 +71,14 @@ func TestDepot(t *testing.T) {
 		name      string
 		setup     func() Depot
 		bootstrap func(t *testing.T) Depot
-		check     func(*testing.T, *depot.Tag, []byte)
-		cleanup   func()
-		tests     []testCase
+		// makeDepot returns an empty depot with the options.
+		makeDepot func(t *testing.T, opts DepotOptions) Depot
+		// tamper modifies the certificate stored for the name without
+		// going through the depot.
+		tamper  func(t *testing.T, d Depot, name string)
+		check   func(*testing.T, *depot.Tag, []byte)
+		cleanup func()
+		tests   []testCase
 	}{
 		{
 			name: "File",
@@ -91,20 +103,25 @@ func TestDepot(t *testing.T) {
 						CommonName: "localhost",
 						Host:       "localhost",
 						CA:         "root",
+						Expires:    time.Minute,
 					},
 				}
-				_, err = BootstrapDepot(ctx, conf)
+				var d Depot
+				d, err = BootstrapDepot(ctx, conf)
+				require.NoError(t, err)
+				return d
+			},
+			makeDepot: func(t *testing.T, opts DepotOptions) Depot {
+				tempDir, err = ioutil.TempDir(".", "file_depot")
 				require.NoError(t, err)
-				// We have to do this because the bootstrapped file depot
-				// bootstrapped does not include any DepotOptions.
 				var d Depot
-				d, err = MakeFileDepot(tempDir, DepotOptions{
-					CA:                "root",
-					DefaultExpiration: time.Minute,
-				})
+				d, err = MakeFileDepot(tempDir, opts)
 				require.NoError(t, err)
 				return d
 			},
+			tamper: func(t *testing.T, d Depot, name string) {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(d.(*fileDepot).dir, name+".crt"), []byte("tampered"), 0644))
+			},
 			check: func(t *testing.T, tag *depot.Tag, data []byte) {
 				path := getTagPath(tag)
 
@@ -159,7 +176,8 @@ func TestDepot(t *testing.T) {
 			setup: func() Depot {
 				return &mongoDepot{
 					ctx:            ctx,
-					client:         client,
+					coll:           client.Database(databaseName).Collection(collectionName),
+					metadataColl:   client.Database(databaseName).Collection(collectionName + depotMetadataCollectionSuffix),
 					databaseName:   databaseName,
 					collectionName: collectionName,
 				}
@@ -167,6 +185,7 @@ func TestDepot(t *testing.T) {
 			bootstrap: func(t *testing.T) Depot {
 				conf := BootstrapDepotConfig{
 					MongoDepot: &MongoDBOptions{
+						MongoDBURI:     testMongoDBURI(),
 						DatabaseName:   databaseName,
 						CollectionName: collectionName,
 						DepotOptions: DepotOptions{
@@ -192,6 +211,20 @@ func TestDepot(t *testing.T) {
 				require.NoError(t, err)
 				return d
 			},
+			makeDepot: func(t *testing.T, opts DepotOptions) Depot {
+				return &mongoDepot{
+					ctx:            ctx,
+					coll:           client.Database(databaseName).Collection(collectionName),
+					metadataColl:   client.Database(databaseName).Collection(collectionName + depotMetadataCollectionSuffix),
+					databaseName:   databaseName,
+					collectionName: collectionName,
+					opts:           opts,
+				}
+			},
+			tamper: func(t *testing.T, d Depot, name string) {
+				_, err := d.(*mongoDepot).coll.UpdateOne(ctx, bson.M{userIDKey: name}, bson.M{"$set": bson.M{userCertKey: "tampered"}})
+				require.NoError(t, err)
+			},
 			check: func(t *testing.T, tag *depot.Tag, data []byte) {
 				var name, key string
 				name, key, err = getNameAndKey(tag)
@@ -217,6 +250,7 @@ func TestDepot(t *testing.T) {
 			},
 			cleanup: func() {
 				require.NoError(t, client.Database(databaseName).Collection(collectionName).Drop(ctx))
+				require.NoError(t, client.Database(databaseName).Collection(collectionName+depotMetadataCollectionSuffix).Drop(ctx))
 			},
 			tests: []testCase{
 				{
@@ -319,6 +353,52 @@ func TestDepot(t *testing.T) {
 						assert.Nil(t, data)
 					},
 				},
+				{
+					name: "PutCertificateRecordsRotation",
+					test: func(t *testing.T, d Depot) {
+						const name = "bob"
+						require.NoError(t, d.Put(CrtTag(name), []byte("first certificate")))
+						u := &User{}
+						coll := client.Database(databaseName).Collection(collectionName)
+						require.NoError(t, coll.FindOne(ctx, bson.M{userIDKey: name}).Decode(u))
+						assert.WithinDuration(t, time.Now(), u.LastIssued, time.Minute)
+						assert.Zero(t, u.LastRotated)
+
+						require.NoError(t, d.Delete(CrtTag(name)))
+						require.NoError(t, d.Put(CrtTag(name), []byte("second certificate")))
+						info, err := d.(RotationTracker).GetRotationInfo(name)
+						require.NoError(t, err)
+						assert.Equal(t, name, info.Name)
+						assert.Equal(t, info.LastIssued, info.LastRotated)
+
+						stale, err := FindStale(d, time.Hour)
+						require.NoError(t, err)
+						assert.Empty(t, stale)
+						stale, err = FindStale(d, -time.Minute)
+						require.NoError(t, err)
+						require.Len(t, stale, 1)
+						assert.Equal(t, name, stale[0].Name)
+					},
+				},
+				{
+					name: "GetIfExistsReturnsFalseOnExistingUserWithNoData",
+					test: func(t *testing.T, d Depot) {
+						const name = "bob"
+						u := &User{
+							ID: name,
+						}
+						_, err = client.Database(databaseName).Collection(collectionName).InsertOne(ctx, u)
+						require.NoError(t, err)
+
+						for _, tag := range []*depot.Tag{CrtTag(name), PrivKeyTag(name), CsrTag(name), CrlTag(name)} {
+							var exists bool
+							data, exists, err = GetIfExists(d, tag)
+							assert.NoError(t, err)
+							assert.False(t, exists)
+							assert.Nil(t, data)
+						}
+					},
+				},
 				{
 					name: "DeleteWhenDNE",
 					test: func(t *testing.T, d Depot) {
@@ -332,6 +412,67 @@ func TestDepot(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "Memory",
+			setup: func() Depot {
+				memDepot, err = NewMemoryDepot(DepotOptions{})
+				require.NoError(t, err)
+				return memDepot
+			},
+			bootstrap: func(t *testing.T) Depot {
+				conf := BootstrapDepotConfig{
+					CAName: "root",
+					CAOpts: &CertificateOptions{
+						CommonName: "root",
+						Expires:    time.Minute,
+					},
+					ServiceName: "localhost",
+					ServiceOpts: &CertificateOptions{
+						CommonName: "localhost",
+						Host:       "localhost",
+						CA:         "root",
+						Expires:    time.Minute,
+					},
+				}
+				memDepot, _, err = BootstrapInMemory(conf)
+				require.NoError(t, err)
+				return memDepot
+			},
+			makeDepot: func(t *testing.T, opts DepotOptions) Depot {
+				memDepot, err = NewMemoryDepot(opts)
+				require.NoError(t, err)
+				return memDepot
+			},
+			tamper: func(t *testing.T, d Depot, name string) {
+				require.NoError(t, d.(*storeDepot).store.Put(name, CredentialCert, []byte("tampered")))
+			},
+			check: func(t *testing.T, tag *depot.Tag, data []byte) {
+				stored, exists, err := GetIfExists(memDepot, tag)
+				require.NoError(t, err)
+				if data == nil {
+					assert.False(t, exists)
+					return
+				}
+				assert.True(t, exists)
+				assert.Equal(t, data, stored)
+			},
+			cleanup: func() {
+				memDepot = nil
+			},
+			tests: []testCase{
+				{
+					name: "DeleteWhenDNE",
+					test: func(t *testing.T, d Depot) {
+						const name = "bob"
+
+						assert.Error(t, d.Delete(CrtTag(name)))
+						assert.Error(t, d.Delete(PrivKeyTag(name)))
+						assert.Error(t, d.Delete(CsrTag(name)))
+						assert.Error(t, d.Delete(CrlTag(name)))
+					},
+				},
+			},
+		},
 	} {
 		t.Run(impl.name, func(t *testing.T) {
 			for _, test := range impl.tests {
@@ -469,6 +610,60 @@ func TestDepot(t *testing.T) {
 					assert.Equal(t, certRevocListData, data)
 				})
 			})
+			t.Run("GetIfExists", func(t *testing.T) {
+				d := impl.setup()
+				defer impl.cleanup()
+				const name = "bob"
+
+				t.Run("ReturnsFalseWhenDNE", func(t *testing.T) {
+					for _, tag := range []*depot.Tag{CrtTag(name), PrivKeyTag(name), CsrTag(name), CrlTag(name)} {
+						data, exists, err := GetIfExists(d, tag)
+						assert.NoError(t, err)
+						assert.False(t, exists)
+						assert.Nil(t, data)
+					}
+				})
+				t.Run("ReturnsCorrectData", func(t *testing.T) {
+					certData := []byte("bob's fake certificate")
+					require.NoError(t, d.Put(CrtTag(name), certData))
+					data, exists, err := GetIfExists(d, CrtTag(name))
+					assert.NoError(t, err)
+					assert.True(t, exists)
+					assert.Equal(t, certData, data)
+
+					data, exists, err = GetIfExists(d, PrivKeyTag(name))
+					assert.NoError(t, err)
+					assert.False(t, exists)
+					assert.Nil(t, data)
+				})
+			})
+			t.Run("GetAll", func(t *testing.T) {
+				d := impl.setup()
+				defer impl.cleanup()
+				const name = "bob"
+
+				t.Run("FailsWhenDNE", func(t *testing.T) {
+					u, err := GetAll(d, name)
+					assert.Error(t, err)
+					assert.Nil(t, u)
+				})
+				t.Run("ReturnsAllData", func(t *testing.T) {
+					certData := []byte("bob's fake certificate")
+					require.NoError(t, d.Put(CrtTag(name), certData))
+					keyData := []byte("bob's fake private key")
+					require.NoError(t, d.Put(PrivKeyTag(name), keyData))
+					certRevocListData := []byte("bob's fake certificate revocation list")
+					require.NoError(t, d.Put(CrlTag(name), certRevocListData))
+
+					u, err := GetAll(d, name)
+					require.NoError(t, err)
+					assert.Equal(t, name, u.ID)
+					assert.Equal(t, string(certData), u.Cert)
+					assert.Equal(t, string(keyData), u.PrivateKey)
+					assert.Empty(t, u.CertReq)
+					assert.Equal(t, string(certRevocListData), u.CertRevocList)
+				})
+			})
 			t.Run("Delete", func(t *testing.T) {
 				d := impl.setup()
 				defer impl.cleanup()
@@ -542,6 +737,35 @@ func TestDepot(t *testing.T) {
 					creds, err := d.Generate("")
 					assert.Error(t, err)
 					assert.Zero(t, creds)
+
+					creds, err = d.Generate("../alice")
+					assert.Error(t, err)
+					assert.Zero(t, creds)
+
+					creds, err = d.Generate("alice..chain")
+					assert.Error(t, err)
+					assert.Zero(t, creds)
+				})
+				t.Run("SaveFailsWithNameCollidingWithTags", func(t *testing.T) {
+					creds, err := d.Generate(name)
+					require.NoError(t, err)
+					for _, reserved := range []string{name + "..chain", name + "..ssh", name + "..dhparam"} {
+						assert.Error(t, d.Save(reserved, creds))
+					}
+					assert.False(t, d.Check(ChainTag(name)))
+					assert.False(t, d.Check(SSHCertTag(name)))
+				})
+				t.Run("UsesStoredNameWithSpaces", func(t *testing.T) {
+					creds, err := d.Generate("my host")
+					require.NoError(t, err)
+					assert.Equal(t, "my_host", creds.ServerName)
+
+					require.NoError(t, d.Put(CrtTag(creds.ServerName), creds.Cert))
+					require.NoError(t, d.Put(PrivKeyTag(creds.ServerName), creds.Key))
+					found, err := d.Find("my host")
+					require.NoError(t, err)
+					assert.Equal(t, "my_host", found.ServerName)
+					assert.Equal(t, creds.Cert, found.Cert)
 				})
 				t.Run("GeneratesCertificateInMemory", func(t *testing.T) {
 					creds, err := d.Generate(name)
@@ -587,6 +811,501 @@ func TestDepot(t *testing.T) {
 					assert.Zero(t, data)
 				})
 			})
+			t.Run("Scope", func(t *testing.T) {
+				d := impl.makeDepot(t, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+				defer impl.cleanup()
+				caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+				require.NoError(t, caOpts.Init(d))
+				for _, name := range []string{"service-x", "service-y"} {
+					creds, err := d.Generate(name)
+					require.NoError(t, err)
+					require.NoError(t, d.Save(name, creds))
+				}
+
+				t.Run("RejectsInvalidPattern", func(t *testing.T) {
+					_, err := NewScopedDepot(d, Scope{Names: []string{"["}})
+					assert.Error(t, err)
+				})
+				t.Run("ReadOnly", func(t *testing.T) {
+					scoped, err := NewScopedDepot(d, Scope{Names: []string{"service-x*"}, Operations: ReadOnlyDepotOperations})
+					require.NoError(t, err)
+
+					creds, err := scoped.Find("service-x")
+					require.NoError(t, err)
+					assert.NotEmpty(t, creds.Key)
+					assert.True(t, scoped.Check(CrtTag("service-x")))
+					_, err = scoped.Get(PrivKeyTag("service-x"))
+					assert.NoError(t, err)
+
+					_, err = scoped.Find("service-y")
+					assert.True(t, IsScopeError(err))
+					assert.False(t, scoped.Check(CrtTag("service-y")))
+					_, err = scoped.Get(CrtTag("root"))
+					assert.True(t, IsScopeError(err))
+
+					_, err = scoped.Generate("service-x")
+					assert.True(t, IsScopeError(err))
+					assert.True(t, IsScopeError(scoped.Save("service-x", creds)))
+					assert.True(t, IsScopeError(scoped.Put(ParamTag("service-x", "dhparam"), []byte("data"))))
+					assert.True(t, IsScopeError(scoped.Delete(CrtTag("service-x"))))
+					assert.True(t, CheckCertificate(d, "service-x"))
+				})
+				t.Run("IssueOnly", func(t *testing.T) {
+					scoped, err := NewScopedDepot(d, Scope{
+						Names:      []string{"service-z"},
+						Operations: []DepotOperation{DepotOpGenerate, DepotOpSave},
+					})
+					require.NoError(t, err)
+
+					creds, err := scoped.GenerateWithOptions(CertificateOptions{CommonName: "service-z", Host: "service-z"})
+					require.NoError(t, err)
+					require.NoError(t, scoped.Save("service-z", creds))
+					assert.True(t, CheckCertificate(d, "service-z"))
+
+					_, err = scoped.Find("service-z")
+					assert.True(t, IsScopeError(err))
+					_, err = scoped.Generate("service-x")
+					assert.True(t, IsScopeError(err))
+				})
+				t.Run("ChecksEveryRequestedName", func(t *testing.T) {
+					scoped, err := NewScopedDepot(d, Scope{
+						Names:      []string{"service-z*"},
+						Operations: []DepotOperation{DepotOpGenerate},
+					})
+					require.NoError(t, err)
+
+					_, err = scoped.GenerateWithOptions(CertificateOptions{CommonName: "service-z", Host: "service-z", Domain: []string{"service-z.example.com"}})
+					assert.NoError(t, err)
+					for name, opts := range map[string]CertificateOptions{
+						"Name":   {CommonName: "service-z", Name: "service-x"},
+						"Host":   {CommonName: "service-z", Host: "service-x"},
+						"Domain": {CommonName: "service-z", Host: "service-z", Domain: []string{"service-x"}},
+						"IP":     {CommonName: "service-z", Host: "service-z", IP: []string{"10.0.0.1"}},
+						"URI":    {CommonName: "service-z", Host: "service-z", URI: []string{"spiffe://example.com/service-x"}},
+					} {
+						t.Run(name, func(t *testing.T) {
+							_, err := scoped.GenerateWithOptions(opts)
+							assert.True(t, IsScopeError(err))
+						})
+					}
+				})
+			})
+			t.Run("PreviousGracePeriod", func(t *testing.T) {
+				replace := func(t *testing.T, grace time.Duration, name string) (Depot, *Credentials, *Credentials) {
+					d := impl.makeDepot(t, DepotOptions{CA: "root", DefaultExpiration: time.Hour, PreviousGracePeriod: grace})
+					caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+					require.NoError(t, caOpts.Init(d))
+
+					first, err := d.Generate(name)
+					require.NoError(t, err)
+					require.NoError(t, d.Save(name, first))
+					second, err := d.Generate(name)
+					require.NoError(t, err)
+					require.NoError(t, d.Save(name, second))
+					return d, first, second
+				}
+
+				t.Run("RetainsReplacedCredentials", func(t *testing.T) {
+					d, first, second := replace(t, time.Hour, "alice")
+					defer impl.cleanup()
+
+					current, err := d.Find("alice")
+					require.NoError(t, err)
+					assert.Equal(t, second.Cert, current.Cert)
+
+					prev, err := FindPrevious(d, "alice")
+					require.NoError(t, err)
+					assert.Equal(t, first.Cert, prev.Cert)
+					assert.Equal(t, first.Key, prev.Key)
+					assert.Equal(t, "alice", prev.ServerName)
+				})
+				t.Run("DisabledByDefault", func(t *testing.T) {
+					d, _, _ := replace(t, 0, "bob")
+					defer impl.cleanup()
+
+					_, err := FindPrevious(d, "bob")
+					assert.Error(t, err)
+					assert.False(t, CheckCertificate(d, PreviousName("bob")))
+				})
+				t.Run("RemovedAfterGracePeriod", func(t *testing.T) {
+					d, _, _ := replace(t, time.Millisecond, "carol")
+					defer impl.cleanup()
+					require.True(t, CheckCertificate(d, PreviousName("carol")))
+
+					time.Sleep(10 * time.Millisecond)
+					_, err := FindPrevious(d, "carol")
+					assert.Error(t, err)
+					assert.False(t, CheckCertificate(d, PreviousName("carol")))
+				})
+			})
+			t.Run("GenerateTemporary", func(t *testing.T) {
+				d := impl.makeDepot(t, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+				defer impl.cleanup()
+				caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+				require.NoError(t, caOpts.Init(d))
+
+				t.Run("IssuesWithoutStoring", func(t *testing.T) {
+					creds, err := GenerateTemporary(ctx, d, "debug alice", 5*time.Minute)
+					require.NoError(t, err)
+					bundle, err := creds.Bundle()
+					require.NoError(t, err)
+					assert.Equal(t, "debug_alice", bundle.Certificate.Subject.CommonName)
+					assert.WithinDuration(t, time.Now().Add(5*time.Minute), bundle.Certificate.NotAfter, time.Minute)
+					_, err = creds.Resolve()
+					assert.NoError(t, err)
+
+					assert.False(t, d.Check(CrtTag("debug_alice")))
+					assert.False(t, d.Check(PrivKeyTag("debug_alice")))
+					assert.False(t, d.Check(CsrTag("debug_alice")))
+
+					records, err := ListTemporaryCredentials(d)
+					require.NoError(t, err)
+					require.Len(t, records, 1)
+					assert.Equal(t, "debug_alice", records[0].Name)
+					assert.Equal(t, bundle.SerialNumber, records[0].SerialNumber)
+					assert.Equal(t, bundle.Fingerprint, records[0].Fingerprint)
+					assert.True(t, records[0].ExpiresAt.Equal(bundle.Certificate.NotAfter))
+
+					expirations, err := ListCertificateExpirations(ctx, d)
+					require.NoError(t, err)
+					for _, exp := range expirations {
+						assert.NotEqual(t, "debug_alice", exp.Name)
+					}
+				})
+				t.Run("PrunesExpiredRecords", func(t *testing.T) {
+					records, err := ListTemporaryCredentials(d)
+					require.NoError(t, err)
+					expired := TemporaryCredentialsRecord{Name: "old", ExpiresAt: time.Now().Add(-2 * TemporaryRegistryRetention)}
+					require.NoError(t, putTemporaryRecords(d, append([]TemporaryCredentialsRecord{expired}, records...)))
+
+					_, err = GenerateTemporary(ctx, d, "debug bob", time.Minute)
+					require.NoError(t, err)
+					records, err = ListTemporaryCredentials(d)
+					require.NoError(t, err)
+					require.Len(t, records, 2)
+					assert.Equal(t, "debug_alice", records[0].Name)
+					assert.Equal(t, "debug_bob", records[1].Name)
+				})
+				t.Run("RejectsInvalidTTL", func(t *testing.T) {
+					for _, ttl := range []time.Duration{0, time.Second, MaxTemporaryTTL + time.Minute} {
+						_, err := GenerateTemporary(ctx, d, "debug carol", ttl)
+						assert.Error(t, err)
+					}
+					_, err := GenerateTemporary(ctx, d, "", time.Minute)
+					assert.Error(t, err)
+				})
+			})
+			t.Run("Aliasing", func(t *testing.T) {
+				inner := impl.makeDepot(t, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+				defer impl.cleanup()
+				d, err := NewAliasingDepot(inner)
+				require.NoError(t, err)
+				caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+				require.NoError(t, caOpts.Init(d))
+				for _, name := range []string{"i-0123", "bob"} {
+					creds, err := d.Generate(name)
+					require.NoError(t, err)
+					require.NoError(t, d.Save(name, creds))
+				}
+
+				t.Run("ResolvesAliases", func(t *testing.T) {
+					require.NoError(t, AddAlias(d, "i-0123", "host.example.com"))
+					require.NoError(t, AddAlias(d, "host.example.com", "host"))
+					require.NoError(t, AddAlias(d, "i-0123", "host"))
+
+					aliases, err := GetAliases(d, "i-0123")
+					require.NoError(t, err)
+					assert.Equal(t, []string{"host", "host.example.com"}, aliases)
+
+					expected, err := d.Find("i-0123")
+					require.NoError(t, err)
+					for _, alias := range aliases {
+						creds, err := d.Find(alias)
+						require.NoError(t, err)
+						assert.Equal(t, expected.Cert, creds.Cert)
+						assert.Equal(t, expected.Key, creds.Key)
+						data, err := d.Get(CrtTag(alias))
+						require.NoError(t, err)
+						assert.Equal(t, expected.Cert, data)
+						assert.False(t, inner.Check(CrtTag(alias)))
+					}
+
+					names, err := d.(NameLister).ListNames()
+					require.NoError(t, err)
+					assert.Equal(t, []string{"bob", "i-0123", "root"}, names)
+				})
+				t.Run("WritesThroughAliases", func(t *testing.T) {
+					creds, err := d.Generate("i-0123")
+					require.NoError(t, err)
+					require.NoError(t, d.Save("host", creds))
+
+					found, err := inner.Find("i-0123")
+					require.NoError(t, err)
+					assert.Equal(t, creds.Key, found.Key)
+					assert.False(t, inner.Check(PrivKeyTag("host")))
+				})
+				t.Run("RejectsConflictingAliases", func(t *testing.T) {
+					assert.Error(t, AddAlias(d, "bob", "host"))
+					assert.Error(t, AddAlias(d, "i-0123", "bob"))
+					assert.Error(t, AddAlias(d, "carol", "alias"))
+					assert.Error(t, AddAlias(d, "bob", "bob"))
+				})
+				t.Run("DeletesThroughAliases", func(t *testing.T) {
+					require.NoError(t, d.Delete(CrtTag("host")))
+					assert.False(t, inner.Check(CrtTag("i-0123")))
+					assert.False(t, d.Check(CrtTag("host.example.com")))
+					_, err := d.Find("host.example.com")
+					assert.Error(t, err)
+				})
+				t.Run("RemovesAliases", func(t *testing.T) {
+					require.NoError(t, RemoveAlias(d, "host"))
+					aliases, err := GetAliases(d, "i-0123")
+					require.NoError(t, err)
+					assert.Equal(t, []string{"host.example.com"}, aliases)
+					assert.Error(t, RemoveAlias(d, "host"))
+
+					require.NoError(t, AddAlias(d, "bob", "host"))
+					creds, err := d.Find("host")
+					require.NoError(t, err)
+					assert.Equal(t, "host", creds.ServerName)
+				})
+				t.Run("RequiresAliasingDepot", func(t *testing.T) {
+					assert.Error(t, AddAlias(inner, "bob", "robert"))
+					_, err := GetAliases(inner, "bob")
+					assert.Error(t, err)
+				})
+			})
+			t.Run("Manifest", func(t *testing.T) {
+				inner := impl.makeDepot(t, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+				defer impl.cleanup()
+				operatorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				require.NoError(t, err)
+
+				caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+				require.NoError(t, caOpts.Init(inner))
+
+				_, err = NewManifestDepot(inner, nil)
+				assert.Error(t, err)
+				d, err := NewManifestDepot(inner, operatorKey)
+				require.NoError(t, err)
+				for _, name := range []string{"alice", "bob", "carol"} {
+					creds, err := d.Generate(name)
+					require.NoError(t, err)
+					require.NoError(t, d.Save(name, creds))
+				}
+				require.NoError(t, d.Delete(CrtTag("carol")))
+
+				t.Run("VerifiesUntouchedDepot", func(t *testing.T) {
+					assert.NoError(t, VerifyManifest(d, &operatorKey.PublicKey))
+					assert.NoError(t, VerifyManifest(inner, &operatorKey.PublicKey))
+
+					reopened, err := NewManifestDepot(inner, operatorKey)
+					require.NoError(t, err)
+					assert.NoError(t, VerifyManifest(reopened, &operatorKey.PublicKey))
+				})
+				t.Run("HidesManifest", func(t *testing.T) {
+					names, err := d.(NameLister).ListNames()
+					require.NoError(t, err)
+					assert.NotContains(t, names, manifestName)
+					assert.Error(t, d.Put(manifestTag(), []byte("{}")))
+					assert.Error(t, d.Delete(manifestTag()))
+				})
+				t.Run("RejectsWrongKey", func(t *testing.T) {
+					_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+					require.NoError(t, err)
+					assert.Error(t, VerifyManifest(d, otherKey.Public()))
+				})
+				t.Run("DetectsAddedEntry", func(t *testing.T) {
+					creds, err := inner.Generate("mallory")
+					require.NoError(t, err)
+					require.NoError(t, inner.Save("mallory", creds))
+					err = VerifyManifest(d, &operatorKey.PublicKey)
+					require.Error(t, err)
+					assert.Contains(t, err.Error(), "entry 'cert/mallory' is not in the manifest")
+					require.NoError(t, d.Delete(CrtTag("mallory")))
+					require.NoError(t, d.Delete(PrivKeyTag("mallory")))
+					assert.NoError(t, VerifyManifest(d, &operatorKey.PublicKey))
+				})
+				t.Run("DetectsRemovedEntry", func(t *testing.T) {
+					require.NoError(t, inner.Delete(PrivKeyTag("bob")))
+					err := VerifyManifest(d, &operatorKey.PublicKey)
+					require.Error(t, err)
+					assert.Contains(t, err.Error(), "entry 'key/bob' was removed")
+				})
+				t.Run("DetectsModifiedEntry", func(t *testing.T) {
+					impl.tamper(t, inner, "alice")
+					err := VerifyManifest(d, &operatorKey.PublicKey)
+					require.Error(t, err)
+					assert.Contains(t, err.Error(), "entry 'cert/alice' was modified")
+				})
+			})
+			t.Run("ListNamesOmitsReservedNames", func(t *testing.T) {
+				inner := impl.makeDepot(t, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+				defer impl.cleanup()
+				caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+				require.NoError(t, caOpts.Init(inner))
+
+				_, err := GenerateTemporary(ctx, inner, "debug", time.Minute)
+				require.NoError(t, err)
+				operatorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				require.NoError(t, err)
+				manifested, err := NewManifestDepot(inner, operatorKey)
+				require.NoError(t, err)
+				aliased, err := NewAliasingDepot(manifested)
+				require.NoError(t, err)
+				creds, err := aliased.Generate("alice")
+				require.NoError(t, err)
+				require.NoError(t, aliased.Save("alice", creds))
+				require.NoError(t, AddAlias(aliased, "alice", "host"))
+
+				names, err := inner.(NameLister).ListNames()
+				require.NoError(t, err)
+				assert.Equal(t, []string{"alice", "host", "root"}, names)
+
+				for _, reserved := range []string{temporaryRegistryName, manifestName, aliasLockName} {
+					assert.Error(t, inner.Save(reserved, creds))
+				}
+			})
+			t.Run("Lock", func(t *testing.T) {
+				d := impl.makeDepot(t, DepotOptions{})
+				defer impl.cleanup()
+				locker, ok := d.(Locker)
+				if !ok {
+					t.Skip("depot does not implement Locker")
+				}
+
+				t.Run("IsExclusive", func(t *testing.T) {
+					acquired, err := locker.TryLock("exclusive", "alice", time.Minute)
+					require.NoError(t, err)
+					assert.True(t, acquired)
+
+					acquired, err = locker.TryLock("exclusive", "bob", time.Minute)
+					require.NoError(t, err)
+					assert.False(t, acquired)
+
+					require.NoError(t, locker.Unlock("exclusive", "bob"))
+					acquired, err = locker.TryLock("exclusive", "bob", time.Minute)
+					require.NoError(t, err)
+					assert.False(t, acquired)
+
+					require.NoError(t, locker.Unlock("exclusive", "alice"))
+					acquired, err = locker.TryLock("exclusive", "bob", time.Minute)
+					require.NoError(t, err)
+					assert.True(t, acquired)
+				})
+				t.Run("TakesOverExpiredLock", func(t *testing.T) {
+					acquired, err := locker.TryLock("expired", "alice", -time.Second)
+					require.NoError(t, err)
+					require.True(t, acquired)
+
+					acquired, err = locker.TryLock("expired", "bob", time.Minute)
+					require.NoError(t, err)
+					assert.True(t, acquired)
+
+					require.NoError(t, locker.Unlock("expired", "alice"))
+					acquired, err = locker.TryLock("expired", "carol", time.Minute)
+					require.NoError(t, err)
+					assert.False(t, acquired)
+				})
+				t.Run("IsNotListed", func(t *testing.T) {
+					names, err := d.(NameLister).ListNames()
+					require.NoError(t, err)
+					assert.Empty(t, names)
+				})
+				t.Run("RenewsLockWhileHeld", func(t *testing.T) {
+					called := false
+					err := withLock(ctx, d, "renewed", 60*time.Millisecond, func() error {
+						called = true
+						time.Sleep(200 * time.Millisecond)
+						acquired, err := locker.TryLock("renewed", "bob", time.Minute)
+						require.NoError(t, err)
+						assert.False(t, acquired)
+						return nil
+					})
+					assert.NoError(t, err)
+					assert.True(t, called)
+
+					acquired, err := locker.TryLock("renewed", "bob", time.Minute)
+					require.NoError(t, err)
+					assert.True(t, acquired)
+				})
+				t.Run("WaitsForContext", func(t *testing.T) {
+					acquired, err := locker.TryLock("held", "alice", time.Minute)
+					require.NoError(t, err)
+					require.True(t, acquired)
+
+					waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+					defer cancel()
+					called := false
+					err = withLock(waitCtx, d, "held", time.Minute, func() error {
+						called = true
+						return nil
+					})
+					assert.Error(t, err)
+					assert.False(t, called)
+				})
+			})
 		})
 	}
 }
+
+func TestNewMongoDBCertDepotWithCollection(t *testing.T) {
+	ctx := context.TODO()
+
+	t.Run("FailsWithNilCollection", func(t *testing.T) {
+		d, err := NewMongoDBCertDepotWithCollection(ctx, nil, DepotOptions{})
+		assert.Error(t, err)
+		assert.Nil(t, d)
+	})
+	t.Run("UsesProvidedCollection", func(t *testing.T) {
+		connctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		client, err := mongo.Connect(connctx, options.Client().ApplyURI(testMongoDBURI()))
+		require.NoError(t, err)
+		coll := client.Database("certDepot").Collection("injected")
+		defer func() {
+			assert.NoError(t, coll.Drop(ctx))
+			assert.NoError(t, coll.Database().Collection(coll.Name()+depotMetadataCollectionSuffix).Drop(ctx))
+		}()
+
+		d, err := NewMongoDBCertDepotWithCollection(ctx, coll, DepotOptions{CA: "root"})
+		require.NoError(t, err)
+		require.NoError(t, d.Put(CrtTag("alice"), []byte("data")))
+
+		u := &User{}
+		require.NoError(t, coll.FindOne(ctx, bson.M{userIDKey: "alice"}).Decode(u))
+		assert.Equal(t, "data", u.Cert)
+
+		require.NoError(t, SaveDepotOptions(d, DepotOptions{CA: "root", DefaultExpiration: time.Hour}))
+		reopened, err := NewMongoDBCertDepotWithCollection(ctx, coll, DepotOptions{})
+		require.NoError(t, err)
+		opts := reopened.(DepotOptionsGetter).DepotOptions()
+		assert.Equal(t, "root", opts.CA)
+		assert.Equal(t, time.Hour, opts.DefaultExpiration)
+	})
+}
+
+func TestMongoDepotOperationContext(t *testing.T) {
+	m := &mongoDepot{
+		ctx:         context.Background(),
+		readTimeout: time.Minute,
+	}
+
+	ctx, cancel := m.readContext()
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	ctx, cancel = m.writeContext()
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+
+	parent, parentCancel := context.WithCancel(context.Background())
+	m.ctx = parent
+	ctx, cancel = m.readContext()
+	defer cancel()
+	parentCancel()
+	assert.Error(t, ctx.Err())
+}
@@ -0,0 +1,113 @@
+package certdepot
+
+import (
+	"crypto/tls"
+
+	"github.com/pkg/errors"
+)
+
+// ECDSASuffix is appended to a name to get the name under which the ECDSA
+// credentials of dual-stack credentials are stored.
+const ECDSASuffix = "-ecdsa"
+
+// ECDSAName returns the name under which the ECDSA credentials of the
+// dual-stack credentials for the name are stored.
+func ECDSAName(name string) string {
+	return name + ECDSASuffix
+}
+
+// DualStackCredentials are a pair of credentials with RSA and ECDSA keys for
+// the same name, so that a server can prefer ECDSA while still supporting
+// clients that only support RSA.
+type DualStackCredentials struct {
+	RSA   *Credentials `bson:"rsa" json:"rsa" yaml:"rsa"`
+	ECDSA *Credentials `bson:"ecdsa" json:"ecdsa" yaml:"ecdsa"`
+}
+
+// GenerateDualStack issues an RSA certificate and an ECDSA certificate with
+// the same subject and subject alt names described by the options, without
+// storing them. The options' KeyType is ignored, and its KeyBits only applies
+// to the RSA key.
+func GenerateDualStack(wd Depot, opts CertificateOptions) (*DualStackCredentials, error) {
+	rsaOpts := opts
+	rsaOpts.KeyType = KeyTypeRSA
+	rsaCreds, err := wd.GenerateWithOptions(rsaOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating RSA credentials")
+	}
+
+	ecdsaOpts := opts
+	ecdsaOpts.KeyType = KeyTypeECDSA
+	ecdsaOpts.KeyBits = 0
+	ecdsaCreds, err := wd.GenerateWithOptions(ecdsaOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating ECDSA credentials")
+	}
+
+	return &DualStackCredentials{RSA: rsaCreds, ECDSA: ecdsaCreds}, nil
+}
+
+// SaveDualStack stores the RSA credentials under the name and the ECDSA
+// credentials under ECDSAName(name).
+func SaveDualStack(wd Depot, name string, creds *DualStackCredentials) error {
+	if err := creds.Validate(); err != nil {
+		return errors.Wrap(err, "invalid dual-stack credentials")
+	}
+	if err := wd.Save(name, creds.RSA); err != nil {
+		return errors.Wrap(err, "saving RSA credentials")
+	}
+
+	return errors.Wrap(wd.Save(ECDSAName(name), creds.ECDSA), "saving ECDSA credentials")
+}
+
+// FindDualStack returns the dual-stack credentials stored for the name by
+// SaveDualStack.
+func FindDualStack(wd Depot, name string) (*DualStackCredentials, error) {
+	rsaCreds, err := wd.Find(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "finding RSA credentials")
+	}
+	ecdsaCreds, err := wd.Find(ECDSAName(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "finding ECDSA credentials")
+	}
+	ecdsaCreds.ServerName = rsaCreds.ServerName
+
+	return &DualStackCredentials{RSA: rsaCreds, ECDSA: ecdsaCreds}, nil
+}
+
+// Validate checks that both credentials are set and valid.
+func (c *DualStackCredentials) Validate() error {
+	if c.RSA == nil || c.ECDSA == nil {
+		return errors.New("must have both RSA and ECDSA credentials")
+	}
+	if err := c.RSA.Validate(); err != nil {
+		return errors.Wrap(err, "invalid RSA credentials")
+	}
+
+	return errors.Wrap(c.ECDSA.Validate(), "invalid ECDSA credentials")
+}
+
+// Resolve converts the credentials into a tls.Config that serves the ECDSA
+// certificate to clients that support it and the RSA certificate to all
+// other clients. The CA certificates and server name are taken from the RSA
+// credentials.
+func (c *DualStackCredentials) Resolve() (*tls.Config, error) {
+	if err := c.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid dual-stack credentials")
+	}
+
+	conf, err := c.RSA.Resolve()
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving RSA credentials")
+	}
+	ecdsaConf, err := c.ECDSA.Resolve()
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving ECDSA credentials")
+	}
+
+	// Servers use the first certificate that the client supports.
+	conf.Certificates = append(ecdsaConf.Certificates, conf.Certificates...)
+
+	return conf, nil
+}
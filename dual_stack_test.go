@@ -0,0 +1,106 @@
+package certdepot
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDualStack(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "dual-stack-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+
+	t.Run("GenerateECDSA", func(t *testing.T) {
+		creds, err := d.GenerateWithOptions(CertificateOptions{CommonName: "ec", Host: "ec", KeyType: KeyTypeECDSA, KeyBits: 384})
+		require.NoError(t, err)
+		bundle, err := creds.Bundle()
+		require.NoError(t, err)
+		key, ok := bundle.Certificate.PublicKey.(*ecdsa.PublicKey)
+		require.True(t, ok)
+		assert.Equal(t, 384, key.Curve.Params().BitSize)
+	})
+	t.Run("RejectsInvalidKeyType", func(t *testing.T) {
+		_, err := d.GenerateWithOptions(CertificateOptions{CommonName: "bad", Host: "bad", KeyType: "dsa"})
+		assert.Error(t, err)
+		_, err = d.GenerateWithOptions(CertificateOptions{CommonName: "bad", Host: "bad", KeyType: KeyTypeECDSA, KeyBits: 2048})
+		assert.Error(t, err)
+	})
+
+	creds, err := GenerateDualStack(d, CertificateOptions{CommonName: "alice", Host: "alice", Domain: []string{"alice"}})
+	require.NoError(t, err)
+	require.NoError(t, SaveDualStack(d, "alice", creds))
+	assert.True(t, CheckCertificate(d, "alice"))
+	assert.True(t, CheckCertificate(d, ECDSAName("alice")))
+
+	found, err := FindDualStack(d, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, creds.RSA.Cert, found.RSA.Cert)
+	assert.Equal(t, creds.ECDSA.Cert, found.ECDSA.Cert)
+	assert.Equal(t, "alice", found.ECDSA.ServerName)
+
+	serverConf, err := found.Resolve()
+	require.NoError(t, err)
+	require.Len(t, serverConf.Certificates, 2)
+
+	bob, err := d.GenerateWithOptions(CertificateOptions{CommonName: "bob", Host: "bob", Domain: []string{"bob"}})
+	require.NoError(t, err)
+
+	// handshake returns the public key of the certificate the server
+	// presents to the client.
+	handshake := func(t *testing.T, clientConf *tls.Config) interface{} {
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConf)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		errs := make(chan error, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			errs <- conn.(*tls.Conn).Handshake()
+		}()
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientConf)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.Handshake())
+		require.NoError(t, <-errs)
+
+		return conn.ConnectionState().PeerCertificates[0].PublicKey
+	}
+	newClientConf := func(t *testing.T) *tls.Config {
+		conf, err := bob.Resolve()
+		require.NoError(t, err)
+		conf.ServerName = "alice"
+		return conf
+	}
+
+	t.Run("PrefersECDSA", func(t *testing.T) {
+		_, ok := handshake(t, newClientConf(t)).(*ecdsa.PublicKey)
+		assert.True(t, ok)
+	})
+	t.Run("FallsBackToRSA", func(t *testing.T) {
+		conf := newClientConf(t)
+		conf.MaxVersion = tls.VersionTLS12
+		conf.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+		_, ok := handshake(t, conf).(*rsa.PublicKey)
+		assert.True(t, ok)
+	})
+}
@@ -0,0 +1,292 @@
+package certdepot
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ParseDuration parses a duration string as time.ParseDuration does, but also
+// accepts days with the unit "d", such as "90d" or "1d12h". A day is always 24
+// hours.
+func ParseDuration(s string) (time.Duration, error) {
+	rest := s
+	negative := false
+	if rest != "" && (rest[0] == '-' || rest[0] == '+') {
+		negative = rest[0] == '-'
+		rest = rest[1:]
+	}
+	if rest == "" {
+		return 0, errors.Errorf("invalid duration '%s'", s)
+	}
+
+	var days float64
+	others := &strings.Builder{}
+	for rest != "" {
+		numEnd := strings.IndexFunc(rest, func(r rune) bool { return r != '.' && (r < '0' || r > '9') })
+		if numEnd == 0 {
+			return 0, errors.Errorf("invalid duration '%s'", s)
+		}
+		if numEnd < 0 {
+			numEnd = len(rest)
+		}
+		unitEnd := strings.IndexFunc(rest[numEnd:], func(r rune) bool { return r == '.' || (r >= '0' && r <= '9') })
+		if unitEnd < 0 {
+			unitEnd = len(rest)
+		} else {
+			unitEnd += numEnd
+		}
+
+		if rest[numEnd:unitEnd] == "d" {
+			count, err := strconv.ParseFloat(rest[:numEnd], 64)
+			if err != nil {
+				return 0, errors.Errorf("invalid duration '%s'", s)
+			}
+			days += count
+		} else {
+			others.WriteString(rest[:unitEnd])
+		}
+		rest = rest[unitEnd:]
+	}
+
+	var d time.Duration
+	if others.Len() > 0 {
+		var err error
+		if d, err = time.ParseDuration(others.String()); err != nil {
+			return 0, errors.Errorf("invalid duration '%s'", s)
+		}
+	}
+	total := float64(d) + days*float64(24*time.Hour)
+	if total > math.MaxInt64 {
+		return 0, errors.Errorf("duration '%s' is too long", s)
+	}
+	if negative {
+		total = -total
+	}
+
+	return time.Duration(total), nil
+}
+
+// humaneDuration is a time.Duration that is unmarshalled from either a number
+// of nanoseconds or a duration string accepted by ParseDuration.
+type humaneDuration time.Duration
+
+func (d *humaneDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var nanos int64
+		if err = json.Unmarshal(data, &nanos); err != nil {
+			return errors.Errorf("duration must be a string such as \"720h\" or \"90d\" or a number of nanoseconds, not %s", data)
+		}
+		*d = humaneDuration(nanos)
+		return nil
+	}
+
+	parsed, err := ParseDuration(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	*d = humaneDuration(parsed)
+	return nil
+}
+
+func (d *humaneDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var nanos int64
+	if err := unmarshal(&nanos); err == nil {
+		*d = humaneDuration(nanos)
+		return nil
+	}
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return errors.New("duration must be a string such as \"720h\" or \"90d\" or a number of nanoseconds")
+	}
+
+	parsed, err := ParseDuration(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	*d = humaneDuration(parsed)
+	return nil
+}
+
+var (
+	durationType       = reflect.TypeOf(time.Duration(0))
+	humaneDurationType = reflect.TypeOf(humaneDuration(0))
+	// humaneDurationMirrors caches the mirror types built by
+	// humaneDurationMirror, keyed by the original type.
+	humaneDurationMirrors sync.Map
+)
+
+// humaneDurationMirror returns a struct type with the same exported fields and
+// tags as the struct type, except that its time.Duration fields are
+// humaneDurations. The struct type must not have embedded fields.
+func humaneDurationMirror(t reflect.Type) reflect.Type {
+	if mirror, ok := humaneDurationMirrors.Load(t); ok {
+		return mirror.(reflect.Type)
+	}
+
+	fields := []reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Type == durationType {
+			field.Type = humaneDurationType
+		}
+		field.Index = nil
+		field.Offset = 0
+		fields = append(fields, field)
+	}
+	mirror := reflect.StructOf(fields)
+	humaneDurationMirrors.Store(t, mirror)
+
+	return mirror
+}
+
+// unmarshalHumaneDurations unmarshals into the struct that v points to with
+// the unmarshal function, accepting duration strings for its time.Duration
+// fields in addition to numbers of nanoseconds. Fields that are not
+// unmarshalled keep their values.
+func unmarshalHumaneDurations(v interface{}, unmarshal func(interface{}) error) error {
+	val := reflect.ValueOf(v).Elem()
+	mirror := reflect.New(humaneDurationMirror(val.Type())).Elem()
+	copyFieldsByName(mirror, val)
+	if err := unmarshal(mirror.Addr().Interface()); err != nil {
+		return err
+	}
+	copyFieldsByName(val, mirror)
+
+	return nil
+}
+
+// copyFieldsByName sets the fields of dst to the fields of src with the same
+// names, converting between time.Duration and humaneDuration.
+func copyFieldsByName(dst, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		dst.Field(i).Set(src.FieldByName(field.Name).Convert(field.Type))
+	}
+}
+
+// jsonUnmarshaler returns an unmarshal function that unmarshals the JSON data.
+func jsonUnmarshaler(data []byte) func(interface{}) error {
+	return func(v interface{}) error { return json.Unmarshal(data, v) }
+}
+
+// UnmarshalJSON unmarshals the options, accepting durations such as
+// DefaultExpiration as strings like "720h" or "90d" (see ParseDuration) as
+// well as numbers of nanoseconds.
+func (opts *DepotOptions) UnmarshalJSON(data []byte) error {
+	return unmarshalHumaneDurations(opts, jsonUnmarshaler(data))
+}
+
+// UnmarshalYAML is the YAML equivalent of UnmarshalJSON.
+func (opts *DepotOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshalHumaneDurations(opts, unmarshal)
+}
+
+// UnmarshalJSON unmarshals the options, accepting durations such as Expires as
+// strings like "720h" or "90d" (see ParseDuration) as well as numbers of
+// nanoseconds. It returns an error if a passphrase is the placeholder that
+// MarshalJSON replaces it with.
+func (opts *CertificateOptions) UnmarshalJSON(data []byte) error {
+	return opts.unmarshal(jsonUnmarshaler(data))
+}
+
+// UnmarshalYAML is the YAML equivalent of UnmarshalJSON.
+func (opts *CertificateOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return opts.unmarshal(unmarshal)
+}
+
+func (opts *CertificateOptions) unmarshal(unmarshal func(interface{}) error) error {
+	if err := unmarshalHumaneDurations(opts, unmarshal); err != nil {
+		return err
+	}
+	return opts.checkNotRedacted()
+}
+
+// UnmarshalJSON unmarshals the options, accepting durations such as the
+// timeouts as strings like "30s" (see ParseDuration) as well as numbers of
+// nanoseconds.
+func (opts *MongoDBOptions) UnmarshalJSON(data []byte) error {
+	return unmarshalHumaneDurations(opts, jsonUnmarshaler(data))
+}
+
+// UnmarshalYAML is the YAML equivalent of UnmarshalJSON.
+func (opts *MongoDBOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshalHumaneDurations(opts, unmarshal)
+}
+
+// ensureServiceCertificateOwnFields has the fields of
+// EnsureServiceCertificateOptions that are not promoted from
+// CertificateOptions.
+type ensureServiceCertificateOwnFields struct {
+	RenewBefore time.Duration `json:"renew_before,omitempty" yaml:"renew_before,omitempty"`
+}
+
+// UnmarshalJSON unmarshals the options, accepting durations such as Expires and
+// RenewBefore as strings like "720h" or "90d" (see ParseDuration) as well as
+// numbers of nanoseconds. Without it, the method promoted from
+// CertificateOptions would drop RenewBefore.
+func (opts *EnsureServiceCertificateOptions) UnmarshalJSON(data []byte) error {
+	return opts.unmarshal(jsonUnmarshaler(data))
+}
+
+// UnmarshalYAML is the YAML equivalent of UnmarshalJSON.
+func (opts *EnsureServiceCertificateOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return opts.unmarshal(unmarshal)
+}
+
+func (opts *EnsureServiceCertificateOptions) unmarshal(unmarshal func(interface{}) error) error {
+	if err := opts.CertificateOptions.unmarshal(unmarshal); err != nil {
+		return err
+	}
+	own := ensureServiceCertificateOwnFields{RenewBefore: opts.RenewBefore}
+	if err := unmarshalHumaneDurations(&own, unmarshal); err != nil {
+		return err
+	}
+	opts.RenewBefore = own.RenewBefore
+
+	return nil
+}
+
+// certificateSpecOwnFields has the fields of CertificateSpec that are not
+// promoted from EnsureServiceCertificateOptions.
+type certificateSpecOwnFields struct {
+	Name string `json:"name" yaml:"name"`
+}
+
+// UnmarshalJSON unmarshals the spec, accepting durations as
+// EnsureServiceCertificateOptions does. Without it, the method promoted from
+// EnsureServiceCertificateOptions would drop Name.
+func (s *CertificateSpec) UnmarshalJSON(data []byte) error {
+	return s.unmarshal(jsonUnmarshaler(data))
+}
+
+// UnmarshalYAML is the YAML equivalent of UnmarshalJSON.
+func (s *CertificateSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return s.unmarshal(unmarshal)
+}
+
+func (s *CertificateSpec) unmarshal(unmarshal func(interface{}) error) error {
+	if err := s.EnsureServiceCertificateOptions.unmarshal(unmarshal); err != nil {
+		return err
+	}
+	own := certificateSpecOwnFields{Name: s.Name}
+	if err := unmarshal(&own); err != nil {
+		return err
+	}
+	s.Name = own.Name
+
+	return nil
+}
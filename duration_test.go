@@ -0,0 +1,98 @@
+package certdepot
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDuration(t *testing.T) {
+	for input, expected := range map[string]time.Duration{
+		"720h":    720 * time.Hour,
+		"90d":     90 * 24 * time.Hour,
+		"1d12h":   36 * time.Hour,
+		"1.5d":    36 * time.Hour,
+		"2h1d30m": 26*time.Hour + 30*time.Minute,
+		"-1d":     -24 * time.Hour,
+		"0":       0,
+		"1m30s":   90 * time.Second,
+	} {
+		t.Run(input, func(t *testing.T) {
+			d, err := ParseDuration(input)
+			require.NoError(t, err)
+			assert.Equal(t, expected, d)
+		})
+	}
+	for _, input := range []string{"", "d", "90", "1y", "1dd", "1.2.3d", "-", "1000000d"} {
+		t.Run("Invalid"+input, func(t *testing.T) {
+			_, err := ParseDuration(input)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestUnmarshalHumaneDurations(t *testing.T) {
+	t.Run("DepotOptions", func(t *testing.T) {
+		opts := DepotOptions{CA: "root"}
+		require.NoError(t, json.Unmarshal([]byte(`{"default_expiration": "90d", "previous_grace_period": "1h"}`), &opts))
+		assert.Equal(t, DepotOptions{CA: "root", DefaultExpiration: 90 * 24 * time.Hour, PreviousGracePeriod: time.Hour}, opts)
+
+		require.NoError(t, json.Unmarshal([]byte(`{"default_expiration": 60000000000}`), &opts))
+		assert.Equal(t, time.Minute, opts.DefaultExpiration)
+
+		assert.Error(t, json.Unmarshal([]byte(`{"default_expiration": "ninety days"}`), &opts))
+		assert.Error(t, json.Unmarshal([]byte(`{"default_expiration": true}`), &opts))
+	})
+	t.Run("BootstrapDepotConfig", func(t *testing.T) {
+		conf := BootstrapDepotConfig{}
+		require.NoError(t, json.Unmarshal([]byte(`{
+			"mongo_depot": {"db_name": "db", "coll_name": "coll", "dial_timeout": "5s", "depot_options": {"default_expiration": "30d"}},
+			"ca_name": "root",
+			"service_name": "web",
+			"ca_opts": {"cn": "root", "expires": "3650d"},
+			"service_opts": {"cn": "web", "ca": "root", "expires": "720h", "dns": ["web.example.com"]}
+		}`), &conf))
+		assert.Equal(t, 5*time.Second, conf.MongoDepot.MongoDBDialTimeout)
+		assert.Equal(t, 30*24*time.Hour, conf.MongoDepot.DepotOptions.DefaultExpiration)
+		assert.Equal(t, 3650*24*time.Hour, conf.CAOpts.Expires)
+		assert.Equal(t, 720*time.Hour, conf.ServiceOpts.Expires)
+		assert.Equal(t, []string{"web.example.com"}, conf.ServiceOpts.Domain)
+		assert.Equal(t, "web", conf.ServiceOpts.CommonName)
+	})
+	t.Run("CertificateSpec", func(t *testing.T) {
+		spec := CertificateSpec{}
+		require.NoError(t, json.Unmarshal([]byte(`{"name": "web", "cn": "web", "expires": "7d", "renew_before": "2d"}`), &spec))
+		assert.Equal(t, "web", spec.Name)
+		assert.Equal(t, "web", spec.CommonName)
+		assert.Equal(t, 7*24*time.Hour, spec.Expires)
+		assert.Equal(t, 2*24*time.Hour, spec.RenewBefore)
+	})
+	t.Run("RoundTrips", func(t *testing.T) {
+		opts := CertificateOptions{CommonName: "web", Expires: time.Hour, Domain: []string{"web"}}
+		data, err := json.Marshal(opts)
+		require.NoError(t, err)
+		unmarshalled := CertificateOptions{}
+		require.NoError(t, json.Unmarshal(data, &unmarshalled))
+		assert.Equal(t, opts, unmarshalled)
+	})
+	t.Run("YAML", func(t *testing.T) {
+		var d humaneDuration
+		require.NoError(t, d.UnmarshalYAML(func(v interface{}) error {
+			if s, ok := v.(*string); ok {
+				*s = "90d"
+				return nil
+			}
+			return assert.AnError
+		}))
+		assert.Equal(t, humaneDuration(90*24*time.Hour), d)
+
+		require.NoError(t, d.UnmarshalYAML(func(v interface{}) error {
+			*v.(*int64) = int64(time.Minute)
+			return nil
+		}))
+		assert.Equal(t, humaneDuration(time.Minute), d)
+	})
+}
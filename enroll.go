@@ -0,0 +1,120 @@
+package certdepot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+)
+
+// EnrollCertificate creates a key and certificate request for the options in
+// the depot and has the signer issue the certificate, instead of a CA in the
+// depot or the depot's Signer. The certificate is stored under the standard
+// tags, so certificates enrolled with an external CA, such as a step-ca
+// server, are rotated and distributed the same way as those issued by the
+// depot.
+func EnrollCertificate(ctx context.Context, wd Depot, opts CertificateOptions, signer Signer) error {
+	if signer == nil {
+		return errors.New("must specify a signer")
+	}
+	if _, err := opts.StorageName(); err != nil {
+		return errors.WithStack(err)
+	}
+	opts.Reset()
+
+	if err := opts.certRequestForCreate(wd); err != nil {
+		return errors.Wrap(err, "creating the certificate request")
+	}
+	if _, err := opts.signExternally(ctx, wd, signer, opts.csr, opts.formattedCertificateName()); err != nil {
+		return errors.Wrap(err, "enrolling certificate")
+	}
+
+	return errors.Wrap(opts.PutCertFromMemory(wd), "putting enrolled certificate")
+}
+
+// EnrollCertificateOnExpiration is the same as CreateCertificateOnExpiration,
+// but enrolls the new certificate with the signer like EnrollCertificate.
+func EnrollCertificateOnExpiration(ctx context.Context, wd Depot, opts CertificateOptions, signer Signer, after time.Duration) (bool, error) {
+	dne, err := opts.deleteForRenewal(wd, after)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if !dne {
+		return false, nil
+	}
+
+	return true, errors.WithStack(EnrollCertificate(ctx, wd, opts, signer))
+}
+
+// StepCASigner is a Signer that enrolls certificates with a step-ca server
+// using its sign API and a one-time token from one of its provisioners.
+type StepCASigner struct {
+	// URL is the base URL of the step-ca server, e.g.
+	// "https://ca.example.com:9000".
+	URL string
+	// Token returns the one-time token authorizing the request, such as a
+	// JWK provisioner token bound to the request's common name and subject
+	// alt names.
+	Token func(context.Context, IssuanceRequest) (string, error)
+	// Client is the HTTP client used to make requests. It should trust the
+	// step-ca server's root certificate. If nil, a client with a default
+	// timeout is used.
+	Client *http.Client
+}
+
+type stepCASignRequest struct {
+	CSR      string `json:"csr"`
+	OTT      string `json:"ott"`
+	NotAfter string `json:"notAfter,omitempty"`
+}
+
+type stepCASignResponse struct {
+	Certificate string `json:"crt"`
+}
+
+// Sign enrolls the certificate request with the step-ca server.
+func (s *StepCASigner) Sign(ctx context.Context, csr *pkix.CertificateSigningRequest, req IssuanceRequest) (*pkix.Certificate, error) {
+	if s.URL == "" {
+		return nil, errors.New("must specify step-ca URL")
+	}
+	if s.Token == nil {
+		return nil, errors.New("must specify step-ca token source")
+	}
+
+	token, err := s.Token(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting step-ca token")
+	}
+	csrPEM, err := csr.Export()
+	if err != nil {
+		return nil, errors.Wrap(err, "exporting certificate signing request")
+	}
+
+	body := stepCASignRequest{
+		CSR: string(csrPEM),
+		OTT: token,
+	}
+	if req.Expires > 0 {
+		body.NotAfter = time.Now().Add(req.Expires).UTC().Format(time.RFC3339)
+	}
+
+	resp := stepCASignResponse{}
+	url := fmt.Sprintf("%s/1.0/sign", strings.TrimSuffix(s.URL, "/"))
+	if err = postJSON(ctx, s.Client, url, nil, body, &resp); err != nil {
+		return nil, errors.Wrap(err, "requesting certificate from step-ca")
+	}
+	if resp.Certificate == "" {
+		return nil, errors.New("step-ca did not return a certificate")
+	}
+
+	crt, err := pkix.NewCertificateFromPEM([]byte(resp.Certificate))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing certificate from step-ca")
+	}
+
+	return crt, nil
+}
@@ -0,0 +1,109 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrollCertificate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	caKey, err := pkix.CreateRSAKey(2048)
+	require.NoError(t, err)
+	caCrt, err := pkix.CreateCertificateAuthority(caKey, "", time.Now().Add(time.Hour), "", "", "", "", "step-root", nil)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/1.0/sign", r.URL.Path)
+		req := stepCASignRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req.OTT != "ott" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		notAfter, err := time.Parse(time.RFC3339, req.NotAfter)
+		require.NoError(t, err)
+
+		csr, err := pkix.NewCertificateSigningRequestFromPEM([]byte(req.CSR))
+		require.NoError(t, err)
+		crt, err := pkix.CreateCertificateHost(caCrt, caKey, csr, notAfter)
+		require.NoError(t, err)
+		crtPEM, err := crt.Export()
+		require.NoError(t, err)
+		assert.NoError(t, json.NewEncoder(w).Encode(stepCASignResponse{Certificate: string(crtPEM)}))
+	}))
+	defer srv.Close()
+
+	tempDir, err := ioutil.TempDir(".", "enroll-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := NewFileDepot(tempDir)
+	require.NoError(t, err)
+
+	var tokenReq IssuanceRequest
+	signer := &StepCASigner{
+		URL: srv.URL,
+		Token: func(_ context.Context, req IssuanceRequest) (string, error) {
+			tokenReq = req
+			return "ott", nil
+		},
+	}
+	opts := CertificateOptions{
+		CommonName: "device",
+		Host:       "device",
+		Domain:     []string{"device.example.com"},
+		Expires:    time.Hour,
+	}
+
+	t.Run("StoresEnrolledCertificate", func(t *testing.T) {
+		require.NoError(t, EnrollCertificate(ctx, d, opts, signer))
+		assert.Equal(t, "device", tokenReq.CommonName)
+		assert.Equal(t, []string{"device.example.com"}, tokenReq.Domain)
+
+		crt, err := getRawCertificate(d, "device")
+		require.NoError(t, err)
+		assert.Equal(t, "step-root", crt.Issuer.CommonName)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), crt.NotAfter, time.Minute)
+		assert.True(t, CheckPrivateKey(d, "device"))
+	})
+	t.Run("RenewsOnExpiration", func(t *testing.T) {
+		created, err := EnrollCertificateOnExpiration(ctx, d, opts, signer, time.Minute)
+		require.NoError(t, err)
+		assert.False(t, created)
+
+		created, err = EnrollCertificateOnExpiration(ctx, d, opts, signer, 2*time.Hour)
+		require.NoError(t, err)
+		assert.True(t, created)
+		assert.True(t, CheckCertificate(d, "device"))
+	})
+	t.Run("FailsWithRejectedToken", func(t *testing.T) {
+		badSigner := &StepCASigner{
+			URL: srv.URL,
+			Token: func(context.Context, IssuanceRequest) (string, error) {
+				return "bad", nil
+			},
+		}
+		opts := opts
+		opts.CommonName = "rejected"
+		opts.Host = "rejected"
+		assert.Error(t, EnrollCertificate(ctx, d, opts, badSigner))
+		assert.False(t, CheckCertificate(d, "rejected"))
+	})
+	t.Run("FailsWithoutSigner", func(t *testing.T) {
+		assert.Error(t, EnrollCertificate(ctx, d, opts, nil))
+		assert.Error(t, EnrollCertificate(ctx, d, opts, &StepCASigner{URL: srv.URL}))
+	})
+}
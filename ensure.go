@@ -0,0 +1,263 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+)
+
+// certificateNotExistReason is the reason a service certificate is issued when
+// there is no existing certificate.
+const certificateNotExistReason = "certificate does not exist"
+
+// EnsureServiceCertificateOptions contains options for
+// EnsureServiceCertificate.
+type EnsureServiceCertificateOptions struct {
+	// Options to create the certificate. CommonName and Host default to
+	// the name of the service, CA defaults to the depot's CA, and Expires
+	// defaults to the depot's default expiration.
+	CertificateOptions `bson:",inline" json:",inline" yaml:",inline"`
+	// RenewBefore is how long before the certificate expires it is
+	// renewed. If zero, the certificate is renewed once less than a third
+	// of its requested lifetime remains.
+	RenewBefore time.Duration `bson:"renew_before,omitempty" json:"renew_before,omitempty" yaml:"renew_before,omitempty"`
+}
+
+// EnsureServiceCertificate makes sure that the depot contains a valid
+// certificate for the named service, so that each service can ensure its own
+// certificate at startup against a shared depot. The existing certificate is
+// kept if it was issued by the CA, has exactly the requested common name and
+// subject alt names, and is not expiring within the renewal window. Otherwise,
+// any existing certificate, certificate request, and key are replaced with
+// newly issued ones. True is returned if a certificate is issued, false otherwise.
+func EnsureServiceCertificate(ctx context.Context, wd Depot, name string, opts EnsureServiceCertificateOptions) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	sc, err := newServiceCertificate(wd, name, opts)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	reason, err := sc.renewalReason(wd)
+	if err != nil {
+		return false, errors.Wrap(err, "checking existing certificate")
+	}
+	if reason == "" {
+		return false, nil
+	}
+
+	if err = ctx.Err(); err != nil {
+		return false, errors.WithStack(err)
+	}
+	if err = sc.issue(wd, reason); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return true, nil
+}
+
+// serviceCertificate is a service certificate whose options have been
+// resolved against the depot's defaults.
+type serviceCertificate struct {
+	// name is the name the certificate is stored under.
+	name string
+	// csrName is the name the certificate request and private key are
+	// stored under.
+	csrName     string
+	opts        CertificateOptions
+	renewBefore time.Duration
+}
+
+// newServiceCertificate resolves the options for the named service's
+// certificate against the depot's defaults.
+func newServiceCertificate(wd Depot, name string, opts EnsureServiceCertificateOptions) (*serviceCertificate, error) {
+	if name == "" {
+		return nil, errors.New("must provide name of service")
+	}
+
+	certOpts := opts.CertificateOptions
+	certOpts.Reset()
+	if certOpts.CommonName == "" {
+		certOpts.CommonName = name
+	}
+	if certOpts.Host == "" {
+		certOpts.Host = name
+	}
+	do := getDepotOptions(wd)
+	if certOpts.CA == "" {
+		certOpts.CA = do.CA
+	}
+	if certOpts.Expires == 0 {
+		certOpts.Expires = do.DefaultExpiration
+	}
+	if certOpts.Expires <= 0 {
+		return nil, errors.New("must specify a positive expiration")
+	}
+	renewBefore := opts.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = certOpts.Expires / 3
+	}
+
+	csrName, err := certOpts.getFormattedCertificateRequestName()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting certificate request name")
+	}
+
+	return &serviceCertificate{
+		name:        formatName(certOpts.Host),
+		csrName:     csrName,
+		opts:        certOpts,
+		renewBefore: renewBefore,
+	}, nil
+}
+
+// renewalReason returns why the certificate in the depot does not satisfy
+// the options, or an empty string if it does.
+func (sc *serviceCertificate) renewalReason(wd Depot) (string, error) {
+	return serviceCertificateRenewalReason(wd, sc.name, sc.csrName, sc.opts, sc.renewBefore)
+}
+
+// issue replaces any existing certificate, certificate request, and key with
+// newly issued ones.
+func (sc *serviceCertificate) issue(wd Depot, reason string) error {
+	if err := deleteIfExists(wd, CrtTag(sc.name), PrivKeyTag(sc.name), CsrTag(sc.csrName), PrivKeyTag(sc.csrName)); err != nil {
+		return errors.Wrap(err, "deleting existing certificate")
+	}
+	opts := sc.opts
+	if err := opts.CreateCertificate(wd); err != nil {
+		return errors.Wrap(err, "creating certificate")
+	}
+
+	grip.Info(message.Fields{
+		"message": "ensured service certificate",
+		"name":    sc.name,
+		"ca":      sc.opts.CA,
+		"reason":  reason,
+	})
+
+	return nil
+}
+
+// serviceCertificateRenewalReason returns why the certificate stored under
+// the name, with its private key stored under the certificate request name,
+// does not satisfy the options, or an empty string if it does.
+func serviceCertificateRenewalReason(wd Depot, name, csrName string, opts CertificateOptions, renewBefore time.Duration) (string, error) {
+	exists, err := CheckCertificateWithError(wd, name)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if !exists {
+		return certificateNotExistReason, nil
+	}
+	keyExists, err := CheckPrivateKeyWithError(wd, csrName)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if !keyExists {
+		return "private key does not exist", nil
+	}
+
+	crt, err := getRawCertificate(wd, name)
+	if err != nil {
+		return "", errors.Wrap(err, "getting certificate")
+	}
+	if crt.NotAfter.Before(time.Now().Add(renewBefore)) {
+		return "certificate is expiring", nil
+	}
+
+	caCrt, err := getRawCertificate(wd, formatName(opts.CA))
+	if err != nil {
+		return "", errors.Wrap(err, "getting CA certificate")
+	}
+	if err = crt.CheckSignatureFrom(caCrt); err != nil {
+		return "certificate was not issued by the CA", nil
+	}
+
+	return subjectDiff(crt, opts)
+}
+
+// subjectDiff returns a description of how the subject common name and
+// subject alt names of the certificate differ from those requested by the
+// options, or an empty string if they are the same.
+func subjectDiff(crt *x509.Certificate, opts CertificateOptions) (string, error) {
+	name, err := opts.getCertificateRequestName()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if crt.Subject.CommonName != name {
+		return fmt.Sprintf("common name changed from '%s' to '%s'", crt.Subject.CommonName, name), nil
+	}
+
+	domains, ipStrs := opts.subjectAltNames()
+	if diff := stringSetDiff(crt.DNSNames, domains); diff != "" {
+		return "DNS names " + diff, nil
+	}
+
+	ips, err := pkix.ParseAndValidateIPs(strings.Join(ipStrs, ","))
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing and validating IPs '%s'", ipStrs)
+	}
+	crtIPs := make([]string, 0, len(crt.IPAddresses))
+	for _, ip := range crt.IPAddresses {
+		crtIPs = append(crtIPs, ip.String())
+	}
+	reqIPs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		reqIPs = append(reqIPs, ip.String())
+	}
+	if diff := stringSetDiff(crtIPs, reqIPs); diff != "" {
+		return "IP addresses " + diff, nil
+	}
+
+	crtURIs := make([]string, 0, len(crt.URIs))
+	for _, uri := range crt.URIs {
+		crtURIs = append(crtURIs, uri.String())
+	}
+	if diff := stringSetDiff(crtURIs, opts.URI); diff != "" {
+		return "URIs " + diff, nil
+	}
+
+	return "", nil
+}
+
+// stringSetDiff describes the difference between the current and requested
+// sets of strings, or returns an empty string if they contain the same
+// elements.
+func stringSetDiff(current, requested []string) string {
+	currentSet := make(map[string]bool, len(current))
+	for _, s := range current {
+		currentSet[s] = true
+	}
+	requestedSet := make(map[string]bool, len(requested))
+	for _, s := range requested {
+		requestedSet[s] = true
+	}
+
+	var added, removed []string
+	for s := range requestedSet {
+		if !currentSet[s] {
+			added = append(added, s)
+		}
+	}
+	for s := range currentSet {
+		if !requestedSet[s] {
+			removed = append(removed, s)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return ""
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return fmt.Sprintf("changed (added %v, removed %v)", added, removed)
+}
@@ -0,0 +1,175 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureServiceCertificate(t *testing.T) {
+	ctx := context.TODO()
+	tempDir, err := ioutil.TempDir(".", "ensure-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	d, err := MakeFileDepot(tempDir, DepotOptions{
+		CA:                "root",
+		DefaultExpiration: 24 * time.Hour,
+	})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{
+		CommonName: "root",
+		Expires:    365 * 24 * time.Hour,
+	}
+	require.NoError(t, caOpts.Init(d))
+
+	serial := func(t *testing.T, name string) string {
+		crt, err := getRawCertificate(d, name)
+		require.NoError(t, err)
+		return crt.SerialNumber.String()
+	}
+
+	t.Run("FailsWithoutName", func(t *testing.T) {
+		created, err := EnsureServiceCertificate(ctx, d, "", EnsureServiceCertificateOptions{})
+		assert.Error(t, err)
+		assert.False(t, created)
+	})
+	t.Run("FailsWithCanceledContext", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		created, err := EnsureServiceCertificate(cctx, d, "canceled", EnsureServiceCertificateOptions{})
+		assert.Error(t, err)
+		assert.False(t, created)
+		assert.False(t, CheckCertificate(d, "canceled"))
+	})
+	t.Run("CreatesMissingCertificateWithDefaults", func(t *testing.T) {
+		created, err := EnsureServiceCertificate(ctx, d, "alice", EnsureServiceCertificateOptions{})
+		require.NoError(t, err)
+		assert.True(t, created)
+
+		crt, err := getRawCertificate(d, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", crt.Subject.CommonName)
+		assert.Equal(t, "root", crt.Issuer.CommonName)
+		assert.WithinDuration(t, time.Now().Add(24*time.Hour), crt.NotAfter, time.Minute)
+		assert.True(t, CheckPrivateKey(d, "alice"))
+	})
+	t.Run("KeepsValidCertificate", func(t *testing.T) {
+		opts := EnsureServiceCertificateOptions{
+			CertificateOptions: CertificateOptions{
+				Domain: []string{"bob.example.com"},
+				IP:     []string{"127.0.0.1"},
+			},
+		}
+		created, err := EnsureServiceCertificate(ctx, d, "bob", opts)
+		require.NoError(t, err)
+		require.True(t, created)
+		original := serial(t, "bob")
+
+		created, err = EnsureServiceCertificate(ctx, d, "bob", opts)
+		require.NoError(t, err)
+		assert.False(t, created)
+		assert.Equal(t, original, serial(t, "bob"))
+	})
+	t.Run("RenewsExpiringCertificate", func(t *testing.T) {
+		opts := EnsureServiceCertificateOptions{
+			CertificateOptions: CertificateOptions{Expires: time.Hour},
+		}
+		created, err := EnsureServiceCertificate(ctx, d, "carol", opts)
+		require.NoError(t, err)
+		require.True(t, created)
+		original := serial(t, "carol")
+
+		opts.RenewBefore = 2 * time.Hour
+		created, err = EnsureServiceCertificate(ctx, d, "carol", opts)
+		require.NoError(t, err)
+		assert.True(t, created)
+		assert.NotEqual(t, original, serial(t, "carol"))
+	})
+	t.Run("ReissuesWhenHostsAreMissing", func(t *testing.T) {
+		opts := EnsureServiceCertificateOptions{
+			CertificateOptions: CertificateOptions{Domain: []string{"dave.example.com"}},
+		}
+		created, err := EnsureServiceCertificate(ctx, d, "dave", opts)
+		require.NoError(t, err)
+		require.True(t, created)
+
+		opts.Domain = append(opts.Domain, "dave.internal")
+		opts.URI = []string{"spiffe://example.com/dave"}
+		created, err = EnsureServiceCertificate(ctx, d, "dave", opts)
+		require.NoError(t, err)
+		assert.True(t, created)
+
+		crt, err := getRawCertificate(d, "dave")
+		require.NoError(t, err)
+		assert.NoError(t, crt.VerifyHostname("dave.internal"))
+		require.Len(t, crt.URIs, 1)
+		assert.Equal(t, "spiffe://example.com/dave", crt.URIs[0].String())
+	})
+	t.Run("ReissuesWhenSubjectChanges", func(t *testing.T) {
+		opts := EnsureServiceCertificateOptions{
+			CertificateOptions: CertificateOptions{
+				Domain: []string{"frank.example.com", "frank.internal"},
+				IP:     []string{"127.0.0.1"},
+			},
+		}
+		created, err := EnsureServiceCertificate(ctx, d, "frank", opts)
+		require.NoError(t, err)
+		require.True(t, created)
+
+		opts.Domain = opts.Domain[:1]
+		created, err = EnsureServiceCertificate(ctx, d, "frank", opts)
+		require.NoError(t, err)
+		assert.True(t, created)
+		crt, err := getRawCertificate(d, "frank")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"frank.example.com"}, crt.DNSNames)
+
+		opts.IP = nil
+		created, err = EnsureServiceCertificate(ctx, d, "frank", opts)
+		require.NoError(t, err)
+		assert.True(t, created)
+		crt, err = getRawCertificate(d, "frank")
+		require.NoError(t, err)
+		assert.Empty(t, crt.IPAddresses)
+
+		opts.CommonName = "frank.example.com"
+		created, err = EnsureServiceCertificate(ctx, d, "frank", opts)
+		require.NoError(t, err)
+		assert.True(t, created)
+		crt, err = getRawCertificate(d, "frank")
+		require.NoError(t, err)
+		assert.Equal(t, "frank.example.com", crt.Subject.CommonName)
+
+		created, err = EnsureServiceCertificate(ctx, d, "frank", opts)
+		require.NoError(t, err)
+		assert.False(t, created)
+	})
+	t.Run("ReissuesWhenSignedByOtherCA", func(t *testing.T) {
+		otherOpts := CertificateOptions{
+			CommonName: "other",
+			Expires:    time.Hour,
+		}
+		require.NoError(t, otherOpts.Init(d))
+		opts := EnsureServiceCertificateOptions{
+			CertificateOptions: CertificateOptions{CA: "other"},
+		}
+		created, err := EnsureServiceCertificate(ctx, d, "erin", opts)
+		require.NoError(t, err)
+		require.True(t, created)
+
+		created, err = EnsureServiceCertificate(ctx, d, "erin", EnsureServiceCertificateOptions{})
+		require.NoError(t, err)
+		assert.True(t, created)
+		crt, err := getRawCertificate(d, "erin")
+		require.NoError(t, err)
+		assert.Equal(t, "root", crt.Issuer.CommonName)
+	})
+}
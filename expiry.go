@@ -0,0 +1,327 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+)
+
+// ttlFileExtension is the extension of the sidecar file in a file depot that
+// holds when the credentials for a name expire.
+const ttlFileExtension = ".ttl"
+
+// CertificateExpiration describes when the certificate stored under a name
+// expires.
+type CertificateExpiration struct {
+	// Name is the name the certificate is stored under.
+	Name string `bson:"name" json:"name" yaml:"name"`
+	// CommonName is the Common Name (CN) of the certificate.
+	CommonName string `bson:"cn" json:"cn" yaml:"cn"`
+	// IsCA is whether the certificate is a certificate authority.
+	IsCA bool `bson:"is_ca" json:"is_ca" yaml:"is_ca"`
+	// Purpose is what the certificate is used for, or empty if it is a CA
+	// or its purpose is not known (see GetCertificatePurpose).
+	Purpose CertificatePurpose `bson:"purpose,omitempty" json:"purpose,omitempty" yaml:"purpose,omitempty"`
+	// NotAfter is when the certificate expires.
+	NotAfter time.Time `bson:"not_after" json:"not_after" yaml:"not_after"`
+}
+
+// ListCertificateExpirations returns the expiration of every certificate in
+// the depot, sorted by name. Names without a certificate are skipped. The
+// depot must implement NameLister. An error is returned if any stored
+// certificate cannot be parsed.
+func ListCertificateExpirations(ctx context.Context, wd Depot) ([]CertificateExpiration, error) {
+	return ListCertificateExpirationsWithOptions(ctx, wd, WorkerPoolOptions{})
+}
+
+// ListCertificateExpirationsWithOptions is the same as
+// ListCertificateExpirations, but reads several certificates at once
+// according to the options.
+func ListCertificateExpirationsWithOptions(ctx context.Context, wd Depot, opts WorkerPoolOptions) ([]CertificateExpiration, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+	lister, ok := wd.(NameLister)
+	if !ok {
+		return nil, errors.New("depot does not support listing entries")
+	}
+
+	names, err := lister.ListNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing depot entries")
+	}
+
+	found := make([]*CertificateExpiration, len(names))
+	errs, err := forEachParallel(ctx, opts, len(names), func(_ context.Context, i int) error {
+		name := names[i]
+		exists, err := CheckCertificateWithError(wd, name)
+		if err != nil {
+			return errors.Wrapf(err, "checking certificate '%s'", name)
+		}
+		if !exists {
+			return nil
+		}
+		crt, err := getRawCertificate(wd, name)
+		if err != nil {
+			return errors.Wrapf(err, "getting certificate '%s'", name)
+		}
+
+		found[i] = &CertificateExpiration{
+			Name:       name,
+			CommonName: crt.Subject.CommonName,
+			IsCA:       crt.IsCA,
+			Purpose:    certificatePurpose(crt),
+			NotAfter:   crt.NotAfter,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	expirations := []CertificateExpiration{}
+	for i, exp := range found {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if exp != nil {
+			expirations = append(expirations, *exp)
+		}
+	}
+
+	return expirations, nil
+}
+
+// DefaultExpiryHistogramBounds are the bucket bounds GetExpiryHistogram uses
+// if none are given: less than 7 days, 30 days, and 90 days, and 90 days or
+// more.
+var DefaultExpiryHistogramBounds = []time.Duration{7 * 24 * time.Hour, 30 * 24 * time.Hour, 90 * 24 * time.Hour}
+
+// ExpiryHistogram counts certificates by how long until they expire.
+type ExpiryHistogram struct {
+	// At is the time the time to expiry is measured from.
+	At time.Time `bson:"at" json:"at" yaml:"at"`
+	// Expired is the number of certificates that have already expired.
+	Expired int `bson:"expired" json:"expired" yaml:"expired"`
+	// Buckets are the counts of the certificates that have not expired, by
+	// time to expiry, in increasing order.
+	Buckets []ExpiryHistogramBucket `bson:"buckets" json:"buckets" yaml:"buckets"`
+}
+
+// ExpiryHistogramBucket is the number of certificates that expire within a
+// range of time. Each bucket starts where the previous one ends, and the first
+// starts at zero.
+type ExpiryHistogramBucket struct {
+	// Below is the exclusive upper bound of the time to expiry of the
+	// certificates in the bucket. It is zero for the last bucket, which has
+	// no upper bound.
+	Below time.Duration `bson:"below" json:"below" yaml:"below"`
+	Count int           `bson:"count" json:"count" yaml:"count"`
+}
+
+// newExpiryHistogram returns an empty histogram with buckets for the bounds.
+func newExpiryHistogram(now time.Time, bounds []time.Duration) *ExpiryHistogram {
+	h := &ExpiryHistogram{At: now, Buckets: make([]ExpiryHistogramBucket, 0, len(bounds)+1)}
+	for _, bound := range bounds {
+		h.Buckets = append(h.Buckets, ExpiryHistogramBucket{Below: bound})
+	}
+	h.Buckets = append(h.Buckets, ExpiryHistogramBucket{})
+
+	return h
+}
+
+// add counts a certificate that expires at the time.
+func (h *ExpiryHistogram) add(notAfter time.Time) {
+	remaining := notAfter.Sub(h.At)
+	if remaining <= 0 {
+		h.Expired++
+		return
+	}
+	for i := range h.Buckets {
+		if h.Buckets[i].Below == 0 || remaining < h.Buckets[i].Below {
+			h.Buckets[i].Count++
+			return
+		}
+	}
+}
+
+// GetExpiryHistogram counts the certificates in the depot by time to expiry,
+// using DefaultExpiryHistogramBounds if no bounds are given. Depots that
+// implement ExpiryAggregator compute the histogram in the backend from the
+// tracked expirations; for other depots, every certificate is read and parsed,
+// and the depot must implement NameLister.
+func GetExpiryHistogram(ctx context.Context, wd Depot, bounds ...time.Duration) (*ExpiryHistogram, error) {
+	if len(bounds) == 0 {
+		bounds = DefaultExpiryHistogramBounds
+	}
+	for i, bound := range bounds {
+		if bound <= 0 || (i > 0 && bound <= bounds[i-1]) {
+			return nil, errors.New("histogram bounds must be positive and increasing")
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if aggregator, ok := wd.(ExpiryAggregator); ok {
+		h, err := aggregator.ExpiryHistogram(now, bounds)
+		return h, errors.Wrap(err, "aggregating expirations")
+	}
+
+	expirations, err := ListCertificateExpirations(ctx, wd)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	h := newExpiryHistogram(now, bounds)
+	for _, exp := range expirations {
+		h.add(exp.NotAfter)
+	}
+
+	return h, nil
+}
+
+// FindExpiresBefore returns all the entries in the depot that expire before the
+// cutoff. The depot must implement ExpiryTracker.
+func FindExpiresBefore(wd Depot, cutoff time.Time) ([]User, error) {
+	tracker, ok := wd.(ExpiryTracker)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not track expiration", wd)
+	}
+
+	users, err := tracker.FindExpiresBefore(cutoff)
+	return users, errors.Wrap(err, "finding expired entries")
+}
+
+// DeleteExpiresBefore removes all the entries in the depot that expire before
+// the cutoff. The depot must implement ExpiryTracker.
+func DeleteExpiresBefore(wd Depot, cutoff time.Time) error {
+	tracker, ok := wd.(ExpiryTracker)
+	if !ok {
+		return errors.Errorf("depot of type %T does not track expiration", wd)
+	}
+
+	return errors.Wrap(tracker.DeleteExpiresBefore(cutoff), "deleting expired entries")
+}
+
+// fileTTL is the contents of a TTL sidecar file.
+type fileTTL struct {
+	TTL time.Time `json:"ttl"`
+}
+
+// PutTTL records when the credentials for the name expire in a sidecar file in
+// the depot's directory. The expiration must be within the validity bounds of
+// the certificate for the name.
+func (fd *fileDepot) PutTTL(name string, expiration time.Time) error {
+	return fd.withName(name, true, func(l *lockedName) error {
+		return fd.putTTL(l, name, expiration)
+	})
+}
+
+// putTTL is PutTTL, reading the certificate for the name from the view of
+// the depot.
+func (fd *fileDepot) putTTL(d Depot, name string, expiration time.Time) error {
+	expiration = expiration.UTC()
+
+	minExpiration, maxExpiration, err := ValidityBounds(d, name)
+	if err != nil {
+		return errors.Wrap(err, "getting certificate validity bounds")
+	}
+	if expiration.Before(minExpiration) || expiration.After(maxExpiration) {
+		return errors.Errorf("cannot set expiration to %s because it must be between %s and %s", expiration, minExpiration, maxExpiration)
+	}
+
+	data, err := json.Marshal(fileTTL{TTL: expiration})
+	if err != nil {
+		return errors.Wrap(err, "marshalling TTL")
+	}
+
+	return errors.Wrap(writeFileAtomic(fd.dir, formatName(name)+ttlFileExtension, data), "writing TTL file")
+}
+
+// GetTTL returns when the credentials for the name expire, or the zero time if
+// no TTL has been recorded for the name.
+func (fd *fileDepot) GetTTL(name string) (time.Time, error) {
+	data, err := ioutil.ReadFile(filepath.Join(fd.dir, formatName(name)+ttlFileExtension))
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "reading TTL file")
+	}
+
+	ttl := fileTTL{}
+	if err = json.Unmarshal(data, &ttl); err != nil {
+		return time.Time{}, errors.Wrap(err, "unmarshalling TTL")
+	}
+
+	return ttl.TTL, nil
+}
+
+// FindExpiresBefore returns all the entries in the file depot whose recorded
+// TTL is before the cutoff.
+func (fd *fileDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
+	names, err := fd.ListNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing names")
+	}
+
+	users := []User{}
+	for _, name := range names {
+		ttl, err := fd.GetTTL(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting TTL for '%s'", name)
+		}
+		if ttl.IsZero() || ttl.After(cutoff) {
+			continue
+		}
+
+		u, err := fd.GetAll(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting entry for '%s'", name)
+		}
+		u.TTL = ttl
+		users = append(users, *u)
+	}
+
+	return users, nil
+}
+
+// DeleteExpiresBefore removes all the files for the entries in the file depot
+// whose recorded TTL is before the cutoff.
+func (fd *fileDepot) DeleteExpiresBefore(cutoff time.Time) error {
+	users, err := fd.FindExpiresBefore(cutoff)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	for _, u := range users {
+		catcher.Wrapf(fd.deleteName(u.ID), "deleting '%s'", u.ID)
+	}
+
+	return catcher.Resolve()
+}
+
+// deleteName removes every file stored for the name, including its sidecar
+// files.
+func (fd *fileDepot) deleteName(name string) error {
+	return fd.withName(name, true, func(l *lockedName) error {
+		catcher := grip.NewBasicCatcher()
+		for _, tag := range fd.List() {
+			if getNameFromTag(tag) == name {
+				catcher.Add(l.Delete(tag))
+			}
+		}
+		for _, ext := range []string{ttlFileExtension, rotationFileExtension} {
+			if err := os.Remove(filepath.Join(fd.dir, name+ext)); err != nil && !os.IsNotExist(err) {
+				catcher.Wrap(err, "removing sidecar file")
+			}
+		}
+
+		return catcher.Resolve()
+	})
+}
@@ -0,0 +1,228 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestListCertificateExpirations(t *testing.T) {
+	ctx := context.TODO()
+	tempDir, err := ioutil.TempDir(".", "expiry-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := NewFileDepot(tempDir)
+	require.NoError(t, err)
+
+	caOpts := CertificateOptions{
+		CommonName: "root",
+		Expires:    2 * time.Hour,
+	}
+	require.NoError(t, caOpts.Init(d))
+	opts := CertificateOptions{
+		CommonName: "alice",
+		Host:       "alice",
+		CA:         "root",
+		Expires:    time.Hour,
+	}
+	require.NoError(t, opts.CreateCertificate(d))
+
+	t.Run("ListsCertificates", func(t *testing.T) {
+		expirations, err := ListCertificateExpirations(ctx, d)
+		require.NoError(t, err)
+		require.Len(t, expirations, 2)
+
+		assert.Equal(t, "alice", expirations[0].Name)
+		assert.Equal(t, "alice", expirations[0].CommonName)
+		assert.False(t, expirations[0].IsCA)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), expirations[0].NotAfter, time.Minute)
+
+		assert.Equal(t, "root", expirations[1].Name)
+		assert.True(t, expirations[1].IsCA)
+		assert.WithinDuration(t, time.Now().Add(2*time.Hour), expirations[1].NotAfter, time.Minute)
+	})
+	t.Run("FailsWithCanceledContext", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := ListCertificateExpirations(cctx, d)
+		assert.Error(t, err)
+	})
+	t.Run("FailsWithInvalidCertificate", func(t *testing.T) {
+		require.NoError(t, d.Put(CrtTag("invalid"), []byte("invalid")))
+		defer func() {
+			assert.NoError(t, d.Delete(CrtTag("invalid")))
+		}()
+		_, err := ListCertificateExpirations(ctx, d)
+		assert.Error(t, err)
+	})
+}
+
+func TestFileDepotExpiry(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "expiry-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{
+		CA:                "root",
+		DefaultExpiration: time.Hour,
+	})
+	require.NoError(t, err)
+
+	caOpts := CertificateOptions{
+		CommonName: "root",
+		Expires:    24 * time.Hour,
+	}
+	require.NoError(t, caOpts.Init(d))
+	opts := CertificateOptions{
+		CommonName: "alice",
+		Host:       "alice",
+		CA:         "root",
+		Expires:    time.Hour,
+	}
+	require.NoError(t, opts.CreateCertificate(d))
+	crt, err := getRawCertificate(d, "alice")
+	require.NoError(t, err)
+
+	t.Run("RecordsTTLWhenSigning", func(t *testing.T) {
+		ttl, err := d.(ExpiryTracker).GetTTL("alice")
+		require.NoError(t, err)
+		assert.WithinDuration(t, crt.NotAfter, ttl, time.Second)
+	})
+	t.Run("ReturnsZeroTTLWhenUntracked", func(t *testing.T) {
+		ttl, err := d.(ExpiryTracker).GetTTL("bob")
+		require.NoError(t, err)
+		assert.Zero(t, ttl)
+	})
+	t.Run("PutTTLFailsOutsideValidityBounds", func(t *testing.T) {
+		assert.Error(t, d.(ExpiryTracker).PutTTL("alice", crt.NotAfter.Add(time.Hour)))
+		assert.Error(t, d.(ExpiryTracker).PutTTL("bob", time.Now()))
+	})
+	t.Run("SaveRecordsTTL", func(t *testing.T) {
+		creds, err := d.Generate("carol")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("carol", creds))
+
+		ttl, err := d.(ExpiryTracker).GetTTL("carol")
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), ttl, time.Minute)
+	})
+	t.Run("FindsExpiredEntries", func(t *testing.T) {
+		users, err := FindExpiresBefore(d, time.Now().Add(30*time.Minute))
+		require.NoError(t, err)
+		assert.Empty(t, users)
+
+		users, err = FindExpiresBefore(d, time.Now().Add(2*time.Hour))
+		require.NoError(t, err)
+		require.Len(t, users, 2)
+		assert.Equal(t, "alice", users[0].ID)
+		assert.NotEmpty(t, users[0].Cert)
+		assert.WithinDuration(t, crt.NotAfter, users[0].TTL, time.Second)
+		assert.Equal(t, "carol", users[1].ID)
+	})
+	t.Run("DeletesExpiredEntries", func(t *testing.T) {
+		require.NoError(t, DeleteExpiresBefore(d, time.Now().Add(2*time.Hour)))
+
+		for _, name := range []string{"alice", "carol"} {
+			assert.False(t, d.Check(CrtTag(name)))
+			assert.False(t, d.Check(PrivKeyTag(name)))
+			ttl, err := d.(ExpiryTracker).GetTTL(name)
+			require.NoError(t, err)
+			assert.Zero(t, ttl)
+		}
+		assert.True(t, d.Check(CrtTag("root")))
+
+		require.NoError(t, opts.CreateCertificate(d))
+		assert.True(t, d.Check(CrtTag("alice")))
+	})
+}
+
+func TestGetExpiryHistogram(t *testing.T) {
+	ctx := context.TODO()
+	day := 24 * time.Hour
+	depotOpts := DepotOptions{CA: "root", DefaultExpiration: time.Hour}
+
+	for name, makeDepot := range map[string]func(t *testing.T) (Depot, func()){
+		"FileDepot": func(t *testing.T) (Depot, func()) {
+			tempDir, err := ioutil.TempDir(".", "expiry-histogram-test")
+			require.NoError(t, err)
+			d, err := MakeFileDepot(tempDir, depotOpts)
+			require.NoError(t, err)
+			return d, func() { assert.NoError(t, os.RemoveAll(tempDir)) }
+		},
+		"MongoDB": func(t *testing.T) (Depot, func()) {
+			d, err := NewMongoDBCertDepot(ctx, &MongoDBOptions{
+				MongoDBURI:     testMongoDBURI(),
+				DatabaseName:   "certDepot",
+				CollectionName: "expiry_histogram",
+				DepotOptions:   depotOpts,
+			})
+			require.NoError(t, err)
+			m := d.(*mongoDepot)
+			return d, func() {
+				assert.NoError(t, m.coll.(*mongo.Collection).Drop(ctx))
+				assert.NoError(t, m.metadataCollection().(*mongo.Collection).Drop(ctx))
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d, cleanup := makeDepot(t)
+			defer cleanup()
+
+			caOpts := CertificateOptions{CommonName: "root", Expires: 365 * day}
+			require.NoError(t, caOpts.Init(d))
+			for name, expires := range map[string]time.Duration{
+				"alice": time.Hour,
+				"bob":   2 * day,
+				"carol": 10 * day,
+				"dave":  60 * day,
+			} {
+				opts := CertificateOptions{CommonName: name, Host: name, CA: "root", Expires: expires}
+				require.NoError(t, opts.CreateCertificate(d))
+			}
+
+			t.Run("DefaultBounds", func(t *testing.T) {
+				h, err := GetExpiryHistogram(ctx, d)
+				require.NoError(t, err)
+				assert.WithinDuration(t, time.Now(), h.At, time.Minute)
+				assert.Zero(t, h.Expired)
+				assert.Equal(t, []ExpiryHistogramBucket{
+					{Below: 7 * day, Count: 2},
+					{Below: 30 * day, Count: 1},
+					{Below: 90 * day, Count: 1},
+					{Count: 1},
+				}, h.Buckets)
+			})
+			t.Run("CustomBounds", func(t *testing.T) {
+				h, err := GetExpiryHistogram(ctx, d, day, 100*day)
+				require.NoError(t, err)
+				assert.Equal(t, []ExpiryHistogramBucket{
+					{Below: day, Count: 1},
+					{Below: 100 * day, Count: 3},
+					{Count: 1},
+				}, h.Buckets)
+			})
+			t.Run("RejectsInvalidBounds", func(t *testing.T) {
+				_, err := GetExpiryHistogram(ctx, d, 30*day, 7*day)
+				assert.Error(t, err)
+				_, err = GetExpiryHistogram(ctx, d, 0)
+				assert.Error(t, err)
+			})
+		})
+	}
+	t.Run("CountsExpired", func(t *testing.T) {
+		h := newExpiryHistogram(time.Now(), DefaultExpiryHistogramBounds)
+		h.add(time.Now().Add(-time.Hour))
+		h.add(time.Now().Add(time.Hour))
+		assert.Equal(t, 1, h.Expired)
+		assert.Equal(t, 1, h.Buckets[0].Count)
+	})
+}
@@ -0,0 +1,215 @@
+package certdepot
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	certstrappkix "github.com/square/certstrap/pkix"
+)
+
+// Extension is a custom X.509 extension to include in issued certificates.
+type Extension struct {
+	// OID is the dotted-decimal object identifier of the extension, e.g.
+	// "1.3.6.1.4.1.34601.1".
+	OID string `bson:"oid" json:"oid" yaml:"oid"`
+	// Critical is whether relying parties must reject the certificate if
+	// they do not recognize the extension.
+	Critical bool `bson:"critical,omitempty" json:"critical,omitempty" yaml:"critical,omitempty"`
+	// Value is the DER-encoded value of the extension.
+	Value []byte `bson:"value" json:"value" yaml:"value"`
+}
+
+// oidStandardExtensions is the arc of the standard certificate extensions
+// defined in RFC 5280 (id-ce), such as basic constraints, key usage, and
+// subject alt names. Custom extensions may not use it because they would
+// override the extensions generated from the certificate options.
+var oidStandardExtensions = asn1.ObjectIdentifier{2, 5, 29}
+
+func (e Extension) toPKIX() (pkix.Extension, error) {
+	oid, err := parseOID(e.OID)
+	if err != nil {
+		return pkix.Extension{}, errors.Wrapf(err, "parsing extension OID '%s'", e.OID)
+	}
+	if len(oid) > len(oidStandardExtensions) && oidStandardExtensions.Equal(oid[:len(oidStandardExtensions)]) {
+		return pkix.Extension{}, errors.Errorf("extension OID '%s' is reserved for standard extensions", e.OID)
+	}
+
+	return pkix.Extension{
+		Id:       oid,
+		Critical: e.Critical,
+		Value:    e.Value,
+	}, nil
+}
+
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, errors.New("OID must have at least two components")
+	}
+
+	oid := make(asn1.ObjectIdentifier, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid OID component '%s'", part)
+		}
+		oid = append(oid, n)
+	}
+
+	return oid, nil
+}
+
+var (
+	oidExtensionCertificatePolicies = asn1.ObjectIdentifier{2, 5, 29, 32}
+	oidAnyPolicy                    = asn1.ObjectIdentifier{2, 5, 29, 32, 0}
+	oidPolicyQualifierCPS           = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 1}
+)
+
+type policyInformation struct {
+	Policy     asn1.ObjectIdentifier
+	Qualifiers []policyQualifierInfo `asn1:"optional,omitempty"`
+}
+
+type policyQualifierInfo struct {
+	PolicyQualifierID asn1.ObjectIdentifier
+	Qualifier         string `asn1:"ia5"`
+}
+
+// certificatePoliciesExtension builds the certificate policies extension
+// from the options. Go's x509 package supports policy identifiers but not
+// qualifiers, so the extension is encoded directly.
+func (opts *CertificateOptions) certificatePoliciesExtension() (*pkix.Extension, error) {
+	if len(opts.PolicyIdentifiers) == 0 && opts.CPSURI == "" {
+		return nil, nil
+	}
+
+	policyOIDs := make([]asn1.ObjectIdentifier, 0, len(opts.PolicyIdentifiers))
+	for _, policy := range opts.PolicyIdentifiers {
+		oid, err := parseOID(policy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing policy OID '%s'", policy)
+		}
+		policyOIDs = append(policyOIDs, oid)
+	}
+	if len(policyOIDs) == 0 {
+		policyOIDs = append(policyOIDs, oidAnyPolicy)
+	}
+
+	var qualifiers []policyQualifierInfo
+	if opts.CPSURI != "" {
+		for _, r := range opts.CPSURI {
+			if r > 127 {
+				return nil, errors.Errorf("CPS URI '%s' must be ASCII", opts.CPSURI)
+			}
+		}
+		qualifiers = []policyQualifierInfo{{
+			PolicyQualifierID: oidPolicyQualifierCPS,
+			Qualifier:         opts.CPSURI,
+		}}
+	}
+
+	policies := make([]policyInformation, 0, len(policyOIDs))
+	for _, oid := range policyOIDs {
+		policies = append(policies, policyInformation{
+			Policy:     oid,
+			Qualifiers: qualifiers,
+		})
+	}
+
+	value, err := asn1.Marshal(policies)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling certificate policies")
+	}
+
+	return &pkix.Extension{
+		Id:    oidExtensionCertificatePolicies,
+		Value: value,
+	}, nil
+}
+
+// templateOptions returns the options that customize the certificate
+// template beyond what certstrap supports, including the extended key usages
+// of the certificate's purpose.
+func (opts *CertificateOptions) templateOptions() ([]certstrappkix.Option, error) {
+	exts := make([]pkix.Extension, 0, len(opts.Extensions)+1)
+
+	policiesExt, err := opts.certificatePoliciesExtension()
+	if err != nil {
+		return nil, errors.Wrap(err, "building certificate policies")
+	}
+	if policiesExt != nil {
+		exts = append(exts, *policiesExt)
+	}
+
+	for _, ext := range opts.Extensions {
+		pkixExt, err := ext.toPKIX()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, other := range exts {
+			if other.Id.Equal(pkixExt.Id) {
+				return nil, errors.Errorf("duplicate extension OID '%s'", ext.OID)
+			}
+		}
+		exts = append(exts, pkixExt)
+	}
+
+	var templateOpts []certstrappkix.Option
+	if len(exts) != 0 {
+		templateOpts = append(templateOpts, func(template *x509.Certificate) {
+			template.ExtraExtensions = append(template.ExtraExtensions, exts...)
+		})
+	}
+	if opts.Purpose != "" {
+		usages, err := opts.Purpose.extKeyUsages()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		templateOpts = append(templateOpts, func(template *x509.Certificate) {
+			template.ExtKeyUsage = usages
+		})
+	}
+
+	return templateOpts, nil
+}
+
+// createCertificateHost creates a host certificate with certstrap's
+// CreateCertificateHost. Since certstrap does not support customizing host
+// certificates, if any options are given, the certificate is re-signed from
+// certstrap's template with the options applied.
+func createCertificateHost(crtAuth *certstrappkix.Certificate, keyAuth *certstrappkix.Key, csr *certstrappkix.CertificateSigningRequest, proposedExpiry time.Time, opts ...certstrappkix.Option) (*certstrappkix.Certificate, error) {
+	crt, err := certstrappkix.CreateCertificateHost(crtAuth, keyAuth, csr, proposedExpiry)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating certificate")
+	}
+	if len(opts) == 0 {
+		return crt, nil
+	}
+
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting raw certificate")
+	}
+	template := *rawCrt
+	for _, opt := range opts {
+		opt(&template)
+	}
+
+	rawCrtAuth, err := crtAuth.GetRawCertificate()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting raw CA certificate")
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, rawCrtAuth, rawCrt.PublicKey, keyAuth.Private)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating certificate with options")
+	}
+
+	return certstrappkix.NewCertificateFromDER(der), nil
+}
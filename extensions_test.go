@@ -0,0 +1,293 @@
+package certdepot
+
+import (
+	"encoding/asn1"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOID(t *testing.T) {
+	for _, test := range []struct {
+		oid      string
+		expected asn1.ObjectIdentifier
+		hasErr   bool
+	}{
+		{oid: "1.3.6.1.4.1.34601.1", expected: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 34601, 1}},
+		{oid: "2.5", expected: asn1.ObjectIdentifier{2, 5}},
+		{oid: "", hasErr: true},
+		{oid: "1", hasErr: true},
+		{oid: "1.a.3", hasErr: true},
+		{oid: "1.-3", hasErr: true},
+		{oid: "1..3", hasErr: true},
+	} {
+		t.Run(test.oid, func(t *testing.T) {
+			oid, err := parseOID(test.oid)
+			if test.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, test.expected.Equal(oid))
+		})
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "extensions-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := NewFileDepot(tempDir)
+	require.NoError(t, err)
+
+	roleValue, err := asn1.Marshal("admin")
+	require.NoError(t, err)
+	roleExt := Extension{
+		OID:   "1.3.6.1.4.1.34601.1",
+		Value: roleValue,
+	}
+	hasExtension := func(t *testing.T, name string, ext Extension) {
+		crt, err := getRawCertificate(d, name)
+		require.NoError(t, err)
+		oid, err := parseOID(ext.OID)
+		require.NoError(t, err)
+		for _, crtExt := range crt.Extensions {
+			if crtExt.Id.Equal(oid) {
+				assert.Equal(t, ext.Critical, crtExt.Critical)
+				assert.Equal(t, ext.Value, crtExt.Value)
+				return
+			}
+		}
+		assert.Fail(t, "certificate does not have extension", ext.OID)
+	}
+
+	caOpts := CertificateOptions{
+		CommonName: "root",
+		Expires:    time.Hour,
+		Extensions: []Extension{roleExt},
+	}
+	require.NoError(t, caOpts.Init(d))
+	hasExtension(t, "root", roleExt)
+
+	t.Run("SignAddsExtensions", func(t *testing.T) {
+		critical := Extension{
+			OID:      "1.3.6.1.4.1.34601.2",
+			Critical: true,
+			Value:    roleValue,
+		}
+		opts := CertificateOptions{
+			CommonName: "alice",
+			Host:       "alice",
+			CA:         "root",
+			Expires:    time.Hour,
+			Extensions: []Extension{roleExt, critical},
+		}
+		require.NoError(t, opts.CreateCertificate(d))
+		hasExtension(t, "alice", roleExt)
+		hasExtension(t, "alice", critical)
+	})
+	t.Run("SignFailsWithInvalidOID", func(t *testing.T) {
+		opts := CertificateOptions{
+			CommonName: "bob",
+			Host:       "bob",
+			CA:         "root",
+			Expires:    time.Hour,
+			Extensions: []Extension{{OID: "invalid"}},
+		}
+		assert.Error(t, opts.CreateCertificate(d))
+		assert.False(t, CheckCertificate(d, "bob"))
+	})
+	t.Run("SignFailsWithStandardExtensionOID", func(t *testing.T) {
+		basicConstraints, err := asn1.Marshal(struct {
+			IsCA bool `asn1:"optional"`
+		}{IsCA: true})
+		require.NoError(t, err)
+		opts := CertificateOptions{
+			CommonName: "mallory",
+			Host:       "mallory",
+			CA:         "root",
+			Expires:    time.Hour,
+			Extensions: []Extension{{OID: "2.5.29.19", Critical: true, Value: basicConstraints}},
+		}
+		assert.Error(t, opts.CreateCertificate(d))
+		assert.False(t, CheckCertificate(d, "mallory"))
+	})
+	t.Run("SignFailsWithDuplicateOID", func(t *testing.T) {
+		opts := CertificateOptions{
+			CommonName: "carol",
+			Host:       "carol",
+			CA:         "root",
+			Expires:    time.Hour,
+			Extensions: []Extension{roleExt, roleExt},
+		}
+		assert.Error(t, opts.CreateCertificate(d))
+		assert.False(t, CheckCertificate(d, "carol"))
+	})
+	t.Run("InitFailsWithInvalidOID", func(t *testing.T) {
+		opts := CertificateOptions{
+			CommonName: "other",
+			Expires:    time.Hour,
+			Extensions: []Extension{{OID: "invalid"}},
+		}
+		assert.Error(t, opts.Init(d))
+		assert.False(t, CheckCertificate(d, "other"))
+	})
+}
+
+func TestCreateCertificateHost(t *testing.T) {
+	caKey, err := pkix.CreateRSAKey(2048)
+	require.NoError(t, err)
+	caCrt, err := pkix.CreateCertificateAuthority(caKey, "", time.Now().Add(time.Hour), "", "", "", "", "root", nil)
+	require.NoError(t, err)
+	key, err := pkix.CreateRSAKey(2048)
+	require.NoError(t, err)
+	csr, err := pkix.CreateCertificateSigningRequest(key, "ou", []net.IP{net.ParseIP("127.0.0.1")}, []string{"alice.example.com"}, nil, "o", "c", "st", "l", "alice")
+	require.NoError(t, err)
+	expires := time.Now().Add(time.Hour)
+
+	baseline, err := pkix.CreateCertificateHost(caCrt, caKey, csr, expires)
+	require.NoError(t, err)
+	rawBaseline, err := baseline.GetRawCertificate()
+	require.NoError(t, err)
+	rawCACrt, err := caCrt.GetRawCertificate()
+	require.NoError(t, err)
+
+	t.Run("WithOptionsOnlyAddsExtensions", func(t *testing.T) {
+		opts := CertificateOptions{
+			Extensions: []Extension{{OID: "1.3.6.1.4.1.34601.1", Value: []byte{0x05, 0x00}}},
+		}
+		templateOpts, err := opts.templateOptions()
+		require.NoError(t, err)
+		crt, err := createCertificateHost(caCrt, caKey, csr, expires, templateOpts...)
+		require.NoError(t, err)
+		rawCrt, err := crt.GetRawCertificate()
+		require.NoError(t, err)
+
+		assert.NoError(t, rawCrt.CheckSignatureFrom(rawCACrt))
+		assert.Equal(t, rawBaseline.RawSubject, rawCrt.RawSubject)
+		assert.Equal(t, rawBaseline.RawIssuer, rawCrt.RawIssuer)
+		assert.Equal(t, rawBaseline.NotBefore, rawCrt.NotBefore)
+		assert.Equal(t, rawBaseline.NotAfter, rawCrt.NotAfter)
+		assert.Equal(t, rawBaseline.KeyUsage, rawCrt.KeyUsage)
+		assert.Equal(t, rawBaseline.ExtKeyUsage, rawCrt.ExtKeyUsage)
+		assert.Equal(t, rawBaseline.BasicConstraintsValid, rawCrt.BasicConstraintsValid)
+		assert.Equal(t, rawBaseline.IsCA, rawCrt.IsCA)
+		assert.Equal(t, rawBaseline.SubjectKeyId, rawCrt.SubjectKeyId)
+		assert.Equal(t, rawBaseline.AuthorityKeyId, rawCrt.AuthorityKeyId)
+		assert.Equal(t, rawBaseline.DNSNames, rawCrt.DNSNames)
+		assert.Equal(t, rawBaseline.IPAddresses, rawCrt.IPAddresses)
+		assert.Equal(t, rawBaseline.RawSubjectPublicKeyInfo, rawCrt.RawSubjectPublicKeyInfo)
+
+		require.Len(t, rawCrt.Extensions, len(rawBaseline.Extensions)+1)
+		for i, ext := range rawBaseline.Extensions {
+			assert.True(t, ext.Id.Equal(rawCrt.Extensions[i].Id))
+			assert.Equal(t, ext.Critical, rawCrt.Extensions[i].Critical)
+			assert.Equal(t, ext.Value, rawCrt.Extensions[i].Value)
+		}
+		assert.Equal(t, "1.3.6.1.4.1.34601.1", rawCrt.Extensions[len(rawCrt.Extensions)-1].Id.String())
+	})
+}
+
+func TestCertificatePolicies(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "extensions-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := NewFileDepot(tempDir)
+	require.NoError(t, err)
+
+	caOpts := CertificateOptions{
+		CommonName:        "root",
+		Expires:           time.Hour,
+		PolicyIdentifiers: []string{"2.23.140.1.2.1"},
+	}
+	require.NoError(t, caOpts.Init(d))
+
+	getPolicies := func(t *testing.T, name string) []policyInformation {
+		crt, err := getRawCertificate(d, name)
+		require.NoError(t, err)
+		for _, ext := range crt.Extensions {
+			if ext.Id.Equal(oidExtensionCertificatePolicies) {
+				policies := []policyInformation{}
+				rest, err := asn1.Unmarshal(ext.Value, &policies)
+				require.NoError(t, err)
+				assert.Empty(t, rest)
+				return policies
+			}
+		}
+		return nil
+	}
+
+	t.Run("InitAddsPolicies", func(t *testing.T) {
+		policies := getPolicies(t, "root")
+		require.Len(t, policies, 1)
+		assert.True(t, policies[0].Policy.Equal(asn1.ObjectIdentifier{2, 23, 140, 1, 2, 1}))
+		assert.Empty(t, policies[0].Qualifiers)
+	})
+	t.Run("SignAddsPoliciesWithCPS", func(t *testing.T) {
+		opts := CertificateOptions{
+			CommonName:        "alice",
+			Host:              "alice",
+			CA:                "root",
+			Expires:           time.Hour,
+			PolicyIdentifiers: []string{"2.23.140.1.2.1", "1.3.6.1.4.1.34601.3"},
+			CPSURI:            "https://pki.example.com/cps",
+		}
+		require.NoError(t, opts.CreateCertificate(d))
+
+		crt, err := getRawCertificate(d, "alice")
+		require.NoError(t, err)
+		require.Len(t, crt.PolicyIdentifiers, 2)
+
+		policies := getPolicies(t, "alice")
+		require.Len(t, policies, 2)
+		for _, policy := range policies {
+			require.Len(t, policy.Qualifiers, 1)
+			assert.True(t, policy.Qualifiers[0].PolicyQualifierID.Equal(oidPolicyQualifierCPS))
+			assert.Equal(t, opts.CPSURI, policy.Qualifiers[0].Qualifier)
+		}
+	})
+	t.Run("CPSWithoutPoliciesUsesAnyPolicy", func(t *testing.T) {
+		opts := CertificateOptions{
+			CommonName: "bob",
+			Host:       "bob",
+			CA:         "root",
+			Expires:    time.Hour,
+			CPSURI:     "https://pki.example.com/cps",
+		}
+		require.NoError(t, opts.CreateCertificate(d))
+
+		policies := getPolicies(t, "bob")
+		require.Len(t, policies, 1)
+		assert.True(t, policies[0].Policy.Equal(oidAnyPolicy))
+	})
+	t.Run("FailsWithInvalidPolicy", func(t *testing.T) {
+		opts := CertificateOptions{
+			CommonName:        "carol",
+			Host:              "carol",
+			CA:                "root",
+			Expires:           time.Hour,
+			PolicyIdentifiers: []string{"policy"},
+		}
+		assert.Error(t, opts.CreateCertificate(d))
+	})
+	t.Run("FailsWithNonASCIICPS", func(t *testing.T) {
+		opts := CertificateOptions{
+			CommonName: "dave",
+			Host:       "dave",
+			CA:         "root",
+			Expires:    time.Hour,
+			CPSURI:     "https://pki.example.com/çps",
+		}
+		assert.Error(t, opts.CreateCertificate(d))
+	})
+}
@@ -0,0 +1,240 @@
+package certdepot
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+// ErrInjectedFault is returned by a FaultInjectingDepot for the operations it
+// fails.
+var ErrInjectedFault = errors.New("injected depot fault")
+
+// IsInjectedFault returns whether the error, or the error it wraps, is
+// ErrInjectedFault.
+func IsInjectedFault(err error) bool {
+	return errors.Cause(err) == ErrInjectedFault
+}
+
+// FaultOptions configure the faults a FaultInjectingDepot injects.
+type FaultOptions struct {
+	// Operations are the operations faults are injected into. If empty,
+	// faults are injected into every operation.
+	Operations []DepotOperation `bson:"operations,omitempty" json:"operations,omitempty" yaml:"operations,omitempty"`
+	// ErrorProbability is the probability, between 0 and 1, that an
+	// operation fails.
+	ErrorProbability float64 `bson:"error_probability,omitempty" json:"error_probability,omitempty" yaml:"error_probability,omitempty"`
+	// Sequence, if set, is whether each of the first operations fails, in
+	// order, e.g. {true, false, true} fails the first and third operation
+	// and lets the second through. Once the sequence is exhausted,
+	// ErrorProbability applies.
+	Sequence []bool `bson:"sequence,omitempty" json:"sequence,omitempty" yaml:"sequence,omitempty"`
+	// Latency is added to every operation, including the ones that fail.
+	Latency time.Duration `bson:"latency,omitempty" json:"latency,omitempty" yaml:"latency,omitempty"`
+	// LatencyJitter is the maximum random latency added on top of Latency.
+	LatencyJitter time.Duration `bson:"latency_jitter,omitempty" json:"latency_jitter,omitempty" yaml:"latency_jitter,omitempty"`
+	// Seed seeds the random faults and jitter so that a run can be
+	// reproduced. If zero, the current time is used.
+	Seed int64 `bson:"seed,omitempty" json:"seed,omitempty" yaml:"seed,omitempty"`
+}
+
+// Validate checks that the options are valid.
+func (opts FaultOptions) Validate() error {
+	if opts.ErrorProbability < 0 || opts.ErrorProbability > 1 {
+		return errors.New("error probability must be between 0 and 1")
+	}
+	if opts.Latency < 0 || opts.LatencyJitter < 0 {
+		return errors.New("latency cannot be negative")
+	}
+
+	return nil
+}
+
+// FaultStats count the operations a FaultInjectingDepot has injected faults
+// into.
+type FaultStats struct {
+	// Operations is the number of operations faults could be injected into.
+	Operations int `bson:"operations" json:"operations" yaml:"operations"`
+	// Faults is the number of those operations that failed with
+	// ErrInjectedFault.
+	Faults int `bson:"faults" json:"faults" yaml:"faults"`
+}
+
+// FaultInjectingDepot is a Depot that slows down and fails operations on
+// another depot, so that services can be tested against a slow or partially
+// failing depot. Failed operations return ErrInjectedFault without reaching
+// the inner depot.
+type FaultInjectingDepot struct {
+	inner Depot
+	mu    sync.Mutex
+	opts  FaultOptions
+	rand  *rand.Rand
+	stats FaultStats
+}
+
+// NewFaultInjectingDepot returns a depot that injects the faults described by
+// the options into the operations on the inner depot.
+func NewFaultInjectingDepot(inner Depot, opts FaultOptions) (*FaultInjectingDepot, error) {
+	if inner == nil {
+		return nil, errors.New("must specify depot")
+	}
+
+	f := &FaultInjectingDepot{inner: inner}
+	if err := f.SetFaults(opts); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// SetFaults replaces the faults the depot injects, e.g. to heal the depot
+// part way through a test, and resets the sequence and stats.
+func (f *FaultInjectingDepot) SetFaults(opts FaultOptions) error {
+	if err := opts.Validate(); err != nil {
+		return errors.Wrap(err, "invalid fault options")
+	}
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.opts = opts
+	f.rand = rand.New(rand.NewSource(seed))
+	f.stats = FaultStats{}
+
+	return nil
+}
+
+// Stats returns the number of operations and injected faults since the
+// faults were last set.
+func (f *FaultInjectingDepot) Stats() FaultStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
+
+// inject waits for the injected latency and returns ErrInjectedFault if the
+// operation on the name should fail.
+func (f *FaultInjectingDepot) inject(op DepotOperation, name string) error {
+	f.mu.Lock()
+	if !f.affects(op) {
+		f.mu.Unlock()
+		return nil
+	}
+	latency := f.opts.Latency
+	if f.opts.LatencyJitter > 0 {
+		latency += time.Duration(f.rand.Int63n(int64(f.opts.LatencyJitter)))
+	}
+	var fail bool
+	if f.stats.Operations < len(f.opts.Sequence) {
+		fail = f.opts.Sequence[f.stats.Operations]
+	} else {
+		fail = f.rand.Float64() < f.opts.ErrorProbability
+	}
+	f.stats.Operations++
+	if fail {
+		f.stats.Faults++
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if fail {
+		return errors.Wrapf(ErrInjectedFault, "%s '%s'", op, name)
+	}
+
+	return nil
+}
+
+// affects returns whether faults are injected into the operation. The caller
+// must hold the lock.
+func (f *FaultInjectingDepot) affects(op DepotOperation) bool {
+	if len(f.opts.Operations) == 0 {
+		return true
+	}
+	for _, affected := range f.opts.Operations {
+		if affected == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FaultInjectingDepot) Put(tag *depot.Tag, data []byte) error {
+	if err := f.inject(DepotOpPut, getNameFromTag(tag)); err != nil {
+		return err
+	}
+	return f.inner.Put(tag, data)
+}
+
+// Check returns false if a fault is injected.
+func (f *FaultInjectingDepot) Check(tag *depot.Tag) bool {
+	return f.inject(DepotOpCheck, getNameFromTag(tag)) == nil && f.inner.Check(tag)
+}
+
+func (f *FaultInjectingDepot) CheckWithError(tag *depot.Tag) (bool, error) {
+	if err := f.inject(DepotOpCheck, getNameFromTag(tag)); err != nil {
+		return false, err
+	}
+	return f.inner.CheckWithError(tag)
+}
+
+func (f *FaultInjectingDepot) Get(tag *depot.Tag) ([]byte, error) {
+	if err := f.inject(DepotOpGet, getNameFromTag(tag)); err != nil {
+		return nil, err
+	}
+	return f.inner.Get(tag)
+}
+
+func (f *FaultInjectingDepot) GetIfExists(tag *depot.Tag) ([]byte, bool, error) {
+	if err := f.inject(DepotOpGet, getNameFromTag(tag)); err != nil {
+		return nil, false, err
+	}
+	return GetIfExists(f.inner, tag)
+}
+
+func (f *FaultInjectingDepot) Delete(tag *depot.Tag) error {
+	if err := f.inject(DepotOpDelete, getNameFromTag(tag)); err != nil {
+		return err
+	}
+	return f.inner.Delete(tag)
+}
+
+func (f *FaultInjectingDepot) Save(name string, creds *Credentials) error {
+	if err := f.inject(DepotOpSave, name); err != nil {
+		return err
+	}
+	return f.inner.Save(name, creds)
+}
+
+func (f *FaultInjectingDepot) Find(name string) (*Credentials, error) {
+	if err := f.inject(DepotOpFind, name); err != nil {
+		return nil, err
+	}
+	return f.inner.Find(name)
+}
+
+func (f *FaultInjectingDepot) Generate(name string) (*Credentials, error) {
+	if err := f.inject(DepotOpGenerate, name); err != nil {
+		return nil, err
+	}
+	return f.inner.Generate(name)
+}
+
+func (f *FaultInjectingDepot) GenerateWithOptions(opts CertificateOptions) (*Credentials, error) {
+	if err := f.inject(DepotOpGenerate, opts.CommonName); err != nil {
+		return nil, err
+	}
+	return f.inner.GenerateWithOptions(opts)
+}
+
+// DepotOptions returns the inner depot's options.
+func (f *FaultInjectingDepot) DepotOptions() DepotOptions {
+	return getDepotOptions(f.inner)
+}
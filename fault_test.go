@@ -0,0 +1,91 @@
+package certdepot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultInjectingDepot(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "fault-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	inner, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(inner))
+	creds, err := inner.Generate("alice")
+	require.NoError(t, err)
+	require.NoError(t, inner.Save("alice", creds))
+
+	t.Run("FailsInSequence", func(t *testing.T) {
+		d, err := NewFaultInjectingDepot(inner, FaultOptions{Sequence: []bool{true, false, true}})
+		require.NoError(t, err)
+
+		_, err = d.Find("alice")
+		assert.True(t, IsInjectedFault(err))
+		_, err = d.Find("alice")
+		assert.NoError(t, err)
+		_, err = d.Get(CrtTag("alice"))
+		assert.True(t, IsInjectedFault(err))
+		for i := 0; i < 10; i++ {
+			_, err = d.Get(CrtTag("alice"))
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, FaultStats{Operations: 13, Faults: 2}, d.Stats())
+	})
+	t.Run("FailsWithProbability", func(t *testing.T) {
+		d, err := NewFaultInjectingDepot(inner, FaultOptions{ErrorProbability: 1})
+		require.NoError(t, err)
+		assert.False(t, d.Check(CrtTag("alice")))
+		_, err = d.CheckWithError(CrtTag("alice"))
+		assert.True(t, IsInjectedFault(err))
+		assert.True(t, IsInjectedFault(d.Delete(CrtTag("alice"))))
+		assert.True(t, inner.Check(CrtTag("alice")))
+
+		require.NoError(t, d.SetFaults(FaultOptions{ErrorProbability: 0.5, Seed: 42}))
+		for i := 0; i < 100; i++ {
+			_ = d.Check(CrtTag("alice"))
+		}
+		stats := d.Stats()
+		assert.Equal(t, 100, stats.Operations)
+		assert.True(t, stats.Faults > 20 && stats.Faults < 80, "%d faults", stats.Faults)
+	})
+	t.Run("OnlyAffectsOperations", func(t *testing.T) {
+		d, err := NewFaultInjectingDepot(inner, FaultOptions{
+			Operations:       []DepotOperation{DepotOpPut, DepotOpSave},
+			ErrorProbability: 1,
+		})
+		require.NoError(t, err)
+
+		creds, err := d.Find("alice")
+		require.NoError(t, err)
+		assert.True(t, IsInjectedFault(d.Save("bob", creds)))
+		assert.True(t, IsInjectedFault(d.Put(CrtTag("bob"), creds.Cert)))
+		assert.False(t, inner.Check(CrtTag("bob")))
+		assert.Equal(t, FaultStats{Operations: 2, Faults: 2}, d.Stats())
+	})
+	t.Run("InjectsLatency", func(t *testing.T) {
+		d, err := NewFaultInjectingDepot(inner, FaultOptions{Latency: 20 * time.Millisecond, LatencyJitter: 10 * time.Millisecond})
+		require.NoError(t, err)
+
+		start := time.Now()
+		_, err = d.Find("alice")
+		require.NoError(t, err)
+		assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	})
+	t.Run("RejectsInvalidOptions", func(t *testing.T) {
+		_, err := NewFaultInjectingDepot(inner, FaultOptions{ErrorProbability: 1.5})
+		assert.Error(t, err)
+		_, err = NewFaultInjectingDepot(inner, FaultOptions{Latency: -time.Second})
+		assert.Error(t, err)
+		_, err = NewFaultInjectingDepot(nil, FaultOptions{})
+		assert.Error(t, err)
+	})
+}
@@ -1,28 +1,50 @@
 package certdepot
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+
 	"github.com/pkg/errors"
 	"github.com/square/certstrap/depot"
 )
 
 type fileDepot struct {
 	*depot.FileDepot
-	opts DepotOptions
+	dir     string
+	ctx     context.Context
+	opts    DepotOptions
+	flights credentialsFlights
+	names   nameLocks
 }
 
-// NewFileDepot creates a FileDepot wrapped with certdepot.Depot.
+// NewFileDepot creates a FileDepot wrapped with certdepot.Depot. Any
+// DepotOptions previously persisted in the directory (see SaveDepotOptions)
+// are loaded.
 func NewFileDepot(dir string) (Depot, error) {
 	dt, err := depot.NewFileDepot(dir)
 	if err != nil {
 		return nil, errors.WithStack(err)
 
 	}
-	return &fileDepot{FileDepot: dt}, nil
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting absolute path of depot directory")
+	}
+
+	fd := &fileDepot{FileDepot: dt, dir: absDir}
+	if fd.opts, err = fd.loadDepotOptions(); err != nil {
+		return nil, errors.Wrap(err, "loading depot options")
+	}
+
+	return fd, nil
 }
 
 // MakeFileDepot constructs a file-based depot implementation and
 // allows users to specify options for the default CA name and
-// expiration time.
+// expiration time. Options that are not set fall back to those
+// persisted in the directory, if any.
 func MakeFileDepot(dir string, opts DepotOptions) (Depot, error) {
 	dt, err := NewFileDepot(dir)
 	if err != nil {
@@ -33,17 +55,126 @@ func MakeFileDepot(dir string, opts DepotOptions) (Depot, error) {
 		return nil, errors.New("internal error constructing depot")
 	}
 
-	fd.opts = opts
+	fd.opts = opts.withDefaults(fd.opts)
 	return fd, nil
 }
 
+// MakeFileDepotWithContext is the same as MakeFileDepot but binds the
+// context to the depot. The context is passed to the depot's
+// IssuanceApprover and may carry the caller's identity (see WithPrincipal).
+func MakeFileDepotWithContext(ctx context.Context, dir string, opts DepotOptions) (Depot, error) {
+	dt, err := MakeFileDepot(dir, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	dt.(*fileDepot).ctx = ctx
+	return dt, nil
+}
+
+// Check returns whether the file specified by the tag exists.
+func (fd *fileDepot) Check(tag *depot.Tag) bool {
+	defer fd.names.rlock(getNameFromTag(tag))()
+	return fd.FileDepot.Check(tag)
+}
+
 func (fd *fileDepot) CheckWithError(tag *depot.Tag) (bool, error) { return fd.Check(tag), nil }
-func (fd *fileDepot) Save(name string, creds *Credentials) error  { return depotSave(fd, name, creds) }
-func (fd *fileDepot) Find(name string) (*Credentials, error)      { return depotFind(fd, name, fd.opts) }
+
+// Get reads the file specified by the tag.
+func (fd *fileDepot) Get(tag *depot.Tag) ([]byte, error) {
+	defer fd.names.rlock(getNameFromTag(tag))()
+	return fd.FileDepot.Get(tag)
+}
+
+// Delete removes the file specified by the tag.
+func (fd *fileDepot) Delete(tag *depot.Tag) error {
+	defer fd.names.lock(getNameFromTag(tag))()
+	return fd.FileDepot.Delete(tag)
+}
+
+// Save stores the credentials under the name. Readers in the same process
+// never observe the name with only some of the credentials saved.
+func (fd *fileDepot) Save(name string, creds *Credentials) error {
+	return fd.withName(name, true, func(l *lockedName) error {
+		return depotSave(l, name, creds)
+	})
+}
+
+func (fd *fileDepot) Find(name string) (*Credentials, error) {
+	return fd.flights.do("find", name, func() (*Credentials, error) {
+		return depotFind(fd, name, fd.opts)
+	})
+}
+
 func (fd *fileDepot) Generate(name string) (*Credentials, error) {
-	return depotGenerateDefault(fd, name, fd.opts)
+	return fd.flights.do("generate", name, func() (*Credentials, error) {
+		return depotGenerateDefault(fd, name, fd.opts)
+	})
 }
 
 func (fd *fileDepot) GenerateWithOptions(opts CertificateOptions) (*Credentials, error) {
 	return depotGenerate(fd, opts.CommonName, fd.opts, opts)
 }
+
+// GetIfExists reads the file specified by the tag, returning false if it does
+// not exist.
+func (fd *fileDepot) GetIfExists(tag *depot.Tag) ([]byte, bool, error) {
+	defer fd.names.rlock(getNameFromTag(tag))()
+	return getFileIfExists(fd.FileDepot, tag)
+}
+
+// getFileIfExists reads the file specified by the tag from the certstrap
+// file depot, returning false if it does not exist.
+func getFileIfExists(fd *depot.FileDepot, tag *depot.Tag) ([]byte, bool, error) {
+	data, err := fd.Get(tag)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "reading file")
+	}
+
+	return data, true, nil
+}
+
+// GetAll reads the files for the certificate, private key, certificate
+// request, and certificate revocation list stored for the name. The files are
+// read atomically with respect to Save, Put, and Delete calls on the depot in
+// the same process, so a concurrent rotation is never observed half-done.
+func (fd *fileDepot) GetAll(name string) (*User, error) {
+	var u *User
+	err := fd.withName(name, false, func(l *lockedName) error {
+		var err error
+		u, err = getAllByTag(l, name)
+		return err
+	})
+
+	return u, err
+}
+
+func (fd *fileDepot) registerCA(name string) error {
+	opts := fd.opts
+	opts.CA = name
+	return fd.SaveDepotOptions(opts)
+}
+
+// DepotOptions returns the options the file depot was configured with.
+func (fd *fileDepot) DepotOptions() DepotOptions { return fd.opts }
+
+// ListNames returns the names of all entries stored in the file depot, except
+// for the names reserved for the depot's own data.
+func (fd *fileDepot) ListNames() ([]string, error) {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, tag := range fd.List() {
+		name := getNameFromTag(tag)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return withoutReservedNames(names), nil
+}
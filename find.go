@@ -0,0 +1,118 @@
+package certdepot
+
+import (
+	"crypto/x509"
+
+	"github.com/pkg/errors"
+)
+
+// FindCA returns the PEM-encoded certificate of the depot's CA followed by
+// the certificates of any additional trusted CAs, such as for building the
+// trust roots of a client. No private keys are read from the depot.
+func FindCA(wd Depot) ([]byte, error) {
+	do := getDepotOptions(wd)
+	if do.CA == "" {
+		return nil, errors.New("depot does not have a CA")
+	}
+
+	caCrt, err := getTrustBundle(wd, do.CA, do)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting CA certificates")
+	}
+	if err = getCryptoPolicy(do).checkCredentials(do.CA, &Credentials{CACert: caCrt}); err != nil {
+		return nil, err
+	}
+
+	return caCrt, nil
+}
+
+// FindCertificate returns the credentials for the name as Find does, but
+// without reading the private key from the depot, so the returned
+// credentials have no Key. The certificate is followed by its chain, if any.
+func FindCertificate(wd Depot, name string) (*Credentials, error) {
+	name, err := canonicalName(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	do := getDepotOptions(wd)
+
+	caCrt, err := getTrustBundle(wd, do.CA, do)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting CA certificates")
+	}
+
+	crt, ok, err := GetIfExists(wd, CrtTag(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "getting certificate")
+	}
+	if !ok {
+		return nil, errors.Errorf("certificate for '%s' not found", name)
+	}
+	chain, ok, err := GetIfExists(wd, ChainTag(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "getting certificate chain")
+	}
+	if ok {
+		crt = appendPEM(crt, chain)
+	}
+
+	creds := &Credentials{CACert: caCrt, Cert: crt, ServerName: name}
+	if err = getCryptoPolicy(do).checkCredentials(name, creds); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+// FindVerified returns the credentials for the name as Find does, after
+// verifying their certificate with the options. If the options have no Roots,
+// the certificate must chain to the depot's CA, one of its TrustedCAs, or one
+// of its AdditionalRoots. The certificates in the stored chain are added to
+// the Intermediates, and KeyUsages defaults to any usage.
+func FindVerified(wd Depot, name string, opts x509.VerifyOptions) (*Credentials, error) {
+	creds, err := wd.Find(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = verifyFoundCertificate(name, creds, getDepotOptions(wd), opts); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return creds, nil
+}
+
+// verifyFoundCertificate verifies the certificate of the credentials found
+// for the name.
+func verifyFoundCertificate(name string, creds *Credentials, do DepotOptions, opts x509.VerifyOptions) error {
+	crts, err := parsePEMCertificates(creds.Cert)
+	if err != nil {
+		return errors.Wrap(err, "parsing certificate")
+	}
+	if len(crts) == 0 {
+		return errors.New("certificate is not PEM-encoded")
+	}
+
+	if opts.Roots == nil {
+		opts.Roots = x509.NewCertPool()
+		if !opts.Roots.AppendCertsFromPEM(creds.CACert) {
+			return errors.New("credentials have no CA certificates")
+		}
+		if do.AdditionalRoots != "" && !opts.Roots.AppendCertsFromPEM([]byte(do.AdditionalRoots)) {
+			return errors.New("additional roots contain no certificates")
+		}
+	}
+	if opts.Intermediates == nil {
+		opts.Intermediates = x509.NewCertPool()
+	} else {
+		opts.Intermediates = opts.Intermediates.Clone()
+	}
+	for _, crt := range crts[1:] {
+		opts.Intermediates.AddCert(crt)
+	}
+	if len(opts.KeyUsages) == 0 {
+		opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+	}
+
+	_, err = crts[0].Verify(opts)
+	return errors.Wrapf(err, "verifying certificate for '%s'", name)
+}
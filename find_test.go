@@ -0,0 +1,160 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// keyGuardDepot fails the test if a private key is read from the depot.
+type keyGuardDepot struct {
+	Depot
+	t  *testing.T
+	do DepotOptions
+}
+
+func (d *keyGuardDepot) DepotOptions() DepotOptions { return d.do }
+
+func (d *keyGuardDepot) Get(tag *depot.Tag) ([]byte, error) {
+	assert.Empty(d.t, GetNameFromPrivKeyTag(tag), "private key should not be read")
+	return d.Depot.Get(tag)
+}
+
+func TestFindWithoutKey(t *testing.T) {
+	ctx := context.TODO()
+	depotOpts := DepotOptions{CA: "root", DefaultExpiration: time.Hour}
+
+	for name, makeDepot := range map[string]func(t *testing.T) (Depot, func()){
+		"FileDepot": func(t *testing.T) (Depot, func()) {
+			tempDir, err := ioutil.TempDir(".", "find-test")
+			require.NoError(t, err)
+			d, err := MakeFileDepot(tempDir, depotOpts)
+			require.NoError(t, err)
+			return d, func() { assert.NoError(t, os.RemoveAll(tempDir)) }
+		},
+		"MongoDB": func(t *testing.T) (Depot, func()) {
+			d, err := NewMongoDBCertDepot(ctx, &MongoDBOptions{
+				MongoDBURI:     testMongoDBURI(),
+				DatabaseName:   "certDepot",
+				CollectionName: "find",
+				DepotOptions:   depotOpts,
+			})
+			require.NoError(t, err)
+			m := d.(*mongoDepot)
+			return d, func() {
+				assert.NoError(t, m.coll.(*mongo.Collection).Drop(ctx))
+				assert.NoError(t, m.metadataCollection().(*mongo.Collection).Drop(ctx))
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d, cleanup := makeDepot(t)
+			defer cleanup()
+			guarded := &keyGuardDepot{Depot: d, t: t, do: depotOpts}
+
+			t.Run("NoCA", func(t *testing.T) {
+				_, err := FindCA(guarded)
+				assert.Error(t, err)
+			})
+
+			caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+			require.NoError(t, caOpts.Init(d))
+			creds, err := d.Generate("alice")
+			require.NoError(t, err)
+			require.NoError(t, d.Save("alice", creds))
+
+			t.Run("FindCA", func(t *testing.T) {
+				caCrt, err := FindCA(guarded)
+				require.NoError(t, err)
+				assert.Equal(t, creds.CACert, caCrt)
+			})
+			t.Run("FindCertificate", func(t *testing.T) {
+				found, err := FindCertificate(guarded, "alice")
+				require.NoError(t, err)
+				assert.Equal(t, creds.CACert, found.CACert)
+				assert.Equal(t, creds.Cert, found.Cert)
+				assert.Equal(t, "alice", found.ServerName)
+				assert.Empty(t, found.Key)
+			})
+			t.Run("FindCertificateNotFound", func(t *testing.T) {
+				_, err := FindCertificate(guarded, "bob")
+				assert.Error(t, err)
+			})
+		})
+	}
+}
+
+func TestFindVerified(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "find-verified-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	externalDir, err := ioutil.TempDir(".", "find-verified-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(externalDir))
+	}()
+
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+	creds, err := d.Generate("alice")
+	require.NoError(t, err)
+	require.NoError(t, d.Save("alice", creds))
+
+	// The external CA is not stored in the depot.
+	external, err := MakeFileDepot(externalDir, DepotOptions{CA: "external", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	externalCAOpts := CertificateOptions{CommonName: "external", Expires: time.Hour}
+	require.NoError(t, externalCAOpts.Init(external))
+	externalCA, err := external.Get(CrtTag("external"))
+	require.NoError(t, err)
+	imported, err := external.Generate("bob")
+	require.NoError(t, err)
+	require.NoError(t, ImportCertificate(d, "bob", imported.Cert, imported.Key))
+
+	t.Run("VerifiesAgainstDepotCA", func(t *testing.T) {
+		found, err := FindVerified(d, "alice", x509.VerifyOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, creds.Cert, found.Cert)
+
+		_, err = FindVerified(d, "alice", x509.VerifyOptions{DNSName: "mallory"})
+		assert.Error(t, err)
+	})
+	t.Run("FailsWithoutExternalRoot", func(t *testing.T) {
+		_, err := FindVerified(d, "bob", x509.VerifyOptions{})
+		assert.Error(t, err)
+	})
+	t.Run("AcceptsCustomRoots", func(t *testing.T) {
+		roots := x509.NewCertPool()
+		require.True(t, roots.AppendCertsFromPEM(externalCA))
+		_, err := FindVerified(d, "bob", x509.VerifyOptions{Roots: roots})
+		assert.NoError(t, err)
+		_, err = FindVerified(d, "alice", x509.VerifyOptions{Roots: roots})
+		assert.Error(t, err)
+	})
+	t.Run("VerifyOnFind", func(t *testing.T) {
+		verifying, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", VerifyOnFind: true})
+		require.NoError(t, err)
+		_, err = verifying.Find("alice")
+		assert.NoError(t, err)
+		_, err = verifying.Find("bob")
+		assert.Error(t, err)
+
+		withRoots, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", VerifyOnFind: true, AdditionalRoots: string(externalCA)})
+		require.NoError(t, err)
+		found, err := withRoots.Find("bob")
+		require.NoError(t, err)
+		assert.NotContains(t, string(found.CACert), string(externalCA))
+	})
+}
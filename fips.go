@@ -0,0 +1,88 @@
+package certdepot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+)
+
+// fipsRSAKeyBits are the RSA key sizes allowed in FIPS mode.
+var fipsRSAKeyBits = map[int]bool{
+	2048: true,
+	3072: true,
+	4096: true,
+}
+
+// fipsCurves are the elliptic curves allowed in FIPS mode.
+var fipsCurves = map[elliptic.Curve]bool{
+	elliptic.P256(): true,
+	elliptic.P384(): true,
+	elliptic.P521(): true,
+}
+
+// fipsSignatureAlgorithms are the signature algorithms allowed in FIPS mode.
+var fipsSignatureAlgorithms = map[x509.SignatureAlgorithm]bool{
+	x509.SHA256WithRSA:    true,
+	x509.SHA384WithRSA:    true,
+	x509.SHA512WithRSA:    true,
+	x509.SHA256WithRSAPSS: true,
+	x509.SHA384WithRSAPSS: true,
+	x509.SHA512WithRSAPSS: true,
+	x509.ECDSAWithSHA256:  true,
+	x509.ECDSAWithSHA384:  true,
+	x509.ECDSAWithSHA512:  true,
+}
+
+// FIPSEnabled returns whether the package was built with the fips build tag,
+// in which case every depot only issues and loads certificates that use
+// FIPS-approved algorithms and key sizes.
+func FIPSEnabled() bool {
+	return fipsBuild
+}
+
+// checkFIPSPublicKey returns a WeakCryptoError if the public key is not an RSA
+// key of an approved size or an ECDSA key on an approved curve.
+func checkFIPSPublicKey(name string, pub interface{}) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if fipsRSAKeyBits[key.N.BitLen()] {
+			return nil
+		}
+		return &WeakCryptoError{
+			Name:    name,
+			Problem: NotFIPSApproved,
+			Detail:  fmt.Sprintf("RSA key has %d bits, but must have 2048, 3072, or 4096", key.N.BitLen()),
+		}
+	case *ecdsa.PublicKey:
+		if fipsCurves[key.Curve] {
+			return nil
+		}
+		return &WeakCryptoError{
+			Name:    name,
+			Problem: NotFIPSApproved,
+			Detail:  fmt.Sprintf("ECDSA key uses curve %s, but must use P-256, P-384, or P-521", key.Curve.Params().Name),
+		}
+	default:
+		return &WeakCryptoError{
+			Name:    name,
+			Problem: NotFIPSApproved,
+			Detail:  fmt.Sprintf("key of type %T is not FIPS-approved", pub),
+		}
+	}
+}
+
+// checkFIPSCertificate returns a WeakCryptoError if the certificate is not
+// signed with an approved algorithm or its key is not approved.
+func checkFIPSCertificate(name string, crt *x509.Certificate) error {
+	if !fipsSignatureAlgorithms[crt.SignatureAlgorithm] {
+		return &WeakCryptoError{
+			Name:    name,
+			Problem: NotFIPSApproved,
+			Detail:  fmt.Sprintf("certificate is signed with %s", crt.SignatureAlgorithm),
+		}
+	}
+
+	return checkFIPSPublicKey(name, crt.PublicKey)
+}
@@ -0,0 +1,7 @@
+//go:build fips && boringcrypto
+
+package certdepot
+
+// Restrict crypto/tls to FIPS-approved settings when built against
+// boringcrypto with GOEXPERIMENT=boringcrypto.
+import _ "crypto/tls/fipsonly"
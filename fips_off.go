@@ -0,0 +1,6 @@
+//go:build !fips
+
+package certdepot
+
+// fipsBuild is whether the package was built with the fips build tag.
+const fipsBuild = false
@@ -0,0 +1,87 @@
+package certdepot
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFIPS(t *testing.T) {
+	problem := func(t *testing.T, err error) WeakCryptoProblem {
+		var weakErr *WeakCryptoError
+		require.True(t, errors.As(err, &weakErr))
+		return weakErr.Problem
+	}
+	rsaKey := func(bits uint) *rsa.PublicKey {
+		return &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), bits-1), E: 65537}
+	}
+
+	t.Run("AllowsApprovedKeys", func(t *testing.T) {
+		for _, bits := range []uint{2048, 3072, 4096} {
+			assert.NoError(t, checkFIPSPublicKey("alice", rsaKey(bits)))
+		}
+		for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+			key, err := ecdsa.GenerateKey(curve, rand.Reader)
+			require.NoError(t, err)
+			assert.NoError(t, checkFIPSPublicKey("alice", &key.PublicKey))
+		}
+	})
+	t.Run("RejectsUnapprovedKeys", func(t *testing.T) {
+		assert.Equal(t, NotFIPSApproved, problem(t, checkFIPSPublicKey("alice", rsaKey(1024))))
+		assert.Equal(t, NotFIPSApproved, problem(t, checkFIPSPublicKey("alice", rsaKey(2049))))
+
+		ecKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+		require.NoError(t, err)
+		assert.Equal(t, NotFIPSApproved, problem(t, checkFIPSPublicKey("alice", &ecKey.PublicKey)))
+
+		edKey, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		assert.Equal(t, NotFIPSApproved, problem(t, checkFIPSPublicKey("alice", edKey)))
+	})
+	t.Run("RejectsUnapprovedSignatures", func(t *testing.T) {
+		crt := &x509.Certificate{SignatureAlgorithm: x509.SHA256WithRSA, PublicKey: rsaKey(2048)}
+		assert.NoError(t, checkFIPSCertificate("alice", crt))
+		for _, alg := range []x509.SignatureAlgorithm{x509.SHA1WithRSA, x509.ECDSAWithSHA1, x509.PureEd25519} {
+			crt.SignatureAlgorithm = alg
+			assert.Equal(t, NotFIPSApproved, problem(t, checkFIPSCertificate("alice", crt)))
+		}
+	})
+}
+
+func TestFIPSDepot(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "fips-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour, FIPS: true})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+
+	t.Run("IssuesApprovedCertificate", func(t *testing.T) {
+		creds, err := d.Generate("alice")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("alice", creds))
+		_, err = d.Find("alice")
+		assert.NoError(t, err)
+	})
+	t.Run("RejectsUnapprovedKeySize", func(t *testing.T) {
+		_, err := d.GenerateWithOptions(CertificateOptions{CommonName: "bob", Host: "bob", KeyBits: 2560})
+		require.Error(t, err)
+		assert.True(t, IsWeakCryptoError(err))
+	})
+}
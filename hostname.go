@@ -0,0 +1,33 @@
+package certdepot
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MatchesHost returns whether the certificate stored under the name is valid
+// for the host, which is a DNS name or an IP address, such as to check that a
+// certificate will work for a new endpoint before it is rolled out. The host
+// is matched against the certificate's subject alternative names following
+// the rules of RFC 6125 that TLS clients apply: DNS names match
+// case-insensitively, a wildcard matches exactly one leftmost label, IP
+// addresses only match IP address SANs, and the common name is ignored. It
+// returns an error if the certificate cannot be read or the host contains a
+// wildcard, not if the certificate does not match.
+func MatchesHost(wd Depot, name, host string) (bool, error) {
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return false, errors.New("must specify host")
+	}
+	if strings.Contains(host, "*") {
+		return false, errors.Errorf("host '%s' cannot contain a wildcard", host)
+	}
+
+	crt, err := getRawCertificate(wd, name)
+	if err != nil {
+		return false, errors.Wrapf(err, "getting certificate '%s'", name)
+	}
+
+	return crt.VerifyHostname(host) == nil, nil
+}
@@ -0,0 +1,59 @@
+package certdepot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchesHost(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "hostname-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+	creds, err := d.GenerateWithOptions(CertificateOptions{
+		CommonName: "web",
+		Name:       "web",
+		Domain:     []string{"web.example.com", "*.api.example.com"},
+		IP:         []string{"10.0.0.1", "fd00::1"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, d.Save("web", creds))
+
+	for host, expected := range map[string]bool{
+		"web.example.com":      true,
+		"WEB.Example.COM":      true,
+		"web.example.com.":     true,
+		"  web.example.com  ":  true,
+		"v1.api.example.com":   true,
+		"api.example.com":      false,
+		"a.v1.api.example.com": false,
+		"other.example.com":    false,
+		"web":                  false,
+		"web.example.com:443":  false,
+		"10.0.0.1":             true,
+		"10.0.0.2":             false,
+		"fd00::1":              true,
+		"[fd00::1]":            true,
+	} {
+		matches, err := MatchesHost(d, "web", host)
+		require.NoError(t, err, host)
+		assert.Equal(t, expected, matches, host)
+	}
+
+	_, err = MatchesHost(d, "web", " ")
+	assert.Error(t, err)
+	_, err = MatchesHost(d, "web", "*.api.example.com")
+	assert.Error(t, err)
+	_, err = MatchesHost(d, "nonexistent", "web.example.com")
+	assert.Error(t, err)
+}
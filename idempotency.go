@@ -0,0 +1,188 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// idempotencyParam is the parameter that holds the idempotency keys of
+	// the latest saves of a name.
+	idempotencyParam = "idempotency"
+	// maxIdempotencyKeys is the number of idempotency keys remembered for
+	// each name.
+	maxIdempotencyKeys = 32
+)
+
+// IdempotencyLockTTL is how long SaveIdempotent and
+// GenerateAndSaveIdempotent hold the lock on a name before other callers
+// consider it abandoned.
+var IdempotencyLockTTL = time.Minute
+
+// idempotencyRecord records the certificate saved with an idempotency key.
+type idempotencyRecord struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	SavedAt     time.Time `json:"saved_at"`
+}
+
+// SaveIdempotent saves the credentials under the name, unless credentials
+// were already saved for the name with the same idempotency key, in which
+// case the credentials stored by that save are returned without saving again.
+// This makes it safe to retry a save that timed out. If the credentials saved
+// with the key have since been replaced, an error is returned rather than
+// overwriting the newer credentials.
+func SaveIdempotent(ctx context.Context, wd Depot, name, key string, creds *Credentials) (*Credentials, error) {
+	if creds == nil {
+		return nil, errors.New("must specify credentials")
+	}
+
+	return saveIdempotent(ctx, wd, name, key, func(string) (*Credentials, error) { return creds, nil })
+}
+
+// GenerateAndSaveIdempotent generates credentials for the name with the
+// options and saves them, unless credentials were already saved for the name
+// with the same idempotency key, in which case those credentials are returned
+// without issuing a new certificate. CommonName and Host default to the name.
+// See SaveIdempotent.
+func GenerateAndSaveIdempotent(ctx context.Context, wd Depot, name, key string, opts CertificateOptions) (*Credentials, error) {
+	return saveIdempotent(ctx, wd, name, key, func(name string) (*Credentials, error) {
+		if opts.CommonName == "" {
+			opts.CommonName = name
+		}
+		if opts.Host == "" {
+			opts.Host = name
+		}
+		creds, err := wd.GenerateWithOptions(opts)
+		return creds, errors.Wrap(err, "generating credentials")
+	})
+}
+
+// saveIdempotent saves the credentials returned by newCreds under the name
+// with the idempotency key while holding the name's idempotency lock, or
+// replays an earlier save with the same key.
+func saveIdempotent(ctx context.Context, wd Depot, name, key string, newCreds func(name string) (*Credentials, error)) (*Credentials, error) {
+	if key == "" {
+		return nil, errors.New("must specify an idempotency key")
+	}
+	name, err := canonicalName(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var creds *Credentials
+	err = withLock(ctx, wd, name+"_"+idempotencyParam, IdempotencyLockTTL, func() error {
+		records, err := getIdempotencyRecords(wd, name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if i := findIdempotencyRecord(records, key); i >= 0 {
+			fingerprint, err := storedCertificateFingerprint(wd, name)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if fingerprint == records[i].Fingerprint {
+				creds, err = wd.Find(name)
+				return errors.Wrap(err, "finding saved credentials")
+			}
+			if i != len(records)-1 {
+				return errors.Errorf("credentials saved for '%s' with idempotency key '%s' have been replaced", name, key)
+			}
+			// The earlier attempt recorded the key but did not finish
+			// saving the credentials, so try again.
+			records = records[:i]
+		}
+
+		if creds, err = newCreds(name); err != nil {
+			return errors.WithStack(err)
+		}
+		crts, err := parsePEMCertificates(creds.Cert)
+		if err != nil {
+			return errors.Wrap(err, "parsing certificate")
+		}
+
+		// The key is recorded before saving so that a retry after a
+		// failure part way through saving does not mistake the
+		// credentials for ones saved by another caller.
+		records = append(records, idempotencyRecord{
+			Key:         key,
+			Fingerprint: certificateFingerprint(crts[0]),
+			SavedAt:     time.Now().UTC(),
+		})
+		if len(records) > maxIdempotencyKeys {
+			records = records[len(records)-maxIdempotencyKeys:]
+		}
+		if err = putIdempotencyRecords(wd, name, records); err != nil {
+			return errors.WithStack(err)
+		}
+
+		return errors.Wrap(wd.Save(name, creds), "saving credentials")
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return creds, nil
+}
+
+// findIdempotencyRecord returns the index of the latest record with the key,
+// or -1 if there is none.
+func findIdempotencyRecord(records []idempotencyRecord, key string) int {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// storedCertificateFingerprint returns the fingerprint of the certificate
+// stored for the name, or an empty string if there is none.
+func storedCertificateFingerprint(wd Depot, name string) (string, error) {
+	data, exists, err := GetIfExists(wd, CrtTag(name))
+	if err != nil {
+		return "", errors.Wrap(err, "getting certificate")
+	}
+	if !exists {
+		return "", nil
+	}
+	crts, err := parsePEMCertificates(data)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing certificate")
+	}
+
+	return certificateFingerprint(crts[0]), nil
+}
+
+func getIdempotencyRecords(wd Depot, name string) ([]idempotencyRecord, error) {
+	data, exists, err := GetIfExists(wd, ParamTag(name, idempotencyParam))
+	if err != nil {
+		return nil, errors.Wrap(err, "getting idempotency keys")
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	records := []idempotencyRecord{}
+	if err = json.Unmarshal(data, &records); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling idempotency keys")
+	}
+
+	return records, nil
+}
+
+func putIdempotencyRecords(wd Depot, name string, records []idempotencyRecord) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return errors.Wrap(err, "marshalling idempotency keys")
+	}
+	if err = deleteIfExists(wd, ParamTag(name, idempotencyParam)); err != nil {
+		return errors.Wrap(err, "deleting idempotency keys")
+	}
+
+	return errors.Wrap(wd.Put(ParamTag(name, idempotencyParam), data), "saving idempotency keys")
+}
@@ -0,0 +1,111 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestIdempotentSave(t *testing.T) {
+	ctx := context.TODO()
+	depotOpts := DepotOptions{CA: "root", DefaultExpiration: time.Hour}
+
+	for name, makeDepot := range map[string]func(t *testing.T) (Depot, func()){
+		"FileDepot": func(t *testing.T) (Depot, func()) {
+			tempDir, err := ioutil.TempDir(".", "idempotency-test")
+			require.NoError(t, err)
+			d, err := MakeFileDepot(tempDir, depotOpts)
+			require.NoError(t, err)
+			return d, func() { assert.NoError(t, os.RemoveAll(tempDir)) }
+		},
+		"MongoDB": func(t *testing.T) (Depot, func()) {
+			d, err := NewMongoDBCertDepot(ctx, &MongoDBOptions{
+				MongoDBURI:     testMongoDBURI(),
+				DatabaseName:   "certDepot",
+				CollectionName: "idempotency",
+				DepotOptions:   depotOpts,
+			})
+			require.NoError(t, err)
+			m := d.(*mongoDepot)
+			return d, func() {
+				assert.NoError(t, m.coll.(*mongo.Collection).Drop(ctx))
+				assert.NoError(t, m.metadataCollection().(*mongo.Collection).Drop(ctx))
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d, cleanup := makeDepot(t)
+			defer cleanup()
+
+			caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+			require.NoError(t, caOpts.Init(d))
+
+			t.Run("GenerateReplaysWithSameKey", func(t *testing.T) {
+				first, err := GenerateAndSaveIdempotent(ctx, d, "alice", "request-1", CertificateOptions{})
+				require.NoError(t, err)
+				replayed, err := GenerateAndSaveIdempotent(ctx, d, "alice", "request-1", CertificateOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, first.Cert, replayed.Cert)
+				assert.Equal(t, first.Key, replayed.Key)
+
+				stored, err := d.Find("alice")
+				require.NoError(t, err)
+				assert.Equal(t, first.Cert, stored.Cert)
+			})
+			t.Run("GenerateIssuesWithNewKey", func(t *testing.T) {
+				first, err := d.Find("alice")
+				require.NoError(t, err)
+				second, err := GenerateAndSaveIdempotent(ctx, d, "alice", "request-2", CertificateOptions{})
+				require.NoError(t, err)
+				assert.NotEqual(t, first.Cert, second.Cert)
+			})
+			t.Run("ReplayDoesNotClobberLaterSave", func(t *testing.T) {
+				_, err := GenerateAndSaveIdempotent(ctx, d, "alice", "request-1", CertificateOptions{})
+				assert.Error(t, err)
+
+				stored, err := d.Find("alice")
+				require.NoError(t, err)
+				latest, err := GenerateAndSaveIdempotent(ctx, d, "alice", "request-2", CertificateOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, stored.Cert, latest.Cert)
+			})
+			t.Run("SaveReplaysWithSameKey", func(t *testing.T) {
+				creds, err := d.Generate("bob")
+				require.NoError(t, err)
+				saved, err := SaveIdempotent(ctx, d, "bob", "save-1", creds)
+				require.NoError(t, err)
+				assert.Equal(t, creds.Cert, saved.Cert)
+
+				other, err := d.Generate("bob")
+				require.NoError(t, err)
+				replayed, err := SaveIdempotent(ctx, d, "bob", "save-1", other)
+				require.NoError(t, err)
+				assert.Equal(t, creds.Cert, replayed.Cert)
+			})
+			t.Run("RetriesIncompleteSave", func(t *testing.T) {
+				creds, err := d.Generate("carol")
+				require.NoError(t, err)
+				crts, err := parsePEMCertificates(creds.Cert)
+				require.NoError(t, err)
+				require.NoError(t, putIdempotencyRecords(d, "carol", []idempotencyRecord{{Key: "save-1", Fingerprint: certificateFingerprint(crts[0])}}))
+				assert.False(t, CheckCertificate(d, "carol"))
+
+				saved, err := SaveIdempotent(ctx, d, "carol", "save-1", creds)
+				require.NoError(t, err)
+				assert.Equal(t, creds.Cert, saved.Cert)
+				assert.True(t, CheckCertificate(d, "carol"))
+			})
+			t.Run("RequiresKey", func(t *testing.T) {
+				_, err := GenerateAndSaveIdempotent(ctx, d, "dave", "", CertificateOptions{})
+				assert.Error(t, err)
+				assert.False(t, CheckCertificate(d, "dave"))
+			})
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+)
+
+// certificateMetadataParam is the parameter that holds the metadata of an
+// imported certificate.
+const certificateMetadataParam = "metadata"
+
+// CertificateMetadata describes a certificate imported with
+// ImportCertificate.
+type CertificateMetadata struct {
+	// Subject is the distinguished name of the certificate's subject.
+	Subject string `bson:"subject" json:"subject" yaml:"subject"`
+	// Issuer is the distinguished name of the certificate's issuer.
+	Issuer string `bson:"issuer" json:"issuer" yaml:"issuer"`
+	// SerialNumber is the hex-encoded serial number of the certificate.
+	SerialNumber string `bson:"serial_number" json:"serial_number" yaml:"serial_number"`
+	// DNSNames, IPAddresses, and URIs are the subject alternative names of
+	// the certificate.
+	DNSNames    []string `bson:"dns_names,omitempty" json:"dns_names,omitempty" yaml:"dns_names,omitempty"`
+	IPAddresses []string `bson:"ip_addresses,omitempty" json:"ip_addresses,omitempty" yaml:"ip_addresses,omitempty"`
+	URIs        []string `bson:"uris,omitempty" json:"uris,omitempty" yaml:"uris,omitempty"`
+	// NotBefore and NotAfter are the validity bounds of the certificate.
+	NotBefore time.Time `bson:"not_before" json:"not_before" yaml:"not_before"`
+	NotAfter  time.Time `bson:"not_after" json:"not_after" yaml:"not_after"`
+	// ImportedAt is when the certificate was imported.
+	ImportedAt time.Time `bson:"imported_at" json:"imported_at" yaml:"imported_at"`
+}
+
+// ImportCertificate stores a PEM-encoded certificate, optionally followed by
+// its chain, and its PEM-encoded private key under the name. It is the
+// supported way to add certificates issued outside of the depot: the key pair
+// is validated, the certificate's expiration is tracked in depots that
+// implement ExpiryTracker, and the certificate's subject and subject
+// alternative names are recorded so that they can be read with
+// GetCertificateMetadata. Any credentials already stored under the name are
+// replaced.
+func ImportCertificate(wd Depot, name string, certPEM, keyPEM []byte) error {
+	name, err := canonicalName(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return errors.Wrap(err, "validating key pair")
+	}
+	crts, err := parsePEMCertificates(certPEM)
+	if err != nil {
+		return errors.Wrap(err, "parsing certificate")
+	}
+	crt := crts[0]
+	if err = getCryptoPolicy(getDepotOptions(wd)).checkCredentials(name, &Credentials{Cert: certPEM}); err != nil {
+		return err
+	}
+
+	metadata := CertificateMetadata{
+		Subject:      crt.Subject.String(),
+		Issuer:       crt.Issuer.String(),
+		SerialNumber: crt.SerialNumber.Text(16),
+		DNSNames:     crt.DNSNames,
+		NotBefore:    crt.NotBefore.UTC(),
+		NotAfter:     crt.NotAfter.UTC(),
+		ImportedAt:   time.Now().UTC(),
+	}
+	for _, ip := range crt.IPAddresses {
+		metadata.IPAddresses = append(metadata.IPAddresses, ip.String())
+	}
+	for _, uri := range crt.URIs {
+		metadata.URIs = append(metadata.URIs, uri.String())
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return errors.Wrap(err, "marshalling certificate metadata")
+	}
+
+	// Saving the credentials deletes the metadata of the certificate they
+	// replace.
+	if err = wd.Save(name, &Credentials{Cert: certPEM, Key: keyPEM}); err != nil {
+		return errors.Wrap(err, "saving credentials")
+	}
+
+	return errors.Wrap(wd.Put(ParamTag(name, certificateMetadataParam), data), "saving certificate metadata")
+}
+
+// CertificateImport is a certificate and its private key to import with
+// BulkImport.
+type CertificateImport struct {
+	// Name is the name to store the certificate under.
+	Name string `bson:"name" json:"name" yaml:"name"`
+	// CertPEM is the PEM-encoded certificate, optionally followed by its
+	// chain.
+	CertPEM []byte `bson:"cert_pem" json:"cert_pem" yaml:"cert_pem"`
+	// KeyPEM is the PEM-encoded private key.
+	KeyPEM []byte `bson:"key_pem" json:"key_pem" yaml:"key_pem"`
+}
+
+// BulkImport imports each of the certificates as ImportCertificate would,
+// importing several at once according to the options. Failing to import one
+// certificate does not stop the others from being imported; the error
+// contains every failure. Once the context is done, no more certificates are
+// imported.
+func BulkImport(ctx context.Context, wd Depot, imports []CertificateImport, opts WorkerPoolOptions) error {
+	if err := opts.Validate(); err != nil {
+		return errors.Wrap(err, "invalid options")
+	}
+
+	errs, ctxErr := forEachParallel(ctx, opts, len(imports), func(_ context.Context, i int) error {
+		imp := imports[i]
+		return errors.Wrapf(ImportCertificate(wd, imp.Name, imp.CertPEM, imp.KeyPEM), "importing certificate '%s'", imp.Name)
+	})
+	catcher := grip.NewBasicCatcher()
+	for _, err := range errs {
+		catcher.Add(err)
+	}
+	catcher.Add(ctxErr)
+
+	return catcher.Resolve()
+}
+
+// GetCertificateMetadata returns the metadata recorded when the certificate
+// stored under the name was imported with ImportCertificate.
+func GetCertificateMetadata(wd Depot, name string) (*CertificateMetadata, error) {
+	name, err := canonicalName(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	data, exists, err := GetIfExists(wd, ParamTag(name, certificateMetadataParam))
+	if err != nil {
+		return nil, errors.Wrap(err, "getting certificate metadata")
+	}
+	if !exists {
+		return nil, errors.Errorf("no certificate metadata recorded for '%s'", name)
+	}
+
+	metadata := &CertificateMetadata{}
+	if err = json.Unmarshal(data, metadata); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling certificate metadata")
+	}
+
+	return metadata, nil
+}
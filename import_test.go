@@ -0,0 +1,97 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportCertificate(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "import-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+
+	// Issue a certificate outside of the depot.
+	extCAKey, err := pkix.CreateRSAKey(2048)
+	require.NoError(t, err)
+	extCA, err := pkix.CreateCertificateAuthority(extCAKey, "", time.Now().Add(time.Hour), "", "", "", "", "external-root", nil)
+	require.NoError(t, err)
+	key, err := pkix.CreateRSAKey(2048)
+	require.NoError(t, err)
+	csr, err := pkix.CreateCertificateSigningRequest(key, "", nil, []string{"web.example.com"}, nil, "", "", "", "", "web")
+	require.NoError(t, err)
+	notAfter := time.Now().Add(30 * time.Minute)
+	crt, err := pkix.CreateCertificateHost(extCA, extCAKey, csr, notAfter)
+	require.NoError(t, err)
+	crtPEM, err := crt.Export()
+	require.NoError(t, err)
+	keyPEM, err := key.ExportPrivate()
+	require.NoError(t, err)
+
+	t.Run("RejectsMismatchedKey", func(t *testing.T) {
+		otherKey, err := pkix.CreateRSAKey(2048)
+		require.NoError(t, err)
+		otherKeyPEM, err := otherKey.ExportPrivate()
+		require.NoError(t, err)
+
+		assert.Error(t, ImportCertificate(d, "web", crtPEM, otherKeyPEM))
+		assert.False(t, CheckCertificate(d, "web"))
+	})
+	t.Run("StoresCertificateAndMetadata", func(t *testing.T) {
+		require.NoError(t, ImportCertificate(d, "web", crtPEM, keyPEM))
+
+		storedCrt, err := d.Get(CrtTag("web"))
+		require.NoError(t, err)
+		assert.Equal(t, crtPEM, storedCrt)
+		storedKey, err := d.Get(PrivKeyTag("web"))
+		require.NoError(t, err)
+		assert.Equal(t, keyPEM, storedKey)
+
+		ttl, err := d.(ExpiryTracker).GetTTL("web")
+		require.NoError(t, err)
+		assert.WithinDuration(t, notAfter, ttl, time.Second)
+
+		metadata, err := GetCertificateMetadata(d, "web")
+		require.NoError(t, err)
+		assert.Equal(t, "CN=web", metadata.Subject)
+		assert.Equal(t, "CN=external-root", metadata.Issuer)
+		assert.Equal(t, []string{"web.example.com"}, metadata.DNSNames)
+		assert.WithinDuration(t, notAfter, metadata.NotAfter, time.Second)
+		assert.NotZero(t, metadata.ImportedAt)
+	})
+	t.Run("SaveClearsMetadata", func(t *testing.T) {
+		creds, err := d.Generate("web")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("web", creds))
+
+		_, err = GetCertificateMetadata(d, "web")
+		assert.Error(t, err)
+	})
+	t.Run("BulkImport", func(t *testing.T) {
+		imports := []CertificateImport{
+			{Name: "web-1", CertPEM: crtPEM, KeyPEM: keyPEM},
+			{Name: "web-2", CertPEM: crtPEM, KeyPEM: keyPEM},
+			{Name: "web-3", CertPEM: crtPEM, KeyPEM: []byte("invalid")},
+		}
+		err := BulkImport(context.TODO(), d, imports, WorkerPoolOptions{Workers: 2})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "web-3")
+		assert.True(t, CheckCertificate(d, "web-1"))
+		assert.True(t, CheckCertificate(d, "web-2"))
+		assert.False(t, CheckCertificate(d, "web-3"))
+
+		assert.Error(t, BulkImport(context.TODO(), d, imports, WorkerPoolOptions{Workers: -1}))
+	})
+}
@@ -1,12 +1,18 @@
 package certdepot
 
 import (
+	"context"
 	"time"
 
 	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
 )
 
-// Depot is a superset wrapper around certrstap's depot.Depot interface.
+// Depot is a superset wrapper around certrstap's depot.Depot interface. New
+// code should prefer GetCredential, PutCredential, CheckCredential, and
+// DeleteCredential, which address data by name and CredentialKind rather than
+// by certstrap tag, and new backends can implement CredentialStore instead
+// (see NewStoreDepot). The tag-based methods are kept for compatibility.
 type Depot interface {
 	depot.Depot
 	CheckWithError(tag *depot.Tag) (bool, error)
@@ -21,4 +27,210 @@ type Depot interface {
 type DepotOptions struct {
 	CA                string        `bson:"ca" json:"ca" yaml:"ca"`
 	DefaultExpiration time.Duration `bson:"default_expiration" json:"default_expiration" yaml:"default_expiration"`
+	// TrustedCAs contains the names of additional CA certificates in the
+	// depot (see ImportTrustedCA) that are included in the CACert of
+	// credentials returned by the depot.
+	TrustedCAs []string `bson:"trusted_cas,omitempty" json:"trusted_cas,omitempty" yaml:"trusted_cas,omitempty"`
+	// IssuanceApprover, if set, is consulted before every certificate,
+	// including root CAs created by Init, is signed in the depot and may
+	// deny issuance. It is only consulted by depots that implement
+	// DepotOptionsGetter, so depots that wrap another depot must
+	// implement it to keep enforcing approval.
+	IssuanceApprover IssuanceApprover `bson:"-" json:"-" yaml:"-"`
+	// Signer, if set, signs every certificate request in the depot instead
+	// of the CA's private key in the depot, so the CA's key does not need
+	// to be stored in the depot. Root CAs created by Init are still signed
+	// locally. Like IssuanceApprover, it is only used by depots that
+	// implement DepotOptionsGetter.
+	Signer Signer `bson:"-" json:"-" yaml:"-"`
+	// Attestor, if set, verifies the attestation evidence supplied with
+	// every certificate request (see CertificateOptions.Evidence) before
+	// the certificate is signed in the depot. Requests without evidence
+	// are denied. Like IssuanceApprover, it is only used by depots that
+	// implement DepotOptionsGetter.
+	Attestor Attestor `bson:"-" json:"-" yaml:"-"`
+	// StrictCrypto, if set, makes the depot refuse to issue or load
+	// certificates signed with SHA-1 or an older hash, RSA keys smaller
+	// than 2048 bits, and expired CAs, returning a WeakCryptoError. Like
+	// IssuanceApprover, it is only used by depots that implement
+	// DepotOptionsGetter.
+	StrictCrypto bool `bson:"strict_crypto,omitempty" json:"strict_crypto,omitempty" yaml:"strict_crypto,omitempty"`
+	// FIPS, if set, makes the depot refuse to issue or load certificates
+	// that do not use FIPS-approved signature algorithms and RSA or ECDSA
+	// key sizes, returning a WeakCryptoError. It is always set in binaries
+	// built with the fips build tag.
+	FIPS bool `bson:"fips,omitempty" json:"fips,omitempty" yaml:"fips,omitempty"`
+	// PreviousGracePeriod, if positive, makes Save retain the credentials
+	// it replaces under PreviousName for the grace period, or until their
+	// certificate expires if that is sooner, so that long-lived connections
+	// established with them can drain. Use FindPrevious to read them.
+	PreviousGracePeriod time.Duration `bson:"previous_grace_period,omitempty" json:"previous_grace_period,omitempty" yaml:"previous_grace_period,omitempty"`
+	// VerifyOnFind, if set, makes Find verify that the certificate it
+	// returns chains to the depot's CA, one of its TrustedCAs, or one of
+	// the AdditionalRoots, returning an error otherwise. Like
+	// IssuanceApprover, it is only used by depots that implement
+	// DepotOptionsGetter.
+	VerifyOnFind bool `bson:"verify_on_find,omitempty" json:"verify_on_find,omitempty" yaml:"verify_on_find,omitempty"`
+	// AdditionalRoots are PEM-encoded CA certificates that are not stored
+	// in the depot but that certificates verified by Find (see
+	// VerifyOnFind and FindVerified) may chain to, such as the external
+	// CAs that issued certificates imported into the depot. They are not
+	// included in the CACert of credentials returned by the depot.
+	AdditionalRoots string `bson:"additional_roots,omitempty" json:"additional_roots,omitempty" yaml:"additional_roots,omitempty"`
+	// DeleteCSRAfterSign, if set, makes Sign and CreateCertificate delete
+	// the stored certificate request once the certificate has been issued
+	// and stored, as if CertificateOptions.DeleteCSR were set. Like
+	// IssuanceApprover, it is only used by depots that implement
+	// DepotOptionsGetter.
+	DeleteCSRAfterSign bool `bson:"delete_csr_after_sign,omitempty" json:"delete_csr_after_sign,omitempty" yaml:"delete_csr_after_sign,omitempty"`
+	// StrictPEM, if set, makes the depot reject certificates, chains,
+	// private keys, certificate requests, and revocation lists that are
+	// not parseable PEM of the right type when they are put in the depot,
+	// instead of failing when they are later read, and store them
+	// normalized to only their PEM blocks.
+	StrictPEM bool `bson:"strict_pem,omitempty" json:"strict_pem,omitempty" yaml:"strict_pem,omitempty"`
+	// DomainTemplate, if set, is a text/template for a DNS name that
+	// Generate adds to the certificates it issues as a subject alt name,
+	// such as "{{.Name}}.svc.internal". The template is executed with the
+	// name the credentials are generated for as .Name.
+	DomainTemplate string `bson:"domain_template,omitempty" json:"domain_template,omitempty" yaml:"domain_template,omitempty"`
+	// URITemplate, if set, is a text/template for a URI that Generate adds
+	// to the certificates it issues as a subject alt name, such as
+	// "spiffe://corp/{{.Name}}". It is executed like DomainTemplate.
+	URITemplate string `bson:"uri_template,omitempty" json:"uri_template,omitempty" yaml:"uri_template,omitempty"`
+}
+
+// ExpiryTracker is implemented by depots that track when the credentials
+// stored under each name expire, so that expired credentials can be found and
+// removed regardless of the backend.
+type ExpiryTracker interface {
+	// PutTTL sets when the credentials for the name expire. The
+	// expiration must be within the validity bounds of the name's
+	// certificate.
+	PutTTL(name string, expiration time.Time) error
+	// GetTTL returns when the credentials for the name expire, or the zero
+	// time if their expiration is not tracked.
+	GetTTL(name string) (time.Time, error)
+	// FindExpiresBefore returns all the entries that expire before the
+	// cutoff.
+	FindExpiresBefore(cutoff time.Time) ([]User, error)
+	// DeleteExpiresBefore removes all the entries that expire before the
+	// cutoff.
+	DeleteExpiresBefore(cutoff time.Time) error
+}
+
+// NameLister is implemented by depots that can enumerate the names of the
+// entries they hold.
+type NameLister interface {
+	// ListNames returns the sorted, unique names of all entries in the
+	// depot.
+	ListNames() ([]string, error)
+}
+
+// EntryStreamer is implemented by depots that can stream their entries with a
+// backend cursor instead of loading every name into memory.
+type EntryStreamer interface {
+	// ListIterator returns an iterator over the entries in the depot that
+	// match the options.
+	ListIterator(ctx context.Context, opts ListOptions) (EntryIterator, error)
+}
+
+// Aliaser is implemented by depots that can find the credentials stored for a
+// name under other names.
+type Aliaser interface {
+	// AddAlias makes the alias refer to the name.
+	AddAlias(name, alias string) error
+	// RemoveAlias removes the alias.
+	RemoveAlias(alias string) error
+	// GetAliases returns the aliases that refer to the name.
+	GetAliases(name string) ([]string, error)
+}
+
+// UserDecoratorRegistrar is implemented by depots that store each name's data
+// in a User document and let applications add their own fields to it.
+type UserDecoratorRegistrar interface {
+	// RegisterUserDecorator adds a decorator that is called before every
+	// write to a user document.
+	RegisterUserDecorator(UserDecorator)
+}
+
+// SchemaMigrator is implemented by depots that record the schema version of
+// their stored documents, so that documents written with older schemas can be
+// migrated incrementally.
+type SchemaMigrator interface {
+	// MigrateSchema migrates documents written with an older schema to
+	// CurrentUserSchemaVersion.
+	MigrateSchema(ctx context.Context, opts SchemaMigrationOptions) (*SchemaMigrationResult, error)
+}
+
+// DepotOptionsGetter is implemented by depots that are configured with
+// DepotOptions.
+type DepotOptionsGetter interface {
+	// DepotOptions returns the options the depot was configured with.
+	DepotOptions() DepotOptions
+}
+
+// DepotOptionsSaver is implemented by depots that can persist their
+// DepotOptions so that they are loaded the next time the depot is opened.
+type DepotOptionsSaver interface {
+	// SaveDepotOptions persists the options and uses them for subsequent
+	// operations on the depot.
+	SaveDepotOptions(DepotOptions) error
+}
+
+// IfExistsGetter is implemented by depots that can check for and read the
+// data for a tag in a single operation.
+type IfExistsGetter interface {
+	// GetIfExists returns the data for the tag and true if it exists, or
+	// nil and false if it does not. An error is only returned if the
+	// depot cannot be read.
+	GetIfExists(*depot.Tag) ([]byte, bool, error)
+}
+
+// AllGetter is implemented by depots that can read all of the data stored for
+// a name in a single operation.
+type AllGetter interface {
+	// GetAll returns the certificate, private key, certificate request, and
+	// certificate revocation list stored for the name. Fields for data that
+	// does not exist are empty.
+	GetAll(name string) (*User, error)
+}
+
+// RotationTracker is implemented by depots that record when the certificate
+// stored under each name was issued and rotated.
+type RotationTracker interface {
+	// GetRotationInfo returns when the certificate stored under the name
+	// was last issued and rotated.
+	GetRotationInfo(name string) (RotationInfo, error)
+	// FindStale returns the rotation info of all certificates that were
+	// last issued before the cutoff, including certificates whose issuance
+	// was never tracked.
+	FindStale(cutoff time.Time) ([]RotationInfo, error)
+}
+
+// ExpiryAggregator is implemented by depots that can count their entries by
+// time to expiry without reading every entry into memory.
+type ExpiryAggregator interface {
+	// ExpiryHistogram returns the number of entries whose tracked
+	// expiration (see ExpiryTracker) falls in each bucket, relative to now.
+	// The bounds are positive and increasing.
+	ExpiryHistogram(now time.Time, bounds []time.Duration) (*ExpiryHistogram, error)
+}
+
+// MatchingDeleter is implemented by depots that can delete every entry whose
+// name matches a pattern in a single operation.
+type MatchingDeleter interface {
+	// DeleteMatching removes all the data stored for every name that
+	// matches the glob pattern, as matched by path.Match, except for the
+	// depot's CA and trusted CAs, and returns the number of names removed.
+	DeleteMatching(pattern string) (int, error)
+}
+
+// Signer signs certificate requests with a CA whose private key is held
+// outside of the depot, such as in an external PKI service.
+type Signer interface {
+	// Sign returns the certificate issued for the request. The issuance
+	// request describes the certificate that was requested and has already
+	// been approved.
+	Sign(context.Context, *pkix.CertificateSigningRequest, IssuanceRequest) (*pkix.Certificate, error)
 }
@@ -0,0 +1,178 @@
+package certdepot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
+)
+
+// maxChainLength bounds how many issuers are followed when building a
+// certificate chain, which guards against cycles in a corrupted depot.
+const maxChainLength = 10
+
+// CreateIntermediateCA issues a subordinate CA certificate for
+// opts.CommonName signed by parentCA and stores its certificate, private key,
+// and an empty CRL in the depot. The options' CA, Host, and Intermediate
+// fields are set by this function. MaxPathLen controls how many further
+// intermediates the new CA may issue; the parent CA must have been created
+// with a MaxPathLen large enough to permit the new intermediate. Nothing is
+// stored in the depot unless the certificate is signed successfully.
+//
+// Once created, the intermediate is registered as the issuing CA of the
+// depot's DepotOptions, so Generate issues certificates from it.
+// Certificates generated by an intermediate include the intermediate chain
+// alongside the leaf certificate.
+func CreateIntermediateCA(wd Depot, parentCA string, opts CertificateOptions) error {
+	if parentCA == "" {
+		return errors.New("must provide name of parent CA")
+	}
+	if opts.CommonName == "" {
+		return errors.New("must provide common name of intermediate CA")
+	}
+	formattedName := formatName(opts.CommonName)
+
+	parentExists, err := CheckCertificateWithError(wd, formatName(parentCA))
+	if err != nil {
+		return errors.Wrap(err, "checking parent CA")
+	}
+	if !parentExists {
+		return errors.Errorf("parent CA '%s' does not exist", parentCA)
+	}
+	for _, tag := range []*depot.Tag{CrtTag(formattedName), PrivKeyTag(formattedName), CsrTag(formattedName)} {
+		exists, err := wd.CheckWithError(tag)
+		if err != nil {
+			return errors.Wrap(err, "checking existing intermediate CA")
+		}
+		if exists {
+			return errors.Errorf("intermediate CA '%s' already exists", opts.CommonName)
+		}
+	}
+
+	opts.Reset()
+	opts.CA = parentCA
+	opts.Host = opts.CommonName
+	opts.Intermediate = true
+
+	if _, _, err = opts.CertRequestInMemory(); err != nil {
+		return errors.Wrap(err, "creating intermediate CA certificate request")
+	}
+	crt, err := opts.SignInMemory(wd)
+	if err != nil {
+		return errors.Wrap(err, "signing intermediate CA certificate")
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return errors.Wrap(err, "getting raw intermediate CA certificate")
+	}
+	// create an empty CRL, as is done for root CAs in Init
+	crl, err := pkix.CreateCertificateRevocationList(opts.key, crt, rawCrt.NotAfter)
+	if err != nil {
+		return errors.Wrap(err, "creating certificate revocation list")
+	}
+
+	if err = opts.PutCertRequestFromMemory(wd); err != nil {
+		return errors.Wrap(err, "saving intermediate CA certificate request")
+	}
+	if err = opts.PutCertFromMemory(wd); err != nil {
+		return errors.Wrap(err, "saving intermediate CA certificate")
+	}
+	if err = PutCertificateRevocationList(wd, formattedName, crl); err != nil {
+		return errors.Wrap(err, "saving certificate revocation list")
+	}
+
+	if r, ok := wd.(caRegisterer); ok {
+		if err = r.registerCA(formattedName); err != nil {
+			return errors.Wrap(err, "registering intermediate CA")
+		}
+	}
+
+	return nil
+}
+
+// caRegisterer is implemented by depots whose issuing CA can be changed
+// after the depot is created.
+type caRegisterer interface {
+	registerCA(name string) error
+}
+
+// GetCertificateChain returns the PEM-encoded certificate for the given name
+// followed by the certificates of each CA in the depot that issued it, ending
+// with the self-signed root CA or the last issuer stored in the depot if the
+// root is kept elsewhere. Issuers are found by the common name of the
+// certificate's issuer.
+func GetCertificateChain(wd Depot, name string) ([]byte, error) {
+	chain, err := getCertificateChain(wd, name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return encodeCertificates(chain), nil
+}
+
+// getIntermediateChain returns the PEM-encoded chain of CA certificates
+// starting at the CA with the given name up to, but not including, the
+// self-signed root CA. If an issuer is not stored in the depot, such as an
+// offline root, the chain ends at the last issuer that is. It returns nil if
+// the CA is a root CA.
+func getIntermediateChain(wd Depot, caName string) ([]byte, error) {
+	chain, err := getCertificateChain(wd, caName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(chain) != 0 && isSelfSigned(chain[len(chain)-1]) {
+		chain = chain[:len(chain)-1]
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+
+	return encodeCertificates(chain), nil
+}
+
+func getCertificateChain(wd Depot, name string) ([]*x509.Certificate, error) {
+	crt, err := getRawCertificate(wd, formatName(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting certificate for '%s'", name)
+	}
+
+	chain := []*x509.Certificate{crt}
+	for !isSelfSigned(crt) {
+		if len(chain) > maxChainLength {
+			return nil, errors.Errorf("certificate chain for '%s' exceeds maximum length %d", name, maxChainLength)
+		}
+
+		issuerName := formatName(crt.Issuer.CommonName)
+		exists, err := CheckCertificateWithError(wd, issuerName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "checking issuer certificate '%s'", issuerName)
+		}
+		if !exists {
+			break
+		}
+		issuer, err := getRawCertificate(wd, issuerName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting issuer certificate '%s'", issuerName)
+		}
+		if err = crt.CheckSignatureFrom(issuer); err != nil {
+			return nil, errors.Wrapf(err, "certificate '%s' was not issued by '%s'", crt.Subject.CommonName, issuerName)
+		}
+
+		chain = append(chain, issuer)
+		crt = issuer
+	}
+
+	return chain, nil
+}
+
+func encodeCertificates(crts []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, crt := range crts {
+		// Writing to a bytes.Buffer cannot fail.
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+	}
+	return buf.Bytes()
+}
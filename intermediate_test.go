@@ -0,0 +1,205 @@
+package certdepot
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateIntermediateCA(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "intermediate-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	d, err := MakeFileDepot(tempDir, DepotOptions{
+		CA:                "root",
+		DefaultExpiration: time.Hour,
+	})
+	require.NoError(t, err)
+
+	rootOpts := CertificateOptions{
+		CommonName: "root",
+		Expires:    2 * time.Hour,
+		MaxPathLen: 1,
+	}
+	require.NoError(t, rootOpts.Init(d))
+
+	t.Run("FailsWithoutParent", func(t *testing.T) {
+		assert.Error(t, CreateIntermediateCA(d, "", CertificateOptions{CommonName: "other"}))
+	})
+	t.Run("FailsWithoutCommonName", func(t *testing.T) {
+		assert.Error(t, CreateIntermediateCA(d, "root", CertificateOptions{}))
+	})
+	t.Run("FailsWithNonexistentParent", func(t *testing.T) {
+		assert.Error(t, CreateIntermediateCA(d, "nonexistent", CertificateOptions{CommonName: "other"}))
+		assert.False(t, CheckCertificateSigningRequest(d, "other"))
+		assert.False(t, CheckPrivateKey(d, "other"))
+	})
+
+	require.NoError(t, CreateIntermediateCA(d, "root", CertificateOptions{
+		CommonName: "intermediate",
+		Expires:    time.Hour,
+	}))
+
+	t.Run("RegistersIntermediate", func(t *testing.T) {
+		dog, ok := d.(DepotOptionsGetter)
+		require.True(t, ok)
+		assert.Equal(t, "intermediate", dog.DepotOptions().CA)
+	})
+	t.Run("FailsWithExistingName", func(t *testing.T) {
+		assert.Error(t, CreateIntermediateCA(d, "root", CertificateOptions{CommonName: "intermediate"}))
+	})
+
+	t.Run("StoresIntermediate", func(t *testing.T) {
+		crt, err := getRawCertificate(d, "intermediate")
+		require.NoError(t, err)
+		assert.True(t, crt.IsCA)
+		assert.True(t, crt.BasicConstraintsValid)
+		assert.Zero(t, crt.MaxPathLen)
+		assert.True(t, crt.MaxPathLenZero)
+		assert.Equal(t, "root", crt.Issuer.CommonName)
+
+		assert.True(t, CheckPrivateKey(d, "intermediate"))
+		_, err = GetCertificateRevocationList(d, "intermediate")
+		assert.NoError(t, err)
+	})
+	t.Run("GetCertificateChain", func(t *testing.T) {
+		chain, err := GetCertificateChain(d, "intermediate")
+		require.NoError(t, err)
+		crts := parseCertificates(t, chain)
+		require.Len(t, crts, 2)
+		assert.Equal(t, "intermediate", crts[0].Subject.CommonName)
+		assert.Equal(t, "root", crts[1].Subject.CommonName)
+
+		_, err = GetCertificateChain(d, "nonexistent")
+		assert.Error(t, err)
+	})
+	t.Run("GenerateIncludesChain", func(t *testing.T) {
+		creds, err := d.Generate("alice")
+		require.NoError(t, err)
+
+		crts := parseCertificates(t, creds.Cert)
+		require.Len(t, crts, 2)
+		assert.Equal(t, "alice", crts[0].Subject.CommonName)
+		assert.Equal(t, "intermediate", crts[1].Subject.CommonName)
+
+		_, err = tls.X509KeyPair(creds.Cert, creds.Key)
+		require.NoError(t, err)
+
+		rootCrt, err := getRawCertificate(d, "root")
+		require.NoError(t, err)
+		roots := x509.NewCertPool()
+		roots.AddCert(rootCrt)
+		intermediates := x509.NewCertPool()
+		intermediates.AddCert(crts[1])
+		_, err = crts[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		assert.NoError(t, err)
+	})
+	t.Run("SaveStoresChainSeparately", func(t *testing.T) {
+		creds, err := d.Generate("bob")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("bob", creds))
+
+		leaf, err := d.Get(CrtTag("bob"))
+		require.NoError(t, err)
+		crts := parseCertificates(t, leaf)
+		require.Len(t, crts, 1)
+		assert.Equal(t, "bob", crts[0].Subject.CommonName)
+
+		chain, err := d.Get(ChainTag("bob"))
+		require.NoError(t, err)
+		crts = parseCertificates(t, chain)
+		require.Len(t, crts, 1)
+		assert.Equal(t, "intermediate", crts[0].Subject.CommonName)
+
+		found, err := d.Find("bob")
+		require.NoError(t, err)
+		crts = parseCertificates(t, found.Cert)
+		require.Len(t, crts, 2)
+		assert.Equal(t, "bob", crts[0].Subject.CommonName)
+		assert.Equal(t, "intermediate", crts[1].Subject.CommonName)
+		_, err = tls.X509KeyPair(found.Cert, found.Key)
+		assert.NoError(t, err)
+
+		names, err := d.(NameLister).ListNames()
+		require.NoError(t, err)
+		assert.Contains(t, names, "bob")
+		assert.NotContains(t, names, "bob..chain")
+	})
+}
+
+func TestIntermediateChainWithExternalRoot(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "intermediate-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	offlineDir, err := ioutil.TempDir(".", "intermediate-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(offlineDir))
+	}()
+
+	offline, err := NewFileDepot(offlineDir)
+	require.NoError(t, err)
+	rootOpts := CertificateOptions{
+		CommonName: "root",
+		Expires:    2 * time.Hour,
+		MaxPathLen: 1,
+	}
+	require.NoError(t, rootOpts.Init(offline))
+	require.NoError(t, CreateIntermediateCA(offline, "root", CertificateOptions{
+		CommonName: "intermediate",
+		Expires:    time.Hour,
+	}))
+
+	d, err := MakeFileDepot(tempDir, DepotOptions{
+		CA:                "intermediate",
+		DefaultExpiration: time.Hour,
+	})
+	require.NoError(t, err)
+	for _, tag := range []*depot.Tag{CrtTag("intermediate"), PrivKeyTag("intermediate")} {
+		data, err := offline.Get(tag)
+		require.NoError(t, err)
+		require.NoError(t, d.Put(tag, data))
+	}
+
+	creds, err := d.Generate("alice")
+	require.NoError(t, err)
+	crts := parseCertificates(t, creds.Cert)
+	require.Len(t, crts, 2)
+	assert.Equal(t, "alice", crts[0].Subject.CommonName)
+	assert.Equal(t, "intermediate", crts[1].Subject.CommonName)
+
+	chain, err := GetCertificateChain(d, "intermediate")
+	require.NoError(t, err)
+	assert.Len(t, parseCertificates(t, chain), 1)
+}
+
+func parseCertificates(t *testing.T, data []byte) []*x509.Certificate {
+	crts := []*x509.Certificate{}
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return crts
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		crts = append(crts, crt)
+		data = rest
+	}
+}
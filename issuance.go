@@ -0,0 +1,230 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IssuanceRequest describes a certificate that is about to be signed. It is
+// passed to an IssuanceApprover before the certificate is issued and never
+// contains passphrases or key material.
+type IssuanceRequest struct {
+	// Name is the name the certificate will be stored under.
+	Name string `bson:"name" json:"name" yaml:"name"`
+	// CA is the name of the CA that will issue the certificate.
+	CA string `bson:"ca" json:"ca" yaml:"ca"`
+	// CommonName is the requested Common Name (CN) of the certificate.
+	CommonName string `bson:"cn,omitempty" json:"cn,omitempty" yaml:"cn,omitempty"`
+	// Domain contains the requested DNS subject alt names.
+	Domain []string `bson:"dns,omitempty" json:"dns,omitempty" yaml:"dns,omitempty"`
+	// IP contains the requested IP address subject alt names.
+	IP []string `bson:"ip,omitempty" json:"ip,omitempty" yaml:"ip,omitempty"`
+	// URI contains the requested URI subject alt names.
+	URI []string `bson:"uri,omitempty" json:"uri,omitempty" yaml:"uri,omitempty"`
+	// RootCA is whether the certificate will be a self-signed root CA
+	// created by Init.
+	RootCA bool `bson:"root_ca,omitempty" json:"root_ca,omitempty" yaml:"root_ca,omitempty"`
+	// Intermediate is whether the certificate will be an intermediate CA.
+	Intermediate bool `bson:"intermediate,omitempty" json:"intermediate,omitempty" yaml:"intermediate,omitempty"`
+	// Expires is the requested lifetime of the certificate.
+	Expires time.Duration `bson:"expires,omitempty" json:"expires,omitempty" yaml:"expires,omitempty"`
+	// Extensions contains the requested custom X.509 extensions.
+	Extensions []Extension `bson:"extensions,omitempty" json:"extensions,omitempty" yaml:"extensions,omitempty"`
+	// PolicyIdentifiers contains the requested certificate policy OIDs.
+	PolicyIdentifiers []string `bson:"policies,omitempty" json:"policies,omitempty" yaml:"policies,omitempty"`
+	// CPSURI is the requested Certification Practice Statement URI.
+	CPSURI string `bson:"cps_uri,omitempty" json:"cps_uri,omitempty" yaml:"cps_uri,omitempty"`
+	// Principal is the identity of the caller requesting the certificate,
+	// if known.
+	Principal string `bson:"principal,omitempty" json:"principal,omitempty" yaml:"principal,omitempty"`
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of the context carrying the identity of the
+// caller. Depots constructed with this context (see MakeFileDepotWithContext
+// and NewMongoDBCertDepot) attribute all issuance to the principal, and
+// reject CertificateOptions that request a different principal.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the caller identity stored in the context by
+// WithPrincipal, or an empty string if there is none.
+func PrincipalFromContext(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// IssuanceApprover decides whether a certificate may be issued. Approve
+// returns a non-nil error to deny issuance.
+type IssuanceApprover interface {
+	Approve(context.Context, IssuanceRequest) error
+}
+
+// IssuancePolicy is an IssuanceApprover that evaluates declarative issuance
+// rules, such as OPAIssuancePolicy.
+type IssuancePolicy = IssuanceApprover
+
+// IssuanceApproverFunc adapts a function into an IssuanceApprover.
+type IssuanceApproverFunc func(context.Context, IssuanceRequest) error
+
+// Approve calls the underlying function.
+func (f IssuanceApproverFunc) Approve(ctx context.Context, req IssuanceRequest) error {
+	return f(ctx, req)
+}
+
+// IssuanceDecision is the response expected from an HTTP issuance approval
+// endpoint.
+type IssuanceDecision struct {
+	Approved bool   `bson:"approved" json:"approved" yaml:"approved"`
+	Reason   string `bson:"reason,omitempty" json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+// HTTPIssuanceApprover is an IssuanceApprover that POSTs the JSON-encoded
+// IssuanceRequest to an external endpoint, which must respond with a 2xx
+// status and a JSON-encoded IssuanceDecision. Any other response denies
+// issuance.
+type HTTPIssuanceApprover struct {
+	// URL is the approval endpoint (required).
+	URL string
+	// Header contains additional headers, such as authorization, to send
+	// with each request.
+	Header http.Header
+	// Client is the HTTP client used to make requests. If nil, a client with
+	// a 30 second timeout is used.
+	Client *http.Client
+}
+
+// Approve requests approval from the configured endpoint.
+func (a *HTTPIssuanceApprover) Approve(ctx context.Context, req IssuanceRequest) error {
+	if a.URL == "" {
+		return errors.New("must specify an approval URL")
+	}
+
+	decision := IssuanceDecision{}
+	if err := postJSON(ctx, a.Client, a.URL, a.Header, req, &decision); err != nil {
+		return errors.Wrap(err, "requesting approval")
+	}
+
+	return decision.err(req.Name)
+}
+
+// postJSON POSTs the JSON-encoded input to the URL and decodes the JSON
+// response into output, failing on any non-2xx response.
+func postJSON(ctx context.Context, client *http.Client, url string, header http.Header, input, output interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return errors.Wrap(err, "marshalling request body")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "making request")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "reading response body")
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return errors.Errorf("request returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return errors.Wrap(json.Unmarshal(respBody, output), "unmarshalling response body")
+}
+
+func (d IssuanceDecision) err(name string) error {
+	if d.Approved {
+		return nil
+	}
+	if d.Reason != "" {
+		return errors.Errorf("issuance of '%s' denied: %s", name, d.Reason)
+	}
+	return errors.Errorf("issuance of '%s' denied", name)
+}
+
+// issuanceRequest describes the certificate the options will issue. The
+// principal in the context is trusted over the one in the options, which is
+// supplied by the caller, so the two may not conflict.
+func (opts *CertificateOptions) issuanceRequest(ctx context.Context, name string) (IssuanceRequest, error) {
+	principal := PrincipalFromContext(ctx)
+	if principal == "" {
+		principal = opts.Principal
+	} else if opts.Principal != "" && opts.Principal != principal {
+		return IssuanceRequest{}, errors.Errorf("requested principal '%s' does not match the depot's principal '%s'", opts.Principal, principal)
+	}
+
+	domains, ips := opts.subjectAltNames()
+	return IssuanceRequest{
+		Name:              name,
+		CA:                opts.CA,
+		CommonName:        opts.CommonName,
+		Domain:            domains,
+		IP:                ips,
+		URI:               opts.URI,
+		Intermediate:      opts.Intermediate,
+		Expires:           opts.Expires,
+		Extensions:        opts.Extensions,
+		PolicyIdentifiers: opts.PolicyIdentifiers,
+		CPSURI:            opts.CPSURI,
+		Principal:         principal,
+	}, nil
+}
+
+// approveIssuance consults the depot's configured IssuanceApprover, if any,
+// before the certificate described by the request is signed.
+func approveIssuance(wd Depot, req IssuanceRequest) error {
+	approver := getDepotOptions(wd).IssuanceApprover
+	if approver == nil {
+		return nil
+	}
+
+	return approver.Approve(depotContext(wd), req)
+}
+
+// getDepotOptions returns the DepotOptions configured for the depot, if the
+// depot implements DepotOptionsGetter.
+func getDepotOptions(wd Depot) DepotOptions {
+	if dog, ok := wd.(DepotOptionsGetter); ok {
+		return dog.DepotOptions()
+	}
+	return DepotOptions{}
+}
+
+// depotContext returns the context bound to the depot, if the depot has one.
+func depotContext(wd Depot) context.Context {
+	switch d := wd.(type) {
+	case *fileDepot:
+		if d.ctx != nil {
+			return d.ctx
+		}
+	case *mongoDepot:
+		if d.ctx != nil {
+			return d.ctx
+		}
+	}
+	return context.Background()
+}
@@ -0,0 +1,247 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPIssuanceApprover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req := IssuanceRequest{
+		Name:       "alice",
+		CA:         "root",
+		CommonName: "alice",
+		Domain:     []string{"alice.example.com"},
+	}
+
+	for testName, testCase := range map[string]struct {
+		handler http.HandlerFunc
+		hasErr  bool
+	}{
+		"Approved": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				received := IssuanceRequest{}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+				assert.Equal(t, req, received)
+				assert.Equal(t, "token", r.Header.Get("Authorization"))
+				assert.NoError(t, json.NewEncoder(w).Encode(IssuanceDecision{Approved: true}))
+			},
+		},
+		"Denied": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				assert.NoError(t, json.NewEncoder(w).Encode(IssuanceDecision{Reason: "not allowed"}))
+			},
+			hasErr: true,
+		},
+		"ErrorStatus": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			hasErr: true,
+		},
+		"InvalidResponse": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, err := w.Write([]byte("approved"))
+				assert.NoError(t, err)
+			},
+			hasErr: true,
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			srv := httptest.NewServer(testCase.handler)
+			defer srv.Close()
+
+			approver := &HTTPIssuanceApprover{
+				URL:    srv.URL,
+				Header: http.Header{"Authorization": []string{"token"}},
+			}
+			err := approver.Approve(ctx, req)
+			if testCase.hasErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+	t.Run("FailsWithoutURL", func(t *testing.T) {
+		approver := &HTTPIssuanceApprover{}
+		assert.Error(t, approver.Approve(ctx, req))
+	})
+}
+
+func TestIssuanceApproval(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "issuance-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	var requests []IssuanceRequest
+	d, err := MakeFileDepot(tempDir, DepotOptions{
+		CA:                "root",
+		DefaultExpiration: time.Hour,
+		IssuanceApprover: IssuanceApproverFunc(func(_ context.Context, req IssuanceRequest) error {
+			requests = append(requests, req)
+			if req.CommonName == "*" {
+				return errors.New("wildcard certificates are not allowed")
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+
+	caOpts := CertificateOptions{
+		CommonName: "root",
+		Expires:    time.Hour,
+	}
+	require.NoError(t, caOpts.Init(d))
+	require.Len(t, requests, 1)
+	assert.Equal(t, "root", requests[0].Name)
+	assert.True(t, requests[0].RootCA)
+	requests = nil
+
+	creds, err := d.Generate("alice")
+	require.NoError(t, err)
+	assert.NotZero(t, creds)
+	require.Len(t, requests, 1)
+	assert.Equal(t, "alice", requests[0].Name)
+	assert.Equal(t, "root", requests[0].CA)
+	assert.False(t, requests[0].RootCA)
+
+	creds, err = d.Generate("*")
+	assert.Error(t, err)
+	assert.Zero(t, creds)
+	assert.Len(t, requests, 2)
+
+	roleExt := Extension{OID: "1.3.6.1.4.1.34601.1", Value: []byte{0x05, 0x00}}
+	_, err = d.GenerateWithOptions(CertificateOptions{
+		CommonName:        "bob",
+		Host:              "bob",
+		Extensions:        []Extension{roleExt},
+		PolicyIdentifiers: []string{"2.23.140.1.2.1"},
+		CPSURI:            "https://pki.example.com/cps",
+	})
+	require.NoError(t, err)
+	require.Len(t, requests, 3)
+	assert.Equal(t, []Extension{roleExt}, requests[2].Extensions)
+	assert.Equal(t, []string{"2.23.140.1.2.1"}, requests[2].PolicyIdentifiers)
+	assert.Equal(t, "https://pki.example.com/cps", requests[2].CPSURI)
+
+	opts := CertificateOptions{
+		CommonName: "*",
+		Host:       "*",
+		CA:         "root",
+		Expires:    time.Hour,
+	}
+	assert.Error(t, opts.CreateCertificate(d))
+	assert.False(t, CheckCertificate(d, "_"))
+
+	caOpts = CertificateOptions{
+		CommonName: "*",
+		Expires:    time.Hour,
+	}
+	assert.Error(t, caOpts.Init(d))
+	assert.False(t, CheckCertificate(d, "*"))
+}
+
+func TestIssuancePrincipal(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "issuance-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	d, err := MakeFileDepot(tempDir, DepotOptions{
+		CA:                "root",
+		DefaultExpiration: time.Hour,
+		IssuanceApprover: IssuanceApproverFunc(func(_ context.Context, req IssuanceRequest) error {
+			if !req.RootCA && req.Principal != req.Name {
+				return errors.Errorf("principal '%s' may not request certificates for '%s'", req.Principal, req.Name)
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{
+		CommonName: "root",
+		Expires:    time.Hour,
+	}
+	require.NoError(t, caOpts.Init(d))
+
+	t.Run("AllowsOwnName", func(t *testing.T) {
+		creds, err := d.GenerateWithOptions(CertificateOptions{
+			CommonName: "alice",
+			Host:       "alice",
+			Principal:  "alice",
+		})
+		require.NoError(t, err)
+		assert.NotZero(t, creds)
+	})
+	t.Run("DeniesOtherName", func(t *testing.T) {
+		creds, err := d.GenerateWithOptions(CertificateOptions{
+			CommonName: "bob",
+			Host:       "bob",
+			Principal:  "alice",
+		})
+		assert.Error(t, err)
+		assert.Zero(t, creds)
+	})
+	t.Run("DeniesMissingPrincipal", func(t *testing.T) {
+		creds, err := d.Generate("alice")
+		assert.Error(t, err)
+		assert.Zero(t, creds)
+	})
+	t.Run("ContextPrincipal", func(t *testing.T) {
+		ctx := WithPrincipal(context.Background(), "alice")
+		assert.Equal(t, "alice", PrincipalFromContext(ctx))
+		assert.Empty(t, PrincipalFromContext(context.Background()))
+
+		opts := CertificateOptions{CA: "root"}
+		req, err := opts.issuanceRequest(ctx, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", req.Principal)
+
+		opts.Principal = "alice"
+		req, err = opts.issuanceRequest(ctx, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", req.Principal)
+
+		opts.Principal = "bob"
+		_, err = opts.issuanceRequest(ctx, "alice")
+		assert.Error(t, err)
+
+		req, err = opts.issuanceRequest(context.Background(), "bob")
+		require.NoError(t, err)
+		assert.Equal(t, "bob", req.Principal)
+	})
+	t.Run("FileDepotContextPrincipal", func(t *testing.T) {
+		do, ok := d.(DepotOptionsGetter)
+		require.True(t, ok)
+		cd, err := MakeFileDepotWithContext(WithPrincipal(context.Background(), "carol"), tempDir, do.DepotOptions())
+		require.NoError(t, err)
+
+		creds, err := cd.Generate("carol")
+		require.NoError(t, err)
+		assert.NotZero(t, creds)
+
+		creds, err = cd.GenerateWithOptions(CertificateOptions{
+			CommonName: "dave",
+			Host:       "dave",
+			Principal:  "dave",
+		})
+		assert.Error(t, err)
+		assert.Zero(t, creds)
+	})
+}
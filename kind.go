@@ -0,0 +1,273 @@
+package certdepot
+
+import (
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+// CredentialKind is the kind of data stored for a name in a depot. Together
+// with the name, it identifies the same data as a certstrap depot.Tag, so
+// that callers and backends do not need to import certstrap to construct or
+// inspect tags.
+type CredentialKind string
+
+const (
+	// CredentialCert is a PEM-encoded certificate.
+	CredentialCert CredentialKind = "cert"
+	// CredentialKey is a PEM-encoded private key.
+	CredentialKey CredentialKind = "key"
+	// CredentialCSR is a PEM-encoded certificate signing request.
+	CredentialCSR CredentialKind = "csr"
+	// CredentialCRL is a PEM-encoded certificate revocation list.
+	CredentialCRL CredentialKind = "crl"
+	// CredentialChain is the PEM-encoded chain of intermediate CA
+	// certificates that issued the certificate.
+	CredentialChain CredentialKind = "chain"
+	// CredentialSSHCert is an OpenSSH certificate in the authorized keys
+	// format.
+	CredentialSSHCert CredentialKind = "ssh_cert"
+)
+
+// CredentialKinds are all the valid credential kinds.
+var CredentialKinds = []CredentialKind{
+	CredentialCert,
+	CredentialKey,
+	CredentialCSR,
+	CredentialCRL,
+	CredentialChain,
+	CredentialSSHCert,
+}
+
+// Validate checks that the kind is one of CredentialKinds.
+func (k CredentialKind) Validate() error {
+	for _, kind := range CredentialKinds {
+		if k == kind {
+			return nil
+		}
+	}
+
+	return errors.Errorf("unrecognized credential kind '%s'", k)
+}
+
+// Tag returns the certstrap tag for the kind of data stored for the name.
+func (k CredentialKind) Tag(name string) (*depot.Tag, error) {
+	switch k {
+	case CredentialCert:
+		return CrtTag(name), nil
+	case CredentialKey:
+		return PrivKeyTag(name), nil
+	case CredentialCSR:
+		return CsrTag(name), nil
+	case CredentialCRL:
+		return CrlTag(name), nil
+	case CredentialChain:
+		return ChainTag(name), nil
+	case CredentialSSHCert:
+		return SSHCertTag(name), nil
+	default:
+		return nil, errors.WithStack(k.Validate())
+	}
+}
+
+// ParseTag returns the name and kind of data the tag identifies, or an error
+// if the tag is not recognized. Tags for parameters (see ParamTag) are
+// private key tags, so they are returned as CredentialKey under the name
+// with the parameter suffix, which Tag converts back into the same tag.
+func ParseTag(tag *depot.Tag) (string, CredentialKind, error) {
+	if name := GetNameFromChainTag(tag); name != "" {
+		return name, CredentialChain, nil
+	}
+	if name := GetNameFromSSHCertTag(tag); name != "" {
+		return name, CredentialSSHCert, nil
+	}
+	if name := GetNameFromCrtTag(tag); name != "" {
+		return name, CredentialCert, nil
+	}
+	if name := GetNameFromPrivKeyTag(tag); name != "" {
+		return name, CredentialKey, nil
+	}
+	if name := GetNameFromCsrTag(tag); name != "" {
+		return name, CredentialCSR, nil
+	}
+	if name := GetNameFromCrlTag(tag); name != "" {
+		return name, CredentialCRL, nil
+	}
+
+	return "", "", errors.New("unrecognized tag")
+}
+
+// GetCredential reads the kind of data stored for the name from the depot.
+// It is equivalent to calling Get with the kind's tag.
+func GetCredential(wd Depot, name string, kind CredentialKind) ([]byte, error) {
+	tag, err := kind.Tag(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	data, err := wd.Get(tag)
+	return data, errors.Wrapf(err, "getting %s for '%s'", kind, name)
+}
+
+// PutCredential stores the kind of data for the name in the depot. It is
+// equivalent to calling Put with the kind's tag.
+func PutCredential(wd Depot, name string, kind CredentialKind, data []byte) error {
+	tag, err := kind.Tag(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.Wrapf(wd.Put(tag, data), "putting %s for '%s'", kind, name)
+}
+
+// CheckCredential returns whether the kind of data is stored for the name in
+// the depot. It is equivalent to calling CheckWithError with the kind's tag.
+func CheckCredential(wd Depot, name string, kind CredentialKind) (bool, error) {
+	tag, err := kind.Tag(name)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	exists, err := wd.CheckWithError(tag)
+	return exists, errors.Wrapf(err, "checking %s for '%s'", kind, name)
+}
+
+// DeleteCredential removes the kind of data stored for the name from the
+// depot. It is equivalent to calling Delete with the kind's tag.
+func DeleteCredential(wd Depot, name string, kind CredentialKind) error {
+	tag, err := kind.Tag(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.Wrapf(wd.Delete(tag), "deleting %s for '%s'", kind, name)
+}
+
+// ListNamesWithKind returns the sorted names in the depot that have the kind
+// of data stored for them. The depot must implement NameLister.
+func ListNamesWithKind(wd Depot, kind CredentialKind) ([]string, error) {
+	if err := kind.Validate(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	lister, ok := wd.(NameLister)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not support listing entries", wd)
+	}
+	all, err := lister.ListNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing depot entries")
+	}
+
+	names := []string{}
+	for _, name := range all {
+		exists, err := CheckCredential(wd, name, kind)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if exists {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// CredentialStore is a storage backend addressed by name and kind rather than
+// by certstrap tag. NewStoreDepot turns a CredentialStore into a Depot, which
+// makes it simpler to write new backends and test doubles than implementing
+// Depot directly.
+type CredentialStore interface {
+	// Get returns the data stored for the name and kind, or an error if
+	// there is none.
+	Get(name string, kind CredentialKind) ([]byte, error)
+	// Put stores the data for the name and kind.
+	Put(name string, kind CredentialKind, data []byte) error
+	// Check returns whether data is stored for the name and kind. An error
+	// is only returned if the store cannot be read.
+	Check(name string, kind CredentialKind) (bool, error)
+	// Delete removes the data stored for the name and kind.
+	Delete(name string, kind CredentialKind) error
+}
+
+// storeDepot is a Depot backed by a CredentialStore.
+type storeDepot struct {
+	store CredentialStore
+	opts  DepotOptions
+}
+
+// NewStoreDepot returns a Depot that stores its data in the store and uses
+// the options to find and generate credentials.
+func NewStoreDepot(store CredentialStore, opts DepotOptions) (Depot, error) {
+	if store == nil {
+		return nil, errors.New("must specify a store")
+	}
+
+	return &storeDepot{store: store, opts: opts}, nil
+}
+
+func (d *storeDepot) Put(tag *depot.Tag, data []byte) error {
+	name, kind, err := ParseTag(tag)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if data, err = checkPEM(d.opts, tag, data); err != nil {
+		return err
+	}
+	return d.store.Put(name, kind, data)
+}
+
+func (d *storeDepot) Check(tag *depot.Tag) bool {
+	exists, _ := d.CheckWithError(tag)
+	return exists
+}
+
+func (d *storeDepot) CheckWithError(tag *depot.Tag) (bool, error) {
+	name, kind, err := ParseTag(tag)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return d.store.Check(name, kind)
+}
+
+func (d *storeDepot) Get(tag *depot.Tag) ([]byte, error) {
+	name, kind, err := ParseTag(tag)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return d.store.Get(name, kind)
+}
+
+func (d *storeDepot) Delete(tag *depot.Tag) error {
+	name, kind, err := ParseTag(tag)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return d.store.Delete(name, kind)
+}
+
+func (d *storeDepot) Save(name string, creds *Credentials) error { return depotSave(d, name, creds) }
+func (d *storeDepot) Find(name string) (*Credentials, error)     { return depotFind(d, name, d.opts) }
+
+func (d *storeDepot) Generate(name string) (*Credentials, error) {
+	return depotGenerateDefault(d, name, d.opts)
+}
+
+func (d *storeDepot) GenerateWithOptions(opts CertificateOptions) (*Credentials, error) {
+	return depotGenerate(d, opts.CommonName, d.opts, opts)
+}
+
+// DepotOptions returns the options the depot was created with.
+func (d *storeDepot) DepotOptions() DepotOptions { return d.opts }
+
+// ListNames returns the names in the store, which must implement NameLister,
+// except for the names reserved for the depot's own data.
+func (d *storeDepot) ListNames() ([]string, error) {
+	lister, ok := d.store.(NameLister)
+	if !ok {
+		return nil, errors.Errorf("store of type %T does not support listing entries", d.store)
+	}
+	names, err := lister.ListNames()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return withoutReservedNames(names), nil
+}
@@ -0,0 +1,144 @@
+package certdepot
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mapStore is a CredentialStore backed by a map.
+type mapStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMapStore() *mapStore { return &mapStore{data: map[string][]byte{}} }
+
+func (s *mapStore) key(name string, kind CredentialKind) string { return string(kind) + "/" + name }
+
+func (s *mapStore) Get(name string, kind CredentialKind) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.data[s.key(name, kind)]
+	if !ok {
+		return nil, errors.Errorf("%s for '%s' not found", kind, name)
+	}
+	return data, nil
+}
+
+func (s *mapStore) Put(name string, kind CredentialKind, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[s.key(name, kind)] = data
+	return nil
+}
+
+func (s *mapStore) Check(name string, kind CredentialKind) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.data[s.key(name, kind)]
+	return ok, nil
+}
+
+func (s *mapStore) Delete(name string, kind CredentialKind) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, s.key(name, kind))
+	return nil
+}
+
+func TestCredentialKind(t *testing.T) {
+	t.Run("RoundTripsTags", func(t *testing.T) {
+		for _, kind := range CredentialKinds {
+			require.NoError(t, kind.Validate())
+			tag, err := kind.Tag("my host")
+			require.NoError(t, err)
+			name, parsed, err := ParseTag(tag)
+			require.NoError(t, err)
+			assert.Equal(t, "my host", name)
+			assert.Equal(t, kind, parsed)
+		}
+	})
+	t.Run("RoundTripsParamTags", func(t *testing.T) {
+		name, kind, err := ParseTag(ParamTag("my_host", "dhparam"))
+		require.NoError(t, err)
+		tag, err := kind.Tag(name)
+		require.NoError(t, err)
+		assert.Equal(t, ParamTag("my_host", "dhparam"), tag)
+	})
+	t.Run("RejectsUnrecognized", func(t *testing.T) {
+		assert.Error(t, CredentialKind("ssh").Validate())
+		_, err := CredentialKind("ssh").Tag("my_host")
+		assert.Error(t, err)
+		_, _, err = ParseTag(&depot.Tag{})
+		assert.Error(t, err)
+	})
+	t.Run("Helpers", func(t *testing.T) {
+		d, err := NewStoreDepot(newMapStore(), DepotOptions{})
+		require.NoError(t, err)
+		require.NoError(t, PutCredential(d, "my_host", CredentialCRL, []byte("crl")))
+		assert.True(t, d.Check(CrlTag("my_host")))
+		exists, err := CheckCredential(d, "my_host", CredentialCRL)
+		require.NoError(t, err)
+		assert.True(t, exists)
+		data, err := GetCredential(d, "my_host", CredentialCRL)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("crl"), data)
+		require.NoError(t, DeleteCredential(d, "my_host", CredentialCRL))
+		_, err = GetCredential(d, "my_host", CredentialCRL)
+		assert.Error(t, err)
+	})
+}
+
+func TestListNamesWithKind(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "kind-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := NewFileDepot(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, PutCredential(d, "alice", CredentialCert, []byte("alice cert")))
+	require.NoError(t, PutCredential(d, "alice", CredentialSSHCert, []byte("alice ssh cert")))
+	require.NoError(t, PutCredential(d, "bob", CredentialSSHCert, []byte("bob ssh cert")))
+	require.NoError(t, PutCredential(d, "carol", CredentialKey, []byte("carol key")))
+
+	names, err := ListNamesWithKind(d, CredentialSSHCert)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, names)
+	names, err = ListNamesWithKind(d, CredentialCert)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice"}, names)
+
+	u, err := GetAll(d, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, "bob ssh cert", u.SSHCert)
+
+	_, err = ListNamesWithKind(d, "ssh")
+	assert.Error(t, err)
+	store, err := NewStoreDepot(newMapStore(), DepotOptions{})
+	require.NoError(t, err)
+	_, err = ListNamesWithKind(store, CredentialCert)
+	assert.Error(t, err)
+}
+
+func TestStoreDepot(t *testing.T) {
+	t.Run("Conformance", func(t *testing.T) {
+		DepotConformanceSuite(t, func() Depot {
+			d, err := NewStoreDepot(newMapStore(), DepotOptions{CA: ConformanceSuiteCA, DefaultExpiration: time.Hour})
+			require.NoError(t, err)
+			return d
+		})
+	})
+	t.Run("FailsWithoutStore", func(t *testing.T) {
+		_, err := NewStoreDepot(nil, DepotOptions{})
+		assert.Error(t, err)
+	})
+}
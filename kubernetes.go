@@ -0,0 +1,185 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// kubernetesServiceAccountDir is where Kubernetes mounts the credentials of a
+// pod's service account.
+const kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesOptions describe how to connect to the Kubernetes API server.
+type KubernetesOptions struct {
+	// Host is the base URL of the API server, e.g.
+	// "https://kubernetes.default.svc".
+	Host string `bson:"host" json:"host" yaml:"host"`
+	// Token is the bearer token used to authenticate.
+	Token string `bson:"token" json:"token" yaml:"token"`
+	// Namespace is the namespace of the secrets.
+	Namespace string `bson:"namespace" json:"namespace" yaml:"namespace"`
+	// Client is the HTTP client used to make requests. It should trust the
+	// API server's certificate. If nil, a client with a default timeout is
+	// used.
+	Client *http.Client `bson:"-" json:"-" yaml:"-"`
+}
+
+// InClusterKubernetesOptions returns the options to connect to the API server
+// from a pod, using the pod's service account.
+func InClusterKubernetesOptions() (KubernetesOptions, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return KubernetesOptions{}, errors.New("not running in a Kubernetes cluster")
+	}
+
+	token, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "token"))
+	if err != nil {
+		return KubernetesOptions{}, errors.Wrap(err, "reading service account token")
+	}
+	namespace, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "namespace"))
+	if err != nil {
+		return KubernetesOptions{}, errors.Wrap(err, "reading service account namespace")
+	}
+	caCert, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return KubernetesOptions{}, errors.Wrap(err, "reading service account CA certificate")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return KubernetesOptions{}, errors.New("parsing service account CA certificate")
+	}
+
+	return KubernetesOptions{
+		Host:      "https://" + net.JoinHostPort(host, port),
+		Token:     strings.TrimSpace(string(token)),
+		Namespace: strings.TrimSpace(string(namespace)),
+		Client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// Validate checks that the options are set.
+func (o KubernetesOptions) Validate() error {
+	if o.Host == "" {
+		return errors.New("must specify Kubernetes API server host")
+	}
+	if o.Namespace == "" {
+		return errors.New("must specify Kubernetes namespace")
+	}
+	return nil
+}
+
+// kubernetesSecret is the subset of a Kubernetes Secret used by the exporter.
+type kubernetesSecret struct {
+	APIVersion string                   `json:"apiVersion"`
+	Kind       string                   `json:"kind"`
+	Metadata   kubernetesObjectMetadata `json:"metadata"`
+	Type       string                   `json:"type,omitempty"`
+	Data       map[string][]byte        `json:"data,omitempty"`
+}
+
+type kubernetesObjectMetadata struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// kubernetesStatusError is an error returned by the Kubernetes API server.
+type kubernetesStatusError struct {
+	StatusCode int
+	Message    string `json:"message"`
+	Reason     string `json:"reason"`
+}
+
+func (e *kubernetesStatusError) Error() string {
+	return fmt.Sprintf("Kubernetes returned status %d: %s: %s", e.StatusCode, e.Reason, e.Message)
+}
+
+// isKubernetesStatus returns whether the error was returned by the Kubernetes
+// API server with the given status code.
+func isKubernetesStatus(err error, code int) bool {
+	statusErr, ok := errors.Cause(err).(*kubernetesStatusError)
+	return ok && statusErr.StatusCode == code
+}
+
+// secretsPath returns the API path of the secrets in the namespace, or of the
+// named secret.
+func (o KubernetesOptions) secretsPath(name string) string {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets", o.Namespace)
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// do makes a request to the API server and unmarshals the response into the
+// output.
+func (o KubernetesOptions) do(ctx context.Context, method, path string, input, output interface{}) error {
+	var body io.Reader
+	if input != nil {
+		data, err := json.Marshal(input)
+		if err != nil {
+			return errors.Wrap(err, "marshalling request body")
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(o.Host, "/")+path, body)
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Accept", "application/json")
+	if input != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if o.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.Token)
+	}
+
+	client := o.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "making request")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "reading response body")
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		statusErr := &kubernetesStatusError{}
+		_ = json.Unmarshal(respBody, statusErr)
+		statusErr.StatusCode = resp.StatusCode
+		if statusErr.Message == "" {
+			statusErr.Message = string(respBody)
+		}
+		return errors.WithStack(statusErr)
+	}
+	if output == nil {
+		return nil
+	}
+
+	return errors.Wrap(json.Unmarshal(respBody, output), "unmarshalling response body")
+}
@@ -0,0 +1,331 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	// kubernetesDepotLabel is the label identifying secrets written by a
+	// Kubernetes depot, as opposed to the exporter.
+	kubernetesDepotLabel = "certdepot.evergreen-ci.github.io/depot"
+	// kubernetesMaxUpdateAttempts is how many times a secret is reread and
+	// updated when it is changed concurrently.
+	kubernetesMaxUpdateAttempts = 10
+)
+
+// kubernetesSecretKeys are the keys of the secret data that each kind of
+// credential is stored under. The certificate and key use the keys of
+// kubernetes.io/tls secrets, so that the secrets can be mounted by pods and
+// used by ingress controllers directly.
+var kubernetesSecretKeys = map[CredentialKind]string{
+	CredentialCert:    corev1.TLSCertKey,
+	CredentialKey:     corev1.TLSPrivateKeyKey,
+	CredentialCSR:     "tls.csr",
+	CredentialCRL:     "tls.crl",
+	CredentialChain:   "chain.crt",
+	CredentialSSHCert: "ssh-cert.pub",
+}
+
+var (
+	kubernetesSecretPrefix   = regexp.MustCompile(`^[a-z0-9][-a-z0-9]*$`)
+	kubernetesNameSeparators = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// KubernetesDepotOptions describe how a Kubernetes depot connects to the API
+// server and names its secrets.
+type KubernetesDepotOptions struct {
+	// Kubeconfig is the path of the kubeconfig file used to connect to the
+	// API server. If empty, the file in $KUBECONFIG or ~/.kube/config is
+	// used if there is one, and otherwise the pod's service account.
+	Kubeconfig string `bson:"kubeconfig,omitempty" json:"kubeconfig,omitempty" yaml:"kubeconfig,omitempty"`
+	// Context is the kubeconfig context to use. It defaults to the current
+	// context.
+	Context string `bson:"context,omitempty" json:"context,omitempty" yaml:"context,omitempty"`
+	// Namespace is the namespace the secrets are stored in. It defaults to
+	// the namespace of the kubeconfig context or, in a pod, the pod's
+	// namespace.
+	Namespace string `bson:"namespace,omitempty" json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	// SecretPrefix is prepended to the name of each secret. It defaults to
+	// "certdepot-".
+	SecretPrefix string `bson:"secret_prefix,omitempty" json:"secret_prefix,omitempty" yaml:"secret_prefix,omitempty"`
+	// DepotOptions are the options of the depot.
+	DepotOptions DepotOptions `bson:"depot_options" json:"depot_options" yaml:"depot_options"`
+	// Client, if set, is used to connect to the API server instead of the
+	// kubeconfig or service account, in which case Namespace must be set.
+	Client kubernetes.Interface `bson:"-" json:"-" yaml:"-"`
+}
+
+// IsZero returns whether the options are unset.
+func (opts *KubernetesDepotOptions) IsZero() bool {
+	return opts == nil || (opts.Kubeconfig == "" && opts.Context == "" && opts.Namespace == "" && opts.SecretPrefix == "" && opts.Client == nil)
+}
+
+// Validate checks that the options are valid and sets defaults.
+func (opts *KubernetesDepotOptions) Validate() error {
+	if opts.SecretPrefix == "" {
+		opts.SecretPrefix = "certdepot-"
+	}
+	if !kubernetesSecretPrefix.MatchString(opts.SecretPrefix) {
+		return errors.Errorf("secret prefix '%s' must be lowercase letters, digits, and hyphens starting with a letter or digit", opts.SecretPrefix)
+	}
+	if opts.Client != nil && opts.Namespace == "" {
+		return errors.New("must specify a namespace with a client")
+	}
+	return nil
+}
+
+// client returns the Kubernetes client and namespace described by the
+// options, loading the kubeconfig, or the pod's service account if there is
+// no kubeconfig, unless a client is set.
+func (opts *KubernetesDepotOptions) client() (kubernetes.Interface, string, error) {
+	if opts.Client != nil {
+		return opts.Client, opts.Namespace, nil
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = opts.Kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{
+		CurrentContext: opts.Context,
+		Context:        clientcmdapi.Context{Namespace: opts.Namespace},
+	})
+
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "loading Kubernetes client configuration")
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "getting Kubernetes namespace")
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "creating Kubernetes client")
+	}
+
+	return client, namespace, nil
+}
+
+// kubernetesStore is a CredentialStore backed by Kubernetes secrets. All the
+// kinds of data for a name are stored in one kubernetes.io/tls secret.
+type kubernetesStore struct {
+	ctx     context.Context
+	opts    KubernetesDepotOptions
+	secrets corev1client.SecretInterface
+}
+
+// NewKubernetesDepot returns a depot that stores each name's credentials in a
+// kubernetes.io/tls secret in a namespace, with the certificate in tls.crt,
+// the key in tls.key, and the certificate request, revocation list, chain,
+// and SSH certificate under additional keys, so that pods can mount the
+// credentials the depot issues. Parameters are stored in secrets of their
+// own. Requests to the API server are made with the context.
+//
+// The client must be allowed to get, list, create, update, and delete
+// secrets in the namespace. Secrets that were not written by a Kubernetes
+// depot are never modified.
+func NewKubernetesDepot(ctx context.Context, opts KubernetesDepotOptions) (Depot, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid Kubernetes depot options")
+	}
+	client, namespace, err := opts.client()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	opts.Namespace = namespace
+
+	return NewStoreDepot(&kubernetesStore{
+		ctx:     ctx,
+		opts:    opts,
+		secrets: client.CoreV1().Secrets(namespace),
+	}, opts.DepotOptions)
+}
+
+func (s *kubernetesStore) Get(name string, kind CredentialKind) ([]byte, error) {
+	secret, exists, err := s.getSecret(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting %s for '%s'", kind, name)
+	}
+	data := secret.Data[kubernetesSecretKeys[kind]]
+	if !exists || len(data) == 0 {
+		return nil, errors.Errorf("%s for '%s' not found", kind, name)
+	}
+	return data, nil
+}
+
+func (s *kubernetesStore) Put(name string, kind CredentialKind, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	return errors.Wrapf(s.update(name, func(secret *corev1.Secret) error {
+		secret.Data[kubernetesSecretKeys[kind]] = data
+		return nil
+	}), "putting %s for '%s'", kind, name)
+}
+
+func (s *kubernetesStore) Check(name string, kind CredentialKind) (bool, error) {
+	secret, exists, err := s.getSecret(name)
+	if err != nil {
+		return false, errors.Wrapf(err, "checking %s for '%s'", kind, name)
+	}
+	return exists && len(secret.Data[kubernetesSecretKeys[kind]]) > 0, nil
+}
+
+func (s *kubernetesStore) Delete(name string, kind CredentialKind) error {
+	return errors.WithStack(s.update(name, func(secret *corev1.Secret) error {
+		key := kubernetesSecretKeys[kind]
+		if len(secret.Data[key]) == 0 {
+			return errors.Errorf("%s for '%s' not found", kind, name)
+		}
+		delete(secret.Data, key)
+		return nil
+	}))
+}
+
+// ListNames returns the sorted names that have secrets in the namespace.
+func (s *kubernetesStore) ListNames() ([]string, error) {
+	seen := map[string]bool{}
+	names := []string{}
+	listOpts := metav1.ListOptions{LabelSelector: kubernetesDepotLabel + "=true", Limit: 500}
+	for {
+		list, err := s.secrets.List(s.ctx, listOpts)
+		if err != nil {
+			return nil, errors.Wrap(err, "listing secrets")
+		}
+
+		for _, secret := range list.Items {
+			stored, ok := secret.Annotations[kubernetesDepotNameAnnotation]
+			if !ok || !strings.HasPrefix(secret.Name, s.opts.SecretPrefix) {
+				continue
+			}
+			// Parameters are stored under the name with the
+			// parameter suffix, so they belong to the name without
+			// it.
+			name := getNameFromTag(PrivKeyTag(stored))
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+
+		if list.Continue == "" {
+			break
+		}
+		listOpts.Continue = list.Continue
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// secretName returns the name of the secret for the depot name. Depot names
+// may contain characters that are not allowed in Kubernetes object names, so
+// they are replaced with '-' and a digest of the depot name is appended to
+// keep the secret names of different depot names distinct.
+func (s *kubernetesStore) secretName(name string) string {
+	sanitized := strings.Trim(kubernetesNameSeparators.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(sanitized) > 200 {
+		sanitized = sanitized[:200]
+	}
+	digest := sha256.Sum256([]byte(name))
+
+	return fmt.Sprintf("%s%s-%s", s.opts.SecretPrefix, sanitized, hex.EncodeToString(digest[:4]))
+}
+
+// getSecret returns the secret for the name and whether it exists.
+func (s *kubernetesStore) getSecret(name string) (*corev1.Secret, bool, error) {
+	secretName := s.secretName(name)
+	secret, err := s.secrets.Get(s.ctx, secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &corev1.Secret{}, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "getting secret '%s'", secretName)
+	}
+	if secret.Labels[kubernetesDepotLabel] != "true" || secret.Annotations[kubernetesDepotNameAnnotation] != name {
+		return nil, false, errors.Errorf("secret '%s' exists and is not managed by the depot", secretName)
+	}
+
+	return secret, true, nil
+}
+
+// update applies the change to the data of the name's secret, creating the
+// secret if it does not exist and deleting it once it has no data. The secret
+// is reread and the change reapplied if the secret is changed concurrently.
+func (s *kubernetesStore) update(name string, change func(*corev1.Secret) error) error {
+	secretName := s.secretName(name)
+	for attempt := 0; ; attempt++ {
+		secret, exists, err := s.getSecret(name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !exists {
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      secretName,
+					Namespace: s.opts.Namespace,
+					Labels: map[string]string{
+						kubernetesManagedByLabel: "certdepot",
+						kubernetesDepotLabel:     "true",
+					},
+					Annotations: map[string]string{kubernetesDepotNameAnnotation: name},
+				},
+				Type: corev1.SecretTypeTLS,
+			}
+		}
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		if err = change(secret); err != nil {
+			return errors.WithStack(err)
+		}
+
+		empty := true
+		for _, value := range secret.Data {
+			empty = empty && len(value) == 0
+		}
+		// kubernetes.io/tls secrets must have a certificate and key, so
+		// they are left empty until they are put.
+		for _, key := range []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey} {
+			if _, ok := secret.Data[key]; !ok {
+				secret.Data[key] = []byte{}
+			}
+		}
+
+		switch {
+		case !exists:
+			_, err = s.secrets.Create(s.ctx, secret, metav1.CreateOptions{})
+			// Another writer created the secret first.
+			if apierrors.IsAlreadyExists(err) && attempt < kubernetesMaxUpdateAttempts {
+				continue
+			}
+			return errors.Wrapf(err, "creating secret '%s'", secretName)
+		case empty:
+			err = s.secrets.Delete(s.ctx, secretName, metav1.DeleteOptions{
+				Preconditions: &metav1.Preconditions{ResourceVersion: &secret.ResourceVersion},
+			})
+		default:
+			_, err = s.secrets.Update(s.ctx, secret, metav1.UpdateOptions{})
+		}
+		// The secret was changed or deleted since it was read.
+		if (apierrors.IsConflict(err) || apierrors.IsNotFound(err)) && attempt < kubernetesMaxUpdateAttempts {
+			continue
+		}
+		return errors.Wrapf(err, "updating secret '%s'", secretName)
+	}
+}
@@ -0,0 +1,225 @@
+package certdepot
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeKubernetesClient returns a fake clientset whose secrets have
+// resource versions that are checked on update and delete, like the API
+// server's optimistic concurrency, which the fake does not do on its own.
+func newFakeKubernetesClient() *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	tracker := client.Tracker()
+	resource := corev1.SchemeGroupVersion.WithResource("secrets")
+
+	var mu sync.Mutex
+	versions := 0
+	client.PrependReactor("*", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		current := func(name string) (*corev1.Secret, error) {
+			obj, err := tracker.Get(resource, action.GetNamespace(), name)
+			if err != nil {
+				return nil, err
+			}
+			return obj.(*corev1.Secret), nil
+		}
+
+		switch action.GetVerb() {
+		case "create":
+			secret := action.(k8stesting.CreateAction).GetObject().(*corev1.Secret).DeepCopy()
+			versions++
+			secret.ResourceVersion = strconv.Itoa(versions)
+			return true, secret, tracker.Create(resource, secret, action.GetNamespace())
+		case "update":
+			secret := action.(k8stesting.UpdateAction).GetObject().(*corev1.Secret).DeepCopy()
+			existing, err := current(secret.Name)
+			if err != nil {
+				return true, nil, err
+			}
+			if existing.ResourceVersion != secret.ResourceVersion {
+				return true, nil, apierrors.NewConflict(resource.GroupResource(), secret.Name, errors.New("resource version changed"))
+			}
+			versions++
+			secret.ResourceVersion = strconv.Itoa(versions)
+			return true, secret, tracker.Update(resource, secret, action.GetNamespace())
+		case "delete":
+			action := action.(k8stesting.DeleteAction)
+			existing, err := current(action.GetName())
+			if err != nil {
+				return true, nil, err
+			}
+			if preconditions := action.GetDeleteOptions().Preconditions; preconditions != nil && preconditions.ResourceVersion != nil && *preconditions.ResourceVersion != existing.ResourceVersion {
+				return true, nil, apierrors.NewConflict(resource.GroupResource(), existing.Name, errors.New("resource version changed"))
+			}
+			return true, nil, tracker.Delete(resource, action.GetNamespace(), action.GetName())
+		}
+		return false, nil, nil
+	})
+
+	return client
+}
+
+// getFakeSecret returns the secret in the fake clientset's "ns" namespace.
+func getFakeSecret(t *testing.T, client *fake.Clientset, name string) *corev1.Secret {
+	secret, err := client.CoreV1().Secrets("ns").Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	return secret
+}
+
+func TestKubernetesDepot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	depotOpts := DepotOptions{CA: ConformanceSuiteCA, DefaultExpiration: time.Hour}
+	newDepot := func(t *testing.T) (*fake.Clientset, Depot) {
+		client := newFakeKubernetesClient()
+		d, err := NewKubernetesDepot(ctx, KubernetesDepotOptions{
+			Client:       client,
+			Namespace:    "ns",
+			DepotOptions: depotOpts,
+		})
+		require.NoError(t, err)
+		return client, d
+	}
+
+	t.Run("Conformance", func(t *testing.T) {
+		DepotConformanceSuite(t, func() Depot {
+			_, d := newDepot(t)
+			return d
+		})
+	})
+	t.Run("Stress", func(t *testing.T) {
+		DepotStressSuite(t, func() Depot {
+			_, d := newDepot(t)
+			return d
+		}, StressOptions{Workers: 4, Operations: 50, Generations: 1})
+	})
+	t.Run("StoresCredentialsInTLSSecrets", func(t *testing.T) {
+		client, d := newDepot(t)
+		initConformanceSuiteCA(t, d)
+		creds, err := d.Generate("Web.Example.com")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("Web.Example.com", creds))
+		require.NoError(t, d.Put(CsrTag("Web.Example.com"), []byte("csr")))
+
+		s := &kubernetesStore{opts: KubernetesDepotOptions{SecretPrefix: "certdepot-"}}
+		secretName := s.secretName("Web.Example.com")
+		assert.True(t, strings.HasPrefix(secretName, "certdepot-web-example-com-"), secretName)
+		assert.NotEqual(t, secretName, s.secretName("web.example.com"))
+
+		secret := getFakeSecret(t, client, secretName)
+		assert.Equal(t, corev1.SecretTypeTLS, secret.Type)
+		assert.Equal(t, creds.Cert, secret.Data[corev1.TLSCertKey])
+		assert.Equal(t, creds.Key, secret.Data[corev1.TLSPrivateKeyKey])
+		assert.Equal(t, "csr", string(secret.Data["tls.csr"]))
+		assert.Equal(t, "Web.Example.com", secret.Annotations[kubernetesDepotNameAnnotation])
+
+		names, err := d.(NameLister).ListNames()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Web.Example.com", ConformanceSuiteCA}, names)
+	})
+	t.Run("DeletesEmptySecrets", func(t *testing.T) {
+		client, d := newDepot(t)
+		require.NoError(t, d.Put(CsrTag("bob"), []byte("csr")))
+		secrets, err := client.CoreV1().Secrets("ns").List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Len(t, secrets.Items, 1)
+
+		require.NoError(t, d.Delete(CsrTag("bob")))
+		assert.Error(t, d.Delete(CsrTag("bob")))
+		secrets, err = client.CoreV1().Secrets("ns").List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, secrets.Items)
+	})
+	t.Run("RetriesConflictingUpdates", func(t *testing.T) {
+		client, d := newDepot(t)
+		require.NoError(t, d.Put(CsrTag("bob"), []byte("csr")))
+
+		conflicts := 0
+		client.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if conflicts < 2 {
+				conflicts++
+				return true, nil, apierrors.NewConflict(corev1.Resource("secrets"), "bob", errors.New("resource version changed"))
+			}
+			return false, nil, nil
+		})
+		require.NoError(t, d.Put(CrtTag("bob"), []byte("cert")))
+		assert.Equal(t, 2, conflicts)
+
+		data, err := d.Get(CrtTag("bob"))
+		require.NoError(t, err)
+		assert.Equal(t, "cert", string(data))
+	})
+	t.Run("LeavesUnmanagedSecretsAlone", func(t *testing.T) {
+		client, d := newDepot(t)
+		s := &kubernetesStore{opts: KubernetesDepotOptions{SecretPrefix: "certdepot-"}}
+		secretName := s.secretName("bob")
+		_, err := client.CoreV1().Secrets("ns").Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: "ns"},
+			Type:       corev1.SecretTypeTLS,
+			Data:       map[string][]byte{corev1.TLSCertKey: []byte("other"), corev1.TLSPrivateKeyKey: []byte("other")},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+
+		assert.Error(t, d.Put(CrtTag("bob"), []byte("cert")))
+		_, err = d.Get(CrtTag("bob"))
+		assert.Error(t, err)
+		assert.Equal(t, "other", string(getFakeSecret(t, client, secretName).Data[corev1.TLSCertKey]))
+	})
+	t.Run("RejectsInvalidOptions", func(t *testing.T) {
+		for name, opts := range map[string]KubernetesDepotOptions{
+			"MissingNamespaceWithClient": {Client: fake.NewSimpleClientset()},
+			"InvalidPrefix":              {Client: fake.NewSimpleClientset(), Namespace: "ns", SecretPrefix: "Certs_"},
+			"MissingKubeconfig":          {Kubeconfig: "does-not-exist.yaml", Namespace: "ns"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := NewKubernetesDepot(ctx, opts)
+				assert.Error(t, err)
+			})
+		}
+	})
+}
+
+func TestBootstrapKubernetesDepot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := newFakeKubernetesClient()
+	d, report, err := BootstrapDepotWithReport(ctx, nil, BootstrapDepotConfig{
+		KubernetesDepot: &KubernetesDepotOptions{
+			Client:    client,
+			Namespace: "ns",
+		},
+		CAName:      "root",
+		ServiceName: "web",
+		CAOpts:      &CertificateOptions{CommonName: "root", Expires: time.Hour},
+		ServiceOpts: &CertificateOptions{CommonName: "web", Host: "web", CA: "root", Expires: time.Hour},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, BootstrapCreated, report.Service.Action)
+
+	creds, err := d.Find("web")
+	require.NoError(t, err)
+	s := &kubernetesStore{opts: KubernetesDepotOptions{SecretPrefix: "certdepot-"}}
+	secret := getFakeSecret(t, client, s.secretName("web"))
+	assert.Equal(t, corev1.SecretTypeTLS, secret.Type)
+	assert.Equal(t, creds.Cert, secret.Data[corev1.TLSCertKey])
+	assert.Equal(t, creds.Key, secret.Data[corev1.TLSPrivateKeyKey])
+}
@@ -0,0 +1,234 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+const (
+	// kubernetesManagedByLabel is the label identifying secrets written by
+	// the exporter.
+	kubernetesManagedByLabel = "app.kubernetes.io/managed-by"
+	// kubernetesDepotNameAnnotation is the annotation holding the depot
+	// name a secret was exported from.
+	kubernetesDepotNameAnnotation = "certdepot.evergreen-ci.github.io/name"
+	// kubernetesCommonNameAnnotation is the annotation cert-manager uses
+	// for the common name of a certificate in a secret.
+	kubernetesCommonNameAnnotation = "cert-manager.io/common-name"
+	// kubernetesAltNamesAnnotation is the annotation cert-manager uses for
+	// the DNS subject alt names of a certificate in a secret.
+	kubernetesAltNamesAnnotation = "cert-manager.io/alt-names"
+	// kubernetesIPSANsAnnotation is the annotation cert-manager uses for
+	// the IP subject alt names of a certificate in a secret.
+	kubernetesIPSANsAnnotation = "cert-manager.io/ip-sans"
+	// kubernetesURISANsAnnotation is the annotation cert-manager uses for
+	// the URI subject alt names of a certificate in a secret.
+	kubernetesURISANsAnnotation = "cert-manager.io/uri-sans"
+)
+
+var invalidKubernetesNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// KubernetesSecretExporter mirrors the certificates and keys in a depot into
+// Kubernetes TLS secrets in the format cert-manager and ingress controllers
+// expect: the certificate in tls.crt, the key in tls.key, and the trusted CA
+// certificates in ca.crt.
+type KubernetesSecretExporter struct {
+	// Depot is the depot to export from.
+	Depot Depot
+	// Kubernetes describes how to connect to the API server.
+	Kubernetes KubernetesOptions
+	// Names are the depot names to export. If empty, every name with a
+	// certificate and key that is not a CA is exported; the depot must
+	// implement NameLister.
+	Names []string
+	// SecretPrefix is prepended to the name of each secret. It defaults to
+	// "certdepot-".
+	SecretPrefix string
+}
+
+// SecretName returns the name of the secret the depot name is exported to.
+// Characters that are not allowed in Kubernetes object names are replaced
+// with '-'.
+func (e *KubernetesSecretExporter) SecretName(name string) string {
+	prefix := e.SecretPrefix
+	if prefix == "" {
+		prefix = "certdepot-"
+	}
+	return strings.Trim(invalidKubernetesNameChars.ReplaceAllString(strings.ToLower(prefix+name), "-"), "-.")
+}
+
+// Sync writes a secret for every exported name whose certificate, key, or CA
+// certificates differ from the secret's. Secrets that are already up to date
+// are left alone.
+func (e *KubernetesSecretExporter) Sync(ctx context.Context) error {
+	if e.Depot == nil {
+		return errors.New("must specify a depot")
+	}
+	if err := e.Kubernetes.Validate(); err != nil {
+		return errors.Wrap(err, "invalid Kubernetes options")
+	}
+
+	names, err := e.exportedNames()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	for _, name := range names {
+		if err = ctx.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+		catcher.Wrapf(e.syncName(ctx, name), "exporting '%s'", name)
+	}
+
+	return catcher.Resolve()
+}
+
+// Run syncs the secrets every interval until the context is canceled. Errors
+// are logged rather than returned so that one failed sync does not stop
+// rotated certificates from being exported later.
+func (e *KubernetesSecretExporter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		grip.Error(message.WrapError(e.Sync(ctx), message.Fields{
+			"message":   "could not sync Kubernetes secrets",
+			"namespace": e.Kubernetes.Namespace,
+		}))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *KubernetesSecretExporter) exportedNames() ([]string, error) {
+	if len(e.Names) > 0 {
+		return e.Names, nil
+	}
+
+	lister, ok := e.Depot.(NameLister)
+	if !ok {
+		return nil, errors.New("depot does not support listing entries")
+	}
+	all, err := lister.ListNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing depot entries")
+	}
+
+	names := []string{}
+	for _, name := range all {
+		u, err := GetAll(e.Depot, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting '%s'", name)
+		}
+		if u.Cert == "" || u.PrivateKey == "" {
+			continue
+		}
+		crt, err := getRawCertificate(e.Depot, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting certificate '%s'", name)
+		}
+		if crt.IsCA {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+func (e *KubernetesSecretExporter) syncName(ctx context.Context, name string) error {
+	creds, err := depotFind(e.Depot, name, getDepotOptions(e.Depot))
+	if err != nil {
+		return errors.Wrap(err, "getting credentials")
+	}
+	crt, err := getRawCertificate(e.Depot, name)
+	if err != nil {
+		return errors.Wrap(err, "getting certificate")
+	}
+
+	ips := make([]string, 0, len(crt.IPAddresses))
+	for _, ip := range crt.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	uris := make([]string, 0, len(crt.URIs))
+	for _, uri := range crt.URIs {
+		uris = append(uris, uri.String())
+	}
+
+	secretName := e.SecretName(name)
+	secret := kubernetesSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: kubernetesObjectMetadata{
+			Name:      secretName,
+			Namespace: e.Kubernetes.Namespace,
+			Labels:    map[string]string{kubernetesManagedByLabel: "certdepot"},
+			Annotations: map[string]string{
+				kubernetesDepotNameAnnotation:  name,
+				kubernetesCommonNameAnnotation: crt.Subject.CommonName,
+				kubernetesAltNamesAnnotation:   strings.Join(crt.DNSNames, ","),
+				kubernetesIPSANsAnnotation:     strings.Join(ips, ","),
+				kubernetesURISANsAnnotation:    strings.Join(uris, ","),
+			},
+		},
+		Type: "kubernetes.io/tls",
+		Data: map[string][]byte{
+			"tls.crt": creds.Cert,
+			"tls.key": creds.Key,
+			"ca.crt":  creds.CACert,
+		},
+	}
+
+	existing := kubernetesSecret{}
+	err = e.Kubernetes.do(ctx, http.MethodGet, e.Kubernetes.secretsPath(secretName), nil, &existing)
+	if isKubernetesStatus(err, http.StatusNotFound) {
+		return errors.Wrap(e.Kubernetes.do(ctx, http.MethodPost, e.Kubernetes.secretsPath(""), secret, nil), "creating secret")
+	}
+	if err != nil {
+		return errors.Wrap(err, "getting secret")
+	}
+	if existing.Metadata.Labels[kubernetesManagedByLabel] != "certdepot" {
+		return errors.Errorf("secret '%s' exists and is not managed by certdepot", secretName)
+	}
+	if secretDataEqual(existing.Data, secret.Data) {
+		return nil
+	}
+
+	secret.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+	if err = e.Kubernetes.do(ctx, http.MethodPut, e.Kubernetes.secretsPath(secretName), secret, nil); err != nil {
+		return errors.Wrap(err, "updating secret")
+	}
+	grip.Info(message.Fields{
+		"message":   "updated Kubernetes secret",
+		"name":      name,
+		"secret":    secretName,
+		"namespace": e.Kubernetes.Namespace,
+	})
+
+	return nil
+}
+
+func secretDataEqual(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if !bytes.Equal(value, b[key]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,230 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// kubernetesSecretList is the subset of a Kubernetes SecretList served by
+// fakeKubernetesSecrets.
+type kubernetesSecretList struct {
+	Items    []kubernetesSecret `json:"items"`
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+}
+
+// fakeKubernetesSecrets serves a minimal Kubernetes secrets API backed by a
+// map, with optimistic concurrency on resource versions, label selectors, and
+// paginated lists.
+type fakeKubernetesSecrets struct {
+	mu       sync.Mutex
+	secrets  map[string]kubernetesSecret
+	writes   int
+	versions int
+}
+
+func (f *fakeKubernetesSecrets) writeStatus(w http.ResponseWriter, code int, reason string) {
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"reason": reason, "message": reason})
+}
+
+func (f *fakeKubernetesSecrets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	const prefix = "/api/v1/namespaces/ns/secrets"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		f.list(w, r)
+	case r.Method == http.MethodGet:
+		secret, ok := f.secrets[name]
+		if !ok {
+			f.writeStatus(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		_ = json.NewEncoder(w).Encode(secret)
+	case r.Method == http.MethodPost, r.Method == http.MethodPut:
+		secret := kubernetesSecret{}
+		if err := json.NewDecoder(r.Body).Decode(&secret); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if secret.Type == "kubernetes.io/tls" {
+			_, hasCert := secret.Data["tls.crt"]
+			_, hasKey := secret.Data["tls.key"]
+			if !hasCert || !hasKey {
+				f.writeStatus(w, http.StatusUnprocessableEntity, "Invalid")
+				return
+			}
+		}
+		existing, exists := f.secrets[secret.Metadata.Name]
+		if r.Method == http.MethodPost && exists {
+			f.writeStatus(w, http.StatusConflict, "AlreadyExists")
+			return
+		}
+		if r.Method == http.MethodPut && (!exists || secret.Metadata.ResourceVersion != existing.Metadata.ResourceVersion) {
+			f.writeStatus(w, http.StatusConflict, "Conflict")
+			return
+		}
+		f.writes++
+		f.versions++
+		secret.Metadata.ResourceVersion = strconv.Itoa(f.versions)
+		f.secrets[secret.Metadata.Name] = secret
+		_ = json.NewEncoder(w).Encode(secret)
+	case r.Method == http.MethodDelete:
+		existing, exists := f.secrets[name]
+		if !exists {
+			f.writeStatus(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		opts := struct {
+			Preconditions struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"preconditions"`
+		}{}
+		_ = json.NewDecoder(r.Body).Decode(&opts)
+		if version := opts.Preconditions.ResourceVersion; version != "" && version != existing.Metadata.ResourceVersion {
+			f.writeStatus(w, http.StatusConflict, "Conflict")
+			return
+		}
+		f.writes++
+		delete(f.secrets, name)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list returns the secrets matching the label selector, two per page.
+func (f *fakeKubernetesSecrets) list(w http.ResponseWriter, r *http.Request) {
+	selector := map[string]string{}
+	for _, requirement := range strings.Split(r.URL.Query().Get("labelSelector"), ",") {
+		if parts := strings.SplitN(requirement, "=", 2); len(parts) == 2 {
+			selector[parts[0]] = parts[1]
+		}
+	}
+
+	names := []string{}
+	for name, secret := range f.secrets {
+		matches := true
+		for label, value := range selector {
+			matches = matches && secret.Metadata.Labels[label] == value
+		}
+		if matches && name >= r.URL.Query().Get("continue") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	list := kubernetesSecretList{}
+	for i, name := range names {
+		if i == 2 {
+			list.Metadata.Continue = name
+			break
+		}
+		list.Items = append(list.Items, f.secrets[name])
+	}
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+func TestKubernetesSecretExporter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tempDir, err := ioutil.TempDir(".", "kubernetes-export-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+	opts := CertificateOptions{
+		CommonName: "web",
+		Host:       "web",
+		CA:         "root",
+		Domain:     []string{"web.example.com"},
+		Expires:    time.Hour,
+	}
+	require.NoError(t, opts.CreateCertificate(d))
+
+	fake := &fakeKubernetesSecrets{secrets: map[string]kubernetesSecret{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	exporter := &KubernetesSecretExporter{
+		Depot: d,
+		Kubernetes: KubernetesOptions{
+			Host:      srv.URL,
+			Token:     "token",
+			Namespace: "ns",
+		},
+	}
+
+	t.Run("CreatesTLSSecrets", func(t *testing.T) {
+		require.NoError(t, exporter.Sync(ctx))
+		require.Len(t, fake.secrets, 1)
+		secret, ok := fake.secrets["certdepot-web"]
+		require.True(t, ok)
+		assert.Equal(t, "kubernetes.io/tls", secret.Type)
+		assert.Equal(t, "web", secret.Metadata.Annotations[kubernetesCommonNameAnnotation])
+		assert.Equal(t, "web.example.com", secret.Metadata.Annotations[kubernetesAltNamesAnnotation])
+
+		creds, err := depotFind(d, "web", getDepotOptions(d))
+		require.NoError(t, err)
+		assert.Equal(t, creds.Cert, secret.Data["tls.crt"])
+		assert.Equal(t, creds.Key, secret.Data["tls.key"])
+		assert.Equal(t, creds.CACert, secret.Data["ca.crt"])
+	})
+	t.Run("SkipsUnchangedSecrets", func(t *testing.T) {
+		writes := fake.writes
+		require.NoError(t, exporter.Sync(ctx))
+		assert.Equal(t, writes, fake.writes)
+	})
+	t.Run("UpdatesRotatedSecrets", func(t *testing.T) {
+		created, err := opts.CreateCertificateOnExpiration(d, 2*time.Hour)
+		require.NoError(t, err)
+		require.True(t, created)
+
+		require.NoError(t, exporter.Sync(ctx))
+		creds, err := depotFind(d, "web", getDepotOptions(d))
+		require.NoError(t, err)
+		assert.Equal(t, creds.Cert, fake.secrets["certdepot-web"].Data["tls.crt"])
+	})
+	t.Run("RefusesUnmanagedSecrets", func(t *testing.T) {
+		fake.secrets["other-web"] = kubernetesSecret{Metadata: kubernetesObjectMetadata{Name: "other-web"}}
+		other := *exporter
+		other.SecretPrefix = "other-"
+		other.Names = []string{"web"}
+		assert.Error(t, other.Sync(ctx))
+	})
+	t.Run("SecretName", func(t *testing.T) {
+		assert.Equal(t, "certdepot-my-service", (&KubernetesSecretExporter{}).SecretName("My_Service"))
+		assert.Equal(t, "my-service.example", (&KubernetesSecretExporter{SecretPrefix: "-"}).SecretName("my service.example"))
+	})
+}
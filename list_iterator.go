@@ -0,0 +1,311 @@
+package certdepot
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultListBatchSize is the number of entries read from the backend at a
+// time if ListOptions does not specify a batch size.
+const defaultListBatchSize = 1000
+
+// ListOptions configures which entries ListIterator returns and how they are
+// read from the backend.
+type ListOptions struct {
+	// Prefix, if set, restricts the entries to the names that start with
+	// it.
+	Prefix string `bson:"prefix,omitempty" json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	// BatchSize is the number of entries read from the backend at a time,
+	// which bounds the memory used by the iterator. It defaults to 1000.
+	BatchSize int `bson:"batch_size,omitempty" json:"batch_size,omitempty" yaml:"batch_size,omitempty"`
+}
+
+// Validate checks that the options are valid.
+func (opts ListOptions) Validate() error {
+	if opts.BatchSize < 0 {
+		return errors.New("batch size cannot be negative")
+	}
+	return nil
+}
+
+func (opts ListOptions) batchSize() int {
+	if opts.BatchSize == 0 {
+		return defaultListBatchSize
+	}
+	return opts.BatchSize
+}
+
+// ListEntry is an entry returned by an EntryIterator.
+type ListEntry struct {
+	// Name is the name of the entry.
+	Name string `bson:"name" json:"name" yaml:"name"`
+	// Expiration is when the entry's credentials expire, or the zero time
+	// if the depot does not track it (see ExpiryTracker).
+	Expiration time.Time `bson:"expiration,omitempty" json:"expiration,omitempty" yaml:"expiration,omitempty"`
+}
+
+// EntryIterator iterates over the entries in a depot. Each name is returned
+// once, but the order depends on the depot.
+type EntryIterator interface {
+	// Next advances the iterator to the next entry, returning false when
+	// there are no more entries or an error occurred.
+	Next(ctx context.Context) bool
+	// Entry returns the entry the iterator is at.
+	Entry() ListEntry
+	// Err returns the error that stopped the iteration, if any.
+	Err() error
+	// Close releases the resources held by the iterator.
+	Close(ctx context.Context) error
+}
+
+// ListIterator returns an iterator over the entries in the depot that match
+// the options. Depots that implement EntryStreamer read the entries in
+// batches from the backend, so the memory used does not grow with the size
+// of the depot. For other depots, the depot must implement NameLister, and
+// all the names are read up front.
+func ListIterator(ctx context.Context, wd Depot, opts ListOptions) (EntryIterator, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid list options")
+	}
+	if streamer, ok := wd.(EntryStreamer); ok {
+		iter, err := streamer.ListIterator(ctx, opts)
+		return iter, errors.Wrap(err, "creating depot iterator")
+	}
+
+	lister, ok := wd.(NameLister)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not support listing entries", wd)
+	}
+	names, err := lister.ListNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing depot entries")
+	}
+	filtered := names[:0]
+	for _, name := range names {
+		if strings.HasPrefix(name, opts.Prefix) {
+			filtered = append(filtered, name)
+		}
+	}
+	tracker, _ := wd.(ExpiryTracker)
+
+	return &namesIterator{names: filtered, tracker: tracker}, nil
+}
+
+// namesIterator iterates over a list of names, looking up each name's
+// expiration if the depot tracks it.
+type namesIterator struct {
+	names   []string
+	tracker ExpiryTracker
+	entry   ListEntry
+	err     error
+}
+
+func (it *namesIterator) Next(ctx context.Context) bool {
+	if it.err != nil || len(it.names) == 0 {
+		return false
+	}
+	if it.err = ctx.Err(); it.err != nil {
+		return false
+	}
+
+	it.entry = ListEntry{Name: it.names[0]}
+	it.names = it.names[1:]
+	if it.tracker != nil {
+		if it.entry.Expiration, it.err = it.tracker.GetTTL(it.entry.Name); it.err != nil {
+			it.err = errors.Wrapf(it.err, "getting TTL for '%s'", it.entry.Name)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (it *namesIterator) Entry() ListEntry            { return it.entry }
+func (it *namesIterator) Err() error                  { return it.err }
+func (it *namesIterator) Close(context.Context) error { return nil }
+
+// ListIterator returns an iterator that reads the file depot's directory in
+// batches. Names are not returned in sorted order.
+func (fd *fileDepot) ListIterator(ctx context.Context, opts ListOptions) (EntryIterator, error) {
+	dir, err := os.Open(fd.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening depot directory")
+	}
+
+	return &fileIterator{fd: fd, dir: dir, opts: opts, paramOnly: map[string]bool{}}, nil
+}
+
+// fileIterator iterates over the entries of a file depot by reading the
+// names of the files in its directory in batches.
+type fileIterator struct {
+	fd    *fileDepot
+	dir   *os.File
+	opts  ListOptions
+	batch []string
+	// paramOnly are the names seen so far that only have parameters
+	// stored for them, which cannot be deduplicated by file.
+	paramOnly map[string]bool
+	entry     ListEntry
+	err       error
+}
+
+func (it *fileIterator) Next(ctx context.Context) bool {
+	for it.err == nil {
+		if it.err = ctx.Err(); it.err != nil {
+			return false
+		}
+		if len(it.batch) == 0 {
+			files, err := it.dir.Readdirnames(it.opts.batchSize())
+			if err == io.EOF {
+				return false
+			}
+			if err != nil {
+				it.err = errors.Wrap(err, "reading depot directory")
+				return false
+			}
+			it.batch = files
+		}
+
+		file := it.batch[0]
+		it.batch = it.batch[1:]
+		name, ok := it.entryName(file)
+		if !ok || !strings.HasPrefix(name, it.opts.Prefix) {
+			continue
+		}
+
+		it.entry = ListEntry{Name: name}
+		if it.entry.Expiration, it.err = it.fd.GetTTL(name); it.err != nil {
+			it.err = errors.Wrapf(it.err, "getting TTL for '%s'", name)
+			return false
+		}
+		return true
+	}
+
+	return false
+}
+
+// entryName returns the name of the entry the file belongs to if the file is
+// the one that represents the entry. An entry is represented by the file for
+// its first kind in CredentialKinds that exists, so that each name is
+// returned once without remembering every name seen.
+func (it *fileIterator) entryName(file string) (string, bool) {
+	tag := fileTag(file)
+	if tag == nil {
+		return "", false
+	}
+	name := getNameFromTag(tag)
+	if name == "" {
+		return "", false
+	}
+	tagName, tagKind, err := ParseTag(tag)
+	if err != nil {
+		return "", false
+	}
+
+	for _, kind := range CredentialKinds {
+		kindTag, err := kind.Tag(name)
+		if err != nil || !it.fd.FileDepot.Check(kindTag) {
+			continue
+		}
+		return name, tagName == name && tagKind == kind
+	}
+
+	if it.paramOnly[name] {
+		return "", false
+	}
+	it.paramOnly[name] = true
+	return name, true
+}
+
+func (it *fileIterator) Entry() ListEntry { return it.entry }
+func (it *fileIterator) Err() error       { return it.err }
+
+func (it *fileIterator) Close(context.Context) error {
+	return errors.Wrap(it.dir.Close(), "closing depot directory")
+}
+
+// fileTag returns the tag for a file in a file depot's directory, or nil if
+// the file does not hold depot data.
+func fileTag(file string) *depot.Tag {
+	ext := filepath.Ext(file)
+	base := strings.TrimSuffix(file, ext)
+	if base == "" {
+		return nil
+	}
+
+	switch ext {
+	case ".crt":
+		return CrtTag(base)
+	case ".key":
+		return PrivKeyTag(base)
+	case ".csr":
+		return CsrTag(base)
+	case ".crl":
+		return CrlTag(base)
+	default:
+		return nil
+	}
+}
+
+// ListIterator returns an iterator that reads the users in the mongo depot
+// with a cursor, sorted by name.
+func (m *mongoDepot) ListIterator(ctx context.Context, opts ListOptions) (EntryIterator, error) {
+	query := bson.M{}
+	if opts.Prefix != "" {
+		query[userIDKey] = bson.M{"$regex": "^" + regexp.QuoteMeta(opts.Prefix)}
+	}
+
+	cursor, err := m.coll.Find(ctx, query, options.Find().
+		SetProjection(bson.M{userIDKey: 1, userTTLKey: 1}).
+		SetSort(bson.M{userIDKey: 1}).
+		SetBatchSize(int32(opts.batchSize())))
+	if err != nil {
+		return nil, errors.Wrap(err, "finding users")
+	}
+
+	return &mongoIterator{cursor: cursor}, nil
+}
+
+// mongoIterator iterates over the users returned by a mongo cursor.
+type mongoIterator struct {
+	cursor *mongo.Cursor
+	entry  ListEntry
+	err    error
+}
+
+func (it *mongoIterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.cursor.Next(ctx) {
+		it.err = errors.Wrap(it.cursor.Err(), "iterating over users")
+		return false
+	}
+
+	u := User{}
+	if it.err = it.cursor.Decode(&u); it.err != nil {
+		it.err = errors.Wrap(it.err, "decoding user")
+		return false
+	}
+	it.entry = ListEntry{Name: u.ID, Expiration: u.TTL}
+
+	return true
+}
+
+func (it *mongoIterator) Entry() ListEntry { return it.entry }
+func (it *mongoIterator) Err() error       { return it.err }
+
+func (it *mongoIterator) Close(ctx context.Context) error {
+	return errors.Wrap(it.cursor.Close(ctx), "closing cursor")
+}
@@ -0,0 +1,135 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestListIterator(t *testing.T) {
+	ctx := context.TODO()
+	depotOpts := DepotOptions{CA: "root", DefaultExpiration: time.Hour}
+
+	// collect reads every entry from the iterator, sorted by name.
+	collect := func(t *testing.T, iter EntryIterator) []ListEntry {
+		defer func() {
+			assert.NoError(t, iter.Close(ctx))
+		}()
+		entries := []ListEntry{}
+		for iter.Next(ctx) {
+			entries = append(entries, iter.Entry())
+		}
+		require.NoError(t, iter.Err())
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		return entries
+	}
+	names := func(entries []ListEntry) []string {
+		out := []string{}
+		for _, entry := range entries {
+			out = append(out, entry.Name)
+		}
+		return out
+	}
+
+	for name, makeDepot := range map[string]func(t *testing.T) (Depot, func()){
+		"FileDepot": func(t *testing.T) (Depot, func()) {
+			tempDir, err := ioutil.TempDir(".", "list-iterator-test")
+			require.NoError(t, err)
+			d, err := MakeFileDepot(tempDir, depotOpts)
+			require.NoError(t, err)
+			return d, func() { assert.NoError(t, os.RemoveAll(tempDir)) }
+		},
+		"ChainedDepot": func(t *testing.T) (Depot, func()) {
+			localDir, err := ioutil.TempDir(".", "list-iterator-test")
+			require.NoError(t, err)
+			parentDir, err := ioutil.TempDir(".", "list-iterator-test")
+			require.NoError(t, err)
+			local, err := MakeFileDepot(localDir, depotOpts)
+			require.NoError(t, err)
+			parent, err := MakeFileDepot(parentDir, depotOpts)
+			require.NoError(t, err)
+			d, err := MakeChainedDepot(local, parent)
+			require.NoError(t, err)
+			return d, func() {
+				assert.NoError(t, os.RemoveAll(localDir))
+				assert.NoError(t, os.RemoveAll(parentDir))
+			}
+		},
+		"MongoDB": func(t *testing.T) (Depot, func()) {
+			d, err := NewMongoDBCertDepot(ctx, &MongoDBOptions{
+				MongoDBURI:     testMongoDBURI(),
+				DatabaseName:   "certDepot",
+				CollectionName: "list_iterator",
+				DepotOptions:   depotOpts,
+			})
+			require.NoError(t, err)
+			m := d.(*mongoDepot)
+			return d, func() {
+				assert.NoError(t, m.coll.(*mongo.Collection).Drop(ctx))
+				assert.NoError(t, m.metadataCollection().(*mongo.Collection).Drop(ctx))
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d, cleanup := makeDepot(t)
+			defer cleanup()
+
+			caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+			require.NoError(t, caOpts.Init(d))
+			for _, name := range []string{"web-1", "web-2", "db-1"} {
+				creds, err := d.Generate(name)
+				require.NoError(t, err)
+				require.NoError(t, d.Save(name, creds))
+			}
+			require.NoError(t, PutCredential(d, "web-3", CredentialCSR, []byte("csr")))
+			require.NoError(t, d.Put(ParamTag("web-4", "dhparam"), []byte("params")))
+			require.NoError(t, d.Put(ParamTag("web-4", "ecparam"), []byte("params")))
+
+			t.Run("ListsEveryEntryOnce", func(t *testing.T) {
+				iter, err := ListIterator(ctx, d, ListOptions{BatchSize: 2})
+				require.NoError(t, err)
+				entries := collect(t, iter)
+				assert.Equal(t, []string{"db-1", "root", "web-1", "web-2", "web-3", "web-4"}, names(entries))
+
+				for _, entry := range entries {
+					if entry.Name == "web-1" {
+						assert.WithinDuration(t, time.Now().Add(time.Hour), entry.Expiration, time.Minute)
+					}
+				}
+			})
+			t.Run("FiltersByPrefix", func(t *testing.T) {
+				iter, err := ListIterator(ctx, d, ListOptions{Prefix: "web-"})
+				require.NoError(t, err)
+				assert.Equal(t, []string{"web-1", "web-2", "web-3", "web-4"}, names(collect(t, iter)))
+			})
+			t.Run("StopsWithCanceledContext", func(t *testing.T) {
+				iter, err := ListIterator(ctx, d, ListOptions{})
+				require.NoError(t, err)
+				defer func() {
+					assert.NoError(t, iter.Close(ctx))
+				}()
+				cctx, cancel := context.WithCancel(ctx)
+				cancel()
+				assert.False(t, iter.Next(cctx))
+				assert.Error(t, iter.Err())
+			})
+			t.Run("RejectsInvalidOptions", func(t *testing.T) {
+				_, err := ListIterator(ctx, d, ListOptions{BatchSize: -1})
+				assert.Error(t, err)
+			})
+		})
+	}
+	t.Run("UnsupportedDepot", func(t *testing.T) {
+		d, err := NewStoreDepot(newMapStore(), DepotOptions{})
+		require.NoError(t, err)
+		_, err = ListIterator(ctx, d, ListOptions{})
+		assert.Error(t, err)
+	})
+}
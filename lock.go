@@ -0,0 +1,320 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// lockFileExtension is the extension of a lock file in a file depot.
+	lockFileExtension = ".lock"
+	// lockIDPrefix is prepended to the ID of a lock document in a mongo
+	// depot's metadata collection.
+	lockIDPrefix = "lock:"
+	// bootstrapLockName is the name of the lock held while bootstrapping a
+	// depot.
+	bootstrapLockName = "bootstrap"
+)
+
+var (
+	// BootstrapLockTTL is how long BootstrapDepot holds the bootstrap lock
+	// before other instances consider it abandoned.
+	BootstrapLockTTL = time.Minute
+	// bootstrapLockPollInterval is how often BootstrapDepot retries the
+	// bootstrap lock while another instance holds it.
+	bootstrapLockPollInterval = 100 * time.Millisecond
+)
+
+// Locker is implemented by depots that can hold an exclusive, named lock
+// shared by every process using the depot.
+type Locker interface {
+	// TryLock acquires the named lock for the owner if it is not held or
+	// if it has been held longer than the TTL, and returns whether it was
+	// acquired.
+	TryLock(name, owner string, ttl time.Duration) (bool, error)
+	// Unlock releases the named lock if it is held by the owner.
+	Unlock(name, owner string) error
+}
+
+// LockRenewer is implemented by Lockers that can extend the TTL of a lock
+// while it is held, so that a holder that runs longer than the TTL keeps the
+// lock.
+type LockRenewer interface {
+	// RenewLock extends the named lock to expire after the TTL if it is
+	// held by the owner, and returns whether it was.
+	RenewLock(name, owner string, ttl time.Duration) (bool, error)
+}
+
+// depotLock is the state of a lock.
+type depotLock struct {
+	ID        string    `bson:"_id,omitempty" json:"-"`
+	Owner     string    `bson:"owner" json:"owner"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// withLock runs the function while holding the named lock in the depot,
+// waiting for it until the context is done. If the depot does not implement
+// Locker, the function is run without a lock. If the depot implements
+// LockRenewer, the lock is renewed while the function runs; otherwise, or if
+// renewing fails, an error is returned once the function returns if it may
+// have run without holding the lock.
+func withLock(ctx context.Context, d Depot, name string, ttl time.Duration, fn func() error) error {
+	locker, ok := d.(Locker)
+	if !ok {
+		return fn()
+	}
+
+	ownerBytes := make([]byte, 16)
+	if _, err := rand.Read(ownerBytes); err != nil {
+		return errors.Wrap(err, "generating lock owner")
+	}
+	owner := hex.EncodeToString(ownerBytes)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "waiting for lock '%s'", name)
+		case <-timer.C:
+		}
+
+		acquired, err := locker.TryLock(name, owner, ttl)
+		if err != nil {
+			return errors.Wrapf(err, "acquiring lock '%s'", name)
+		}
+		if acquired {
+			break
+		}
+		timer.Reset(bootstrapLockPollInterval)
+	}
+
+	acquiredAt := time.Now()
+	stopRenewing := make(chan struct{})
+	renewErr := make(chan error, 1)
+	if renewer, ok := locker.(LockRenewer); ok && ttl > 0 {
+		go func() {
+			renewErr <- renewLock(renewer, name, owner, ttl, stopRenewing)
+		}()
+	} else {
+		renewErr <- nil
+	}
+
+	fnErr := fn()
+	close(stopRenewing)
+	lostErr := <-renewErr
+	if lostErr == nil {
+		if _, ok := locker.(LockRenewer); (!ok || ttl <= 0) && time.Since(acquiredAt) > ttl {
+			lostErr = errors.Errorf("held lock '%s' longer than its TTL of %s", name, ttl)
+		}
+	}
+	if err := locker.Unlock(name, owner); err != nil && lostErr == nil {
+		lostErr = errors.Wrapf(err, "releasing lock '%s'", name)
+	}
+
+	if fnErr != nil {
+		return fnErr
+	}
+	return lostErr
+}
+
+// renewLock renews the lock held by the owner a few times per TTL until stop
+// is closed, and returns an error if the lock could not be renewed before it
+// expired.
+func renewLock(renewer LockRenewer, name, owner string, ttl time.Duration, stop <-chan struct{}) error {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		renewed, err := renewer.RenewLock(name, owner, ttl)
+		if err != nil {
+			return errors.Wrapf(err, "renewing lock '%s'", name)
+		}
+		if !renewed {
+			return errors.Errorf("lost lock '%s' while it was held", name)
+		}
+	}
+}
+
+// TryLock acquires the named lock by exclusively creating a lock file in the
+// depot's directory. An expired lock file is atomically replaced, and the lock
+// is only acquired if the owner is still the one in the lock file afterward,
+// since another process may have replaced it at the same time.
+func (fd *fileDepot) TryLock(name, owner string, ttl time.Duration) (bool, error) {
+	data, err := json.Marshal(depotLock{Owner: owner, ExpiresAt: time.Now().Add(ttl)})
+	if err != nil {
+		return false, errors.Wrap(err, "marshalling lock")
+	}
+	if err = os.MkdirAll(fd.dir, 0755); err != nil {
+		return false, errors.Wrap(err, "creating directory")
+	}
+
+	file, err := os.OpenFile(fd.lockPath(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		_, err = file.Write(data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err == nil, errors.Wrap(err, "writing lock file")
+	}
+	if !os.IsExist(err) {
+		return false, errors.Wrap(err, "creating lock file")
+	}
+
+	current, err := fd.readLock(name)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if current != nil && time.Now().Before(current.ExpiresAt) {
+		return false, nil
+	}
+	// The lock was abandoned, so take it over.
+	if err = writeFileAtomic(fd.dir, lockFileName(name), data); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	current, err = fd.readLock(name)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return current != nil && current.Owner == owner, nil
+}
+
+// RenewLock rewrites the lock file with the new expiration if it is held by
+// the owner.
+func (fd *fileDepot) RenewLock(name, owner string, ttl time.Duration) (bool, error) {
+	current, err := fd.readLock(name)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if current == nil || current.Owner != owner {
+		return false, nil
+	}
+
+	data, err := json.Marshal(depotLock{Owner: owner, ExpiresAt: time.Now().Add(ttl)})
+	if err != nil {
+		return false, errors.Wrap(err, "marshalling lock")
+	}
+	if err = writeFileAtomic(fd.dir, lockFileName(name), data); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	current, err = fd.readLock(name)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return current != nil && current.Owner == owner, nil
+}
+
+// Unlock removes the lock file if it is held by the owner.
+func (fd *fileDepot) Unlock(name, owner string) error {
+	current, err := fd.readLock(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if current == nil || current.Owner != owner {
+		return nil
+	}
+
+	err = os.Remove(fd.lockPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing lock file")
+	}
+
+	return nil
+}
+
+func (fd *fileDepot) lockPath(name string) string {
+	return filepath.Join(fd.dir, lockFileName(name))
+}
+
+func lockFileName(name string) string {
+	return "." + name + lockFileExtension
+}
+
+// readLock returns the lock in the lock file, or nil if there is no lock file.
+// A lock file that cannot be parsed, such as one whose owner crashed while
+// writing it, is treated as expired.
+func (fd *fileDepot) readLock(name string) (*depotLock, error) {
+	data, err := ioutil.ReadFile(fd.lockPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading lock file")
+	}
+
+	lock := &depotLock{}
+	if err = json.Unmarshal(data, lock); err != nil {
+		return &depotLock{}, nil
+	}
+
+	return lock, nil
+}
+
+// TryLock acquires the named lock by inserting a lock document into the
+// depot's metadata collection, or by taking over an expired one.
+func (m *mongoDepot) TryLock(name, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	lock := depotLock{ID: lockIDPrefix + name, Owner: owner, ExpiresAt: now.Add(ttl)}
+
+	insertCtx, insertCancel := m.writeContext()
+	defer insertCancel()
+	_, err := m.metadataCollection().InsertOne(insertCtx, lock)
+	if err == nil {
+		return true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return false, errors.Wrap(err, "inserting lock")
+	}
+
+	updateCtx, updateCancel := m.writeContext()
+	defer updateCancel()
+	res, err := m.metadataCollection().UpdateOne(updateCtx,
+		bson.M{"_id": lock.ID, "expires_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"owner": owner, "expires_at": lock.ExpiresAt}})
+	if err != nil {
+		return false, errors.Wrap(err, "taking over expired lock")
+	}
+
+	return res.ModifiedCount == 1, nil
+}
+
+// RenewLock extends the lock document if it is held by the owner.
+func (m *mongoDepot) RenewLock(name, owner string, ttl time.Duration) (bool, error) {
+	ctx, cancel := m.writeContext()
+	defer cancel()
+
+	res, err := m.metadataCollection().UpdateOne(ctx,
+		bson.M{"_id": lockIDPrefix + name, "owner": owner},
+		bson.M{"$set": bson.M{"expires_at": time.Now().Add(ttl)}})
+	if err != nil {
+		return false, errors.Wrap(err, "renewing lock")
+	}
+
+	return res.MatchedCount == 1, nil
+}
+
+// Unlock deletes the lock document if it is held by the owner.
+func (m *mongoDepot) Unlock(name, owner string) error {
+	ctx, cancel := m.writeContext()
+	defer cancel()
+
+	_, err := m.metadataCollection().DeleteOne(ctx, bson.M{"_id": lockIDPrefix + name, "owner": owner})
+	return errors.Wrap(err, "deleting lock")
+}
@@ -0,0 +1,98 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nonRenewingDepot is a depot that implements Locker but not LockRenewer.
+type nonRenewingDepot struct {
+	Depot
+	locker Locker
+}
+
+func (d *nonRenewingDepot) TryLock(name, owner string, ttl time.Duration) (bool, error) {
+	return d.locker.TryLock(name, owner, ttl)
+}
+
+func (d *nonRenewingDepot) Unlock(name, owner string) error {
+	return d.locker.Unlock(name, owner)
+}
+
+func TestWithLock(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "with-lock-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	fd, err := NewFileDepot(tempDir)
+	require.NoError(t, err)
+	d := &nonRenewingDepot{Depot: fd, locker: fd.(Locker)}
+
+	t.Run("FailsWhenHeldPastTTL", func(t *testing.T) {
+		err := withLock(context.Background(), d, "slow", 20*time.Millisecond, func() error {
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+		assert.Error(t, err)
+	})
+	t.Run("SucceedsWithinTTL", func(t *testing.T) {
+		assert.NoError(t, withLock(context.Background(), d, "fast", time.Minute, func() error { return nil }))
+	})
+}
+
+func TestBootstrapDepotConcurrently(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "bootstrap-lock-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	conf := BootstrapDepotConfig{
+		FileDepot:   tempDir,
+		CAName:      "root",
+		ServiceName: "localhost",
+		CAOpts: &CertificateOptions{
+			CommonName: "root",
+			Expires:    time.Hour,
+		},
+		ServiceOpts: &CertificateOptions{
+			CommonName: "localhost",
+			Host:       "localhost",
+			CA:         "root",
+			Expires:    time.Hour,
+		},
+	}
+
+	const instances = 5
+	cas := make([][]byte, instances)
+	errs := make([]error, instances)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < instances; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d, err := BootstrapDepot(context.Background(), conf)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			cas[i], errs[i] = d.Get(CrtTag("root"))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < instances; i++ {
+		require.NoError(t, errs[i])
+		assert.Equal(t, cas[0], cas[i])
+	}
+	_, err = os.Stat(filepath.Join(tempDir, "."+bootstrapLockName+lockFileExtension))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,482 @@
+package certdepot
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+const (
+	// manifestName is the reserved name the manifest is stored under in
+	// the depot.
+	manifestName = "certdepot-manifest"
+	// manifestParam is the parameter that holds the manifest.
+	manifestParam = "manifest"
+)
+
+// ManifestLockTTL is how long a manifest depot holds the manifest lock while
+// updating the manifest before other processes consider it abandoned.
+var ManifestLockTTL = time.Minute
+
+// depotManifest is the hash of every entry in a depot, signed by an operator
+// key.
+type depotManifest struct {
+	// Entries maps each entry, as "<kind>/<name>", to the hex-encoded
+	// SHA-256 hash of its data.
+	Entries   map[string]string `json:"entries"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	// Signature is the signature of the JSON encoding of the manifest
+	// without the signature.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// manifestTag returns the tag the manifest is stored under.
+func manifestTag() *depot.Tag { return ParamTag(manifestName, manifestParam) }
+
+// manifestEntryKey returns the key of the entry for the tag in a manifest.
+func manifestEntryKey(tag *depot.Tag) (string, error) {
+	name, kind, err := ParseTag(tag)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(kind) + "/" + name, nil
+}
+
+// parseManifestEntryKey returns the tag for the key of an entry in a
+// manifest.
+func parseManifestEntryKey(key string) (*depot.Tag, error) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid manifest entry '%s'", key)
+	}
+	return CredentialKind(parts[0]).Tag(parts[1])
+}
+
+func hashManifestEntry(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// payload returns the data the manifest's signature is computed over.
+func (m *depotManifest) payload() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	data, err := json.Marshal(unsigned)
+	return data, errors.Wrap(err, "marshalling manifest")
+}
+
+func (m *depotManifest) sign(signer crypto.Signer) error {
+	payload, err := m.payload()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		m.Signature, err = signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(payload)
+		m.Signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+
+	return errors.Wrap(err, "signing manifest")
+}
+
+func (m *depotManifest) verify(pub crypto.PublicKey) error {
+	payload, err := m.payload()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	digest := sha256.Sum256(payload)
+
+	var valid bool
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], m.Signature) == nil
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(key, digest[:], m.Signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, payload, m.Signature)
+	default:
+		return errors.Errorf("unsupported public key type %T", pub)
+	}
+	if !valid {
+		return errors.New("manifest signature is invalid")
+	}
+
+	return nil
+}
+
+// getManifest returns the manifest stored in the depot, or nil if there is
+// none.
+func getManifest(wd Depot) (*depotManifest, error) {
+	data, exists, err := GetIfExists(wd, manifestTag())
+	if err != nil {
+		return nil, errors.Wrap(err, "getting manifest")
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	m := &depotManifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling manifest")
+	}
+	if m.Entries == nil {
+		m.Entries = map[string]string{}
+	}
+
+	return m, nil
+}
+
+// hashDepotEntries returns the hash of the data for every name and
+// credential kind in the depot, by manifest entry key. Parameters cannot be
+// enumerated, so they are not included. The depot must implement NameLister.
+func hashDepotEntries(wd Depot) (map[string]string, error) {
+	lister, ok := wd.(NameLister)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not support listing entries", wd)
+	}
+	names, err := lister.ListNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing depot entries")
+	}
+
+	entries := map[string]string{}
+	for _, name := range names {
+		if name == manifestName {
+			continue
+		}
+		for _, kind := range CredentialKinds {
+			tag, err := kind.Tag(name)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			data, exists, err := GetIfExists(wd, tag)
+			if err != nil {
+				return nil, errors.Wrapf(err, "getting %s for '%s'", kind, name)
+			}
+			if exists {
+				entries[string(kind)+"/"+name] = hashManifestEntry(data)
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// manifestDepot is a Depot that maintains a signed manifest of its entries.
+type manifestDepot struct {
+	inner  Depot
+	signer crypto.Signer
+	mu     sync.Mutex
+}
+
+// NewManifestDepot returns a handle to the depot that records the hash of
+// every entry in a manifest signed by the operator key whenever an entry is
+// put or deleted through it, so that changes made to the depot by other means,
+// such as editing the files of a file depot or the documents of a MongoDB
+// depot directly, can be detected with VerifyManifest. If the depot has no
+// manifest, one is created from its current entries, which requires the depot
+// to implement NameLister unless it is empty.
+//
+// Every mutation rewrites the whole manifest, so manifests are intended for
+// depots of modest size.
+func NewManifestDepot(inner Depot, signer crypto.Signer) (Depot, error) {
+	if inner == nil {
+		return nil, errors.New("must specify depot")
+	}
+	if signer == nil {
+		return nil, errors.New("must specify signing key")
+	}
+
+	md := &manifestDepot{inner: inner, signer: signer}
+	existing, err := getManifest(inner)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if existing != nil {
+		return md, nil
+	}
+
+	err = md.updateManifest(func(m *depotManifest, created bool) error {
+		if !created {
+			return nil
+		}
+		if _, ok := inner.(NameLister); !ok {
+			return nil
+		}
+		entries, err := hashDepotEntries(inner)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		m.Entries = entries
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing manifest")
+	}
+
+	return md, nil
+}
+
+// updateManifest applies the update to the stored manifest and signs and
+// stores the result while holding the manifest lock. The update is told
+// whether the manifest is being created.
+func (md *manifestDepot) updateManifest(update func(m *depotManifest, created bool) error) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	return withLock(context.Background(), md.inner, manifestName, ManifestLockTTL, func() error {
+		m, err := getManifest(md.inner)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		created := m == nil
+		if created {
+			m = &depotManifest{Entries: map[string]string{}}
+		}
+		if err = update(m, created); err != nil {
+			return errors.WithStack(err)
+		}
+
+		m.UpdatedAt = time.Now().UTC()
+		if err = m.sign(md.signer); err != nil {
+			return errors.WithStack(err)
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return errors.Wrap(err, "marshalling manifest")
+		}
+		if err = deleteIfExists(md.inner, manifestTag()); err != nil {
+			return errors.Wrap(err, "deleting old manifest")
+		}
+
+		return errors.Wrap(md.inner.Put(manifestTag(), data), "saving manifest")
+	})
+}
+
+// isManifest returns whether the tag is for the manifest itself, which cannot
+// be changed through the depot.
+func isManifest(tag *depot.Tag) bool { return getNameFromTag(tag) == manifestName }
+
+func (md *manifestDepot) Put(tag *depot.Tag, data []byte) error {
+	if isManifest(tag) {
+		return errors.New("cannot modify the manifest directly")
+	}
+	key, err := manifestEntryKey(tag)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = md.inner.Put(tag, data); err != nil {
+		return err
+	}
+
+	return errors.Wrap(md.updateManifest(func(m *depotManifest, _ bool) error {
+		m.Entries[key] = hashManifestEntry(data)
+		return nil
+	}), "updating manifest")
+}
+
+func (md *manifestDepot) Delete(tag *depot.Tag) error {
+	if isManifest(tag) {
+		return errors.New("cannot modify the manifest directly")
+	}
+	key, err := manifestEntryKey(tag)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = md.inner.Delete(tag); err != nil {
+		return err
+	}
+
+	return errors.Wrap(md.updateManifest(func(m *depotManifest, _ bool) error {
+		delete(m.Entries, key)
+		return nil
+	}), "updating manifest")
+}
+
+func (md *manifestDepot) Check(tag *depot.Tag) bool { return md.inner.Check(tag) }
+func (md *manifestDepot) CheckWithError(tag *depot.Tag) (bool, error) {
+	return md.inner.CheckWithError(tag)
+}
+func (md *manifestDepot) Get(tag *depot.Tag) ([]byte, error) { return md.inner.Get(tag) }
+func (md *manifestDepot) GetIfExists(tag *depot.Tag) ([]byte, bool, error) {
+	return GetIfExists(md.inner, tag)
+}
+
+func (md *manifestDepot) Save(name string, creds *Credentials) error {
+	return depotSave(md, name, creds)
+}
+
+func (md *manifestDepot) Find(name string) (*Credentials, error) { return md.inner.Find(name) }
+
+func (md *manifestDepot) Generate(name string) (*Credentials, error) {
+	return depotGenerateDefault(md, name, md.DepotOptions())
+}
+
+func (md *manifestDepot) GenerateWithOptions(opts CertificateOptions) (*Credentials, error) {
+	return depotGenerate(md, opts.CommonName, md.DepotOptions(), opts)
+}
+
+// DepotOptions returns the inner depot's options.
+func (md *manifestDepot) DepotOptions() DepotOptions { return getDepotOptions(md.inner) }
+
+// ListNames returns the names in the inner depot, which must implement
+// NameLister, without the manifest.
+func (md *manifestDepot) ListNames() ([]string, error) {
+	lister, ok := md.inner.(NameLister)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not support listing entries", md.inner)
+	}
+	names, err := lister.ListNames()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	filtered := names[:0]
+	for _, name := range names {
+		if name != manifestName {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered, nil
+}
+
+// PutTTL sets when the credentials for the name expire in the inner depot, if
+// it tracks expiration. TTLs are not covered by the manifest.
+func (md *manifestDepot) PutTTL(name string, expiration time.Time) error {
+	return putTTL(md.inner, name, expiration)
+}
+
+func (md *manifestDepot) tracker() (ExpiryTracker, error) {
+	tracker, ok := md.inner.(ExpiryTracker)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not support expiration", md.inner)
+	}
+	return tracker, nil
+}
+
+func (md *manifestDepot) GetTTL(name string) (time.Time, error) {
+	tracker, err := md.tracker()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return tracker.GetTTL(name)
+}
+
+func (md *manifestDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
+	tracker, err := md.tracker()
+	if err != nil {
+		return nil, err
+	}
+	return tracker.FindExpiresBefore(cutoff)
+}
+
+// DeleteExpiresBefore removes the expired entries from the inner depot and
+// the manifest.
+func (md *manifestDepot) DeleteExpiresBefore(cutoff time.Time) error {
+	tracker, err := md.tracker()
+	if err != nil {
+		return err
+	}
+	users, err := tracker.FindExpiresBefore(cutoff)
+	if err != nil {
+		return errors.Wrap(err, "finding expired entries")
+	}
+	if err = tracker.DeleteExpiresBefore(cutoff); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.Wrap(md.updateManifest(func(m *depotManifest, _ bool) error {
+		for _, u := range users {
+			for key := range m.Entries {
+				tag, err := parseManifestEntryKey(key)
+				if err == nil && getNameFromTag(tag) == u.ID {
+					delete(m.Entries, key)
+				}
+			}
+		}
+		return nil
+	}), "updating manifest")
+}
+
+// VerifyManifest checks that the manifest stored in the depot is signed by
+// the operator's public key and that every entry in the depot matches it.
+// Entries that were modified or removed since they were recorded are reported,
+// as are certificates, keys, and other credentials that are not in the
+// manifest if the depot implements NameLister.
+func VerifyManifest(wd Depot, pub crypto.PublicKey) error {
+	if md, ok := wd.(*manifestDepot); ok {
+		wd = md.inner
+	}
+
+	m, err := getManifest(wd)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if m == nil {
+		return errors.New("depot has no manifest")
+	}
+	if err = m.verify(pub); err != nil {
+		return errors.WithStack(err)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	keys := make([]string, 0, len(m.Entries))
+	for key := range m.Entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tag, err := parseManifestEntryKey(key)
+		if err != nil {
+			catcher.Add(err)
+			continue
+		}
+		data, exists, err := GetIfExists(wd, tag)
+		if err != nil {
+			catcher.Wrapf(err, "getting entry '%s'", key)
+			continue
+		}
+		if !exists {
+			catcher.Errorf("entry '%s' was removed", key)
+			continue
+		}
+		if hashManifestEntry(data) != m.Entries[key] {
+			catcher.Errorf("entry '%s' was modified", key)
+		}
+	}
+
+	if _, ok := wd.(NameLister); ok {
+		current, err := hashDepotEntries(wd)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		added := []string{}
+		for key := range current {
+			if _, ok := m.Entries[key]; !ok {
+				added = append(added, key)
+			}
+		}
+		sort.Strings(added)
+		for _, key := range added {
+			catcher.Errorf("entry '%s' is not in the manifest", key)
+		}
+	}
+
+	return catcher.Resolve()
+}
@@ -0,0 +1,124 @@
+package certdepot
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// memoryStore is a CredentialStore that keeps its data in memory.
+type memoryStore struct {
+	mu   sync.RWMutex
+	data map[CredentialKind]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: map[CredentialKind]map[string][]byte{}}
+}
+
+func (s *memoryStore) Get(name string, kind CredentialKind) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.data[kind][name]
+	if !ok {
+		return nil, errors.Errorf("%s for '%s' not found", kind, name)
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (s *memoryStore) Put(name string, kind CredentialKind, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data[kind] == nil {
+		s.data[kind] = map[string][]byte{}
+	}
+	s.data[kind][name] = append([]byte{}, data...)
+	return nil
+}
+
+func (s *memoryStore) Check(name string, kind CredentialKind) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.data[kind][name]
+	return ok, nil
+}
+
+func (s *memoryStore) Delete(name string, kind CredentialKind) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[kind][name]; !ok {
+		return errors.Errorf("%s for '%s' not found", kind, name)
+	}
+	delete(s.data[kind], name)
+	return nil
+}
+
+// ListNames returns the names of all entries in the store.
+func (s *memoryStore) ListNames() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[string]bool{}
+	names := []string{}
+	for kind, entries := range s.data {
+		for name := range entries {
+			tag, err := kind.Tag(name)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			name = getNameFromTag(tag)
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// NewMemoryDepot returns a depot that keeps its data in memory, such as for
+// tests that should not touch the disk or a database. Its data is lost when
+// it is garbage collected.
+func NewMemoryDepot(opts DepotOptions) (Depot, error) {
+	return NewStoreDepot(newMemoryStore(), opts)
+}
+
+// BootstrapInMemory creates an in-memory depot with a CA and service
+// certificate, as BootstrapDepot does, and returns it along with the CA's
+// credentials, so that test harnesses can create a complete PKI per test
+// without touching the disk or a database. The configuration must not
+// specify a file, mongo, or Kubernetes depot.
+func BootstrapInMemory(conf BootstrapDepotConfig) (Depot, *Credentials, error) {
+	if conf.FileDepot != "" || (conf.MongoDepot != nil && !conf.MongoDepot.IsZero()) || !conf.KubernetesDepot.IsZero() {
+		return nil, nil, errors.New("cannot specify a depot configuration for an in-memory depot")
+	}
+	if err := conf.validateCertificates(); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid configuration")
+	}
+
+	opts := DepotOptions{CA: conf.CAName}
+	if conf.ServiceOpts != nil {
+		opts.DefaultExpiration = conf.ServiceOpts.Expires
+	}
+	d, err := NewMemoryDepot(opts)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "creating depot")
+	}
+	if _, err = bootstrapDepot(d, conf); err != nil {
+		return nil, nil, errors.Wrap(err, "bootstrapping depot")
+	}
+	ca, err := d.Find(conf.CAName)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "finding CA credentials")
+	}
+
+	return d, ca, nil
+}
@@ -0,0 +1,88 @@
+package certdepot
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDepot(t *testing.T) {
+	d, err := NewMemoryDepot(DepotOptions{})
+	require.NoError(t, err)
+
+	data := []byte("data")
+	require.NoError(t, d.Put(CrtTag("alice"), data))
+	require.NoError(t, d.Put(ParamTag("bob", "dhparam"), data))
+	data[0] = 'D'
+	stored, err := d.Get(CrtTag("alice"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), stored)
+	assert.True(t, d.Check(CrtTag("alice")))
+	assert.False(t, d.Check(PrivKeyTag("alice")))
+
+	names, err := d.(NameLister).ListNames()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, names)
+
+	require.NoError(t, d.Delete(CrtTag("alice")))
+	assert.False(t, d.Check(CrtTag("alice")))
+	assert.Error(t, d.Delete(CrtTag("alice")))
+	_, err = d.Get(CrtTag("alice"))
+	assert.Error(t, err)
+}
+
+func TestBootstrapInMemory(t *testing.T) {
+	conf := BootstrapDepotConfig{
+		CAName:      "root",
+		ServiceName: "service",
+		CAOpts: &CertificateOptions{
+			CommonName: "root",
+			Expires:    time.Hour,
+		},
+		ServiceOpts: &CertificateOptions{
+			CA:         "root",
+			CommonName: "service",
+			Host:       "service",
+			Expires:    time.Hour,
+		},
+	}
+
+	t.Run("CreatesPKI", func(t *testing.T) {
+		d, ca, err := BootstrapInMemory(conf)
+		require.NoError(t, err)
+		assert.Equal(t, "root", ca.ServerName)
+		assert.NotEmpty(t, ca.Key)
+		assert.True(t, CheckCertificate(d, "service"))
+
+		pool := x509.NewCertPool()
+		require.True(t, pool.AppendCertsFromPEM(ca.Cert))
+		creds, err := d.Generate("alice")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("alice", creds))
+		crt, err := getRawCertificate(d, "alice")
+		require.NoError(t, err)
+		_, err = crt.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+		assert.NoError(t, err)
+	})
+	t.Run("CreatesSeparatePKIs", func(t *testing.T) {
+		_, ca1, err := BootstrapInMemory(conf)
+		require.NoError(t, err)
+		_, ca2, err := BootstrapInMemory(conf)
+		require.NoError(t, err)
+		assert.NotEqual(t, ca1.Cert, ca2.Cert)
+	})
+	t.Run("RejectsDepotConfiguration", func(t *testing.T) {
+		withFileDepot := conf
+		withFileDepot.FileDepot = "depot"
+		_, _, err := BootstrapInMemory(withFileDepot)
+		assert.Error(t, err)
+
+		withoutService := conf
+		withoutService.ServiceName = ""
+		_, _, err = BootstrapInMemory(withoutService)
+		assert.Error(t, err)
+	})
+}
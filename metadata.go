@@ -0,0 +1,193 @@
+package certdepot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// depotOptionsFileName is the name of the file in a file depot's
+	// directory that holds its persisted DepotOptions.
+	depotOptionsFileName = "depot_options.json"
+	// depotMetadataCollectionSuffix is appended to the name of a mongo
+	// depot's collection to get the name of the collection that holds its
+	// metadata.
+	depotMetadataCollectionSuffix = ".metadata"
+	// depotOptionsID is the ID of the metadata document that holds a mongo
+	// depot's persisted DepotOptions.
+	depotOptionsID = "depot_options"
+)
+
+// depotOptionsDocument is the mongo metadata document for DepotOptions.
+type depotOptionsDocument struct {
+	ID           string `bson:"_id"`
+	DepotOptions `bson:",inline"`
+}
+
+// withDefaults returns the options with any unset fields filled in from the
+// defaults.
+func (opts DepotOptions) withDefaults(defaults DepotOptions) DepotOptions {
+	if opts.CA == "" {
+		opts.CA = defaults.CA
+	}
+	if opts.DefaultExpiration == 0 {
+		opts.DefaultExpiration = defaults.DefaultExpiration
+	}
+	if opts.TrustedCAs == nil {
+		opts.TrustedCAs = defaults.TrustedCAs
+	}
+	if opts.IssuanceApprover == nil {
+		opts.IssuanceApprover = defaults.IssuanceApprover
+	}
+	if opts.Signer == nil {
+		opts.Signer = defaults.Signer
+	}
+	if opts.Attestor == nil {
+		opts.Attestor = defaults.Attestor
+	}
+	if !opts.StrictCrypto {
+		opts.StrictCrypto = defaults.StrictCrypto
+	}
+	if !opts.FIPS {
+		opts.FIPS = defaults.FIPS
+	}
+	if opts.PreviousGracePeriod == 0 {
+		opts.PreviousGracePeriod = defaults.PreviousGracePeriod
+	}
+	if !opts.VerifyOnFind {
+		opts.VerifyOnFind = defaults.VerifyOnFind
+	}
+	if opts.AdditionalRoots == "" {
+		opts.AdditionalRoots = defaults.AdditionalRoots
+	}
+	if !opts.DeleteCSRAfterSign {
+		opts.DeleteCSRAfterSign = defaults.DeleteCSRAfterSign
+	}
+	if !opts.StrictPEM {
+		opts.StrictPEM = defaults.StrictPEM
+	}
+	if opts.DomainTemplate == "" {
+		opts.DomainTemplate = defaults.DomainTemplate
+	}
+	if opts.URITemplate == "" {
+		opts.URITemplate = defaults.URITemplate
+	}
+
+	return opts
+}
+
+// SaveDepotOptions persists the options in the depot, if the depot implements
+// DepotOptionsSaver, so that they are loaded the next time the depot is
+// opened. The IssuanceApprover, Signer, and Attestor are never persisted.
+func SaveDepotOptions(wd Depot, opts DepotOptions) error {
+	saver, ok := wd.(DepotOptionsSaver)
+	if !ok {
+		return errors.Errorf("depot of type %T cannot persist depot options", wd)
+	}
+
+	return errors.Wrap(saver.SaveDepotOptions(opts), "saving depot options")
+}
+
+// SaveDepotOptions persists the options in a metadata file in the depot's
+// directory and uses them for subsequent operations.
+func (fd *fileDepot) SaveDepotOptions(opts DepotOptions) error {
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return errors.Wrap(err, "marshalling depot options")
+	}
+
+	if err = writeFileAtomic(fd.dir, depotOptionsFileName, data); err != nil {
+		return errors.Wrap(err, "writing depot options file")
+	}
+
+	fd.opts = opts
+	return nil
+}
+
+// writeFileAtomic replaces the contents of the named file in the directory by
+// renaming a temporary file over it, so readers never see a partial write.
+func writeFileAtomic(dir, name string, data []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "creating directory")
+	}
+	tmpFile, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return errors.Wrap(err, "creating temporary file")
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "writing temporary file")
+	}
+	if err = tmpFile.Close(); err != nil {
+		return errors.Wrap(err, "closing temporary file")
+	}
+	if err = os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return errors.Wrap(err, "setting file permissions")
+	}
+
+	return errors.Wrap(os.Rename(tmpFile.Name(), filepath.Join(dir, name)), "replacing file")
+}
+
+// loadDepotOptions reads the options persisted in the depot's directory, if
+// there are any.
+func (fd *fileDepot) loadDepotOptions() (DepotOptions, error) {
+	opts := DepotOptions{}
+	data, err := ioutil.ReadFile(filepath.Join(fd.dir, depotOptionsFileName))
+	if os.IsNotExist(err) {
+		return opts, nil
+	}
+	if err != nil {
+		return opts, errors.Wrap(err, "reading depot options file")
+	}
+
+	return opts, errors.Wrap(json.Unmarshal(data, &opts), "unmarshalling depot options")
+}
+
+// SaveDepotOptions persists the options in a metadata document in the depot's
+// metadata collection and uses them for subsequent operations.
+func (m *mongoDepot) SaveDepotOptions(opts DepotOptions) error {
+	ctx, cancel := m.writeContext()
+	defer cancel()
+
+	_, err := m.metadataCollection().ReplaceOne(ctx,
+		bson.M{"_id": depotOptionsID},
+		depotOptionsDocument{ID: depotOptionsID, DepotOptions: opts},
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		return errors.Wrap(err, "saving depot options to the database")
+	}
+
+	m.opts = opts
+	return nil
+}
+
+// loadDepotOptions reads the options persisted in the depot's metadata
+// collection, if there are any.
+func (m *mongoDepot) loadDepotOptions() (DepotOptions, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
+	doc := depotOptionsDocument{}
+	err := m.metadataCollection().FindOne(ctx, bson.M{"_id": depotOptionsID}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return DepotOptions{}, nil
+	}
+	if err != nil {
+		return DepotOptions{}, errors.Wrap(err, "finding depot options in the database")
+	}
+
+	return doc.DepotOptions, nil
+}
+
+func (m *mongoDepot) metadataCollection() MongoDBCollection {
+	return m.metadataColl
+}
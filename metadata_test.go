@@ -0,0 +1,110 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDepotOptions(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "metadata-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	getOpts := func(t *testing.T, d Depot) DepotOptions {
+		dog, ok := d.(DepotOptionsGetter)
+		require.True(t, ok)
+		return dog.DepotOptions()
+	}
+
+	t.Run("NewFileDepotWithoutMetadataHasNoOptions", func(t *testing.T) {
+		d, err := NewFileDepot(tempDir)
+		require.NoError(t, err)
+		assert.Zero(t, getOpts(t, d))
+	})
+	t.Run("SaveDepotOptionsPersists", func(t *testing.T) {
+		d, err := NewFileDepot(tempDir)
+		require.NoError(t, err)
+		opts := DepotOptions{
+			CA:                "root",
+			DefaultExpiration: time.Hour,
+			TrustedCAs:        []string{"external"},
+			IssuanceApprover: IssuanceApproverFunc(func(context.Context, IssuanceRequest) error {
+				return nil
+			}),
+		}
+		require.NoError(t, SaveDepotOptions(d, opts))
+		assert.Equal(t, "root", getOpts(t, d).CA)
+
+		reopened, err := NewFileDepot(tempDir)
+		require.NoError(t, err)
+		persisted := getOpts(t, reopened)
+		assert.Equal(t, "root", persisted.CA)
+		assert.Equal(t, time.Hour, persisted.DefaultExpiration)
+		assert.Equal(t, []string{"external"}, persisted.TrustedCAs)
+		assert.Nil(t, persisted.IssuanceApprover)
+		names, err := reopened.(NameLister).ListNames()
+		require.NoError(t, err)
+		assert.Empty(t, names)
+	})
+	t.Run("MakeFileDepotPrefersExplicitOptions", func(t *testing.T) {
+		d, err := MakeFileDepot(tempDir, DepotOptions{CA: "other"})
+		require.NoError(t, err)
+		opts := getOpts(t, d)
+		assert.Equal(t, "other", opts.CA)
+		assert.Equal(t, time.Hour, opts.DefaultExpiration)
+	})
+	t.Run("FailsWithInvalidMetadata", func(t *testing.T) {
+		dir, err := ioutil.TempDir(".", "metadata-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(dir))
+		}()
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, depotOptionsFileName), []byte("{"), 0644))
+
+		_, err = NewFileDepot(dir)
+		assert.Error(t, err)
+	})
+	t.Run("BootstrappedDepotCanGenerate", func(t *testing.T) {
+		dir, err := ioutil.TempDir(".", "metadata-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(dir))
+		}()
+
+		_, err = BootstrapDepot(context.TODO(), BootstrapDepotConfig{
+			FileDepot: dir,
+			CAName:    "root",
+			CAOpts: &CertificateOptions{
+				CommonName: "root",
+				Expires:    time.Hour,
+			},
+			ServiceName: "localhost",
+			ServiceOpts: &CertificateOptions{
+				CommonName: "localhost",
+				Host:       "localhost",
+				CA:         "root",
+				Expires:    time.Minute,
+			},
+		})
+		require.NoError(t, err)
+
+		d, err := NewFileDepot(dir)
+		require.NoError(t, err)
+		opts := getOpts(t, d)
+		assert.Equal(t, "root", opts.CA)
+		assert.Equal(t, time.Minute, opts.DefaultExpiration)
+
+		creds, err := d.Generate("alice")
+		require.NoError(t, err)
+		assert.NoError(t, creds.Validate())
+	})
+}
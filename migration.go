@@ -0,0 +1,238 @@
+package certdepot
+
+import (
+	"context"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CurrentUserSchemaVersion is the schema version of the user documents
+// written by this version of the package.
+const CurrentUserSchemaVersion = 1
+
+// userMigration migrates user documents from the previous schema version to
+// its version.
+type userMigration struct {
+	version     int
+	description string
+	// update returns the update that migrates the document, or nil if only
+	// the document's schema version needs to be set.
+	update func(doc bson.Raw) (bson.M, error)
+}
+
+// userMigrations are the migrations to every schema version after 0, in
+// order. Schema changes add a migration here and increment
+// CurrentUserSchemaVersion.
+var userMigrations = []userMigration{
+	{
+		version:     1,
+		description: "record the schema version of each document",
+	},
+}
+
+// SchemaMigrationOptions configure how documents are migrated to the current
+// schema version.
+type SchemaMigrationOptions struct {
+	// BatchSize is the number of documents read from the database at a
+	// time. It defaults to 1000.
+	BatchSize int `bson:"batch_size,omitempty" json:"batch_size,omitempty" yaml:"batch_size,omitempty"`
+	// BatchInterval is how long to wait between batches, so that migrating
+	// a large collection does not starve other clients of the database.
+	BatchInterval time.Duration `bson:"batch_interval,omitempty" json:"batch_interval,omitempty" yaml:"batch_interval,omitempty"`
+	// MaxDocuments is the maximum number of documents migrated in this
+	// run, so that a large collection can be migrated over several runs.
+	// If zero, every document is migrated.
+	MaxDocuments int `bson:"max_documents,omitempty" json:"max_documents,omitempty" yaml:"max_documents,omitempty"`
+	// WorkerPoolOptions configure how many documents in each batch are
+	// migrated at once.
+	WorkerPoolOptions `bson:",inline" json:",inline" yaml:",inline"`
+}
+
+// Validate checks that the options are valid and sets defaults.
+func (opts *SchemaMigrationOptions) Validate() error {
+	scan := opts.scanOptions()
+	if err := scan.Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+	opts.BatchSize = scan.BatchSize
+	if err := opts.WorkerPoolOptions.Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// scanOptions returns the options for paging through the documents to
+// migrate.
+func (opts SchemaMigrationOptions) scanOptions() ExpiryScanOptions {
+	return ExpiryScanOptions{
+		BatchSize:     opts.BatchSize,
+		BatchInterval: opts.BatchInterval,
+		MaxDocuments:  opts.MaxDocuments,
+	}
+}
+
+// SchemaMigrationResult is the outcome of a schema migration.
+type SchemaMigrationResult struct {
+	// Migrated is the number of migrations applied, counting a document
+	// once for each schema version it was migrated to.
+	Migrated int `bson:"migrated" json:"migrated" yaml:"migrated"`
+	// Complete is whether every document is at the current schema
+	// version. It is false if MaxDocuments was reached first.
+	Complete bool `bson:"complete" json:"complete" yaml:"complete"`
+}
+
+// MigrateSchema migrates the documents in the depot, which must implement
+// SchemaMigrator, to CurrentUserSchemaVersion. It is safe to run while the
+// depot is in use and from several processes at once, and a migration that
+// is interrupted or limited by MaxDocuments continues where it stopped the
+// next time it is run.
+func MigrateSchema(ctx context.Context, wd Depot, opts SchemaMigrationOptions) (*SchemaMigrationResult, error) {
+	migrator, ok := wd.(SchemaMigrator)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not support schema migrations", wd)
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	return migrator.MigrateSchema(ctx, opts)
+}
+
+// MigrateSchema applies each migration in order to the user documents that
+// are at an older schema version, in batches according to the options.
+func (m *mongoDepot) MigrateSchema(ctx context.Context, opts SchemaMigrationOptions) (*SchemaMigrationResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+	scan := opts.scanOptions()
+
+	res := &SchemaMigrationResult{}
+	for _, migration := range userMigrations {
+		if migration.version > CurrentUserSchemaVersion {
+			break
+		}
+		lastID := ""
+		for {
+			limit := scan.nextBatchSize(res.Migrated)
+			if limit <= 0 {
+				return res, nil
+			}
+			if res.Migrated > 0 {
+				if err := scan.wait(ctx); err != nil {
+					return res, errors.Wrap(err, "waiting between batches")
+				}
+			}
+
+			batch, err := m.findOutdatedUsers(ctx, migration.version, lastID, limit)
+			if err != nil {
+				return res, errors.Wrapf(err, "finding documents to migrate to version %d", migration.version)
+			}
+			ids := make([]string, 0, len(batch))
+			for _, doc := range batch {
+				id, ok := doc.Lookup(userIDKey).StringValueOK()
+				if !ok {
+					return res, errors.Errorf("document has an invalid %s", userIDKey)
+				}
+				ids = append(ids, id)
+			}
+			migrated := make([]bool, len(batch))
+			errs, err := forEachParallel(ctx, opts.WorkerPoolOptions, len(batch), func(ctx context.Context, i int) error {
+				if err := m.migrateUser(ctx, migration, ids[i], batch[i]); err != nil {
+					return errors.Wrapf(err, "migrating user '%s' to version %d", ids[i], migration.version)
+				}
+				migrated[i] = true
+				return nil
+			})
+			for i := range batch {
+				if errs[i] != nil {
+					return res, errs[i]
+				}
+				if !migrated[i] {
+					break
+				}
+				lastID = ids[i]
+				res.Migrated++
+			}
+			if err != nil {
+				return res, err
+			}
+			if len(batch) < limit {
+				break
+			}
+		}
+
+		grip.Info(message.Fields{
+			"message":     "migrated user documents",
+			"db":          m.databaseName,
+			"coll":        m.collectionName,
+			"version":     migration.version,
+			"description": migration.description,
+		})
+	}
+	res.Complete = true
+
+	return res, nil
+}
+
+// outdatedUserQuery matches the user documents at a schema version older than
+// the version, including documents with no schema version.
+func outdatedUserQuery(version int) bson.M {
+	return bson.M{userSchemaVersionKey: bson.M{"$not": bson.M{"$gte": version}}}
+}
+
+// findOutdatedUsers finds a batch of user documents, in order of ID after the
+// last ID, that are at a schema version older than the version.
+func (m *mongoDepot) findOutdatedUsers(ctx context.Context, version int, lastID string, limit int) ([]bson.Raw, error) {
+	query := outdatedUserQuery(version)
+	if lastID != "" {
+		query[userIDKey] = bson.M{"$gt": lastID}
+	}
+
+	cursor, err := m.coll.Find(ctx, query, options.Find().SetSort(bson.M{userIDKey: 1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, errors.Wrap(err, "finding users")
+	}
+	batch := []bson.Raw{}
+	if err = cursor.All(ctx, &batch); err != nil {
+		return nil, errors.Wrap(err, "decoding users")
+	}
+
+	return batch, nil
+}
+
+// migrateUser applies the migration to the document if it has not been
+// migrated concurrently. Migrations that change the document's data also
+// change its revision, so that concurrent compare-and-swap writers notice.
+func (m *mongoDepot) migrateUser(ctx context.Context, migration userMigration, id string, doc bson.Raw) error {
+	update := bson.M{}
+	if migration.update != nil {
+		var err error
+		if update, err = migration.update(doc); err != nil {
+			return errors.Wrap(err, "computing update")
+		}
+		if len(update) == 0 {
+			update = bson.M{}
+		} else {
+			update["$inc"] = bson.M{userRevisionKey: 1}
+		}
+	}
+	set, _ := update["$set"].(bson.M)
+	if set == nil {
+		set = bson.M{}
+	}
+	set[userSchemaVersionKey] = migration.version
+	update["$set"] = set
+
+	query := outdatedUserQuery(migration.version)
+	query[userIDKey] = id
+	m.recentWrites.record(id)
+	_, err := m.coll.UpdateOne(ctx, query, update)
+
+	return errors.Wrap(err, "updating user")
+}
@@ -0,0 +1,98 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestUserMigrations(t *testing.T) {
+	require.NotEmpty(t, userMigrations)
+	for i, migration := range userMigrations {
+		assert.Equal(t, i+1, migration.version)
+		assert.NotEmpty(t, migration.description)
+	}
+	assert.Equal(t, CurrentUserSchemaVersion, userMigrations[len(userMigrations)-1].version)
+}
+
+func TestMigrateSchema(t *testing.T) {
+	ctx := context.TODO()
+	depotOpts := DepotOptions{CA: "root", DefaultExpiration: time.Hour}
+
+	t.Run("FileDepot", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir(".", "migration-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		}()
+		d, err := MakeFileDepot(tempDir, depotOpts)
+		require.NoError(t, err)
+
+		_, err = MigrateSchema(ctx, d, SchemaMigrationOptions{})
+		assert.Error(t, err)
+	})
+	t.Run("MongoDB", func(t *testing.T) {
+		d, err := NewMongoDBCertDepot(ctx, &MongoDBOptions{
+			MongoDBURI:     testMongoDBURI(),
+			DatabaseName:   "certDepot",
+			CollectionName: "migration",
+			DepotOptions:   depotOpts,
+		})
+		require.NoError(t, err)
+		m := d.(*mongoDepot)
+		defer func() {
+			assert.NoError(t, m.coll.(*mongo.Collection).Drop(ctx))
+			assert.NoError(t, m.metadataCollection().(*mongo.Collection).Drop(ctx))
+		}()
+
+		schemaVersion := func(t *testing.T, name string) int {
+			u := User{}
+			require.NoError(t, m.coll.FindOne(ctx, bson.M{userIDKey: name}).Decode(&u))
+			return u.SchemaVersion
+		}
+
+		require.NoError(t, d.Put(CrtTag("current"), []byte("data")))
+		assert.Equal(t, CurrentUserSchemaVersion, schemaVersion(t, "current"))
+
+		legacy := []interface{}{}
+		for _, name := range []string{"legacy-1", "legacy-2", "legacy-3"} {
+			legacy = append(legacy, bson.M{userIDKey: name, userCertKey: "data"})
+		}
+		_, err = m.coll.(*mongo.Collection).InsertMany(ctx, legacy)
+		require.NoError(t, err)
+		assert.Zero(t, schemaVersion(t, "legacy-1"))
+
+		t.Run("RejectsInvalidOptions", func(t *testing.T) {
+			_, err := MigrateSchema(ctx, d, SchemaMigrationOptions{BatchSize: -1})
+			assert.Error(t, err)
+		})
+		t.Run("MigratesIncrementally", func(t *testing.T) {
+			res, err := MigrateSchema(ctx, d, SchemaMigrationOptions{BatchSize: 1, MaxDocuments: 2})
+			require.NoError(t, err)
+			assert.Equal(t, &SchemaMigrationResult{Migrated: 2}, res)
+			assert.Equal(t, CurrentUserSchemaVersion, schemaVersion(t, "legacy-2"))
+			assert.Zero(t, schemaVersion(t, "legacy-3"))
+
+			res, err = MigrateSchema(ctx, d, SchemaMigrationOptions{BatchSize: 1})
+			require.NoError(t, err)
+			assert.Equal(t, &SchemaMigrationResult{Migrated: 1, Complete: true}, res)
+			assert.Equal(t, CurrentUserSchemaVersion, schemaVersion(t, "legacy-3"))
+
+			data, err := d.Get(CrtTag("legacy-3"))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("data"), data)
+		})
+		t.Run("DoesNothingWhenComplete", func(t *testing.T) {
+			res, err := MigrateSchema(ctx, d, SchemaMigrationOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, &SchemaMigrationResult{Complete: true}, res)
+		})
+	})
+}
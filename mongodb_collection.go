@@ -0,0 +1,101 @@
+package certdepot
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// MongoDBCollection is the subset of a MongoDB collection that a mongo depot
+// uses. The official driver's *mongo.Collection implements it. Adapters for
+// other drivers, such as the legacy mgo driver, can implement it outside of
+// this module by returning results built with mongo.NewSingleResultFromDocument
+// and mongo.NewCursorFromDocuments, and open a depot with
+// NewMongoDBCertDepotWithCollections.
+type MongoDBCollection interface {
+	// Name returns the name of the collection.
+	Name() string
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	ReplaceOne(ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error)
+	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+}
+
+var _ MongoDBCollection = &mongo.Collection{}
+
+// MongoDBCollections are the collections that a mongo depot stores its data
+// in.
+type MongoDBCollections struct {
+	// Certs holds a document with the credentials of each name.
+	Certs MongoDBCollection
+	// Metadata holds the depot's persisted options and its locks.
+	Metadata MongoDBCollection
+	// Primary is Certs read from the primary, which is used for names
+	// written within the read-your-writes window (see
+	// MongoDBOptions.ReadYourWritesWindow). It defaults to Certs.
+	Primary MongoDBCollection
+	// DatabaseName is the name of the database the collections are in,
+	// which is only used in logs.
+	DatabaseName string
+}
+
+// DriverCollections returns the collections of a mongo depot that stores its
+// documents in the official driver's collection, with its metadata in a
+// sibling collection in the same database.
+func DriverCollections(coll *mongo.Collection) (MongoDBCollections, error) {
+	if coll == nil {
+		return MongoDBCollections{}, errors.New("must specify a non-nil collection")
+	}
+
+	primary, err := coll.Clone(options.Collection().SetReadPreference(readpref.Primary()))
+	if err != nil {
+		return MongoDBCollections{}, errors.Wrap(err, "cloning collection for primary reads")
+	}
+
+	return MongoDBCollections{
+		Certs:        coll,
+		Metadata:     coll.Database().Collection(coll.Name() + depotMetadataCollectionSuffix),
+		Primary:      primary,
+		DatabaseName: coll.Database().Name(),
+	}, nil
+}
+
+// Validate checks that the collections are set.
+func (colls MongoDBCollections) Validate() error {
+	if colls.Certs == nil {
+		return errors.New("must specify a collection for certificates")
+	}
+	if colls.Metadata == nil {
+		return errors.New("must specify a collection for metadata")
+	}
+	return nil
+}
+
+// NewMongoDBCertDepotWithCollections returns a new cert depot backed by
+// MongoDB that stores its documents in the collections, which may be
+// implemented by a driver other than the official one. Only the depot options,
+// timeouts, read-your-writes window, and user decorators of the options are
+// used.
+func NewMongoDBCertDepotWithCollections(ctx context.Context, colls MongoDBCollections, opts *MongoDBOptions) (Depot, error) {
+	if err := colls.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid collections")
+	}
+	if opts == nil {
+		opts = &MongoDBOptions{}
+	}
+
+	m, err := newMongoDepot(ctx, colls, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,41 @@
+package certdepot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestDriverCollections(t *testing.T) {
+	ctx := context.TODO()
+
+	t.Run("FailsWithNilCollection", func(t *testing.T) {
+		_, err := DriverCollections(nil)
+		assert.Error(t, err)
+	})
+	t.Run("UsesSiblingMetadataCollection", func(t *testing.T) {
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(testMongoDBURI()))
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, client.Disconnect(ctx))
+		}()
+
+		colls, err := DriverCollections(client.Database("certDepot").Collection("certs"))
+		require.NoError(t, err)
+		assert.NoError(t, colls.Validate())
+		assert.Equal(t, "certs", colls.Certs.Name())
+		assert.Equal(t, "certs"+depotMetadataCollectionSuffix, colls.Metadata.Name())
+		assert.Equal(t, "certs", colls.Primary.Name())
+		assert.NotSame(t, colls.Certs, colls.Primary)
+		assert.Equal(t, "certDepot", colls.DatabaseName)
+	})
+	t.Run("RequiresCollections", func(t *testing.T) {
+		d, err := NewMongoDBCertDepotWithCollections(ctx, MongoDBCollections{}, nil)
+		assert.Error(t, err)
+		assert.Nil(t, d)
+	})
+}
@@ -2,22 +2,37 @@ package certdepot
 
 import (
 	"context"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/mongodb/grip"
 	"github.com/mongodb/grip/message"
 	"github.com/pkg/errors"
 	"github.com/square/certstrap/depot"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type mongoDepot struct {
 	ctx            context.Context
-	client         *mongo.Client
+	coll           MongoDBCollection
+	metadataColl   MongoDBCollection
 	databaseName   string
 	collectionName string
 	opts           DepotOptions
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	flights        credentialsFlights
+	decoratorsMu   sync.RWMutex
+	decorators     []UserDecorator
+	// primaryColl is the collection read from the primary, used for reads
+	// of names written within the read-your-writes window.
+	primaryColl  MongoDBCollection
+	recentWrites recentWrites
 }
 
 // NewMongoDBCertDepot returns a new cert depot backed by MongoDB using the
@@ -32,13 +47,16 @@ func NewMongoDBCertDepot(ctx context.Context, opts *MongoDBOptions) (Depot, erro
 		return nil, errors.Wrap(err, "connecting to database")
 	}
 
-	return &mongoDepot{
-		ctx:            ctx,
-		client:         client,
-		databaseName:   opts.DatabaseName,
-		collectionName: opts.CollectionName,
-		opts:           opts.DepotOptions,
-	}, nil
+	colls, err := DriverCollections(client.Database(opts.DatabaseName).Collection(opts.CollectionName))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	m, err := newMongoDepot(ctx, colls, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return m, nil
 }
 
 // NewMongoDBCertDepotWithClient returns a new cert depot backed by MongoDB
@@ -52,13 +70,81 @@ func NewMongoDBCertDepotWithClient(ctx context.Context, client *mongo.Client, op
 		return nil, errors.Wrap(err, "invalid options")
 	}
 
-	return &mongoDepot{
+	colls, err := DriverCollections(client.Database(opts.DatabaseName).Collection(opts.CollectionName))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	m, err := newMongoDepot(ctx, colls, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return m, nil
+}
+
+// NewMongoDBCertDepotWithCollection returns a new cert depot backed by MongoDB
+// that stores its documents in the provided collection, so the collection's
+// read and write concerns and other settings are used for every operation.
+// Depot metadata is stored in a sibling collection in the same database.
+func NewMongoDBCertDepotWithCollection(ctx context.Context, coll *mongo.Collection, opts DepotOptions) (Depot, error) {
+	colls, err := DriverCollections(coll)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	m, err := newMongoDepot(ctx, colls, &MongoDBOptions{DepotOptions: opts})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return m, nil
+}
+
+// newMongoDepot constructs a mongo depot, filling in depot options that are
+// not set from those persisted in the database, if any.
+func newMongoDepot(ctx context.Context, colls MongoDBCollections, opts *MongoDBOptions) (*mongoDepot, error) {
+	m := &mongoDepot{
 		ctx:            ctx,
-		client:         client,
-		databaseName:   opts.DatabaseName,
-		collectionName: opts.CollectionName,
-		opts:           opts.DepotOptions,
-	}, nil
+		coll:           colls.Certs,
+		metadataColl:   colls.Metadata,
+		databaseName:   colls.DatabaseName,
+		collectionName: colls.Certs.Name(),
+		readTimeout:    opts.ReadTimeout,
+		writeTimeout:   opts.WriteTimeout,
+		decorators:     append([]UserDecorator{}, opts.UserDecorators...),
+		primaryColl:    colls.Certs,
+		recentWrites:   recentWrites{window: opts.ReadYourWritesWindow},
+	}
+	if opts.ReadYourWritesWindow > 0 && colls.Primary != nil {
+		m.primaryColl = colls.Primary
+	}
+
+	persisted, err := m.loadDepotOptions()
+	if err != nil {
+		return nil, errors.Wrap(err, "loading depot options")
+	}
+	m.opts = opts.DepotOptions.withDefaults(persisted)
+
+	return m, nil
+}
+
+// readContext returns the context for a single read from the database, which
+// is canceled after the read timeout, if there is one.
+func (m *mongoDepot) readContext() (context.Context, context.CancelFunc) {
+	return m.operationContext(m.readTimeout)
+}
+
+// writeContext returns the context for a single write to the database, which
+// is canceled after the write timeout, if there is one.
+func (m *mongoDepot) writeContext() (context.Context, context.CancelFunc) {
+	return m.operationContext(m.writeTimeout)
+}
+
+func (m *mongoDepot) operationContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(m.ctx)
+	}
+	return context.WithTimeout(m.ctx, timeout)
 }
 
 // Put inserts the data into the document specified by the tag.
@@ -71,10 +157,28 @@ func (m *mongoDepot) Put(tag *depot.Tag, data []byte) error {
 	if err != nil {
 		return errors.Wrapf(err, "formatting name '%s'", name)
 	}
+	if data, err = checkPEM(m.opts, tag, data); err != nil {
+		return err
+	}
+	if key == userCertKey {
+		return errors.WithStack(m.putCertificate(name, data))
+	}
 
-	update := bson.M{"$set": bson.M{key: string(data)}}
+	value := bsonString(data)
+	defer zeroBytes(value.Value)
+	update := bson.M{
+		"$set":         bson.M{key: value},
+		"$inc":         bson.M{userRevisionKey: 1},
+		"$setOnInsert": bson.M{userSchemaVersionKey: CurrentUserSchemaVersion},
+	}
+	if err = m.decorate(name, update); err != nil {
+		return errors.Wrap(err, "decorating user")
+	}
 
-	res, err := m.client.Database(m.databaseName).Collection(m.collectionName).UpdateOne(m.ctx,
+	ctx, cancel := m.writeContext()
+	defer cancel()
+	m.recentWrites.record(name)
+	res, err := m.coll.UpdateOne(ctx,
 		bson.D{{Key: userIDKey, Value: name}},
 		update,
 		options.Update().SetUpsert(true))
@@ -95,6 +199,9 @@ func (m *mongoDepot) Put(tag *depot.Tag, data []byte) error {
 
 // Check returns whether the user and data specified by the tag exists.
 func (m *mongoDepot) Check(tag *depot.Tag) bool {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
 	name, key, err := getNameAndKey(tag)
 	if err != nil {
 		return false
@@ -102,7 +209,9 @@ func (m *mongoDepot) Check(tag *depot.Tag) bool {
 
 	u := &User{}
 
-	err = m.client.Database(m.databaseName).Collection(m.collectionName).FindOne(m.ctx, bson.D{{Key: userIDKey, Value: name}}).Decode(u)
+	err = m.readColl(name).FindOne(ctx,
+		bson.D{{Key: userIDKey, Value: name}},
+		options.FindOne().SetProjection(bson.M{key: 1})).Decode(u)
 	grip.WarningWhen(errNotNoDocuments(err), message.WrapError(err, message.Fields{
 		"db":   m.databaseName,
 		"coll": m.collectionName,
@@ -110,23 +219,15 @@ func (m *mongoDepot) Check(tag *depot.Tag) bool {
 		"op":   "check",
 	}))
 
-	switch key {
-	case userCertKey:
-		return u.Cert != ""
-	case userPrivateKeyKey:
-		return u.PrivateKey != ""
-	case userCertReqKey:
-		return u.CertReq != ""
-	case userCertRevocListKey:
-		return u.CertRevocList != ""
-	default:
-		return false
-	}
+	return len(userData(u, key)) != 0
 }
 
 // CheckWithError returns whether the user and data specified by the tag exists
 // as well as an error in the case of an internal error.
 func (m *mongoDepot) CheckWithError(tag *depot.Tag) (bool, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
 	name, key, err := getNameAndKey(tag)
 	if err != nil {
 		return false, errors.Wrap(err, "getting name and key")
@@ -134,84 +235,215 @@ func (m *mongoDepot) CheckWithError(tag *depot.Tag) (bool, error) {
 
 	u := &User{}
 
-	err = m.client.Database(m.databaseName).Collection(m.collectionName).FindOne(m.ctx, bson.D{{Key: userIDKey, Value: name}}).Decode(u)
+	err = m.readColl(name).FindOne(ctx,
+		bson.D{{Key: userIDKey, Value: name}},
+		options.FindOne().SetProjection(bson.M{key: 1})).Decode(u)
 	if errNotNoDocuments(err) {
 		return false, errors.Wrap(err, "checking depot tag")
 	}
 
-	switch key {
-	case userCertKey:
-		return u.Cert != "", nil
-	case userPrivateKeyKey:
-		return u.PrivateKey != "", nil
-	case userCertReqKey:
-		return u.CertReq != "", nil
-	case userCertRevocListKey:
-		return u.CertRevocList != "", nil
-	default:
-		return false, nil
-	}
+	return len(userData(u, key)) != 0, nil
 }
 
 // Get reads the data for the user specified by tag. Returns an error if the
 // user does not exist or if the data is empty.
 func (m *mongoDepot) Get(tag *depot.Tag) ([]byte, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
 	name, key, err := getNameAndKey(tag)
 	if err != nil {
 		return nil, errors.Wrapf(err, "formatting name '%s'", name)
 	}
 
-	u := &User{}
-	if err = m.client.Database(m.databaseName).Collection(m.collectionName).FindOne(m.ctx, bson.D{{Key: userIDKey, Value: name}}).Decode(u); err != nil {
+	res := m.readColl(name).FindOne(ctx,
+		bson.D{{Key: userIDKey, Value: name}},
+		options.FindOne().SetProjection(bson.M{key: 1}))
+	var data []byte
+	if key == userPrivateKeyKey {
+		data, err = decodeStringBytes(res, key)
+	} else {
+		u := &User{}
+		if err = res.Decode(u); err == nil {
+			data = userData(u, key)
+		}
+	}
+	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, errors.Wrapf(err, "name '%s' not found", name)
 		}
 		return nil, errors.Wrapf(err, "looking up name '%s' in the database", name)
 	}
+	if len(data) == 0 {
+		return nil, errors.New("no data available")
+	}
+	return data, nil
+}
 
-	var data []byte
-	switch key {
-	case userCertKey:
-		data = []byte(u.Cert)
-	case userPrivateKeyKey:
-		data = []byte(u.PrivateKey)
-	case userCertReqKey:
-		data = []byte(u.CertReq)
-	case userCertRevocListKey:
-		data = []byte(u.CertRevocList)
+// GetIfExists reads the data for the user specified by the tag with a single
+// query, returning false if the user does not exist or the data is empty.
+func (m *mongoDepot) GetIfExists(tag *depot.Tag) ([]byte, bool, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "formatting name '%s'", name)
+	}
+
+	u := &User{}
+	err = m.readColl(name).FindOne(ctx,
+		bson.D{{Key: userIDKey, Value: name}},
+		options.FindOne().SetProjection(bson.M{key: 1})).Decode(u)
+	if err == mongo.ErrNoDocuments {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "looking up name '%s' in the database", name)
 	}
 
+	data := userData(u, key)
 	if len(data) == 0 {
-		return nil, errors.New("no data available")
+		return nil, false, nil
 	}
-	return data, nil
+	return data, true, nil
+}
+
+// GetAll reads the certificate, private key, certificate request, and
+// certificate revocation list for the user with a single query.
+func (m *mongoDepot) GetAll(name string) (*User, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
+	u := &User{}
+	if err := m.readColl(name).FindOne(ctx, bson.D{{Key: userIDKey, Value: name}}).Decode(u); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errors.Wrapf(err, "name '%s' not found", name)
+		}
+		return nil, errors.Wrapf(err, "looking up name '%s' in the database", name)
+	}
+
+	return u, nil
 }
 
 // Delete removes the data from a user specified by the tag.
 func (m *mongoDepot) Delete(tag *depot.Tag) error {
+	ctx, cancel := m.writeContext()
+	defer cancel()
+
 	name, key, err := getNameAndKey(tag)
 	if err != nil {
 		return errors.Wrapf(err, "formatting name '%s'", name)
 	}
 
-	if _, err = m.client.Database(m.databaseName).Collection(m.collectionName).UpdateOne(m.ctx,
+	m.recentWrites.record(name)
+	if _, err = m.coll.UpdateOne(ctx,
 		bson.D{{Key: userIDKey, Value: name}},
-		bson.M{"$unset": bson.M{key: ""}}); errNotNoDocuments(err) {
+		bson.M{"$unset": bson.M{key: ""}, "$inc": bson.M{userRevisionKey: 1}}); errNotNoDocuments(err) {
 		return errors.Wrapf(err, "deleting '%s.%s' from the database", name, key)
 	}
 
 	return nil
 }
+
+// ListNames returns the IDs of all users in the mongo depot, except for the
+// names reserved for the depot's own data.
+func (m *mongoDepot) ListNames() ([]string, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
+	res, err := m.readColl("").Find(ctx,
+		bson.M{},
+		options.Find().SetProjection(bson.M{userIDKey: 1}).SetSort(bson.M{userIDKey: 1}))
+	if err != nil {
+		return nil, errors.Wrap(err, "finding users")
+	}
+
+	users := []User{}
+	if err := res.All(ctx, &users); err != nil {
+		return nil, errors.Wrap(err, "decoding users")
+	}
+
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, u.ID)
+	}
+
+	return withoutReservedNames(names), nil
+}
+
 func (m *mongoDepot) Save(name string, creds *Credentials) error { return depotSave(m, name, creds) }
-func (m *mongoDepot) Find(name string) (*Credentials, error)     { return depotFind(m, name, m.opts) }
+
+func (m *mongoDepot) Find(name string) (*Credentials, error) {
+	return m.flights.do("find", name, func() (*Credentials, error) {
+		return depotFind(m, name, m.opts)
+	})
+}
+
 func (m *mongoDepot) Generate(name string) (*Credentials, error) {
-	return depotGenerateDefault(m, name, m.opts)
+	return m.flights.do("generate", name, func() (*Credentials, error) {
+		return depotGenerateDefault(m, name, m.opts)
+	})
 }
 
 func (m *mongoDepot) GenerateWithOptions(opts CertificateOptions) (*Credentials, error) {
 	return depotGenerate(m, opts.CommonName, m.opts, opts)
 }
 
+func (m *mongoDepot) registerCA(name string) error {
+	opts := m.opts
+	opts.CA = name
+	return m.SaveDepotOptions(opts)
+}
+
+// DepotOptions returns the options the mongo depot was configured with.
+func (m *mongoDepot) DepotOptions() DepotOptions { return m.opts }
+
+// userData returns the data stored in the user document under the key.
+func userData(u *User, key string) []byte {
+	if param := strings.TrimPrefix(key, userParamsKey+"."); param != key {
+		return []byte(u.Params[param])
+	}
+	for kind, kindKey := range userKindKeys {
+		if kindKey == key {
+			return []byte(*u.kindField(kind))
+		}
+	}
+
+	return nil
+}
+
+// bsonString returns the data as a BSON string value without converting it to
+// a Go string, which, unlike a byte slice, cannot be zeroed once it holds a
+// private key. The caller should zero the value once it has been written.
+func bsonString(data []byte) bson.RawValue {
+	value := make([]byte, 4+len(data)+1)
+	binary.LittleEndian.PutUint32(value, uint32(len(data)+1))
+	copy(value[4:], data)
+	return bson.RawValue{Type: bsontype.String, Value: value}
+}
+
+// decodeStringBytes returns a copy of the string field with the key in the
+// document of the result without converting it to a Go string, and zeroes the
+// raw document afterwards. It returns no data if the field does not exist.
+func decodeStringBytes(res *mongo.SingleResult, key string) ([]byte, error) {
+	raw, err := res.DecodeBytes()
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(raw)
+
+	value, err := raw.LookupErr(key)
+	if err != nil {
+		return nil, nil
+	}
+	if value.Type != bsontype.String || len(value.Value) < 5 {
+		return nil, errors.Errorf("field '%s' is not a string", key)
+	}
+
+	return append([]byte{}, value.Value[4:len(value.Value)-1]...), nil
+}
+
 func errNotNoDocuments(err error) bool {
 	return err != nil && err != mongo.ErrNoDocuments
 }
@@ -6,7 +6,8 @@ import (
 	"github.com/mongodb/anser/bsonutil"
 )
 
-// User stores information for a user in the mongo certificate depot.
+// User stores information for a user in the mongo certificate depot. It is
+// also used by GetAll to return all of the data stored for a name in any depot.
 type User struct {
 	ID            string    `bson:"_id"`
 	Cert          string    `bson:"cert"`
@@ -14,20 +15,92 @@ type User struct {
 	CertReq       string    `bson:"cert_req"`
 	CertRevocList string    `bson:"cert_revoc_list"`
 	TTL           time.Time `bson:"ttl,omitempty"`
+	// Chain is the PEM-encoded chain of intermediate CA certificates that
+	// issued Cert, stored with ChainTag.
+	Chain string `bson:"chain,omitempty"`
+	// SSHCert is the OpenSSH certificate stored with SSHCertTag.
+	SSHCert string `bson:"ssh_cert,omitempty"`
+	// LastIssued is when the current certificate was put in the depot.
+	LastIssued time.Time `bson:"last_issued,omitempty"`
+	// LastRotated is when the current certificate replaced a previous
+	// certificate.
+	LastRotated time.Time `bson:"last_rotated,omitempty"`
+	// Params holds the auxiliary TLS artifacts stored with ParamTag, keyed
+	// by parameter.
+	Params map[string]string `bson:"params,omitempty"`
+	// Revision is incremented on every change to the document, so that
+	// concurrent writers can detect conflicting changes.
+	Revision int64 `bson:"revision,omitempty"`
+	// SchemaVersion is the version of the schema the document was written
+	// with. Documents written before schema versions were recorded have
+	// no version and are at version 0.
+	SchemaVersion int `bson:"schema_version,omitempty"`
+	// Extra holds the application-defined fields set by UserDecorators,
+	// such as the ID of the cluster or job that provisioned the
+	// credentials. Certdepot writes them but never reads them.
+	Extra map[string]interface{} `bson:"extra,omitempty"`
 }
 
+// UserDecorator is called with a User holding the ID of each document the
+// mongo depot is about to write. The fields it sets in the User's Extra are
+// written to the document along with the change; changes to the other fields
+// are ignored.
+type UserDecorator func(*User)
+
 var (
 	userIDKey            = bsonutil.MustHaveTag(User{}, "ID")
 	userCertKey          = bsonutil.MustHaveTag(User{}, "Cert")
 	userPrivateKeyKey    = bsonutil.MustHaveTag(User{}, "PrivateKey")
 	userCertReqKey       = bsonutil.MustHaveTag(User{}, "CertReq")
 	userCertRevocListKey = bsonutil.MustHaveTag(User{}, "CertRevocList")
+	userChainKey         = bsonutil.MustHaveTag(User{}, "Chain")
+	userSSHCertKey       = bsonutil.MustHaveTag(User{}, "SSHCert")
 	userTTLKey           = bsonutil.MustHaveTag(User{}, "TTL")
+	userLastIssuedKey    = bsonutil.MustHaveTag(User{}, "LastIssued")
+	userLastRotatedKey   = bsonutil.MustHaveTag(User{}, "LastRotated")
+	userParamsKey        = bsonutil.MustHaveTag(User{}, "Params")
+	userRevisionKey      = bsonutil.MustHaveTag(User{}, "Revision")
+	userSchemaVersionKey = bsonutil.MustHaveTag(User{}, "SchemaVersion")
+	userExtraKey         = bsonutil.MustHaveTag(User{}, "Extra")
 )
 
+// userKindKeys are the keys of the user document fields holding each kind of
+// credential.
+var userKindKeys = map[CredentialKind]string{
+	CredentialCert:    userCertKey,
+	CredentialKey:     userPrivateKeyKey,
+	CredentialCSR:     userCertReqKey,
+	CredentialCRL:     userCertRevocListKey,
+	CredentialChain:   userChainKey,
+	CredentialSSHCert: userSSHCertKey,
+}
+
+// kindField returns the field of the user document holding the kind of
+// credential, or nil if the kind is not valid.
+func (u *User) kindField(kind CredentialKind) *string {
+	switch kind {
+	case CredentialCert:
+		return &u.Cert
+	case CredentialKey:
+		return &u.PrivateKey
+	case CredentialCSR:
+		return &u.CertReq
+	case CredentialCRL:
+		return &u.CertRevocList
+	case CredentialChain:
+		return &u.Chain
+	case CredentialSSHCert:
+		return &u.SSHCert
+	default:
+		return nil
+	}
+}
+
 // MongoDBOptions contains options for NewMongoDBCertDepot,
-// NewMongoDBCertDepotWithClient, NewMgoCertDepot, and
-// NewMgoCertDepotWithSession.
+// NewMongoDBCertDepotWithClient, and NewMongoDBCertDepotWithCollections.
+// Services that use a driver other than the official one, such as the legacy
+// mgo driver, can implement MongoDBCollection for it and use
+// NewMongoDBCertDepotWithCollections.
 type MongoDBOptions struct {
 	MongoDBURI           string        `bson:"mongodb_uri" json:"mongodb_uri" yaml:"mongodb_uri"`
 	DatabaseName         string        `bson:"db_name" json:"db_name" yaml:"db_name"`
@@ -35,6 +108,23 @@ type MongoDBOptions struct {
 	MongoDBDialTimeout   time.Duration `bson:"dial_timeout,omitempty" json:"dial_timeout,omitempty" yaml:"dial_timeout,omitempty"`
 	MongoDBSocketTimeout time.Duration `bson:"socket_timeout,omitempty" json:"socket_timeout,omitempty" yaml:"socket_timeout,omitempty"`
 	DepotOptions         DepotOptions  `bson:"depot_options" json:"depot_options" yaml:"depot_options"`
+	// ReadTimeout, if set, limits how long each read from the database
+	// may take, so that an unresponsive server fails depot operations
+	// instead of blocking them until the depot's context is done.
+	ReadTimeout time.Duration `bson:"read_timeout,omitempty" json:"read_timeout,omitempty" yaml:"read_timeout,omitempty"`
+	// WriteTimeout, if set, limits how long each write to the database
+	// may take.
+	WriteTimeout time.Duration `bson:"write_timeout,omitempty" json:"write_timeout,omitempty" yaml:"write_timeout,omitempty"`
+	// UserDecorators are called before every write to a user document so
+	// that applications can add their own fields to it (see
+	// RegisterUserDecorator).
+	UserDecorators []UserDecorator `bson:"-" json:"-" yaml:"-"`
+	// ReadYourWritesWindow, if set, is how long after the depot writes a
+	// name that its reads of the name go to the primary, even if the
+	// connection prefers reading from secondaries, so that credentials
+	// are found right after they are saved. Writes made by other
+	// processes are not tracked.
+	ReadYourWritesWindow time.Duration `bson:"read_your_writes_window,omitempty" json:"read_your_writes_window,omitempty" yaml:"read_your_writes_window,omitempty"`
 }
 
 // IsZero returns whether the given MongoDBOptions struct holds the "zero"
@@ -0,0 +1,154 @@
+package certdepot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/square/certstrap/depot"
+)
+
+// nameLocks are in-process read-write locks on the names in a depot, so that
+// operations that touch several tags for a name, such as saving or deleting
+// credentials, appear atomic to readers in the same process.
+type nameLocks struct {
+	mu    sync.Mutex
+	locks map[string]*nameLock
+}
+
+type nameLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// acquire returns the lock for the name, creating it if needed. Each call
+// must be followed by a call to release.
+func (l *nameLocks) acquire(name string) *nameLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locks == nil {
+		l.locks = map[string]*nameLock{}
+	}
+	lock, ok := l.locks[name]
+	if !ok {
+		lock = &nameLock{}
+		l.locks[name] = lock
+	}
+	lock.refs++
+
+	return lock
+}
+
+// release drops the reference to the name's lock taken by acquire, removing
+// the lock once nothing references it.
+func (l *nameLocks) release(name string, lock *nameLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, name)
+	}
+}
+
+// lock takes the write lock on the name and returns a function that releases
+// it.
+func (l *nameLocks) lock(name string) func() {
+	name = formatName(name)
+	lock := l.acquire(name)
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+		l.release(name, lock)
+	}
+}
+
+// rlock takes the read lock on the name and returns a function that releases
+// it.
+func (l *nameLocks) rlock(name string) func() {
+	name = formatName(name)
+	lock := l.acquire(name)
+	lock.RLock()
+
+	return func() {
+		lock.RUnlock()
+		l.release(name, lock)
+	}
+}
+
+// lockedName is a view of a file depot used while holding the lock on a
+// name. It accesses the files for that name without locking it again, and
+// locks any other name as usual.
+type lockedName struct {
+	*fileDepot
+	name string
+}
+
+// withName calls fn with a view of the file depot while holding the write
+// lock on the name if write is true, or the read lock otherwise.
+func (fd *fileDepot) withName(name string, write bool, fn func(*lockedName) error) error {
+	if write {
+		defer fd.names.lock(name)()
+	} else {
+		defer fd.names.rlock(name)()
+	}
+
+	return fn(&lockedName{fileDepot: fd, name: formatName(name)})
+}
+
+// holds returns whether the tag belongs to the locked name.
+func (l *lockedName) holds(tag *depot.Tag) bool {
+	return formatName(getNameFromTag(tag)) == l.name
+}
+
+func (l *lockedName) Put(tag *depot.Tag, data []byte) error {
+	if l.holds(tag) {
+		return l.fileDepot.put(tag, data)
+	}
+	return l.fileDepot.Put(tag, data)
+}
+
+func (l *lockedName) Check(tag *depot.Tag) bool {
+	if l.holds(tag) {
+		return l.FileDepot.Check(tag)
+	}
+	return l.fileDepot.Check(tag)
+}
+
+func (l *lockedName) CheckWithError(tag *depot.Tag) (bool, error) { return l.Check(tag), nil }
+
+func (l *lockedName) Get(tag *depot.Tag) ([]byte, error) {
+	if l.holds(tag) {
+		return l.FileDepot.Get(tag)
+	}
+	return l.fileDepot.Get(tag)
+}
+
+func (l *lockedName) GetIfExists(tag *depot.Tag) ([]byte, bool, error) {
+	if l.holds(tag) {
+		return getFileIfExists(l.FileDepot, tag)
+	}
+	return l.fileDepot.GetIfExists(tag)
+}
+
+func (l *lockedName) Delete(tag *depot.Tag) error {
+	if l.holds(tag) {
+		return l.FileDepot.Delete(tag)
+	}
+	return l.fileDepot.Delete(tag)
+}
+
+func (l *lockedName) GetAll(name string) (*User, error) {
+	if formatName(name) == l.name {
+		return getAllByTag(l, name)
+	}
+	return l.fileDepot.GetAll(name)
+}
+
+func (l *lockedName) PutTTL(name string, expiration time.Time) error {
+	if formatName(name) == l.name {
+		return l.fileDepot.putTTL(l, name, expiration)
+	}
+	return l.fileDepot.PutTTL(name, expiration)
+}
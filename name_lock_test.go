@@ -0,0 +1,80 @@
+package certdepot
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDepotConsistentReads(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "name-lock-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour, PreviousGracePeriod: time.Minute})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+
+	generations := []*Credentials{}
+	for i := 0; i < 3; i++ {
+		creds, err := d.Generate("alice")
+		require.NoError(t, err)
+		generations = append(generations, creds)
+	}
+	require.NoError(t, d.Save("alice", generations[0]))
+
+	const rotations = 50
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < rotations; i++ {
+			assert.NoError(t, d.Save("alice", generations[i%len(generations)]))
+		}
+	}()
+
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				u, err := GetAll(d, "alice")
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, err = tls.X509KeyPair([]byte(u.Cert), []byte(u.PrivateKey))
+				if !assert.NoError(t, err, "certificate and key are from different saves") {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	found, err := d.Find("alice")
+	require.NoError(t, err)
+	assert.Equal(t, generations[(rotations-1)%len(generations)].Cert, found.Cert)
+
+	t.Run("ReleasesLocks", func(t *testing.T) {
+		fd := d.(*fileDepot)
+		fd.names.mu.Lock()
+		defer fd.names.mu.Unlock()
+		assert.Empty(t, fd.names.locks)
+	})
+}
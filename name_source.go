@@ -0,0 +1,61 @@
+package certdepot
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NameSource is a kind of subject alt name that the common name of a
+// certificate request can be derived from when the options do not set one.
+type NameSource string
+
+const (
+	// NameSourceDomain derives the name from the first requested domain.
+	NameSourceDomain NameSource = "domain"
+	// NameSourceIP derives the name from the first valid requested IP
+	// address, for identities that only have IP addresses, such as hosts
+	// without DNS records.
+	NameSourceIP NameSource = "ip"
+)
+
+// defaultNameSources are the sources that names are derived from if the
+// options do not set any.
+var defaultNameSources = []NameSource{NameSourceDomain, NameSourceIP}
+
+// Validate checks that the name source is known.
+func (s NameSource) Validate() error {
+	switch s {
+	case NameSourceDomain, NameSourceIP:
+		return nil
+	default:
+		return errors.Errorf("unknown name source '%s'", s)
+	}
+}
+
+// name returns the name derived from the requested domains and IP addresses,
+// or an empty string if there is none.
+func (s NameSource) name(domains, ips []string) string {
+	switch s {
+	case NameSourceDomain:
+		if len(domains) != 0 {
+			return domains[0]
+		}
+	case NameSourceIP:
+		for _, ip := range ips {
+			if ip = strings.TrimSpace(ip); net.ParseIP(ip) != nil {
+				return ip
+			}
+		}
+	}
+	return ""
+}
+
+func joinNameSources(sources []NameSource) string {
+	names := make([]string, 0, len(sources))
+	for _, source := range sources {
+		names = append(names, string(source))
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,75 @@
+package certdepot
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameSources(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "name-source-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+
+	t.Run("StorageName", func(t *testing.T) {
+		for testName, testCase := range map[string]struct {
+			opts     CertificateOptions
+			expected string
+		}{
+			"Name":         {opts: CertificateOptions{Name: "alice", Host: "bob", CommonName: "carol"}, expected: "alice"},
+			"Host":         {opts: CertificateOptions{Host: "bob", CommonName: "carol"}, expected: "bob"},
+			"CommonName":   {opts: CertificateOptions{CommonName: "carol", IP: []string{"10.0.0.1"}}, expected: "carol"},
+			"Domain":       {opts: CertificateOptions{Domain: []string{"dave.example.com"}, IP: []string{"10.0.0.1"}}, expected: "dave.example.com"},
+			"IP":           {opts: CertificateOptions{IP: []string{"not an ip", "10.0.0.1"}}, expected: "10.0.0.1"},
+			"IPv6":         {opts: CertificateOptions{IP: []string{"fe80::1"}}, expected: "fe80__1"},
+			"IPBeforeHost": {opts: CertificateOptions{Domain: []string{"dave.example.com"}, IP: []string{"10.0.0.1"}, NameSources: []NameSource{NameSourceIP, NameSourceDomain}}, expected: "10.0.0.1"},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				name, err := testCase.opts.StorageName()
+				require.NoError(t, err)
+				assert.Equal(t, testCase.expected, name)
+			})
+		}
+
+		_, err := CertificateOptions{IP: []string{"10.0.0.1"}, NameSources: []NameSource{NameSourceDomain}}.StorageName()
+		assert.Error(t, err)
+		_, err = CertificateOptions{}.StorageName()
+		assert.Error(t, err)
+	})
+	t.Run("IssuesIPOnlyCertificate", func(t *testing.T) {
+		opts := CertificateOptions{IP: []string{"10.0.0.1", "10.0.0.2"}, CA: "root", Expires: time.Hour}
+		require.NoError(t, opts.CertRequest(d))
+		require.NoError(t, opts.Sign(d))
+
+		crt, err := getRawCertificate(d, "10.0.0.1")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.1", crt.Subject.CommonName)
+		require.Len(t, crt.IPAddresses, 2)
+		assert.True(t, crt.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")))
+		assert.Empty(t, crt.DNSNames)
+
+		matches, err := MatchesHost(d, "10.0.0.1", "10.0.0.2")
+		require.NoError(t, err)
+		assert.True(t, matches)
+	})
+	t.Run("CreatesIPv6OnlyCertificate", func(t *testing.T) {
+		opts := CertificateOptions{IP: []string{"fe80::1"}, CA: "root", Expires: time.Hour}
+		require.NoError(t, opts.CreateCertificate(d))
+		assert.True(t, d.Check(CrtTag("fe80__1")))
+	})
+	t.Run("RejectsUnknownSources", func(t *testing.T) {
+		opts := CertificateOptions{IP: []string{"10.0.0.3"}, NameSources: []NameSource{"uri"}}
+		assert.Error(t, opts.Validate(OperationCertRequest))
+	})
+}
@@ -0,0 +1,141 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultOPAPolicyPath is the path of the decision in the default OPA
+// issuance policy.
+const DefaultOPAPolicyPath = "certdepot/issuance"
+
+//go:embed policies/issuance.rego
+var defaultOPAPolicy []byte
+
+// DefaultOPAPolicy returns the Rego source of the default issuance policy
+// bundled with certdepot. It denies root and intermediate CAs, wildcard
+// names, and lifetimes over 90 days, and its decision is at
+// DefaultOPAPolicyPath.
+func DefaultOPAPolicy() []byte {
+	return append([]byte{}, defaultOPAPolicy...)
+}
+
+// OPAIssuancePolicy is an IssuancePolicy that evaluates each IssuanceRequest
+// against a Rego policy loaded into an Open Policy Agent server using OPA's
+// data API. The IssuanceRequest is sent as the policy input.
+//
+// Policies are not evaluated in-process, so an OPA server must be running
+// and reachable at URL. Use PutPolicy to load a policy, such as
+// DefaultOPAPolicy, into the server.
+//
+// The policy decision at Path must be either a boolean or an object of the
+// form {"allow": <bool>, "reasons": [<string>, ...]}. An undefined decision
+// denies issuance.
+type OPAIssuancePolicy struct {
+	// URL is the base URL of the OPA server, e.g. "http://localhost:8181"
+	// (required).
+	URL string
+	// Path is the slash-separated path to the policy decision, e.g.
+	// "certdepot/issuance/allow" (required).
+	Path string
+	// Header contains additional headers, such as authorization, to send
+	// with each request.
+	Header http.Header
+	// Client is the HTTP client used to make requests. If nil, a client with
+	// a 30 second timeout is used.
+	Client *http.Client
+}
+
+type opaInput struct {
+	Input IssuanceRequest `json:"input"`
+}
+
+type opaResult struct {
+	Result json.RawMessage `json:"result"`
+}
+
+type opaDecision struct {
+	Allow   bool     `json:"allow"`
+	Reasons []string `json:"reasons"`
+}
+
+// Approve evaluates the policy for the issuance request.
+func (p *OPAIssuancePolicy) Approve(ctx context.Context, req IssuanceRequest) error {
+	if p.URL == "" {
+		return errors.New("must specify the OPA server URL")
+	}
+	if p.Path == "" {
+		return errors.New("must specify the OPA policy path")
+	}
+
+	dataURL := strings.TrimSuffix(p.URL, "/") + "/v1/data/" + strings.Trim(p.Path, "/")
+	res := opaResult{}
+	if err := postJSON(ctx, p.Client, dataURL, p.Header, opaInput{Input: req}, &res); err != nil {
+		return errors.Wrap(err, "evaluating OPA policy")
+	}
+	if len(res.Result) == 0 {
+		return errors.Errorf("OPA policy '%s' is undefined for issuance of '%s'", p.Path, req.Name)
+	}
+
+	decision := opaDecision{}
+	if err := json.Unmarshal(res.Result, &decision.Allow); err != nil {
+		if err = json.Unmarshal(res.Result, &decision); err != nil {
+			return errors.Wrap(err, "unmarshalling OPA policy decision")
+		}
+	}
+
+	return IssuanceDecision{
+		Approved: decision.Allow,
+		Reason:   strings.Join(decision.Reasons, "; "),
+	}.err(req.Name)
+}
+
+// PutPolicy creates or replaces the Rego policy module with the given ID in
+// the OPA server using OPA's policy API.
+func (p *OPAIssuancePolicy) PutPolicy(ctx context.Context, id string, module []byte) error {
+	if p.URL == "" {
+		return errors.New("must specify the OPA server URL")
+	}
+	if id == "" {
+		return errors.New("must specify the policy ID")
+	}
+
+	policyURL := strings.TrimSuffix(p.URL, "/") + "/v1/policies/" + url.PathEscape(id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, policyURL, bytes.NewReader(module))
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	for key, values := range p.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "making request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("putting OPA policy '%s' returned status %d: %s", id, resp.StatusCode, string(body))
+	}
+
+	return nil
+}
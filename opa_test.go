@@ -0,0 +1,114 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOPAIssuancePolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req := IssuanceRequest{
+		Name:       "alice",
+		CA:         "root",
+		CommonName: "alice",
+	}
+
+	for testName, testCase := range map[string]struct {
+		result string
+		hasErr bool
+	}{
+		"BooleanAllow": {
+			result: `{"result": true}`,
+		},
+		"BooleanDeny": {
+			result: `{"result": false}`,
+			hasErr: true,
+		},
+		"ObjectAllow": {
+			result: `{"result": {"allow": true}}`,
+		},
+		"ObjectDenyWithReasons": {
+			result: `{"result": {"allow": false, "reasons": ["wildcards are not allowed"]}}`,
+			hasErr: true,
+		},
+		"UndefinedDecision": {
+			result: `{}`,
+			hasErr: true,
+		},
+		"InvalidDecision": {
+			result: `{"result": "yes"}`,
+			hasErr: true,
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/v1/data/certdepot/issuance/allow", r.URL.Path)
+				input := opaInput{}
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+				assert.Equal(t, req, input.Input)
+				_, err := w.Write([]byte(testCase.result))
+				assert.NoError(t, err)
+			}))
+			defer srv.Close()
+
+			policy := &OPAIssuancePolicy{
+				URL:  srv.URL + "/",
+				Path: "/certdepot/issuance/allow",
+			}
+			err := policy.Approve(ctx, req)
+			if testCase.hasErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+	t.Run("FailsWithoutURLOrPath", func(t *testing.T) {
+		assert.Error(t, (&OPAIssuancePolicy{Path: "certdepot"}).Approve(ctx, req))
+		assert.Error(t, (&OPAIssuancePolicy{URL: "http://localhost:8181"}).Approve(ctx, req))
+	})
+}
+
+func TestOPAPutPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	policy := DefaultOPAPolicy()
+	assert.Contains(t, string(policy), "package certdepot.issuance")
+
+	t.Run("PutsPolicy", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodPut, r.Method)
+			assert.Equal(t, "/v1/policies/certdepot", r.URL.Path)
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, policy, body)
+			_, err = w.Write([]byte("{}"))
+			assert.NoError(t, err)
+		}))
+		defer srv.Close()
+
+		assert.NoError(t, (&OPAIssuancePolicy{URL: srv.URL}).PutPolicy(ctx, "certdepot", policy))
+	})
+	t.Run("FailsWithErrorStatus", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer srv.Close()
+
+		assert.Error(t, (&OPAIssuancePolicy{URL: srv.URL}).PutPolicy(ctx, "certdepot", []byte("package")))
+	})
+	t.Run("FailsWithoutURLOrID", func(t *testing.T) {
+		assert.Error(t, (&OPAIssuancePolicy{}).PutPolicy(ctx, "certdepot", policy))
+		assert.Error(t, (&OPAIssuancePolicy{URL: "http://localhost:8181"}).PutPolicy(ctx, "", policy))
+	})
+}
@@ -0,0 +1,117 @@
+package certdepot
+
+import (
+	"bytes"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
+)
+
+// pemBlockTypes are the PEM block types allowed for each kind of credential
+// in strict PEM mode.
+var pemBlockTypes = map[CredentialKind][]string{
+	CredentialCert:  {"CERTIFICATE"},
+	CredentialChain: {"CERTIFICATE"},
+	CredentialKey:   {"RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY", "ENCRYPTED PRIVATE KEY"},
+	CredentialCSR:   {"CERTIFICATE REQUEST", "NEW CERTIFICATE REQUEST"},
+	CredentialCRL:   {"X509 CRL"},
+}
+
+// checkPEM returns the data to store for the tag. If the options enable strict
+// PEM mode and the tag is for a PEM-encoded credential, it returns an error if
+// the data is not parseable PEM of the credential's kind, and otherwise
+// returns the data normalized to only its PEM blocks, each re-encoded in the
+// standard form. Otherwise, the data is returned as is.
+func checkPEM(do DepotOptions, tag *depot.Tag, data []byte) ([]byte, error) {
+	if !do.StrictPEM {
+		return data, nil
+	}
+	if name, _ := GetNameFromParamTag(tag); name != "" {
+		return data, nil
+	}
+	name, kind, err := ParseTag(tag)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	types, ok := pemBlockTypes[kind]
+	if !ok {
+		return data, nil
+	}
+
+	normalized, err := normalizePEM(data, types, kind != CredentialChain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s for '%s'", kind, name)
+	}
+	if err = parsePEMCredential(kind, normalized); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s for '%s'", kind, name)
+	}
+
+	return normalized, nil
+}
+
+// normalizePEM decodes the PEM blocks in the data, which must all have one of
+// the types, and re-encodes them. Text between blocks, such as the
+// human-readable dump some tools print before a certificate, is dropped, but
+// anything other than whitespace after the last block is rejected as
+// truncated or corrupt.
+func normalizePEM(data []byte, types []string, single bool) ([]byte, error) {
+	out := &bytes.Buffer{}
+	rest := data
+	blocks := 0
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if !containsString(types, block.Type) {
+			return nil, errors.Errorf("unexpected PEM block of type '%s'", block.Type)
+		}
+		if err := pem.Encode(out, block); err != nil {
+			return nil, errors.Wrap(err, "encoding PEM block")
+		}
+		blocks++
+	}
+
+	switch {
+	case blocks == 0:
+		return nil, errors.New("no PEM data found")
+	case single && blocks > 1:
+		return nil, errors.Errorf("expected one PEM block but found %d", blocks)
+	case len(bytes.TrimSpace(rest)) != 0:
+		return nil, errors.New("unexpected data after PEM blocks")
+	}
+
+	return out.Bytes(), nil
+}
+
+// parsePEMCredential checks that the PEM-encoded credential of the kind can
+// be parsed.
+func parsePEMCredential(kind CredentialKind, data []byte) error {
+	var err error
+	switch kind {
+	case CredentialCert:
+		var crt *pkix.Certificate
+		if crt, err = pkix.NewCertificateFromPEM(data); err == nil {
+			_, err = crt.GetRawCertificate()
+		}
+	case CredentialChain:
+		_, err = parsePEMCertificates(data)
+	case CredentialKey:
+		// Encrypted keys cannot be parsed without the passphrase.
+		if !isEncryptedPEM(data) {
+			_, err = pkix.NewKeyFromPrivateKeyPEM(data)
+		}
+	case CredentialCSR:
+		var csr *pkix.CertificateSigningRequest
+		if csr, err = pkix.NewCertificateSigningRequestFromPEM(data); err == nil {
+			_, err = csr.GetRawCertificateSigningRequest()
+		}
+	case CredentialCRL:
+		_, err = pkix.NewCertificateRevocationListFromPEM(data)
+	}
+
+	return errors.Wrap(err, "parsing PEM data")
+}
@@ -0,0 +1,65 @@
+package certdepot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrictPEM(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "pem-validation-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	fileDepot, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour, StrictPEM: true})
+	require.NoError(t, err)
+	memoryDepot, err := NewMemoryDepot(DepotOptions{CA: "root", DefaultExpiration: time.Hour, StrictPEM: true})
+	require.NoError(t, err)
+
+	for depotName, d := range map[string]Depot{"FileDepot": fileDepot, "MemoryDepot": memoryDepot} {
+		t.Run(depotName, func(t *testing.T) {
+			caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+			require.NoError(t, caOpts.Init(d))
+			creds, err := d.Generate("alice")
+			require.NoError(t, err)
+			require.NoError(t, d.Save("alice", creds))
+			csrOpts := CertificateOptions{CommonName: "bob", Host: "bob"}
+			require.NoError(t, csrOpts.CertRequest(d))
+
+			t.Run("RejectsJunk", func(t *testing.T) {
+				assert.Error(t, d.Put(CrtTag("carol"), []byte("carol's fake certificate")))
+				assert.Error(t, d.Put(PrivKeyTag("carol"), []byte("carol's fake key")))
+				assert.Error(t, d.Put(CsrTag("carol"), []byte("")))
+				assert.Error(t, d.Put(CrlTag("carol"), []byte("not a CRL")))
+				assert.False(t, d.Check(CrtTag("carol")))
+			})
+			t.Run("RejectsWrongType", func(t *testing.T) {
+				assert.Error(t, d.Put(PrivKeyTag("carol"), creds.Cert))
+				assert.Error(t, d.Put(CrtTag("carol"), creds.Key))
+				assert.Error(t, d.Put(CrtTag("carol"), append(append([]byte{}, creds.Cert...), creds.Cert...)))
+				assert.Error(t, d.Put(CrtTag("carol"), append(append([]byte{}, creds.Cert...), "trailing junk"...)))
+			})
+			t.Run("NormalizesPEM", func(t *testing.T) {
+				data := append([]byte("Certificate:\n    Data: ...\n"), creds.Cert...)
+				require.NoError(t, d.Put(CrtTag("carol"), data))
+				stored, err := d.Get(CrtTag("carol"))
+				require.NoError(t, err)
+				assert.Equal(t, creds.Cert, stored)
+				require.NoError(t, d.Delete(CrtTag("carol")))
+			})
+			t.Run("AllowsParameters", func(t *testing.T) {
+				require.NoError(t, d.Put(ParamTag("carol", "notes"), []byte("not PEM")))
+			})
+		})
+	}
+	t.Run("DisabledByDefault", func(t *testing.T) {
+		d, err := NewMemoryDepot(DepotOptions{})
+		require.NoError(t, err)
+		assert.NoError(t, d.Put(CrtTag("bob"), []byte("bob's fake certificate")))
+	})
+}
@@ -0,0 +1,224 @@
+package certdepot
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PinSource is the certificate a pin was computed from.
+type PinSource string
+
+const (
+	// PinSourceCurrent is the certificate currently stored for the name.
+	PinSourceCurrent PinSource = "current"
+	// PinSourceNext is the certificate staged to replace the current one
+	// by StageRotation.
+	PinSourceNext PinSource = "next"
+	// PinSourceCA is the depot's CA certificate.
+	PinSourceCA PinSource = "ca"
+)
+
+// PinningOptions configure the pinning manifest generated from a depot.
+type PinningOptions struct {
+	// Names are the names, which are expected to be the pinned domains,
+	// whose certificates are pinned.
+	Names []string `bson:"names" json:"names" yaml:"names"`
+	// IncludeCA, if set, also pins the depot's CA certificate, so that
+	// clients keep working if a certificate is replaced without being
+	// staged first.
+	IncludeCA bool `bson:"include_ca,omitempty" json:"include_ca,omitempty" yaml:"include_ca,omitempty"`
+	// IncludeSubdomains sets whether the pins also apply to the
+	// subdomains of each name.
+	IncludeSubdomains bool `bson:"include_subdomains,omitempty" json:"include_subdomains,omitempty" yaml:"include_subdomains,omitempty"`
+	// MaxAge is how long clients remember the pins. It is required for
+	// HPKP headers.
+	MaxAge time.Duration `bson:"max_age,omitempty" json:"max_age,omitempty" yaml:"max_age,omitempty"`
+	// ReportURIs are where clients report pin validation failures.
+	ReportURIs []string `bson:"report_uris,omitempty" json:"report_uris,omitempty" yaml:"report_uris,omitempty"`
+}
+
+// Validate checks that the options are valid.
+func (opts PinningOptions) Validate() error {
+	if len(opts.Names) == 0 {
+		return errors.New("must specify at least one name to pin")
+	}
+	if opts.MaxAge < 0 {
+		return errors.New("max age cannot be negative")
+	}
+
+	return nil
+}
+
+// Pin is the SPKI hash of a certificate.
+type Pin struct {
+	// Source is the certificate the pin was computed from.
+	Source PinSource `bson:"source" json:"source" yaml:"source"`
+	// SHA256 is the base64-encoded SHA-256 hash of the certificate's
+	// DER-encoded SubjectPublicKeyInfo.
+	SHA256 string `bson:"sha256" json:"sha256" yaml:"sha256"`
+	// NotAfter is when the certificate expires.
+	NotAfter time.Time `bson:"not_after" json:"not_after" yaml:"not_after"`
+}
+
+// PinnedName is the pins for the certificates of a name.
+type PinnedName struct {
+	Name string `bson:"name" json:"name" yaml:"name"`
+	Pins []Pin  `bson:"pins" json:"pins" yaml:"pins"`
+}
+
+// PinningManifest is the pins for the certificates of the selected names in
+// a depot, which can be exported in the formats mobile clients use to pin
+// certificates.
+type PinningManifest struct {
+	GeneratedAt time.Time      `bson:"generated_at" json:"generated_at" yaml:"generated_at"`
+	Names       []PinnedName   `bson:"names" json:"names" yaml:"names"`
+	Options     PinningOptions `bson:"options" json:"options" yaml:"options"`
+}
+
+// spkiHash returns the base64-encoded SHA-256 hash of the certificate's
+// SubjectPublicKeyInfo.
+func spkiHash(crt *x509.Certificate) string {
+	sum := sha256.Sum256(crt.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// GeneratePinningManifest returns the pins for the current certificate of
+// each name in the options and, if a rotation is staged for the name, its
+// next certificate, so that clients accept the next certificate before it is
+// committed. Certificates that share a key share a pin, which is only listed
+// once.
+func GeneratePinningManifest(wd Depot, opts PinningOptions) (*PinningManifest, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid pinning options")
+	}
+
+	var caPin *Pin
+	if opts.IncludeCA {
+		caName := getDepotOptions(wd).CA
+		if caName == "" {
+			return nil, errors.New("depot does not have a CA to pin")
+		}
+		caCrt, err := getRawCertificate(wd, caName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting CA certificate '%s'", caName)
+		}
+		caPin = &Pin{Source: PinSourceCA, SHA256: spkiHash(caCrt), NotAfter: caCrt.NotAfter}
+	}
+
+	manifest := &PinningManifest{GeneratedAt: time.Now().UTC(), Names: []PinnedName{}, Options: opts}
+	for _, name := range opts.Names {
+		name, err := canonicalName(name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		pinned := PinnedName{Name: name, Pins: []Pin{}}
+		add := func(pin Pin) {
+			for _, existing := range pinned.Pins {
+				if existing.SHA256 == pin.SHA256 {
+					return
+				}
+			}
+			pinned.Pins = append(pinned.Pins, pin)
+		}
+
+		crt, err := getRawCertificate(wd, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting certificate '%s'", name)
+		}
+		add(Pin{Source: PinSourceCurrent, SHA256: spkiHash(crt), NotAfter: crt.NotAfter})
+
+		staged, err := CheckCertificateWithError(wd, StagedName(name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "checking for staged certificate for '%s'", name)
+		}
+		if staged {
+			next, err := getRawCertificate(wd, StagedName(name))
+			if err != nil {
+				return nil, errors.Wrapf(err, "getting staged certificate for '%s'", name)
+			}
+			add(Pin{Source: PinSourceNext, SHA256: spkiHash(next), NotAfter: next.NotAfter})
+		}
+		if caPin != nil {
+			add(*caPin)
+		}
+
+		manifest.Names = append(manifest.Names, pinned)
+	}
+
+	return manifest, nil
+}
+
+// HPKPHeaders returns the value of the Public-Key-Pins header for each name.
+// Browsers require at least two pins, so a name with only one pin, such as
+// one with neither a staged certificate nor a pinned CA, is an error.
+func (m *PinningManifest) HPKPHeaders() (map[string]string, error) {
+	if m.Options.MaxAge <= 0 {
+		return nil, errors.New("max age is required for HPKP headers")
+	}
+
+	headers := map[string]string{}
+	for _, pinned := range m.Names {
+		if len(pinned.Pins) < 2 {
+			return nil, errors.Errorf("name '%s' needs at least two pins for HPKP, but has %d", pinned.Name, len(pinned.Pins))
+		}
+		directives := []string{}
+		for _, pin := range pinned.Pins {
+			directives = append(directives, fmt.Sprintf(`pin-sha256="%s"`, pin.SHA256))
+		}
+		directives = append(directives, fmt.Sprintf("max-age=%d", int64(m.Options.MaxAge/time.Second)))
+		if m.Options.IncludeSubdomains {
+			directives = append(directives, "includeSubDomains")
+		}
+		if len(m.Options.ReportURIs) != 0 {
+			directives = append(directives, fmt.Sprintf(`report-uri="%s"`, m.Options.ReportURIs[0]))
+		}
+		headers[pinned.Name] = strings.Join(directives, "; ")
+	}
+
+	return headers, nil
+}
+
+// trustKitDomain is the TrustKit configuration of a pinned domain.
+type trustKitDomain struct {
+	PublicKeyHashes   []string `json:"TSKPublicKeyHashes"`
+	IncludeSubdomains bool     `json:"TSKIncludeSubdomains"`
+	EnforcePinning    bool     `json:"TSKEnforcePinning"`
+	ExpirationDate    string   `json:"TSKExpirationDate,omitempty"`
+	ReportURIs        []string `json:"TSKReportUris,omitempty"`
+}
+
+// TrustKitConfig returns the JSON-encoded TrustKit configuration that
+// enforces the pins for each name. The pins expire when the last of the
+// pinned certificates does.
+func (m *PinningManifest) TrustKitConfig() ([]byte, error) {
+	domains := map[string]trustKitDomain{}
+	for _, pinned := range m.Names {
+		domain := trustKitDomain{
+			PublicKeyHashes:   []string{},
+			IncludeSubdomains: m.Options.IncludeSubdomains,
+			EnforcePinning:    true,
+			ReportURIs:        m.Options.ReportURIs,
+		}
+		var expires time.Time
+		for _, pin := range pinned.Pins {
+			domain.PublicKeyHashes = append(domain.PublicKeyHashes, pin.SHA256)
+			if pin.NotAfter.After(expires) {
+				expires = pin.NotAfter
+			}
+		}
+		if !expires.IsZero() {
+			domain.ExpirationDate = expires.UTC().Format("2006-01-02")
+		}
+		domains[pinned.Name] = domain
+	}
+
+	b, err := json.MarshalIndent(map[string]interface{}{"TSKPinnedDomains": domains}, "", "  ")
+	return b, errors.Wrap(err, "marshalling TrustKit configuration")
+}
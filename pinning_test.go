@@ -0,0 +1,112 @@
+package certdepot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratePinningManifest(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "pinning-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+	for _, name := range []string{"alice.example.com", "bob.example.com"} {
+		creds, err := d.Generate(name)
+		require.NoError(t, err)
+		require.NoError(t, d.Save(name, creds))
+	}
+	_, err = StageRotation(d, "alice.example.com")
+	require.NoError(t, err)
+
+	pin := func(t *testing.T, name string) string {
+		crt, err := getRawCertificate(d, name)
+		require.NoError(t, err)
+		return spkiHash(crt)
+	}
+
+	t.Run("PinsCurrentAndNextCertificates", func(t *testing.T) {
+		m, err := GeneratePinningManifest(d, PinningOptions{Names: []string{"alice.example.com", "bob.example.com"}})
+		require.NoError(t, err)
+		require.Len(t, m.Names, 2)
+
+		alice := m.Names[0]
+		assert.Equal(t, "alice.example.com", alice.Name)
+		require.Len(t, alice.Pins, 2)
+		assert.Equal(t, PinSourceCurrent, alice.Pins[0].Source)
+		assert.Equal(t, pin(t, "alice.example.com"), alice.Pins[0].SHA256)
+		assert.Equal(t, PinSourceNext, alice.Pins[1].Source)
+		assert.Equal(t, pin(t, StagedName("alice.example.com")), alice.Pins[1].SHA256)
+
+		bob := m.Names[1]
+		require.Len(t, bob.Pins, 1)
+		assert.Equal(t, PinSourceCurrent, bob.Pins[0].Source)
+	})
+	t.Run("PinsCA", func(t *testing.T) {
+		m, err := GeneratePinningManifest(d, PinningOptions{Names: []string{"bob.example.com"}, IncludeCA: true})
+		require.NoError(t, err)
+		require.Len(t, m.Names[0].Pins, 2)
+		assert.Equal(t, PinSourceCA, m.Names[0].Pins[1].Source)
+		assert.Equal(t, pin(t, "root"), m.Names[0].Pins[1].SHA256)
+	})
+	t.Run("HPKPHeaders", func(t *testing.T) {
+		m, err := GeneratePinningManifest(d, PinningOptions{
+			Names:             []string{"alice.example.com"},
+			MaxAge:            24 * time.Hour,
+			IncludeSubdomains: true,
+			ReportURIs:        []string{"https://example.com/pkp"},
+		})
+		require.NoError(t, err)
+		headers, err := m.HPKPHeaders()
+		require.NoError(t, err)
+		assert.Equal(t, strings.Join([]string{
+			`pin-sha256="` + pin(t, "alice.example.com") + `"`,
+			`pin-sha256="` + pin(t, StagedName("alice.example.com")) + `"`,
+			"max-age=86400",
+			"includeSubDomains",
+			`report-uri="https://example.com/pkp"`,
+		}, "; "), headers["alice.example.com"])
+
+		m, err = GeneratePinningManifest(d, PinningOptions{Names: []string{"bob.example.com"}, MaxAge: time.Hour})
+		require.NoError(t, err)
+		_, err = m.HPKPHeaders()
+		assert.Error(t, err, "HPKP requires a backup pin")
+		m.Options.MaxAge = 0
+		_, err = m.HPKPHeaders()
+		assert.Error(t, err)
+	})
+	t.Run("TrustKitConfig", func(t *testing.T) {
+		m, err := GeneratePinningManifest(d, PinningOptions{Names: []string{"alice.example.com"}, IncludeSubdomains: true})
+		require.NoError(t, err)
+		b, err := m.TrustKitConfig()
+		require.NoError(t, err)
+
+		config := struct {
+			Domains map[string]trustKitDomain `json:"TSKPinnedDomains"`
+		}{}
+		require.NoError(t, json.Unmarshal(b, &config))
+		domain, ok := config.Domains["alice.example.com"]
+		require.True(t, ok)
+		assert.Equal(t, []string{pin(t, "alice.example.com"), pin(t, StagedName("alice.example.com"))}, domain.PublicKeyHashes)
+		assert.True(t, domain.IncludeSubdomains)
+		assert.True(t, domain.EnforcePinning)
+		assert.NotEmpty(t, domain.ExpirationDate)
+	})
+	t.Run("FailsWithMissingCertificate", func(t *testing.T) {
+		_, err := GeneratePinningManifest(d, PinningOptions{Names: []string{"carol.example.com"}})
+		assert.Error(t, err)
+		_, err = GeneratePinningManifest(d, PinningOptions{})
+		assert.Error(t, err)
+	})
+}
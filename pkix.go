@@ -1,6 +1,9 @@
 package certdepot
 
 import (
+	"crypto"
+	"crypto/x509"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -28,8 +31,75 @@ func CrlTag(prefix string) *depot.Tag {
 	return depot.CrlTag(prefix)
 }
 
-// GetNameFromCrtTag returns the name from a certificate tag.
+// paramTagSeparator separates the name from the parameter in a ParamTag.
+const paramTagSeparator = ".."
+
+// ParamTag returns a tag corresponding to an auxiliary TLS artifact, such as
+// Diffie-Hellman parameters or session ticket keys, that is stored alongside
+// the credentials for the name. The parameter names the artifact and must not
+// be empty or contain "." or "/". Like private keys, parameters are only
+// readable by their owner in a file depot.
+func ParamTag(prefix, param string) *depot.Tag {
+	return depot.PrivKeyTag(prefix + paramTagSeparator + param)
+}
+
+// GetNameFromParamTag returns the name and the parameter from a parameter
+// tag, or empty strings if the tag is not a parameter tag.
+func GetNameFromParamTag(tag *depot.Tag) (string, string) {
+	name := depot.GetNameFromPrivKeyTag(tag)
+	idx := strings.LastIndex(name, paramTagSeparator)
+	if idx <= 0 || idx == len(name)-len(paramTagSeparator) {
+		return "", ""
+	}
+
+	return name[:idx], name[idx+len(paramTagSeparator):]
+}
+
+// chainTagSuffix is appended to the name in a ChainTag.
+const chainTagSuffix = paramTagSeparator + "chain"
+
+// ChainTag returns a tag corresponding to the PEM-encoded chain of
+// intermediate CA certificates that issued the certificate for the name,
+// starting with the certificate's issuer.
+func ChainTag(prefix string) *depot.Tag {
+	return depot.CrtTag(prefix + chainTagSuffix)
+}
+
+// GetNameFromChainTag returns the name from a certificate chain tag.
+func GetNameFromChainTag(tag *depot.Tag) string {
+	name := depot.GetNameFromCrtTag(tag)
+	if len(name) <= len(chainTagSuffix) || !strings.HasSuffix(name, chainTagSuffix) {
+		return ""
+	}
+
+	return strings.TrimSuffix(name, chainTagSuffix)
+}
+
+// sshCertTagSuffix is appended to the name in an SSHCertTag.
+const sshCertTagSuffix = paramTagSeparator + "ssh"
+
+// SSHCertTag returns a tag corresponding to the OpenSSH certificate for the
+// name.
+func SSHCertTag(prefix string) *depot.Tag {
+	return depot.CrtTag(prefix + sshCertTagSuffix)
+}
+
+// GetNameFromSSHCertTag returns the name from an SSH certificate tag.
+func GetNameFromSSHCertTag(tag *depot.Tag) string {
+	name := depot.GetNameFromCrtTag(tag)
+	if len(name) <= len(sshCertTagSuffix) || !strings.HasSuffix(name, sshCertTagSuffix) {
+		return ""
+	}
+
+	return strings.TrimSuffix(name, sshCertTagSuffix)
+}
+
+// GetNameFromCrtTag returns the name from a certificate tag. It returns an
+// empty string for a certificate chain tag or SSH certificate tag.
 func GetNameFromCrtTag(tag *depot.Tag) string {
+	if GetNameFromChainTag(tag) != "" || GetNameFromSSHCertTag(tag) != "" {
+		return ""
+	}
 	return depot.GetNameFromCrtTag(tag)
 }
 
@@ -48,6 +118,89 @@ func GetNameFromCrlTag(tag *depot.Tag) string {
 	return depot.GetNameFromCrlTag(tag)
 }
 
+func getNameFromTag(tag *depot.Tag) string {
+	if name, _ := GetNameFromParamTag(tag); name != "" {
+		return name
+	}
+	for _, getName := range []func(*depot.Tag) string{
+		GetNameFromCrtTag,
+		GetNameFromChainTag,
+		GetNameFromSSHCertTag,
+		GetNameFromPrivKeyTag,
+		GetNameFromCsrTag,
+		GetNameFromCrlTag,
+	} {
+		if name := getName(tag); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// GetIfExists returns the data for the tag and true if it exists in the depot,
+// or nil and false if it does not. Depots that implement IfExistsGetter do so
+// in a single operation; for other depots, this falls back to CheckWithError
+// followed by Get.
+func GetIfExists(d Depot, tag *depot.Tag) ([]byte, bool, error) {
+	if getter, ok := d.(IfExistsGetter); ok {
+		return getter.GetIfExists(tag)
+	}
+
+	exists, err := d.CheckWithError(tag)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "checking tag")
+	}
+	if !exists {
+		return nil, false, nil
+	}
+
+	data, err := d.Get(tag)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "getting tag")
+	}
+
+	return data, true, nil
+}
+
+// GetAll returns the certificate, private key, certificate request, and
+// certificate revocation list stored for the name in the depot, leaving fields
+// for data that does not exist empty. Depots that implement AllGetter do so in
+// a single operation; for other depots, this falls back to GetIfExists for
+// each tag. An error is returned if no data exists for the name.
+func GetAll(d Depot, name string) (*User, error) {
+	if getter, ok := d.(AllGetter); ok {
+		return getter.GetAll(name)
+	}
+
+	return getAllByTag(d, name)
+}
+
+// getAllByTag gets the data stored for the name by reading each tag
+// separately.
+func getAllByTag(d Depot, name string) (*User, error) {
+	u := &User{ID: name}
+	found := false
+	for _, kind := range CredentialKinds {
+		tag, err := kind.Tag(name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		data, exists, err := GetIfExists(d, tag)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting data for name '%s'", name)
+		}
+		if exists {
+			*u.kindField(kind) = string(data)
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.Errorf("name '%s' not found", name)
+	}
+
+	return u, nil
+}
+
 // PutCertificate creates a certificate for a given name in the depot.
 func PutCertificate(d Depot, name string, crt *pkix.Certificate) error {
 	return depot.PutCertificate(d, name, crt)
@@ -71,8 +224,21 @@ func GetCertificate(d Depot, name string) (crt *pkix.Certificate, err error) {
 	return depot.GetCertificate(d, name)
 }
 
-// DeleteCertificate removes a certificate for a given name from the depot.
+// GetPKIXCertificate retrieves and parses the certificate for a given name
+// from the depot.
+func GetPKIXCertificate(d Depot, name string) (*x509.Certificate, error) {
+	crt, err := getRawCertificate(d, name)
+	return crt, errors.Wrapf(err, "getting certificate for '%s'", name)
+}
+
+// DeleteCertificate removes a certificate for a given name from the depot. If
+// the certificate is a CA that unexpired certificates in the depot still chain
+// to, it returns a CAInUseError instead; use DeleteCA with Force to delete it
+// anyway.
 func DeleteCertificate(d Depot, name string) error {
+	if err := checkCADeletion(depotContext(d), d, name, DeleteCAOptions{}); err != nil {
+		return errors.WithStack(err)
+	}
 	return depot.DeleteCertificate(d, name)
 }
 
@@ -102,6 +268,21 @@ func GetCertificateSigningRequest(d Depot, name string) (crt *pkix.CertificateSi
 	return depot.GetCertificateSigningRequest(d, name)
 }
 
+// GetPKIXCSR retrieves and parses the certificate signing request for a given
+// name from the depot.
+func GetPKIXCSR(d Depot, name string) (*x509.CertificateRequest, error) {
+	csr, err := depot.GetCertificateSigningRequest(d, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting certificate signing request for '%s'", name)
+	}
+	rawCSR, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing certificate signing request for '%s'", name)
+	}
+
+	return rawCSR, nil
+}
+
 // DeleteCertificateSigningRequest removes a certificate signing request for a
 // given name from the depot.
 func DeleteCertificateSigningRequest(d Depot, name string) error {
@@ -131,6 +312,21 @@ func GetPrivateKey(d Depot, name string) (key *pkix.Key, err error) {
 	return depot.GetPrivateKey(d, name)
 }
 
+// GetPKIXKey retrieves and parses the unencrypted private key for a given name
+// from the depot.
+func GetPKIXKey(d Depot, name string) (crypto.Signer, error) {
+	key, err := depot.GetPrivateKey(d, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting private key for '%s'", name)
+	}
+	signer, ok := key.Private.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("private key for '%s' of type %T cannot sign", name, key.Private)
+	}
+
+	return signer, nil
+}
+
 // DeletePrivateKey removes a private key for a given name from the depot. This
 // works for both encrypted and unencrypted private keys.
 func DeletePrivateKey(d Depot, name string) error {
@@ -164,11 +360,12 @@ func DeleteCertificateRevocationList(d Depot, name string) error {
 	return d.Delete(depot.CrlTag(name))
 }
 
-// PutTTL puts a new TTL for a given name in the mongo depot.
+// putTTL puts a new TTL for a given name in the depot if the depot implements
+// ExpiryTracker.
 func putTTL(d Depot, name string, expiration time.Time) error {
-	md, ok := d.(*mongoDepot)
+	tracker, ok := d.(ExpiryTracker)
 	if !ok {
-		return errors.New("cannot put TTL if depot is not a mongo depot")
+		return nil
 	}
-	return md.PutTTL(name, expiration)
+	return tracker.PutTTL(name, expiration)
 }
@@ -0,0 +1,123 @@
+package certdepot
+
+import (
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParamTag(t *testing.T) {
+	t.Run("RoundTrips", func(t *testing.T) {
+		name, param := GetNameFromParamTag(ParamTag("my_host", "dhparam"))
+		assert.Equal(t, "my_host", name)
+		assert.Equal(t, "dhparam", param)
+	})
+	t.Run("IgnoresOtherTags", func(t *testing.T) {
+		for _, tag := range []*depot.Tag{
+			CrtTag("my_host"),
+			PrivKeyTag("my_host"),
+			PrivKeyTag("my_host.."),
+			PrivKeyTag("..dhparam"),
+			CsrTag("my_host..dhparam"),
+		} {
+			name, param := GetNameFromParamTag(tag)
+			assert.Empty(t, name)
+			assert.Empty(t, param)
+		}
+	})
+	t.Run("IsStoredWithName", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir(".", "param-tag-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		}()
+		d, err := NewFileDepot(tempDir)
+		require.NoError(t, err)
+
+		require.NoError(t, d.Put(ParamTag("alice", "dhparam"), []byte("params")))
+		assert.False(t, d.Check(PrivKeyTag("alice")))
+		names, err := d.(NameLister).ListNames()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"alice"}, names)
+	})
+}
+
+func TestChainTag(t *testing.T) {
+	assert.Equal(t, "my_host", GetNameFromChainTag(ChainTag("my_host")))
+	assert.Empty(t, GetNameFromCrtTag(ChainTag("my_host")))
+	assert.Empty(t, GetNameFromChainTag(CrtTag("my_host")))
+	assert.Empty(t, GetNameFromChainTag(CrtTag("..chain")))
+	assert.Equal(t, "my_host", GetNameFromCrtTag(CrtTag("my_host")))
+
+	name, key, err := getNameAndKey(ChainTag("my host"))
+	require.NoError(t, err)
+	assert.Equal(t, "my_host", name)
+	assert.Equal(t, userChainKey, key)
+}
+
+func TestSSHCertTag(t *testing.T) {
+	assert.Equal(t, "my_host", GetNameFromSSHCertTag(SSHCertTag("my_host")))
+	assert.Empty(t, GetNameFromSSHCertTag(CrtTag("my_host")))
+	assert.Empty(t, GetNameFromCrtTag(SSHCertTag("my_host")))
+	assert.Equal(t, "my_host", getNameFromTag(SSHCertTag("my_host")))
+
+	name, key, err := getNameAndKey(SSHCertTag("my host"))
+	require.NoError(t, err)
+	assert.Equal(t, "my_host", name)
+	assert.Equal(t, userSSHCertKey, key)
+
+	u := &User{SSHCert: "ssh cert", Params: map[string]string{"dhparam": "params"}}
+	assert.Equal(t, []byte("ssh cert"), userData(u, key))
+	_, key, err = getNameAndKey(ParamTag("my_host", "dhparam"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("params"), userData(u, key))
+}
+
+func TestGetPKIX(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "get-pkix-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+	opts := CertificateOptions{CommonName: "my_host", Host: "my_host", CA: "root", Expires: time.Hour}
+	require.NoError(t, opts.CreateCertificate(d))
+
+	t.Run("Certificate", func(t *testing.T) {
+		crt, err := GetPKIXCertificate(d, "my_host")
+		require.NoError(t, err)
+		assert.Equal(t, "my_host", crt.Subject.CommonName)
+
+		_, err = GetPKIXCertificate(d, "nonexistent")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "nonexistent")
+	})
+	t.Run("Key", func(t *testing.T) {
+		key, err := GetPKIXKey(d, "my_host")
+		require.NoError(t, err)
+		crt, err := GetPKIXCertificate(d, "my_host")
+		require.NoError(t, err)
+		assert.True(t, key.Public().(*rsa.PublicKey).Equal(crt.PublicKey))
+
+		_, err = GetPKIXKey(d, "nonexistent")
+		assert.Error(t, err)
+	})
+	t.Run("CSR", func(t *testing.T) {
+		csr, err := GetPKIXCSR(d, "my_host")
+		require.NoError(t, err)
+		assert.Equal(t, "my_host", csr.Subject.CommonName)
+		assert.NoError(t, csr.CheckSignature())
+
+		_, err = GetPKIXCSR(d, "root")
+		assert.Error(t, err)
+	})
+}
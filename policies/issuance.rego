@@ -0,0 +1,39 @@
+# Default certificate issuance policy for certdepot. Load it into an OPA
+# server with OPAIssuancePolicy.PutPolicy and evaluate it at the path
+# "certdepot/issuance". The input is a JSON-encoded IssuanceRequest.
+package certdepot.issuance
+
+import rego.v1
+
+# Maximum lifetime of a leaf certificate, in nanoseconds (90 days).
+max_expires := ((90 * 24) * 60) * 60000000000
+
+default allow := false
+
+allow if count(reasons) == 0
+
+reasons contains msg if {
+	input.root_ca
+	msg := "root CAs must be created out of band"
+}
+
+reasons contains msg if {
+	input.intermediate
+	msg := "intermediate CAs must be created out of band"
+}
+
+reasons contains msg if {
+	startswith(input.cn, "*")
+	msg := sprintf("wildcard common name '%s' is not allowed", [input.cn])
+}
+
+reasons contains msg if {
+	some name in input.dns
+	startswith(name, "*")
+	msg := sprintf("wildcard DNS name '%s' is not allowed", [name])
+}
+
+reasons contains msg if {
+	input.expires > max_expires
+	msg := "certificate lifetime exceeds 90 days"
+}
@@ -0,0 +1,133 @@
+package certdepot
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PreviousSuffix is appended to a name to get the name under which Save
+// retains the credentials it replaces when the depot has a
+// PreviousGracePeriod.
+const PreviousSuffix = "-previous"
+
+// retainUntilParam is the parameter that holds when retained credentials
+// should no longer be used.
+const retainUntilParam = "retain_until"
+
+// PreviousName returns the name under which the credentials replaced for the
+// name are retained.
+func PreviousName(name string) string {
+	return name + PreviousSuffix
+}
+
+// isPreviousOf returns whether the name is the previous name of any of the
+// names in the set.
+func isPreviousOf(name string, names map[string]bool) bool {
+	base := strings.TrimSuffix(name, PreviousSuffix)
+	return base != name && names[base]
+}
+
+// retainPrevious copies the credentials currently stored under the name, if
+// any, to its previous name, replacing any credentials retained before. They
+// are retained until the grace period elapses or the certificate expires,
+// whichever is first.
+func retainPrevious(dpt Depot, name string, grace time.Duration) error {
+	leaf, exists, err := GetIfExists(dpt, CrtTag(name))
+	if err != nil {
+		return errors.Wrap(err, "getting certificate")
+	}
+	if !exists {
+		return nil
+	}
+	key, exists, err := GetIfExists(dpt, PrivKeyTag(name))
+	if err != nil {
+		return errors.Wrap(err, "getting key")
+	}
+	if !exists {
+		return nil
+	}
+	defer zeroBytes(key)
+	chain, hasChain, err := GetIfExists(dpt, ChainTag(name))
+	if err != nil {
+		return errors.Wrap(err, "getting certificate chain")
+	}
+
+	crts, err := parsePEMCertificates(leaf)
+	if err != nil {
+		return errors.Wrap(err, "parsing certificate")
+	}
+	if len(crts) == 0 {
+		return errors.New("certificate is not PEM-encoded")
+	}
+	retainUntil := time.Now().Add(grace).UTC()
+	if crts[0].NotAfter.Before(retainUntil) {
+		retainUntil = crts[0].NotAfter.UTC()
+	}
+
+	prev := PreviousName(name)
+	if err = deletePrevious(dpt, name); err != nil {
+		return errors.Wrap(err, "deleting previously retained credentials")
+	}
+	if err = dpt.Put(PrivKeyTag(prev), key); err != nil {
+		return errors.Wrap(err, "saving key")
+	}
+	if err = dpt.Put(CrtTag(prev), leaf); err != nil {
+		return errors.Wrap(err, "saving certificate")
+	}
+	if hasChain {
+		if err = dpt.Put(ChainTag(prev), chain); err != nil {
+			return errors.Wrap(err, "saving certificate chain")
+		}
+	}
+	if err = dpt.Put(ParamTag(prev, retainUntilParam), []byte(retainUntil.Format(time.RFC3339Nano))); err != nil {
+		return errors.Wrap(err, "saving retention deadline")
+	}
+
+	return errors.Wrap(putTTL(dpt, prev, retainUntil), "putting expiration on retained credentials")
+}
+
+// deletePrevious removes the credentials retained for the name.
+func deletePrevious(dpt Depot, name string) error {
+	prev := PreviousName(name)
+	return deleteIfExists(dpt, PrivKeyTag(prev), CrtTag(prev), ChainTag(prev), ParamTag(prev, retainUntilParam))
+}
+
+// FindPrevious returns the credentials that were replaced for the name by the
+// most recent Save, so that connections established with them can drain. It
+// returns an error if no credentials are retained for the name or their grace
+// period has elapsed, in which case they are removed from the depot.
+func FindPrevious(wd Depot, name string) (*Credentials, error) {
+	name, err := canonicalName(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	prev := PreviousName(name)
+
+	deadline, exists, err := GetIfExists(wd, ParamTag(prev, retainUntilParam))
+	if err != nil {
+		return nil, errors.Wrap(err, "getting retention deadline")
+	}
+	if !exists {
+		return nil, errors.Errorf("no previous credentials retained for '%s'", name)
+	}
+	retainUntil, err := time.Parse(time.RFC3339Nano, string(deadline))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing retention deadline")
+	}
+	if !time.Now().Before(retainUntil) {
+		if err = deletePrevious(wd, name); err != nil {
+			return nil, errors.Wrap(err, "deleting expired previous credentials")
+		}
+		return nil, errors.Errorf("grace period for previous credentials of '%s' elapsed at %s", name, retainUntil)
+	}
+
+	creds, err := depotFind(wd, prev, getDepotOptions(wd))
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding previous credentials for '%s'", name)
+	}
+	creds.ServerName = name
+
+	return creds, nil
+}
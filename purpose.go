@@ -0,0 +1,125 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/x509"
+
+	"github.com/pkg/errors"
+)
+
+// CertificatePurpose is what a certificate is used for, which determines its
+// extended key usages.
+type CertificatePurpose string
+
+const (
+	// PurposeServer is for certificates that identify servers to clients.
+	PurposeServer CertificatePurpose = "server"
+	// PurposeClient is for certificates that identify clients to servers.
+	PurposeClient CertificatePurpose = "client"
+	// PurposePeer is for certificates that identify both servers and
+	// clients, such as cluster members that connect to each other. It is
+	// the purpose of certificates issued without an explicit purpose.
+	PurposePeer CertificatePurpose = "peer"
+	// PurposeSigning is for certificates that sign code or artifacts.
+	PurposeSigning CertificatePurpose = "signing"
+)
+
+// Validate checks that the purpose is known.
+func (p CertificatePurpose) Validate() error {
+	_, err := p.extKeyUsages()
+	return err
+}
+
+// extKeyUsages returns the extended key usages of certificates for the
+// purpose.
+func (p CertificatePurpose) extKeyUsages() ([]x509.ExtKeyUsage, error) {
+	switch p {
+	case PurposeServer:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, nil
+	case PurposeClient:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, nil
+	case PurposePeer:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, nil
+	case PurposeSigning:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, nil
+	default:
+		return nil, errors.Errorf("unknown certificate purpose '%s'", p)
+	}
+}
+
+// certificatePurpose returns the purpose of the certificate from its extended
+// key usages, or an empty purpose if it is a CA or its usages do not match a
+// purpose.
+func certificatePurpose(crt *x509.Certificate) CertificatePurpose {
+	if crt.IsCA {
+		return ""
+	}
+
+	var server, client, signing, other bool
+	for _, usage := range crt.ExtKeyUsage {
+		switch usage {
+		case x509.ExtKeyUsageServerAuth:
+			server = true
+		case x509.ExtKeyUsageClientAuth:
+			client = true
+		case x509.ExtKeyUsageCodeSigning:
+			signing = true
+		case x509.ExtKeyUsageAny:
+			server, client = true, true
+		default:
+			other = true
+		}
+	}
+
+	switch {
+	case other || (signing && (server || client)):
+		return ""
+	case signing:
+		return PurposeSigning
+	case server && client:
+		return PurposePeer
+	case server:
+		return PurposeServer
+	case client:
+		return PurposeClient
+	default:
+		// A certificate without extended key usages may be used for
+		// anything.
+		return PurposePeer
+	}
+}
+
+// GetCertificatePurpose returns the purpose of the certificate stored under
+// the name, as recorded in its extended key usages when it was issued. The
+// purpose is empty if the certificate is a CA or was issued outside of the
+// depot with usages that do not match a purpose.
+func GetCertificatePurpose(wd Depot, name string) (CertificatePurpose, error) {
+	crt, err := getRawCertificate(wd, name)
+	if err != nil {
+		return "", errors.Wrapf(err, "getting certificate '%s'", name)
+	}
+	return certificatePurpose(crt), nil
+}
+
+// ListCertificatesByPurpose returns the expiration of every certificate in the
+// depot with the purpose, sorted by name, so that audits can find, for
+// example, every stored client identity. The depot must implement NameLister.
+func ListCertificatesByPurpose(ctx context.Context, wd Depot, purpose CertificatePurpose) ([]CertificateExpiration, error) {
+	if err := purpose.Validate(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	expirations, err := ListCertificateExpirations(ctx, wd)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	matching := []CertificateExpiration{}
+	for _, exp := range expirations {
+		if exp.Purpose == purpose {
+			matching = append(matching, exp)
+		}
+	}
+
+	return matching, nil
+}
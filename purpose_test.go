@@ -0,0 +1,96 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificatePurpose(t *testing.T) {
+	ctx := context.TODO()
+	tempDir, err := ioutil.TempDir(".", "purpose-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+
+	for name, purpose := range map[string]CertificatePurpose{
+		"web":     PurposeServer,
+		"alice":   PurposeClient,
+		"node":    PurposePeer,
+		"release": PurposeSigning,
+		"default": "",
+	} {
+		creds, err := d.GenerateWithOptions(CertificateOptions{CommonName: name, Host: name, Purpose: purpose})
+		require.NoError(t, err)
+		require.NoError(t, d.Save(name, creds))
+	}
+
+	t.Run("RecordsPurposeInCertificate", func(t *testing.T) {
+		crt, err := getRawCertificate(d, "web")
+		require.NoError(t, err)
+		assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, crt.ExtKeyUsage)
+		crt, err = getRawCertificate(d, "release")
+		require.NoError(t, err)
+		assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, crt.ExtKeyUsage)
+
+		for name, expected := range map[string]CertificatePurpose{
+			"web":     PurposeServer,
+			"alice":   PurposeClient,
+			"node":    PurposePeer,
+			"release": PurposeSigning,
+			"default": PurposePeer,
+			"root":    "",
+		} {
+			purpose, err := GetCertificatePurpose(d, name)
+			require.NoError(t, err)
+			assert.Equal(t, expected, purpose, name)
+		}
+		_, err = GetCertificatePurpose(d, "nonexistent")
+		assert.Error(t, err)
+	})
+	t.Run("ListsCertificatesByPurpose", func(t *testing.T) {
+		peers, err := ListCertificatesByPurpose(ctx, d, PurposePeer)
+		require.NoError(t, err)
+		require.Len(t, peers, 2)
+		assert.Equal(t, "default", peers[0].Name)
+		assert.Equal(t, "node", peers[1].Name)
+
+		clients, err := ListCertificatesByPurpose(ctx, d, PurposeClient)
+		require.NoError(t, err)
+		require.Len(t, clients, 1)
+		assert.Equal(t, "alice", clients[0].Name)
+		assert.Equal(t, PurposeClient, clients[0].Purpose)
+
+		_, err = ListCertificatesByPurpose(ctx, d, "admin")
+		assert.Error(t, err)
+	})
+	t.Run("RecordsPurposeInVerifyReport", func(t *testing.T) {
+		report, err := VerifyDepot(ctx, d)
+		require.NoError(t, err)
+		for _, entry := range report.Entries {
+			if entry.Name == "web" {
+				assert.Equal(t, PurposeServer, entry.Purpose)
+			}
+		}
+	})
+	t.Run("RejectsInvalidPurposes", func(t *testing.T) {
+		_, err := d.GenerateWithOptions(CertificateOptions{CommonName: "bob", Host: "bob", Purpose: "admin"})
+		assert.Error(t, err)
+
+		opts := CertificateOptions{CommonName: "other-root", Expires: time.Hour, Purpose: PurposeServer}
+		assert.Error(t, opts.Init(d))
+		opts = CertificateOptions{CommonName: "intermediate", Host: "intermediate", CA: "root", Intermediate: true, Purpose: PurposeServer}
+		assert.Error(t, opts.Validate(OperationSign))
+	})
+}
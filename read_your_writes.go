@@ -0,0 +1,87 @@
+package certdepot
+
+import (
+	"sync"
+	"time"
+)
+
+// recentWritesPruneSize is the number of tracked names above which expired
+// names are pruned when a write is recorded.
+const recentWritesPruneSize = 1024
+
+// recentWrites tracks when the depot last wrote each name so that reads of
+// the name can go to the primary for a window afterwards.
+type recentWrites struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	names map[string]time.Time
+	// all is when the depot last wrote a set of names it did not track
+	// individually, such as in a bulk delete, or when it last wrote any
+	// name, for reads across names.
+	all time.Time
+}
+
+// record records a write of the name. An empty name records a write of names
+// that are not known individually.
+func (w *recentWrites) record(name string) {
+	if w.window <= 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if name == "" {
+		w.all = now
+		return
+	}
+	if w.names == nil {
+		w.names = map[string]time.Time{}
+	}
+	if len(w.names) >= recentWritesPruneSize {
+		for written, at := range w.names {
+			if now.Sub(at) >= w.window {
+				delete(w.names, written)
+			}
+		}
+	}
+	w.names[name] = now
+}
+
+// recent returns whether the name was written within the window. An empty
+// name returns whether any name was written within the window.
+func (w *recentWrites) recent(name string) bool {
+	if w.window <= 0 {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.all) < w.window {
+		return true
+	}
+	if name == "" {
+		for _, at := range w.names {
+			if now.Sub(at) < w.window {
+				return true
+			}
+		}
+		return false
+	}
+	at, ok := w.names[name]
+	return ok && now.Sub(at) < w.window
+}
+
+// readColl returns the collection to read the name from, which is read from
+// the primary if the depot wrote the name within the read-your-writes window.
+// An empty name is for reads across names.
+func (m *mongoDepot) readColl(name string) MongoDBCollection {
+	if m.recentWrites.recent(name) {
+		return m.primaryColl
+	}
+	return m.coll
+}
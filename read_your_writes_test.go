@@ -0,0 +1,79 @@
+package certdepot
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestReadYourWrites(t *testing.T) {
+	ctx := context.TODO()
+
+	t.Run("TracksWritesWithinWindow", func(t *testing.T) {
+		w := recentWrites{window: 50 * time.Millisecond}
+		assert.False(t, w.recent("alice"))
+		assert.False(t, w.recent(""))
+
+		w.record("alice")
+		assert.True(t, w.recent("alice"))
+		assert.True(t, w.recent(""))
+		assert.False(t, w.recent("bob"))
+
+		time.Sleep(60 * time.Millisecond)
+		assert.False(t, w.recent("alice"))
+		assert.False(t, w.recent(""))
+
+		w.record("")
+		assert.True(t, w.recent("bob"))
+	})
+	t.Run("PrunesExpiredNames", func(t *testing.T) {
+		w := recentWrites{window: time.Minute}
+		expired := time.Now().Add(-time.Hour)
+		w.names = map[string]time.Time{}
+		for i := 0; i < recentWritesPruneSize; i++ {
+			w.names[fmt.Sprintf("name-%d", i)] = expired
+		}
+		w.record("alice")
+		assert.Len(t, w.names, 1)
+		assert.True(t, w.recent("alice"))
+	})
+	t.Run("DisabledWithoutWindow", func(t *testing.T) {
+		w := recentWrites{}
+		w.record("alice")
+		assert.False(t, w.recent("alice"))
+		assert.Nil(t, w.names)
+	})
+	t.Run("MongoDB", func(t *testing.T) {
+		d, err := NewMongoDBCertDepot(ctx, &MongoDBOptions{
+			MongoDBURI:           testMongoDBURI(),
+			DatabaseName:         "certDepot",
+			CollectionName:       "read_your_writes",
+			DepotOptions:         DepotOptions{CA: "root", DefaultExpiration: time.Hour},
+			ReadYourWritesWindow: time.Minute,
+		})
+		require.NoError(t, err)
+		m := d.(*mongoDepot)
+		defer func() {
+			assert.NoError(t, m.coll.(*mongo.Collection).Drop(ctx))
+			assert.NoError(t, m.metadataCollection().(*mongo.Collection).Drop(ctx))
+		}()
+		assert.NotSame(t, m.coll, m.primaryColl)
+		assert.Equal(t, m.coll, m.readColl("alice"))
+
+		caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+		require.NoError(t, caOpts.Init(d))
+		creds, err := d.Generate("alice")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("alice", creds))
+		assert.Equal(t, m.primaryColl, m.readColl("alice"))
+
+		found, err := d.Find("alice")
+		require.NoError(t, err)
+		assert.Equal(t, creds.Cert, found.Cert)
+	})
+}
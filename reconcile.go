@@ -0,0 +1,262 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+// CertificateSpec declares a certificate that should exist in the depot.
+type CertificateSpec struct {
+	// Name is the name of the service the certificate is for.
+	Name string `bson:"name" json:"name" yaml:"name"`
+	// Options to create and renew the certificate, as for
+	// EnsureServiceCertificate.
+	EnsureServiceCertificateOptions `bson:",inline" json:",inline" yaml:",inline"`
+}
+
+// NewCertificateSpecsFromFile parses the JSON list of certificate specs in the
+// file at path.
+func NewCertificateSpecsFromFile(path string) ([]CertificateSpec, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading certificate specs file")
+	}
+
+	specs := []CertificateSpec{}
+	if err = json.Unmarshal(contents, &specs); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling JSON contents of certificate specs file")
+	}
+
+	return specs, nil
+}
+
+// ReconcileAction is an action taken to converge the depot to the desired
+// state.
+type ReconcileAction string
+
+const (
+	// ReconcileCreate issues a certificate that does not exist.
+	ReconcileCreate ReconcileAction = "create"
+	// ReconcileRenew replaces an existing certificate that does not satisfy
+	// its spec.
+	ReconcileRenew ReconcileAction = "renew"
+	// ReconcileDelete removes a certificate that is not in the desired
+	// state.
+	ReconcileDelete ReconcileAction = "delete"
+)
+
+// ReconcileChange describes a change made to converge the depot to the
+// desired state.
+type ReconcileChange struct {
+	// Name is the name the certificate is stored under.
+	Name string `bson:"name" json:"name" yaml:"name"`
+	// Action is the action taken on the certificate.
+	Action ReconcileAction `bson:"action" json:"action" yaml:"action"`
+	// Reason is why the action was taken.
+	Reason string `bson:"reason" json:"reason" yaml:"reason"`
+}
+
+// ReconcileResult is the difference between the depot and the desired state.
+type ReconcileResult struct {
+	// Applied is whether the changes were made to the depot, or are only
+	// planned.
+	Applied bool `bson:"applied" json:"applied" yaml:"applied"`
+	// Changes are the changes made, or planned to be made, to the depot, in
+	// the order they are made.
+	Changes []ReconcileChange `bson:"changes" json:"changes" yaml:"changes"`
+	// Unchanged are the names of the certificates that already satisfied
+	// their spec.
+	Unchanged []string `bson:"unchanged" json:"unchanged" yaml:"unchanged"`
+}
+
+// Summary returns the number of changes for each action.
+func (r *ReconcileResult) Summary() map[ReconcileAction]int {
+	summary := map[ReconcileAction]int{
+		ReconcileCreate: 0,
+		ReconcileRenew:  0,
+		ReconcileDelete: 0,
+	}
+	for _, change := range r.Changes {
+		summary[change.Action]++
+	}
+
+	return summary
+}
+
+// HasChanges returns whether any changes were made, or are planned.
+func (r *ReconcileResult) HasChanges() bool {
+	return len(r.Changes) != 0
+}
+
+// Export exports the result into indented JSON, including a summary of the
+// number of changes for each action, so that it can be posted for review.
+func (r *ReconcileResult) Export() ([]byte, error) {
+	b, err := json.MarshalIndent(struct {
+		*ReconcileResult
+		Summary map[ReconcileAction]int `json:"summary"`
+	}{ReconcileResult: r, Summary: r.Summary()}, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "exporting reconcile result")
+	}
+
+	return b, nil
+}
+
+// ReconcileOptions configure how the depot is converged to the desired state.
+type ReconcileOptions struct {
+	// Plan is whether to only compute the changes instead of making them.
+	Plan bool `bson:"plan,omitempty" json:"plan,omitempty" yaml:"plan,omitempty"`
+	// WorkerPoolOptions configure how many certificates are checked and
+	// converged at once.
+	WorkerPoolOptions `bson:",inline" json:",inline" yaml:",inline"`
+}
+
+// Reconcile converges the depot to the desired list of certificates. Each
+// certificate in the list is issued or renewed as EnsureServiceCertificate
+// would. Every other certificate in the depot is deleted, except for CA
+// certificates and the private keys of names that do not have a certificate.
+// The depot must implement NameLister. Failing to converge one certificate
+// does not stop the others from being converged; the returned result contains
+// the changes that were made and the error contains every failure.
+func Reconcile(ctx context.Context, wd Depot, desired []CertificateSpec) (*ReconcileResult, error) {
+	return ReconcileWithOptions(ctx, wd, desired, ReconcileOptions{})
+}
+
+// PlanReconcile returns the changes that Reconcile would make to converge the
+// depot to the desired list of certificates, without making them, so that the
+// plan can be reviewed before it is applied.
+func PlanReconcile(ctx context.Context, wd Depot, desired []CertificateSpec) (*ReconcileResult, error) {
+	return ReconcileWithOptions(ctx, wd, desired, ReconcileOptions{Plan: true})
+}
+
+// ReconcileWithOptions is the same as Reconcile, or PlanReconcile if the
+// options only plan the changes, but converges several certificates at once
+// according to the options. The changes in the result are in the same order
+// regardless of how many certificates are converged at once.
+func ReconcileWithOptions(ctx context.Context, wd Depot, desired []CertificateSpec, opts ReconcileOptions) (*ReconcileResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+	lister, ok := wd.(NameLister)
+	if !ok {
+		return nil, errors.New("depot does not support listing entries")
+	}
+	apply := !opts.Plan
+
+	keep := map[string]bool{}
+	scs := make([]*serviceCertificate, 0, len(desired))
+	for _, spec := range desired {
+		sc, err := newServiceCertificate(wd, spec.Name, spec.EnsureServiceCertificateOptions)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving spec for '%s'", spec.Name)
+		}
+		if keep[sc.name] {
+			return nil, errors.Errorf("certificate '%s' is specified more than once", sc.name)
+		}
+		keep[sc.name] = true
+		keep[sc.csrName] = true
+		keep[formatName(sc.opts.CA)] = true
+		scs = append(scs, sc)
+	}
+
+	names, err := lister.ListNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing depot entries")
+	}
+	sort.Strings(names)
+
+	res := &ReconcileResult{Applied: apply, Changes: []ReconcileChange{}, Unchanged: []string{}}
+	catcher := grip.NewBasicCatcher()
+
+	changes := make([]*ReconcileChange, len(scs))
+	unchanged := make([]bool, len(scs))
+	errs, ctxErr := forEachParallel(ctx, opts.WorkerPoolOptions, len(scs), func(_ context.Context, i int) error {
+		sc := scs[i]
+		reason, err := sc.renewalReason(wd)
+		if err != nil {
+			return errors.Wrapf(err, "checking existing certificate '%s'", sc.name)
+		}
+		if reason == "" {
+			unchanged[i] = true
+			return nil
+		}
+
+		action := ReconcileRenew
+		if reason == certificateNotExistReason {
+			action = ReconcileCreate
+		}
+		if apply {
+			if err = sc.issue(wd, reason); err != nil {
+				return errors.Wrapf(err, "issuing certificate '%s'", sc.name)
+			}
+		}
+		changes[i] = &ReconcileChange{Name: sc.name, Action: action, Reason: reason}
+		return nil
+	})
+	for i, sc := range scs {
+		switch {
+		case errs[i] != nil:
+			catcher.Add(errs[i])
+		case changes[i] != nil:
+			res.Changes = append(res.Changes, *changes[i])
+		case unchanged[i]:
+			res.Unchanged = append(res.Unchanged, sc.name)
+		}
+	}
+	if ctxErr != nil {
+		catcher.Add(ctxErr)
+		return res, catcher.Resolve()
+	}
+
+	candidates := []string{}
+	for _, name := range names {
+		if !keep[name] && !isPreviousOf(name, keep) && !isStagedOf(name, keep) {
+			candidates = append(candidates, name)
+		}
+	}
+	deleted := make([]bool, len(candidates))
+	errs, ctxErr = forEachParallel(ctx, opts.WorkerPoolOptions, len(candidates), func(_ context.Context, i int) error {
+		name := candidates[i]
+		exists, err := CheckCertificateWithError(wd, name)
+		if err != nil {
+			return errors.Wrapf(err, "checking certificate '%s'", name)
+		}
+		if !exists {
+			return nil
+		}
+		crt, err := getRawCertificate(wd, name)
+		if err != nil {
+			return errors.Wrapf(err, "getting certificate '%s'", name)
+		}
+		if crt.IsCA {
+			return nil
+		}
+
+		if apply {
+			if err = deleteIfExists(wd, CrtTag(name), ChainTag(name), PrivKeyTag(name), CsrTag(name)); err != nil {
+				return errors.Wrapf(err, "deleting certificate '%s'", name)
+			}
+			grip.Info(message.Fields{
+				"message": "deleted certificate not in desired state",
+				"name":    name,
+			})
+		}
+		deleted[i] = true
+		return nil
+	})
+	for i, name := range candidates {
+		catcher.Add(errs[i])
+		if deleted[i] {
+			res.Changes = append(res.Changes, ReconcileChange{Name: name, Action: ReconcileDelete, Reason: "certificate is not in desired state"})
+		}
+	}
+	catcher.Add(ctxErr)
+
+	return res, catcher.Resolve()
+}
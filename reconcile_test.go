@@ -0,0 +1,209 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.TODO()
+	tempDir, err := ioutil.TempDir(".", "reconcile-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	d, err := MakeFileDepot(tempDir, DepotOptions{
+		CA:                "root",
+		DefaultExpiration: 24 * time.Hour,
+	})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{
+		CommonName: "root",
+		Expires:    365 * 24 * time.Hour,
+	}
+	require.NoError(t, caOpts.Init(d))
+
+	alice := CertificateSpec{Name: "alice"}
+	bob := CertificateSpec{Name: "bob"}
+
+	t.Run("PlanDoesNotChangeDepot", func(t *testing.T) {
+		res, err := PlanReconcile(ctx, d, []CertificateSpec{alice, bob})
+		require.NoError(t, err)
+		assert.False(t, res.Applied)
+		assert.True(t, res.HasChanges())
+		assert.Equal(t, []ReconcileChange{
+			{Name: "alice", Action: ReconcileCreate, Reason: certificateNotExistReason},
+			{Name: "bob", Action: ReconcileCreate, Reason: certificateNotExistReason},
+		}, res.Changes)
+		assert.False(t, CheckCertificate(d, "alice"))
+		assert.False(t, CheckCertificate(d, "bob"))
+	})
+	t.Run("CreatesMissingCertificates", func(t *testing.T) {
+		res, err := Reconcile(ctx, d, []CertificateSpec{alice, bob})
+		require.NoError(t, err)
+		assert.Equal(t, []ReconcileChange{
+			{Name: "alice", Action: ReconcileCreate, Reason: certificateNotExistReason},
+			{Name: "bob", Action: ReconcileCreate, Reason: certificateNotExistReason},
+		}, res.Changes)
+		assert.Empty(t, res.Unchanged)
+		assert.True(t, res.Applied)
+		assert.True(t, CheckCertificate(d, "alice"))
+		assert.True(t, CheckCertificate(d, "bob"))
+	})
+	t.Run("KeepsCertificatesInDesiredState", func(t *testing.T) {
+		res, err := Reconcile(ctx, d, []CertificateSpec{alice, bob})
+		require.NoError(t, err)
+		assert.False(t, res.HasChanges())
+		assert.Equal(t, []string{"alice", "bob"}, res.Unchanged)
+	})
+	t.Run("RenewsChangedCertificates", func(t *testing.T) {
+		changed := bob
+		changed.IP = []string{"127.0.0.1"}
+		res, err := Reconcile(ctx, d, []CertificateSpec{alice, changed})
+		require.NoError(t, err)
+		require.Len(t, res.Changes, 1)
+		assert.Equal(t, "bob", res.Changes[0].Name)
+		assert.Equal(t, ReconcileRenew, res.Changes[0].Action)
+		assert.Contains(t, res.Changes[0].Reason, "IP addresses")
+		assert.Equal(t, []string{"alice"}, res.Unchanged)
+
+		crt, err := getRawCertificate(d, "bob")
+		require.NoError(t, err)
+		require.Len(t, crt.IPAddresses, 1)
+		assert.Equal(t, "127.0.0.1", crt.IPAddresses[0].String())
+	})
+	t.Run("PlansDeletes", func(t *testing.T) {
+		res, err := PlanReconcile(ctx, d, []CertificateSpec{alice})
+		require.NoError(t, err)
+		assert.Equal(t, []ReconcileChange{
+			{Name: "bob", Action: ReconcileDelete, Reason: "certificate is not in desired state"},
+		}, res.Changes)
+		assert.True(t, CheckCertificate(d, "bob"))
+	})
+	t.Run("DeletesCertificatesNotInDesiredState", func(t *testing.T) {
+		res, err := Reconcile(ctx, d, []CertificateSpec{alice})
+		require.NoError(t, err)
+		assert.Equal(t, []ReconcileChange{
+			{Name: "bob", Action: ReconcileDelete, Reason: "certificate is not in desired state"},
+		}, res.Changes)
+		assert.False(t, CheckCertificate(d, "bob"))
+		assert.False(t, CheckPrivateKey(d, "bob"))
+		assert.True(t, CheckCertificate(d, "alice"))
+	})
+	t.Run("KeepsCACertificates", func(t *testing.T) {
+		res, err := Reconcile(ctx, d, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []ReconcileChange{
+			{Name: "alice", Action: ReconcileDelete, Reason: "certificate is not in desired state"},
+		}, res.Changes)
+		assert.True(t, CheckCertificate(d, "root"))
+		assert.True(t, CheckPrivateKey(d, "root"))
+	})
+	t.Run("ConvergesInParallel", func(t *testing.T) {
+		specs := []CertificateSpec{}
+		for _, name := range []string{"carol", "dave", "erin", "frank"} {
+			specs = append(specs, CertificateSpec{Name: name})
+		}
+		res, err := ReconcileWithOptions(ctx, d, specs, ReconcileOptions{WorkerPoolOptions: WorkerPoolOptions{Workers: 3}})
+		require.NoError(t, err)
+		require.Len(t, res.Changes, 4)
+		for i, name := range []string{"carol", "dave", "erin", "frank"} {
+			assert.Equal(t, name, res.Changes[i].Name)
+			assert.Equal(t, ReconcileCreate, res.Changes[i].Action)
+			assert.True(t, CheckCertificate(d, name))
+		}
+		assert.Empty(t, res.Unchanged)
+
+		res, err = ReconcileWithOptions(ctx, d, nil, ReconcileOptions{Plan: true, WorkerPoolOptions: WorkerPoolOptions{Workers: 3}})
+		require.NoError(t, err)
+		assert.False(t, res.Applied)
+		require.Len(t, res.Changes, 4)
+		assert.Equal(t, "carol", res.Changes[0].Name)
+		assert.Equal(t, ReconcileDelete, res.Changes[0].Action)
+		assert.True(t, CheckCertificate(d, "carol"))
+
+		res, err = ReconcileWithOptions(ctx, d, nil, ReconcileOptions{WorkerPoolOptions: WorkerPoolOptions{Workers: 3}})
+		require.NoError(t, err)
+		assert.Len(t, res.Changes, 4)
+		assert.False(t, CheckCertificate(d, "carol"))
+
+		_, err = ReconcileWithOptions(ctx, d, specs, ReconcileOptions{WorkerPoolOptions: WorkerPoolOptions{Workers: -1}})
+		assert.Error(t, err)
+	})
+	t.Run("FailsWithDuplicateSpecs", func(t *testing.T) {
+		res, err := Reconcile(ctx, d, []CertificateSpec{alice, alice})
+		assert.Error(t, err)
+		assert.Nil(t, res)
+		assert.False(t, CheckCertificate(d, "alice"))
+	})
+	t.Run("FailsWithInvalidSpec", func(t *testing.T) {
+		res, err := Reconcile(ctx, d, []CertificateSpec{{}})
+		assert.Error(t, err)
+		assert.Nil(t, res)
+	})
+	t.Run("FailsWithCanceledContext", func(t *testing.T) {
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		res, err := Reconcile(canceledCtx, d, []CertificateSpec{alice})
+		assert.Error(t, err)
+		require.NotNil(t, res)
+		assert.Empty(t, res.Changes)
+		assert.False(t, CheckCertificate(d, "alice"))
+	})
+}
+
+func TestReconcileResultExport(t *testing.T) {
+	res := &ReconcileResult{
+		Changes: []ReconcileChange{
+			{Name: "alice", Action: ReconcileCreate, Reason: certificateNotExistReason},
+			{Name: "bob", Action: ReconcileDelete, Reason: "certificate is not in desired state"},
+		},
+		Unchanged: []string{"carol"},
+	}
+	assert.Equal(t, map[ReconcileAction]int{
+		ReconcileCreate: 1,
+		ReconcileRenew:  0,
+		ReconcileDelete: 1,
+	}, res.Summary())
+
+	b, err := res.Export()
+	require.NoError(t, err)
+	exported := struct {
+		Applied bool              `json:"applied"`
+		Changes []ReconcileChange `json:"changes"`
+		Summary map[string]int    `json:"summary"`
+	}{}
+	require.NoError(t, json.Unmarshal(b, &exported))
+	assert.False(t, exported.Applied)
+	assert.Equal(t, res.Changes, exported.Changes)
+	assert.Equal(t, map[string]int{"create": 1, "renew": 0, "delete": 1}, exported.Summary)
+}
+
+func TestNewCertificateSpecsFromFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "reconcile-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	path := filepath.Join(tempDir, "specs.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`[{"name": "alice", "ip": ["127.0.0.1"], "renew_before": 3600000000000}]`), 0600))
+	specs, err := NewCertificateSpecsFromFile(path)
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(t, "alice", specs[0].Name)
+	assert.Equal(t, []string{"127.0.0.1"}, specs[0].IP)
+	assert.Equal(t, time.Hour, specs[0].RenewBefore)
+
+	_, err = NewCertificateSpecsFromFile(filepath.Join(tempDir, "missing.json"))
+	assert.Error(t, err)
+}
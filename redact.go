@@ -0,0 +1,173 @@
+package certdepot
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// redactedValue replaces secrets when credentials and options are printed or
+// marshalled to JSON. Unmarshalling it back into a secret is an error, so that
+// the placeholder is never used as a passphrase or key.
+const redactedValue = "[redacted]"
+
+func redactString(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// formatRedacted formats the redacted copy of a value with the verb and flags
+// of the state. The copy must be of a type without a Format method.
+func formatRedacted(f fmt.State, verb rune, v interface{}) {
+	fmt.Fprintf(f, fmt.FormatString(f, verb), v)
+}
+
+// credentialsFields has the fields of Credentials without its methods, so
+// that it is formatted and marshalled as is.
+type credentialsFields Credentials
+
+// redacted returns a copy of the credentials with the private key replaced
+// and the signer removed.
+func (c Credentials) redacted() credentialsFields {
+	if len(c.Key) != 0 {
+		c.Key = []byte(redactedValue)
+	}
+	c.Signer = nil
+	c.bundle = nil
+	return credentialsFields(c)
+}
+
+// String returns the credentials with the private key redacted.
+func (c Credentials) String() string {
+	return fmt.Sprintf("%+v", c.redacted())
+}
+
+// Format formats the credentials with the private key redacted, so that
+// logging the credentials does not leak the key.
+func (c Credentials) Format(f fmt.State, verb rune) {
+	formatRedacted(f, verb, c.redacted())
+}
+
+// MarshalJSON returns the JSON encoding of the credentials with the private
+// key redacted. Use Export to encode the credentials with the key.
+func (c Credentials) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.redacted())
+}
+
+// UnmarshalJSON decodes the JSON encoding of the credentials, such as from
+// Export. It returns an error if the private key was redacted by MarshalJSON.
+func (c *Credentials) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*credentialsFields)(c)); err != nil {
+		return err
+	}
+	if string(c.Key) == redactedValue {
+		c.Key = nil
+		return errors.New("private key was redacted when the credentials were marshalled, so use Export to marshal credentials with their key")
+	}
+	return nil
+}
+
+// certificateOptionsFields has the fields of CertificateOptions without its
+// methods, so that it is formatted and marshalled as is.
+type certificateOptionsFields CertificateOptions
+
+// redacted returns a copy of the options with the passphrases replaced and
+// the cached private key removed.
+func (opts CertificateOptions) redacted() certificateOptionsFields {
+	opts.Passphrase = redactString(opts.Passphrase)
+	opts.CAPassphrase = redactString(opts.CAPassphrase)
+	opts.key = nil
+	return certificateOptionsFields(opts)
+}
+
+// String returns the options with the passphrases redacted.
+func (opts CertificateOptions) String() string {
+	return fmt.Sprintf("%+v", opts.redacted())
+}
+
+// Format formats the options with the passphrases redacted, so that logging
+// the options does not leak them.
+func (opts CertificateOptions) Format(f fmt.State, verb rune) {
+	formatRedacted(f, verb, opts.redacted())
+}
+
+// MarshalJSON returns the JSON encoding of the options with the passphrases
+// redacted. The encoding cannot be unmarshalled if it has a passphrase.
+func (opts CertificateOptions) MarshalJSON() ([]byte, error) {
+	return json.Marshal(opts.redacted())
+}
+
+// checkNotRedacted returns an error if a passphrase is the redacted
+// placeholder.
+func (opts *CertificateOptions) checkNotRedacted() error {
+	if opts.Passphrase == redactedValue || opts.CAPassphrase == redactedValue {
+		return errors.New("passphrase was redacted when the options were marshalled")
+	}
+	return nil
+}
+
+// ensureServiceCertificateOptionsFields has the fields of
+// EnsureServiceCertificateOptions without the methods promoted from
+// CertificateOptions, which would otherwise drop RenewBefore.
+type ensureServiceCertificateOptionsFields struct {
+	certificateOptionsFields
+	RenewBefore time.Duration `json:"renew_before,omitempty"`
+}
+
+func (opts EnsureServiceCertificateOptions) redacted() ensureServiceCertificateOptionsFields {
+	return ensureServiceCertificateOptionsFields{
+		certificateOptionsFields: opts.CertificateOptions.redacted(),
+		RenewBefore:              opts.RenewBefore,
+	}
+}
+
+// String returns the options with the passphrases redacted.
+func (opts EnsureServiceCertificateOptions) String() string {
+	return fmt.Sprintf("%+v", opts.redacted())
+}
+
+// Format formats the options with the passphrases redacted.
+func (opts EnsureServiceCertificateOptions) Format(f fmt.State, verb rune) {
+	formatRedacted(f, verb, opts.redacted())
+}
+
+// MarshalJSON returns the JSON encoding of the options with the passphrases
+// redacted.
+func (opts EnsureServiceCertificateOptions) MarshalJSON() ([]byte, error) {
+	return json.Marshal(opts.redacted())
+}
+
+// certificateSpecFields has the fields of CertificateSpec without the methods
+// promoted from EnsureServiceCertificateOptions, which would otherwise drop
+// Name.
+type certificateSpecFields struct {
+	Name string `json:"name"`
+	ensureServiceCertificateOptionsFields
+}
+
+func (s CertificateSpec) redacted() certificateSpecFields {
+	return certificateSpecFields{
+		Name:                                  s.Name,
+		ensureServiceCertificateOptionsFields: s.EnsureServiceCertificateOptions.redacted(),
+	}
+}
+
+// String returns the spec with the passphrases redacted.
+func (s CertificateSpec) String() string {
+	return fmt.Sprintf("%+v", s.redacted())
+}
+
+// Format formats the spec with the passphrases redacted.
+func (s CertificateSpec) Format(f fmt.State, verb rune) {
+	formatRedacted(f, verb, s.redacted())
+}
+
+// MarshalJSON returns the JSON encoding of the spec with the passphrases
+// redacted.
+func (s CertificateSpec) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.redacted())
+}
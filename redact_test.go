@@ -0,0 +1,108 @@
+package certdepot
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedaction(t *testing.T) {
+	t.Run("Credentials", func(t *testing.T) {
+		creds := &Credentials{
+			CACert:     []byte("ca"),
+			Cert:       []byte("cert"),
+			Key:        []byte("secret key"),
+			ServerName: "alice",
+		}
+		for _, out := range []string{
+			creds.String(),
+			fmt.Sprint(creds),
+			fmt.Sprintf("%v", *creds),
+			fmt.Sprintf("%+v", creds),
+			fmt.Sprintf("%#v", creds),
+			fmt.Sprintf("%s", creds),
+		} {
+			assert.NotContains(t, out, "secret key")
+			assert.NotContains(t, out, fmt.Sprint([]byte("secret key")))
+			assert.Contains(t, out, "alice")
+		}
+
+		data, err := json.Marshal(creds)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "secret key")
+		decoded := Credentials{}
+		assert.Error(t, json.Unmarshal(data, &decoded))
+		assert.Empty(t, decoded.Key)
+		assert.Equal(t, []byte("secret key"), creds.Key)
+
+		data, err = creds.Export()
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, creds.Key, decoded.Key)
+
+		var nilCreds *Credentials
+		assert.Equal(t, "<nil>", fmt.Sprint(nilCreds))
+	})
+	t.Run("CertificateOptions", func(t *testing.T) {
+		opts := CertificateOptions{
+			CommonName:   "alice",
+			Passphrase:   "secret passphrase",
+			CAPassphrase: "secret CA passphrase",
+		}
+		for _, out := range []string{
+			opts.String(),
+			fmt.Sprint(opts),
+			fmt.Sprintf("%+v", &opts),
+			fmt.Sprintf("%#v", opts),
+		} {
+			assert.NotContains(t, out, "secret")
+			assert.Contains(t, out, "alice")
+		}
+
+		data, err := json.Marshal(opts)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "secret")
+		decoded := CertificateOptions{}
+		assert.Error(t, json.Unmarshal(data, &decoded))
+		assert.Error(t, decoded.UnmarshalYAML(jsonUnmarshaler([]byte(`{"ca_passphrase": "`+redactedValue+`"}`))))
+		assert.Equal(t, "secret passphrase", opts.Passphrase)
+
+		data, err = json.Marshal(CertificateOptions{CommonName: "bob"})
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "passphrase")
+		decoded = CertificateOptions{}
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, "bob", decoded.CommonName)
+	})
+	t.Run("EmbeddingTypes", func(t *testing.T) {
+		spec := CertificateSpec{
+			Name: "alice",
+			EnsureServiceCertificateOptions: EnsureServiceCertificateOptions{
+				CertificateOptions: CertificateOptions{CommonName: "alice", Passphrase: "secret passphrase"},
+				RenewBefore:        time.Hour,
+			},
+		}
+		out := fmt.Sprintf("%+v", spec)
+		assert.NotContains(t, out, "secret")
+		assert.Contains(t, out, "RenewBefore")
+
+		data, err := json.Marshal(spec)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "secret")
+		decoded := CertificateSpec{}
+		assert.Error(t, json.Unmarshal(data, &decoded))
+
+		spec.Passphrase = ""
+		data, err = json.Marshal(spec)
+		require.NoError(t, err)
+		decoded = CertificateSpec{}
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, "alice", decoded.Name)
+		assert.Equal(t, "alice", decoded.CommonName)
+		assert.Equal(t, time.Hour, decoded.RenewBefore)
+	})
+}
@@ -0,0 +1,307 @@
+package certdepot
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RemoteKey is a private key held by a backend, such as a KMS, Vault, or an
+// HSM, that signs digests on behalf of the process so that the private key
+// never enters process memory.
+type RemoteKey interface {
+	// SignDigest signs the digest with the private key matching the public
+	// key. The opts are those passed to crypto.Signer's Sign and describe
+	// the hash function and padding to use.
+	SignDigest(ctx context.Context, pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+// RemoteKeyFunc adapts a function into a RemoteKey, such as for signing with
+// a PKCS #11 library for an HSM.
+type RemoteKeyFunc func(ctx context.Context, pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+
+// SignDigest calls the underlying function.
+func (f RemoteKeyFunc) SignDigest(ctx context.Context, pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return f(ctx, pub, digest, opts)
+}
+
+// remoteSigner is a crypto.Signer that signs with a RemoteKey.
+type remoteSigner struct {
+	ctx context.Context
+	pub crypto.PublicKey
+	key RemoteKey
+}
+
+// NewRemoteSigner returns a crypto.Signer for the public key that signs with
+// the remote key, for use as the Signer of Credentials. The context bounds
+// every signing request made by the signer.
+func NewRemoteSigner(ctx context.Context, pub crypto.PublicKey, key RemoteKey) crypto.Signer {
+	return &remoteSigner{ctx: ctx, pub: pub, key: key}
+}
+
+// Public returns the public key.
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs the digest with the remote key. The random source is ignored,
+// since the backend provides its own.
+func (s *remoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	sig, err := s.key.SignDigest(s.ctx, s.pub, digest, opts)
+	return sig, errors.Wrap(err, "signing with remote key")
+}
+
+// NewCredentialsWithRemoteKey returns credentials for the certificate whose
+// private key is held by the remote key, so that the credentials can be
+// resolved into a TLS configuration without the private key. The signer's
+// public key is taken from the certificate, which may be followed by its
+// chain.
+func NewCredentialsWithRemoteKey(ctx context.Context, caCert, cert []byte, key RemoteKey) (*Credentials, error) {
+	crts, err := parsePEMCertificates(cert)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing certificate chain")
+	}
+	if len(crts) == 0 {
+		return nil, errors.New("credentials do not contain a certificate")
+	}
+
+	creds := &Credentials{
+		CACert: caCert,
+		Cert:   cert,
+		Signer: NewRemoteSigner(ctx, crts[0].PublicKey, key),
+	}
+	if err = creds.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid credentials")
+	}
+
+	return creds, nil
+}
+
+// remoteHashName returns the suffix that KMS and Vault use for the hash
+// function.
+func remoteHashName(hash crypto.Hash) (string, error) {
+	switch hash {
+	case crypto.SHA256:
+		return "256", nil
+	case crypto.SHA384:
+		return "384", nil
+	case crypto.SHA512:
+		return "512", nil
+	default:
+		return "", errors.Errorf("hash function %s is not supported by remote keys", hash)
+	}
+}
+
+// AWSKMSKey is a RemoteKey held by AWS KMS. The key must be an asymmetric
+// key with the SIGN_VERIFY usage.
+type AWSKMSKey struct {
+	// KeyID is the ID, ARN, or alias of the key (required).
+	KeyID string
+	// Region is the AWS region of the key (required).
+	Region string
+	// Credentials are used to sign requests to AWS. If unset, they are read
+	// from the environment.
+	Credentials AWSCredentials
+	// Endpoint overrides the KMS endpoint for the region.
+	Endpoint string
+	// Client is the HTTP client used to make requests. If nil, a client
+	// with a default timeout is used.
+	Client *http.Client
+}
+
+type awsKMSSignInput struct {
+	KeyId            string `json:"KeyId"`
+	Message          []byte `json:"Message"`
+	MessageType      string `json:"MessageType"`
+	SigningAlgorithm string `json:"SigningAlgorithm"`
+}
+
+type awsKMSSignOutput struct {
+	Signature []byte `json:"Signature"`
+}
+
+// SignDigest signs the digest with the KMS key.
+func (k *AWSKMSKey) SignDigest(ctx context.Context, pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if k.KeyID == "" {
+		return nil, errors.New("must specify KMS key ID")
+	}
+	algorithm, err := awsKMSSigningAlgorithm(pub, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	creds := k.Credentials
+	if creds.AccessKeyID == "" {
+		creds = AWSCredentialsFromEnv()
+	}
+	client := &awsJSONClient{
+		service:      "kms",
+		region:       k.Region,
+		endpoint:     k.Endpoint,
+		targetPrefix: "TrentService",
+		credentials:  creds,
+		client:       k.Client,
+	}
+
+	out := awsKMSSignOutput{}
+	if err = client.do(ctx, "Sign", awsKMSSignInput{
+		KeyId:            k.KeyID,
+		Message:          digest,
+		MessageType:      "DIGEST",
+		SigningAlgorithm: algorithm,
+	}, &out); err != nil {
+		return nil, errors.Wrap(err, "signing with KMS")
+	}
+	if len(out.Signature) == 0 {
+		return nil, errors.New("KMS did not return a signature")
+	}
+
+	return out.Signature, nil
+}
+
+// awsKMSSigningAlgorithm returns the KMS signing algorithm for the key type,
+// hash function, and padding.
+func awsKMSSigningAlgorithm(pub crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
+	hash, err := remoteHashName(opts.HashFunc())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return "RSASSA_PSS_SHA_" + hash, nil
+		}
+		return "RSASSA_PKCS1_V1_5_SHA_" + hash, nil
+	case *ecdsa.PublicKey:
+		return "ECDSA_SHA_" + hash, nil
+	default:
+		return "", errors.Errorf("KMS cannot sign with keys of type %T", pub)
+	}
+}
+
+// VaultTransitKey is a RemoteKey held by a HashiCorp Vault transit secrets
+// engine. The key must be an RSA or ECDSA key; PSS signatures require Vault
+// 1.12 or later.
+type VaultTransitKey struct {
+	// Address is the base URL of the Vault server, e.g.
+	// "https://vault.example.com:8200".
+	Address string
+	// Token is the Vault token used to authenticate.
+	Token string
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string
+	// Mount is the path at which the transit secrets engine is mounted. It
+	// defaults to "transit".
+	Mount string
+	// Name is the name of the transit key (required).
+	Name string
+	// Header contains additional headers to send with each request.
+	Header http.Header
+	// Client is the HTTP client used to make requests. If nil, a client
+	// with a default timeout is used.
+	Client *http.Client
+}
+
+type vaultTransitSignRequest struct {
+	Input               string `json:"input"`
+	Prehashed           bool   `json:"prehashed"`
+	SignatureAlgorithm  string `json:"signature_algorithm,omitempty"`
+	SaltLength          string `json:"salt_length,omitempty"`
+	MarshalingAlgorithm string `json:"marshaling_algorithm"`
+}
+
+type vaultTransitSignResponse struct {
+	Data struct {
+		Signature string `json:"signature"`
+	} `json:"data"`
+}
+
+// Validate checks that the key is configured.
+func (k *VaultTransitKey) Validate() error {
+	if k.Address == "" {
+		return errors.New("must specify Vault address")
+	}
+	if k.Token == "" {
+		return errors.New("must specify Vault token")
+	}
+	if k.Name == "" {
+		return errors.New("must specify transit key name")
+	}
+
+	return nil
+}
+
+// SignDigest signs the digest with the Vault transit key.
+func (k *VaultTransitKey) SignDigest(ctx context.Context, pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := k.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid Vault transit key")
+	}
+	hash, err := remoteHashName(opts.HashFunc())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	body := vaultTransitSignRequest{
+		Input:               base64.StdEncoding.EncodeToString(digest),
+		Prehashed:           true,
+		MarshalingAlgorithm: "asn1",
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		body.SignatureAlgorithm = "pkcs1v15"
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			// TLS requires the salt to be as long as the hash.
+			body.SignatureAlgorithm = "pss"
+			body.SaltLength = "hash"
+		}
+	case *ecdsa.PublicKey:
+	default:
+		return nil, errors.Errorf("Vault transit cannot sign with keys of type %T", pub)
+	}
+
+	header := http.Header{}
+	for key, values := range k.Header {
+		header[key] = values
+	}
+	header.Set("X-Vault-Token", k.Token)
+	if k.Namespace != "" {
+		header.Set("X-Vault-Namespace", k.Namespace)
+	}
+
+	resp := vaultTransitSignResponse{}
+	if err = postJSON(ctx, k.Client, k.signURL(hash), header, body, &resp); err != nil {
+		return nil, errors.Wrap(err, "requesting signature from Vault")
+	}
+
+	// Signatures are formatted as "vault:v<key version>:<base64 signature>".
+	parts := strings.Split(resp.Data.Signature, ":")
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, errors.New("Vault did not return a signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding signature from Vault")
+	}
+
+	return sig, nil
+}
+
+// signURL returns the URL of the transit endpoint that signs digests of the
+// hash function.
+func (k *VaultTransitKey) signURL(hash string) string {
+	mount := strings.Trim(k.Mount, "/")
+	if mount == "" {
+		mount = "transit"
+	}
+
+	return fmt.Sprintf("%s/v1/%s/sign/%s/sha2-%s", strings.TrimSuffix(k.Address, "/"), mount, k.Name, hash)
+}
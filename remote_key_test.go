@@ -0,0 +1,177 @@
+package certdepot
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tempDir, err := ioutil.TempDir(".", "remote-key-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+
+	alice, err := d.GenerateWithOptions(CertificateOptions{CommonName: "alice", Host: "alice", Domain: []string{"alice"}})
+	require.NoError(t, err)
+	bob, err := d.GenerateWithOptions(CertificateOptions{CommonName: "bob", Host: "bob", Domain: []string{"bob"}})
+	require.NoError(t, err)
+
+	// backendKey simulates a backend holding the private key.
+	backendKey := func(t *testing.T, keyPEM []byte, calls *int) RemoteKey {
+		key, err := pkix.NewKeyFromPrivateKeyPEM(keyPEM)
+		require.NoError(t, err)
+		return RemoteKeyFunc(func(_ context.Context, _ crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+			*calls++
+			return key.Private.(crypto.Signer).Sign(rand.Reader, digest, opts)
+		})
+	}
+
+	t.Run("HandshakeWithRemoteKey", func(t *testing.T) {
+		calls := 0
+		remote, err := NewCredentialsWithRemoteKey(ctx, alice.CACert, alice.Cert, backendKey(t, alice.Key, &calls))
+		require.NoError(t, err)
+		assert.Empty(t, remote.Key)
+
+		aliceConf, err := remote.Resolve()
+		require.NoError(t, err)
+		bobConf, err := bob.Resolve()
+		require.NoError(t, err)
+		bobConf.ServerName = "alice"
+
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", aliceConf)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		errs := make(chan error, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			errs <- conn.(*tls.Conn).Handshake()
+		}()
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), bobConf)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.Handshake())
+		assert.NoError(t, <-errs)
+		assert.NotZero(t, calls)
+	})
+	t.Run("ResolveFailsWithMismatchedSigner", func(t *testing.T) {
+		calls := 0
+		remote, err := NewCredentialsWithRemoteKey(ctx, bob.CACert, bob.Cert, backendKey(t, bob.Key, &calls))
+		require.NoError(t, err)
+		remote.Cert = alice.Cert
+
+		_, err = remote.Resolve()
+		assert.Error(t, err)
+	})
+	t.Run("ExportFails", func(t *testing.T) {
+		calls := 0
+		remote, err := NewCredentialsWithRemoteKey(ctx, alice.CACert, alice.Cert, backendKey(t, alice.Key, &calls))
+		require.NoError(t, err)
+
+		_, err = remote.Export()
+		assert.Error(t, err)
+	})
+}
+
+func TestRemoteKeyBackends(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("handshake"))
+	pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+
+	t.Run("AWSKMSKey", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "TrentService.Sign", r.Header.Get("X-Amz-Target"))
+			assert.NotEmpty(t, r.Header.Get("Authorization"))
+
+			in := awsKMSSignInput{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&in))
+			assert.Equal(t, "alias/web", in.KeyId)
+			assert.Equal(t, "DIGEST", in.MessageType)
+			assert.Equal(t, "RSASSA_PSS_SHA_256", in.SigningAlgorithm)
+
+			sig, err := key.Sign(rand.Reader, in.Message, pssOpts)
+			require.NoError(t, err)
+			assert.NoError(t, json.NewEncoder(w).Encode(awsKMSSignOutput{Signature: sig}))
+		}))
+		defer srv.Close()
+
+		signer := NewRemoteSigner(ctx, &key.PublicKey, &AWSKMSKey{
+			KeyID:       "alias/web",
+			Region:      "us-east-1",
+			Credentials: AWSCredentials{AccessKeyID: "id", SecretAccessKey: "secret"},
+			Endpoint:    srv.URL,
+		})
+		sig, err := signer.Sign(rand.Reader, digest[:], pssOpts)
+		require.NoError(t, err)
+		assert.NoError(t, rsa.VerifyPSS(&key.PublicKey, crypto.SHA256, digest[:], sig, pssOpts))
+	})
+	t.Run("VaultTransitKey", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v1/transit/sign/web/sha2-256", r.URL.Path)
+			assert.Equal(t, "token", r.Header.Get("X-Vault-Token"))
+
+			req := vaultTransitSignRequest{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.True(t, req.Prehashed)
+			assert.Equal(t, "pkcs1v15", req.SignatureAlgorithm)
+			input, err := base64.StdEncoding.DecodeString(req.Input)
+			require.NoError(t, err)
+
+			sig, err := key.Sign(rand.Reader, input, crypto.SHA256)
+			require.NoError(t, err)
+			resp := vaultTransitSignResponse{}
+			resp.Data.Signature = "vault:v1:" + base64.StdEncoding.EncodeToString(sig)
+			assert.NoError(t, json.NewEncoder(w).Encode(resp))
+		}))
+		defer srv.Close()
+
+		signer := NewRemoteSigner(ctx, &key.PublicKey, &VaultTransitKey{
+			Address: srv.URL + "/",
+			Token:   "token",
+			Name:    "web",
+		})
+		sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+		assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig))
+	})
+	t.Run("RejectsUnsupportedHash", func(t *testing.T) {
+		_, err := awsKMSSigningAlgorithm(&key.PublicKey, crypto.SHA1)
+		assert.Error(t, err)
+		_, err = (&VaultTransitKey{Address: "addr", Token: "token", Name: "web"}).SignDigest(ctx, &key.PublicKey, digest[:], crypto.SHA1)
+		assert.Error(t, err)
+	})
+}
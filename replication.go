@@ -0,0 +1,302 @@
+package certdepot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+const (
+	defaultReplicationQueueSize     = 1000
+	defaultReplicationRetryInterval = time.Second
+	// replicationFlushPollInterval is how often Flush checks whether the
+	// queues have drained.
+	replicationFlushPollInterval = 10 * time.Millisecond
+)
+
+// ReplicationOptions configure a ReplicatingDepot.
+type ReplicationOptions struct {
+	// QueueSize is the number of mutations that can wait to be applied to
+	// each secondary depot. Once a secondary's queue is full, mutations of
+	// the primary depot block until there is room. It defaults to 1000.
+	QueueSize int `bson:"queue_size,omitempty" json:"queue_size,omitempty" yaml:"queue_size,omitempty"`
+	// RetryInterval is how long to wait before retrying a mutation that
+	// failed to apply to a secondary depot. It defaults to one second.
+	RetryInterval time.Duration `bson:"retry_interval,omitempty" json:"retry_interval,omitempty" yaml:"retry_interval,omitempty"`
+}
+
+// Validate checks that the options are valid and sets defaults.
+func (opts *ReplicationOptions) Validate() error {
+	if opts.QueueSize < 0 {
+		return errors.New("queue size cannot be negative")
+	}
+	if opts.RetryInterval < 0 {
+		return errors.New("retry interval cannot be negative")
+	}
+	if opts.QueueSize == 0 {
+		opts.QueueSize = defaultReplicationQueueSize
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = defaultReplicationRetryInterval
+	}
+	return nil
+}
+
+// replicationOp is a mutation to apply to a secondary depot.
+type replicationOp struct {
+	apply func(d Depot, secondary bool) error
+	desc  string
+}
+
+// replica is a secondary depot and the queue of mutations to apply to it.
+type replica struct {
+	depot Depot
+	queue chan replicationOp
+}
+
+// ReplicatingDepot is a Depot that mirrors every mutation of its primary depot
+// to one or more secondary depots asynchronously, such as to keep a warm
+// standby depot in another region in sync. Reads are only served by the
+// primary. Mutations are applied to each secondary in the order they were
+// made to the primary, and a mutation that fails to apply to a secondary is
+// retried until it succeeds, so an unavailable secondary delays, but does not
+// lose, its updates.
+type ReplicatingDepot struct {
+	primary  Depot
+	replicas []*replica
+	opts     ReplicationOptions
+	pending  int64
+	// mu serializes mutations so that they are queued in the order they
+	// are applied to the primary.
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewReplicatingDepot returns a depot that mirrors the mutations of the
+// primary depot to the secondary depots until the context is done or the
+// depot is closed.
+func NewReplicatingDepot(ctx context.Context, primary Depot, secondaries []Depot, opts ReplicationOptions) (*ReplicatingDepot, error) {
+	if primary == nil {
+		return nil, errors.New("must specify primary depot")
+	}
+	if len(secondaries) == 0 {
+		return nil, errors.New("must specify at least one secondary depot")
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid replication options")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &ReplicatingDepot{primary: primary, opts: opts, ctx: ctx, cancel: cancel}
+	for _, secondary := range secondaries {
+		if secondary == nil {
+			cancel()
+			return nil, errors.New("secondary depot cannot be nil")
+		}
+		rep := &replica{depot: secondary, queue: make(chan replicationOp, opts.QueueSize)}
+		r.replicas = append(r.replicas, rep)
+		r.wg.Add(1)
+		go r.replicate(ctx, rep)
+	}
+
+	return r, nil
+}
+
+// replicate applies the mutations queued for the replica until the context is
+// done.
+func (r *ReplicatingDepot) replicate(ctx context.Context, rep *replica) {
+	defer r.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case op := <-rep.queue:
+			for {
+				err := op.apply(rep.depot, true)
+				if err == nil {
+					break
+				}
+				grip.Warning(message.WrapError(err, message.Fields{
+					"message":   "could not replicate mutation to secondary depot",
+					"mutation":  op.desc,
+					"secondary": fmt.Sprintf("%T", rep.depot),
+				}))
+
+				timer := time.NewTimer(r.opts.RetryInterval)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+			atomic.AddInt64(&r.pending, -1)
+		}
+	}
+}
+
+// mutate applies the mutation to the primary and, if it succeeds, queues it
+// for every secondary. The mutation is told whether it is being applied to a
+// secondary, where it may be retried.
+func (r *ReplicatingDepot) mutate(desc string, apply func(d Depot, secondary bool) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := apply(r.primary, false); err != nil {
+		return err
+	}
+	for _, rep := range r.replicas {
+		atomic.AddInt64(&r.pending, 1)
+		select {
+		case rep.queue <- replicationOp{apply: apply, desc: desc}:
+		case <-r.ctx.Done():
+			// Replication has stopped, so the mutation is dropped.
+			atomic.AddInt64(&r.pending, -1)
+		}
+	}
+
+	return nil
+}
+
+// Pending returns the number of mutations that have not yet been applied to
+// a secondary depot, counting each secondary separately.
+func (r *ReplicatingDepot) Pending() int { return int(atomic.LoadInt64(&r.pending)) }
+
+// Flush waits until every queued mutation has been applied to every secondary
+// depot or the context is done.
+func (r *ReplicatingDepot) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(replicationFlushPollInterval)
+	defer ticker.Stop()
+
+	for r.Pending() > 0 {
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "waiting for %d pending mutations", r.Pending())
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// Close stops replicating to the secondary depots. Mutations that have not
+// been applied yet are dropped, so callers should Flush first.
+func (r *ReplicatingDepot) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+func (r *ReplicatingDepot) Put(tag *depot.Tag, data []byte) error {
+	data = append([]byte{}, data...)
+	return r.mutate("put", func(d Depot, secondary bool) error {
+		if secondary {
+			// Replace the data so that retries are idempotent.
+			if err := deleteIfExists(d, tag); err != nil {
+				return errors.Wrap(err, "deleting existing data")
+			}
+		}
+		return d.Put(tag, data)
+	})
+}
+
+func (r *ReplicatingDepot) Delete(tag *depot.Tag) error {
+	return r.mutate("delete", func(d Depot, secondary bool) error {
+		if secondary {
+			return deleteIfExists(d, tag)
+		}
+		return d.Delete(tag)
+	})
+}
+
+func (r *ReplicatingDepot) Check(tag *depot.Tag) bool { return r.primary.Check(tag) }
+func (r *ReplicatingDepot) CheckWithError(tag *depot.Tag) (bool, error) {
+	return r.primary.CheckWithError(tag)
+}
+func (r *ReplicatingDepot) Get(tag *depot.Tag) ([]byte, error) { return r.primary.Get(tag) }
+func (r *ReplicatingDepot) GetIfExists(tag *depot.Tag) ([]byte, bool, error) {
+	return GetIfExists(r.primary, tag)
+}
+
+func (r *ReplicatingDepot) Save(name string, creds *Credentials) error {
+	return depotSave(r, name, creds)
+}
+
+func (r *ReplicatingDepot) Find(name string) (*Credentials, error) { return r.primary.Find(name) }
+
+func (r *ReplicatingDepot) Generate(name string) (*Credentials, error) {
+	return depotGenerateDefault(r, name, r.DepotOptions())
+}
+
+func (r *ReplicatingDepot) GenerateWithOptions(opts CertificateOptions) (*Credentials, error) {
+	return depotGenerate(r, opts.CommonName, r.DepotOptions(), opts)
+}
+
+// DepotOptions returns the primary depot's options.
+func (r *ReplicatingDepot) DepotOptions() DepotOptions { return getDepotOptions(r.primary) }
+
+// ListNames returns the names in the primary depot, which must implement
+// NameLister.
+func (r *ReplicatingDepot) ListNames() ([]string, error) {
+	lister, ok := r.primary.(NameLister)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not support listing entries", r.primary)
+	}
+	return lister.ListNames()
+}
+
+// PutTTL sets when the credentials for the name expire in every depot that
+// tracks expiration.
+func (r *ReplicatingDepot) PutTTL(name string, expiration time.Time) error {
+	return r.mutate("put TTL", func(d Depot, _ bool) error {
+		return putTTL(d, name, expiration)
+	})
+}
+
+func (r *ReplicatingDepot) tracker() (ExpiryTracker, error) {
+	tracker, ok := r.primary.(ExpiryTracker)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not support expiration", r.primary)
+	}
+	return tracker, nil
+}
+
+func (r *ReplicatingDepot) GetTTL(name string) (time.Time, error) {
+	tracker, err := r.tracker()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return tracker.GetTTL(name)
+}
+
+func (r *ReplicatingDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
+	tracker, err := r.tracker()
+	if err != nil {
+		return nil, err
+	}
+	return tracker.FindExpiresBefore(cutoff)
+}
+
+// DeleteExpiresBefore removes the expired entries from the primary depot and
+// from every secondary depot that tracks expiration.
+func (r *ReplicatingDepot) DeleteExpiresBefore(cutoff time.Time) error {
+	if _, err := r.tracker(); err != nil {
+		return err
+	}
+	return r.mutate("delete expired", func(d Depot, _ bool) error {
+		tracker, ok := d.(ExpiryTracker)
+		if !ok {
+			return nil
+		}
+		return tracker.DeleteExpiresBefore(cutoff)
+	})
+}
@@ -0,0 +1,116 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyDepot fails the first puts to the depot.
+type flakyDepot struct {
+	Depot
+	mu       sync.Mutex
+	failures int
+}
+
+func (d *flakyDepot) Put(tag *depot.Tag, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failures > 0 {
+		d.failures--
+		return errors.New("secondary is unavailable")
+	}
+	return d.Depot.Put(tag, data)
+}
+
+func TestReplicatingDepot(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	depotOpts := DepotOptions{CA: "root", DefaultExpiration: time.Hour}
+
+	makeFileDepot := func(t *testing.T) Depot {
+		tempDir, err := ioutil.TempDir(".", "replication-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { assert.NoError(t, os.RemoveAll(tempDir)) })
+		d, err := MakeFileDepot(tempDir, depotOpts)
+		require.NoError(t, err)
+		return d
+	}
+	primary := makeFileDepot(t)
+	standby := makeFileDepot(t)
+	flaky := &flakyDepot{Depot: makeFileDepot(t), failures: 3}
+
+	r, err := NewReplicatingDepot(ctx, primary, []Depot{standby, flaky}, ReplicationOptions{RetryInterval: time.Millisecond})
+	require.NoError(t, err)
+	defer r.Close()
+
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(r))
+	creds, err := r.Generate("alice")
+	require.NoError(t, err)
+	require.NoError(t, r.Save("alice", creds))
+
+	t.Run("MirrorsMutations", func(t *testing.T) {
+		require.NoError(t, r.Flush(ctx))
+		assert.Zero(t, r.Pending())
+
+		for _, secondary := range []Depot{standby, flaky} {
+			for _, tag := range []*depot.Tag{CrtTag("root"), PrivKeyTag("root"), CrtTag("alice"), PrivKeyTag("alice")} {
+				expected, err := primary.Get(tag)
+				require.NoError(t, err)
+				actual, err := secondary.Get(tag)
+				require.NoError(t, err)
+				assert.Equal(t, expected, actual)
+			}
+			found, err := secondary.Find("alice")
+			require.NoError(t, err)
+			assert.Equal(t, creds.Cert, found.Cert)
+		}
+
+		ttl, err := standby.(ExpiryTracker).GetTTL("alice")
+		require.NoError(t, err)
+		assert.False(t, ttl.IsZero())
+	})
+	t.Run("MirrorsDeletes", func(t *testing.T) {
+		require.NoError(t, r.Put(CrtTag("carol"), []byte("carol")))
+		require.NoError(t, r.Flush(ctx))
+		require.True(t, standby.Check(CrtTag("carol")))
+
+		require.NoError(t, r.Delete(CrtTag("carol")))
+		require.NoError(t, r.Flush(ctx))
+		assert.False(t, standby.Check(CrtTag("carol")))
+		assert.False(t, flaky.Check(CrtTag("carol")))
+	})
+	t.Run("DoesNotReplicateFailedMutations", func(t *testing.T) {
+		assert.Error(t, r.Delete(CrtTag("nonexistent")))
+		assert.Zero(t, r.Pending())
+	})
+	t.Run("FlushStopsWhenContextIsDone", func(t *testing.T) {
+		stalled := &flakyDepot{Depot: makeFileDepot(t), failures: 1000}
+		sr, err := NewReplicatingDepot(ctx, primary, []Depot{stalled}, ReplicationOptions{RetryInterval: time.Millisecond})
+		require.NoError(t, err)
+		defer sr.Close()
+		require.NoError(t, sr.Put(CrtTag("bob"), []byte("bob")))
+
+		tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer tcancel()
+		assert.Error(t, sr.Flush(tctx))
+		assert.Equal(t, 1, sr.Pending())
+	})
+	t.Run("RejectsInvalidArguments", func(t *testing.T) {
+		_, err := NewReplicatingDepot(ctx, nil, []Depot{standby}, ReplicationOptions{})
+		assert.Error(t, err)
+		_, err = NewReplicatingDepot(ctx, primary, nil, ReplicationOptions{})
+		assert.Error(t, err)
+		_, err = NewReplicatingDepot(ctx, primary, []Depot{standby}, ReplicationOptions{QueueSize: -1})
+		assert.Error(t, err)
+	})
+}
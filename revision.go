@@ -0,0 +1,193 @@
+package certdepot
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrConflict is returned by compare-and-swap writes when the entry was
+// changed since the expected revision was read.
+var ErrConflict = errors.New("entry was changed concurrently")
+
+// IsConflict returns whether the error, or the error it wraps, is
+// ErrConflict.
+func IsConflict(err error) bool {
+	return errors.Cause(err) == ErrConflict
+}
+
+// RevisionTracker is implemented by depots that version each entry, so that
+// concurrent writers can update an entry with compare-and-swap semantics
+// instead of overwriting each other's changes. Every write to an entry,
+// including writes that do not use compare-and-swap, changes its revision.
+type RevisionTracker interface {
+	// GetRevision returns the current revision of the entry for the name,
+	// or zero if the entry does not exist or has never been versioned.
+	GetRevision(name string) (int64, error)
+	// PutIfRevision inserts the data for the tag if the entry's revision
+	// is still the given revision, or returns ErrConflict otherwise.
+	PutIfRevision(tag *depot.Tag, data []byte, revision int64) error
+	// SaveIfRevision saves the credentials as Save does if the entry's
+	// revision is still the given revision, or returns ErrConflict
+	// otherwise.
+	SaveIfRevision(name string, creds *Credentials, revision int64) error
+}
+
+// GetRevision returns the current revision of the entry for the name. The
+// depot must implement RevisionTracker.
+func GetRevision(wd Depot, name string) (int64, error) {
+	tracker, ok := wd.(RevisionTracker)
+	if !ok {
+		return 0, errors.Errorf("depot of type %T does not track revisions", wd)
+	}
+
+	revision, err := tracker.GetRevision(name)
+	return revision, errors.Wrapf(err, "getting revision of '%s'", name)
+}
+
+// SaveIfRevision saves the credentials under the name if the entry has not
+// changed since the revision was read with GetRevision, or returns
+// ErrConflict otherwise. The depot must implement RevisionTracker.
+func SaveIfRevision(wd Depot, name string, creds *Credentials, revision int64) error {
+	tracker, ok := wd.(RevisionTracker)
+	if !ok {
+		return errors.Errorf("depot of type %T does not track revisions", wd)
+	}
+
+	return errors.Wrapf(tracker.SaveIfRevision(name, creds, revision), "saving '%s'", name)
+}
+
+// GetRevision returns the current revision of the user's document.
+func (m *mongoDepot) GetRevision(name string) (int64, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
+	u := User{}
+	err := m.readColl(formatName(name)).FindOne(ctx,
+		bson.D{{Key: userIDKey, Value: formatName(name)}},
+		options.FindOne().SetProjection(bson.M{userRevisionKey: 1}),
+	).Decode(&u)
+	if errNotNoDocuments(err) {
+		return 0, errors.Wrapf(err, "looking up name '%s' in the database", name)
+	}
+
+	return u.Revision, nil
+}
+
+// PutIfRevision sets the data for the tag in the user's document if the
+// document is still at the revision.
+func (m *mongoDepot) PutIfRevision(tag *depot.Tag, data []byte, revision int64) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return errors.Wrapf(err, "formatting name '%s'", name)
+	}
+
+	value := bsonString(data)
+	defer zeroBytes(value.Value)
+	set := bson.M{key: value}
+	var issuedAt time.Time
+	if key == userCertKey {
+		issuedAt = time.Now().UTC()
+		set[userLastIssuedKey] = issuedAt
+	}
+
+	return errors.WithStack(m.updateIfRevision(name, revision, bson.M{"$set": set}, issuedAt))
+}
+
+// SaveIfRevision replaces the credentials in the user's document in a single
+// update if the document is still at the revision.
+func (m *mongoDepot) SaveIfRevision(name string, creds *Credentials, revision int64) error {
+	name, err := canonicalName(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	leaf, chain, err := splitCertificateChain(creds.Cert)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	crt, err := pkix.NewCertificateFromPEM(leaf)
+	if err != nil {
+		return errors.Wrap(err, "getting certificate from PEM bytes")
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return errors.Wrap(err, "getting x509 certificate")
+	}
+
+	key := bsonString(creds.Key)
+	defer zeroBytes(key.Value)
+	issuedAt := time.Now().UTC()
+	set := bson.M{
+		userCertKey:       string(leaf),
+		userPrivateKeyKey: key,
+		userTTLKey:        rawCrt.NotAfter.UTC(),
+		userLastIssuedKey: issuedAt,
+	}
+	unset := bson.M{userCertReqKey: ""}
+	if len(chain) != 0 {
+		set[userChainKey] = string(chain)
+	} else {
+		unset[userChainKey] = ""
+	}
+
+	return errors.WithStack(m.updateIfRevision(name, revision, bson.M{"$set": set, "$unset": unset}, issuedAt))
+}
+
+// updateIfRevision applies the update to the user's document and increments
+// its revision if the document is still at the revision. A revision of zero
+// matches a document that does not exist or has never been versioned, in
+// which case the document is created if needed. If the update issues a
+// certificate at issuedAt, its rotation is recorded.
+func (m *mongoDepot) updateIfRevision(name string, revision int64, update bson.M, issuedAt time.Time) error {
+	filter := bson.M{userIDKey: name, userRevisionKey: revision}
+	if revision == 0 {
+		filter[userRevisionKey] = bson.M{"$exists": false}
+	}
+	update["$inc"] = bson.M{userRevisionKey: 1}
+	update["$setOnInsert"] = bson.M{userSchemaVersionKey: CurrentUserSchemaVersion}
+	if err := m.decorate(name, update); err != nil {
+		return errors.Wrap(err, "decorating user")
+	}
+
+	ctx, cancel := m.writeContext()
+	defer cancel()
+	prev := RotationInfo{}
+	m.recentWrites.record(name)
+	err := m.coll.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().
+			SetUpsert(revision == 0).
+			SetReturnDocument(options.Before).
+			SetProjection(bson.M{userLastIssuedKey: 1}),
+	).Decode(&prev)
+	switch {
+	case mongo.IsDuplicateKeyError(err):
+		return ErrConflict
+	case err == mongo.ErrNoDocuments && revision != 0:
+		return ErrConflict
+	case errNotNoDocuments(err):
+		return errors.Wrap(err, "updating document in the database")
+	}
+
+	if issuedAt.IsZero() || prev.LastIssued.IsZero() {
+		return nil
+	}
+	updateCtx, updateCancel := m.writeContext()
+	defer updateCancel()
+	if _, err = m.coll.UpdateOne(updateCtx,
+		bson.D{{Key: userIDKey, Value: name}},
+		bson.M{"$set": bson.M{userLastRotatedKey: issuedAt}}); err != nil {
+		return errors.Wrap(err, "recording certificate rotation")
+	}
+
+	return nil
+}
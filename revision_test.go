@@ -0,0 +1,89 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestRevisions(t *testing.T) {
+	ctx := context.TODO()
+	depotOpts := DepotOptions{CA: "root", DefaultExpiration: time.Hour}
+
+	t.Run("FailsWithFileDepot", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir(".", "revision-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		}()
+		d, err := MakeFileDepot(tempDir, depotOpts)
+		require.NoError(t, err)
+
+		_, err = GetRevision(d, "alice")
+		assert.Error(t, err)
+		assert.Error(t, SaveIfRevision(d, "alice", &Credentials{}, 0))
+	})
+	t.Run("IsConflict", func(t *testing.T) {
+		assert.True(t, IsConflict(ErrConflict))
+		assert.True(t, IsConflict(errors.Wrap(ErrConflict, "saving")))
+		assert.False(t, IsConflict(errors.New("error")))
+	})
+	t.Run("MongoDB", func(t *testing.T) {
+		d, err := NewMongoDBCertDepot(ctx, &MongoDBOptions{
+			MongoDBURI:     testMongoDBURI(),
+			DatabaseName:   "certDepot",
+			CollectionName: "revisions",
+			DepotOptions:   depotOpts,
+		})
+		require.NoError(t, err)
+		m := d.(*mongoDepot)
+		defer func() {
+			assert.NoError(t, m.coll.(*mongo.Collection).Drop(ctx))
+			assert.NoError(t, m.metadataCollection().(*mongo.Collection).Drop(ctx))
+		}()
+
+		caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+		require.NoError(t, caOpts.Init(d))
+		first, err := d.Generate("alice")
+		require.NoError(t, err)
+		second, err := d.Generate("alice")
+		require.NoError(t, err)
+
+		revision, err := GetRevision(d, "alice")
+		require.NoError(t, err)
+		assert.Zero(t, revision)
+
+		require.NoError(t, SaveIfRevision(d, "alice", first, 0))
+		assert.True(t, IsConflict(SaveIfRevision(d, "alice", second, 0)), "entry already exists")
+
+		revision, err = GetRevision(d, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), revision)
+
+		require.NoError(t, d.Put(CsrTag("alice"), []byte("csr")), "unconditional writes change the revision")
+		assert.True(t, IsConflict(SaveIfRevision(d, "alice", second, revision)))
+
+		revision, err = GetRevision(d, "alice")
+		require.NoError(t, err)
+		require.NoError(t, SaveIfRevision(d, "alice", second, revision))
+		found, err := d.Find("alice")
+		require.NoError(t, err)
+		assert.Equal(t, second.Cert, found.Cert)
+		assert.Equal(t, second.Key, found.Key)
+		assert.False(t, d.Check(CsrTag("alice")))
+
+		info, err := m.GetRotationInfo("alice")
+		require.NoError(t, err)
+		assert.False(t, info.LastRotated.IsZero())
+
+		assert.True(t, IsConflict(m.PutIfRevision(CrtTag("bob"), first.Cert, 1)), "entry does not exist")
+		require.NoError(t, m.PutIfRevision(CrtTag("bob"), first.Cert, 0))
+	})
+}
@@ -0,0 +1,112 @@
+package certdepot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// VerifyPeer returns a function suitable for tls.Config.VerifyPeerCertificate
+// that verifies that the peer's certificate chains to one of the named CAs in
+// the depot and that no certificate in the chain has been revoked by a
+// certificate revocation list stored in the depot under one of the CA names.
+// If no names are given, the depot's CA and trusted CAs are used. Include the
+// names of intermediate CAs so that the revocation lists they issue are
+// checked. The CA certificates and revocation lists are re-read from the
+// depot on every handshake, so rotations and revocations take effect
+// immediately. As with DynamicCertPool, set InsecureSkipVerify on clients or
+// ClientAuth to RequireAnyClientCert on servers so that the returned function
+// does the verification; it does not verify the peer's host name.
+func VerifyPeer(wd Depot, caNames ...string) func([][]byte, [][]*x509.Certificate) error {
+	var (
+		mu   sync.Mutex
+		pool *DynamicCertPool
+	)
+	loadPool := func() (*DynamicCertPool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if pool == nil {
+			var err error
+			pool, err = newCAPool(wd, caNames...)
+			return pool, err
+		}
+		_, err := pool.Refresh()
+		return pool, err
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		pool, err := loadPool()
+		if err != nil {
+			return errors.Wrap(err, "loading CA certificates")
+		}
+
+		chains, err := pool.verify(rawCerts)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		return errors.WithStack(pool.checkRevocation(chains))
+	}
+}
+
+// checkRevocation returns an error if any certificate in the chains is listed
+// in a revocation list, stored under one of the pool's CA names, that was
+// issued by the certificate's issuer.
+func (p *DynamicCertPool) checkRevocation(chains [][]*x509.Certificate) error {
+	crls, err := p.revocationLists()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(crls) == 0 {
+		return nil
+	}
+
+	for _, chain := range chains {
+		for i := 0; i+1 < len(chain); i++ {
+			crt, issuer := chain[i], chain[i+1]
+			for _, crl := range crls {
+				if !bytes.Equal(crl.RawIssuer, crt.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+					continue
+				}
+				for _, revoked := range crl.RevokedCertificates {
+					if revoked.SerialNumber.Cmp(crt.SerialNumber) == 0 {
+						return errors.Errorf("certificate '%s' with serial number %s has been revoked", crt.Subject.CommonName, crt.SerialNumber)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// revocationLists reads the revocation lists stored under the pool's CA
+// names.
+func (p *DynamicCertPool) revocationLists() ([]*x509.RevocationList, error) {
+	crls := []*x509.RevocationList{}
+	for _, name := range p.caNames {
+		data, err := getIfExists(p.wd, CrlTag(name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting revocation list for '%s'", name)
+		}
+		if data == nil {
+			continue
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.Errorf("revocation list for '%s' is not PEM-encoded", name)
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing revocation list for '%s'", name)
+		}
+		crls = append(crls, crl)
+	}
+
+	return crls, nil
+}
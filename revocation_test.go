@@ -0,0 +1,81 @@
+package certdepot
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPeer(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "revocation-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+
+	peer := func(t *testing.T, name string) ([][]byte, *x509.Certificate) {
+		opts := CertificateOptions{CommonName: name, Host: name, CA: "root", Expires: time.Hour}
+		require.NoError(t, opts.CreateCertificate(d))
+		crt, err := getRawCertificate(d, name)
+		require.NoError(t, err)
+		return [][]byte{crt.Raw}, crt
+	}
+	alice, _ := peer(t, "alice")
+	bob, bobCrt := peer(t, "bob")
+
+	verify := VerifyPeer(d)
+	t.Run("AcceptsWithEmptyRevocationList", func(t *testing.T) {
+		assert.True(t, d.Check(CrlTag("root")))
+		assert.NoError(t, verify(alice, nil))
+		assert.NoError(t, verify(bob, nil))
+	})
+	t.Run("RejectsRevokedCertificate", func(t *testing.T) {
+		caCrt, err := getRawCertificate(d, "root")
+		require.NoError(t, err)
+		caKey, err := depot.GetPrivateKey(d, "root")
+		require.NoError(t, err)
+		crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(2),
+			ThisUpdate: time.Now(),
+			NextUpdate: time.Now().Add(time.Hour),
+			RevokedCertificates: []pkix.RevokedCertificate{
+				{SerialNumber: bobCrt.SerialNumber, RevocationTime: time.Now()},
+			},
+		}, caCrt, caKey.Private.(crypto.Signer))
+		require.NoError(t, err)
+		require.NoError(t, d.Delete(CrlTag("root")))
+		require.NoError(t, d.Put(CrlTag("root"), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER})))
+
+		assert.NoError(t, verify(alice, nil))
+		assert.Error(t, verify(bob, nil))
+	})
+	t.Run("RejectsUntrustedCertificate", func(t *testing.T) {
+		otherOpts := CertificateOptions{CommonName: "other", Expires: time.Hour}
+		require.NoError(t, otherOpts.Init(d))
+		opts := CertificateOptions{CommonName: "carol", Host: "carol", CA: "other", Expires: time.Hour}
+		require.NoError(t, opts.CreateCertificate(d))
+		crt, err := getRawCertificate(d, "carol")
+		require.NoError(t, err)
+
+		assert.Error(t, verify([][]byte{crt.Raw}, nil))
+		assert.NoError(t, VerifyPeer(d, "root", "other")([][]byte{crt.Raw}, nil))
+	})
+	t.Run("FailsWithMissingCA", func(t *testing.T) {
+		assert.Error(t, VerifyPeer(d, "nonexistent")(alice, nil))
+	})
+}
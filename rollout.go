@@ -0,0 +1,154 @@
+package certdepot
+
+import (
+	"context"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+// RolloutOptions configure how RotateFleet stages a rotation.
+type RolloutOptions struct {
+	// BatchSize is the number of certificates rotated in each batch.
+	BatchSize int `bson:"batch_size,omitempty" json:"batch_size,omitempty" yaml:"batch_size,omitempty"`
+	// BatchPercent is the percentage of the certificates rotated in each
+	// batch, rounded up. Exactly one of BatchSize and BatchPercent must be
+	// set.
+	BatchPercent int `bson:"batch_percent,omitempty" json:"batch_percent,omitempty" yaml:"batch_percent,omitempty"`
+	// Interval is how long to wait after a batch before checking its
+	// health, such as to give services time to pick up their new
+	// certificates.
+	Interval time.Duration `bson:"interval,omitempty" json:"interval,omitempty" yaml:"interval,omitempty"`
+	// HealthCheck, if set, is called after each batch except the last. If
+	// it returns an error, the rollout is halted before the next batch.
+	HealthCheck func(context.Context, RolloutBatch) error `bson:"-" json:"-" yaml:"-"`
+}
+
+// Validate checks that the options are valid.
+func (opts RolloutOptions) Validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.BatchSize < 0, "batch size cannot be negative")
+	catcher.NewWhen(opts.BatchPercent < 0 || opts.BatchPercent > 100, "batch percent must be between 1 and 100")
+	catcher.NewWhen((opts.BatchSize == 0) == (opts.BatchPercent == 0), "must specify exactly one of batch size or batch percent")
+	catcher.NewWhen(opts.Interval < 0, "interval cannot be negative")
+	return catcher.Resolve()
+}
+
+// batchSize returns the number of certificates in each batch of a rollout
+// of the total number of certificates.
+func (opts RolloutOptions) batchSize(total int) int {
+	if opts.BatchSize > 0 {
+		return opts.BatchSize
+	}
+	return (total*opts.BatchPercent + 99) / 100
+}
+
+// RolloutBatch is a batch of certificates rotated together.
+type RolloutBatch struct {
+	// Index is the position of the batch in the rollout, starting at 0.
+	Index int `bson:"index" json:"index" yaml:"index"`
+	// Names are the names of the certificates in the batch.
+	Names []string `bson:"names" json:"names" yaml:"names"`
+}
+
+// RolloutResult is the outcome of a staged rotation.
+type RolloutResult struct {
+	// Batches are the batches that were rotated, in order.
+	Batches []RolloutBatch `bson:"batches" json:"batches" yaml:"batches"`
+	// Remaining are the names of the certificates that were not rotated
+	// because the rollout was halted.
+	Remaining []string `bson:"remaining,omitempty" json:"remaining,omitempty" yaml:"remaining,omitempty"`
+}
+
+// Halted returns whether the rollout stopped before every certificate was
+// rotated.
+func (r *RolloutResult) Halted() bool { return len(r.Remaining) != 0 }
+
+// RotateFleet re-issues the certificate for every spec, regardless of whether
+// it needs to be renewed, in batches of the configured size. After each batch
+// except the last, it waits for the interval and then calls the health check,
+// so that a bad rotation can be halted before it reaches every service. The
+// rollout halts if the health check fails, if any certificate in a batch
+// cannot be issued, or if the context is done; the result contains the
+// batches that were rotated and the names that were not.
+func RotateFleet(ctx context.Context, wd Depot, specs []CertificateSpec, opts RolloutOptions) (*RolloutResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid rollout options")
+	}
+
+	seen := map[string]bool{}
+	scs := make([]*serviceCertificate, 0, len(specs))
+	for _, spec := range specs {
+		sc, err := newServiceCertificate(wd, spec.Name, spec.EnsureServiceCertificateOptions)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving spec for '%s'", spec.Name)
+		}
+		if seen[sc.name] {
+			return nil, errors.Errorf("certificate '%s' is specified more than once", sc.name)
+		}
+		seen[sc.name] = true
+		scs = append(scs, sc)
+	}
+
+	res := &RolloutResult{Batches: []RolloutBatch{}}
+	size := opts.batchSize(len(scs))
+	for start := 0; start < len(scs); start += size {
+		end := start + size
+		if end > len(scs) {
+			end = len(scs)
+		}
+		halt := func(err error) (*RolloutResult, error) {
+			for _, sc := range scs[end:] {
+				res.Remaining = append(res.Remaining, sc.name)
+			}
+			return res, err
+		}
+		if err := ctx.Err(); err != nil {
+			end = start
+			return halt(errors.WithStack(err))
+		}
+
+		batch := RolloutBatch{Index: len(res.Batches), Names: []string{}}
+		catcher := grip.NewBasicCatcher()
+		for _, sc := range scs[start:end] {
+			if err := sc.issue(wd, "fleet rotation"); err != nil {
+				catcher.Wrapf(err, "rotating certificate '%s'", sc.name)
+				res.Remaining = append(res.Remaining, sc.name)
+				continue
+			}
+			batch.Names = append(batch.Names, sc.name)
+		}
+		res.Batches = append(res.Batches, batch)
+		grip.Info(message.Fields{
+			"message": "rotated batch of certificates",
+			"batch":   batch.Index,
+			"names":   batch.Names,
+			"failed":  catcher.Len(),
+		})
+		if catcher.HasErrors() {
+			return halt(errors.Wrapf(catcher.Resolve(), "rotating batch %d", batch.Index))
+		}
+		if end == len(scs) {
+			break
+		}
+
+		if opts.Interval > 0 {
+			timer := time.NewTimer(opts.Interval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return halt(errors.WithStack(ctx.Err()))
+			case <-timer.C:
+			}
+		}
+		if opts.HealthCheck != nil {
+			if err := opts.HealthCheck(ctx, batch); err != nil {
+				return halt(errors.Wrapf(err, "health check failed after batch %d", batch.Index))
+			}
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,123 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateFleet(t *testing.T) {
+	ctx := context.TODO()
+	tempDir, err := ioutil.TempDir(".", "rollout-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+
+	specs := []CertificateSpec{}
+	for _, name := range []string{"svc-1", "svc-2", "svc-3", "svc-4", "svc-5"} {
+		specs = append(specs, CertificateSpec{Name: name})
+	}
+	// fingerprints returns the fingerprint of each service's certificate.
+	fingerprints := func(t *testing.T) map[string]string {
+		out := map[string]string{}
+		for _, spec := range specs {
+			crt, err := getRawCertificate(d, spec.Name)
+			require.NoError(t, err)
+			out[spec.Name] = certificateFingerprint(crt)
+		}
+		return out
+	}
+	for _, spec := range specs {
+		_, err := EnsureServiceCertificate(ctx, d, spec.Name, spec.EnsureServiceCertificateOptions)
+		require.NoError(t, err)
+	}
+
+	t.Run("RotatesInBatches", func(t *testing.T) {
+		before := fingerprints(t)
+		checked := []RolloutBatch{}
+		res, err := RotateFleet(ctx, d, specs, RolloutOptions{
+			BatchSize: 2,
+			HealthCheck: func(_ context.Context, batch RolloutBatch) error {
+				checked = append(checked, batch)
+				return nil
+			},
+		})
+		require.NoError(t, err)
+		assert.False(t, res.Halted())
+		assert.Equal(t, []RolloutBatch{
+			{Index: 0, Names: []string{"svc-1", "svc-2"}},
+			{Index: 1, Names: []string{"svc-3", "svc-4"}},
+			{Index: 2, Names: []string{"svc-5"}},
+		}, res.Batches)
+		assert.Equal(t, res.Batches[:2], checked)
+
+		after := fingerprints(t)
+		for name := range before {
+			assert.NotEqual(t, before[name], after[name], name)
+		}
+	})
+	t.Run("BatchesByPercent", func(t *testing.T) {
+		res, err := RotateFleet(ctx, d, specs, RolloutOptions{BatchPercent: 40})
+		require.NoError(t, err)
+		require.Len(t, res.Batches, 3)
+		assert.Len(t, res.Batches[0].Names, 2)
+	})
+	t.Run("HaltsOnFailedHealthCheck", func(t *testing.T) {
+		before := fingerprints(t)
+		res, err := RotateFleet(ctx, d, specs, RolloutOptions{
+			BatchSize: 2,
+			HealthCheck: func(context.Context, RolloutBatch) error {
+				return errors.New("error rate too high")
+			},
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "error rate too high")
+		assert.True(t, res.Halted())
+		require.Len(t, res.Batches, 1)
+		assert.Equal(t, []string{"svc-3", "svc-4", "svc-5"}, res.Remaining)
+
+		after := fingerprints(t)
+		assert.NotEqual(t, before["svc-1"], after["svc-1"])
+		for _, name := range res.Remaining {
+			assert.Equal(t, before[name], after[name], name)
+		}
+	})
+	t.Run("HaltsWhenContextIsDone", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		res, err := RotateFleet(cctx, d, specs, RolloutOptions{
+			BatchSize: 3,
+			HealthCheck: func(context.Context, RolloutBatch) error {
+				cancel()
+				return nil
+			},
+		})
+		require.Error(t, err)
+		require.Len(t, res.Batches, 1)
+		assert.Equal(t, []string{"svc-4", "svc-5"}, res.Remaining)
+	})
+	t.Run("RejectsInvalidOptions", func(t *testing.T) {
+		for _, opts := range []RolloutOptions{
+			{},
+			{BatchSize: 1, BatchPercent: 10},
+			{BatchPercent: 101},
+			{BatchSize: -1},
+		} {
+			_, err := RotateFleet(ctx, d, specs, opts)
+			assert.Error(t, err)
+		}
+		_, err := RotateFleet(ctx, d, append(specs, specs[0]), RolloutOptions{BatchSize: 1})
+		assert.Error(t, err)
+	})
+}
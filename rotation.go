@@ -0,0 +1,243 @@
+package certdepot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rotationFileExtension is the extension of the sidecar file in a file depot
+// that holds the rotation history of a name.
+const rotationFileExtension = ".rotation"
+
+// RotationInfo describes when the certificate stored under a name was issued
+// and rotated.
+type RotationInfo struct {
+	// Name is the name the certificate is stored under.
+	Name string `bson:"_id" json:"name" yaml:"name"`
+	// LastIssued is when the current certificate was put in the depot. It
+	// is zero if the certificate was put in the depot before issuance was
+	// tracked.
+	LastIssued time.Time `bson:"last_issued,omitempty" json:"last_issued,omitempty" yaml:"last_issued,omitempty"`
+	// LastRotated is when the current certificate replaced a previous
+	// certificate stored under the same name. It is zero if the
+	// certificate has never been rotated.
+	LastRotated time.Time `bson:"last_rotated,omitempty" json:"last_rotated,omitempty" yaml:"last_rotated,omitempty"`
+}
+
+// next returns the rotation info after a new certificate is put at
+// the given time.
+func (info RotationInfo) next(now time.Time) RotationInfo {
+	if !info.LastIssued.IsZero() {
+		info.LastRotated = now
+	}
+	info.LastIssued = now
+
+	return info
+}
+
+// isStale returns whether the certificate was issued before the cutoff, or if
+// it is not known when it was issued.
+func (info RotationInfo) isStale(cutoff time.Time) bool {
+	return info.LastIssued.IsZero() || info.LastIssued.Before(cutoff)
+}
+
+// Put inserts the data into the file specified by the tag and, if the data is
+// a certificate, records its issuance in the name's rotation history.
+func (fd *fileDepot) Put(tag *depot.Tag, data []byte) error {
+	defer fd.names.lock(getNameFromTag(tag))()
+	return fd.put(tag, data)
+}
+
+// put is Put without locking the name.
+func (fd *fileDepot) put(tag *depot.Tag, data []byte) error {
+	data, err := checkPEM(fd.opts, tag, data)
+	if err != nil {
+		return err
+	}
+	if err = fd.FileDepot.Put(tag, data); err != nil {
+		return err
+	}
+
+	name := GetNameFromCrtTag(tag)
+	if name == "" {
+		return nil
+	}
+	info, err := fd.GetRotationInfo(name)
+	if err != nil {
+		return errors.Wrap(err, "getting rotation info")
+	}
+
+	return errors.Wrap(fd.putRotationInfo(info.next(time.Now().UTC())), "recording certificate issuance")
+}
+
+// GetRotationInfo returns when the certificate stored under the name was last
+// issued and rotated.
+func (fd *fileDepot) GetRotationInfo(name string) (RotationInfo, error) {
+	info := RotationInfo{Name: name}
+	data, err := ioutil.ReadFile(filepath.Join(fd.dir, name+rotationFileExtension))
+	if os.IsNotExist(err) {
+		return info, nil
+	}
+	if err != nil {
+		return info, errors.Wrap(err, "reading rotation file")
+	}
+	if err = json.Unmarshal(data, &info); err != nil {
+		return info, errors.Wrap(err, "unmarshalling rotation info")
+	}
+	info.Name = name
+
+	return info, nil
+}
+
+func (fd *fileDepot) putRotationInfo(info RotationInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return errors.Wrap(err, "marshalling rotation info")
+	}
+
+	return errors.WithStack(writeFileAtomic(fd.dir, info.Name+rotationFileExtension, data))
+}
+
+// FindStale returns the rotation info of all certificates in the file depot
+// that were last issued before the cutoff, including certificates whose
+// issuance was never tracked.
+func (fd *fileDepot) FindStale(cutoff time.Time) ([]RotationInfo, error) {
+	names, err := fd.ListNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing names")
+	}
+
+	stale := []RotationInfo{}
+	for _, name := range names {
+		if !fd.Check(CrtTag(name)) {
+			continue
+		}
+		info, err := fd.GetRotationInfo(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting rotation info for '%s'", name)
+		}
+		if info.isStale(cutoff) {
+			stale = append(stale, info)
+		}
+	}
+
+	return stale, nil
+}
+
+// putCertificate sets the certificate for the user and records its issuance
+// in the user's rotation history.
+func (m *mongoDepot) putCertificate(name string, data []byte) error {
+	now := time.Now().UTC()
+	update := bson.M{
+		"$set":         bson.M{userCertKey: string(data), userLastIssuedKey: now},
+		"$inc":         bson.M{userRevisionKey: 1},
+		"$setOnInsert": bson.M{userSchemaVersionKey: CurrentUserSchemaVersion},
+	}
+	if err := m.decorate(name, update); err != nil {
+		return errors.Wrap(err, "decorating user")
+	}
+
+	prev := RotationInfo{}
+	findCtx, findCancel := m.writeContext()
+	defer findCancel()
+	m.recentWrites.record(name)
+	err := m.coll.FindOneAndUpdate(findCtx,
+		bson.D{{Key: userIDKey, Value: name}},
+		update,
+		options.FindOneAndUpdate().
+			SetUpsert(true).
+			SetReturnDocument(options.Before).
+			SetProjection(bson.M{userLastIssuedKey: 1}),
+	).Decode(&prev)
+	if errNotNoDocuments(err) {
+		return errors.Wrap(err, "adding certificate to the database")
+	}
+
+	if prev.LastIssued.IsZero() {
+		return nil
+	}
+	updateCtx, updateCancel := m.writeContext()
+	defer updateCancel()
+	if _, err = m.coll.UpdateOne(updateCtx,
+		bson.D{{Key: userIDKey, Value: name}},
+		bson.M{"$set": bson.M{userLastRotatedKey: now}}); err != nil {
+		return errors.Wrap(err, "recording certificate rotation")
+	}
+
+	return nil
+}
+
+// GetRotationInfo returns when the certificate for the user was last issued
+// and rotated.
+func (m *mongoDepot) GetRotationInfo(name string) (RotationInfo, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
+	info := RotationInfo{}
+	err := m.readColl(name).FindOne(ctx,
+		bson.D{{Key: userIDKey, Value: name}},
+		options.FindOne().SetProjection(bson.M{userLastIssuedKey: 1, userLastRotatedKey: 1}),
+	).Decode(&info)
+	if errNotNoDocuments(err) {
+		return info, errors.Wrapf(err, "looking up name '%s' in the database", name)
+	}
+	info.Name = name
+
+	return info, nil
+}
+
+// FindStale returns the rotation info of all users whose certificates were
+// last issued before the cutoff, including certificates whose issuance was
+// never tracked.
+func (m *mongoDepot) FindStale(cutoff time.Time) ([]RotationInfo, error) {
+	ctx, cancel := m.readContext()
+	defer cancel()
+
+	res, err := m.coll.Find(ctx,
+		bson.M{
+			userCertKey: bson.M{"$exists": true, "$ne": ""},
+			"$or": []bson.M{
+				{userLastIssuedKey: bson.M{"$lt": cutoff}},
+				{userLastIssuedKey: bson.M{"$exists": false}},
+			},
+		},
+		options.Find().
+			SetProjection(bson.M{userLastIssuedKey: 1, userLastRotatedKey: 1}).
+			SetSort(bson.M{userIDKey: 1}))
+	if err != nil {
+		return nil, errors.Wrap(err, "finding stale users")
+	}
+
+	stale := []RotationInfo{}
+	if err := res.All(ctx, &stale); err != nil {
+		return nil, errors.Wrap(err, "decoding results")
+	}
+
+	return stale, nil
+}
+
+// FindStale returns the rotation info of all certificates in the depot that
+// have not been issued or rotated within the given duration, sorted by name.
+func FindStale(d Depot, olderThan time.Duration) ([]RotationInfo, error) {
+	tracker, ok := d.(RotationTracker)
+	if !ok {
+		return nil, errors.Errorf("depot of type %T does not track rotation", d)
+	}
+
+	stale, err := tracker.FindStale(time.Now().Add(-olderThan))
+	if err != nil {
+		return nil, errors.Wrap(err, "finding stale certificates")
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Name < stale[j].Name })
+
+	return stale, nil
+}
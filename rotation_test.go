@@ -0,0 +1,65 @@
+package certdepot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDepotRotation(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "rotation-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := NewFileDepot(tempDir)
+	require.NoError(t, err)
+	tracker, ok := d.(RotationTracker)
+	require.True(t, ok)
+
+	t.Run("TracksIssuanceAndRotation", func(t *testing.T) {
+		require.NoError(t, d.Put(CrtTag("alice"), []byte("first certificate")))
+		info, err := tracker.GetRotationInfo("alice")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", info.Name)
+		assert.WithinDuration(t, time.Now(), info.LastIssued, time.Minute)
+		assert.Zero(t, info.LastRotated)
+
+		require.NoError(t, d.Delete(CrtTag("alice")))
+		require.NoError(t, d.Put(CrtTag("alice"), []byte("second certificate")))
+		rotated, err := tracker.GetRotationInfo("alice")
+		require.NoError(t, err)
+		assert.False(t, rotated.LastIssued.Before(info.LastIssued))
+		assert.Equal(t, rotated.LastIssued, rotated.LastRotated)
+	})
+	t.Run("IgnoresOtherTags", func(t *testing.T) {
+		require.NoError(t, d.Put(PrivKeyTag("bob"), []byte("key")))
+		info, err := tracker.GetRotationInfo("bob")
+		require.NoError(t, err)
+		assert.Zero(t, info.LastIssued)
+	})
+	t.Run("FindStale", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tempDir, "legacy.crt"), []byte("legacy certificate"), 0444))
+
+		stale, err := FindStale(d, time.Hour)
+		require.NoError(t, err)
+		require.Len(t, stale, 1)
+		assert.Equal(t, "legacy", stale[0].Name)
+		assert.Zero(t, stale[0].LastIssued)
+
+		stale, err = FindStale(d, -time.Minute)
+		require.NoError(t, err)
+		require.Len(t, stale, 2)
+		assert.Equal(t, "alice", stale[0].Name)
+		assert.Equal(t, "legacy", stale[1].Name)
+
+		names, err := d.(NameLister).ListNames()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"alice", "bob", "legacy"}, names)
+	})
+}
@@ -0,0 +1,219 @@
+package certdepot
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultEC2MetadataEndpoint is the address of the EC2 instance
+	// metadata service.
+	defaultEC2MetadataEndpoint = "http://169.254.169.254"
+	// ec2MetadataTokenTTL is how long, in seconds, an IMDSv2 session token
+	// requested by PopulateSANs is valid.
+	ec2MetadataTokenTTL = "60"
+	// maxMetadataSize is the largest instance metadata value that is read.
+	maxMetadataSize = 1 << 16
+)
+
+// SANDiscoveryOptions selects where PopulateSANs discovers subject alt names.
+type SANDiscoveryOptions struct {
+	// Hostname adds the host name reported by the kernel.
+	Hostname bool `bson:"hostname,omitempty" json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	// Interfaces adds the addresses of the host's network interfaces that
+	// are up, except for loopback and link-local addresses.
+	Interfaces bool `bson:"interfaces,omitempty" json:"interfaces,omitempty" yaml:"interfaces,omitempty"`
+	// EC2Metadata adds the private and public host names and IPv4
+	// addresses reported by the EC2 instance metadata service.
+	EC2Metadata bool `bson:"ec2_metadata,omitempty" json:"ec2_metadata,omitempty" yaml:"ec2_metadata,omitempty"`
+	// MetadataEndpoint overrides the address of the instance metadata
+	// service.
+	MetadataEndpoint string `bson:"metadata_endpoint,omitempty" json:"metadata_endpoint,omitempty" yaml:"metadata_endpoint,omitempty"`
+	// Client is the HTTP client used to query the instance metadata
+	// service. It defaults to a client with a 2 second timeout.
+	Client *http.Client `bson:"-" json:"-" yaml:"-"`
+}
+
+// PopulateSANs adds the host names and IP addresses of the current host,
+// discovered from the sources selected in the discovery options, to the DNS
+// names and IP addresses of the certificate options, so that agents
+// bootstrapping on dynamic hosts do not need their own discovery code. Names
+// and addresses already in the options are not added again.
+func (opts *CertificateOptions) PopulateSANs(ctx context.Context, discovery SANDiscoveryOptions) error {
+	names := []string{}
+	ips := []net.IP{}
+
+	if discovery.Hostname {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "getting host name")
+		}
+		names = append(names, hostname)
+	}
+
+	if discovery.Interfaces {
+		addrs, err := interfaceAddresses()
+		if err != nil {
+			return errors.Wrap(err, "getting network interface addresses")
+		}
+		ips = append(ips, addrs...)
+	}
+
+	if discovery.EC2Metadata {
+		ec2Names, ec2IPs, err := discovery.ec2SANs(ctx)
+		if err != nil {
+			return errors.Wrap(err, "querying EC2 instance metadata")
+		}
+		names = append(names, ec2Names...)
+		ips = append(ips, ec2IPs...)
+	}
+
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		if name != "" && !containsFold(opts.Domain, name) {
+			opts.Domain = append(opts.Domain, name)
+		}
+	}
+	for _, ip := range ips {
+		if !containsIP(opts.IP, ip) {
+			opts.IP = append(opts.IP, ip.String())
+		}
+	}
+
+	return nil
+}
+
+// interfaceAddresses returns the addresses of the network interfaces that
+// are up, except for loopback and link-local addresses.
+func interfaceAddresses() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ips := []net.IP{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting addresses of interface '%s'", iface.Name)
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+
+	return ips, nil
+}
+
+// ec2SANs returns the host names and IP addresses of the EC2 instance, using
+// an IMDSv2 session token.
+func (d SANDiscoveryOptions) ec2SANs(ctx context.Context) ([]string, []net.IP, error) {
+	endpoint := strings.TrimSuffix(d.MetadataEndpoint, "/")
+	if endpoint == "" {
+		endpoint = defaultEC2MetadataEndpoint
+	}
+	client := d.Client
+	if client == nil {
+		client = &http.Client{Timeout: 2 * time.Second}
+	}
+
+	tokenReq, err := http.NewRequest(http.MethodPut, endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "creating token request")
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", ec2MetadataTokenTTL)
+	token, _, err := getMetadata(ctx, client, tokenReq)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "getting session token")
+	}
+
+	names := []string{}
+	ips := []net.IP{}
+	for _, path := range []string{"local-hostname", "local-ipv4", "public-hostname", "public-ipv4"} {
+		req, err := http.NewRequest(http.MethodGet, endpoint+"/latest/meta-data/"+path, nil)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "creating request for '%s'", path)
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		value, found, err := getMetadata(ctx, client, req)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "getting '%s'", path)
+		}
+		// Instances without a public address have no public host name
+		// or IP address.
+		if !found || value == "" {
+			continue
+		}
+
+		if strings.HasSuffix(path, "ipv4") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, nil, errors.Errorf("'%s' is not an IP address: '%s'", path, value)
+			}
+			ips = append(ips, ip)
+		} else {
+			names = append(names, value)
+		}
+	}
+
+	return names, ips, nil
+}
+
+// getMetadata sends the request to the instance metadata service and returns
+// the trimmed response body, or false if the value does not exist.
+func getMetadata(ctx context.Context, client *http.Client, req *http.Request) (string, bool, error) {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", false, errors.Wrap(err, "sending request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, errors.Errorf("request returned status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMetadataSize))
+	if err != nil {
+		return "", false, errors.Wrap(err, "reading response")
+	}
+
+	return strings.TrimSpace(string(data)), true, nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(values []string, ip net.IP) bool {
+	for _, v := range values {
+		if parsed := net.ParseIP(v); parsed != nil && parsed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
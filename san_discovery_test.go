@@ -0,0 +1,102 @@
+package certdepot
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPopulateSANs(t *testing.T) {
+	ctx := context.TODO()
+
+	// newMetadataServer returns a fake EC2 instance metadata service that
+	// requires an IMDSv2 session token.
+	newMetadataServer := func(values map[string]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/latest/api/token" {
+				if r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				_, _ = w.Write([]byte("token"))
+				return
+			}
+			if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			value, ok := values[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write([]byte(value))
+		}))
+	}
+
+	t.Run("EC2Metadata", func(t *testing.T) {
+		srv := newMetadataServer(map[string]string{
+			"/latest/meta-data/local-hostname":  "ip-10-0-0-5.ec2.internal",
+			"/latest/meta-data/local-ipv4":      "10.0.0.5",
+			"/latest/meta-data/public-hostname": "ec2-54-1-2-3.compute-1.amazonaws.com",
+			"/latest/meta-data/public-ipv4":     "54.1.2.3\n",
+		})
+		defer srv.Close()
+
+		opts := CertificateOptions{Domain: []string{"IP-10-0-0-5.ec2.internal"}, IP: []string{"10.0.0.5"}}
+		require.NoError(t, opts.PopulateSANs(ctx, SANDiscoveryOptions{EC2Metadata: true, MetadataEndpoint: srv.URL}))
+		assert.Equal(t, []string{"IP-10-0-0-5.ec2.internal", "ec2-54-1-2-3.compute-1.amazonaws.com"}, opts.Domain)
+		assert.Equal(t, []string{"10.0.0.5", "54.1.2.3"}, opts.IP)
+	})
+	t.Run("EC2MetadataWithoutPublicAddress", func(t *testing.T) {
+		srv := newMetadataServer(map[string]string{
+			"/latest/meta-data/local-hostname": "ip-10-0-0-5.ec2.internal",
+			"/latest/meta-data/local-ipv4":     "10.0.0.5",
+		})
+		defer srv.Close()
+
+		opts := CertificateOptions{}
+		require.NoError(t, opts.PopulateSANs(ctx, SANDiscoveryOptions{EC2Metadata: true, MetadataEndpoint: srv.URL}))
+		assert.Equal(t, []string{"ip-10-0-0-5.ec2.internal"}, opts.Domain)
+		assert.Equal(t, []string{"10.0.0.5"}, opts.IP)
+	})
+	t.Run("FailsWithInvalidMetadata", func(t *testing.T) {
+		srv := newMetadataServer(map[string]string{"/latest/meta-data/local-ipv4": "not an IP"})
+		defer srv.Close()
+
+		opts := CertificateOptions{}
+		assert.Error(t, opts.PopulateSANs(ctx, SANDiscoveryOptions{EC2Metadata: true, MetadataEndpoint: srv.URL}))
+		assert.Empty(t, opts.IP)
+	})
+	t.Run("Hostname", func(t *testing.T) {
+		hostname, err := os.Hostname()
+		require.NoError(t, err)
+
+		opts := CertificateOptions{}
+		require.NoError(t, opts.PopulateSANs(ctx, SANDiscoveryOptions{Hostname: true}))
+		if net.ParseIP(hostname) == nil {
+			assert.Equal(t, []string{hostname}, opts.Domain)
+		}
+	})
+	t.Run("Interfaces", func(t *testing.T) {
+		opts := CertificateOptions{}
+		require.NoError(t, opts.PopulateSANs(ctx, SANDiscoveryOptions{Interfaces: true}))
+		for _, addr := range opts.IP {
+			ip := net.ParseIP(addr)
+			require.NotNil(t, ip)
+			assert.False(t, ip.IsLoopback())
+		}
+	})
+	t.Run("NoSources", func(t *testing.T) {
+		opts := CertificateOptions{Domain: []string{"alice"}}
+		require.NoError(t, opts.PopulateSANs(ctx, SANDiscoveryOptions{}))
+		assert.Equal(t, []string{"alice"}, opts.Domain)
+		assert.Empty(t, opts.IP)
+	})
+}
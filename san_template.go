@@ -0,0 +1,61 @@
+package certdepot
+
+import (
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// sanTemplateData is the data the subject alt name templates in DepotOptions
+// are executed with.
+type sanTemplateData struct {
+	// Name is the name the credentials are generated for.
+	Name string
+}
+
+// applySANTemplates adds the DNS name and URI rendered from the options'
+// templates for the name to the certificate options.
+func (do DepotOptions) applySANTemplates(name string, opts *CertificateOptions) error {
+	name, err := canonicalName(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	domain, err := executeSANTemplate("domain", do.DomainTemplate, name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if domain != "" {
+		opts.Domain = append(opts.Domain, domain)
+	}
+
+	uri, err := executeSANTemplate("URI", do.URITemplate, name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if uri != "" {
+		opts.URI = append(opts.URI, uri)
+	}
+
+	return nil
+}
+
+// executeSANTemplate returns the template text executed for the name, or an
+// empty string if the text is empty.
+func executeSANTemplate(kind, text, name string) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+
+	tmpl, err := template.New(kind).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing %s template", kind)
+	}
+	out := &strings.Builder{}
+	if err = tmpl.Execute(out, sanTemplateData{Name: name}); err != nil {
+		return "", errors.Wrapf(err, "executing %s template for '%s'", kind, name)
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
@@ -0,0 +1,64 @@
+package certdepot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSANTemplates(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "san-template-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	t.Run("GenerateAddsSANs", func(t *testing.T) {
+		d, err := MakeFileDepot(tempDir, DepotOptions{
+			CA:                "root",
+			DefaultExpiration: time.Hour,
+			DomainTemplate:    "{{.Name}}.svc.internal",
+			URITemplate:       "spiffe://corp/{{.Name}}",
+		})
+		require.NoError(t, err)
+		caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+		require.NoError(t, caOpts.Init(d))
+
+		creds, err := d.Generate("alice")
+		require.NoError(t, err)
+		bundle, err := creds.Bundle()
+		require.NoError(t, err)
+		assert.Equal(t, "alice", bundle.Certificate.Subject.CommonName)
+		assert.Equal(t, []string{"alice.svc.internal"}, bundle.Certificate.DNSNames)
+		require.Len(t, bundle.Certificate.URIs, 1)
+		assert.Equal(t, "spiffe://corp/alice", bundle.Certificate.URIs[0].String())
+	})
+	t.Run("WithoutTemplates", func(t *testing.T) {
+		opts := CertificateOptions{}
+		require.NoError(t, DepotOptions{}.applySANTemplates("alice", &opts))
+		assert.Empty(t, opts.Domain)
+		assert.Empty(t, opts.URI)
+	})
+	t.Run("UsesCanonicalName", func(t *testing.T) {
+		opts := CertificateOptions{}
+		require.NoError(t, DepotOptions{DomainTemplate: "{{.Name}}.internal"}.applySANTemplates("bob smith", &opts))
+		assert.Equal(t, []string{"bob_smith.internal"}, opts.Domain)
+	})
+	t.Run("RejectsInvalidTemplates", func(t *testing.T) {
+		for _, do := range []DepotOptions{
+			{DomainTemplate: "{{.Name"},
+			{URITemplate: "spiffe://corp/{{.Namespace}}"},
+		} {
+			assert.Error(t, do.applySANTemplates("alice", &CertificateOptions{}))
+		}
+
+		d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour, DomainTemplate: "{{.Name}} .internal"})
+		require.NoError(t, err)
+		_, err = d.Generate("carol")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,221 @@
+package certdepot
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+// DepotOperation is an operation on a depot that a Scope may allow.
+type DepotOperation string
+
+const (
+	// DepotOpCheck is Check and CheckWithError.
+	DepotOpCheck DepotOperation = "check"
+	// DepotOpGet is Get.
+	DepotOpGet DepotOperation = "get"
+	// DepotOpPut is Put.
+	DepotOpPut DepotOperation = "put"
+	// DepotOpDelete is Delete.
+	DepotOpDelete DepotOperation = "delete"
+	// DepotOpFind is Find.
+	DepotOpFind DepotOperation = "find"
+	// DepotOpSave is Save.
+	DepotOpSave DepotOperation = "save"
+	// DepotOpGenerate is Generate and GenerateWithOptions.
+	DepotOpGenerate DepotOperation = "generate"
+)
+
+// ReadOnlyDepotOperations are the operations that do not modify a depot.
+var ReadOnlyDepotOperations = []DepotOperation{DepotOpCheck, DepotOpGet, DepotOpFind}
+
+// Scope restricts the names and operations a scoped depot allows.
+type Scope struct {
+	// Names are the glob patterns, as matched by path.Match, of the names
+	// that may be accessed, e.g. "service-x*". Patterns match the name
+	// with spaces replaced by underscores.
+	Names []string `bson:"names" json:"names" yaml:"names"`
+	// Operations are the operations that may be performed on those names.
+	Operations []DepotOperation `bson:"operations" json:"operations" yaml:"operations"`
+}
+
+// Validate checks that the scope's patterns are well-formed.
+func (s Scope) Validate() error {
+	for _, pattern := range s.Names {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid name pattern '%s'", pattern)
+		}
+	}
+
+	return nil
+}
+
+// allows returns whether the scope allows the operation on the name.
+func (s Scope) allows(op DepotOperation, name string) bool {
+	allowed := false
+	for _, scopeOp := range s.Operations {
+		if scopeOp == op {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	name = formatName(name)
+	for _, pattern := range s.Names {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ScopeError is returned when a scoped depot denies an operation. Use
+// errors.As to check for it.
+type ScopeError struct {
+	// Operation is the operation that was denied.
+	Operation DepotOperation
+	// Name is the name the operation was denied on.
+	Name string
+}
+
+func (e *ScopeError) Error() string {
+	return fmt.Sprintf("operation '%s' on '%s' is not allowed by the depot's scope", e.Operation, e.Name)
+}
+
+// IsScopeError returns whether the error, or the error it wraps, is a
+// ScopeError.
+func IsScopeError(err error) bool {
+	var scopeErr *ScopeError
+	return errors.As(err, &scopeErr)
+}
+
+// scopedDepot is a Depot that only allows the operations and names in its
+// scope.
+type scopedDepot struct {
+	inner Depot
+	scope Scope
+}
+
+// NewScopedDepot returns a handle to the depot that only allows the
+// operations and names in the scope, so that components can be given
+// narrower access than the whole depot. Denied operations return a
+// ScopeError, except for Check, which returns false. Only the name the
+// operation is performed on is checked, along with the requested subject alt
+// names for GenerateWithOptions: for example, a handle that allows
+// Find on "service-x*" can find service-x's credentials, which include the
+// CA's certificate, without being allowed to get the CA's certificate
+// directly.
+func NewScopedDepot(inner Depot, scope Scope) (Depot, error) {
+	if inner == nil {
+		return nil, errors.New("must specify depot")
+	}
+	if err := scope.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid scope")
+	}
+
+	return &scopedDepot{inner: inner, scope: scope}, nil
+}
+
+// check returns a ScopeError if the scope does not allow the operation on the
+// name.
+func (s *scopedDepot) check(op DepotOperation, name string) error {
+	if !s.scope.allows(op, name) {
+		return &ScopeError{Operation: op, Name: name}
+	}
+	return nil
+}
+
+func (s *scopedDepot) Put(tag *depot.Tag, data []byte) error {
+	if err := s.check(DepotOpPut, getNameFromTag(tag)); err != nil {
+		return err
+	}
+	return s.inner.Put(tag, data)
+}
+
+func (s *scopedDepot) Check(tag *depot.Tag) bool {
+	return s.scope.allows(DepotOpCheck, getNameFromTag(tag)) && s.inner.Check(tag)
+}
+
+func (s *scopedDepot) CheckWithError(tag *depot.Tag) (bool, error) {
+	if err := s.check(DepotOpCheck, getNameFromTag(tag)); err != nil {
+		return false, err
+	}
+	return s.inner.CheckWithError(tag)
+}
+
+func (s *scopedDepot) Get(tag *depot.Tag) ([]byte, error) {
+	if err := s.check(DepotOpGet, getNameFromTag(tag)); err != nil {
+		return nil, err
+	}
+	return s.inner.Get(tag)
+}
+
+// GetIfExists requires DepotOpGet.
+func (s *scopedDepot) GetIfExists(tag *depot.Tag) ([]byte, bool, error) {
+	if err := s.check(DepotOpGet, getNameFromTag(tag)); err != nil {
+		return nil, false, err
+	}
+	return GetIfExists(s.inner, tag)
+}
+
+func (s *scopedDepot) Delete(tag *depot.Tag) error {
+	if err := s.check(DepotOpDelete, getNameFromTag(tag)); err != nil {
+		return err
+	}
+	return s.inner.Delete(tag)
+}
+
+func (s *scopedDepot) Save(name string, creds *Credentials) error {
+	if err := s.check(DepotOpSave, name); err != nil {
+		return err
+	}
+	return s.inner.Save(name, creds)
+}
+
+func (s *scopedDepot) Find(name string) (*Credentials, error) {
+	if err := s.check(DepotOpFind, name); err != nil {
+		return nil, err
+	}
+	return s.inner.Find(name)
+}
+
+func (s *scopedDepot) Generate(name string) (*Credentials, error) {
+	if err := s.check(DepotOpGenerate, name); err != nil {
+		return nil, err
+	}
+	return s.inner.Generate(name)
+}
+
+// GenerateWithOptions requires DepotOpGenerate on the common name, the name
+// the certificate is stored under, and every requested subject alt name, so
+// that a handle scoped to some names cannot issue a certificate that is valid
+// for others.
+func (s *scopedDepot) GenerateWithOptions(opts CertificateOptions) (*Credentials, error) {
+	names := []string{opts.CommonName}
+	if name := opts.formattedCertificateName(); name != "" {
+		names = append(names, name)
+	}
+	if opts.Host != "" {
+		names = append(names, opts.Host)
+	}
+	names = append(names, opts.Domain...)
+	names = append(names, opts.IP...)
+	names = append(names, opts.URI...)
+	for _, name := range names {
+		if err := s.check(DepotOpGenerate, name); err != nil {
+			return nil, err
+		}
+	}
+	return s.inner.GenerateWithOptions(opts)
+}
+
+// DepotOptions returns the inner depot's options.
+func (s *scopedDepot) DepotOptions() DepotOptions {
+	return getDepotOptions(s.inner)
+}
@@ -0,0 +1,409 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/pkg/errors"
+)
+
+// SecretsManagerClient is the subset of the AWS Secrets Manager API that a
+// Secrets Manager depot uses, which *secretsmanager.Client implements.
+type SecretsManagerClient interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	CreateSecret(ctx context.Context, params *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error)
+	PutSecretValue(ctx context.Context, params *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error)
+	DeleteSecret(ctx context.Context, params *secretsmanager.DeleteSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DeleteSecretOutput, error)
+	RestoreSecret(ctx context.Context, params *secretsmanager.RestoreSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.RestoreSecretOutput, error)
+	ListSecrets(ctx context.Context, params *secretsmanager.ListSecretsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error)
+}
+
+var _ SecretsManagerClient = &secretsmanager.Client{}
+
+// defaultSecretsManagerRecoveryWindow is how many days deleted secrets can be
+// recovered for if the options do not say otherwise, which is the Secrets
+// Manager default.
+const defaultSecretsManagerRecoveryWindow = 30
+
+// SecretsManagerOptions describe how a Secrets Manager depot connects to AWS
+// Secrets Manager and how it creates secrets.
+type SecretsManagerOptions struct {
+	// Region is the AWS region of the secrets. If unset, the region is
+	// read from the environment or the shared configuration.
+	Region string `bson:"region,omitempty" json:"region,omitempty" yaml:"region,omitempty"`
+	// Profile is the shared configuration profile to load, such as an
+	// IAM Identity Center (SSO) profile. If unset, the default profile is
+	// used.
+	Profile string `bson:"profile,omitempty" json:"profile,omitempty" yaml:"profile,omitempty"`
+	// Credentials are static credentials used to sign requests to AWS. If
+	// unset, the SDK's default credential chain is used: the environment,
+	// the shared configuration and SSO, web identity tokens (such as IAM
+	// roles for service accounts), and ECS task and EC2 instance roles.
+	Credentials AWSCredentials `bson:"credentials" json:"credentials" yaml:"credentials"`
+	// Prefix is prepended to the name of every secret the depot stores. It
+	// defaults to "certdepot/".
+	Prefix string `bson:"prefix,omitempty" json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	// KMSKeyID is the ID or ARN of the KMS key that encrypts new secrets. If
+	// unset, Secrets Manager uses the account's aws/secretsmanager key.
+	KMSKeyID string `bson:"kms_key_id,omitempty" json:"kms_key_id,omitempty" yaml:"kms_key_id,omitempty"`
+	// Tags are added to every secret the depot creates.
+	Tags map[string]string `bson:"tags,omitempty" json:"tags,omitempty" yaml:"tags,omitempty"`
+	// RecoveryWindowInDays is how long deleted secrets can be recovered,
+	// between 7 and 30 days. It defaults to 30 days.
+	RecoveryWindowInDays int `bson:"recovery_window_in_days,omitempty" json:"recovery_window_in_days,omitempty" yaml:"recovery_window_in_days,omitempty"`
+	// ForceDeleteWithoutRecovery deletes secrets immediately, so that they
+	// cannot be recovered, instead of scheduling them for deletion after
+	// the recovery window.
+	ForceDeleteWithoutRecovery bool `bson:"force_delete_without_recovery,omitempty" json:"force_delete_without_recovery,omitempty" yaml:"force_delete_without_recovery,omitempty"`
+	// Endpoint overrides the Secrets Manager endpoint for the region.
+	Endpoint string `bson:"endpoint,omitempty" json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	// Client, if set, is used to make requests instead of a client created
+	// from the region, profile, credentials, and endpoint.
+	Client SecretsManagerClient `bson:"-" json:"-" yaml:"-"`
+}
+
+// Validate checks that the options are valid and sets defaults.
+func (o *SecretsManagerOptions) Validate() error {
+	if o.ForceDeleteWithoutRecovery && o.RecoveryWindowInDays != 0 {
+		return errors.New("cannot specify both a recovery window and deletion without recovery")
+	}
+	if o.RecoveryWindowInDays == 0 {
+		o.RecoveryWindowInDays = defaultSecretsManagerRecoveryWindow
+	}
+	if o.RecoveryWindowInDays < 7 || o.RecoveryWindowInDays > 30 {
+		return errors.Errorf("recovery window of %d days must be between 7 and 30 days", o.RecoveryWindowInDays)
+	}
+	if o.Prefix == "" {
+		o.Prefix = "certdepot/"
+	}
+	if o.Credentials.AccessKeyID != "" || o.Credentials.SecretAccessKey != "" {
+		return errors.Wrap(o.Credentials.Validate(), "invalid AWS credentials")
+	}
+
+	return nil
+}
+
+// client returns the client described by the options, loading the AWS
+// configuration with the SDK's defaults unless a client is set.
+func (o *SecretsManagerOptions) client(ctx context.Context) (SecretsManagerClient, error) {
+	if o.Client != nil {
+		return o.Client, nil
+	}
+
+	loadOpts := []func(*config.LoadOptions) error{}
+	if o.Region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(o.Region))
+	}
+	if o.Profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(o.Profile))
+	}
+	if o.Credentials.AccessKeyID != "" {
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			o.Credentials.AccessKeyID, o.Credentials.SecretAccessKey, o.Credentials.SessionToken)))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading AWS configuration")
+	}
+	if cfg.Region == "" {
+		return nil, errors.New("must specify AWS region")
+	}
+
+	return secretsmanager.NewFromConfig(cfg, func(smOpts *secretsmanager.Options) {
+		if o.Endpoint != "" {
+			smOpts.BaseEndpoint = aws.String(o.Endpoint)
+		}
+	}), nil
+}
+
+// secretsManagerFields are the fields of a secret, keyed by the kind of data.
+// Data that is not valid UTF-8 is base64-encoded under the kind with a
+// "_base64" suffix, so PEM-encoded credentials remain readable in the
+// console.
+type secretsManagerFields map[string]string
+
+func (f secretsManagerFields) get(kind CredentialKind) ([]byte, bool, error) {
+	if value, ok := f[string(kind)]; ok {
+		return []byte(value), true, nil
+	}
+	if value, ok := f[string(kind)+"_base64"]; ok {
+		data, err := base64.StdEncoding.DecodeString(value)
+		return data, true, errors.Wrap(err, "decoding base64 data")
+	}
+	return nil, false, nil
+}
+
+func (f secretsManagerFields) put(kind CredentialKind, data []byte) {
+	f.remove(kind)
+	if utf8.Valid(data) {
+		f[string(kind)] = string(data)
+	} else {
+		f[string(kind)+"_base64"] = base64.StdEncoding.EncodeToString(data)
+	}
+}
+
+func (f secretsManagerFields) remove(kind CredentialKind) {
+	delete(f, string(kind))
+	delete(f, string(kind)+"_base64")
+}
+
+// secretsManagerStore is a CredentialStore backed by AWS Secrets Manager.
+// Each name is a separate secret whose fields hold the kinds of data stored
+// for it; parameters are stored in secrets of their own.
+type secretsManagerStore struct {
+	ctx    context.Context
+	opts   SecretsManagerOptions
+	client SecretsManagerClient
+}
+
+// NewSecretsManagerDepot returns a depot that stores certificates, keys,
+// certificate requests, and revocation lists in AWS Secrets Manager, with one
+// secret per name. Requests to AWS are made with the context. Deleted secrets
+// can be recovered for 30 days unless the options say otherwise.
+//
+// Writing one kind of data for a name reads and rewrites the name's secret.
+// The depot does not implement Locker, so callers that write the same name
+// concurrently from several processes must serialize their writes.
+func NewSecretsManagerDepot(ctx context.Context, opts SecretsManagerOptions, depotOpts DepotOptions) (Depot, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid Secrets Manager options")
+	}
+
+	client, err := opts.client(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating Secrets Manager client")
+	}
+
+	return NewStoreDepot(&secretsManagerStore{ctx: ctx, opts: opts, client: client}, depotOpts)
+}
+
+func (s *secretsManagerStore) Get(name string, kind CredentialKind) ([]byte, error) {
+	fields, exists, err := s.getFields(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting secret for '%s'", name)
+	}
+	data, ok, err := fields.get(kind)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s for '%s'", kind, name)
+	}
+	if !exists || !ok {
+		return nil, errors.Errorf("%s for '%s' not found", kind, name)
+	}
+
+	return data, nil
+}
+
+func (s *secretsManagerStore) Put(name string, kind CredentialKind, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+
+	fields, exists, err := s.getFields(name)
+	if err != nil {
+		return errors.Wrapf(err, "getting secret for '%s'", name)
+	}
+	if !exists {
+		fields = secretsManagerFields{}
+	}
+	fields.put(kind, data)
+
+	return errors.Wrapf(s.putFields(name, fields, exists), "writing %s for '%s'", kind, name)
+}
+
+func (s *secretsManagerStore) Check(name string, kind CredentialKind) (bool, error) {
+	fields, exists, err := s.getFields(name)
+	if err != nil {
+		return false, errors.Wrapf(err, "getting secret for '%s'", name)
+	}
+	if !exists {
+		return false, nil
+	}
+	_, ok, _ := fields.get(kind)
+	return ok, nil
+}
+
+func (s *secretsManagerStore) Delete(name string, kind CredentialKind) error {
+	fields, exists, err := s.getFields(name)
+	if err != nil {
+		return errors.Wrapf(err, "getting secret for '%s'", name)
+	}
+	if _, ok, _ := fields.get(kind); !exists || !ok {
+		return errors.Errorf("%s for '%s' not found", kind, name)
+	}
+	fields.remove(kind)
+
+	if len(fields) > 0 {
+		return errors.Wrapf(s.putFields(name, fields, true), "deleting %s for '%s'", kind, name)
+	}
+
+	input := &secretsmanager.DeleteSecretInput{SecretId: aws.String(s.secretName(name))}
+	if s.opts.ForceDeleteWithoutRecovery {
+		input.ForceDeleteWithoutRecovery = aws.Bool(true)
+	} else {
+		input.RecoveryWindowInDays = aws.Int64(int64(s.opts.RecoveryWindowInDays))
+	}
+	_, err = s.client.DeleteSecret(s.ctx, input)
+	return errors.Wrapf(err, "deleting secret for '%s'", name)
+}
+
+// ListNames returns the sorted names that have secrets in Secrets Manager.
+// Secrets that are scheduled for deletion are not listed.
+func (s *secretsManagerStore) ListNames() ([]string, error) {
+	seen := map[string]bool{}
+	names := []string{}
+	paginator := secretsmanager.NewListSecretsPaginator(s.client, &secretsmanager.ListSecretsInput{
+		Filters: []types.Filter{{Key: types.FilterNameStringTypeName, Values: []string{s.opts.Prefix}}},
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(s.ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "listing secrets")
+		}
+
+		for _, secret := range out.SecretList {
+			secretName := aws.ToString(secret.Name)
+			// The name filter matches prefixes of any word in the
+			// name, so check the whole prefix.
+			if !strings.HasPrefix(secretName, s.opts.Prefix) {
+				continue
+			}
+			stored, err := unescapeSecretName(strings.TrimPrefix(secretName, s.opts.Prefix))
+			if err != nil {
+				return nil, errors.Wrapf(err, "unescaping secret name '%s'", secretName)
+			}
+			// Parameters are stored under the name with the
+			// parameter suffix, so they belong to the name without
+			// it.
+			name := getNameFromTag(PrivKeyTag(stored))
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// getFields returns the fields of the secret for the name and whether the
+// secret exists.
+func (s *secretsManagerStore) getFields(name string) (secretsManagerFields, bool, error) {
+	out, err := s.client.GetSecretValue(s.ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(s.secretName(name))})
+	// Secrets that are scheduled for deletion cannot be read, so they are
+	// treated as not existing.
+	var notFound *types.ResourceNotFoundException
+	var invalidRequest *types.InvalidRequestException
+	if errors.As(err, &notFound) || errors.As(err, &invalidRequest) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+
+	fields := secretsManagerFields{}
+	if err = json.Unmarshal([]byte(aws.ToString(out.SecretString)), &fields); err != nil {
+		return nil, false, errors.Wrap(err, "unmarshalling secret")
+	}
+
+	return fields, true, nil
+}
+
+// putFields writes the fields to the secret for the name, creating the
+// secret if it does not exist.
+func (s *secretsManagerStore) putFields(name string, fields secretsManagerFields, exists bool) error {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return errors.Wrap(err, "marshalling secret")
+	}
+	secretName := s.secretName(name)
+
+	if exists {
+		_, err = s.client.PutSecretValue(s.ctx, &secretsmanager.PutSecretValueInput{
+			SecretId:     aws.String(secretName),
+			SecretString: aws.String(string(data)),
+		})
+		return errors.WithStack(err)
+	}
+
+	input := &secretsmanager.CreateSecretInput{
+		Name:         aws.String(secretName),
+		SecretString: aws.String(string(data)),
+	}
+	if s.opts.KMSKeyID != "" {
+		input.KmsKeyId = aws.String(s.opts.KMSKeyID)
+	}
+	for key, value := range s.opts.Tags {
+		input.Tags = append(input.Tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	sort.Slice(input.Tags, func(i, j int) bool { return aws.ToString(input.Tags[i].Key) < aws.ToString(input.Tags[j].Key) })
+
+	_, err = s.client.CreateSecret(s.ctx, input)
+	var invalidRequest *types.InvalidRequestException
+	if !errors.As(err, &invalidRequest) {
+		return errors.WithStack(err)
+	}
+
+	// A secret that was deleted within its recovery window cannot be
+	// created again, so restore it and overwrite its value instead.
+	if _, err = s.client.RestoreSecret(s.ctx, &secretsmanager.RestoreSecretInput{SecretId: aws.String(secretName)}); err != nil {
+		return errors.Wrap(err, "restoring deleted secret")
+	}
+	_, err = s.client.PutSecretValue(s.ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(secretName),
+		SecretString: aws.String(string(data)),
+	})
+	return errors.WithStack(err)
+}
+
+// secretName returns the name of the secret for the name.
+func (s *secretsManagerStore) secretName(name string) string {
+	return s.opts.Prefix + escapeSecretName(name)
+}
+
+// escapeSecretName escapes the characters that are not allowed in secret
+// names, and '@', as '@' followed by two hex digits.
+func escapeSecretName(name string) string {
+	escaped := &strings.Builder{}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c != '@' && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("/_+=.-", c) >= 0) {
+			escaped.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(escaped, "@%02X", c)
+	}
+	return escaped.String()
+}
+
+func unescapeSecretName(name string) (string, error) {
+	unescaped := &strings.Builder{}
+	for i := 0; i < len(name); i++ {
+		if name[i] != '@' {
+			unescaped.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", errors.New("truncated escape sequence")
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.Wrap(err, "parsing escape sequence")
+		}
+		unescaped.WriteByte(byte(c))
+		i += 2
+	}
+	return unescaped.String(), nil
+}
@@ -0,0 +1,270 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSecretsManager is an in-memory AWS Secrets Manager that supports the
+// actions the Secrets Manager depot uses.
+type fakeSecretsManager struct {
+	mu      sync.Mutex
+	secrets map[string]string
+	deleted map[string]string
+	created []*secretsmanager.CreateSecretInput
+	deletes []*secretsmanager.DeleteSecretInput
+}
+
+func newFakeSecretsManager() *fakeSecretsManager {
+	return &fakeSecretsManager{secrets: map[string]string{}, deleted: map[string]string{}}
+}
+
+func (sm *fakeSecretsManager) GetSecretValue(_ context.Context, params *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	id := aws.ToString(params.SecretId)
+	if _, ok := sm.deleted[id]; ok {
+		return nil, &types.InvalidRequestException{Message: aws.String("secret is scheduled for deletion")}
+	}
+	value, ok := sm.secrets[id]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("secret not found")}
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(value)}, nil
+}
+
+func (sm *fakeSecretsManager) CreateSecret(_ context.Context, params *secretsmanager.CreateSecretInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	name := aws.ToString(params.Name)
+	if _, ok := sm.deleted[name]; ok {
+		return nil, &types.InvalidRequestException{Message: aws.String("secret is scheduled for deletion")}
+	}
+	if _, ok := sm.secrets[name]; ok {
+		return nil, &types.ResourceExistsException{Message: aws.String("secret already exists")}
+	}
+	sm.created = append(sm.created, params)
+	sm.secrets[name] = aws.ToString(params.SecretString)
+	return &secretsmanager.CreateSecretOutput{}, nil
+}
+
+func (sm *fakeSecretsManager) PutSecretValue(_ context.Context, params *secretsmanager.PutSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	id := aws.ToString(params.SecretId)
+	if _, ok := sm.secrets[id]; !ok {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("secret not found")}
+	}
+	sm.secrets[id] = aws.ToString(params.SecretString)
+	return &secretsmanager.PutSecretValueOutput{}, nil
+}
+
+func (sm *fakeSecretsManager) DeleteSecret(_ context.Context, params *secretsmanager.DeleteSecretInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.DeleteSecretOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	id := aws.ToString(params.SecretId)
+	value, ok := sm.secrets[id]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("secret not found")}
+	}
+	sm.deletes = append(sm.deletes, params)
+	delete(sm.secrets, id)
+	if !aws.ToBool(params.ForceDeleteWithoutRecovery) {
+		sm.deleted[id] = value
+	}
+	return &secretsmanager.DeleteSecretOutput{}, nil
+}
+
+func (sm *fakeSecretsManager) RestoreSecret(_ context.Context, params *secretsmanager.RestoreSecretInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.RestoreSecretOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	id := aws.ToString(params.SecretId)
+	value, ok := sm.deleted[id]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("secret not found")}
+	}
+	delete(sm.deleted, id)
+	sm.secrets[id] = value
+	return &secretsmanager.RestoreSecretOutput{}, nil
+}
+
+// ListSecrets returns one secret per page to exercise pagination.
+func (sm *fakeSecretsManager) ListSecrets(_ context.Context, params *secretsmanager.ListSecretsInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	names := []string{}
+	for name := range sm.secrets {
+		if strings.HasPrefix(name, params.Filters[0].Values[0]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := &secretsmanager.ListSecretsOutput{}
+	start := 0
+	if token := aws.ToString(params.NextToken); token != "" {
+		start = sort.SearchStrings(names, token)
+	}
+	if start < len(names) {
+		out.SecretList = append(out.SecretList, types.SecretListEntry{Name: aws.String(names[start])})
+	}
+	if start+1 < len(names) {
+		out.NextToken = aws.String(names[start+1])
+	}
+	return out, nil
+}
+
+func TestSecretsManagerDepot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	depotOpts := DepotOptions{CA: ConformanceSuiteCA, DefaultExpiration: time.Hour}
+	creds := AWSCredentials{AccessKeyID: "id", SecretAccessKey: "secret"}
+
+	t.Run("Conformance", func(t *testing.T) {
+		DepotConformanceSuite(t, func() Depot {
+			d, err := NewSecretsManagerDepot(ctx, SecretsManagerOptions{Client: newFakeSecretsManager()}, depotOpts)
+			require.NoError(t, err)
+			return d
+		})
+	})
+	t.Run("StoresOneSecretPerName", func(t *testing.T) {
+		sm := newFakeSecretsManager()
+		d, err := NewSecretsManagerDepot(ctx, SecretsManagerOptions{
+			Client:   sm,
+			KMSKeyID: "alias/certdepot",
+			Tags:     map[string]string{"team": "infra", "env": "prod"},
+		}, depotOpts)
+		require.NoError(t, err)
+
+		require.NoError(t, d.Put(CrtTag("alice"), []byte("alice cert")))
+		require.NoError(t, d.Put(PrivKeyTag("alice"), []byte("alice key")))
+		require.NoError(t, d.Put(ParamTag("alice", "attestation"), []byte{0xff, 0x00}))
+		require.NoError(t, d.Put(CrtTag("bob smith@corp"), []byte("bob cert")))
+
+		fields := secretsManagerFields{}
+		require.NoError(t, json.Unmarshal([]byte(sm.secrets["certdepot/alice"]), &fields))
+		assert.Equal(t, secretsManagerFields{"cert": "alice cert", "key": "alice key"}, fields)
+		assert.Contains(t, sm.secrets, "certdepot/bob@20smith@40corp")
+		require.Len(t, sm.created, 3)
+		assert.Equal(t, "alias/certdepot", aws.ToString(sm.created[0].KmsKeyId))
+		assert.Equal(t, []types.Tag{
+			{Key: aws.String("env"), Value: aws.String("prod")},
+			{Key: aws.String("team"), Value: aws.String("infra")},
+		}, sm.created[0].Tags)
+
+		data, err := d.Get(ParamTag("alice", "attestation"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0xff, 0x00}, data)
+
+		names, err := d.(NameLister).ListNames()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"alice", "bob smith@corp"}, names)
+
+		require.NoError(t, d.Delete(CrtTag("alice")))
+		assert.False(t, d.Check(CrtTag("alice")))
+		assert.True(t, d.Check(PrivKeyTag("alice")))
+		require.NoError(t, d.Delete(PrivKeyTag("alice")))
+		assert.NotContains(t, sm.secrets, "certdepot/alice")
+		assert.Error(t, d.Delete(PrivKeyTag("alice")))
+	})
+	t.Run("DeletesWithRecoveryWindowByDefault", func(t *testing.T) {
+		sm := newFakeSecretsManager()
+		d, err := NewSecretsManagerDepot(ctx, SecretsManagerOptions{Client: sm}, depotOpts)
+		require.NoError(t, err)
+
+		require.NoError(t, d.Put(CrtTag("alice"), []byte("cert")))
+		require.NoError(t, d.Delete(CrtTag("alice")))
+		require.Len(t, sm.deletes, 1)
+		assert.EqualValues(t, 30, aws.ToInt64(sm.deletes[0].RecoveryWindowInDays))
+		assert.Nil(t, sm.deletes[0].ForceDeleteWithoutRecovery)
+		assert.Contains(t, sm.deleted, "certdepot/alice")
+	})
+	t.Run("ForceDeletesOnlyWhenRequested", func(t *testing.T) {
+		sm := newFakeSecretsManager()
+		d, err := NewSecretsManagerDepot(ctx, SecretsManagerOptions{Client: sm, ForceDeleteWithoutRecovery: true}, depotOpts)
+		require.NoError(t, err)
+
+		require.NoError(t, d.Put(CrtTag("alice"), []byte("cert")))
+		require.NoError(t, d.Delete(CrtTag("alice")))
+		require.Len(t, sm.deletes, 1)
+		assert.True(t, aws.ToBool(sm.deletes[0].ForceDeleteWithoutRecovery))
+		assert.Nil(t, sm.deletes[0].RecoveryWindowInDays)
+		assert.NotContains(t, sm.deleted, "certdepot/alice")
+	})
+	t.Run("RestoresSecretsInRecoveryWindow", func(t *testing.T) {
+		sm := newFakeSecretsManager()
+		d, err := NewSecretsManagerDepot(ctx, SecretsManagerOptions{Client: sm, RecoveryWindowInDays: 7}, depotOpts)
+		require.NoError(t, err)
+
+		require.NoError(t, d.Put(CrtTag("alice"), []byte("old cert")))
+		require.NoError(t, d.Delete(CrtTag("alice")))
+		assert.EqualValues(t, 7, aws.ToInt64(sm.deletes[0].RecoveryWindowInDays))
+		assert.Contains(t, sm.deleted, "certdepot/alice")
+		assert.False(t, d.Check(CrtTag("alice")))
+
+		require.NoError(t, d.Put(CrtTag("alice"), []byte("new cert")))
+		data, err := d.Get(CrtTag("alice"))
+		require.NoError(t, err)
+		assert.Equal(t, "new cert", string(data))
+	})
+	t.Run("EscapesSecretNames", func(t *testing.T) {
+		for _, name := range []string{"alice", "bob smith", "a@b", "a..param", "ünïcode"} {
+			unescaped, err := unescapeSecretName(escapeSecretName(name))
+			require.NoError(t, err)
+			assert.Equal(t, name, unescaped)
+		}
+		_, err := unescapeSecretName("a@2")
+		assert.Error(t, err)
+	})
+	t.Run("SendsRequestsToEndpoint", func(t *testing.T) {
+		targets := make(chan string, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			targets <- r.Header.Get("X-Amz-Target")
+			assert.Contains(t, r.Header.Get("Authorization"), "Credential=id/")
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type": "ResourceNotFoundException", "message": "secret not found"}`))
+		}))
+		defer server.Close()
+
+		d, err := NewSecretsManagerDepot(ctx, SecretsManagerOptions{
+			Region:      "us-east-1",
+			Credentials: creds,
+			Endpoint:    server.URL,
+		}, depotOpts)
+		require.NoError(t, err)
+
+		assert.False(t, d.Check(CrtTag("alice")))
+		assert.Equal(t, "secretsmanager.GetSecretValue", <-targets)
+	})
+	t.Run("RejectsInvalidOptions", func(t *testing.T) {
+		for _, opts := range []SecretsManagerOptions{
+			{Client: newFakeSecretsManager(), Credentials: AWSCredentials{AccessKeyID: "id"}},
+			{Client: newFakeSecretsManager(), RecoveryWindowInDays: 3},
+			{Client: newFakeSecretsManager(), RecoveryWindowInDays: 7, ForceDeleteWithoutRecovery: true},
+		} {
+			_, err := NewSecretsManagerDepot(ctx, opts, depotOpts)
+			assert.Error(t, err)
+		}
+	})
+}
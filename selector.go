@@ -0,0 +1,232 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+// DefaultCertificateSelectorRefreshInterval is how often a CertificateSelector
+// re-reads its credentials from the depot if its options do not set a refresh
+// interval.
+const DefaultCertificateSelectorRefreshInterval = time.Minute
+
+// CertificateRule selects the credentials stored under a name in the depot for
+// TLS handshakes whose client hello matches the rule.
+type CertificateRule struct {
+	// ServerName is the server name (SNI) the client must request. It is
+	// matched case-insensitively and may start with a "*." wildcard that
+	// matches exactly one label, so "*.example.com" matches
+	// "api.example.com" but not "example.com" or "a.b.example.com". If
+	// empty, any server name matches, including none.
+	ServerName string `bson:"server_name,omitempty" json:"server_name,omitempty" yaml:"server_name,omitempty"`
+	// Protocol is an application protocol (ALPN), such as "h2", that the
+	// client must offer. If empty, any protocols match, including none.
+	Protocol string `bson:"protocol,omitempty" json:"protocol,omitempty" yaml:"protocol,omitempty"`
+	// Name is the name the credentials are stored under in the depot.
+	Name string `bson:"name" json:"name" yaml:"name"`
+}
+
+// Validate checks that the rule is valid.
+func (r CertificateRule) Validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(r.Name == "", "must specify name of credentials")
+	pattern := strings.TrimPrefix(r.ServerName, "*.")
+	catcher.ErrorfWhen(strings.Contains(pattern, "*"), "server name '%s' can only have a wildcard as its first label", r.ServerName)
+	catcher.ErrorfWhen(r.ServerName != "" && pattern == "", "server name '%s' is empty", r.ServerName)
+	return catcher.Resolve()
+}
+
+// matches returns whether the client hello matches the rule.
+func (r CertificateRule) matches(hello *tls.ClientHelloInfo) bool {
+	if r.Protocol != "" && !containsString(hello.SupportedProtos, r.Protocol) {
+		return false
+	}
+	if r.ServerName == "" {
+		return true
+	}
+
+	serverName := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	pattern := strings.ToLower(r.ServerName)
+	if suffix := strings.TrimPrefix(pattern, "*"); suffix != pattern {
+		label := strings.TrimSuffix(serverName, suffix)
+		return label != serverName && label != "" && !strings.Contains(label, ".")
+	}
+	return serverName == pattern
+}
+
+// CertificateSelectorOptions configure a CertificateSelector.
+type CertificateSelectorOptions struct {
+	// Rules select the credentials for a handshake. The first rule that
+	// matches the client hello is used.
+	Rules []CertificateRule `bson:"rules,omitempty" json:"rules,omitempty" yaml:"rules,omitempty"`
+	// Default is the name of the credentials used if no rule matches. If
+	// empty, handshakes that match no rule fail.
+	Default string `bson:"default,omitempty" json:"default,omitempty" yaml:"default,omitempty"`
+	// RefreshInterval is how often the credentials are re-read from the
+	// depot, so that renewed certificates are served without a restart.
+	// It defaults to DefaultCertificateSelectorRefreshInterval.
+	RefreshInterval time.Duration `bson:"refresh_interval,omitempty" json:"refresh_interval,omitempty" yaml:"refresh_interval,omitempty"`
+}
+
+// Validate checks that the options are valid and sets defaults.
+func (opts *CertificateSelectorOptions) Validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(len(opts.Rules) == 0 && opts.Default == "", "must specify at least one rule or a default")
+	for i, rule := range opts.Rules {
+		catcher.Wrapf(rule.Validate(), "invalid rule %d", i)
+	}
+	catcher.NewWhen(opts.RefreshInterval < 0, "refresh interval cannot be negative")
+	if opts.RefreshInterval == 0 {
+		opts.RefreshInterval = DefaultCertificateSelectorRefreshInterval
+	}
+	return catcher.Resolve()
+}
+
+// names returns the distinct names of the credentials the options select.
+func (opts *CertificateSelectorOptions) names() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if name = formatName(name); name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, rule := range opts.Rules {
+		add(rule.Name)
+	}
+	add(opts.Default)
+	return names
+}
+
+// CertificateSelector serves different credentials from a depot to TLS
+// clients based on the server name (SNI) and application protocols (ALPN)
+// they request, such as for a gateway that terminates TLS for several
+// internal domains. Use the selector's GetCertificate as a tls.Config's
+// GetCertificate hook.
+type CertificateSelector struct {
+	wd   Depot
+	opts CertificateSelectorOptions
+
+	mu           sync.RWMutex
+	certs        map[string]*tls.Certificate
+	fingerprints map[string]string
+}
+
+// NewCertificateSelector loads the credentials selected by the options from
+// the depot, returning an error if any of them cannot be loaded. The
+// credentials are refreshed from the depot every refresh interval until the
+// context is canceled.
+func NewCertificateSelector(ctx context.Context, wd Depot, opts CertificateSelectorOptions) (*CertificateSelector, error) {
+	if wd == nil {
+		return nil, errors.New("must specify a depot")
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	s := &CertificateSelector{
+		wd:           wd,
+		opts:         opts,
+		certs:        map[string]*tls.Certificate{},
+		fingerprints: map[string]string{},
+	}
+	if _, err := s.Refresh(); err != nil {
+		return nil, errors.Wrap(err, "loading credentials")
+	}
+
+	go s.refreshEvery(ctx)
+
+	return s, nil
+}
+
+// GetCertificate returns the certificate selected for the client hello. It
+// has the signature of tls.Config.GetCertificate.
+func (s *CertificateSelector) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := s.opts.Default
+	for _, rule := range s.opts.Rules {
+		if rule.matches(hello) {
+			name = rule.Name
+			break
+		}
+	}
+	if name == "" {
+		return nil, errors.Errorf("no certificate for server name '%s'", hello.ServerName)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	crt, ok := s.certs[formatName(name)]
+	if !ok {
+		return nil, errors.Errorf("credentials '%s' are not loaded", name)
+	}
+	return crt, nil
+}
+
+// Refresh re-reads the selected credentials from the depot and replaces those
+// that changed. It returns whether any credentials changed. Credentials that
+// cannot be read are kept as they are.
+func (s *CertificateSelector) Refresh() (bool, error) {
+	catcher := grip.NewBasicCatcher()
+	changed := false
+	for _, name := range s.opts.names() {
+		creds, err := s.wd.Find(name)
+		if err != nil {
+			catcher.Wrapf(err, "finding credentials '%s'", name)
+			continue
+		}
+		fingerprint := creds.Fingerprint()
+
+		s.mu.RLock()
+		unchanged := s.fingerprints[name] == fingerprint
+		s.mu.RUnlock()
+		if unchanged {
+			continue
+		}
+
+		bundle, err := creds.Bundle()
+		if err != nil {
+			catcher.Wrapf(err, "parsing credentials '%s'", name)
+			continue
+		}
+		crt := bundle.TLSCertificate()
+
+		s.mu.Lock()
+		s.certs[name] = &crt
+		s.fingerprints[name] = fingerprint
+		s.mu.Unlock()
+		changed = true
+	}
+
+	return changed, catcher.Resolve()
+}
+
+func (s *CertificateSelector) refreshEvery(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := s.Refresh()
+		grip.Error(message.WrapError(err, message.Fields{
+			"message": "could not refresh selected credentials",
+			"names":   s.opts.names(),
+		}))
+		grip.InfoWhen(changed, message.Fields{
+			"message": "refreshed selected credentials",
+			"names":   s.opts.names(),
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateSelector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tempDir, err := ioutil.TempDir(".", "selector-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+	for _, name := range []string{"api", "internal", "grpc", "fallback"} {
+		creds, err := d.Generate(name)
+		require.NoError(t, err)
+		require.NoError(t, d.Save(name, creds))
+	}
+
+	opts := CertificateSelectorOptions{
+		Rules: []CertificateRule{
+			{ServerName: "api.example.com", Name: "api"},
+			{ServerName: "*.grpc.example.com", Protocol: "h2", Name: "grpc"},
+			{ServerName: "*.Internal.Example.com", Name: "internal"},
+		},
+		Default: "fallback",
+	}
+	s, err := NewCertificateSelector(ctx, d, opts)
+	require.NoError(t, err)
+
+	t.Run("SelectsByServerNameAndProtocol", func(t *testing.T) {
+		for serverName, testCase := range map[string]struct {
+			protos   []string
+			expected string
+		}{
+			"api.example.com":           {expected: "api"},
+			"API.example.com.":          {expected: "api"},
+			"db.internal.example.com":   {expected: "internal"},
+			"a.db.internal.example.com": {expected: "fallback"},
+			"internal.example.com":      {expected: "fallback"},
+			"svc.grpc.example.com":      {protos: []string{"http/1.1", "h2"}, expected: "grpc"},
+			"svc.grpc.example.com.":     {protos: []string{"http/1.1"}, expected: "fallback"},
+			"":                          {expected: "fallback"},
+		} {
+			crt, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName, SupportedProtos: testCase.protos})
+			require.NoError(t, err, serverName)
+			assert.Equal(t, testCase.expected, crt.Leaf.Subject.CommonName, serverName)
+		}
+	})
+	t.Run("ServesHandshakes", func(t *testing.T) {
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+
+		server := tls.Server(serverConn, &tls.Config{GetCertificate: s.GetCertificate})
+		go func() {
+			_ = server.Handshake()
+		}()
+		client := tls.Client(clientConn, &tls.Config{ServerName: "api.example.com", InsecureSkipVerify: true})
+		require.NoError(t, client.Handshake())
+		peers := client.ConnectionState().PeerCertificates
+		require.NotEmpty(t, peers)
+		assert.Equal(t, "api", peers[0].Subject.CommonName)
+	})
+	t.Run("RefreshesRenewedCredentials", func(t *testing.T) {
+		before, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+		require.NoError(t, err)
+
+		changed, err := s.Refresh()
+		require.NoError(t, err)
+		assert.False(t, changed)
+
+		creds, err := d.Generate("api")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("api", creds))
+		changed, err = s.Refresh()
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		after, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+		require.NoError(t, err)
+		assert.NotEqual(t, before.Leaf.SerialNumber, after.Leaf.SerialNumber)
+	})
+	t.Run("FailsWithoutMatch", func(t *testing.T) {
+		s, err := NewCertificateSelector(ctx, d, CertificateSelectorOptions{
+			Rules: []CertificateRule{{ServerName: "api.example.com", Name: "api"}},
+		})
+		require.NoError(t, err)
+		_, err = s.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+		assert.Error(t, err)
+	})
+	t.Run("RejectsInvalidOptions", func(t *testing.T) {
+		for _, opts := range []CertificateSelectorOptions{
+			{},
+			{Rules: []CertificateRule{{ServerName: "api.example.com"}}},
+			{Rules: []CertificateRule{{ServerName: "api.*.com", Name: "api"}}},
+			{Rules: []CertificateRule{{ServerName: "*.", Name: "api"}}},
+			{Default: "fallback", RefreshInterval: -time.Second},
+		} {
+			_, err := NewCertificateSelector(ctx, d, opts)
+			assert.Error(t, err)
+		}
+		_, err := NewCertificateSelector(ctx, d, CertificateSelectorOptions{Default: "nonexistent"})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,333 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSigningQueueSize   = 1000
+	defaultSigningTicketTTL   = time.Hour
+	signingTicketIDSizeInBits = 128
+	// signingTicketPruneInterval is how often finished tickets are checked
+	// for expiration.
+	signingTicketPruneInterval = time.Minute
+)
+
+// ErrSigningQueueFull is returned by RequestCertificate when the signing
+// queue cannot accept more requests.
+var ErrSigningQueueFull = errors.New("signing queue is full")
+
+// TicketStatus is the status of a request in a signing queue.
+type TicketStatus string
+
+const (
+	// TicketPending is the status of a request waiting to be signed.
+	TicketPending TicketStatus = "pending"
+	// TicketInProgress is the status of a request being signed.
+	TicketInProgress TicketStatus = "in-progress"
+	// TicketComplete is the status of a request whose credentials were
+	// signed and saved in the depot.
+	TicketComplete TicketStatus = "complete"
+	// TicketFailed is the status of a request that could not be signed.
+	TicketFailed TicketStatus = "failed"
+)
+
+// Done returns whether the request has finished, successfully or not.
+func (s TicketStatus) Done() bool { return s == TicketComplete || s == TicketFailed }
+
+// IssuanceTicket tracks a request in a signing queue. Once the request is
+// complete, its credentials can be found in the depot under Name.
+type IssuanceTicket struct {
+	ID        string       `bson:"id" json:"id" yaml:"id"`
+	Name      string       `bson:"name" json:"name" yaml:"name"`
+	Status    TicketStatus `bson:"status" json:"status" yaml:"status"`
+	Error     string       `bson:"error,omitempty" json:"error,omitempty" yaml:"error,omitempty"`
+	Submitted time.Time    `bson:"submitted" json:"submitted" yaml:"submitted"`
+	Completed time.Time    `bson:"completed,omitempty" json:"completed,omitempty" yaml:"completed,omitempty"`
+}
+
+// SigningQueueOptions configure a SigningQueue.
+type SigningQueueOptions struct {
+	// Workers is the number of requests signed at once. It defaults to
+	// the number of CPUs.
+	Workers int `bson:"workers,omitempty" json:"workers,omitempty" yaml:"workers,omitempty"`
+	// QueueSize is the number of requests that can wait to be signed. It
+	// defaults to 1000.
+	QueueSize int `bson:"queue_size,omitempty" json:"queue_size,omitempty" yaml:"queue_size,omitempty"`
+	// MinInterval, if set, is the minimum time between starting to sign
+	// two requests, so that a burst of requests does not overwhelm the
+	// CA.
+	MinInterval time.Duration `bson:"min_interval,omitempty" json:"min_interval,omitempty" yaml:"min_interval,omitempty"`
+	// TicketTTL is how long tickets are kept after their requests finish.
+	// It defaults to one hour.
+	TicketTTL time.Duration `bson:"ticket_ttl,omitempty" json:"ticket_ttl,omitempty" yaml:"ticket_ttl,omitempty"`
+	// OnComplete, if set, is called with each ticket once its request
+	// finishes.
+	OnComplete func(IssuanceTicket) `bson:"-" json:"-" yaml:"-"`
+}
+
+// Validate checks that the options are valid and sets defaults.
+func (opts *SigningQueueOptions) Validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Workers < 0, "workers cannot be negative")
+	catcher.NewWhen(opts.QueueSize < 0, "queue size cannot be negative")
+	catcher.NewWhen(opts.MinInterval < 0, "minimum interval cannot be negative")
+	catcher.NewWhen(opts.TicketTTL < 0, "ticket TTL cannot be negative")
+	if catcher.HasErrors() {
+		return catcher.Resolve()
+	}
+
+	if opts.Workers == 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.QueueSize == 0 {
+		opts.QueueSize = defaultSigningQueueSize
+	}
+	if opts.TicketTTL == 0 {
+		opts.TicketTTL = defaultSigningTicketTTL
+	}
+	return nil
+}
+
+// signingRequest is a request waiting in the signing queue.
+type signingRequest struct {
+	id   string
+	opts CertificateOptions
+}
+
+// signingTicket is a ticket and a channel closed once its request finishes.
+type signingTicket struct {
+	ticket IssuanceTicket
+	done   chan struct{}
+}
+
+// SigningQueue signs certificates in the background with a pool of workers,
+// so that a burst of requests, such as when provisioning many hosts at once,
+// is spread out instead of spiking CPU usage on key generation and signing.
+// Requests return a ticket immediately, which callers can poll with Status
+// or wait on with Wait.
+type SigningQueue struct {
+	wd       Depot
+	opts     SigningQueueOptions
+	requests chan signingRequest
+	limit    <-chan time.Time
+	ticker   *time.Ticker
+
+	mu         sync.Mutex
+	tickets    map[string]*signingTicket
+	lastPruned time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewSigningQueue returns a queue that generates credentials in the depot
+// until the context is done or the queue is closed.
+func NewSigningQueue(ctx context.Context, wd Depot, opts SigningQueueOptions) (*SigningQueue, error) {
+	if wd == nil {
+		return nil, errors.New("must specify depot")
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid signing queue options")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	q := &SigningQueue{
+		wd:       wd,
+		opts:     opts,
+		requests: make(chan signingRequest, opts.QueueSize),
+		tickets:  map[string]*signingTicket{},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	if opts.MinInterval > 0 {
+		q.ticker = time.NewTicker(opts.MinInterval)
+		q.limit = q.ticker.C
+	}
+	for i := 0; i < opts.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	return q, nil
+}
+
+// RequestCertificate queues a request to generate credentials with the
+// options and save them in the depot, returning a ticket for the request. It
+// returns ErrSigningQueueFull if the queue cannot accept more requests.
+func (q *SigningQueue) RequestCertificate(opts CertificateOptions) (IssuanceTicket, error) {
+	name, err := canonicalName(opts.CommonName)
+	if err != nil {
+		return IssuanceTicket{}, errors.WithStack(err)
+	}
+	if err = q.ctx.Err(); err != nil {
+		return IssuanceTicket{}, errors.Wrap(err, "signing queue is closed")
+	}
+	id, err := newSigningTicketID()
+	if err != nil {
+		return IssuanceTicket{}, errors.WithStack(err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pruneTickets()
+	ticket := &signingTicket{
+		ticket: IssuanceTicket{ID: id, Name: name, Status: TicketPending, Submitted: time.Now()},
+		done:   make(chan struct{}),
+	}
+	select {
+	case q.requests <- signingRequest{id: id, opts: opts}:
+	default:
+		return IssuanceTicket{}, ErrSigningQueueFull
+	}
+	q.tickets[id] = ticket
+
+	return ticket.ticket, nil
+}
+
+// Status returns the ticket with the ID.
+func (q *SigningQueue) Status(id string) (IssuanceTicket, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ticket, ok := q.tickets[id]
+	if !ok {
+		return IssuanceTicket{}, errors.Errorf("ticket '%s' not found", id)
+	}
+	return ticket.ticket, nil
+}
+
+// Wait waits until the request for the ticket with the ID finishes or the
+// context is done, returning the ticket.
+func (q *SigningQueue) Wait(ctx context.Context, id string) (IssuanceTicket, error) {
+	q.mu.Lock()
+	ticket, ok := q.tickets[id]
+	q.mu.Unlock()
+	if !ok {
+		return IssuanceTicket{}, errors.Errorf("ticket '%s' not found", id)
+	}
+
+	select {
+	case <-ticket.done:
+		return q.Status(id)
+	case <-ctx.Done():
+		return IssuanceTicket{}, errors.Wrapf(ctx.Err(), "waiting for ticket '%s'", id)
+	}
+}
+
+// Close stops signing. Requests that have not been signed yet are marked as
+// failed.
+func (q *SigningQueue) Close() {
+	q.cancel()
+	q.wg.Wait()
+	if q.ticker != nil {
+		q.ticker.Stop()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, ticket := range q.tickets {
+		if !ticket.ticket.Status.Done() {
+			q.finish(ticket, errors.New("signing queue closed"))
+		}
+	}
+}
+
+// work signs queued requests until the context is done.
+func (q *SigningQueue) work() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case req := <-q.requests:
+			if q.limit != nil {
+				select {
+				case <-q.ctx.Done():
+					return
+				case <-q.limit:
+				}
+			}
+			q.sign(req)
+		}
+	}
+}
+
+// sign generates and saves the credentials for the request.
+func (q *SigningQueue) sign(req signingRequest) {
+	q.mu.Lock()
+	ticket := q.tickets[req.id]
+	ticket.ticket.Status = TicketInProgress
+	name := ticket.ticket.Name
+	q.mu.Unlock()
+
+	creds, err := q.wd.GenerateWithOptions(req.opts)
+	if err == nil {
+		err = errors.Wrapf(q.wd.Save(name, creds), "saving credentials for '%s'", name)
+		// The credentials are not handed back to the requester, so the
+		// key does not need to stay in memory.
+		creds.Zero()
+	} else {
+		err = errors.Wrapf(err, "generating credentials for '%s'", name)
+	}
+	grip.Warning(message.WrapError(err, message.Fields{
+		"message": "could not sign queued certificate request",
+		"ticket":  req.id,
+		"name":    name,
+	}))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finish(ticket, err)
+}
+
+// finish records the outcome of the ticket's request. The caller must hold
+// the lock.
+func (q *SigningQueue) finish(ticket *signingTicket, err error) {
+	ticket.ticket.Status = TicketComplete
+	if err != nil {
+		ticket.ticket.Status = TicketFailed
+		ticket.ticket.Error = err.Error()
+	}
+	ticket.ticket.Completed = time.Now()
+	close(ticket.done)
+
+	if q.opts.OnComplete != nil {
+		go q.opts.OnComplete(ticket.ticket)
+	}
+}
+
+// pruneTickets removes tickets whose requests finished more than the ticket
+// TTL ago, at most once per signingTicketPruneInterval. The caller must hold
+// the lock.
+func (q *SigningQueue) pruneTickets() {
+	if time.Since(q.lastPruned) < signingTicketPruneInterval {
+		return
+	}
+	q.lastPruned = time.Now()
+	for id, ticket := range q.tickets {
+		if ticket.ticket.Status.Done() && time.Since(ticket.ticket.Completed) > q.opts.TicketTTL {
+			delete(q.tickets, id)
+		}
+	}
+}
+
+func newSigningTicketID() (string, error) {
+	id := make([]byte, signingTicketIDSizeInBits/8)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "generating ticket ID")
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,111 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigningQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tempDir, err := ioutil.TempDir(".", "signing-queue-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+
+	t.Run("SignsQueuedRequests", func(t *testing.T) {
+		completed := make(chan IssuanceTicket, 3)
+		q, err := NewSigningQueue(ctx, d, SigningQueueOptions{
+			Workers:     2,
+			MinInterval: time.Millisecond,
+			OnComplete:  func(ticket IssuanceTicket) { completed <- ticket },
+		})
+		require.NoError(t, err)
+		defer q.Close()
+
+		tickets := []IssuanceTicket{}
+		for _, name := range []string{"alice", "bob", "carol"} {
+			ticket, err := q.RequestCertificate(CertificateOptions{CommonName: name, Host: name})
+			require.NoError(t, err)
+			assert.Equal(t, name, ticket.Name)
+			assert.NotEmpty(t, ticket.ID)
+			tickets = append(tickets, ticket)
+		}
+
+		for _, ticket := range tickets {
+			done, err := q.Wait(ctx, ticket.ID)
+			require.NoError(t, err)
+			assert.Equal(t, TicketComplete, done.Status)
+			assert.Empty(t, done.Error)
+			assert.False(t, done.Completed.IsZero())
+
+			creds, err := d.Find(ticket.Name)
+			require.NoError(t, err)
+			assert.NotEmpty(t, creds.Cert)
+		}
+		for range tickets {
+			ticket := <-completed
+			assert.Equal(t, TicketComplete, ticket.Status)
+		}
+
+		_, err = q.Status("nonexistent")
+		assert.Error(t, err)
+	})
+	t.Run("RecordsFailures", func(t *testing.T) {
+		q, err := NewSigningQueue(ctx, d, SigningQueueOptions{Workers: 1})
+		require.NoError(t, err)
+		defer q.Close()
+
+		ticket, err := q.RequestCertificate(CertificateOptions{CommonName: "dave", CA: "nonexistent"})
+		require.NoError(t, err)
+		done, err := q.Wait(ctx, ticket.ID)
+		require.NoError(t, err)
+		assert.Equal(t, TicketFailed, done.Status)
+		assert.NotEmpty(t, done.Error)
+		assert.False(t, d.Check(CrtTag("dave")))
+	})
+	t.Run("RejectsRequestsWhenFull", func(t *testing.T) {
+		q, err := NewSigningQueue(ctx, d, SigningQueueOptions{Workers: 1, QueueSize: 1, MinInterval: time.Hour})
+		require.NoError(t, err)
+
+		var full bool
+		tickets := []IssuanceTicket{}
+		for i := 0; i < 3 && !full; i++ {
+			ticket, err := q.RequestCertificate(CertificateOptions{CommonName: "erin"})
+			if err == ErrSigningQueueFull {
+				full = true
+				continue
+			}
+			require.NoError(t, err)
+			tickets = append(tickets, ticket)
+		}
+		assert.True(t, full)
+
+		q.Close()
+		for _, ticket := range tickets {
+			done, err := q.Status(ticket.ID)
+			require.NoError(t, err)
+			assert.Equal(t, TicketFailed, done.Status)
+		}
+		_, err = q.RequestCertificate(CertificateOptions{CommonName: "erin"})
+		assert.Error(t, err)
+	})
+	t.Run("RejectsInvalidOptions", func(t *testing.T) {
+		_, err := NewSigningQueue(ctx, nil, SigningQueueOptions{})
+		assert.Error(t, err)
+		_, err = NewSigningQueue(ctx, d, SigningQueueOptions{Workers: -1})
+		assert.Error(t, err)
+	})
+}
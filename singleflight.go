@@ -0,0 +1,41 @@
+package certdepot
+
+import (
+	"golang.org/x/sync/singleflight"
+)
+
+// credentialsFlights collapses concurrent calls that find or generate the
+// credentials for the same name in a depot into a single backend operation,
+// so that many goroutines starting to serve the same host at once do not each
+// issue a certificate.
+type credentialsFlights struct {
+	group singleflight.Group
+}
+
+// do calls fn for the operation on the name unless a call for the same
+// operation and name is already in flight, in which case it waits for that
+// call and returns its result. If the result is shared, each caller receives
+// its own deep copy of the credentials, so that zeroing one caller's
+// credentials does not wipe the key of the others.
+func (f *credentialsFlights) do(op, name string, fn func() (*Credentials, error)) (*Credentials, error) {
+	v, err, shared := f.group.Do(op+"/"+formatName(name), func() (interface{}, error) {
+		return fn()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	creds := v.(*Credentials)
+	if !shared {
+		return creds, nil
+	}
+	// The cached bundle is not copied, since zeroing it would wipe the
+	// parsed key of the other callers.
+	return &Credentials{
+		CACert:     append([]byte(nil), creds.CACert...),
+		Cert:       append([]byte(nil), creds.Cert...),
+		Key:        append([]byte(nil), creds.Key...),
+		Signer:     creds.Signer,
+		ServerName: creds.ServerName,
+	}, nil
+}
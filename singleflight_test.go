@@ -0,0 +1,130 @@
+package certdepot
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialsFlights(t *testing.T) {
+	t.Run("CollapsesConcurrentCalls", func(t *testing.T) {
+		f := &credentialsFlights{}
+		var calls int32
+		started := make(chan struct{})
+		release := make(chan struct{})
+		fn := func() (*Credentials, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(started)
+			}
+			<-release
+			return &Credentials{ServerName: "my_host"}, nil
+		}
+
+		const callers = 10
+		results := make([]*Credentials, callers)
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[0], _ = f.do("find", "my host", fn)
+		}()
+		<-started
+		for i := 1; i < callers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], _ = f.do("find", "my_host", fn)
+			}(i)
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+		for i := range results {
+			require.NotNil(t, results[i])
+			assert.Equal(t, "my_host", results[i].ServerName)
+		}
+		results[0].ServerName = "changed"
+		assert.Equal(t, "my_host", results[1].ServerName)
+	})
+	t.Run("ZeroingOneResultKeepsOthers", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir(".", "singleflight-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		}()
+		d, err := MakeFileDepot(tempDir, DepotOptions{CA: ConformanceSuiteCA, DefaultExpiration: time.Hour})
+		require.NoError(t, err)
+		initConformanceSuiteCA(t, d)
+		creds, err := d.Generate("bob")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("bob", creds))
+
+		f := &credentialsFlights{}
+		started := make(chan struct{})
+		release := make(chan struct{})
+		var calls int32
+		find := func() (*Credentials, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(started)
+			}
+			<-release
+			return d.Find("bob")
+		}
+
+		results := make([]*Credentials, 2)
+		errs := make([]error, 2)
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[0], errs[0] = f.do("find", "bob", find)
+		}()
+		<-started
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[1], errs[1] = f.do("find", "bob", find)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		require.NoError(t, errs[0])
+		require.NoError(t, errs[1])
+
+		results[0].Zero()
+		_, err = tls.X509KeyPair(results[1].Cert, results[1].Key)
+		assert.NoError(t, err)
+	})
+	t.Run("SeparatesOperations", func(t *testing.T) {
+		f := &credentialsFlights{}
+		calls := 0
+		fn := func() (*Credentials, error) {
+			calls++
+			return &Credentials{}, nil
+		}
+
+		_, err := f.do("find", "alice", fn)
+		require.NoError(t, err)
+		_, err = f.do("generate", "alice", fn)
+		require.NoError(t, err)
+		assert.Equal(t, 2, calls)
+	})
+	t.Run("ReturnsErrors", func(t *testing.T) {
+		f := &credentialsFlights{}
+		creds, err := f.do("find", "alice", func() (*Credentials, error) {
+			return nil, errors.New("not found")
+		})
+		assert.Error(t, err)
+		assert.Nil(t, creds)
+	})
+}
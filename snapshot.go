@@ -0,0 +1,290 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// snapshotFormatVersion is the version of the depot snapshot format.
+const snapshotFormatVersion = 1
+
+// SnapshotStore is object storage that holds depot snapshots.
+type SnapshotStore interface {
+	// PutSnapshot stores the snapshot under the key.
+	PutSnapshot(ctx context.Context, key string, data []byte) error
+	// GetSnapshot returns the snapshot stored under the key.
+	GetSnapshot(ctx context.Context, key string) ([]byte, error)
+}
+
+// snapshotHeader is the first document in a depot snapshot.
+type snapshotHeader struct {
+	Version    int       `bson:"version"`
+	CreatedAt  time.Time `bson:"created_at"`
+	Collection string    `bson:"collection"`
+}
+
+// snapshotEntry is a document from the depot's collection, or from its
+// metadata collection, in a depot snapshot.
+type snapshotEntry struct {
+	Metadata bool     `bson:"metadata,omitempty"`
+	Document bson.Raw `bson:"doc"`
+}
+
+// SnapshotToBucket dumps every document in the MongoDB depot's collection and
+// its persisted options to the store under the key, so that the depot can be
+// restored with RestoreFromSnapshot independently of database backups.
+// Documents are copied as raw BSON without being decoded, so encrypted fields
+// stay encrypted as long as the depot's client does not automatically decrypt
+// them.
+func SnapshotToBucket(ctx context.Context, wd Depot, store SnapshotStore, key string) error {
+	m, ok := wd.(*mongoDepot)
+	if !ok {
+		return errors.Errorf("cannot snapshot depot of type %T", wd)
+	}
+
+	data, err := m.snapshot(ctx)
+	if err != nil {
+		return errors.Wrap(err, "creating snapshot")
+	}
+
+	return errors.Wrap(store.PutSnapshot(ctx, key, data), "putting snapshot in store")
+}
+
+// RestoreFromSnapshot replaces the contents of the MongoDB depot's collection
+// and its persisted options with the snapshot stored under the key. Documents
+// that are not in the snapshot are removed. The depot must be reopened to use
+// the restored options.
+func RestoreFromSnapshot(ctx context.Context, wd Depot, store SnapshotStore, key string) error {
+	m, ok := wd.(*mongoDepot)
+	if !ok {
+		return errors.Errorf("cannot restore depot of type %T", wd)
+	}
+
+	data, err := store.GetSnapshot(ctx, key)
+	if err != nil {
+		return errors.Wrap(err, "getting snapshot from store")
+	}
+
+	return errors.Wrap(m.restore(ctx, data), "restoring snapshot")
+}
+
+// snapshot returns the depot's documents as a sequence of BSON documents,
+// starting with a snapshotHeader followed by a snapshotEntry for each
+// document. Locks are not included.
+func (m *mongoDepot) snapshot(ctx context.Context) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	header, err := bson.Marshal(snapshotHeader{
+		Version:    snapshotFormatVersion,
+		CreatedAt:  time.Now().UTC(),
+		Collection: m.coll.Name(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling snapshot header")
+	}
+	buf.Write(header)
+
+	for _, source := range []struct {
+		coll     MongoDBCollection
+		filter   bson.M
+		metadata bool
+	}{
+		{coll: m.coll, filter: bson.M{}},
+		{coll: m.metadataCollection(), filter: bson.M{"_id": depotOptionsID}, metadata: true},
+	} {
+		cur, err := source.coll.Find(ctx, source.filter, options.Find().SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return nil, errors.Wrapf(err, "finding documents in collection '%s'", source.coll.Name())
+		}
+		for cur.Next(ctx) {
+			entry, err := bson.Marshal(snapshotEntry{Metadata: source.metadata, Document: cur.Current})
+			if err != nil {
+				_ = cur.Close(ctx)
+				return nil, errors.Wrap(err, "marshalling snapshot entry")
+			}
+			buf.Write(entry)
+		}
+		if err = cur.Err(); err != nil {
+			_ = cur.Close(ctx)
+			return nil, errors.Wrapf(err, "reading documents in collection '%s'", source.coll.Name())
+		}
+		if err = cur.Close(ctx); err != nil {
+			return nil, errors.Wrap(err, "closing cursor")
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// restore upserts every document in the snapshot and removes the documents
+// in the depot's collection that are not in the snapshot.
+func (m *mongoDepot) restore(ctx context.Context, data []byte) error {
+	docs, err := splitBSONDocuments(data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(docs) == 0 {
+		return errors.New("snapshot is empty")
+	}
+
+	header := snapshotHeader{}
+	if err = bson.Unmarshal(docs[0], &header); err != nil {
+		return errors.Wrap(err, "unmarshalling snapshot header")
+	}
+	if header.Version != snapshotFormatVersion {
+		return errors.Errorf("unsupported snapshot format version %d", header.Version)
+	}
+
+	m.recentWrites.record("")
+	ids := []interface{}{}
+	for _, doc := range docs[1:] {
+		entry := snapshotEntry{}
+		if err = bson.Unmarshal(doc, &entry); err != nil {
+			return errors.Wrap(err, "unmarshalling snapshot entry")
+		}
+		id, err := entry.Document.LookupErr("_id")
+		if err != nil {
+			return errors.Wrap(err, "getting document ID")
+		}
+
+		coll := m.coll
+		if entry.Metadata {
+			coll = m.metadataCollection()
+		} else {
+			ids = append(ids, id)
+		}
+		if _, err = coll.ReplaceOne(ctx, bson.M{"_id": id}, entry.Document, options.Replace().SetUpsert(true)); err != nil {
+			return errors.Wrapf(err, "restoring document '%s'", id)
+		}
+	}
+
+	if _, err = m.coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$nin": ids}}); err != nil {
+		return errors.Wrap(err, "deleting documents not in snapshot")
+	}
+
+	return nil
+}
+
+// splitBSONDocuments splits a sequence of BSON documents, each of which is
+// prefixed with its length, into the individual documents.
+func splitBSONDocuments(data []byte) ([]bson.Raw, error) {
+	docs := []bson.Raw{}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("truncated BSON document")
+		}
+		size := int(binary.LittleEndian.Uint32(data))
+		if size < 5 || size > len(data) {
+			return nil, errors.New("truncated BSON document")
+		}
+		doc := bson.Raw(data[:size])
+		if err := doc.Validate(); err != nil {
+			return nil, errors.Wrap(err, "validating BSON document")
+		}
+		docs = append(docs, doc)
+		data = data[size:]
+	}
+
+	return docs, nil
+}
+
+// S3SnapshotStore is a SnapshotStore backed by an Amazon S3 bucket.
+type S3SnapshotStore struct {
+	// Bucket is the name of the bucket (required).
+	Bucket string `bson:"bucket" json:"bucket" yaml:"bucket"`
+	// Prefix is prepended to each snapshot key.
+	Prefix string `bson:"prefix,omitempty" json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	// Region is the region of the bucket (required).
+	Region string `bson:"region" json:"region" yaml:"region"`
+	// Endpoint overrides the URL of the S3 API, such as for S3-compatible
+	// object storage. Requests to a custom endpoint use path-style bucket
+	// addressing.
+	Endpoint string `bson:"endpoint,omitempty" json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	// Credentials are used to sign requests (required).
+	Credentials AWSCredentials `bson:"credentials" json:"credentials" yaml:"credentials"`
+	// Client is the HTTP client used to make requests. If nil, a client
+	// with a 30 second timeout is used.
+	Client *http.Client `bson:"-" json:"-" yaml:"-"`
+}
+
+// PutSnapshot uploads the snapshot to the bucket.
+func (s *S3SnapshotStore) PutSnapshot(ctx context.Context, key string, data []byte) error {
+	_, err := s.do(ctx, http.MethodPut, key, data)
+	return errors.Wrapf(err, "uploading snapshot '%s'", key)
+}
+
+// GetSnapshot downloads the snapshot from the bucket.
+func (s *S3SnapshotStore) GetSnapshot(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.do(ctx, http.MethodGet, key, nil)
+	return data, errors.Wrapf(err, "downloading snapshot '%s'", key)
+}
+
+func (s *S3SnapshotStore) do(ctx context.Context, method, key string, body []byte) ([]byte, error) {
+	if s.Bucket == "" {
+		return nil, errors.New("must specify S3 bucket")
+	}
+	if s.Region == "" {
+		return nil, errors.New("must specify AWS region")
+	}
+	if err := s.Credentials.Validate(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	bodyHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(bodyHash[:]))
+	signAWSRequest(req, body, s.Credentials, s.Region, "s3", time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "making request")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading response body")
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, errors.Errorf("request returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return respBody, nil
+}
+
+// objectURL returns the URL of the object for the snapshot key.
+func (s *S3SnapshotStore) objectURL(key string) (string, error) {
+	key = strings.TrimPrefix(s.Prefix+key, "/")
+	if key == "" {
+		return "", errors.New("must specify snapshot key")
+	}
+	path := (&url.URL{Path: "/" + key}).EscapedPath()
+
+	if s.Endpoint != "" {
+		return fmt.Sprintf("%s/%s%s", strings.TrimSuffix(s.Endpoint, "/"), s.Bucket, path), nil
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", s.Bucket, s.Region, path), nil
+}
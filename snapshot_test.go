@@ -0,0 +1,164 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// memorySnapshotStore is a SnapshotStore that holds snapshots in memory.
+type memorySnapshotStore map[string][]byte
+
+func (s memorySnapshotStore) PutSnapshot(_ context.Context, key string, data []byte) error {
+	s[key] = data
+	return nil
+}
+
+func (s memorySnapshotStore) GetSnapshot(_ context.Context, key string) ([]byte, error) {
+	data, ok := s[key]
+	if !ok {
+		return nil, errors.Errorf("snapshot '%s' not found", key)
+	}
+	return data, nil
+}
+
+func TestSplitBSONDocuments(t *testing.T) {
+	first, err := bson.Marshal(bson.M{"_id": "alice"})
+	require.NoError(t, err)
+	second, err := bson.Marshal(bson.M{"_id": "bob"})
+	require.NoError(t, err)
+
+	docs, err := splitBSONDocuments(append(append([]byte{}, first...), second...))
+	require.NoError(t, err)
+	require.Len(t, docs, 2)
+	assert.Equal(t, bson.Raw(first), docs[0])
+	assert.Equal(t, bson.Raw(second), docs[1])
+
+	_, err = splitBSONDocuments(append(append([]byte{}, first...), second[:len(second)-1]...))
+	assert.Error(t, err)
+	_, err = splitBSONDocuments([]byte{1, 2})
+	assert.Error(t, err)
+}
+
+func TestS3SnapshotStore(t *testing.T) {
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=id/"))
+		assert.Contains(t, r.Header.Get("Authorization"), "/us-east-1/s3/aws4_request")
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodyHash := sha256.Sum256(body)
+		assert.Equal(t, hex.EncodeToString(bodyHash[:]), r.Header.Get("X-Amz-Content-Sha256"))
+
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path] = body
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(data)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.TODO()
+	store := &S3SnapshotStore{
+		Bucket:      "pki",
+		Prefix:      "snapshots/",
+		Region:      "us-east-1",
+		Endpoint:    srv.URL,
+		Credentials: AWSCredentials{AccessKeyID: "id", SecretAccessKey: "secret"},
+	}
+
+	require.NoError(t, store.PutSnapshot(ctx, "depot.bson", []byte("snapshot")))
+	assert.Equal(t, []byte("snapshot"), objects["/pki/snapshots/depot.bson"])
+	data, err := store.GetSnapshot(ctx, "depot.bson")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("snapshot"), data)
+
+	_, err = store.GetSnapshot(ctx, "missing.bson")
+	assert.Error(t, err)
+
+	noBucket := *store
+	noBucket.Bucket = ""
+	assert.Error(t, noBucket.PutSnapshot(ctx, "depot.bson", nil))
+}
+
+func TestDepotSnapshot(t *testing.T) {
+	ctx := context.TODO()
+	depotOpts := DepotOptions{CA: "root", DefaultExpiration: time.Hour}
+
+	t.Run("FailsWithFileDepot", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir(".", "snapshot-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		}()
+		d, err := MakeFileDepot(tempDir, depotOpts)
+		require.NoError(t, err)
+
+		store := memorySnapshotStore{}
+		assert.Error(t, SnapshotToBucket(ctx, d, store, "depot.bson"))
+		assert.Error(t, RestoreFromSnapshot(ctx, d, store, "depot.bson"))
+	})
+	t.Run("MongoDB", func(t *testing.T) {
+		d, err := NewMongoDBCertDepot(ctx, &MongoDBOptions{
+			MongoDBURI:     testMongoDBURI(),
+			DatabaseName:   "certDepot",
+			CollectionName: "snapshot",
+			DepotOptions:   depotOpts,
+		})
+		require.NoError(t, err)
+		m := d.(*mongoDepot)
+		defer func() {
+			assert.NoError(t, m.coll.(*mongo.Collection).Drop(ctx))
+			assert.NoError(t, m.metadataCollection().(*mongo.Collection).Drop(ctx))
+		}()
+
+		caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+		require.NoError(t, caOpts.Init(d))
+		require.NoError(t, SaveDepotOptions(d, depotOpts))
+		alice, err := d.Generate("alice")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("alice", alice))
+
+		store := memorySnapshotStore{}
+		require.NoError(t, SnapshotToBucket(ctx, d, store, "depot.bson"))
+
+		bob, err := d.Generate("bob")
+		require.NoError(t, err)
+		require.NoError(t, d.Save("bob", bob))
+		require.NoError(t, d.Delete(PrivKeyTag("alice")))
+
+		require.NoError(t, RestoreFromSnapshot(ctx, d, store, "depot.bson"))
+		found, err := d.Find("alice")
+		require.NoError(t, err)
+		assert.Equal(t, alice.Cert, found.Cert)
+		assert.Equal(t, alice.Key, found.Key)
+		assert.False(t, CheckCertificate(d, "bob"))
+		assert.True(t, CheckCertificate(d, "root"))
+
+		persisted, err := m.loadDepotOptions()
+		require.NoError(t, err)
+		assert.Equal(t, "root", persisted.CA)
+
+		assert.Error(t, RestoreFromSnapshot(ctx, d, store, "missing.bson"))
+	})
+}
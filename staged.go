@@ -0,0 +1,152 @@
+package certdepot
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StagedSuffix is appended to a name to get the name under which
+// StageRotation stores the credentials that will replace the name's
+// credentials.
+const StagedSuffix = "-next"
+
+// StagedRotationLockTTL is how long StageRotation, CommitRotation, and
+// AbortRotation hold the lock for a name before other processes consider it
+// abandoned.
+var StagedRotationLockTTL = time.Minute
+
+// StagedName returns the name under which the credentials staged to replace
+// the name's credentials are stored.
+func StagedName(name string) string {
+	return name + StagedSuffix
+}
+
+// isStagedOf returns whether the name is the staged name of any of the names
+// in the set.
+func isStagedOf(name string, names map[string]bool) bool {
+	base := strings.TrimSuffix(name, StagedSuffix)
+	return base != name && names[base]
+}
+
+// stagedRotationLock returns the name of the lock held while the staged
+// credentials for the name change.
+func stagedRotationLock(name string) string {
+	return name + "_staged_rotation"
+}
+
+// StageRotation generates new credentials for the name with the depot's
+// default options and stores them under the name's staged name alongside the
+// current credentials, which are not changed. Services can use FindStaged to
+// fetch and validate the new credentials before CommitRotation switches to
+// them, and AbortRotation discards them without affecting the current
+// credentials. It returns an error if a rotation is already staged.
+func StageRotation(wd Depot, name string) (*Credentials, error) {
+	name, err := canonicalName(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return stageRotation(wd, name, func() (*Credentials, error) { return wd.Generate(name) })
+}
+
+// StageRotationWithOptions is the same as StageRotation but generates the new
+// credentials for the options' common name with the options.
+func StageRotationWithOptions(wd Depot, opts CertificateOptions) (*Credentials, error) {
+	name, err := canonicalName(opts.CommonName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return stageRotation(wd, name, func() (*Credentials, error) { return wd.GenerateWithOptions(opts) })
+}
+
+func stageRotation(wd Depot, name string, generate func() (*Credentials, error)) (*Credentials, error) {
+	var creds *Credentials
+	err := withLock(depotContext(wd), wd, stagedRotationLock(name), StagedRotationLockTTL, func() error {
+		staged, err := CheckCertificateWithError(wd, StagedName(name))
+		if err != nil {
+			return errors.Wrap(err, "checking for staged certificate")
+		}
+		if staged {
+			return errors.Errorf("rotation is already staged for '%s'", name)
+		}
+
+		if creds, err = generate(); err != nil {
+			return errors.Wrap(err, "generating credentials")
+		}
+		return errors.Wrap(wd.Save(StagedName(name), creds), "saving staged credentials")
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "staging rotation for '%s'", name)
+	}
+	creds.ServerName = name
+
+	return creds, nil
+}
+
+// FindStaged returns the credentials staged to replace the name's
+// credentials.
+func FindStaged(wd Depot, name string) (*Credentials, error) {
+	name, err := canonicalName(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	creds, err := depotFind(wd, StagedName(name), getDepotOptions(wd))
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding staged credentials for '%s'", name)
+	}
+	creds.ServerName = name
+
+	return creds, nil
+}
+
+// CommitRotation replaces the name's credentials with the credentials staged
+// by StageRotation and removes the staged credentials. The replaced
+// credentials are retained as Save retains them. It returns the new
+// credentials.
+func CommitRotation(wd Depot, name string) (*Credentials, error) {
+	name, err := canonicalName(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var creds *Credentials
+	err = withLock(depotContext(wd), wd, stagedRotationLock(name), StagedRotationLockTTL, func() error {
+		if creds, err = FindStaged(wd, name); err != nil {
+			return errors.WithStack(err)
+		}
+		if err = wd.Save(name, creds); err != nil {
+			return errors.Wrap(err, "saving staged credentials")
+		}
+		return errors.Wrap(deleteStaged(wd, name), "deleting staged credentials")
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "committing rotation for '%s'", name)
+	}
+
+	return creds, nil
+}
+
+// AbortRotation discards the credentials staged for the name, if any,
+// without changing its current credentials.
+func AbortRotation(wd Depot, name string) error {
+	name, err := canonicalName(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = withLock(depotContext(wd), wd, stagedRotationLock(name), StagedRotationLockTTL, func() error {
+		return deleteStaged(wd, name)
+	})
+
+	return errors.Wrapf(err, "aborting rotation for '%s'", name)
+}
+
+// deleteStaged removes the credentials staged for the name.
+func deleteStaged(wd Depot, name string) error {
+	staged := StagedName(name)
+	return deleteIfExists(wd, PrivKeyTag(staged), CrtTag(staged), ChainTag(staged), ParamTag(staged, certificateMetadataParam))
+}
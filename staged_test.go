@@ -0,0 +1,99 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStagedRotation(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "staged-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+	current, err := d.Generate("alice")
+	require.NoError(t, err)
+	require.NoError(t, d.Save("alice", current))
+
+	t.Run("AbortDoesNotChangeCurrentCredentials", func(t *testing.T) {
+		staged, err := StageRotation(d, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", staged.ServerName)
+		assert.NotEqual(t, current.Key, staged.Key)
+
+		found, err := d.Find("alice")
+		require.NoError(t, err)
+		assert.Equal(t, current.Cert, found.Cert)
+
+		require.NoError(t, AbortRotation(d, "alice"))
+		_, err = FindStaged(d, "alice")
+		assert.Error(t, err)
+		found, err = d.Find("alice")
+		require.NoError(t, err)
+		assert.Equal(t, current.Cert, found.Cert)
+		assert.NoError(t, AbortRotation(d, "alice"))
+	})
+	t.Run("CommitSwitchesToStagedCredentials", func(t *testing.T) {
+		staged, err := StageRotation(d, "alice")
+		require.NoError(t, err)
+		_, err = StageRotation(d, "alice")
+		assert.Error(t, err)
+
+		prefetched, err := FindStaged(d, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, staged.Cert, prefetched.Cert)
+		assert.Equal(t, staged.Key, prefetched.Key)
+		assert.Equal(t, "alice", prefetched.ServerName)
+		_, err = prefetched.Export()
+		require.NoError(t, err)
+
+		committed, err := CommitRotation(d, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, staged.Cert, committed.Cert)
+		found, err := d.Find("alice")
+		require.NoError(t, err)
+		assert.Equal(t, staged.Cert, found.Cert)
+		assert.Equal(t, staged.Key, found.Key)
+		assert.False(t, CheckCertificate(d, StagedName("alice")))
+
+		_, err = CommitRotation(d, "alice")
+		assert.Error(t, err)
+	})
+	t.Run("StagesWithOptions", func(t *testing.T) {
+		staged, err := StageRotationWithOptions(d, CertificateOptions{
+			CommonName: "alice",
+			Host:       "alice",
+			Domain:     []string{"alice.example.com"},
+		})
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, AbortRotation(d, "alice"))
+		}()
+
+		crt, err := getRawCertificate(d, StagedName("alice"))
+		require.NoError(t, err)
+		assert.Contains(t, crt.DNSNames, "alice.example.com")
+		assert.NotNil(t, staged)
+	})
+	t.Run("ReconcileKeepsStagedCredentials", func(t *testing.T) {
+		_, err := StageRotation(d, "alice")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, AbortRotation(d, "alice"))
+		}()
+
+		_, err = Reconcile(context.TODO(), d, []CertificateSpec{{Name: "alice"}})
+		require.NoError(t, err)
+		assert.True(t, CheckCertificate(d, StagedName("alice")))
+	})
+}
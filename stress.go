@@ -0,0 +1,232 @@
+package certdepot
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// StressOptions configure DepotStressSuite.
+type StressOptions struct {
+	// Workers is the number of goroutines operating on the depot at once.
+	// It defaults to 8.
+	Workers int
+	// Names is the number of names the workers operate on. It defaults to
+	// twice the number of workers.
+	Names int
+	// Operations is the number of Put, Get, Check, and Delete operations
+	// each worker performs. It defaults to 200.
+	Operations int
+	// Generations is the number of credentials each worker generates and
+	// saves. Generating keys is slow, so it defaults to 3.
+	Generations int
+	// Seed seeds the random choice of operations, so that failures can be
+	// reproduced. If unset, the current time is used and logged.
+	Seed int64
+}
+
+func (opts StressOptions) withDefaults() StressOptions {
+	if opts.Workers <= 0 {
+		opts.Workers = 8
+	}
+	if opts.Names <= 0 {
+		opts.Names = 2 * opts.Workers
+	}
+	if opts.Operations <= 0 {
+		opts.Operations = 200
+	}
+	if opts.Generations <= 0 {
+		opts.Generations = 3
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	return opts
+}
+
+// DepotStressSuite hammers depots returned by newDepot with concurrent Put,
+// Get, Check, Delete, Generate, Save, and Find operations across many names,
+// and checks that no writes are lost, that no torn or partial data is ever
+// read, and that Find never returns a certificate that does not match its
+// key. Like DepotConformanceSuite, newDepot is called once per test and must
+// return an empty depot configured with ConformanceSuiteCA as its CA. Run it
+// with the race detector to also catch data races in the depot.
+//
+// Each name is only written by one worker, while every worker reads every
+// name: the depots in this package do not serialize concurrent Saves of the
+// same name, so only concurrent writes to different names and reads
+// concurrent with writes are checked.
+func DepotStressSuite(t *testing.T, newDepot func() Depot, opts StressOptions) {
+	opts = opts.withDefaults()
+	t.Logf("stress suite seed: %d", opts.Seed)
+
+	names := make([]string, opts.Names)
+	for i := range names {
+		names[i] = fmt.Sprintf("stress%d", i)
+	}
+	// owned returns the names the worker writes.
+	owned := func(worker int) []string {
+		var result []string
+		for i := worker; i < len(names); i += opts.Workers {
+			result = append(result, names[i])
+		}
+		return result
+	}
+
+	t.Run("ConcurrentPutGetDelete", func(t *testing.T) {
+		d := newDepot()
+		final := make([]map[string]string, opts.Workers)
+
+		wg := &sync.WaitGroup{}
+		for worker := 0; worker < opts.Workers; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				rng := rand.New(rand.NewSource(opts.Seed + int64(worker)))
+				mine := owned(worker)
+				// stored is the last value written to each owned
+				// name, or "" if it was deleted.
+				stored := map[string]string{}
+				final[worker] = stored
+
+				for op := 0; op < opts.Operations; op++ {
+					if len(mine) == 0 || rng.Intn(2) == 0 {
+						// Read a name owned by any worker, which
+						// must never be torn.
+						name := names[rng.Intn(len(names))]
+						data, err := d.Get(CrtTag(name))
+						if err == nil {
+							assert.NoError(t, checkStressValue(name, string(data)))
+						}
+						continue
+					}
+
+					name := mine[rng.Intn(len(mine))]
+					if stored[name] != "" && rng.Intn(4) == 0 {
+						if !assert.NoError(t, d.Delete(CrtTag(name)), name) {
+							return
+						}
+						stored[name] = ""
+						assert.False(t, d.Check(CrtTag(name)), "deleted %s is still present", name)
+						continue
+					}
+
+					// Depots differ in whether Put overwrites
+					// existing data, so delete it first.
+					if stored[name] != "" {
+						if !assert.NoError(t, d.Delete(CrtTag(name)), name) {
+							return
+						}
+					}
+					value := stressValue(name, op)
+					if !assert.NoError(t, d.Put(CrtTag(name), []byte(value)), name) {
+						return
+					}
+					stored[name] = value
+					data, err := d.Get(CrtTag(name))
+					if assert.NoError(t, err, "%s written by its only writer is missing", name) {
+						assert.Equal(t, value, string(data), "write to %s was lost", name)
+					}
+				}
+			}(worker)
+		}
+		wg.Wait()
+
+		for _, stored := range final {
+			for name, value := range stored {
+				if value == "" {
+					assert.False(t, d.Check(CrtTag(name)), "deleted %s is present after all workers finished", name)
+					continue
+				}
+				data, err := d.Get(CrtTag(name))
+				if assert.NoError(t, err, "%s is missing after all workers finished", name) {
+					assert.Equal(t, value, string(data), "last write to %s was lost", name)
+				}
+			}
+		}
+	})
+	t.Run("ConcurrentGenerateSaveFind", func(t *testing.T) {
+		d := newDepot()
+		initConformanceSuiteCA(t, d)
+		final := make([]map[string][]byte, opts.Workers)
+
+		wg := &sync.WaitGroup{}
+		for worker := 0; worker < opts.Workers; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				rng := rand.New(rand.NewSource(opts.Seed + int64(worker)))
+				mine := owned(worker)
+				saved := map[string][]byte{}
+				final[worker] = saved
+
+				for op := 0; op < opts.Generations && len(mine) > 0; op++ {
+					name := mine[rng.Intn(len(mine))]
+					creds, err := d.Generate(name)
+					if !assert.NoError(t, err, name) {
+						return
+					}
+					if !assert.NoError(t, d.Save(name, creds), name) {
+						return
+					}
+					saved[name] = creds.Cert
+
+					// Read names owned by other workers, which may
+					// be in the middle of being saved.
+					for i := 0; i < 5; i++ {
+						other := names[rng.Intn(len(names))]
+						found, err := d.Find(other)
+						if err != nil {
+							continue
+						}
+						_, err = tls.X509KeyPair(found.Cert, found.Key)
+						assert.NoError(t, err, "Find returned partial credentials for %s", other)
+					}
+				}
+			}(worker)
+		}
+		wg.Wait()
+
+		for _, saved := range final {
+			for name, cert := range saved {
+				found, err := d.Find(name)
+				if !assert.NoError(t, err, name) {
+					continue
+				}
+				assert.Equal(t, string(cert), string(found.Cert), "last save of %s was lost", name)
+				_, err = tls.X509KeyPair(found.Cert, found.Key)
+				assert.NoError(t, err, name)
+			}
+		}
+	})
+}
+
+// stressValueRepeats is how many times the unit of a stress value is repeated,
+// which makes values large enough that torn reads and writes are likely to be
+// detected.
+const stressValueRepeats = 256
+
+// stressValue returns the value written to the name by the operation.
+func stressValue(name string, op int) string {
+	return strings.Repeat(fmt.Sprintf("%s/%d;", name, op), stressValueRepeats)
+}
+
+// checkStressValue returns an error if the value is not a complete value
+// written to the name by a single operation.
+func checkStressValue(name, value string) error {
+	unit := value[:strings.IndexByte(value, ';')+1]
+	if !strings.HasPrefix(unit, name+"/") {
+		return errors.Errorf("value for %s was written to another name: %.40q", name, value)
+	}
+	if value != strings.Repeat(unit, stressValueRepeats) {
+		return errors.Errorf("value for %s is torn or partial: %.40q", name, value)
+	}
+	return nil
+}
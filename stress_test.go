@@ -0,0 +1,73 @@
+package certdepot
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestDepotStress(t *testing.T) {
+	depotOpts := DepotOptions{
+		CA:                ConformanceSuiteCA,
+		DefaultExpiration: time.Hour,
+	}
+
+	t.Run("File", func(t *testing.T) {
+		DepotStressSuite(t, func() Depot {
+			tempDir, err := ioutil.TempDir(".", "stress-test")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				assert.NoError(t, os.RemoveAll(tempDir))
+			})
+
+			d, err := MakeFileDepot(tempDir, depotOpts)
+			require.NoError(t, err)
+			return d
+		}, StressOptions{})
+	})
+	t.Run("Memory", func(t *testing.T) {
+		DepotStressSuite(t, func() Depot {
+			d, err := NewMemoryDepot(depotOpts)
+			require.NoError(t, err)
+			return d
+		}, StressOptions{})
+	})
+	t.Run("MongoDB", func(t *testing.T) {
+		ctx := context.Background()
+		collections := 0
+		DepotStressSuite(t, func() Depot {
+			collections++
+			opts := &MongoDBOptions{
+				MongoDBURI:     testMongoDBURI(),
+				DatabaseName:   "certDepot",
+				CollectionName: fmt.Sprintf("stress%d", collections),
+				DepotOptions:   depotOpts,
+			}
+			d, err := NewMongoDBCertDepot(ctx, opts)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				assert.NoError(t, d.(*mongoDepot).coll.(*mongo.Collection).Drop(ctx))
+				assert.NoError(t, d.(*mongoDepot).metadataCollection().(*mongo.Collection).Drop(ctx))
+			})
+
+			return d
+		}, StressOptions{})
+	})
+}
+
+func TestStressValues(t *testing.T) {
+	value := stressValue("stress1", 3)
+	require.NoError(t, checkStressValue("stress1", value))
+	assert.Error(t, checkStressValue("stress10", value))
+	assert.Error(t, checkStressValue("stress0", value))
+	assert.Error(t, checkStressValue("stress1", value[:len(value)/2]))
+	assert.Error(t, checkStressValue("stress1", value[:len(value)/2]+stressValue("stress1", 4)[len(value)/2:]))
+	assert.Error(t, checkStressValue("stress1", "data"))
+}
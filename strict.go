@@ -0,0 +1,174 @@
+package certdepot
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// minStrictRSAKeyBits is the smallest RSA key size allowed in strict crypto
+// mode.
+const minStrictRSAKeyBits = 2048
+
+// WeakCryptoProblem is a reason that credentials are rejected in strict crypto
+// mode.
+type WeakCryptoProblem string
+
+const (
+	// WeakSignatureAlgorithm is a certificate signed with SHA-1 or an older
+	// hash.
+	WeakSignatureAlgorithm WeakCryptoProblem = "weak-signature-algorithm"
+	// WeakKeySize is an RSA key smaller than 2048 bits.
+	WeakKeySize WeakCryptoProblem = "weak-key-size"
+	// ExpiredCA is a CA certificate that has expired.
+	ExpiredCA WeakCryptoProblem = "expired-ca"
+	// NotFIPSApproved is an algorithm or key size that is not approved in
+	// FIPS mode.
+	NotFIPSApproved WeakCryptoProblem = "not-fips-approved"
+)
+
+// WeakCryptoError is returned when a depot with StrictCrypto or FIPS set
+// refuses to load or issue credentials. Use errors.As to check for it.
+type WeakCryptoError struct {
+	// Name is the name of the certificate or key that was rejected.
+	Name string
+	// Problem is why it was rejected.
+	Problem WeakCryptoProblem
+	// Detail describes the problem.
+	Detail string
+}
+
+func (e *WeakCryptoError) Error() string {
+	return fmt.Sprintf("'%s' rejected by strict crypto mode (%s): %s", e.Name, e.Problem, e.Detail)
+}
+
+// IsWeakCryptoError returns whether the error, or the error it wraps, is a
+// WeakCryptoError.
+func IsWeakCryptoError(err error) bool {
+	var weakErr *WeakCryptoError
+	return errors.As(err, &weakErr)
+}
+
+// cryptoPolicy is the set of restrictions on the algorithms and key sizes
+// that a depot issues and loads.
+type cryptoPolicy struct {
+	// strict rejects weak algorithms, key sizes, and expired CAs.
+	strict bool
+	// fips rejects algorithms and key sizes that are not FIPS-approved.
+	fips bool
+}
+
+// getCryptoPolicy returns the crypto policy for the depot options. FIPS mode
+// is always enabled in binaries built with the fips build tag.
+func getCryptoPolicy(do DepotOptions) cryptoPolicy {
+	return cryptoPolicy{strict: do.StrictCrypto, fips: fipsBuild || do.FIPS}
+}
+
+// enabled returns whether the policy has any restrictions.
+func (p cryptoPolicy) enabled() bool {
+	return p.strict || p.fips
+}
+
+// checkPublicKey returns a WeakCryptoError if the policy rejects the public
+// key.
+func (p cryptoPolicy) checkPublicKey(name string, pub interface{}) error {
+	if p.strict {
+		if err := checkStrictPublicKey(name, pub); err != nil {
+			return err
+		}
+	}
+	if p.fips {
+		return checkFIPSPublicKey(name, pub)
+	}
+
+	return nil
+}
+
+// checkCertificate returns a WeakCryptoError if the policy rejects the
+// certificate.
+func (p cryptoPolicy) checkCertificate(name string, crt *x509.Certificate, now time.Time) error {
+	if p.strict {
+		if err := checkStrictCertificate(name, crt, now); err != nil {
+			return err
+		}
+	}
+	if p.fips {
+		return checkFIPSCertificate(name, crt)
+	}
+
+	return nil
+}
+
+// checkCredentials returns a WeakCryptoError if the policy rejects any
+// certificate in the credentials.
+func (p cryptoPolicy) checkCredentials(name string, creds *Credentials) error {
+	if !p.enabled() {
+		return nil
+	}
+
+	now := time.Now()
+	for _, data := range [][]byte{creds.Cert, creds.CACert} {
+		crts, err := parsePEMCertificates(data)
+		if err != nil {
+			return errors.Wrap(err, "parsing certificates")
+		}
+		for _, crt := range crts {
+			if err = p.checkCertificate(name, crt, now); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// weakSignatureAlgorithms are the signature algorithms rejected in strict
+// crypto mode.
+var weakSignatureAlgorithms = map[x509.SignatureAlgorithm]bool{
+	x509.MD2WithRSA:    true,
+	x509.MD5WithRSA:    true,
+	x509.SHA1WithRSA:   true,
+	x509.DSAWithSHA1:   true,
+	x509.ECDSAWithSHA1: true,
+}
+
+// checkStrictPublicKey returns a WeakCryptoError if the public key is too weak
+// for strict crypto mode.
+func checkStrictPublicKey(name string, pub interface{}) error {
+	if rsaPub, ok := pub.(*rsa.PublicKey); ok && rsaPub.N.BitLen() < minStrictRSAKeyBits {
+		return &WeakCryptoError{
+			Name:    name,
+			Problem: WeakKeySize,
+			Detail:  fmt.Sprintf("RSA key has %d bits, but at least %d are required", rsaPub.N.BitLen(), minStrictRSAKeyBits),
+		}
+	}
+
+	return nil
+}
+
+// checkStrictCertificate returns a WeakCryptoError if the certificate has a
+// weak signature or key, or if it is an expired CA, for strict crypto mode.
+func checkStrictCertificate(name string, crt *x509.Certificate, now time.Time) error {
+	if weakSignatureAlgorithms[crt.SignatureAlgorithm] {
+		return &WeakCryptoError{
+			Name:    name,
+			Problem: WeakSignatureAlgorithm,
+			Detail:  fmt.Sprintf("certificate is signed with %s", crt.SignatureAlgorithm),
+		}
+	}
+	if err := checkStrictPublicKey(name, crt.PublicKey); err != nil {
+		return err
+	}
+	if crt.IsCA && now.After(crt.NotAfter) {
+		return &WeakCryptoError{
+			Name:    name,
+			Problem: ExpiredCA,
+			Detail:  fmt.Sprintf("CA certificate '%s' expired at %s", crt.Subject.CommonName, crt.NotAfter),
+		}
+	}
+
+	return nil
+}
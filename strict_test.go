@@ -0,0 +1,121 @@
+package certdepot
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckStrictCertificate(t *testing.T) {
+	now := time.Now()
+	strongKey := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 2047), E: 65537}
+	weakKey := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 1023), E: 65537}
+	newCrt := func() *x509.Certificate {
+		return &x509.Certificate{
+			Subject:            pkix.Name{CommonName: "root"},
+			SignatureAlgorithm: x509.SHA256WithRSA,
+			PublicKey:          strongKey,
+			NotAfter:           now.Add(time.Hour),
+			IsCA:               true,
+		}
+	}
+	problem := func(t *testing.T, err error) WeakCryptoProblem {
+		var weakErr *WeakCryptoError
+		require.True(t, errors.As(err, &weakErr))
+		assert.Equal(t, "root", weakErr.Name)
+		return weakErr.Problem
+	}
+
+	t.Run("AllowsStrongCertificate", func(t *testing.T) {
+		assert.NoError(t, checkStrictCertificate("root", newCrt(), now))
+	})
+	t.Run("RejectsSHA1Signature", func(t *testing.T) {
+		crt := newCrt()
+		crt.SignatureAlgorithm = x509.SHA1WithRSA
+		assert.Equal(t, WeakSignatureAlgorithm, problem(t, checkStrictCertificate("root", crt, now)))
+	})
+	t.Run("RejectsSmallRSAKey", func(t *testing.T) {
+		crt := newCrt()
+		crt.PublicKey = weakKey
+		assert.Equal(t, WeakKeySize, problem(t, checkStrictCertificate("root", crt, now)))
+	})
+	t.Run("RejectsExpiredCA", func(t *testing.T) {
+		crt := newCrt()
+		crt.NotAfter = now.Add(-time.Hour)
+		assert.Equal(t, ExpiredCA, problem(t, checkStrictCertificate("root", crt, now)))
+	})
+	t.Run("AllowsExpiredLeaf", func(t *testing.T) {
+		crt := newCrt()
+		crt.IsCA = false
+		crt.NotAfter = now.Add(-time.Hour)
+		assert.NoError(t, checkStrictCertificate("root", crt, now))
+	})
+}
+
+func TestStrictCrypto(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "strict-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	lax, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	strict, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour, StrictCrypto: true})
+	require.NoError(t, err)
+
+	t.Run("RejectsWeakCAKey", func(t *testing.T) {
+		caOpts := CertificateOptions{CommonName: "weak_root", Expires: time.Hour, KeyBits: 1024}
+		err := caOpts.Init(strict)
+		require.Error(t, err)
+		assert.True(t, IsWeakCryptoError(err))
+		assert.False(t, CheckCertificate(strict, "weak_root"))
+	})
+
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(strict))
+
+	t.Run("IssuesStrongCertificate", func(t *testing.T) {
+		creds, err := strict.Generate("alice")
+		require.NoError(t, err)
+		require.NoError(t, strict.Save("alice", creds))
+		_, err = strict.Find("alice")
+		assert.NoError(t, err)
+	})
+	t.Run("RejectsIssuingWeakKey", func(t *testing.T) {
+		_, err := strict.GenerateWithOptions(CertificateOptions{CommonName: "bob", Host: "bob", KeyBits: 1024})
+		require.Error(t, err)
+		assert.True(t, IsWeakCryptoError(err))
+	})
+	t.Run("RejectsLoadingWeakKey", func(t *testing.T) {
+		if FIPSEnabled() {
+			t.Skip("cannot issue weak keys in FIPS mode")
+		}
+		creds, err := lax.GenerateWithOptions(CertificateOptions{CommonName: "carol", Host: "carol", KeyBits: 1024})
+		require.NoError(t, err)
+		require.NoError(t, lax.Save("carol", creds))
+
+		_, err = lax.Find("carol")
+		assert.NoError(t, err)
+		_, err = strict.Find("carol")
+		require.Error(t, err)
+		assert.True(t, IsWeakCryptoError(err))
+	})
+	t.Run("DisabledByDefault", func(t *testing.T) {
+		if FIPSEnabled() {
+			t.Skip("FIPS mode is always enabled")
+		}
+		assert.False(t, IsWeakCryptoError(errors.New("error")))
+		_, err := lax.GenerateWithOptions(CertificateOptions{CommonName: "dave", Host: "dave", KeyBits: 1024})
+		assert.NoError(t, err)
+	})
+}
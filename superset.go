@@ -1,6 +1,11 @@
 package certdepot
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+
 	"github.com/mongodb/grip"
 	"github.com/pkg/errors"
 	"github.com/square/certstrap/depot"
@@ -18,19 +23,41 @@ func deleteIfExists(dpt depot.Depot, tags ...*depot.Tag) error {
 }
 
 func depotSave(dpt Depot, name string, creds *Credentials) error {
-	if err := deleteIfExists(dpt, CsrTag(name), PrivKeyTag(name), CrtTag(name)); err != nil {
+	name, err := canonicalName(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	leaf, chain, err := splitCertificateChain(creds.Cert)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if grace := getDepotOptions(dpt).PreviousGracePeriod; grace > 0 {
+		if err = retainPrevious(dpt, name, grace); err != nil {
+			return errors.Wrap(err, "retaining previous credentials")
+		}
+	}
+
+	if err = deleteIfExists(dpt, CsrTag(name), PrivKeyTag(name), CrtTag(name), ChainTag(name), ParamTag(name, certificateMetadataParam)); err != nil {
 		return errors.Wrap(err, "deleting existing credentials")
 	}
 
-	if err := dpt.Put(PrivKeyTag(name), creds.Key); err != nil {
+	if err = dpt.Put(PrivKeyTag(name), creds.Key); err != nil {
 		return errors.Wrap(err, "saving key")
 	}
 
-	if err := dpt.Put(CrtTag(name), creds.Cert); err != nil {
+	if err = dpt.Put(CrtTag(name), leaf); err != nil {
 		return errors.Wrap(err, "saving certificate")
 	}
 
-	crt, err := pkix.NewCertificateFromPEM(creds.Cert)
+	if len(chain) != 0 {
+		if err = dpt.Put(ChainTag(name), chain); err != nil {
+			return errors.Wrap(err, "saving certificate chain")
+		}
+	}
+
+	crt, err := pkix.NewCertificateFromPEM(leaf)
 	if err != nil {
 		return errors.Wrap(err, "getting certificate from PEM bytes")
 	}
@@ -38,7 +65,7 @@ func depotSave(dpt Depot, name string, creds *Credentials) error {
 	if err != nil {
 		return errors.Wrap(err, "getting x509 certificate")
 	}
-	if err := putTTL(dpt, name, rawCrt.NotAfter); err != nil {
+	if err = putTTL(dpt, name, rawCrt.NotAfter); err != nil {
 		return errors.Wrap(err, "putting expiration on credentials")
 	}
 
@@ -46,13 +73,23 @@ func depotSave(dpt Depot, name string, creds *Credentials) error {
 }
 
 func depotGenerateDefault(dpt Depot, name string, do DepotOptions) (*Credentials, error) {
-	return depotGenerate(dpt, name, do, CertificateOptions{
+	opts := CertificateOptions{
 		CommonName: name,
 		Host:       name,
-	})
+	}
+	if err := do.applySANTemplates(name, &opts); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return depotGenerate(dpt, name, do, opts)
 }
 
 func depotGenerate(dpt Depot, name string, do DepotOptions, opts CertificateOptions) (*Credentials, error) {
+	name, err := canonicalName(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
 	if opts.CA == "" {
 		opts.CA = do.CA
 	}
@@ -65,9 +102,9 @@ func depotGenerate(dpt Depot, name string, do DepotOptions, opts CertificateOpti
 		return nil, errors.Wrap(err, "making certificate request and key")
 	}
 
-	pemCACrt, err := dpt.Get(CrtTag(do.CA))
+	pemCACrt, err := getTrustBundle(dpt, do.CA, do)
 	if err != nil {
-		return nil, errors.Wrap(err, "getting CA certificate")
+		return nil, errors.Wrap(err, "getting CA certificates")
 	}
 
 	pemKey, err := key.ExportPrivate()
@@ -84,6 +121,11 @@ func depotGenerate(dpt Depot, name string, do DepotOptions, opts CertificateOpti
 	if err != nil {
 		return nil, errors.Wrap(err, "exporting certificate")
 	}
+	chain, err := getIntermediateChain(dpt, opts.CA)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting intermediate CA chain")
+	}
+	pemCrt = append(pemCrt, chain...)
 
 	creds, err := NewCredentials(pemCACrt, pemCrt, pemKey)
 	if err != nil {
@@ -91,30 +133,111 @@ func depotGenerate(dpt Depot, name string, do DepotOptions, opts CertificateOpti
 	}
 	creds.ServerName = name
 
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting raw certificate")
+	}
+	intermediates, err := parsePEMCertificates(chain)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing intermediate CA chain")
+	}
+	if creds.bundle, err = creds.newBundle(rawCrt, intermediates, key); err != nil {
+		return nil, errors.Wrap(err, "creating issued bundle")
+	}
+	if err = getCryptoPolicy(do).checkCredentials(name, creds); err != nil {
+		return nil, err
+	}
+
 	return creds, nil
 }
 
-func depotFind(dpt depot.Depot, name string, do DepotOptions) (*Credentials, error) {
-	caCrt, err := dpt.Get(CrtTag(do.CA))
+func depotFind(dpt Depot, name string, do DepotOptions) (*Credentials, error) {
+	name, err := canonicalName(name)
 	if err != nil {
-		return nil, errors.Wrap(err, "getting CA certificate")
+		return nil, errors.WithStack(err)
 	}
 
-	crt, err := dpt.Get(CrtTag(name))
+	caCrt, err := getTrustBundle(dpt, do.CA, do)
 	if err != nil {
-		return nil, errors.Wrap(err, "getting certificate")
+		return nil, errors.Wrap(err, "getting CA certificates")
 	}
 
-	key, err := dpt.Get(PrivKeyTag(name))
+	crt, exists, err := GetIfExists(dpt, CrtTag(name))
 	if err != nil {
-		return nil, errors.Wrap(err, "getting key")
+		return nil, errors.Wrapf(err, "getting certificate for '%s'", name)
+	}
+	if !exists {
+		return nil, errors.Errorf("certificate for '%s' not found", name)
+	}
+	chain, _, err := GetIfExists(dpt, ChainTag(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting intermediate CA chain for '%s'", name)
+	}
+	// The key is read as bytes rather than through GetAll, which would
+	// copy it into an immutable string that cannot be zeroed. The buffer
+	// is handed to the credentials, or zeroed if they are not created.
+	key, exists, err := GetIfExists(dpt, PrivKeyTag(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting key for '%s'", name)
+	}
+	if !exists {
+		return nil, errors.Errorf("key for '%s' not found", name)
+	}
+
+	// The certificate and key are read separately, so if they are being
+	// saved concurrently, they may be from different credentials.
+	if !isEncryptedPEM(key) {
+		if _, err = tls.X509KeyPair(crt, key); err != nil {
+			zeroBytes(key)
+			return nil, errors.Wrapf(err, "certificate for '%s' does not match its key", name)
+		}
+	}
+
+	if len(chain) != 0 {
+		crt = appendPEM(crt, chain)
 	}
 
 	creds, err := NewCredentials(caCrt, crt, key)
 	if err != nil {
+		zeroBytes(key)
 		return nil, errors.Wrap(err, "creating credentials")
 	}
 	creds.ServerName = name
+	if err = getCryptoPolicy(do).checkCredentials(name, creds); err != nil {
+		return nil, err
+	}
+	if do.VerifyOnFind {
+		if err = verifyFoundCertificate(name, creds, do, x509.VerifyOptions{}); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
 
 	return creds, nil
 }
+
+// splitCertificateChain splits PEM-encoded certificates into the first
+// certificate and the PEM-encoded certificates that follow it, if any.
+func splitCertificateChain(data []byte) ([]byte, []byte, error) {
+	block, rest := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("certificate is not PEM-encoded")
+	}
+
+	leaf := pem.EncodeToMemory(block)
+	rest = bytes.TrimSpace(rest)
+	if len(rest) == 0 {
+		return leaf, nil, nil
+	}
+
+	return leaf, append(append([]byte{}, rest...), '\n'), nil
+}
+
+// appendPEM appends PEM-encoded data to PEM-encoded data, separating them with
+// a newline if needed.
+func appendPEM(data, more []byte) []byte {
+	out := append([]byte{}, data...)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	return append(out, more...)
+}
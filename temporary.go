@@ -0,0 +1,173 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+const (
+	// temporaryRegistryName is the reserved name the registry of
+	// temporary credentials is stored under in the depot.
+	temporaryRegistryName = "certdepot-temporary"
+	// temporaryRegistryParam is the parameter that holds the registry.
+	temporaryRegistryParam = "registry"
+	// maxTemporaryRecords is the number of temporary credentials
+	// remembered in the registry.
+	maxTemporaryRecords = 1000
+
+	// MaxTemporaryTTL is the longest lifetime of temporary credentials.
+	MaxTemporaryTTL = time.Hour
+)
+
+// TemporaryRegistryLockTTL is how long GenerateTemporary holds the lock on
+// the registry of temporary credentials before other callers consider it
+// abandoned.
+var TemporaryRegistryLockTTL = time.Minute
+
+// TemporaryRegistryRetention is how long records of temporary credentials are
+// kept in the registry after the credentials expire.
+var TemporaryRegistryRetention = 30 * 24 * time.Hour
+
+// TemporaryCredentialsRecord records the issuance of temporary credentials
+// for auditing.
+type TemporaryCredentialsRecord struct {
+	// Name is the name the credentials were issued for.
+	Name string `bson:"name" json:"name" yaml:"name"`
+	// SerialNumber is the hex-encoded serial number of the certificate.
+	SerialNumber string `bson:"serial_number" json:"serial_number" yaml:"serial_number"`
+	// Fingerprint is the hex-encoded SHA-256 digest of the certificate.
+	Fingerprint string `bson:"fingerprint" json:"fingerprint" yaml:"fingerprint"`
+	// IssuedAt is when the credentials were issued.
+	IssuedAt time.Time `bson:"issued_at" json:"issued_at" yaml:"issued_at"`
+	// ExpiresAt is when the certificate expires.
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at" yaml:"expires_at"`
+}
+
+// temporaryRegistryTag returns the tag the registry is stored under.
+func temporaryRegistryTag() *depot.Tag {
+	return ParamTag(temporaryRegistryName, temporaryRegistryParam)
+}
+
+// GenerateTemporary issues short-lived credentials for the name that expire
+// after the TTL, which must be between MinExpiration and MaxTemporaryTTL, such
+// as for ad hoc debugging access to services that require mutual TLS. Neither
+// the credentials nor their private key are stored in the depot; instead, the
+// issuance is recorded in a registry of temporary credentials, which can be
+// listed with ListTemporaryCredentials. The credentials are only returned
+// once they have been recorded.
+func GenerateTemporary(ctx context.Context, wd Depot, name string, ttl time.Duration) (*Credentials, error) {
+	if ttl < MinExpiration || ttl > MaxTemporaryTTL {
+		return nil, errors.Errorf("TTL %s must be between %s and %s", ttl, MinExpiration, MaxTemporaryTTL)
+	}
+	name, err := canonicalName(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	creds, err := wd.GenerateWithOptions(CertificateOptions{
+		CommonName: name,
+		Host:       name,
+		CA:         getDepotOptions(wd).CA,
+		Expires:    ttl,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "generating temporary credentials for '%s'", name)
+	}
+	bundle, err := creds.Bundle()
+	if err != nil {
+		creds.Zero()
+		return nil, errors.Wrap(err, "parsing temporary credentials")
+	}
+
+	record := TemporaryCredentialsRecord{
+		Name:         name,
+		SerialNumber: bundle.SerialNumber,
+		Fingerprint:  bundle.Fingerprint,
+		IssuedAt:     time.Now().UTC(),
+		ExpiresAt:    bundle.Certificate.NotAfter.UTC(),
+	}
+	err = withLock(ctx, wd, temporaryRegistryName, TemporaryRegistryLockTTL, func() error {
+		records, err := getTemporaryRecords(wd)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(putTemporaryRecords(wd, append(records, record)))
+	})
+	if err != nil {
+		creds.Zero()
+		return nil, errors.Wrap(err, "recording temporary credentials")
+	}
+
+	grip.Info(message.Fields{
+		"message":    "issued temporary credentials",
+		"name":       name,
+		"serial":     record.SerialNumber,
+		"expires_at": record.ExpiresAt,
+	})
+
+	return creds, nil
+}
+
+// ListTemporaryCredentials returns the records of the temporary credentials
+// issued by GenerateTemporary, in the order they were issued. Records are
+// kept for TemporaryRegistryRetention after the credentials expire, up to
+// the latest 1000 records.
+func ListTemporaryCredentials(wd Depot) ([]TemporaryCredentialsRecord, error) {
+	records, err := getTemporaryRecords(wd)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if records == nil {
+		records = []TemporaryCredentialsRecord{}
+	}
+	return records, nil
+}
+
+func getTemporaryRecords(wd Depot) ([]TemporaryCredentialsRecord, error) {
+	data, exists, err := GetIfExists(wd, temporaryRegistryTag())
+	if err != nil {
+		return nil, errors.Wrap(err, "getting temporary credentials registry")
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	records := []TemporaryCredentialsRecord{}
+	if err = json.Unmarshal(data, &records); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling temporary credentials registry")
+	}
+
+	return records, nil
+}
+
+// putTemporaryRecords stores the records in the registry, dropping those that
+// have been expired for longer than the retention period and the oldest
+// records beyond the maximum.
+func putTemporaryRecords(wd Depot, records []TemporaryCredentialsRecord) error {
+	cutoff := time.Now().Add(-TemporaryRegistryRetention)
+	kept := make([]TemporaryCredentialsRecord, 0, len(records))
+	for _, record := range records {
+		if record.ExpiresAt.After(cutoff) {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) > maxTemporaryRecords {
+		kept = kept[len(kept)-maxTemporaryRecords:]
+	}
+
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return errors.Wrap(err, "marshalling temporary credentials registry")
+	}
+	if err = deleteIfExists(wd, temporaryRegistryTag()); err != nil {
+		return errors.Wrap(err, "deleting temporary credentials registry")
+	}
+
+	return errors.Wrap(wd.Put(temporaryRegistryTag(), data), "saving temporary credentials registry")
+}
@@ -0,0 +1,277 @@
+// Package testcerts generates throwaway certificate authorities and leaf
+// credentials entirely in memory for use in unit tests. Certificates use small
+// ECDSA P-256 keys so that they are cheap to generate, and their lifetimes can
+// be configured to produce certificates that are not yet valid or have already
+// expired. Generated material is random unless a seeded source of randomness
+// is given in the options (see Options.Rand). None of the generated material
+// should be used outside of tests.
+package testcerts
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/evergreen-ci/certdepot"
+	"github.com/pkg/errors"
+)
+
+// DefaultExpiration is the lifetime of generated certificates if the options
+// do not specify one.
+const DefaultExpiration = time.Hour
+
+// Options configure a generated certificate.
+type Options struct {
+	// CommonName is the Common Name (CN) of the certificate (required).
+	CommonName string
+	// Domain contains the DNS subject alt names. Leaf certificates use the
+	// common name if no domains or IPs are given.
+	Domain []string
+	// IP contains the IP address subject alt names.
+	IP []string
+	// Expires is how long from now until the certificate expires. A
+	// negative value produces a certificate that has already expired. If
+	// zero, DefaultExpiration is used.
+	Expires time.Duration
+	// NotBefore is the start of the certificate's validity period. If zero,
+	// the certificate is valid starting an hour before it expires or an hour
+	// ago, whichever is earlier.
+	NotBefore time.Time
+	// Rand is the source of randomness for the certificate's key and serial
+	// number. If set, an Ed25519 key is derived from it instead of an ECDSA
+	// key, because Ed25519 keys and signatures do not depend on any other
+	// randomness, so a reader seeded with the same value always produces
+	// the same key and serial number. If nil, crypto/rand is used.
+	Rand io.Reader
+}
+
+func (opts Options) rand() io.Reader {
+	if opts.Rand != nil {
+		return opts.Rand
+	}
+	return rand.Reader
+}
+
+func (opts Options) validity(now time.Time) (time.Time, time.Time) {
+	expires := opts.Expires
+	if expires == 0 {
+		expires = DefaultExpiration
+	}
+	notAfter := now.Add(expires)
+
+	notBefore := opts.NotBefore
+	if notBefore.IsZero() {
+		notBefore = now.Add(-time.Hour)
+		if notAfter.Before(now) {
+			notBefore = notAfter.Add(-time.Hour)
+		}
+	}
+
+	return notBefore, notAfter
+}
+
+// CA is an in-memory certificate authority.
+type CA struct {
+	// Cert is the parsed CA certificate.
+	Cert *x509.Certificate
+	// Key is the CA private key.
+	Key crypto.Signer
+	// CertPEM is the PEM-encoded CA certificate.
+	CertPEM []byte
+	// KeyPEM is the PEM-encoded CA private key.
+	KeyPEM []byte
+}
+
+// NewCA generates a self-signed CA.
+func NewCA(opts Options) (*CA, error) {
+	if opts.CommonName == "" {
+		return nil, errors.New("must provide a common name")
+	}
+
+	key, keyPEM, err := generateKey(opts.Rand)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	serial, err := generateSerial(opts.rand())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	notBefore, notAfter := opts.validity(time.Now())
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: opts.CommonName},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	crt, crtPEM, err := createCertificate(template, template, key.Public(), key)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating CA certificate")
+	}
+
+	return &CA{
+		Cert:    crt,
+		Key:     key,
+		CertPEM: crtPEM,
+		KeyPEM:  keyPEM,
+	}, nil
+}
+
+// MustNewCA is the same as NewCA but panics on error.
+func MustNewCA(opts Options) *CA {
+	ca, err := NewCA(opts)
+	if err != nil {
+		panic(err)
+	}
+	return ca
+}
+
+// Credentials returns the CA's own certificate and key as credentials.
+func (ca *CA) Credentials() *certdepot.Credentials {
+	return &certdepot.Credentials{
+		CACert:     ca.CertPEM,
+		Cert:       ca.CertPEM,
+		Key:        ca.KeyPEM,
+		ServerName: ca.Cert.Subject.CommonName,
+	}
+}
+
+// NewCredentials generates a leaf certificate signed by the CA, usable for
+// both server and client authentication.
+func (ca *CA) NewCredentials(opts Options) (*certdepot.Credentials, error) {
+	if opts.CommonName == "" {
+		return nil, errors.New("must provide a common name")
+	}
+
+	key, keyPEM, err := generateKey(opts.Rand)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	serial, err := generateSerial(opts.rand())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ips := make([]net.IP, 0, len(opts.IP))
+	for _, ip := range opts.IP {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, errors.Errorf("invalid IP address '%s'", ip)
+		}
+		ips = append(ips, parsed)
+	}
+	domains := opts.Domain
+	if len(domains) == 0 && len(ips) == 0 {
+		domains = []string{opts.CommonName}
+	}
+
+	notBefore, notAfter := opts.validity(time.Now())
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: opts.CommonName},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		DNSNames:    domains,
+		IPAddresses: ips,
+	}
+	_, crtPEM, err := createCertificate(template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating certificate")
+	}
+
+	return &certdepot.Credentials{
+		CACert:     ca.CertPEM,
+		Cert:       crtPEM,
+		Key:        keyPEM,
+		ServerName: opts.CommonName,
+	}, nil
+}
+
+// MustNewCredentials is the same as NewCredentials but panics on error.
+func (ca *CA) MustNewCredentials(opts Options) *certdepot.Credentials {
+	creds, err := ca.NewCredentials(opts)
+	if err != nil {
+		panic(err)
+	}
+	return creds
+}
+
+// NewCredentials generates a throwaway CA and a leaf certificate for the
+// given name signed by it, both valid for DefaultExpiration.
+func NewCredentials(name string) (*certdepot.Credentials, error) {
+	ca, err := NewCA(Options{CommonName: name + "-ca"})
+	if err != nil {
+		return nil, errors.Wrap(err, "creating CA")
+	}
+
+	return ca.NewCredentials(Options{CommonName: name})
+}
+
+// generateKey generates an ECDSA key, or an Ed25519 key derived from r if it
+// is not nil.
+func generateKey(r io.Reader) (crypto.Signer, []byte, error) {
+	if r != nil {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := io.ReadFull(r, seed); err != nil {
+			return nil, nil, errors.Wrap(err, "reading key seed")
+		}
+		key := ed25519.NewKeyFromSeed(seed)
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "marshalling key")
+		}
+
+		return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "generating key")
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "marshalling key")
+	}
+
+	return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// generateSerial returns a random, positive 128-bit serial number.
+func generateSerial(r io.Reader) (*big.Int, error) {
+	serial, err := rand.Int(r, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "generating serial number")
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+func createCertificate(template, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) (*x509.Certificate, []byte, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
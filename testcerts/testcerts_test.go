@@ -0,0 +1,124 @@
+package testcerts
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	mathrand "math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCA(t *testing.T) {
+	t.Run("FailsWithoutCommonName", func(t *testing.T) {
+		ca, err := NewCA(Options{})
+		assert.Error(t, err)
+		assert.Nil(t, ca)
+		assert.Panics(t, func() { MustNewCA(Options{}) })
+	})
+	t.Run("AssignsUniqueSerials", func(t *testing.T) {
+		first := MustNewCA(Options{CommonName: "root"})
+		second := MustNewCA(Options{CommonName: "root"})
+		assert.NotEqual(t, first.Cert.SerialNumber, second.Cert.SerialNumber)
+	})
+	t.Run("SeededRandIsDeterministic", func(t *testing.T) {
+		seeded := func() *CA {
+			return MustNewCA(Options{
+				CommonName: "root",
+				Rand:       mathrand.New(mathrand.NewSource(42)),
+			})
+		}
+		first := seeded()
+		second := seeded()
+		assert.Equal(t, first.KeyPEM, second.KeyPEM)
+		assert.Equal(t, first.Cert.SerialNumber, second.Cert.SerialNumber)
+		assert.NoError(t, first.Credentials().Validate())
+
+		other := MustNewCA(Options{CommonName: "root"})
+		assert.NotEqual(t, first.KeyPEM, other.KeyPEM)
+	})
+	t.Run("GeneratesValidCA", func(t *testing.T) {
+		ca := MustNewCA(Options{CommonName: "root"})
+		assert.True(t, ca.Cert.IsCA)
+		assert.Equal(t, "root", ca.Cert.Subject.CommonName)
+		assert.WithinDuration(t, time.Now().Add(DefaultExpiration), ca.Cert.NotAfter, time.Minute)
+		assert.NoError(t, ca.Credentials().Validate())
+	})
+}
+
+func TestNewCredentials(t *testing.T) {
+	ca := MustNewCA(Options{CommonName: "root"})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	parse := func(t *testing.T, certPEM, keyPEM []byte) *x509.Certificate {
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		require.NoError(t, err)
+		crt, err := x509.ParseCertificate(pair.Certificate[0])
+		require.NoError(t, err)
+		return crt
+	}
+
+	t.Run("FailsWithoutCommonName", func(t *testing.T) {
+		creds, err := ca.NewCredentials(Options{})
+		assert.Error(t, err)
+		assert.Nil(t, creds)
+	})
+	t.Run("FailsWithInvalidIP", func(t *testing.T) {
+		creds, err := ca.NewCredentials(Options{CommonName: "alice", IP: []string{"invalid"}})
+		assert.Error(t, err)
+		assert.Nil(t, creds)
+	})
+	t.Run("GeneratesVerifiableLeaf", func(t *testing.T) {
+		creds := ca.MustNewCredentials(Options{CommonName: "alice", IP: []string{"127.0.0.1"}})
+		require.NoError(t, creds.Validate())
+		assert.Equal(t, "alice", creds.ServerName)
+		crt := parse(t, creds.Cert, creds.Key)
+		_, err := crt.Verify(x509.VerifyOptions{Roots: roots, DNSName: "127.0.0.1"})
+		assert.NoError(t, err)
+
+		_, err = creds.Resolve()
+		assert.NoError(t, err)
+	})
+	t.Run("DefaultsDomainToCommonName", func(t *testing.T) {
+		creds := ca.MustNewCredentials(Options{CommonName: "alice"})
+		crt := parse(t, creds.Cert, creds.Key)
+		assert.Equal(t, []string{"alice"}, crt.DNSNames)
+		_, err := crt.Verify(x509.VerifyOptions{Roots: roots, DNSName: "alice"})
+		assert.NoError(t, err)
+	})
+	t.Run("AssignsUniqueSerials", func(t *testing.T) {
+		first := ca.MustNewCredentials(Options{CommonName: "alice"})
+		second := ca.MustNewCredentials(Options{CommonName: "alice"})
+		firstCrt := parse(t, first.Cert, first.Key)
+		secondCrt := parse(t, second.Cert, second.Key)
+		assert.NotEqual(t, firstCrt.SerialNumber, secondCrt.SerialNumber)
+	})
+	t.Run("GeneratesSeededLeaf", func(t *testing.T) {
+		creds := ca.MustNewCredentials(Options{
+			CommonName: "alice",
+			Rand:       mathrand.New(mathrand.NewSource(42)),
+		})
+		crt := parse(t, creds.Cert, creds.Key)
+		_, err := crt.Verify(x509.VerifyOptions{Roots: roots, DNSName: "alice"})
+		assert.NoError(t, err)
+		_, err = creds.Resolve()
+		assert.NoError(t, err)
+	})
+	t.Run("GeneratesExpiredLeaf", func(t *testing.T) {
+		creds := ca.MustNewCredentials(Options{CommonName: "alice", Expires: -time.Minute})
+		crt := parse(t, creds.Cert, creds.Key)
+		assert.True(t, crt.NotAfter.Before(time.Now()))
+		assert.True(t, crt.NotBefore.Before(crt.NotAfter))
+		_, err := crt.Verify(x509.VerifyOptions{Roots: roots})
+		assert.Error(t, err)
+	})
+	t.Run("GeneratesStandaloneCredentials", func(t *testing.T) {
+		creds, err := NewCredentials("bob")
+		require.NoError(t, err)
+		assert.Equal(t, "bob", creds.ServerName)
+		assert.NoError(t, creds.Validate())
+	})
+}
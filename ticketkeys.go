@@ -0,0 +1,362 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultTicketKeyRotationInterval is how long a session ticket key
+	// issues new tickets before it is rotated, if not otherwise specified.
+	DefaultTicketKeyRotationInterval = 24 * time.Hour
+	// DefaultTicketKeyRefreshInterval is how often a TicketKeyManager
+	// re-reads its keys from the depot, if not otherwise specified.
+	DefaultTicketKeyRefreshInterval = time.Minute
+	// defaultTicketKeysRetained is the number of previous session ticket
+	// keys kept to resume sessions, if not otherwise specified.
+	defaultTicketKeysRetained = 2
+
+	// ticketKeysParam is the parameter that session ticket keys are stored
+	// under (see ParamTag).
+	ticketKeysParam = "session_ticket_keys"
+	// ticketKeysPEMType is the PEM block type of the encrypted session
+	// ticket keys stored in the depot.
+	ticketKeysPEMType = "ENCRYPTED SESSION TICKET KEYS"
+	// ticketKeyLockTimeout is how long a TicketKeyManager waits for another
+	// instance to finish rotating the keys.
+	ticketKeyLockTimeout = 30 * time.Second
+)
+
+// TicketKeyManagerOptions configure a TicketKeyManager.
+type TicketKeyManagerOptions struct {
+	// Name is the name the session ticket keys are stored under in the
+	// depot, typically the name of the service they are used by.
+	Name string `bson:"name" json:"name" yaml:"name"`
+	// EncryptionKey is the 32-byte AES-256 key that the session ticket
+	// keys are encrypted with in the depot. Every instance sharing the
+	// keys must use the same encryption key.
+	EncryptionKey []byte `bson:"-" json:"-" yaml:"-"`
+	// RotationInterval is how long a session ticket key issues new
+	// tickets before it is replaced. Defaults to
+	// DefaultTicketKeyRotationInterval.
+	RotationInterval time.Duration `bson:"rotation_interval,omitempty" json:"rotation_interval,omitempty" yaml:"rotation_interval,omitempty"`
+	// Retain is the number of previous keys that are kept so that
+	// sessions resumed with tickets issued before a rotation do not need
+	// a full handshake. Defaults to 2.
+	Retain int `bson:"retain,omitempty" json:"retain,omitempty" yaml:"retain,omitempty"`
+	// RefreshInterval is how often the keys are re-read from the depot
+	// and rotated if needed. Defaults to DefaultTicketKeyRefreshInterval.
+	RefreshInterval time.Duration `bson:"refresh_interval,omitempty" json:"refresh_interval,omitempty" yaml:"refresh_interval,omitempty"`
+}
+
+// Validate checks that the options are valid and sets defaults.
+func (opts *TicketKeyManagerOptions) Validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Name == "", "must specify a name")
+	catcher.NewWhen(len(opts.EncryptionKey) != 32, "encryption key must be 32 bytes")
+	catcher.NewWhen(opts.RotationInterval < 0 || opts.Retain < 0 || opts.RefreshInterval < 0, "ticket key options cannot be negative")
+	if catcher.HasErrors() {
+		return catcher.Resolve()
+	}
+
+	if opts.RotationInterval == 0 {
+		opts.RotationInterval = DefaultTicketKeyRotationInterval
+	}
+	if opts.Retain == 0 {
+		opts.Retain = defaultTicketKeysRetained
+	}
+	if opts.RefreshInterval == 0 {
+		opts.RefreshInterval = DefaultTicketKeyRefreshInterval
+	}
+
+	return nil
+}
+
+// ticketKey is a session ticket key and when it was created.
+type ticketKey struct {
+	Key     []byte    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// TicketKeyManager shares TLS session ticket keys between every instance of a
+// service through the depot, so that a session resumed with any instance can
+// use a ticket issued by another. The keys are stored encrypted alongside the
+// service's credentials and the newest key is rotated on an interval by
+// whichever instance first notices that it is due. If the depot implements
+// Locker, only one instance rotates the keys at a time.
+type TicketKeyManager struct {
+	wd   Depot
+	opts TicketKeyManagerOptions
+	now  func() time.Time
+
+	mu      sync.RWMutex
+	keys    []ticketKey
+	configs []*tls.Config
+}
+
+// NewTicketKeyManager loads the session ticket keys from the depot, creating
+// them if they do not exist, and refreshes them every RefreshInterval until
+// the context is canceled.
+func NewTicketKeyManager(ctx context.Context, wd Depot, opts TicketKeyManagerOptions) (*TicketKeyManager, error) {
+	m, err := newTicketKeyManager(wd, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	go m.refreshEvery(ctx)
+
+	return m, nil
+}
+
+// newTicketKeyManager loads the session ticket keys from the depot without
+// refreshing them in the background.
+func newTicketKeyManager(wd Depot, opts TicketKeyManagerOptions) (*TicketKeyManager, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+	opts.Name = formatName(opts.Name)
+
+	m := &TicketKeyManager{
+		wd:   wd,
+		opts: opts,
+		now:  time.Now,
+	}
+	if _, err := m.Refresh(); err != nil {
+		return nil, errors.Wrap(err, "loading session ticket keys")
+	}
+
+	return m, nil
+}
+
+// Keys returns the current session ticket keys, newest first, in the form
+// accepted by tls.Config.SetSessionTicketKeys.
+func (m *TicketKeyManager) Keys() [][32]byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return sessionTicketKeys(m.keys)
+}
+
+// Register sets the current session ticket keys on the config and updates
+// them whenever the keys are rotated.
+func (m *TicketKeyManager) Register(conf *tls.Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.configs = append(m.configs, conf)
+	conf.SetSessionTicketKeys(sessionTicketKeys(m.keys))
+}
+
+// Refresh re-reads the session ticket keys from the depot, rotating them if
+// the newest key is older than the rotation interval, and updates registered
+// configs if the keys changed. It returns whether the keys changed. If the
+// keys cannot be read or rotated, the current keys are kept.
+func (m *TicketKeyManager) Refresh() (bool, error) {
+	keys, err := m.load()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	if m.needsRotation(keys) {
+		ctx, cancel := context.WithTimeout(depotContext(m.wd), ticketKeyLockTimeout)
+		defer cancel()
+		err = withLock(ctx, m.wd, m.opts.Name+"_"+ticketKeysParam, ticketKeyLockTimeout, func() error {
+			// Another instance may have rotated the keys while this one
+			// waited for the lock.
+			if keys, err = m.load(); err != nil {
+				return errors.WithStack(err)
+			}
+			if !m.needsRotation(keys) {
+				return nil
+			}
+
+			keys, err = m.rotate(keys)
+			return errors.WithStack(err)
+		})
+		if err != nil {
+			return false, errors.Wrap(err, "rotating session ticket keys")
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ticketKeysEqual(m.keys, keys) {
+		return false, nil
+	}
+	m.keys = keys
+	for _, conf := range m.configs {
+		conf.SetSessionTicketKeys(sessionTicketKeys(keys))
+	}
+
+	return true, nil
+}
+
+func (m *TicketKeyManager) needsRotation(keys []ticketKey) bool {
+	return len(keys) == 0 || m.now().Sub(keys[0].Created) >= m.opts.RotationInterval
+}
+
+// rotate adds a new key in front of the keys, drops keys that are no longer
+// retained, and stores the result in the depot.
+func (m *TicketKeyManager) rotate(keys []ticketKey) ([]ticketKey, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.Wrap(err, "generating session ticket key")
+	}
+
+	rotated := append([]ticketKey{{Key: key, Created: m.now().UTC()}}, keys...)
+	if len(rotated) > m.opts.Retain+1 {
+		rotated = rotated[:m.opts.Retain+1]
+	}
+	if err := m.store(rotated); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	grip.Info(message.Fields{
+		"message": "rotated session ticket keys",
+		"name":    m.opts.Name,
+		"keys":    len(rotated),
+	})
+
+	return rotated, nil
+}
+
+// load reads and decrypts the keys stored in the depot, returning no keys if
+// none are stored.
+func (m *TicketKeyManager) load() ([]ticketKey, error) {
+	data, exists, err := GetIfExists(m.wd, ParamTag(m.opts.Name, ticketKeysParam))
+	if err != nil {
+		return nil, errors.Wrap(err, "getting session ticket keys")
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != ticketKeysPEMType {
+		return nil, errors.New("session ticket keys are not PEM-encoded")
+	}
+	gcm, err := m.cipher()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(block.Bytes) < gcm.NonceSize() {
+		return nil, errors.New("encrypted session ticket keys are too short")
+	}
+	plaintext, err := gcm.Open(nil, block.Bytes[:gcm.NonceSize()], block.Bytes[gcm.NonceSize():], []byte(m.opts.Name))
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypting session ticket keys")
+	}
+
+	keys := []ticketKey{}
+	if err = json.Unmarshal(plaintext, &keys); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling session ticket keys")
+	}
+	for _, key := range keys {
+		if len(key.Key) != 32 {
+			return nil, errors.New("session ticket keys must be 32 bytes")
+		}
+	}
+
+	return keys, nil
+}
+
+// store encrypts the keys and replaces the keys stored in the depot.
+func (m *TicketKeyManager) store(keys []ticketKey) error {
+	plaintext, err := json.Marshal(keys)
+	if err != nil {
+		return errors.Wrap(err, "marshalling session ticket keys")
+	}
+	gcm, err := m.cipher()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.Wrap(err, "generating nonce")
+	}
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:  ticketKeysPEMType,
+		Bytes: gcm.Seal(nonce, nonce, plaintext, []byte(m.opts.Name)),
+	})
+
+	tag := ParamTag(m.opts.Name, ticketKeysParam)
+	if err = deleteIfExists(m.wd, tag); err != nil {
+		return errors.Wrap(err, "deleting previous session ticket keys")
+	}
+
+	return errors.Wrap(m.wd.Put(tag, data), "putting session ticket keys")
+}
+
+func (m *TicketKeyManager) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(m.opts.EncryptionKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating GCM")
+	}
+
+	return gcm, nil
+}
+
+func (m *TicketKeyManager) refreshEvery(ctx context.Context) {
+	ticker := time.NewTicker(m.opts.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := m.Refresh()
+		grip.Error(message.WrapError(err, message.Fields{
+			"message": "could not refresh session ticket keys",
+			"name":    m.opts.Name,
+		}))
+		grip.InfoWhen(changed, message.Fields{
+			"message": "refreshed session ticket keys",
+			"name":    m.opts.Name,
+		})
+	}
+}
+
+func sessionTicketKeys(keys []ticketKey) [][32]byte {
+	tlsKeys := make([][32]byte, 0, len(keys))
+	for _, key := range keys {
+		var tlsKey [32]byte
+		copy(tlsKey[:], key.Key)
+		tlsKeys = append(tlsKeys, tlsKey)
+	}
+
+	return tlsKeys
+}
+
+func ticketKeysEqual(a, b []ticketKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Key, b[i].Key) || !a[i].Created.Equal(b[i].Created) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,105 @@
+package certdepot
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTicketKeyManagerOptionsValidate(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	for name, opts := range map[string]TicketKeyManagerOptions{
+		"MissingName":      {EncryptionKey: key},
+		"ShortKey":         {Name: "service", EncryptionKey: key[:16]},
+		"NegativeRotation": {Name: "service", EncryptionKey: key, RotationInterval: -time.Hour},
+		"NegativeRetain":   {Name: "service", EncryptionKey: key, Retain: -1},
+		"NegativeRefresh":  {Name: "service", EncryptionKey: key, RefreshInterval: -time.Minute},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, opts.Validate())
+		})
+	}
+	t.Run("SetsDefaults", func(t *testing.T) {
+		opts := TicketKeyManagerOptions{Name: "service", EncryptionKey: key}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, DefaultTicketKeyRotationInterval, opts.RotationInterval)
+		assert.Equal(t, defaultTicketKeysRetained, opts.Retain)
+		assert.Equal(t, DefaultTicketKeyRefreshInterval, opts.RefreshInterval)
+	})
+}
+
+func TestTicketKeyManager(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "ticket-keys-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := NewFileDepot(tempDir)
+	require.NoError(t, err)
+
+	opts := TicketKeyManagerOptions{
+		Name:             "my service",
+		EncryptionKey:    bytes.Repeat([]byte{1}, 32),
+		RotationInterval: time.Hour,
+		Retain:           1,
+	}
+	first, err := newTicketKeyManager(d, opts)
+	require.NoError(t, err)
+	require.Len(t, first.Keys(), 1)
+
+	t.Run("SharesKeysThroughDepot", func(t *testing.T) {
+		second, err := newTicketKeyManager(d, opts)
+		require.NoError(t, err)
+		assert.Equal(t, first.Keys(), second.Keys())
+	})
+	t.Run("EncryptsKeysInDepot", func(t *testing.T) {
+		data, err := d.Get(ParamTag("my_service", ticketKeysParam))
+		require.NoError(t, err)
+		assert.False(t, bytes.Contains(data, first.Keys()[0][:]))
+
+		wrongKey := opts
+		wrongKey.EncryptionKey = bytes.Repeat([]byte{2}, 32)
+		_, err = newTicketKeyManager(d, wrongKey)
+		assert.Error(t, err)
+	})
+	t.Run("DoesNotRotateBeforeInterval", func(t *testing.T) {
+		changed, err := first.Refresh()
+		require.NoError(t, err)
+		assert.False(t, changed)
+	})
+	t.Run("RotatesAndRetainsPreviousKeys", func(t *testing.T) {
+		original := first.Keys()
+		conf := &tls.Config{}
+		first.Register(conf)
+
+		first.now = func() time.Time { return time.Now().Add(time.Hour) }
+		changed, err := first.Refresh()
+		require.NoError(t, err)
+		assert.True(t, changed)
+		rotated := first.Keys()
+		require.Len(t, rotated, 2)
+		assert.Equal(t, original[0], rotated[1])
+
+		second, err := newTicketKeyManager(d, opts)
+		require.NoError(t, err)
+		assert.Equal(t, rotated, second.Keys())
+
+		first.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		changed, err = first.Refresh()
+		require.NoError(t, err)
+		assert.True(t, changed)
+		require.Len(t, first.Keys(), 2)
+		assert.Equal(t, rotated[0], first.Keys()[1])
+
+		changed, err = second.Refresh()
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Equal(t, first.Keys(), second.Keys())
+	})
+}
@@ -0,0 +1,363 @@
+package certdepot
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+// DefaultTokenTTL is how long tokens minted by MintToken are valid for if
+// TokenOptions.TTL is not set.
+const DefaultTokenTTL = 5 * time.Minute
+
+// TokenOptions configure the tokens minted by MintToken.
+type TokenOptions struct {
+	// SigningKey is the name of the private key in the depot that signs
+	// the token. It defaults to the depot's CA.
+	SigningKey string `bson:"signing_key,omitempty" json:"signing_key,omitempty" yaml:"signing_key,omitempty"`
+	// Issuer is the token's "iss" claim.
+	Issuer string `bson:"issuer,omitempty" json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	// Audience is the token's "aud" claim.
+	Audience []string `bson:"audience,omitempty" json:"audience,omitempty" yaml:"audience,omitempty"`
+	// TTL is how long the token is valid for. It defaults to
+	// DefaultTokenTTL, and tokens never outlive the certificate they are
+	// minted for.
+	TTL time.Duration `bson:"ttl,omitempty" json:"ttl,omitempty" yaml:"ttl,omitempty"`
+}
+
+// TokenClaims are the claims of a token minted by MintToken.
+type TokenClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub"`
+	Audience  []string `json:"aud,omitempty"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	Expires   int64    `json:"exp"`
+	ID        string   `json:"jti"`
+	// DNSNames and URIs are the subject alt names of the certificate.
+	DNSNames []string `json:"dns,omitempty"`
+	URIs     []string `json:"uris,omitempty"`
+	// Confirmation binds the token to the certificate, as described in
+	// RFC 8705.
+	Confirmation TokenConfirmation `json:"cnf"`
+}
+
+// TokenConfirmation identifies the certificate a token was minted for.
+type TokenConfirmation struct {
+	// CertificateThumbprint is the base64url-encoded SHA-256 digest of the
+	// DER-encoded certificate.
+	CertificateThumbprint string `json:"x5t#S256"`
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// MintToken returns a short-lived JWT, signed by a key in the depot, that
+// asserts the identity of the holder of the certificate, so that services
+// that accept bearer tokens but not client certificates can authenticate
+// holders of depot-issued certificates. The certificate must chain to the
+// depot's CA or trusted CAs and must not be revoked; callers are responsible
+// for checking that the requester holds its private key, for example by
+// requiring it as a TLS client certificate. The token's subject is the
+// certificate's common name.
+func MintToken(wd Depot, crt *x509.Certificate, opts TokenOptions) (string, error) {
+	if crt == nil {
+		return "", errors.New("must specify a certificate")
+	}
+	if opts.TTL < 0 {
+		return "", errors.New("TTL cannot be negative")
+	}
+	if opts.TTL == 0 {
+		opts.TTL = DefaultTokenTTL
+	}
+
+	pool, err := newCAPool(wd)
+	if err != nil {
+		return "", errors.Wrap(err, "loading CA certificates")
+	}
+	chains, err := pool.verify([][]byte{crt.Raw})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err = pool.checkRevocation(chains); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	name, err := tokenSigningKeyName(wd, opts.SigningKey)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	key, err := depot.GetPrivateKey(wd, name)
+	if err != nil {
+		return "", errors.Wrapf(err, "getting signing key '%s'", name)
+	}
+	signer, ok := key.Private.(crypto.Signer)
+	if !ok {
+		return "", errors.Errorf("signing key '%s' of type %T cannot sign", name, key.Private)
+	}
+	alg, err := tokenAlgorithm(signer.Public())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	now := time.Now()
+	expires := now.Add(opts.TTL)
+	if crt.NotAfter.Before(expires) {
+		expires = crt.NotAfter
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "generating token ID")
+	}
+	thumbprint := sha256.Sum256(crt.Raw)
+	claims := TokenClaims{
+		Issuer:       opts.Issuer,
+		Subject:      crt.Subject.CommonName,
+		Audience:     opts.Audience,
+		IssuedAt:     now.Unix(),
+		NotBefore:    now.Unix(),
+		Expires:      expires.Unix(),
+		ID:           hex.EncodeToString(id),
+		DNSNames:     crt.DNSNames,
+		Confirmation: TokenConfirmation{CertificateThumbprint: base64.RawURLEncoding.EncodeToString(thumbprint[:])},
+	}
+	for _, uri := range crt.URIs {
+		claims.URIs = append(claims.URIs, uri.String())
+	}
+
+	header := tokenHeader{Algorithm: alg.name, Type: "JWT"}
+	if signingCrt, err := getRawCertificate(wd, name); err == nil {
+		header.KeyID = certificateFingerprint(signingCrt)
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", errors.Wrap(err, "marshalling token header")
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "marshalling token claims")
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	sig, err := alg.sign(signer, []byte(signed))
+	if err != nil {
+		return "", errors.Wrap(err, "signing token")
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// VerifyToken checks that the token was signed by the key in the depot with
+// the given name, or the depot's CA if the name is empty, and that it is
+// currently valid, and returns its claims. If audience is not empty, the
+// token must be intended for it.
+func VerifyToken(wd Depot, token, signingKey, audience string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWT")
+	}
+
+	name, err := tokenSigningKeyName(wd, signingKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pub, err := tokenVerificationKey(wd, name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	alg, err := tokenAlgorithm(pub)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding token header")
+	}
+	header := tokenHeader{}
+	if err = json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling token header")
+	}
+	if header.Algorithm != alg.name {
+		return nil, errors.Errorf("token algorithm '%s' does not match signing key algorithm '%s'", header.Algorithm, alg.name)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding token signature")
+	}
+	if err = alg.verify(pub, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, errors.Wrap(err, "verifying token signature")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding token claims")
+	}
+	claims := &TokenClaims{}
+	if err = json.Unmarshal(claimsJSON, claims); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling token claims")
+	}
+
+	now := time.Now().Unix()
+	if now < claims.NotBefore {
+		return nil, errors.New("token is not valid yet")
+	}
+	if now >= claims.Expires {
+		return nil, errors.New("token has expired")
+	}
+	if audience != "" {
+		found := false
+		for _, aud := range claims.Audience {
+			if aud == audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("token is not intended for audience '%s'", audience)
+		}
+	}
+
+	return claims, nil
+}
+
+// tokenSigningKeyName returns the name of the signing key, defaulting to the
+// depot's CA.
+func tokenSigningKeyName(wd Depot, name string) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+	if name = getDepotOptions(wd).CA; name == "" {
+		return "", errors.New("must specify a signing key if the depot has no default CA")
+	}
+
+	return name, nil
+}
+
+// tokenVerificationKey returns the public key for the signing key, from its
+// certificate if it has one and from its private key otherwise.
+func tokenVerificationKey(wd Depot, name string) (crypto.PublicKey, error) {
+	exists, err := CheckCertificateWithError(wd, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "checking certificate for signing key '%s'", name)
+	}
+	if exists {
+		crt, err := getRawCertificate(wd, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting certificate for signing key '%s'", name)
+		}
+		return crt.PublicKey, nil
+	}
+
+	key, err := depot.GetPrivateKey(wd, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting signing key '%s'", name)
+	}
+
+	return key.Public, nil
+}
+
+// tokenAlg is a JWS signature algorithm.
+type tokenAlg struct {
+	name string
+	hash crypto.Hash
+	// size is the size in bytes of each of the ECDSA signature's integers.
+	size int
+}
+
+// tokenAlgorithm returns the JWS algorithm for the public key.
+func tokenAlgorithm(pub crypto.PublicKey) (tokenAlg, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return tokenAlg{name: "RS256", hash: crypto.SHA256}, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			return tokenAlg{name: "ES256", hash: crypto.SHA256, size: 32}, nil
+		case 384:
+			return tokenAlg{name: "ES384", hash: crypto.SHA384, size: 48}, nil
+		case 521:
+			return tokenAlg{name: "ES512", hash: crypto.SHA512, size: 66}, nil
+		}
+		return tokenAlg{}, errors.Errorf("unsupported ECDSA curve '%s'", key.Curve.Params().Name)
+	default:
+		return tokenAlg{}, errors.Errorf("unsupported signing key type %T", pub)
+	}
+}
+
+func (a tokenAlg) digest(data []byte) []byte {
+	switch a.hash {
+	case crypto.SHA384:
+		sum := sha512.Sum384(data)
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(data)
+		return sum[:]
+	default:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// sign signs the data, converting ECDSA signatures from ASN.1 to the
+// fixed-size encoding JWS uses.
+func (a tokenAlg) sign(signer crypto.Signer, data []byte) ([]byte, error) {
+	sig, err := signer.Sign(rand.Reader, a.digest(data), a.hash)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if a.size == 0 {
+		return sig, nil
+	}
+
+	parsed := ecdsaSignature{}
+	if _, err = asn1.Unmarshal(sig, &parsed); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling ECDSA signature")
+	}
+	out := make([]byte, 2*a.size)
+	parsed.R.FillBytes(out[:a.size])
+	parsed.S.FillBytes(out[a.size:])
+
+	return out, nil
+}
+
+func (a tokenAlg) verify(pub crypto.PublicKey, data, sig []byte) error {
+	digest := a.digest(data)
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return errors.WithStack(rsa.VerifyPKCS1v15(key, a.hash, digest, sig))
+	case *ecdsa.PublicKey:
+		if len(sig) != 2*a.size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:a.size])
+		s := new(big.Int).SetBytes(sig[a.size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	default:
+		return errors.Errorf("unsupported signing key type %T", pub)
+	}
+}
@@ -0,0 +1,87 @@
+package certdepot
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToken(t *testing.T) {
+	tempDir, err := ioutil.TempDir(".", "token-test")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+	d, err := MakeFileDepot(tempDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+	require.NoError(t, err)
+	caOpts := CertificateOptions{CommonName: "root", Expires: time.Hour}
+	require.NoError(t, caOpts.Init(d))
+	creds, err := d.GenerateWithOptions(CertificateOptions{CommonName: "alice", Host: "alice", Domain: []string{"alice.example.com"}, Expires: 2 * time.Minute})
+	require.NoError(t, err)
+	bundle, err := creds.Bundle()
+	require.NoError(t, err)
+	crt := bundle.Certificate
+
+	t.Run("SignedByCA", func(t *testing.T) {
+		token, err := MintToken(d, crt, TokenOptions{Issuer: "certdepot", Audience: []string{"api"}})
+		require.NoError(t, err)
+		assert.Len(t, strings.Split(token, "."), 3)
+
+		claims, err := VerifyToken(d, token, "", "api")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", claims.Subject)
+		assert.Equal(t, "certdepot", claims.Issuer)
+		assert.Contains(t, claims.DNSNames, "alice.example.com")
+		thumbprint := sha256.Sum256(crt.Raw)
+		assert.Equal(t, base64.RawURLEncoding.EncodeToString(thumbprint[:]), claims.Confirmation.CertificateThumbprint)
+		assert.Equal(t, crt.NotAfter.Unix(), claims.Expires, "token must not outlive the certificate")
+
+		_, err = VerifyToken(d, token, "", "other")
+		assert.Error(t, err)
+		_, err = VerifyToken(d, token[:len(token)-4]+"AAAA", "", "")
+		assert.Error(t, err)
+	})
+	t.Run("SignedByDedicatedECDSAKey", func(t *testing.T) {
+		require.NoError(t, (&CertificateOptions{CommonName: "token-signer", Expires: time.Hour, KeyType: KeyTypeECDSA}).Init(d))
+
+		token, err := MintToken(d, crt, TokenOptions{SigningKey: "token-signer", TTL: time.Minute})
+		require.NoError(t, err)
+		claims, err := VerifyToken(d, token, "token-signer", "")
+		require.NoError(t, err)
+		assert.Equal(t, claims.IssuedAt+60, claims.Expires)
+
+		_, err = VerifyToken(d, token, "", "")
+		assert.Error(t, err, "token must not verify with a different key")
+	})
+	t.Run("RejectsUntrustedCertificate", func(t *testing.T) {
+		otherDir, err := ioutil.TempDir(".", "token-test-other")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(otherDir))
+		}()
+		other, err := MakeFileDepot(otherDir, DepotOptions{CA: "root", DefaultExpiration: time.Hour})
+		require.NoError(t, err)
+		require.NoError(t, (&CertificateOptions{CommonName: "root", Expires: time.Hour}).Init(other))
+		otherCreds, err := other.Generate("mallory")
+		require.NoError(t, err)
+		otherBundle, err := otherCreds.Bundle()
+		require.NoError(t, err)
+
+		_, err = MintToken(d, otherBundle.Certificate, TokenOptions{})
+		assert.Error(t, err)
+	})
+	t.Run("RejectsExpiredToken", func(t *testing.T) {
+		token, err := MintToken(d, crt, TokenOptions{TTL: time.Second})
+		require.NoError(t, err)
+		time.Sleep(1100 * time.Millisecond)
+		_, err = VerifyToken(d, token, "", "")
+		assert.Error(t, err)
+	})
+}
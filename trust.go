@@ -0,0 +1,171 @@
+package certdepot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+)
+
+// ImportTrustedCA stores the PEM-encoded certificate of an external CA in the
+// depot under the given name without a private key. Adding the name to
+// DepotOptions.TrustedCAs includes the CA in the CACert of credentials
+// returned by the depot, so that services issued by different CAs can
+// mutually authenticate. Any existing trusted CA certificate with the same
+// name is replaced, but if a private key is stored under the name, such as
+// for the depot's own CA, the import is refused; use ReplaceTrustedCA to
+// overwrite such an entry.
+func ImportTrustedCA(wd Depot, name string, caCert []byte) error {
+	return importTrustedCA(wd, name, caCert, false)
+}
+
+// ReplaceTrustedCA is the same as ImportTrustedCA but overwrites any existing
+// entry with the given name, deleting its private key, certificate request,
+// and revocation list.
+func ReplaceTrustedCA(wd Depot, name string, caCert []byte) error {
+	return importTrustedCA(wd, name, caCert, true)
+}
+
+func importTrustedCA(wd Depot, name string, caCert []byte, overwrite bool) error {
+	if name == "" {
+		return errors.New("must provide name of trusted CA")
+	}
+
+	crts, err := parseCACertificates(caCert)
+	if err != nil {
+		return errors.Wrap(err, "parsing trusted CA certificate")
+	}
+	if len(crts) != 1 {
+		return errors.Errorf("expected exactly one CA certificate, found %d", len(crts))
+	}
+
+	formattedName := formatName(name)
+	if overwrite {
+		if err = deleteIfExists(wd, PrivKeyTag(formattedName), CsrTag(formattedName), CrlTag(formattedName)); err != nil {
+			return errors.Wrap(err, "deleting existing entry")
+		}
+	} else {
+		keyExists, err := CheckPrivateKeyWithError(wd, formattedName)
+		if err != nil {
+			return errors.Wrap(err, "checking for existing private key")
+		}
+		if keyExists {
+			return errors.Errorf("'%s' has a private key in the depot and cannot be replaced by a trusted CA", name)
+		}
+	}
+
+	if err = deleteIfExists(wd, CrtTag(formattedName)); err != nil {
+		return errors.Wrap(err, "deleting existing trusted CA certificate")
+	}
+	if err = wd.Put(CrtTag(formattedName), encodeCertificates(crts)); err != nil {
+		return errors.Wrap(err, "saving trusted CA certificate")
+	}
+
+	return nil
+}
+
+// ImportTrustedCAFromDepot copies the certificate of the named CA from the
+// source depot into the destination depot. See ImportTrustedCA.
+func ImportTrustedCAFromDepot(wd Depot, src Depot, name string) error {
+	caCert, err := src.Get(CrtTag(formatName(name)))
+	if err != nil {
+		return errors.Wrap(err, "getting CA certificate from source depot")
+	}
+
+	return ImportTrustedCA(wd, name, caCert)
+}
+
+// AddTrustedCA appends the PEM-encoded CA certificates to the credentials'
+// CACert bundle, skipping any that are already present.
+func (c *Credentials) AddTrustedCA(caCert []byte) error {
+	crts, err := parseCACertificates(caCert)
+	if err != nil {
+		return errors.Wrap(err, "parsing trusted CA certificate")
+	}
+
+	existing, err := parsePEMCertificates(c.CACert)
+	if err != nil {
+		return errors.Wrap(err, "parsing existing CA certificates")
+	}
+	for _, crt := range crts {
+		found := false
+		for _, other := range existing {
+			if crt.Equal(other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.CACert = append(append([]byte{}, c.CACert...), encodeCertificates([]*x509.Certificate{crt})...)
+			existing = append(existing, crt)
+		}
+	}
+
+	return nil
+}
+
+// getTrustBundle returns the PEM-encoded certificate of the given CA followed
+// by the certificates of any additional trusted CAs in the depot options.
+func getTrustBundle(wd Depot, caName string, do DepotOptions) ([]byte, error) {
+	bundle, err := wd.Get(CrtTag(caName))
+	if err != nil {
+		return nil, errors.Wrap(err, "getting CA certificate")
+	}
+
+	if len(do.TrustedCAs) == 0 {
+		return bundle, nil
+	}
+
+	creds := &Credentials{CACert: bundle}
+	for _, name := range do.TrustedCAs {
+		caCert, err := wd.Get(CrtTag(formatName(name)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting trusted CA certificate '%s'", name)
+		}
+		if err = creds.AddTrustedCA(caCert); err != nil {
+			return nil, errors.Wrapf(err, "adding trusted CA '%s'", name)
+		}
+	}
+
+	return creds.CACert, nil
+}
+
+func parseCACertificates(data []byte) ([]*x509.Certificate, error) {
+	crts, err := parsePEMCertificates(data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, crt := range crts {
+		if !crt.IsCA {
+			return nil, errors.Errorf("certificate '%s' is not a CA", crt.Subject.CommonName)
+		}
+	}
+
+	return crts, nil
+}
+
+func parsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	crts := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing certificate")
+		}
+		crts = append(crts, crt)
+	}
+	if len(bytes.TrimSpace(data)) != 0 {
+		return nil, errors.New("trailing data after PEM certificates")
+	}
+
+	return crts, nil
+}
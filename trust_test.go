@@ -0,0 +1,137 @@
+package certdepot
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedCAs(t *testing.T) {
+	makeDepot := func(t *testing.T, ca string, trusted ...string) Depot {
+		tempDir, err := ioutil.TempDir(".", "trust-test")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		})
+
+		d, err := MakeFileDepot(tempDir, DepotOptions{
+			CA:                ca,
+			DefaultExpiration: time.Hour,
+			TrustedCAs:        trusted,
+		})
+		require.NoError(t, err)
+
+		opts := CertificateOptions{
+			CommonName: ca,
+			Expires:    time.Hour,
+		}
+		require.NoError(t, opts.Init(d))
+		return d
+	}
+
+	east := makeDepot(t, "east", "west")
+	west := makeDepot(t, "west", "east")
+
+	t.Run("ImportFailsWithNonCA", func(t *testing.T) {
+		creds, err := makeDepot(t, "other").Generate("leaf")
+		require.NoError(t, err)
+		assert.Error(t, ImportTrustedCA(west, "leaf", creds.Cert))
+	})
+	t.Run("ImportFailsWithInvalidData", func(t *testing.T) {
+		assert.Error(t, ImportTrustedCA(west, "junk", []byte("junk")))
+		assert.Error(t, ImportTrustedCA(west, "", []byte("junk")))
+	})
+	t.Run("ImportFailsWithExistingPrivateKey", func(t *testing.T) {
+		westCA, err := west.Get(CrtTag("west"))
+		require.NoError(t, err)
+		assert.Error(t, ImportTrustedCA(east, "east", westCA))
+		eastCA, err := east.Get(CrtTag("east"))
+		require.NoError(t, err)
+		assert.NotEqual(t, westCA, eastCA)
+	})
+	t.Run("ReplaceOverwritesExistingEntry", func(t *testing.T) {
+		d := makeDepot(t, "other")
+		westCA, err := west.Get(CrtTag("west"))
+		require.NoError(t, err)
+		require.NoError(t, ReplaceTrustedCA(d, "other", westCA))
+
+		otherCA, err := d.Get(CrtTag("other"))
+		require.NoError(t, err)
+		assert.Equal(t, westCA, otherCA)
+		assert.False(t, CheckPrivateKey(d, "other"))
+		assert.False(t, d.Check(CrlTag("other")))
+	})
+	t.Run("FindFailsWithMissingTrustedCA", func(t *testing.T) {
+		_, err := east.Generate("alice")
+		assert.Error(t, err)
+	})
+
+	require.NoError(t, ImportTrustedCAFromDepot(east, west, "west"))
+	require.NoError(t, ImportTrustedCAFromDepot(west, east, "east"))
+	t.Run("ImportIsIdempotent", func(t *testing.T) {
+		require.NoError(t, ImportTrustedCAFromDepot(west, east, "east"))
+	})
+
+	t.Run("FederatedCredentialsMutuallyAuthenticate", func(t *testing.T) {
+		alice, err := east.GenerateWithOptions(CertificateOptions{
+			CommonName: "alice",
+			Host:       "alice",
+			Domain:     []string{"alice"},
+		})
+		require.NoError(t, err)
+		bob, err := west.GenerateWithOptions(CertificateOptions{
+			CommonName: "bob",
+			Host:       "bob",
+			Domain:     []string{"bob"},
+		})
+		require.NoError(t, err)
+
+		assert.Len(t, parseCertificates(t, alice.CACert), 2)
+		assert.Len(t, parseCertificates(t, bob.CACert), 2)
+
+		aliceConf, err := alice.Resolve()
+		require.NoError(t, err)
+		bobConf, err := bob.Resolve()
+		require.NoError(t, err)
+		bobConf.ServerName = "alice"
+
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", aliceConf)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		errs := make(chan error, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			errs <- conn.(*tls.Conn).Handshake()
+		}()
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), bobConf)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.Handshake())
+		assert.NoError(t, <-errs)
+	})
+	t.Run("AddTrustedCASkipsDuplicates", func(t *testing.T) {
+		eastCA, err := east.Get(CrtTag("east"))
+		require.NoError(t, err)
+		creds := &Credentials{CACert: eastCA}
+		require.NoError(t, creds.AddTrustedCA(eastCA))
+		assert.Len(t, parseCertificates(t, creds.CACert), 1)
+	})
+	t.Run("AddTrustedCAFailsWithInvalidBundle", func(t *testing.T) {
+		eastCA, err := east.Get(CrtTag("east"))
+		require.NoError(t, err)
+		creds := &Credentials{CACert: []byte("junk")}
+		assert.Error(t, creds.AddTrustedCA(eastCA))
+	})
+}
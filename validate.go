@@ -0,0 +1,127 @@
+package certdepot
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+)
+
+// CertificateOperation is an operation that uses CertificateOptions.
+type CertificateOperation string
+
+const (
+	// OperationInit is the creation of a root CA by Init.
+	OperationInit CertificateOperation = "init"
+	// OperationCertRequest is the creation of a certificate signing request
+	// and key by CertRequest.
+	OperationCertRequest CertificateOperation = "cert-request"
+	// OperationSign is the signing of a certificate request by Sign.
+	OperationSign CertificateOperation = "sign"
+)
+
+var domainLabel = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?$`)
+
+// Validate checks that the options required by the operation are set, that
+// no options conflict, and that the subject alt names, extensions, and
+// policies used by the operation are well formed. Options that are not used
+// by the operation are ignored. All problems are returned together. Init,
+// CertRequest, and Sign validate their options before doing anything else.
+func (opts *CertificateOptions) Validate(op CertificateOperation) error {
+	catcher := grip.NewBasicCatcher()
+
+	switch op {
+	case OperationInit:
+		catcher.NewWhen(opts.CommonName == "", "must provide common name of CA")
+		catcher.NewWhen(opts.Purpose != "", "cannot set purpose of CA")
+		opts.validateSubjectAltNames(catcher)
+		opts.validateIssuance(catcher)
+	case OperationCertRequest:
+		_, err := opts.getCertificateRequestName()
+		catcher.Add(err)
+		opts.validateSubjectAltNames(catcher)
+	case OperationSign:
+		_, err := opts.StorageName()
+		catcher.Add(err)
+		catcher.NewWhen(opts.CA == "", "must provide name of CA")
+		catcher.NewWhen(opts.MaxPathLen != 0 && !opts.Intermediate, "cannot set maximum path length unless signing an intermediate")
+		catcher.NewWhen(opts.Purpose != "" && opts.Intermediate, "cannot set purpose of an intermediate CA")
+		opts.validateIssuance(catcher)
+	default:
+		catcher.Errorf("unknown operation '%s'", op)
+	}
+
+	opts.validateKey(catcher)
+
+	return catcher.Resolve()
+}
+
+// validateKey checks the options that describe the certificate request's
+// name and key, which every operation uses.
+func (opts *CertificateOptions) validateKey(catcher grip.Catcher) {
+	for _, source := range opts.NameSources {
+		catcher.Add(source.Validate())
+	}
+	catcher.NewWhen(opts.KeyBits < 0, "key size cannot be negative")
+	switch opts.KeyType {
+	case "", KeyTypeRSA:
+	case KeyTypeECDSA:
+		_, err := ecdsaCurve(opts.KeyBits)
+		catcher.Add(err)
+	default:
+		catcher.Errorf("unknown key type '%s'", opts.KeyType)
+	}
+}
+
+// validateSubjectAltNames checks that the requested IPs, URIs, and domains are
+// well formed.
+func (opts *CertificateOptions) validateSubjectAltNames(catcher grip.Catcher) {
+	domains, ips := opts.subjectAltNames()
+	for _, ip := range ips {
+		catcher.ErrorfWhen(net.ParseIP(strings.TrimSpace(ip)) == nil, "invalid IP address '%s'", ip)
+	}
+	for _, uri := range opts.URI {
+		_, err := pkix.ParseAndValidateURIs(uri)
+		catcher.Wrapf(err, "invalid URI '%s'", uri)
+	}
+	for _, domain := range domains {
+		catcher.Wrapf(validateDomain(domain), "invalid domain '%s'", domain)
+	}
+}
+
+// validateIssuance checks the options that describe the issued certificate.
+func (opts *CertificateOptions) validateIssuance(catcher grip.Catcher) {
+	catcher.ErrorfWhen(opts.Expires < 0, "expiration %s cannot be negative", opts.Expires)
+	catcher.ErrorfWhen(opts.Expires > 0 && opts.Expires < MinExpiration, "expiration %s is shorter than the minimum of %s", opts.Expires, MinExpiration)
+	_, err := opts.templateOptions()
+	catcher.Wrap(err, "invalid extensions or policies")
+}
+
+// validateDomain checks that the domain is a valid DNS name, optionally with a
+// leading wildcard label.
+func validateDomain(domain string) error {
+	if domain == "" {
+		return errors.New("domain is empty")
+	}
+	if len(domain) > 253 {
+		return errors.New("domain is longer than 253 characters")
+	}
+
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	for i, label := range labels {
+		if i == 0 && label == "*" && len(labels) > 1 {
+			continue
+		}
+		if len(label) > 63 {
+			return errors.Errorf("label '%s' is longer than 63 characters", label)
+		}
+		if !domainLabel.MatchString(label) {
+			return errors.Errorf("label '%s' is not a valid DNS label", label)
+		}
+	}
+
+	return nil
+}
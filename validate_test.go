@@ -0,0 +1,89 @@
+package certdepot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateOptionsValidate(t *testing.T) {
+	for testName, testCase := range map[string]struct {
+		op       CertificateOperation
+		opts     CertificateOptions
+		problems []string
+	}{
+		"ValidInit": {
+			op:   OperationInit,
+			opts: CertificateOptions{CommonName: "ca", Expires: time.Hour},
+		},
+		"InitIgnoresSignOptions": {
+			op:   OperationInit,
+			opts: CertificateOptions{CommonName: "ca", Intermediate: true, CA: "other"},
+		},
+		"InitWithoutCommonName": {
+			op:       OperationInit,
+			opts:     CertificateOptions{},
+			problems: []string{"common name"},
+		},
+		"ValidCertRequest": {
+			op: OperationCertRequest,
+			opts: CertificateOptions{
+				IP:     []string{"127.0.0.1", "::1"},
+				URI:    []string{"spiffe://example.com/service"},
+				Domain: []string{"service.example.com", "*.example.com", "service_internal"},
+			},
+		},
+		"CertRequestReturnsAllProblems": {
+			op: OperationCertRequest,
+			opts: CertificateOptions{
+				Host: "service",
+				IP:   []string{"256.0.0.1"},
+				URI:  []string{"not a uri"},
+			},
+			problems: []string{"common name or one of: domain, ip", "256.0.0.1", "not a uri"},
+		},
+		"CertRequestWithInvalidDomains": {
+			op:       OperationCertRequest,
+			opts:     CertificateOptions{Domain: []string{"bad domain", "a..b", "*", ""}},
+			problems: []string{"bad domain", "a..b", "'*'", "''"},
+		},
+		"ValidSign": {
+			op:   OperationSign,
+			opts: CertificateOptions{Host: "service", CA: "ca", Intermediate: true, MaxPathLen: 1},
+		},
+		"SignReturnsAllProblems": {
+			op: OperationSign,
+			opts: CertificateOptions{
+				Expires:           -time.Hour,
+				MaxPathLen:        1,
+				PolicyIdentifiers: []string{"not.an.oid"},
+			},
+			problems: []string{"host", "CA", "path length", "negative", "policies"},
+		},
+		"SignBelowMinimumExpiration": {
+			op:       OperationSign,
+			opts:     CertificateOptions{Host: "service", CA: "ca", Expires: time.Second},
+			problems: []string{"minimum"},
+		},
+		"UnknownOperation": {
+			op:       CertificateOperation("renew"),
+			opts:     CertificateOptions{CommonName: "ca"},
+			problems: []string{"unknown operation"},
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			err := testCase.opts.Validate(testCase.op)
+			if len(testCase.problems) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			for _, problem := range testCase.problems {
+				assert.True(t, strings.Contains(err.Error(), problem), "missing problem '%s' in: %s", problem, err)
+			}
+		})
+	}
+}
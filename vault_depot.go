@@ -0,0 +1,423 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// VaultAppRole are the credentials of a Vault AppRole used to log in to
+// Vault.
+type VaultAppRole struct {
+	// RoleID is the role ID of the AppRole.
+	RoleID string `bson:"role_id" json:"role_id" yaml:"role_id"`
+	// SecretID is the secret ID of the AppRole.
+	SecretID string `bson:"secret_id" json:"secret_id" yaml:"secret_id"`
+	// Mount is the path at which the AppRole auth method is mounted. It
+	// defaults to "approle".
+	Mount string `bson:"mount,omitempty" json:"mount,omitempty" yaml:"mount,omitempty"`
+}
+
+// VaultOptions describe how a Vault depot connects to Vault and where in the
+// KV secrets engine it stores its data.
+type VaultOptions struct {
+	// Address is the base URL of the Vault server, e.g.
+	// "https://vault.example.com:8200".
+	Address string `bson:"address" json:"address" yaml:"address"`
+	// Token is the Vault token used to authenticate. Exactly one of Token
+	// and AppRole must be set.
+	Token string `bson:"token,omitempty" json:"token,omitempty" yaml:"token,omitempty"`
+	// AppRole, if set, is used to log in to Vault for a token, which is
+	// renewed by logging in again once it expires.
+	AppRole *VaultAppRole `bson:"app_role,omitempty" json:"app_role,omitempty" yaml:"app_role,omitempty"`
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string `bson:"namespace,omitempty" json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	// Mount is the path at which the KV secrets engine is mounted. It
+	// defaults to "secret".
+	Mount string `bson:"mount,omitempty" json:"mount,omitempty" yaml:"mount,omitempty"`
+	// Path is the path within the secrets engine under which the depot's
+	// secrets are stored. It defaults to "certdepot".
+	Path string `bson:"path,omitempty" json:"path,omitempty" yaml:"path,omitempty"`
+	// KVVersion is the version of the KV secrets engine, either 1 or 2. It
+	// defaults to 2.
+	KVVersion int `bson:"kv_version,omitempty" json:"kv_version,omitempty" yaml:"kv_version,omitempty"`
+	// Client is the HTTP client used to make requests. If nil, a client
+	// with a default timeout is used.
+	Client *http.Client `bson:"-" json:"-" yaml:"-"`
+}
+
+// Validate checks that the options are valid and sets defaults.
+func (o *VaultOptions) Validate() error {
+	if o.Address == "" {
+		return errors.New("must specify Vault address")
+	}
+	if (o.Token == "") == (o.AppRole == nil) {
+		return errors.New("must specify exactly one of Vault token and AppRole")
+	}
+	if o.AppRole != nil && (o.AppRole.RoleID == "" || o.AppRole.SecretID == "") {
+		return errors.New("must specify AppRole role ID and secret ID")
+	}
+	if o.KVVersion == 0 {
+		o.KVVersion = 2
+	}
+	if o.KVVersion != 1 && o.KVVersion != 2 {
+		return errors.Errorf("unsupported KV secrets engine version %d", o.KVVersion)
+	}
+	if o.Mount = strings.Trim(o.Mount, "/"); o.Mount == "" {
+		o.Mount = "secret"
+	}
+	if o.Path = strings.Trim(o.Path, "/"); o.Path == "" {
+		o.Path = "certdepot"
+	}
+
+	return nil
+}
+
+// vaultError is an error returned by Vault.
+type vaultError struct {
+	StatusCode int
+	Errors     []string `json:"errors"`
+}
+
+func (e *vaultError) Error() string {
+	return fmt.Sprintf("Vault returned status %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// isVaultStatus returns whether the error was returned by Vault with the
+// given status code.
+func isVaultStatus(err error, code int) bool {
+	statusErr, ok := errors.Cause(err).(*vaultError)
+	return ok && statusErr.StatusCode == code
+}
+
+// vaultSecret is the data of a secret the depot stores in Vault. Data that is
+// not valid UTF-8 is base64-encoded, so PEM-encoded credentials remain
+// readable in Vault.
+type vaultSecret struct {
+	Data     string `json:"data"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// vaultStore is a CredentialStore backed by Vault's KV secrets engine. Each
+// kind of data for a name is a separate secret at "<path>/<name>/<kind>".
+type vaultStore struct {
+	ctx  context.Context
+	opts VaultOptions
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewVaultDepot returns a depot that stores certificates, keys, certificate
+// requests, and revocation lists in HashiCorp Vault's KV secrets engine,
+// so that private keys are kept in Vault rather than on disk or in a
+// database. Requests to Vault are made with the context.
+func NewVaultDepot(ctx context.Context, opts VaultOptions, depotOpts DepotOptions) (Depot, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid Vault options")
+	}
+
+	store := &vaultStore{ctx: ctx, opts: opts, token: opts.Token}
+	if opts.AppRole != nil {
+		if err := store.login(); err != nil {
+			return nil, errors.Wrap(err, "logging in to Vault")
+		}
+	}
+
+	return NewStoreDepot(store, depotOpts)
+}
+
+func (s *vaultStore) Get(name string, kind CredentialKind) ([]byte, error) {
+	secret := vaultSecret{}
+	if err := s.read(s.secretPath(name, kind), &secret); err != nil {
+		if isVaultStatus(err, http.StatusNotFound) {
+			return nil, errors.Errorf("%s for '%s' not found", kind, name)
+		}
+		return nil, errors.Wrapf(err, "reading %s for '%s'", kind, name)
+	}
+
+	if secret.Encoding == "base64" {
+		data, err := base64.StdEncoding.DecodeString(secret.Data)
+		return data, errors.Wrapf(err, "decoding %s for '%s'", kind, name)
+	}
+	return []byte(secret.Data), nil
+}
+
+func (s *vaultStore) Put(name string, kind CredentialKind, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+
+	secret := vaultSecret{Data: string(data)}
+	if !utf8.Valid(data) {
+		secret = vaultSecret{Data: base64.StdEncoding.EncodeToString(data), Encoding: "base64"}
+	}
+
+	return errors.Wrapf(s.write(s.secretPath(name, kind), secret), "writing %s for '%s'", kind, name)
+}
+
+func (s *vaultStore) Check(name string, kind CredentialKind) (bool, error) {
+	err := s.read(s.secretPath(name, kind), &vaultSecret{})
+	if isVaultStatus(err, http.StatusNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "checking %s for '%s'", kind, name)
+	}
+	return true, nil
+}
+
+func (s *vaultStore) Delete(name string, kind CredentialKind) error {
+	exists, err := s.Check(name, kind)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !exists {
+		return errors.Errorf("%s for '%s' not found", kind, name)
+	}
+
+	// Deleting the metadata of a KV version 2 secret deletes every version
+	// of it, rather than only marking the latest version as deleted.
+	path := s.secretPath(name, kind)
+	if s.opts.KVVersion == 2 {
+		path = s.metadataURL(path)
+	} else {
+		path = s.dataURL(path)
+	}
+	return errors.Wrapf(s.do(http.MethodDelete, path, nil, nil), "deleting %s for '%s'", kind, name)
+}
+
+// ListNames returns the sorted names that have data stored in Vault.
+func (s *vaultStore) ListNames() ([]string, error) {
+	listURL := s.dataURL(s.opts.Path)
+	if s.opts.KVVersion == 2 {
+		listURL = s.metadataURL(s.opts.Path)
+	}
+
+	resp := struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}{}
+	if err := s.do(http.MethodGet, listURL+"?list=true", nil, &resp); err != nil {
+		if isVaultStatus(err, http.StatusNotFound) {
+			return []string{}, nil
+		}
+		return nil, errors.Wrap(err, "listing secrets")
+	}
+
+	seen := map[string]bool{}
+	names := []string{}
+	for _, key := range resp.Data.Keys {
+		stored, err := url.PathUnescape(strings.TrimSuffix(key, "/"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unescaping secret name '%s'", key)
+		}
+		// Parameters are stored under the name with the parameter
+		// suffix, so they belong to the name without it.
+		name := getNameFromTag(PrivKeyTag(stored))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// secretPath returns the path of the secret for the name and kind within the
+// secrets engine.
+func (s *vaultStore) secretPath(name string, kind CredentialKind) string {
+	return s.opts.Path + "/" + url.PathEscape(name) + "/" + string(kind)
+}
+
+// dataURL returns the URL to read and write the secret at the path.
+func (s *vaultStore) dataURL(path string) string {
+	if s.opts.KVVersion == 2 {
+		return s.url(s.opts.Mount + "/data/" + path)
+	}
+	return s.url(s.opts.Mount + "/" + path)
+}
+
+// metadataURL returns the URL of the metadata of the KV version 2 secret at
+// the path.
+func (s *vaultStore) metadataURL(path string) string {
+	return s.url(s.opts.Mount + "/metadata/" + path)
+}
+
+func (s *vaultStore) url(path string) string {
+	return strings.TrimSuffix(s.opts.Address, "/") + "/v1/" + path
+}
+
+// read reads the secret at the path into the output.
+func (s *vaultStore) read(path string, output *vaultSecret) error {
+	if s.opts.KVVersion == 1 {
+		resp := struct {
+			Data *vaultSecret `json:"data"`
+		}{Data: output}
+		return s.do(http.MethodGet, s.dataURL(path), nil, &resp)
+	}
+
+	resp := struct {
+		Data struct {
+			Data *vaultSecret `json:"data"`
+		} `json:"data"`
+	}{}
+	resp.Data.Data = output
+	return s.do(http.MethodGet, s.dataURL(path), nil, &resp)
+}
+
+// write writes the secret to the path.
+func (s *vaultStore) write(path string, secret vaultSecret) error {
+	if s.opts.KVVersion == 1 {
+		return s.do(http.MethodPost, s.dataURL(path), secret, nil)
+	}
+	return s.do(http.MethodPost, s.dataURL(path), struct {
+		Data vaultSecret `json:"data"`
+	}{Data: secret}, nil)
+}
+
+// do makes an authenticated request to Vault, logging in again and retrying
+// once if the AppRole token has expired or been revoked.
+func (s *vaultStore) do(method, url string, input, output interface{}) error {
+	token, err := s.getToken()
+	if err != nil {
+		return errors.Wrap(err, "getting Vault token")
+	}
+	err = s.request(method, url, token, input, output)
+	if s.opts.AppRole == nil || !isVaultStatus(err, http.StatusForbidden) {
+		return err
+	}
+
+	if err = s.login(); err != nil {
+		return errors.Wrap(err, "logging in to Vault")
+	}
+	if token, err = s.getToken(); err != nil {
+		return errors.Wrap(err, "getting Vault token")
+	}
+	return s.request(method, url, token, input, output)
+}
+
+// getToken returns the token to authenticate with, logging in with the
+// AppRole if its token has expired.
+func (s *vaultStore) getToken() (string, error) {
+	s.mu.Lock()
+	expired := s.opts.AppRole != nil && !s.tokenExpiry.IsZero() && time.Now().After(s.tokenExpiry)
+	s.mu.Unlock()
+	if expired {
+		if err := s.login(); err != nil {
+			return "", errors.Wrap(err, "logging in to Vault")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token, nil
+}
+
+// login logs in to Vault with the AppRole and stores the token it returns.
+func (s *vaultStore) login() error {
+	mount := strings.Trim(s.opts.AppRole.Mount, "/")
+	if mount == "" {
+		mount = "approle"
+	}
+
+	resp := struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int64  `json:"lease_duration"`
+		} `json:"auth"`
+	}{}
+	err := s.request(http.MethodPost, s.url("auth/"+mount+"/login"), "", map[string]string{
+		"role_id":   s.opts.AppRole.RoleID,
+		"secret_id": s.opts.AppRole.SecretID,
+	}, &resp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return errors.New("Vault did not return a token")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = resp.Auth.ClientToken
+	s.tokenExpiry = time.Time{}
+	if resp.Auth.LeaseDuration > 0 {
+		// Log in again shortly before the token expires so that
+		// requests in flight do not fail.
+		lease := time.Duration(resp.Auth.LeaseDuration) * time.Second
+		s.tokenExpiry = time.Now().Add(lease - lease/10)
+	}
+
+	return nil
+}
+
+// request makes a request to Vault with the token and unmarshals the response
+// into the output.
+func (s *vaultStore) request(method, url, token string, input, output interface{}) error {
+	var body io.Reader
+	if input != nil {
+		data, err := json.Marshal(input)
+		if err != nil {
+			return errors.Wrap(err, "marshalling request body")
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(s.ctx, method, url, body)
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	if input != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if s.opts.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.opts.Namespace)
+	}
+
+	client := s.opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "making request")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "reading response body")
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		vaultErr := &vaultError{}
+		_ = json.Unmarshal(respBody, vaultErr)
+		vaultErr.StatusCode = resp.StatusCode
+		return errors.WithStack(vaultErr)
+	}
+	if output == nil || len(respBody) == 0 {
+		return nil
+	}
+
+	return errors.Wrap(json.Unmarshal(respBody, output), "unmarshalling response body")
+}
@@ -0,0 +1,201 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVault is an in-memory Vault server that supports the KV secrets engine
+// and AppRole logins.
+type fakeVault struct {
+	mu        sync.Mutex
+	kvVersion int
+	token     string
+	secrets   map[string]json.RawMessage
+	logins    int
+}
+
+func newFakeVault(kvVersion int) *fakeVault {
+	return &fakeVault{kvVersion: kvVersion, token: "root-token", secrets: map[string]json.RawMessage{}}
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/v1/")
+	if path == "auth/approle/login" {
+		creds := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil || creds["role_id"] != "role" || creds["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		v.logins++
+		v.token = "approle-token"
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": v.token, "lease_duration": 3600},
+		})
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != v.token {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+
+	var key string
+	switch {
+	case v.kvVersion == 2 && strings.HasPrefix(path, "secret/data/"):
+		key = strings.TrimPrefix(path, "secret/data/")
+	case v.kvVersion == 2 && strings.HasPrefix(path, "secret/metadata/"):
+		key = strings.TrimPrefix(path, "secret/metadata/")
+	case v.kvVersion == 1 && strings.HasPrefix(path, "secret/"):
+		key = strings.TrimPrefix(path, "secret/")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("list") == "true":
+		prefix := key + "/"
+		seen := map[string]bool{}
+		keys := []string{}
+		for stored := range v.secrets {
+			if !strings.HasPrefix(stored, prefix) {
+				continue
+			}
+			child := strings.TrimPrefix(stored, prefix)
+			if i := strings.Index(child, "/"); i >= 0 {
+				child = child[:i+1]
+			}
+			if !seen[child] {
+				seen[child] = true
+				keys = append(keys, child)
+			}
+		}
+		if len(keys) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Strings(keys)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+	case r.Method == http.MethodGet:
+		data, ok := v.secrets[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if v.kvVersion == 2 {
+			data, _ = json.Marshal(map[string]interface{}{"data": data})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	case r.Method == http.MethodPost:
+		body := map[string]json.RawMessage{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if v.kvVersion == 2 {
+			v.secrets[key] = body["data"]
+		} else {
+			v.secrets[key], _ = json.Marshal(body)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(v.secrets, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestVaultDepot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	depotOpts := DepotOptions{CA: ConformanceSuiteCA, DefaultExpiration: time.Hour}
+
+	for _, kvVersion := range []int{1, 2} {
+		t.Run(fmt.Sprintf("ConformanceKVVersion%d", kvVersion), func(t *testing.T) {
+			DepotConformanceSuite(t, func() Depot {
+				server := httptest.NewServer(newFakeVault(kvVersion))
+				t.Cleanup(server.Close)
+
+				d, err := NewVaultDepot(ctx, VaultOptions{Address: server.URL, Token: "root-token", KVVersion: kvVersion}, depotOpts)
+				require.NoError(t, err)
+				return d
+			})
+		})
+	}
+	t.Run("StoresDataAsSecrets", func(t *testing.T) {
+		vault := newFakeVault(2)
+		server := httptest.NewServer(vault)
+		defer server.Close()
+		d, err := NewVaultDepot(ctx, VaultOptions{Address: server.URL, Token: "root-token"}, depotOpts)
+		require.NoError(t, err)
+
+		require.NoError(t, d.Put(CrtTag("alice"), []byte("alice cert")))
+		require.NoError(t, d.Put(ParamTag("alice", "attestation"), []byte{0xff, 0x00}))
+		require.NoError(t, d.Put(CrtTag("bob smith"), []byte("bob cert")))
+		assert.Contains(t, vault.secrets, "certdepot/alice/cert")
+		assert.Equal(t, `{"data":"alice cert"}`, string(vault.secrets["certdepot/alice/cert"]))
+
+		data, err := d.Get(ParamTag("alice", "attestation"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0xff, 0x00}, data)
+
+		names, err := d.(NameLister).ListNames()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"alice", "bob smith"}, names)
+
+		require.NoError(t, d.Delete(CrtTag("alice")))
+		assert.False(t, d.Check(CrtTag("alice")))
+		assert.Error(t, d.Delete(CrtTag("alice")))
+	})
+	t.Run("LogsInWithAppRole", func(t *testing.T) {
+		vault := newFakeVault(2)
+		server := httptest.NewServer(vault)
+		defer server.Close()
+		d, err := NewVaultDepot(ctx, VaultOptions{
+			Address: server.URL,
+			AppRole: &VaultAppRole{RoleID: "role", SecretID: "secret"},
+		}, depotOpts)
+		require.NoError(t, err)
+		require.NoError(t, d.Put(CrtTag("alice"), []byte("alice cert")))
+		assert.Equal(t, 1, vault.logins)
+
+		vault.token = "revoked"
+		assert.True(t, d.Check(CrtTag("alice")))
+		assert.Equal(t, 2, vault.logins)
+
+		_, err = NewVaultDepot(ctx, VaultOptions{
+			Address: server.URL,
+			AppRole: &VaultAppRole{RoleID: "role", SecretID: "wrong"},
+		}, depotOpts)
+		assert.Error(t, err)
+	})
+	t.Run("RejectsInvalidOptions", func(t *testing.T) {
+		for _, opts := range []VaultOptions{
+			{Token: "token"},
+			{Address: "http://localhost:8200"},
+			{Address: "http://localhost:8200", Token: "token", AppRole: &VaultAppRole{RoleID: "role", SecretID: "secret"}},
+			{Address: "http://localhost:8200", AppRole: &VaultAppRole{RoleID: "role"}},
+			{Address: "http://localhost:8200", Token: "token", KVVersion: 3},
+		} {
+			_, err := NewVaultDepot(ctx, opts, depotOpts)
+			assert.Error(t, err)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package certdepot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+)
+
+// VaultPKISigner is a Signer that delegates signing to a HashiCorp Vault PKI
+// secrets engine, so that the CA's private key never leaves Vault. The depot
+// still stores and distributes the signed certificates; the Vault CA's
+// certificate should be stored in the depot under the depot's CA name or
+// imported with ImportTrustedCA so that clients can verify them.
+type VaultPKISigner struct {
+	// Address is the base URL of the Vault server, e.g.
+	// "https://vault.example.com:8200".
+	Address string
+	// Token is the Vault token used to authenticate.
+	Token string
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string
+	// Mount is the path at which the PKI secrets engine is mounted. It
+	// defaults to "pki".
+	Mount string
+	// Role is the PKI role to sign with. It is required unless Verbatim is
+	// set.
+	Role string
+	// Verbatim signs with the sign-verbatim endpoint, which keeps the
+	// subject and extensions of the CSR instead of applying the role's.
+	Verbatim bool
+	// Header contains additional headers to send with each request.
+	Header http.Header
+	// Client is the HTTP client used to make requests. If nil, a client
+	// with a default timeout is used.
+	Client *http.Client
+}
+
+type vaultPKISignRequest struct {
+	CSR        string `json:"csr"`
+	CommonName string `json:"common_name,omitempty"`
+	AltNames   string `json:"alt_names,omitempty"`
+	IPSANs     string `json:"ip_sans,omitempty"`
+	URISANs    string `json:"uri_sans,omitempty"`
+	TTL        string `json:"ttl,omitempty"`
+	Format     string `json:"format"`
+}
+
+type vaultPKISignResponse struct {
+	Data struct {
+		Certificate string `json:"certificate"`
+	} `json:"data"`
+}
+
+// Validate checks that the signer is configured.
+func (s *VaultPKISigner) Validate() error {
+	if s.Address == "" {
+		return errors.New("must specify Vault address")
+	}
+	if s.Token == "" {
+		return errors.New("must specify Vault token")
+	}
+	if s.Role == "" && !s.Verbatim {
+		return errors.New("must specify PKI role unless signing verbatim")
+	}
+
+	return nil
+}
+
+// Sign sends the certificate request to the Vault PKI secrets engine and
+// returns the certificate it issues.
+func (s *VaultPKISigner) Sign(ctx context.Context, csr *pkix.CertificateSigningRequest, req IssuanceRequest) (*pkix.Certificate, error) {
+	if err := s.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid Vault PKI signer")
+	}
+
+	csrPEM, err := csr.Export()
+	if err != nil {
+		return nil, errors.Wrap(err, "exporting certificate signing request")
+	}
+
+	body := vaultPKISignRequest{
+		CSR:        string(csrPEM),
+		CommonName: req.CommonName,
+		AltNames:   strings.Join(req.Domain, ","),
+		IPSANs:     strings.Join(req.IP, ","),
+		URISANs:    strings.Join(req.URI, ","),
+		Format:     "pem",
+	}
+	if req.Expires > 0 {
+		body.TTL = fmt.Sprintf("%ds", int64(req.Expires.Seconds()))
+	}
+
+	header := http.Header{}
+	for key, values := range s.Header {
+		header[key] = values
+	}
+	header.Set("X-Vault-Token", s.Token)
+	if s.Namespace != "" {
+		header.Set("X-Vault-Namespace", s.Namespace)
+	}
+
+	resp := vaultPKISignResponse{}
+	if err = postJSON(ctx, s.Client, s.signURL(req), header, body, &resp); err != nil {
+		return nil, errors.Wrap(err, "requesting signature from Vault")
+	}
+	if resp.Data.Certificate == "" {
+		return nil, errors.New("Vault did not return a certificate")
+	}
+
+	crt, err := pkix.NewCertificateFromPEM([]byte(resp.Data.Certificate))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing certificate from Vault")
+	}
+
+	return crt, nil
+}
+
+// signURL returns the URL of the PKI endpoint that signs the request.
+func (s *VaultPKISigner) signURL(req IssuanceRequest) string {
+	mount := strings.Trim(s.Mount, "/")
+	if mount == "" {
+		mount = "pki"
+	}
+
+	var endpoint string
+	switch {
+	case req.Intermediate:
+		endpoint = "root/sign-intermediate"
+	case s.Verbatim && s.Role != "":
+		endpoint = "sign-verbatim/" + s.Role
+	case s.Verbatim:
+		endpoint = "sign-verbatim"
+	default:
+		endpoint = "sign/" + s.Role
+	}
+
+	return fmt.Sprintf("%s/v1/%s/%s", strings.TrimSuffix(s.Address, "/"), mount, endpoint)
+}
@@ -0,0 +1,135 @@
+package certdepot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultPKISigner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	caKey, err := pkix.CreateRSAKey(2048)
+	require.NoError(t, err)
+	caCrt, err := pkix.CreateCertificateAuthority(caKey, "", time.Now().Add(time.Hour), "", "", "", "", "vault-root", nil)
+	require.NoError(t, err)
+
+	newVaultServer := func(t *testing.T, path string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, path, r.URL.Path)
+			assert.Equal(t, "token", r.Header.Get("X-Vault-Token"))
+			assert.Equal(t, "ns", r.Header.Get("X-Vault-Namespace"))
+
+			req := vaultPKISignRequest{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, "pem", req.Format)
+			csr, err := pkix.NewCertificateSigningRequestFromPEM([]byte(req.CSR))
+			require.NoError(t, err)
+			crt, err := pkix.CreateCertificateHost(caCrt, caKey, csr, time.Now().Add(time.Hour))
+			require.NoError(t, err)
+			crtPEM, err := crt.Export()
+			require.NoError(t, err)
+
+			resp := vaultPKISignResponse{}
+			resp.Data.Certificate = string(crtPEM)
+			assert.NoError(t, json.NewEncoder(w).Encode(resp))
+		}))
+	}
+
+	t.Run("SignsCertificatesForDepot", func(t *testing.T) {
+		srv := newVaultServer(t, "/v1/pki_int/sign/service")
+		defer srv.Close()
+
+		tempDir, err := ioutil.TempDir(".", "vault-pki-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		}()
+		d, err := MakeFileDepot(tempDir, DepotOptions{
+			CA:                "vault-root",
+			DefaultExpiration: time.Hour,
+			Signer: &VaultPKISigner{
+				Address:   srv.URL + "/",
+				Token:     "token",
+				Namespace: "ns",
+				Mount:     "/pki_int/",
+				Role:      "service",
+			},
+		})
+		require.NoError(t, err)
+
+		opts := CertificateOptions{
+			CommonName: "alice",
+			Host:       "alice",
+			CA:         "vault-root",
+			Expires:    time.Hour,
+		}
+		require.NoError(t, opts.CreateCertificate(d))
+
+		crt, err := getRawCertificate(d, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", crt.Subject.CommonName)
+		assert.Equal(t, "vault-root", crt.Issuer.CommonName)
+		assert.True(t, CheckPrivateKey(d, "alice"))
+		assert.False(t, CheckPrivateKey(d, "vault-root"))
+	})
+	t.Run("SignsVerbatim", func(t *testing.T) {
+		srv := newVaultServer(t, "/v1/pki/sign-verbatim")
+		defer srv.Close()
+
+		key, err := pkix.CreateRSAKey(2048)
+		require.NoError(t, err)
+		csr, err := pkix.CreateCertificateSigningRequest(key, "", nil, nil, nil, "", "", "", "", "bob")
+		require.NoError(t, err)
+
+		signer := &VaultPKISigner{
+			Address:   srv.URL,
+			Token:     "token",
+			Namespace: "ns",
+			Verbatim:  true,
+		}
+		crt, err := signer.Sign(ctx, csr, IssuanceRequest{Name: "bob", CommonName: "bob"})
+		require.NoError(t, err)
+		rawCrt, err := crt.GetRawCertificate()
+		require.NoError(t, err)
+		assert.Equal(t, "bob", rawCrt.Subject.CommonName)
+	})
+	t.Run("FailsWithErrorStatus", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer srv.Close()
+
+		key, err := pkix.CreateRSAKey(2048)
+		require.NoError(t, err)
+		csr, err := pkix.CreateCertificateSigningRequest(key, "", nil, nil, nil, "", "", "", "", "carol")
+		require.NoError(t, err)
+
+		signer := &VaultPKISigner{Address: srv.URL, Token: "token", Role: "service"}
+		_, err = signer.Sign(ctx, csr, IssuanceRequest{Name: "carol"})
+		assert.Error(t, err)
+	})
+	t.Run("Validate", func(t *testing.T) {
+		assert.Error(t, (&VaultPKISigner{Token: "token", Role: "service"}).Validate())
+		assert.Error(t, (&VaultPKISigner{Address: "http://localhost:8200", Role: "service"}).Validate())
+		assert.Error(t, (&VaultPKISigner{Address: "http://localhost:8200", Token: "token"}).Validate())
+		assert.NoError(t, (&VaultPKISigner{Address: "http://localhost:8200", Token: "token", Verbatim: true}).Validate())
+	})
+	t.Run("SignURL", func(t *testing.T) {
+		signer := &VaultPKISigner{Address: "http://localhost:8200", Role: "service"}
+		assert.Equal(t, "http://localhost:8200/v1/pki/sign/service", signer.signURL(IssuanceRequest{}))
+		assert.Equal(t, "http://localhost:8200/v1/pki/root/sign-intermediate", signer.signURL(IssuanceRequest{Intermediate: true}))
+		signer.Verbatim = true
+		assert.Equal(t, "http://localhost:8200/v1/pki/sign-verbatim/service", signer.signURL(IssuanceRequest{}))
+	})
+}
@@ -0,0 +1,216 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
+)
+
+// VerifyReport contains the results of verifying the integrity of every entry
+// in a depot.
+type VerifyReport struct {
+	// Entries contains the verification results for each name in the depot.
+	Entries []VerifyEntry `bson:"entries" json:"entries" yaml:"entries"`
+}
+
+// VerifyEntry contains the verification results for a single name in a depot.
+type VerifyEntry struct {
+	// Name is the name of the depot entry.
+	Name string `bson:"name" json:"name" yaml:"name"`
+	// IsCA is whether the entry's certificate is a certificate authority.
+	IsCA bool `bson:"is_ca" json:"is_ca" yaml:"is_ca"`
+	// Purpose is what the entry's certificate is used for, if known (see
+	// GetCertificatePurpose).
+	Purpose CertificatePurpose `bson:"purpose,omitempty" json:"purpose,omitempty" yaml:"purpose,omitempty"`
+	// Expired is whether the entry's certificate has expired. Expiration is
+	// not considered a problem with the entry.
+	Expired bool `bson:"expired" json:"expired" yaml:"expired"`
+	// Problems describes each integrity issue found with the entry.
+	Problems []string `bson:"problems,omitempty" json:"problems,omitempty" yaml:"problems,omitempty"`
+}
+
+// HasProblems returns whether any entry in the report has problems.
+func (r *VerifyReport) HasProblems() bool {
+	for _, entry := range r.Entries {
+		if len(entry.Problems) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Problems returns only the entries in the report that have problems.
+func (r *VerifyReport) Problems() []VerifyEntry {
+	entries := []VerifyEntry{}
+	for _, entry := range r.Entries {
+		if len(entry.Problems) != 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// VerifyDepot walks every entry in the depot and checks that the stored
+// certificates, keys, certificate requests, and revocation lists are parseable
+// PEM, that each certificate matches its private key, that each certificate
+// chains to a CA stored in the depot, and that any TTL tracked by the depot is
+// consistent with the certificate's expiration. The depot must implement
+// NameLister. An error is only returned if the depot cannot be walked;
+// problems with individual entries are recorded in the report.
+func VerifyDepot(ctx context.Context, wd Depot) (*VerifyReport, error) {
+	lister, ok := wd.(NameLister)
+	if !ok {
+		return nil, errors.New("depot does not support listing entries")
+	}
+
+	names, err := lister.ListNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing depot entries")
+	}
+
+	certs := map[string]*x509.Certificate{}
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	entries := make([]VerifyEntry, 0, len(names))
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Wrap(err, "verifying depot")
+		}
+
+		entry, crt := verifyEntry(wd, name)
+		if crt != nil {
+			certs[name] = crt
+			entry.IsCA = crt.IsCA
+			entry.Purpose = certificatePurpose(crt)
+			entry.Expired = time.Now().After(crt.NotAfter)
+			if crt.IsCA {
+				if isSelfSigned(crt) {
+					roots.AddCert(crt)
+				} else {
+					intermediates.AddCert(crt)
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	for i := range entries {
+		crt, ok := certs[entries[i].Name]
+		if !ok {
+			continue
+		}
+		if _, err := crt.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   crt.NotBefore,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			entries[i].Problems = append(entries[i].Problems, fmt.Sprintf("certificate does not chain to a CA in the depot: %s", err))
+		}
+	}
+
+	return &VerifyReport{Entries: entries}, nil
+}
+
+func verifyEntry(wd Depot, name string) (VerifyEntry, *x509.Certificate) {
+	entry := VerifyEntry{Name: name}
+	addProblem := func(format string, args ...interface{}) {
+		entry.Problems = append(entry.Problems, fmt.Sprintf(format, args...))
+	}
+
+	var crt *x509.Certificate
+	certPEM, err := getIfExists(wd, CrtTag(name))
+	if err != nil {
+		addProblem("getting certificate: %s", err)
+	} else if certPEM != nil {
+		var pkixCrt *pkix.Certificate
+		pkixCrt, err = pkix.NewCertificateFromPEM(certPEM)
+		if err == nil {
+			crt, err = pkixCrt.GetRawCertificate()
+		}
+		if err != nil {
+			addProblem("parsing certificate: %s", err)
+		}
+	}
+
+	keyPEM, err := getIfExists(wd, PrivKeyTag(name))
+	if err != nil {
+		addProblem("getting private key: %s", err)
+	} else if keyPEM != nil && !isEncryptedPEM(keyPEM) {
+		// Encrypted keys cannot be parsed or matched against the
+		// certificate without the passphrase.
+		if _, err = pkix.NewKeyFromPrivateKeyPEM(keyPEM); err != nil {
+			addProblem("parsing private key: %s", err)
+		} else if crt != nil {
+			if _, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+				addProblem("certificate does not match private key: %s", err)
+			}
+		}
+	}
+
+	csrPEM, err := getIfExists(wd, CsrTag(name))
+	if err != nil {
+		addProblem("getting certificate signing request: %s", err)
+	} else if csrPEM != nil {
+		if _, err = pkix.NewCertificateSigningRequestFromPEM(csrPEM); err != nil {
+			addProblem("parsing certificate signing request: %s", err)
+		}
+	}
+
+	crlPEM, err := getIfExists(wd, CrlTag(name))
+	if err != nil {
+		addProblem("getting certificate revocation list: %s", err)
+	} else if crlPEM != nil {
+		if _, err = pkix.NewCertificateRevocationListFromPEM(crlPEM); err != nil {
+			addProblem("parsing certificate revocation list: %s", err)
+		}
+	}
+
+	if tg, ok := wd.(ExpiryTracker); ok && crt != nil {
+		// Entries without a TTL, such as imported trusted CAs, never
+		// expire from the depot and so cannot be inconsistent.
+		ttl, err := tg.GetTTL(name)
+		if err != nil {
+			addProblem("getting TTL: %s", err)
+		} else if diff := ttl.Sub(crt.NotAfter); !ttl.IsZero() && (diff > time.Second || diff < -time.Second) {
+			addProblem("TTL %s does not match certificate expiration %s", ttl, crt.NotAfter)
+		}
+	}
+
+	return entry, crt
+}
+
+// getIfExists returns the data for the tag, or nil if the tag does not exist
+// in the depot.
+func getIfExists(wd Depot, tag *depot.Tag) ([]byte, error) {
+	exists, err := wd.CheckWithError(tag)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	data, err := wd.Get(tag)
+	return data, errors.WithStack(err)
+}
+
+func isEncryptedPEM(data []byte) bool {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false
+	}
+	return block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED")
+}
+
+func isSelfSigned(crt *x509.Certificate) bool {
+	return crt.CheckSignatureFrom(crt) == nil
+}
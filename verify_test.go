@@ -0,0 +1,198 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestVerifyDepot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const (
+		databaseName   = "certDepot"
+		collectionName = "verify"
+	)
+	connctx, connCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer connCancel()
+	client, err := mongo.Connect(connctx, options.Client().ApplyURI(testMongoDBURI()))
+	require.NoError(t, err)
+
+	serviceOpts := &CertificateOptions{
+		CommonName: "localhost",
+		Host:       "localhost",
+		CA:         "root",
+		Expires:    time.Hour,
+	}
+	caOpts := &CertificateOptions{
+		CommonName: "root",
+		Expires:    time.Hour,
+	}
+
+	testCases := map[string]func(t *testing.T, d Depot){
+		"SucceedsWithBootstrappedDepot": func(t *testing.T, d Depot) {
+			report, err := VerifyDepot(ctx, d)
+			require.NoError(t, err)
+			assert.False(t, report.HasProblems())
+			assert.Empty(t, report.Problems())
+			require.Len(t, report.Entries, 2)
+			assert.Equal(t, "localhost", report.Entries[0].Name)
+			assert.False(t, report.Entries[0].IsCA)
+			assert.Equal(t, "root", report.Entries[1].Name)
+			assert.True(t, report.Entries[1].IsCA)
+		},
+		"ReportsUnparseableData": func(t *testing.T, d Depot) {
+			require.NoError(t, d.Put(CrtTag("bob"), []byte("bob's fake certificate")))
+			require.NoError(t, d.Put(CsrTag("bob"), []byte("bob's fake certificate request")))
+
+			report, err := VerifyDepot(ctx, d)
+			require.NoError(t, err)
+			assert.True(t, report.HasProblems())
+			problems := report.Problems()
+			require.Len(t, problems, 1)
+			assert.Equal(t, "bob", problems[0].Name)
+			assert.Len(t, problems[0].Problems, 2)
+		},
+		"ReportsMismatchedKey": func(t *testing.T, d Depot) {
+			key, err := d.Get(PrivKeyTag("root"))
+			require.NoError(t, err)
+			require.NoError(t, d.Delete(PrivKeyTag("localhost")))
+			require.NoError(t, d.Put(PrivKeyTag("localhost"), key))
+
+			report, err := VerifyDepot(ctx, d)
+			require.NoError(t, err)
+			problems := report.Problems()
+			require.Len(t, problems, 1)
+			assert.Equal(t, "localhost", problems[0].Name)
+		},
+		"ReportsCertificateWithoutCA": func(t *testing.T, d Depot) {
+			opts := CertificateOptions{
+				CommonName: "other",
+				Expires:    time.Hour,
+			}
+			require.NoError(t, opts.Init(d))
+			otherOpts := CertificateOptions{
+				CommonName: "alice",
+				Host:       "alice",
+				CA:         "other",
+				Expires:    time.Hour,
+			}
+			require.NoError(t, otherOpts.CreateCertificate(d))
+			require.NoError(t, DeleteCA(ctx, d, "other", DeleteCAOptions{Force: true}))
+
+			report, err := VerifyDepot(ctx, d)
+			require.NoError(t, err)
+			problems := report.Problems()
+			require.Len(t, problems, 1)
+			assert.Equal(t, "alice", problems[0].Name)
+		},
+		"FailsWithCanceledContext": func(t *testing.T, d Depot) {
+			cctx, ccancel := context.WithCancel(ctx)
+			ccancel()
+			report, err := VerifyDepot(cctx, d)
+			assert.Error(t, err)
+			assert.Nil(t, report)
+		},
+	}
+
+	for _, impl := range []struct {
+		name      string
+		bootstrap func(t *testing.T) (Depot, func())
+		tests     map[string]func(t *testing.T, d Depot)
+	}{
+		{
+			name: "File",
+			bootstrap: func(t *testing.T) (Depot, func()) {
+				tempDir, err := ioutil.TempDir(".", "verify-test")
+				require.NoError(t, err)
+
+				d, err := BootstrapDepot(ctx, BootstrapDepotConfig{
+					FileDepot:   tempDir,
+					CAName:      "root",
+					CAOpts:      caOpts,
+					ServiceName: "localhost",
+					ServiceOpts: serviceOpts,
+				})
+				require.NoError(t, err)
+
+				return d, func() {
+					assert.NoError(t, os.RemoveAll(tempDir))
+				}
+			},
+		},
+		{
+			name: "MongoDB",
+			bootstrap: func(t *testing.T) (Depot, func()) {
+				d, err := BootstrapDepotWithMongoClient(ctx, client, BootstrapDepotConfig{
+					MongoDepot: &MongoDBOptions{
+						DatabaseName:   databaseName,
+						CollectionName: collectionName,
+					},
+					CAName:      "root",
+					CAOpts:      caOpts,
+					ServiceName: "localhost",
+					ServiceOpts: serviceOpts,
+				})
+				require.NoError(t, err)
+
+				return d, func() {
+					assert.NoError(t, client.Database(databaseName).Collection(collectionName).Drop(ctx))
+				}
+			},
+			tests: map[string]func(t *testing.T, d Depot){
+				"ReportsMismatchedTTL": func(t *testing.T, d Depot) {
+					md, ok := d.(*mongoDepot)
+					require.True(t, ok)
+					notBefore, _, err := ValidityBounds(md, "localhost")
+					require.NoError(t, err)
+					require.NoError(t, md.PutTTL("localhost", notBefore.Add(time.Minute)))
+
+					report, err := VerifyDepot(ctx, d)
+					require.NoError(t, err)
+					problems := report.Problems()
+					require.Len(t, problems, 1)
+					assert.Equal(t, "localhost", problems[0].Name)
+				},
+				"IgnoresEntriesWithoutTTL": func(t *testing.T, d Depot) {
+					caCert, err := d.Get(CrtTag("root"))
+					require.NoError(t, err)
+					require.NoError(t, ImportTrustedCA(d, "other_root", caCert))
+
+					report, err := VerifyDepot(ctx, d)
+					require.NoError(t, err)
+					assert.False(t, report.HasProblems())
+					assert.Len(t, report.Entries, 3)
+				},
+			},
+		},
+	} {
+		t.Run(impl.name, func(t *testing.T) {
+			tests := map[string]func(t *testing.T, d Depot){}
+			for name, test := range testCases {
+				tests[name] = test
+			}
+			for name, test := range impl.tests {
+				tests[name] = test
+			}
+
+			for testName, testCase := range tests {
+				t.Run(testName, func(t *testing.T) {
+					caOpts.Reset()
+					serviceOpts.Reset()
+					d, cleanup := impl.bootstrap(t)
+					defer cleanup()
+
+					testCase(t, d)
+				})
+			}
+		})
+	}
+}
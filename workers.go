@@ -0,0 +1,71 @@
+package certdepot
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// WorkerPoolOptions configure how many operations a bulk operation, such as
+// BulkImport or Reconcile, runs at once, so that operators can trade off how
+// long the operation takes against the load it puts on the depot's backend.
+type WorkerPoolOptions struct {
+	// Workers is the number of operations run at once. It defaults to one,
+	// which runs them one at a time.
+	Workers int `bson:"workers,omitempty" json:"workers,omitempty" yaml:"workers,omitempty"`
+}
+
+// Validate checks that the options are valid and sets defaults.
+func (opts *WorkerPoolOptions) Validate() error {
+	if opts.Workers < 0 {
+		return errors.New("workers cannot be negative")
+	}
+	if opts.Workers == 0 {
+		opts.Workers = 1
+	}
+	return nil
+}
+
+// forEachParallel calls fn for each index up to n with the workers, returning
+// the error of each call by index. Once the context is done, no more calls are
+// started, and the context's error is returned along with the errors of the
+// calls that were made; calls that were not made have no error. Calls in
+// progress are passed the context so that they can stop early.
+func forEachParallel(ctx context.Context, opts WorkerPoolOptions, n int, fn func(ctx context.Context, i int) error) ([]error, error) {
+	errs := make([]error, n)
+	workers := opts.Workers
+	if workers > n {
+		workers = n
+	}
+
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = fn(ctx, i)
+			}
+		}()
+	}
+
+	var ctxErr error
+dispatch:
+	for i := 0; i < n; i++ {
+		if ctxErr = ctx.Err(); ctxErr != nil {
+			break
+		}
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	return errs, errors.WithStack(ctxErr)
+}
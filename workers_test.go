@@ -0,0 +1,59 @@
+package certdepot
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForEachParallel(t *testing.T) {
+	t.Run("LimitsWorkers", func(t *testing.T) {
+		var running, maxRunning int64
+		errs, err := forEachParallel(context.TODO(), WorkerPoolOptions{Workers: 3}, 20, func(_ context.Context, i int) error {
+			n := atomic.AddInt64(&running, 1)
+			defer atomic.AddInt64(&running, -1)
+			for {
+				max := atomic.LoadInt64(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt64(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			if i%5 == 0 {
+				return errors.New("failed")
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Len(t, errs, 20)
+		for i, err := range errs {
+			assert.Equal(t, i%5 == 0, err != nil, "index %d", i)
+		}
+		assert.True(t, maxRunning <= 3)
+	})
+	t.Run("StopsWhenContextIsDone", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var calls int64
+		_, err := forEachParallel(ctx, WorkerPoolOptions{Workers: 2}, 100, func(ctx context.Context, i int) error {
+			if atomic.AddInt64(&calls, 1) == 2 {
+				cancel()
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		assert.Error(t, err)
+		assert.True(t, atomic.LoadInt64(&calls) < 100)
+	})
+	t.Run("ValidatesOptions", func(t *testing.T) {
+		opts := WorkerPoolOptions{}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, 1, opts.Workers)
+		opts.Workers = -1
+		assert.Error(t, opts.Validate())
+	})
+}
@@ -0,0 +1,81 @@
+package certdepot
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"math/big"
+)
+
+// zeroBytes overwrites the data with zeroes so that private key material does
+// not linger in memory after it is no longer needed.
+func zeroBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// zeroPrivateKey overwrites the secret values of the parsed private key with
+// zeroes. It is best effort: keys of unknown types, such as remote signers,
+// are left alone, and copies made by the standard library, such as the
+// precomputed values it caches for RSA keys, cannot be reached. The key cannot
+// be used afterwards.
+func zeroPrivateKey(key interface{}) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		zeroBigInts(k.D, k.Precomputed.Dp, k.Precomputed.Dq, k.Precomputed.Qinv)
+		zeroBigInts(k.Primes...)
+		for _, crt := range k.Precomputed.CRTValues {
+			zeroBigInts(crt.Exp, crt.Coeff, crt.R)
+		}
+	case *ecdsa.PrivateKey:
+		zeroBigInts(k.D)
+	case ed25519.PrivateKey:
+		zeroBytes(k)
+	case *ed25519.PrivateKey:
+		if k != nil {
+			zeroBytes(*k)
+		}
+	}
+}
+
+func zeroBigInts(ints ...*big.Int) {
+	for _, i := range ints {
+		if i == nil {
+			continue
+		}
+		words := i.Bits()
+		for j := range words {
+			words[j] = 0
+		}
+		i.SetInt64(0)
+	}
+}
+
+// Zero overwrites the credentials' private key, as well as the key held by
+// the bundle cached by Bundle, with zeroes and removes them from the
+// credentials, so that the key does not linger in memory once the credentials
+// have been saved or loaded into a TLS configuration. It is best effort, since
+// copies of the key made elsewhere, such as by the TLS configuration or a
+// depot's database driver, cannot be reached. The credentials cannot be used
+// to authenticate afterwards, and bundles previously returned by Bundle are
+// zeroed as well.
+func (c *Credentials) Zero() {
+	if c == nil {
+		return
+	}
+
+	zeroBytes(c.Key)
+	c.Key = nil
+	if c.bundle != nil {
+		zeroBytes(c.bundle.KeyDER)
+		c.bundle.KeyDER = nil
+		// The bundle's signer is the credentials' own Signer if there is
+		// one, which is not the credentials' to zero.
+		if c.Signer == nil {
+			zeroPrivateKey(c.bundle.Signer)
+		}
+		c.bundle.Signer = nil
+		c.bundle = nil
+	}
+}